@@ -0,0 +1,363 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"facebookexperimental/moq-go-server/moqclient"
+	"facebookexperimental/moq-go-server/moqdebug"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default values
+const RELAY_URL = "https://localhost:4433/moq"
+const NAMESPACE_PREFIX = "load"
+const TRACK_NAME = "video"
+const PUBLISHERS = 1
+const SUBSCRIBERS = 10
+const OBJECTS_PER_SEC = 30
+const OBJECT_SIZE = 4 * 1024
+const GROUP_DURATION_MS = 2000
+const RAMP_UP_MS = 5 * 1000
+const DURATION_MS = 30 * 1000
+const STATS_PERIOD_MS = 5 * 1000
+const LOG_LEVEL = "info"
+
+// Object streams read in parallel per subscriber
+const LOADGEN_SUBSCRIBER_READERS = 4
+
+// Timeout of the relay runtime requests
+const LOADGEN_RELAY_DEBUG_TIMEOUT_MS = 2000
+
+type loadGenConfig struct {
+	clientConfig    moqclient.MoqClientConfig
+	authInfo        string
+	objectsPerSec   uint64
+	objectSize      uint64
+	groupDurationMs uint64
+}
+
+// Counters of all the sessions
+type loadGenStats struct {
+	pubSessions   atomic.Int64
+	subSessions   atomic.Int64
+	failedConns   atomic.Uint64
+	droppedConns  atomic.Uint64
+	sentObjs      atomic.Uint64
+	sentBytes     atomic.Uint64
+	recvObjs      atomic.Uint64
+	recvBytes     atomic.Uint64
+	periodLatency *moqclient.MoqLatencyStats
+	totalLatency  *moqclient.MoqLatencyStats
+}
+
+// Relay CPU / memory, read from its /debug/runtime
+type relayRuntimeStats struct {
+	last          *moqdebug.MoqDebugRuntime
+	lastAt        time.Time
+	maxGoroutines int
+	maxHeapInuse  uint64
+	maxCpuPercent float64
+}
+
+func main() {
+	relayUrl := flag.String("url", RELAY_URL, "Relay WebTransport endpoint")
+	certPath := flag.String("cert", "", "PEM certificate (or CA) to trust besides the system ones, ex: the relay self-signed one")
+	insecure := flag.Bool("insecure", false, "Skip the relay certificate verification (local testing only)")
+	namespacePrefix := flag.String("namespace_prefix", NAMESPACE_PREFIX, "Publisher N announces the namespace [prefix]-N (track "+TRACK_NAME+")")
+	authInfo := flag.String("auth_info", "", "Auth info sent in the ANNOUNCEs and SUBSCRIBEs")
+	publishers := flag.Uint64("publishers", PUBLISHERS, "Publisher sessions, every one announces its own namespace")
+	subscribers := flag.Uint64("subscribers", SUBSCRIBERS, "Subscriber sessions, spread evenly across the publishers")
+	objectsPerSec := flag.Uint64("objects_per_sec", OBJECTS_PER_SEC, "Objects published per second (per publisher)")
+	objectSize := flag.Uint64("object_size", OBJECT_SIZE, "Payload size of every object (in bytes)")
+	groupDurationMs := flag.Uint64("group_duration_ms", GROUP_DURATION_MS, "A new group starts every this time (in milliseconds)")
+	rampUpMs := flag.Uint64("ramp_up_ms", RAMP_UP_MS, "Time to start all the sessions, spread evenly (in milliseconds)")
+	durationMs := flag.Uint64("duration_ms", DURATION_MS, "Test duration after the ramp up, 0 runs until ctrl+C (in milliseconds)")
+	statsPeriodMs := flag.Uint64("stats_period_ms", STATS_PERIOD_MS, "Period of the stats logs (in milliseconds)")
+	relayDebugUrl := flag.String("relay_debug_url", "", "Relay runtime endpoint to report its CPU / memory usage, relay started with --debug_addr (example: \"http://127.0.0.1:6060/debug/runtime\"), empty disables it")
+	logLevel := flag.String("log_level", LOG_LEVEL, "Log level (panic, fatal, error, warn, info, debug, trace)")
+	flag.Parse()
+
+	level, errLevel := log.ParseLevel(*logLevel)
+	if errLevel != nil {
+		log.Fatal(fmt.Sprintf("Invalid log level: %s", *logLevel))
+	}
+	log.SetLevel(level)
+	if *publishers <= 0 || *objectsPerSec <= 0 || *statsPeriodMs <= 0 {
+		log.Fatal("publishers, objects_per_sec and stats_period_ms have to be greater than 0")
+	}
+
+	config := loadGenConfig{
+		clientConfig:    moqclient.MoqClientConfig{Url: *relayUrl, CertPath: *certPath, Insecure: *insecure},
+		authInfo:        *authInfo,
+		objectsPerSec:   *objectsPerSec,
+		objectSize:      *objectSize,
+		groupDurationMs: *groupDurationMs,
+	}
+	stats := &loadGenStats{periodLatency: moqclient.NewLatencyStats(), totalLatency: moqclient.NewLatencyStats()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Catch ctrl+C
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Info("Stopping")
+		cancel()
+	}()
+
+	log.Info(fmt.Sprintf("Starting %d publishers and %d subscribers against %s in %dms", *publishers, *subscribers, *relayUrl, *rampUpMs))
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sessions := *publishers + *subscribers
+		startInterval := time.Duration(*rampUpMs) * time.Millisecond / time.Duration(sessions)
+		// Publishers first, subscribers of a namespace NOT announced yet are rejected
+		for i := uint64(0); i < sessions && ctx.Err() == nil; i++ {
+			wg.Add(1)
+			if i < *publishers {
+				go runPublisher(ctx, wg, config, getNamespace(*namespacePrefix, i), stats)
+			} else {
+				go runSubscriber(ctx, wg, config, getNamespace(*namespacePrefix, (i-*publishers)%*publishers), stats)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(startInterval):
+			}
+		}
+		if *durationMs > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(*durationMs) * time.Millisecond):
+				cancel()
+			}
+		}
+	}()
+
+	relayStats := &relayRuntimeStats{}
+	statsTicker := time.NewTicker(time.Duration(*statsPeriodMs) * time.Millisecond)
+	defer statsTicker.Stop()
+	lastStats := time.Now()
+	lastRecvBytes := uint64(0)
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case now := <-statsTicker.C:
+			recvBytes := stats.recvBytes.Load()
+			recvBitrateBps := uint64(float64((recvBytes-lastRecvBytes)*8) / now.Sub(lastStats).Seconds())
+			lastStats = now
+			lastRecvBytes = recvBytes
+
+			log.WithFields(log.Fields{"pubSessions": stats.pubSessions.Load(), "subSessions": stats.subSessions.Load(), "failedConns": stats.failedConns.Load(), "droppedConns": stats.droppedConns.Load(), "sentObjs": stats.sentObjs.Load(), "recvObjs": stats.recvObjs.Load(), "recvBitrateBps": recvBitrateBps}).Info("Stats")
+			log.Info(fmt.Sprintf("Fan-out latency: %s", stats.periodLatency.Collect().GetDebugStr()))
+			if *relayDebugUrl != "" {
+				relayStats.update(*relayDebugUrl)
+			}
+		}
+	}
+	wg.Wait()
+
+	log.WithFields(log.Fields{"failedConns": stats.failedConns.Load(), "droppedConns": stats.droppedConns.Load(), "sentObjs": stats.sentObjs.Load(), "sentBytes": stats.sentBytes.Load(), "recvObjs": stats.recvObjs.Load(), "recvBytes": stats.recvBytes.Load()}).Info("Totals")
+	log.Info(fmt.Sprintf("Total fan-out latency: %s", stats.totalLatency.Collect().GetDebugStr()))
+	if *relayDebugUrl != "" {
+		log.WithFields(log.Fields{"maxGoroutines": relayStats.maxGoroutines, "maxHeapInuse": relayStats.maxHeapInuse, "maxCpuPercent": fmt.Sprintf("%.1f", relayStats.maxCpuPercent)}).Info("Relay peak usage")
+	}
+}
+
+// runPublisher Announces namespace and publishes its track objects (only while the relay is subscribed) until ctx is done
+func runPublisher(ctx context.Context, wg *sync.WaitGroup, config loadGenConfig, namespace string, stats *loadGenStats) {
+	defer wg.Done()
+
+	client, errConnect := moqclient.Connect(ctx, config.clientConfig, moqhelpers.MoqRolePublisher)
+	if errConnect != nil {
+		stats.failedConns.Add(1)
+		log.WithField("namespace", namespace).WithError(errConnect).Error("Publisher connecting")
+		return
+	}
+	defer client.Close("Load test finished")
+	errAnnounce := client.Announce(namespace, config.authInfo)
+	if errAnnounce != nil {
+		stats.failedConns.Add(1)
+		log.WithField("namespace", namespace).WithError(errAnnounce).Error("Publisher announcing")
+		return
+	}
+	stats.pubSessions.Add(1)
+	defer stats.pubSessions.Add(-1)
+
+	subscribed := atomic.Bool{}
+	go func() {
+		for {
+			moqMsg, _, errReceive := client.ReceiveControlMessage()
+			if errReceive != nil {
+				return
+			}
+			switch msg := moqMsg.(type) {
+			case moqhelpers.MoqMessageSubscribe:
+				if msg.TrackNamespace == namespace && msg.TrackName == TRACK_NAME {
+					subscribed.Store(true)
+					client.WriteControl(func(stream webtransport.Stream) error {
+						return moqhelpers.SendSubscribeOk(stream, moqhelpers.MoqMessageSubscribeOk{TrackNamespace: msg.TrackNamespace, TrackName: msg.TrackName, TrackId: 0})
+					})
+				} else {
+					client.WriteControl(func(stream webtransport.Stream) error {
+						return moqhelpers.SendSubscribeError(stream, moqhelpers.MoqMessageSubscribeError{TrackNamespace: msg.TrackNamespace, TrackName: msg.TrackName, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: "Track NOT found"})
+					})
+				}
+			case moqhelpers.MoqMessageUnSubscribe:
+				subscribed.Store(false)
+			}
+		}
+	}()
+
+	objectsPerGroup := config.objectsPerSec * config.groupDurationMs / 1000
+	if objectsPerGroup <= 0 {
+		objectsPerGroup = 1
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(config.objectsPerSec))
+	defer ticker.Stop()
+	for objectNumber := uint64(0); ; objectNumber++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.Context().Done():
+			stats.droppedConns.Add(1)
+			log.WithField("namespace", namespace).Error("Publisher session closed by the relay")
+			return
+		case <-ticker.C:
+		}
+		if !subscribed.Load() {
+			continue
+		}
+		header := moqobject.MoqObjectHeader{TrackId: 0, GroupSequence: objectNumber / objectsPerGroup, ObjectSequence: objectNumber % objectsPerGroup}
+		payload := moqclient.CreateTestPayload(int(config.objectSize), time.Now())
+		errSend := client.SendObject(ctx, 0, header, payload)
+		if errSend != nil {
+			if ctx.Err() == nil {
+				log.WithFields(log.Fields{"namespace": namespace, "obj": header.GetDebugStr()}).WithError(errSend).Warning("Sending object")
+			}
+			continue
+		}
+		stats.sentObjs.Add(1)
+		stats.sentBytes.Add(uint64(len(payload)))
+	}
+}
+
+// runSubscriber Subscribes to the track of namespace and measures the latency of its objects until ctx is done
+func runSubscriber(ctx context.Context, wg *sync.WaitGroup, config loadGenConfig, namespace string, stats *loadGenStats) {
+	defer wg.Done()
+
+	client, errConnect := moqclient.Connect(ctx, config.clientConfig, moqhelpers.MoqRoleSubscriber)
+	if errConnect != nil {
+		stats.failedConns.Add(1)
+		log.WithField("namespace", namespace).WithError(errConnect).Error("Subscriber connecting")
+		return
+	}
+	defer client.Close("Load test finished")
+
+	readersWg := new(sync.WaitGroup)
+	defer readersWg.Wait()
+	readersCtx, cancelReaders := context.WithCancel(ctx)
+	defer cancelReaders()
+	for i := 0; i < LOADGEN_SUBSCRIBER_READERS; i++ {
+		readersWg.Add(1)
+		go func() {
+			defer readersWg.Done()
+			for {
+				_, payload, errReceive := client.ReceiveObject(readersCtx)
+				if errReceive != nil {
+					if readersCtx.Err() != nil || client.Context().Err() != nil {
+						return
+					}
+					continue
+				}
+				createdAt, isTestPayload := moqclient.ParseTestPayload(payload)
+				if isTestPayload {
+					latency := time.Since(createdAt)
+					stats.periodLatency.Add(latency)
+					stats.totalLatency.Add(latency)
+				}
+				stats.recvObjs.Add(1)
+				stats.recvBytes.Add(uint64(len(payload)))
+			}
+		}()
+	}
+
+	_, errSubscribe := client.Subscribe(namespace, TRACK_NAME, config.authInfo)
+	if errSubscribe != nil {
+		stats.failedConns.Add(1)
+		log.WithField("namespace", namespace).WithError(errSubscribe).Error("Subscriber subscribing")
+		return
+	}
+	stats.subSessions.Add(1)
+	defer stats.subSessions.Add(-1)
+
+	select {
+	case <-ctx.Done():
+	case <-client.Context().Done():
+		stats.droppedConns.Add(1)
+		log.WithField("namespace", namespace).Error("Subscriber session closed by the relay")
+	}
+}
+
+// update Reads the relay runtime, logs its usage and keeps the peaks
+func (relayStats *relayRuntimeStats) update(relayDebugUrl string) {
+	httpClient := http.Client{Timeout: LOADGEN_RELAY_DEBUG_TIMEOUT_MS * time.Millisecond}
+	response, errGet := httpClient.Get(relayDebugUrl)
+	if errGet != nil {
+		log.WithError(errGet).Warning("Reading relay runtime")
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Warning(fmt.Sprintf("Reading relay runtime, status %d", response.StatusCode))
+		return
+	}
+	runtime := moqdebug.MoqDebugRuntime{}
+	errDecode := json.NewDecoder(response.Body).Decode(&runtime)
+	if errDecode != nil {
+		log.WithError(errDecode).Warning("Reading relay runtime")
+		return
+	}
+	now := time.Now()
+
+	cpuPercent := float64(0)
+	if relayStats.last != nil {
+		cpuMs := (runtime.CpuUserMs + runtime.CpuSystemMs) - (relayStats.last.CpuUserMs + relayStats.last.CpuSystemMs)
+		cpuPercent = float64(cpuMs) * 100 / float64(now.Sub(relayStats.lastAt).Milliseconds())
+	}
+	relayStats.last = &runtime
+	relayStats.lastAt = now
+	relayStats.maxGoroutines = max(relayStats.maxGoroutines, runtime.Goroutines)
+	relayStats.maxHeapInuse = max(relayStats.maxHeapInuse, runtime.HeapInuse)
+	relayStats.maxCpuPercent = max(relayStats.maxCpuPercent, cpuPercent)
+
+	log.WithFields(log.Fields{"cpuPercent": fmt.Sprintf("%.1f", cpuPercent), "goroutines": runtime.Goroutines, "heapInuse": runtime.HeapInuse, "sys": runtime.Sys, "numGc": runtime.NumGC}).Info("Relay usage")
+}
+
+// Helpers
+
+func getNamespace(namespacePrefix string, publisherIndex uint64) string {
+	return fmt.Sprintf("%s-%d", namespacePrefix, publisherIndex)
+}
@@ -0,0 +1,280 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package main
+
+import (
+	"context"
+	"facebookexperimental/moq-go-server/moqclient"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default values
+const RELAY_URL = "https://localhost:4433/moq"
+const TRACK_NAMESPACE = "test"
+const TRACK_NAMES = "video"
+const OBJECTS_PER_SEC = 30
+const GROUP_DURATION_MS = 2000
+const BITRATE_BPS = 1000 * 1000
+const DURATION_MS = 0
+const STATS_PERIOD_MS = 5 * 1000
+const LOG_LEVEL = "info"
+
+// Published track, objects are only sent while it is subscribed
+type pubTrack struct {
+	trackName  string
+	trackId    uint64
+	subscribed bool
+	sentBytes  uint64
+	sentObjs   uint64
+}
+
+type moqPub struct {
+	client *moqclient.MoqClient
+	cancel context.CancelFunc
+
+	// Protected
+	tracks map[string]*pubTrack
+	lock   *sync.Mutex
+}
+
+func main() {
+	relayUrl := flag.String("url", RELAY_URL, "Relay WebTransport endpoint")
+	certPath := flag.String("cert", "", "PEM certificate (or CA) to trust besides the system ones, ex: the relay self-signed one")
+	insecure := flag.Bool("insecure", false, "Skip the relay certificate verification (local testing only)")
+	trackNamespace := flag.String("namespace", TRACK_NAMESPACE, "Namespace to announce")
+	trackNames := flag.String("tracks", TRACK_NAMES, "Comma separated track names, all of them publish the same objects")
+	authInfo := flag.String("auth_info", "", "Auth info sent in the ANNOUNCE")
+	objectsPerSec := flag.Uint64("objects_per_sec", OBJECTS_PER_SEC, "Objects published per second (per track)")
+	groupDurationMs := flag.Uint64("group_duration_ms", GROUP_DURATION_MS, "A new group starts every this time (in milliseconds)")
+	bitrateBps := flag.Uint64("bitrate_bps", BITRATE_BPS, "Bitrate per track, sets the payload size of every object")
+	filePath := flag.String("file", "", "File used as payload source, split in objects of the bitrate size and looped (empty sends synthetic payloads with their creation time, used by moq-sub to measure latency)")
+	durationMs := flag.Uint64("duration_ms", DURATION_MS, "Stop after this time, 0 publishes until ctrl+C (in milliseconds)")
+	statsPeriodMs := flag.Uint64("stats_period_ms", STATS_PERIOD_MS, "Period of the sent objects stats logs, 0 disables them (in milliseconds)")
+	logLevel := flag.String("log_level", LOG_LEVEL, "Log level (panic, fatal, error, warn, info, debug, trace)")
+	flag.Parse()
+
+	level, errLevel := log.ParseLevel(*logLevel)
+	if errLevel != nil {
+		log.Fatal(fmt.Sprintf("Invalid log level: %s", *logLevel))
+	}
+	log.SetLevel(level)
+	if *objectsPerSec <= 0 {
+		log.Fatal("objects_per_sec has to be greater than 0")
+	}
+
+	var fileData []byte = nil
+	if *filePath != "" {
+		var errRead error
+		fileData, errRead = os.ReadFile(*filePath)
+		if errRead != nil {
+			log.Fatal(fmt.Sprintf("Can not read payload file %s. Err: %v", *filePath, errRead))
+		}
+		if len(fileData) == 0 {
+			log.Fatal(fmt.Sprintf("Payload file %s is empty", *filePath))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, errConnect := moqclient.Connect(ctx, moqclient.MoqClientConfig{Url: *relayUrl, CertPath: *certPath, Insecure: *insecure}, moqhelpers.MoqRolePublisher)
+	if errConnect != nil {
+		log.Fatal(fmt.Sprintf("Can not connect to %s. Err: %v", *relayUrl, errConnect))
+	}
+	errAnnounce := client.Announce(*trackNamespace, *authInfo)
+	if errAnnounce != nil {
+		client.Close("Announce failed")
+		log.Fatal(fmt.Sprintf("Can not announce %s. Err: %v", *trackNamespace, errAnnounce))
+	}
+	log.Info(fmt.Sprintf("Connected to %s, announced %s", *relayUrl, *trackNamespace))
+
+	pub := &moqPub{client: client, cancel: cancel, tracks: map[string]*pubTrack{}, lock: new(sync.Mutex)}
+	for i, trackName := range strings.Split(*trackNames, ",") {
+		pub.tracks[trackName] = &pubTrack{trackName: trackName, trackId: uint64(i)}
+	}
+	go pub.answerSubscribes(*trackNamespace)
+
+	// Catch ctrl+C
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Info("Stopping")
+		cancel()
+	}()
+	if *durationMs > 0 {
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(*durationMs) * time.Millisecond):
+				cancel()
+			}
+		}()
+	}
+
+	objectSize := *bitrateBps / 8 / *objectsPerSec
+	pub.publish(ctx, *objectsPerSec, *groupDurationMs, objectSize, fileData, *statsPeriodMs)
+
+	pub.logStats()
+	client.WriteControl(func(stream webtransport.Stream) error {
+		return moqhelpers.SendUnAnnounce(stream, moqhelpers.MoqMessageUnAnnounce{TrackNamespace: *trackNamespace})
+	})
+	client.Close("Publisher finished")
+}
+
+// publish Creates the objects at the configured rate and sends them to the subscribed tracks until ctx is done
+func (pub *moqPub) publish(ctx context.Context, objectsPerSec uint64, groupDurationMs uint64, objectSize uint64, fileData []byte, statsPeriodMs uint64) {
+	objectsPerGroup := objectsPerSec * groupDurationMs / 1000
+	if objectsPerGroup <= 0 {
+		objectsPerGroup = 1
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(objectsPerSec))
+	defer ticker.Stop()
+	var statsChannel <-chan time.Time = nil
+	if statsPeriodMs > 0 {
+		statsTicker := time.NewTicker(time.Duration(statsPeriodMs) * time.Millisecond)
+		defer statsTicker.Stop()
+		statsChannel = statsTicker.C
+	}
+
+	fileOffset := uint64(0)
+	for objectNumber := uint64(0); ; objectNumber++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pub.client.Context().Done():
+			log.Error("Session closed by the relay")
+			return
+		case <-statsChannel:
+			pub.logStats()
+			continue
+		case <-ticker.C:
+		}
+
+		var payload []byte = nil
+		if fileData != nil {
+			payload = make([]byte, 0, objectSize)
+			for uint64(len(payload)) < objectSize {
+				n := min(objectSize-uint64(len(payload)), uint64(len(fileData))-fileOffset)
+				payload = append(payload, fileData[fileOffset:fileOffset+n]...)
+				fileOffset = (fileOffset + n) % uint64(len(fileData))
+			}
+		} else {
+			payload = moqclient.CreateTestPayload(int(objectSize), time.Now())
+		}
+		header := moqobject.MoqObjectHeader{GroupSequence: objectNumber / objectsPerGroup, ObjectSequence: objectNumber % objectsPerGroup}
+		for _, track := range pub.getSubscribedTracks() {
+			header.TrackId = track.trackId
+			errSend := pub.client.SendObject(ctx, track.trackId, header, payload)
+			if errSend != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.WithFields(log.Fields{"track": track.trackName, "obj": header.GetDebugStr()}).WithError(errSend).Error("Sending object")
+				continue
+			}
+			pub.addSent(track.trackName, uint64(len(payload)))
+		}
+	}
+}
+
+// answerSubscribes Reads the control messages, answers the SUBSCRIBEs of the published tracks
+func (pub *moqPub) answerSubscribes(trackNamespace string) {
+	for {
+		moqMsg, _, errReceive := pub.client.ReceiveControlMessage()
+		if errReceive != nil {
+			log.WithError(errReceive).Error("Reading control message")
+			pub.cancel()
+			return
+		}
+		switch msg := moqMsg.(type) {
+		case moqhelpers.MoqMessageSubscribe:
+			trackId, found := pub.setSubscribed(msg.TrackName, true)
+			var errSend error = nil
+			if !found || msg.TrackNamespace != trackNamespace {
+				log.WithFields(log.Fields{"namespace": msg.TrackNamespace, "track": msg.TrackName}).Warning("Received SUBSCRIBE of unknown track")
+				errSend = pub.client.WriteControl(func(stream webtransport.Stream) error {
+					return moqhelpers.SendSubscribeError(stream, moqhelpers.MoqMessageSubscribeError{TrackNamespace: msg.TrackNamespace, TrackName: msg.TrackName, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: "Track NOT found"})
+				})
+			} else {
+				log.WithField("track", msg.TrackName).Info("Received SUBSCRIBE")
+				errSend = pub.client.WriteControl(func(stream webtransport.Stream) error {
+					return moqhelpers.SendSubscribeOk(stream, moqhelpers.MoqMessageSubscribeOk{TrackNamespace: msg.TrackNamespace, TrackName: msg.TrackName, TrackId: trackId})
+				})
+			}
+			if errSend != nil {
+				log.WithError(errSend).Error("Answering SUBSCRIBE")
+			}
+		case moqhelpers.MoqMessageUnSubscribe:
+			log.WithField("track", msg.TrackName).Info("Received UNSUBSCRIBE")
+			pub.setSubscribed(msg.TrackName, false)
+		case moqhelpers.MoqMessageGoAway:
+			log.Warning("Received GOAWAY, stopping")
+			pub.cancel()
+			return
+		default:
+			log.Debug(fmt.Sprintf("Ignored control message %T", moqMsg))
+		}
+	}
+}
+
+// Helpers
+
+func (pub *moqPub) setSubscribed(trackName string, subscribed bool) (trackId uint64, found bool) {
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+
+	track, found := pub.tracks[trackName]
+	if found {
+		track.subscribed = subscribed
+		trackId = track.trackId
+	}
+	return
+}
+
+func (pub *moqPub) getSubscribedTracks() (tracks []pubTrack) {
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+
+	tracks = []pubTrack{}
+	for _, track := range pub.tracks {
+		if track.subscribed {
+			tracks = append(tracks, *track)
+		}
+	}
+	return
+}
+
+func (pub *moqPub) addSent(trackName string, bytes uint64) {
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+
+	track := pub.tracks[trackName]
+	track.sentObjs++
+	track.sentBytes += bytes
+}
+
+func (pub *moqPub) logStats() {
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+
+	for _, track := range pub.tracks {
+		log.WithFields(log.Fields{"track": track.trackName, "subscribed": track.subscribed, "sentObjs": track.sentObjs, "sentBytes": track.sentBytes}).Info("Stats")
+	}
+}
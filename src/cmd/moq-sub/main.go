@@ -0,0 +1,289 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package main
+
+import (
+	"context"
+	"facebookexperimental/moq-go-server/moqclient"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default values
+const RELAY_URL = "https://localhost:4433/moq"
+const TRACK_NAMESPACE = "test"
+const TRACK_NAMES = "video"
+const DURATION_MS = 0
+const STATS_PERIOD_MS = 5 * 1000
+const LOG_LEVEL = "info"
+
+// Object streams read in parallel (objects of the same track can arrive out of order)
+const SUBSCRIBER_READERS = 16
+
+// Subscribed track, it validates the order of its objects
+type subTrack struct {
+	trackName string
+
+	started        bool
+	lastGroup      uint64
+	lastObject     uint64
+	recvObjs       uint64
+	recvBytes      uint64
+	periodBytes    uint64
+	gaps           uint64
+	missingObjs    uint64
+	outOfOrderObjs uint64
+}
+
+type moqSub struct {
+	client  *moqclient.MoqClient
+	cancel  context.CancelFunc
+	latency *moqclient.MoqLatencyStats
+
+	// Protected
+	tracks map[uint64]*subTrack
+	lock   *sync.Mutex
+}
+
+func main() {
+	relayUrl := flag.String("url", RELAY_URL, "Relay WebTransport endpoint")
+	certPath := flag.String("cert", "", "PEM certificate (or CA) to trust besides the system ones, ex: the relay self-signed one")
+	insecure := flag.Bool("insecure", false, "Skip the relay certificate verification (local testing only)")
+	trackNamespace := flag.String("namespace", TRACK_NAMESPACE, "Namespace of the tracks")
+	trackNames := flag.String("tracks", TRACK_NAMES, "Comma separated track names to subscribe")
+	authInfo := flag.String("auth_info", "", "Auth info sent in the SUBSCRIBEs")
+	durationMs := flag.Uint64("duration_ms", DURATION_MS, "Stop after this time, 0 receives until ctrl+C (in milliseconds)")
+	statsPeriodMs := flag.Uint64("stats_period_ms", STATS_PERIOD_MS, "Period of the received objects stats logs (in milliseconds)")
+	logLevel := flag.String("log_level", LOG_LEVEL, "Log level (panic, fatal, error, warn, info, debug, trace)")
+	flag.Parse()
+
+	level, errLevel := log.ParseLevel(*logLevel)
+	if errLevel != nil {
+		log.Fatal(fmt.Sprintf("Invalid log level: %s", *logLevel))
+	}
+	log.SetLevel(level)
+	if *statsPeriodMs <= 0 {
+		log.Fatal("stats_period_ms has to be greater than 0")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, errConnect := moqclient.Connect(ctx, moqclient.MoqClientConfig{Url: *relayUrl, CertPath: *certPath, Insecure: *insecure}, moqhelpers.MoqRoleSubscriber)
+	if errConnect != nil {
+		log.Fatal(fmt.Sprintf("Can not connect to %s. Err: %v", *relayUrl, errConnect))
+	}
+	sub := &moqSub{client: client, cancel: cancel, latency: moqclient.NewLatencyStats(), tracks: map[uint64]*subTrack{}, lock: new(sync.Mutex)}
+
+	// Readers before subscribing, objects can arrive before the SUBSCRIBE OK is read
+	wg := new(sync.WaitGroup)
+	for i := 0; i < SUBSCRIBER_READERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub.receiveObjects(ctx)
+		}()
+	}
+
+	for _, trackName := range strings.Split(*trackNames, ",") {
+		trackId, errSubscribe := client.Subscribe(*trackNamespace, trackName, *authInfo)
+		if errSubscribe != nil {
+			client.Close("Subscribe failed")
+			log.Fatal(fmt.Sprintf("Can not subscribe to %s/%s. Err: %v", *trackNamespace, trackName, errSubscribe))
+		}
+		sub.addTrack(trackId, trackName)
+		log.WithFields(log.Fields{"track": trackName, "trackId": trackId}).Info("Subscribed")
+	}
+	log.Info(fmt.Sprintf("Connected to %s, subscribed to %s", *relayUrl, *trackNamespace))
+	go sub.readControl()
+
+	// Catch ctrl+C
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Info("Stopping")
+		cancel()
+	}()
+	var durationChannel <-chan time.Time = nil
+	if *durationMs > 0 {
+		durationChannel = time.After(time.Duration(*durationMs) * time.Millisecond)
+	}
+
+	statsTicker := time.NewTicker(time.Duration(*statsPeriodMs) * time.Millisecond)
+	defer statsTicker.Stop()
+	lastStats := time.Now()
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-client.Context().Done():
+			log.Error("Session closed by the relay")
+			running = false
+		case <-durationChannel:
+			running = false
+		case now := <-statsTicker.C:
+			sub.logStats(now.Sub(lastStats))
+			lastStats = now
+		}
+	}
+	cancel()
+
+	sub.unsubscribe(*trackNamespace)
+	client.Close("Subscriber finished")
+	wg.Wait()
+	sub.logStats(time.Since(lastStats))
+	sub.logTotals()
+}
+
+// receiveObjects Reads object streams and validates them until ctx is done
+func (sub *moqSub) receiveObjects(ctx context.Context) {
+	for {
+		header, payload, errReceive := sub.client.ReceiveObject(ctx)
+		if errReceive != nil {
+			if ctx.Err() != nil || sub.client.Context().Err() != nil {
+				return
+			}
+			log.WithError(errReceive).Warning("Receiving object")
+			continue
+		}
+		createdAt, isTestPayload := moqclient.ParseTestPayload(payload)
+		if isTestPayload {
+			sub.latency.Add(time.Since(createdAt))
+		}
+		sub.addReceived(header, uint64(len(payload)))
+	}
+}
+
+// readControl Reads the control messages until the session ends (subscriptions terminated by the relay / publisher)
+func (sub *moqSub) readControl() {
+	for {
+		moqMsg, _, errReceive := sub.client.ReceiveControlMessage()
+		if errReceive != nil {
+			log.WithError(errReceive).Debug("Reading control message")
+			sub.cancel()
+			return
+		}
+		switch msg := moqMsg.(type) {
+		case moqhelpers.MoqMessageSubscribeRst:
+			log.WithFields(log.Fields{"track": msg.TrackName, "errCode": msg.ErrCode, "errMsg": msg.ErrMsg, "finalGroup": msg.FinalGroup, "finalObject": msg.FinalObject}).Warning("Received SUBSCRIBE RESET")
+		case moqhelpers.MoqMessageGoAway:
+			log.Warning("Received GOAWAY, stopping")
+			sub.cancel()
+			return
+		default:
+			log.Debug(fmt.Sprintf("Ignored control message %T", moqMsg))
+		}
+	}
+}
+
+func (sub *moqSub) unsubscribe(trackNamespace string) {
+	sub.lock.Lock()
+	trackNames := []string{}
+	for _, track := range sub.tracks {
+		trackNames = append(trackNames, track.trackName)
+	}
+	sub.lock.Unlock()
+
+	for _, trackName := range trackNames {
+		sub.client.WriteControl(func(stream webtransport.Stream) error {
+			return moqhelpers.SendUnSubscribe(stream, moqhelpers.MoqMessageUnSubscribe{TrackNamespace: trackNamespace, TrackName: trackName})
+		})
+	}
+}
+
+// Helpers
+
+func (sub *moqSub) addTrack(trackId uint64, trackName string) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	track, found := sub.tracks[trackId]
+	if found {
+		track.trackName = trackName
+	} else {
+		sub.tracks[trackId] = &subTrack{trackName: trackName}
+	}
+}
+
+// addReceived Updates the track stats, objects are expected in order: next object of the group or first object of the next group
+func (sub *moqSub) addReceived(header moqobject.MoqObjectHeader, bytes uint64) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	track, found := sub.tracks[header.TrackId]
+	if !found {
+		// SUBSCRIBE OK NOT processed yet, added as unknown
+		track = &subTrack{trackName: fmt.Sprintf("unknown-%d", header.TrackId)}
+		sub.tracks[header.TrackId] = track
+	}
+	track.recvObjs++
+	track.recvBytes += bytes
+	track.periodBytes += bytes
+
+	if !track.started {
+		track.started = true
+		track.lastGroup = header.GroupSequence
+		track.lastObject = header.ObjectSequence
+		return
+	}
+	if header.GroupSequence < track.lastGroup || (header.GroupSequence == track.lastGroup && header.ObjectSequence <= track.lastObject) {
+		track.outOfOrderObjs++
+		log.WithFields(log.Fields{"track": track.trackName, "obj": header.GetDebugStr(), "lastGroup": track.lastGroup, "lastObject": track.lastObject}).Debug("Object out of order")
+		return
+	}
+	// Objects at the end of the previous group are unknown, only the skipped groups and the start of this one are counted
+	missing := header.ObjectSequence
+	skippedGroups := uint64(0)
+	if header.GroupSequence == track.lastGroup {
+		missing = header.ObjectSequence - track.lastObject - 1
+	} else {
+		skippedGroups = header.GroupSequence - track.lastGroup - 1
+	}
+	if missing > 0 || skippedGroups > 0 {
+		track.gaps++
+		track.missingObjs += missing
+		log.WithFields(log.Fields{"track": track.trackName, "obj": header.GetDebugStr(), "missingObjs": missing, "skippedGroups": skippedGroups}).Warning("Gap detected")
+	}
+	track.lastGroup = header.GroupSequence
+	track.lastObject = header.ObjectSequence
+}
+
+func (sub *moqSub) logStats(period time.Duration) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	for _, track := range sub.tracks {
+		bitrateBps := uint64(0)
+		if period > 0 {
+			bitrateBps = uint64(float64(track.periodBytes*8) / period.Seconds())
+		}
+		track.periodBytes = 0
+		log.WithFields(log.Fields{"track": track.trackName, "recvObjs": track.recvObjs, "recvBytes": track.recvBytes, "bitrateBps": bitrateBps, "gaps": track.gaps, "missingObjs": track.missingObjs, "outOfOrderObjs": track.outOfOrderObjs}).Info("Stats")
+	}
+	log.Info(fmt.Sprintf("Latency: %s", sub.latency.Collect().GetDebugStr()))
+}
+
+func (sub *moqSub) logTotals() {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	for _, track := range sub.tracks {
+		log.WithFields(log.Fields{"track": track.trackName, "recvObjs": track.recvObjs, "recvBytes": track.recvBytes, "gaps": track.gaps, "missingObjs": track.missingObjs, "outOfOrderObjs": track.outOfOrderObjs}).Info("Totals")
+	}
+}
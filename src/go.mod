@@ -6,6 +6,7 @@ require (
 	github.com/google/uuid v1.5.0
 	github.com/quic-go/quic-go v0.41.0
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.17.0
 	golang.org/x/exp v0.0.0-20231226003508-02704c960a9b
 )
 
@@ -17,7 +18,6 @@ require (
 	github.com/onsi/ginkgo/v2 v2.13.2 // indirect
 	github.com/quic-go/webtransport-go v0.6.0
 	go.uber.org/mock v0.3.0 // indirect
-	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/mod v0.14.0 // indirect
 	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
@@ -8,35 +8,206 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"facebookexperimental/moq-go-server/moqacme"
+	"facebookexperimental/moq-go-server/moqadmin"
+	"facebookexperimental/moq-go-server/moqadmission"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqbandwidth"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqcluster"
+	"facebookexperimental/moq-go-server/moqcmafingest"
+	"facebookexperimental/moq-go-server/moqconfigfile"
 	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqdebug"
+	"facebookexperimental/moq-go-server/moqdevcert"
+	"facebookexperimental/moq-go-server/moqdiskcache"
+	"facebookexperimental/moq-go-server/moqevents"
+	"facebookexperimental/moq-go-server/moqeventsexport"
 	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhealth"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqhls"
+	"facebookexperimental/moq-go-server/moqhooks"
+	"facebookexperimental/moq-go-server/moqhttporigin"
+	"facebookexperimental/moq-go-server/moqlocalpublisher"
+	"facebookexperimental/moq-go-server/moqlogsampler"
+	"facebookexperimental/moq-go-server/moqmesh"
 	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqmetrics"
 	"facebookexperimental/moq-go-server/moqorigins"
+	"facebookexperimental/moq-go-server/moqquicstats"
+	"facebookexperimental/moq-go-server/moqrecorder"
+	"facebookexperimental/moq-go-server/moqreplay"
+	"facebookexperimental/moq-go-server/moqsession"
+	"facebookexperimental/moq-go-server/moqworkerpool"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 )
 
 // Default parameters
 const HTTP_SERVER_LISTEN_ADDR = ":4433"
 const TLS_CERT_FILEPATH = "../certs/certificate.pem"
 const TLS_KEY_FILEPATH = "../certs/certificate.key"
+const TLS_CLIENT_CA_FILEPATH = ""
+const CLIENT_CERT_IDENTITIES_FILEPATH = ""
+const DEV_MODE = false
+const DEV_CERT_VALIDITY_MS = 10 * 24 * 60 * 60 * 1000
+const ACME_HOSTS = ""
+const ACME_EMAIL = ""
+const ACME_CACHE_DIR = "../certs/acme"
+const ACME_DIRECTORY_URL = ""
+const ACME_CHALLENGE = string(moqacme.MoqAcmeChallengeHttp01)
+const ACME_CHALLENGE_ADDR = ":80"
 const OBJECT_EXPIRATION_MS = 3 * 60 * 1000
 const CACHE_CLEAN_UP_PERIOD_MS = 10 * 1000
+const CACHE_MAX_BYTES = 0
+const CACHE_QUOTAS_FILEPATH = ""
+const CACHE_PURGE_ON_UNANNOUNCE = false
+const CACHE_COMPRESS_NAMESPACES = ""
+const OBJ_DEDUP_POLICY = "none"
+const CACHE_DISK_DIR = ""
+const RECORD_DIR = ""
+const RECORD_NAMESPACES = ""
+const RECORD_SEGMENT_MAX_BYTES = 64 * 1024 * 1024
+const RECORD_SEGMENT_MAX_MS = 60 * 1000
+const REPLAY_TRACK_DIRS = ""
+const REPLAY_NAMESPACE = ""
+const REPLAY_LOOP = false
+const CMAF_INGEST_LISTEN_ADDR = ""
+const CMAF_INGEST_PIPE = ""
+const CMAF_INGEST_PIPE_TRACK = "video"
+const CMAF_INGEST_NAMESPACE = "cmaf"
+const CMAF_INGEST_INIT_TRACK_SUFFIX = ".init"
+const CACHE_DISK_SPILL_AFTER_S = 0
 const HTTP_CONNECTION_KEEP_ALIVE_MS = 10 * 1000
+const QUIC_STATS = true
 const MOQ_ORIGINS_FILEPATH = ""
+const ORIGIN_LAZY_IDLE_TIMEOUT_MS = 30 * 1000
+const ORIGIN_WARM_POOL_SIZE = 0
+const ORIGIN_WARM_POOL_TTL_MS = 5 * 60 * 1000
+const RELAY_ID = ""
+const SUBSCRIBE_RESPONSE_TIMEOUT_MS = 10 * 1000
+const SUBSCRIBE_NEGATIVE_CACHE_MS = 0
+const SUBSCRIPTION_AUTO_RENEW = false
+const DUPLICATE_SUBSCRIBE_POLICY = string(moqsession.MoqDuplicateSubscribePolicyReject)
+const SESSION_STALL_TIMEOUT_MS = 0
+const PUBLISHER_ANNOUNCE_TIMEOUT_MS = 0
+const SUBSCRIBER_SUBSCRIBE_TIMEOUT_MS = 0
+const SESSION_OBJECTS_IDLE_TIMEOUT_MS = 0
+const VALIDATE_OBJ_SEQUENCES = false
+const BANDWIDTH_BUDGET_BPS = 0
+const RETRY_AFTER_S = 5
+const CORS_ALLOWED_ORIGINS = ""
+const SHUTDOWN_DRAIN_MS = 10 * 1000
+const SHUTDOWN_DRAIN_CHECK_PERIOD_MS = 250
+const MAX_SESSIONS = 0
+const MAX_SESSIONS_PER_IP = 0
+const IP_ALLOW_LIST = ""
+const IP_DENY_LIST = ""
+const SESSION_RATE_PER_IP = 0
+const SESSION_BURST_PER_IP = 10
+const SUBSCRIBE_RATE_PER_IP = 0
+const SUBSCRIBE_BURST_PER_IP = 50
+const SUBSCRIBER_OBJ_QUEUE_SIZE = 1024
+const SUBSCRIBER_OBJ_QUEUE_POLICY = string(moqsession.MoqObjQueuePolicyDropOldest)
+const SUBSCRIBER_SKIP_TO_LATEST_GROUP = false
+const SUBSCRIBER_RATE_BPS = 0
+const SUBSCRIBER_BURST_BYTES = 256 * 1024
+const SUBSCRIBER_RATE_MAX_WAIT_MS = 500
+const SUBSCRIBER_PRIORITY_MAX_WAIT_MS = 2000
+const PUBLISHER_INGEST_WORKERS = 0
+const PUBLISHER_INGEST_QUEUE_SIZE = 4096
+const SUBSCRIBER_EGRESS_WORKERS = 0
+const SUBSCRIBER_EGRESS_QUEUE_SIZE = 16384
+const SUBSCRIBER_BATCH_MAX_OBJECT_BYTES = 0
+const ANNOUNCE_POLICIES_FILEPATH = ""
+const ENDPOINTS_FILEPATH = ""
+const AUTHORIZER_FILEPATH = ""
+const ADMIN_LISTEN_ADDR = ""
+const HEALTH_LISTEN_ADDR = ""
+const METRICS_LISTEN_ADDR = ""
+const DEBUG_LISTEN_ADDR = ""
+const HLS_LISTEN_ADDR = ""
+const HLS_PLAYLIST_SEGMENTS = 6
+const HLS_PART_TARGET_MS = 500
+const HLS_BLOCKING_TIMEOUT_MS = 6 * 1000
+const HLS_INIT_TRACK_SUFFIX = ""
+const HTTP_ORIGIN_LISTEN_ADDR = ""
+const ADMIN_TOKENS_FILEPATH = ""
+const ADMIN_AUDIT_LOG_FILEPATH = ""
+const ADMIN_EVENTS_SUMMARY_PERIOD_MS = 5 * 1000
+const EVENTS_EXPORT_URL = ""
+const EVENTS_TRACK_IDLE_TIMEOUT_MS = 10 * 1000
+const CLUSTER_BUS_URL = ""
+const CLUSTER_FETCH_URL = ""
+const CLUSTER_FETCH_TOKEN = ""
+const CLUSTER_FETCH_ALLOWED_HOSTS = ""
+const CLUSTER_FETCH_CA_FILEPATH = ""
+const CLUSTER_SHARDING = false
+const CLUSTER_RELAY_URL = ""
+const MESH_BIND_ADDR = ""
+const MESH_ADVERTISE_ADDR = ""
+const MESH_SEEDS = ""
+const MESH_RELAY_URL = ""
+const MESH_SECRET = ""
+const MESH_CA_FILEPATH = ""
+const LOG_LEVEL = "info"
+const LOG_FORMAT = "text"
+const LOG_OBJ_SAMPLE_INGEST = 1
+const LOG_OBJ_SAMPLE_EGRESS = 1
+const CONFIG_FILEPATH = ""
+
+// Goroutines of these packages are counted per session in /debug/goroutines
+var DEBUG_MODULE_PREFIXES = []string{"main.", "facebookexperimental/moq-go-server/"}
+
+// Every flag can be set with the env var MOQ_[FLAG NAME IN UPPER CASE] (example: MOQ_LISTEN_ADDR), command line flags override them
+const ENV_VARS_PREFIX = "MOQ_"
+
+// Unified config file sections and the flags each one can set
+var configSections = map[string][]string{
+	"listener":    {"listen_addr", "health_addr", "endpoints_config", "cors_allowed_origins", "http_conn_time_out_ms", "quic_stats", "max_sessions", "max_sessions_per_ip", "ip_allow_list", "ip_deny_list", "session_rate_per_ip", "session_burst_per_ip", "subscribe_rate_per_ip", "subscribe_burst_per_ip", "bandwidth_budget_bps", "relay_id", "shutdown_drain_ms"},
+	"tls":         {"tls_cert", "tls_key", "tls_client_ca", "client_cert_identities_config", "dev", "dev_cert_validity_ms", "acme_hosts", "acme_email", "acme_cache_dir", "acme_directory_url", "acme_challenge", "acme_challenge_addr"},
+	"cache":       {"obj_exp_ms", "cache_cleanup_period_ms", "cache_max_bytes", "cache_purge_on_unannounce", "obj_dedup_policy", "cache_compress_namespaces", "cache_disk_dir", "cache_disk_spill_after_s", "cache_quotas_config"},
+	"timeouts":    {"session_stall_timeout_ms", "publisher_announce_timeout_ms", "subscriber_subscribe_timeout_ms", "session_objects_idle_timeout_ms", "subscribe_response_timeout_ms", "subscribe_negative_cache_ms"},
+	"subscribers": {"subscriber_obj_queue_size", "subscriber_obj_queue_policy", "subscriber_skip_to_latest_group", "subscriber_rate_bps", "subscriber_burst_bytes", "subscriber_rate_max_wait_ms", "subscriber_priority_max_wait_ms", "subscriber_egress_workers", "subscriber_egress_queue_size", "subscriber_batch_max_object_bytes", "subscription_auto_renew", "duplicate_subscribe_policy"},
+	"publishers":  {"validate_obj_sequences", "announce_policies_config", "publisher_ingest_workers", "publisher_ingest_queue_size"},
+	"upstream":    {"moq_origins_config", "origin_lazy_idle_timeout_ms", "origin_warm_pool_size", "origin_warm_pool_ttl_ms"},
+	"auth":        {"authorizer_config"},
+	"admin":       {"admin_addr", "admin_tokens_config", "admin_audit_log", "admin_events_summary_period_ms", "metrics_addr", "debug_addr"},
+	"hls":         {"hls_addr", "hls_playlist_segments", "hls_part_target_ms", "hls_blocking_timeout_ms", "hls_init_track_suffix"},
+	"recording":   {"record_dir", "record_namespaces", "record_segment_max_bytes", "record_segment_max_ms"},
+	"replay":      {"replay_track_dirs", "replay_namespace", "replay_loop"},
+	"http_origin": {"http_origin_addr"},
+	"events":      {"events_export_url", "events_track_idle_timeout_ms"},
+	"cluster":     {"cluster_bus_url", "cluster_fetch_url", "cluster_fetch_token", "cluster_fetch_allowed_hosts", "cluster_fetch_ca", "cluster_sharding", "cluster_relay_url"},
+	"mesh":        {"mesh_bind_addr", "mesh_advertise_addr", "mesh_seeds", "mesh_relay_url", "mesh_secret", "mesh_ca"},
+	"cmaf":        {"cmaf_ingest_addr", "cmaf_ingest_pipe", "cmaf_ingest_pipe_track", "cmaf_ingest_namespace", "cmaf_ingest_init_track_suffix"},
+	"logging":     {"log_level", "log_format", "log_obj_sample_ingest", "log_obj_sample_egress"},
+}
+
+// Unified config file key with the inline origins list (same format as the origins config)
+const CONFIG_ORIGINS_KEY = "origins"
 
 // Main function
 
@@ -45,94 +216,858 @@ func main() {
 	listenAddr := flag.String("listen_addr", HTTP_SERVER_LISTEN_ADDR, "Server listen port (example: \":4433\")")
 	tlsCertPath := flag.String("tls_cert", TLS_CERT_FILEPATH, "TLS certificate file path to use in this server")
 	tlsKeyPath := flag.String("tls_key", TLS_KEY_FILEPATH, "TLS key file path to use in this server")
+	tlsClientCaPath := flag.String("tls_client_ca", TLS_CLIENT_CA_FILEPATH, "PEM CA bundle to verify client certificates (mTLS), needed by endpoints with clientcertrequired. Empty disables client certificates")
+	clientCertIdentitiesConfigFile := flag.String("client_cert_identities_config", CLIENT_CERT_IDENTITIES_FILEPATH, "Json file with client certificate identities (CN / SAN) and the namespaces each one can announce / subscribe (default: any verified certificate, any namespace)")
+	devMode := flag.Bool("dev", DEV_MODE, "Local development, generates a self-signed certificate (localhost) at startup and prints its hash for WebTransport serverCertificateHashes, tls_cert / tls_key are NOT used")
+	devCertValidityMs := flag.Uint64("dev_cert_validity_ms", DEV_CERT_VALIDITY_MS, "Validity of the dev certificate, max 14 days (in milliseconds)")
+	acmeHosts := flag.String("acme_hosts", ACME_HOSTS, "Get (and renew) the TLS certificate from Let's Encrypt (ACME) for these hostnames (comma separated), tls_cert / tls_key are NOT used. Empty disables it")
+	acmeEmail := flag.String("acme_email", ACME_EMAIL, "ACME account contact email (optional)")
+	acmeCacheDir := flag.String("acme_cache_dir", ACME_CACHE_DIR, "Dir where ACME certificates and account key are stored")
+	acmeDirectoryUrl := flag.String("acme_directory_url", ACME_DIRECTORY_URL, "ACME directory URL, empty is Let's Encrypt production (example: staging \"https://acme-staging-v02.api.letsencrypt.org/directory\")")
+	acmeChallenge := flag.String("acme_challenge", ACME_CHALLENGE, "ACME challenge (http-01, tls-alpn-01)")
+	acmeChallengeAddr := flag.String("acme_challenge_addr", ACME_CHALLENGE_ADDR, "TCP listen address that answers the ACME challenges (\":80\" for http-01, \":443\" for tls-alpn-01)")
 	objExpMs := flag.Uint64("obj_exp_ms", OBJECT_EXPIRATION_MS, "Object TTL in this server (in milliseconds)")
 	cacheCleanUpPeriodMs := flag.Uint64("cache_cleanup_period_ms", CACHE_CLEAN_UP_PERIOD_MS, "Execute clean up task every (in milliseconds)")
+	cacheMaxBytes := flag.Uint64("cache_max_bytes", CACHE_MAX_BYTES, "Max memory used by cached objects payloads, least recently used objects are evicted when reached, 0 unlimited (in bytes)")
+	cachePurgeOnUnAnnounce := flag.Bool("cache_purge_on_unannounce", CACHE_PURGE_ON_UNANNOUNCE, "Delete the cached objects of a namespace when its publisher sends UNANNOUNCE")
+	objDedupPolicy := flag.String("obj_dedup_policy", OBJ_DEDUP_POLICY, "What to do when an object already cached is received again, example redundant publishers (none: replace it and forward it again, key: discard it, payload: discard it if the payload is the same)")
+	cacheCompressNamespaces := flag.String("cache_compress_namespaces", CACHE_COMPRESS_NAMESPACES, "Comma separated list of namespaces which objects are compressed in the cache, useful for text-like tracks (chat, captions, catalogs)")
+	cacheDiskDir := flag.String("cache_disk_dir", CACHE_DISK_DIR, "Directory used as disk cache tier for the objects evicted from memory (or older than cache_disk_spill_after_s), empty disables it. WARNING: Objects files in that dir are deleted at start")
+	recordDir := flag.String("record_dir", RECORD_DIR, "Directory where the objects of record_namespaces are persisted (segmented files + index per track), independent of the cache TTL, empty disables recording")
+	recordNamespaces := flag.String("record_namespaces", RECORD_NAMESPACES, "Comma separated list of namespaces recorded to record_dir, exact or wildcard (example: \"live/*\")")
+	recordSegmentMaxBytes := flag.Uint64("record_segment_max_bytes", RECORD_SEGMENT_MAX_BYTES, "Recorded tracks start a new segment file when the current one reaches this size, 0 no limit (in bytes)")
+	recordSegmentMaxMs := flag.Uint64("record_segment_max_ms", RECORD_SEGMENT_MAX_MS, "Recorded tracks start a new segment file when the current one is older than this, 0 no limit (in milliseconds)")
+	replayTrackDirs := flag.String("replay_track_dirs", REPLAY_TRACK_DIRS, "Comma separated list of recorded track dirs (see record_dir) played back as a live publisher with the original pacing, empty disables it (example: \"./rec/live/video,./rec/live/audio\")")
+	replayNamespace := flag.String("replay_namespace", REPLAY_NAMESPACE, "Namespace announced by the replay publisher, empty uses the recorded one")
+	cmafIngestListenAddr := flag.String("cmaf_ingest_addr", CMAF_INGEST_LISTEN_ADDR, "Plain HTTP (TCP) listen address of the CMAF ingest (PUT / POST /cmaf/[track]/[file name], every request is a segment), empty disables it (example: \":8083\")")
+	cmafIngestPipe := flag.String("cmaf_ingest_pipe", CMAF_INGEST_PIPE, "File / FIFO with a continuous fMP4 (CMAF) stream published in cmaf_ingest_pipe_track (\"-\" reads stdin), empty disables it")
+	cmafIngestPipeTrack := flag.String("cmaf_ingest_pipe_track", CMAF_INGEST_PIPE_TRACK, "Track name of the stream read from cmaf_ingest_pipe")
+	cmafIngestNamespace := flag.String("cmaf_ingest_namespace", CMAF_INGEST_NAMESPACE, "Namespace announced by the CMAF ingest, every segment is a group and every chunk (moof + mdat) an object")
+	cmafIngestInitTrackSuffix := flag.String("cmaf_ingest_init_track_suffix", CMAF_INGEST_INIT_TRACK_SUFFIX, "Init segments (ftyp + moov) are published in the track name + this suffix (same as hls_init_track_suffix)")
+	replayLoop := flag.Bool("replay_loop", REPLAY_LOOP, "Start the replay again when the recording ends (group sequences keep increasing)")
+	cacheDiskSpillAfterS := flag.Uint64("cache_disk_spill_after_s", CACHE_DISK_SPILL_AFTER_S, "Move objects older than this to the disk tier, 0 only evicted objects are moved (in seconds)")
+	cacheQuotasConfigFile := flag.String("cache_quotas_config", CACHE_QUOTAS_FILEPATH, "Json file with the cache quotas (max bytes, max objects), default and per namespace, objects over quota are dropped")
+	corsAllowedOrigins := flag.String("cors_allowed_origins", CORS_ALLOWED_ORIGINS, "Web origins allowed to open WebTransport sessions, comma separated, exact or wildcard (example: \"https://player.example.com,https://*.example.com\"). Requests without Origin header (non browser) are always allowed. Empty allows all")
 	httpConnTimeoutMs := flag.Uint64("http_conn_time_out_ms", HTTP_CONNECTION_KEEP_ALIVE_MS, "HTTP connection timeout (in milliseconds)")
-	moqOriginsConfigFile := flag.String("moq_origins_config", MOQ_ORIGINS_FILEPATH, "Json file with list of MOQ content origins")
+	quicStatsEnabled := flag.Bool("quic_stats", QUIC_STATS, "Collect QUIC transport stats per connection (RTT, congestion window, lost packets, streams), shown in the session info of the admin API")
+	sessionStallTimeoutMs := flag.Uint64("session_stall_timeout_ms", SESSION_STALL_TIMEOUT_MS, "Close sessions without any control / object activity for this time, 0 disables it (in milliseconds)")
+	publisherAnnounceTimeoutMs := flag.Uint64("publisher_announce_timeout_ms", PUBLISHER_ANNOUNCE_TIMEOUT_MS, "Close publisher sessions that do not ANNOUNCE within this time after setup, 0 disables it (in milliseconds)")
+	subscriberSubscribeTimeoutMs := flag.Uint64("subscriber_subscribe_timeout_ms", SUBSCRIBER_SUBSCRIBE_TIMEOUT_MS, "Close subscriber sessions that do not SUBSCRIBE within this time after setup, 0 disables it (in milliseconds)")
+	sessionObjectsIdleTimeoutMs := flag.Uint64("session_objects_idle_timeout_ms", SESSION_OBJECTS_IDLE_TIMEOUT_MS, "Close sessions that do not receive / send any object for this time, 0 disables it (in milliseconds)")
+	validateObjSequences := flag.Bool("validate_obj_sequences", VALIDATE_OBJ_SEQUENCES, "Warn about duplicated objects or groups jumping backwards from publishers")
+	bandwidthBudgetBps := flag.Uint64("bandwidth_budget_bps", BANDWIDTH_BUDGET_BPS, "Relay wide ingest + egress budget, new sessions are rejected when saturated, 0 unlimited (in bits per second)")
+	maxSessions := flag.Int("max_sessions", MAX_SESSIONS, "Max concurrent sessions, new ones are rejected with 503, 0 unlimited")
+	maxSessionsPerIp := flag.Int("max_sessions_per_ip", MAX_SESSIONS_PER_IP, "Max concurrent sessions from the same IP, new ones are rejected with 503, 0 unlimited")
+	ipAllowList := flag.String("ip_allow_list", IP_ALLOW_LIST, "Only these IPs / CIDRs can open sessions, comma separated (example: \"10.0.0.0/8,2001:db8::/32\"). Empty allows all")
+	ipDenyList := flag.String("ip_deny_list", IP_DENY_LIST, "IPs / CIDRs that can NOT open sessions (rejected with 403), comma separated, it wins over ip_allow_list")
+	sessionRatePerIp := flag.Float64("session_rate_per_ip", SESSION_RATE_PER_IP, "New sessions per second allowed from the same IP, over it they are rejected with 429, 0 unlimited")
+	sessionBurstPerIp := flag.Uint64("session_burst_per_ip", SESSION_BURST_PER_IP, "New sessions an IP can open in a burst over session_rate_per_ip")
+	subscribeRatePerIp := flag.Float64("subscribe_rate_per_ip", SUBSCRIBE_RATE_PER_IP, "SUBSCRIBE messages per second allowed from the same IP (all its sessions), over it they are answered with SUBSCRIBE_ERROR, 0 unlimited")
+	subscribeBurstPerIp := flag.Uint64("subscribe_burst_per_ip", SUBSCRIBE_BURST_PER_IP, "SUBSCRIBE messages an IP can send in a burst over subscribe_rate_per_ip")
+	subscriberObjQueueSize := flag.Int("subscriber_obj_queue_size", SUBSCRIBER_OBJ_QUEUE_SIZE, "Max objects waiting to be sent per subscriber")
+	subscriberObjQueuePolicy := flag.String("subscriber_obj_queue_policy", SUBSCRIBER_OBJ_QUEUE_POLICY, "What to do when a subscriber objects queue is full (drop-oldest, drop-lowest-priority, disconnect-slow-subscriber)")
+	subscriberSkipToLatestGroup := flag.Bool("subscriber_skip_to_latest_group", SUBSCRIBER_SKIP_TO_LATEST_GROUP, "When a new group starts, drop the queued objects of older groups of that track (live)")
+	subscriberRateBps := flag.Uint64("subscriber_rate_bps", SUBSCRIBER_RATE_BPS, "Send rate limit per subscriber session, 0 unlimited (in bits per second)")
+	subscriberBurstBytes := flag.Uint64("subscriber_burst_bytes", SUBSCRIBER_BURST_BYTES, "Bytes a subscriber session can send in a burst over its rate limit")
+	subscriberRateMaxWaitMs := flag.Uint64("subscriber_rate_max_wait_ms", SUBSCRIBER_RATE_MAX_WAIT_MS, "Max time an object is delayed by the subscriber rate limit before dropping it, objects are also dropped if higher priority ones are waiting (in milliseconds)")
+	subscriberPriorityMaxWaitMs := flag.Uint64("subscriber_priority_max_wait_ms", SUBSCRIBER_PRIORITY_MAX_WAIT_MS, "Max time an object stream waits for the higher priority streams (lower send order, newer group) of the same subscriber to be written before dropping it, 0 waits forever (in milliseconds)")
+	subscriberEgressWorkers := flag.Int("subscriber_egress_workers", SUBSCRIBER_EGRESS_WORKERS, "Relay wide goroutines that send the objects to subscribers, 0 a goroutine per object (unbounded)")
+	subscriberEgressQueueSize := flag.Int("subscriber_egress_queue_size", SUBSCRIBER_EGRESS_QUEUE_SIZE, "Objects waiting for an egress worker (all subscribers), over it they are dropped")
+	subscriberBatchMaxObjectBytes := flag.Uint64("subscriber_batch_max_object_bytes", SUBSCRIBER_BATCH_MAX_OBJECT_BYTES, "Consecutive objects of the same track / group up to this size are sent to subscribers in a shared stream, with their payload length (message type 0x2, the subscribers have to support it), 0 disabled (a stream per object)")
+	publisherIngestWorkers := flag.Int("publisher_ingest_workers", PUBLISHER_INGEST_WORKERS, "Relay wide goroutines that receive the object streams of publishers, 0 a goroutine per stream (unbounded)")
+	publisherIngestQueueSize := flag.Int("publisher_ingest_queue_size", PUBLISHER_INGEST_QUEUE_SIZE, "Object streams waiting for an ingest worker (all publishers), over it they are rejected (reset)")
+	relayId := flag.String("relay_id", RELAY_ID, "Unique ID of this relay used for loop detection (default: random)")
+	subscribeResponseTimeoutMs := flag.Uint64("subscribe_response_timeout_ms", SUBSCRIBE_RESPONSE_TIMEOUT_MS, "Time to wait for a publisher to answer a forwarded SUBSCRIBE (in milliseconds)")
+	subscribeNegativeCacheMs := flag.Uint64("subscribe_negative_cache_ms", SUBSCRIBE_NEGATIVE_CACHE_MS, "Time a failed upstream SUBSCRIBE (no publishers or timeout) is remembered, new subscribes of that track are rejected meanwhile, 0 disabled (in milliseconds)")
+	subscriptionAutoRenew := flag.Bool("subscription_auto_renew", SUBSCRIPTION_AUTO_RENEW, "Renew upstream subscriptions when SUBSCRIBE_OK Expires is reached (subscribers receive Expires 0), if not they are ended with SUBSCRIBE_RST")
+	duplicateSubscribePolicy := flag.String("duplicate_subscribe_policy", DUPLICATE_SUBSCRIBE_POLICY, "What to do when a session subscribes again to the same track (reject: SUBSCRIBE_ERROR, update: replace the subscription params keeping its track alias)")
+	moqOriginsConfigFile := flag.String("moq_origins_config", MOQ_ORIGINS_FILEPATH, "Json (or YAML / TOML by extension) file with list of MOQ content origins")
+	originLazyIdleTimeoutMs := flag.Uint64("origin_lazy_idle_timeout_ms", ORIGIN_LAZY_IDLE_TIMEOUT_MS, "On demand (lazy) origins are disconnected after this time without subscriptions (in milliseconds)")
+	originWarmPoolSize := flag.Int("origin_warm_pool_size", ORIGIN_WARM_POOL_SIZE, "Idle on demand (lazy) origin sessions kept connected after the idle timeout, the most used origins first (0 disabled)")
+	originWarmPoolTtlMs := flag.Uint64("origin_warm_pool_ttl_ms", ORIGIN_WARM_POOL_TTL_MS, "Max time an idle on demand origin session is kept connected in the warm pool (in milliseconds)")
+	announcePoliciesConfigFile := flag.String("announce_policies_config", ANNOUNCE_POLICIES_FILEPATH, "Json file with the policy to apply when a namespace is announced twice (reject-second, replace-primary, active-standby), default and per namespace (default: reject-second)")
+	authorizerConfigFile := flag.String("authorizer_config", AUTHORIZER_FILEPATH, "Json file with the authorizer of ANNOUNCE / SUBSCRIBE auth info (allowall, tokens, hmac) (default: allow everything)")
+	endpointsConfigFile := flag.String("endpoints_config", ENDPOINTS_FILEPATH, "Json file with the WebTransport endpoints (URL paths) and their allowed roles, auth requirement and namespace (default: /moq allowing everything)")
+	healthListenAddr := flag.String("health_addr", HEALTH_LISTEN_ADDR, "Plain HTTP (TCP) listen address for load balancer probes /healthz and /readyz, empty disables it (example: \":8081\")")
+	adminListenAddr := flag.String("admin_addr", ADMIN_LISTEN_ADDR, "Admin API listen address, empty disables it (example: \"127.0.0.1:8080\")")
+	metricsListenAddr := flag.String("metrics_addr", METRICS_LISTEN_ADDR, "Prometheus metrics listen address (serves /metrics), empty disables it (example: \"127.0.0.1:9090\")")
+	debugListenAddr := flag.String("debug_addr", DEBUG_LISTEN_ADDR, "pprof and runtime debug endpoints listen address (/debug/pprof/, /debug/runtime, /debug/goroutines), empty disables it, use a private address (example: \"127.0.0.1:6060\")")
+	hlsListenAddr := flag.String("hls_addr", HLS_LISTEN_ADDR, "Plain HTTP (TCP) listen address of the LL-HLS gateway (/hls/playlist.m3u8?namespace=...&track=...), serves the cached tracks to legacy players, empty disables it (example: \":8082\")")
+	hlsPlaylistSegments := flag.Int("hls_playlist_segments", HLS_PLAYLIST_SEGMENTS, "LL-HLS completed segments (groups) listed in the playlists")
+	hlsPartTargetMs := flag.Uint64("hls_part_target_ms", HLS_PART_TARGET_MS, "LL-HLS min part target duration, parts are objects and their duration is estimated from their arrival times (in milliseconds)")
+	hlsBlockingTimeoutMs := flag.Uint64("hls_blocking_timeout_ms", HLS_BLOCKING_TIMEOUT_MS, "LL-HLS max time blocking playlist reloads and preload hint parts wait (in milliseconds)")
+	hlsInitTrackSuffix := flag.String("hls_init_track_suffix", HLS_INIT_TRACK_SUFFIX, "LL-HLS tracks are fMP4 (CMAF) and their init segment is the latest object of the track name + this suffix (example: \".init\"), empty tracks are MPEG-TS")
+	httpOriginListenAddr := flag.String("http_origin_addr", HTTP_ORIGIN_LISTEN_ADDR, "HTTPS (TCP) listen address that serves the cached objects (/objects/[namespace]/[track]/[group]/[object]) with Cache-Control from the object max age, so a CDN can front the relay, same TLS config as the relay, empty disables it (example: \":8443\")")
+	adminTokensConfigFile := flag.String("admin_tokens_config", ADMIN_TOKENS_FILEPATH, "Json file with list of admin API tokens and their scopes")
+	shutdownDrainMs := flag.Uint64("shutdown_drain_ms", SHUTDOWN_DRAIN_MS, "On SIGTERM / ctrl+C stop accepting sessions, send GOAWAY and wait up to this time for sessions to finish before closing them (in milliseconds)")
+	adminEventsSummaryPeriodMs := flag.Uint64("admin_events_summary_period_ms", ADMIN_EVENTS_SUMMARY_PERIOD_MS, "Period of the per track stats summaries sent to /admin/events clients, 0 disables them (in milliseconds)")
+	eventsExportUrl := flag.String("events_export_url", EVENTS_EXPORT_URL, "Event bus where the session / track lifecycle events are published: NATS (nats://[user:pass@]host:port/[subject prefix]) or Kafka REST proxy (http(s)://host:port/topics/[topic]), empty disables it")
+	eventsTrackIdleTimeoutMs := flag.Uint64("events_track_idle_timeout_ms", EVENTS_TRACK_IDLE_TIMEOUT_MS, "A track without objects for this time generates a track idle event (the next object generates a first object event again), 0 disables the track events (in milliseconds)")
+	clusterBusUrl := flag.String("cluster_bus_url", CLUSTER_BUS_URL, "Pub/sub bus shared by the relay instances of a cluster, they share their announced namespaces and received objects so subscribers of any instance get the objects published in another one: NATS (nats://[user:pass@]host:port/[subject]) or Redis (redis://[user:pass@]host:port/[channel]), empty disables it")
+	clusterFetchUrl := flag.String("cluster_fetch_url", CLUSTER_FETCH_URL, "Base URL of the HTTP origin (http_origin_addr) of this instance reachable by the other cluster instances, they fetch its objects from it (example: \"https://relay-1.example.com:8443\"), required by cluster_bus_url (NOT used when sharding)")
+	clusterFetchToken := flag.String("cluster_fetch_token", CLUSTER_FETCH_TOKEN, "Token sent (Authorization: Bearer) when fetching objects from the other cluster instances, if their HTTP origins use an authorizer")
+	clusterFetchAllowedHosts := flag.String("cluster_fetch_allowed_hosts", CLUSTER_FETCH_ALLOWED_HOSTS, "Hosts of the HTTP origins of the other cluster instances objects are fetched from, comma separated host (any port), host:port or *.domain (example: \"*.relays.internal,relay-1.example.com:8443\"), required when NOT sharding")
+	clusterFetchCaPath := flag.String("cluster_fetch_ca", CLUSTER_FETCH_CA_FILEPATH, "PEM CA bundle (added to the system ones) to verify the HTTP origins (or the relay URLs when sharding) of the other cluster instances")
+	clusterSharding := flag.Bool("cluster_sharding", CLUSTER_SHARDING, "Assign every namespace to one cluster instance (consistent hashing), the others proxy its publishers and subscribers to it with relay sessions instead of sharing every object through the bus (all instances need the same mode)")
+	clusterRelayUrl := flag.String("cluster_relay_url", CLUSTER_RELAY_URL, "MoQ URL of this instance reachable by the other cluster instances, they connect to it for the namespaces it owns (example: \"https://relay-1.example.com:4433/moq\"), required by cluster_sharding")
+	meshBindAddr := flag.String("mesh_bind_addr", MESH_BIND_ADDR, "UDP listen address of the mesh gossip, the relays of the mesh discover each other, exchange their announced namespaces and connect to each other on demand (no origins config needed per peer), empty disables it (example: \":7946\")")
+	meshAdvertiseAddr := flag.String("mesh_advertise_addr", MESH_ADVERTISE_ADDR, "UDP address (host:port) the other mesh relays send the gossip to, empty the source address of the gossip of this relay")
+	meshSeeds := flag.String("mesh_seeds", MESH_SEEDS, "Comma separated gossip addresses (host:port) of some mesh relays used to join the mesh (example: \"relay-1.example.com:7946,relay-2.example.com:7946\")")
+	meshRelayUrl := flag.String("mesh_relay_url", MESH_RELAY_URL, "MoQ URL of this relay reachable by the other mesh relays, they connect to it to subscribe to its namespaces (example: \"https://relay-1.example.com:4433/moq\"), required by mesh_bind_addr")
+	meshSecret := flag.String("mesh_secret", MESH_SECRET, "Secret shared by the mesh relays, the gossip is signed with it (HMAC-SHA256) and the unsigned one ignored, empty NOT signed")
+	meshCaPath := flag.String("mesh_ca", MESH_CA_FILEPATH, "PEM CA bundle (added to the system ones) to verify the relay URLs of the other mesh relays")
+	adminAuditLogFile := flag.String("admin_audit_log", ADMIN_AUDIT_LOG_FILEPATH, "File to append admin API audit log (default: stderr)")
+	logLevel := flag.String("log_level", LOG_LEVEL, "Log level (panic, fatal, error, warn, info, debug, trace)")
+	logFormat := flag.String("log_format", LOG_FORMAT, "Log format (text, json). In json session messages are emitted with structured fields (session, namespace, track, etc)")
+	logObjSampleIngest := flag.Uint64("log_obj_sample_ingest", LOG_OBJ_SAMPLE_INGEST, "Per object Info logs of received objects, logs 1 in N objects per track (1 all, 0 none). Errors / warnings are always logged")
+	logObjSampleEgress := flag.Uint64("log_obj_sample_egress", LOG_OBJ_SAMPLE_EGRESS, "Per object Info logs of sent objects, logs 1 in N objects per track and subscriber (1 all, 0 none). Errors / warnings are always logged")
+	configFile := flag.String("config", CONFIG_FILEPATH, "Unified config file (listener, TLS, cache, timeouts, origins, admin, logging), JSON, YAML (.yaml, .yml) or TOML (.toml), flags override its values. See ../config/example-config.json (.yaml, .toml)")
 
 	flag.Parse()
 
 	log.SetFormatter(&log.TextFormatter{})
 
+	errEnv := loadEnvVars()
+	if errEnv != nil {
+		log.Fatal(fmt.Sprintf("Invalid env var. Err: %v", errEnv))
+	}
+
+	if *configFile != "" {
+		errConfig := loadConfigFile(*configFile)
+		if errConfig != nil {
+			log.Fatal(fmt.Sprintf("Invalid config file %s. Err: %v", *configFile, errConfig))
+		}
+		log.Info(fmt.Sprintf("Loaded config file %s", *configFile))
+	}
+
+	level, errLevel := log.ParseLevel(*logLevel)
+	if errLevel != nil {
+		log.Fatal(fmt.Sprintf("Invalid log level: %s", *logLevel))
+	}
+	log.SetLevel(level)
+
+	formatter, errFormat := newLogFormatter(*logFormat)
+	if errFormat != nil {
+		log.Fatal(fmt.Sprintf("Invalid log format. Err: %v", errFormat))
+	}
+	log.SetFormatter(formatter)
+
 	ctx, cancel := context.WithCancel(context.Background())
 
+	clock := moqclock.New()
+
+	if *subscriberObjQueueSize <= 0 || !moqsession.IsValidObjQueuePolicy(moqsession.MoqObjQueuePolicy(*subscriberObjQueuePolicy)) {
+		log.Fatal(fmt.Sprintf("Invalid subscriber objects queue settings, size: %d, policy: %s", *subscriberObjQueueSize, *subscriberObjQueuePolicy))
+	}
+
+	if !moqmessageobjects.IsValidObjDedupPolicy(moqmessageobjects.MoqObjDedupPolicy(*objDedupPolicy)) {
+		log.Fatal(fmt.Sprintf("Invalid object dedup policy: %s", *objDedupPolicy))
+	}
+
+	if !moqsession.IsValidDuplicateSubscribePolicy(moqsession.MoqDuplicateSubscribePolicy(*duplicateSubscribePolicy)) {
+		log.Fatal(fmt.Sprintf("Invalid duplicate subscribe policy: %s", *duplicateSubscribePolicy))
+	}
+
+	if *relayId == "" {
+		*relayId = uuid.New().String()
+	}
+	log.Info(fmt.Sprintf("Relay ID: %s", *relayId))
+
 	// Create moqt obj forward table
-	moqtFwdTable := moqfwdtable.New()
+	moqtFwdTable := moqfwdtable.New(*relayId, *subscribeResponseTimeoutMs, *subscribeNegativeCacheMs, *subscriptionAutoRenew, clock)
+
+	// Load duplicated announce policies
+	errAnnouncePolicies := loadAndInitializeAnnouncePolicies(*announcePoliciesConfigFile, moqtFwdTable)
+	if errAnnouncePolicies != nil {
+		log.Error(fmt.Sprintf("Can not load/parse announce policies from file %s. Err: %s", *announcePoliciesConfigFile, errAnnouncePolicies))
+	}
 
 	// create objects mem storage (relay)
-	objects := moqmessageobjects.New(*cacheCleanUpPeriodMs)
+	objects := moqmessageobjects.New(*cacheCleanUpPeriodMs, *cacheMaxBytes, clock)
+
+	objects.SetDedupPolicy(moqmessageobjects.MoqObjDedupPolicy(*objDedupPolicy))
+	if *cacheCompressNamespaces != "" {
+		objects.SetCompressedNamespaces(strings.Split(*cacheCompressNamespaces, ","))
+	}
+
+	// Disk cache tier
+	if *cacheDiskDir != "" {
+		disk, errDisk := moqdiskcache.New(*cacheDiskDir)
+		if errDisk != nil {
+			log.Fatal(fmt.Sprintf("Can not create disk cache tier at %s. Err: %v", *cacheDiskDir, errDisk))
+		}
+		objects.SetDiskTier(disk, *cacheDiskSpillAfterS)
+	}
+
+	// DVR recording
+	var recorder *moqrecorder.MoqRecorder = nil
+	if *recordDir != "" && *recordNamespaces != "" {
+		var errRecorder error
+		recorder, errRecorder = moqrecorder.New(moqrecorder.MoqRecorderConfig{Dir: *recordDir, TrackNamespaces: strings.Split(*recordNamespaces, ","), SegmentMaxBytes: *recordSegmentMaxBytes, SegmentMaxMs: *recordSegmentMaxMs}, clock)
+		if errRecorder != nil {
+			log.Fatal(fmt.Sprintf("Can not start recording to %s. Err: %v", *recordDir, errRecorder))
+		}
+	}
+
+	// Load per namespace cache quotas
+	errCacheQuotas := loadAndInitializeCacheQuotas(*cacheQuotasConfigFile, objects)
+	if errCacheQuotas != nil {
+		log.Error(fmt.Sprintf("Can not load/parse cache quotas from file %s. Err: %s", *cacheQuotasConfigFile, errCacheQuotas))
+	}
+
+	// Relay wide bandwidth budget
+	bandwidth := moqbandwidth.New(*bandwidthBudgetBps, clock)
+
+	// Concurrent sessions limits
+	admission := moqadmission.New(*maxSessions, *maxSessionsPerIp)
+
+	// IP allow / deny lists and per IP rate limits (connection floods)
+	ipFilter, errIpFilter := moqadmission.NewIpFilter(strings.Split(*ipAllowList, ","), strings.Split(*ipDenyList, ","))
+	if errIpFilter != nil {
+		log.Fatal(fmt.Sprintf("Invalid IP allow / deny lists. Err: %v", errIpFilter))
+	}
+	var sessionRateLimiter *moqadmission.MoqIpRateLimiter = nil
+	if *sessionRatePerIp > 0 {
+		sessionRateLimiter = moqadmission.NewIpRateLimiter(*sessionRatePerIp, *sessionBurstPerIp, clock)
+	}
+	var subscribeRateLimiter *moqadmission.MoqIpRateLimiter = nil
+	if *subscribeRatePerIp > 0 {
+		subscribeRateLimiter = moqadmission.NewIpRateLimiter(*subscribeRatePerIp, *subscribeBurstPerIp, clock)
+	}
+
+	// Bounded workers for object streams
+	var ingestPool *moqworkerpool.MoqWorkerPool = nil
+	if *publisherIngestWorkers > 0 {
+		ingestPool = moqworkerpool.New(*publisherIngestWorkers, *publisherIngestQueueSize)
+	}
+	var egressPool *moqworkerpool.MoqWorkerPool = nil
+	if *subscriberEgressWorkers > 0 {
+		egressPool = moqworkerpool.New(*subscriberEgressWorkers, *subscriberEgressQueueSize)
+	}
+
+	// Prometheus metrics (relay counters are always updated, served only if metrics_addr is set)
+	moqMetrics := moqmetrics.New(*metricsListenAddr)
+	relayMetrics := moqmetrics.NewRelayMetrics(moqMetrics)
+
+	// Application / plugin hooks (register them here, ex: moqHooks.Register(myHooks))
+	moqHooks := moqhooks.New()
+
+	// QUIC transport stats (shown per session)
+	var quicStats *moqquicstats.MoqQuicStats = nil
+	if *quicStatsEnabled {
+		quicStats = moqquicstats.New()
+	}
+
+	// Relay events stream (served by the admin API and / or exported to an event bus)
+	var moqEvents *moqevents.MoqEvents = nil
+	if *adminListenAddr != "" || *eventsExportUrl != "" {
+		moqEvents = moqevents.New(clock)
+		moqEvents.StartTrackIdleCheck(*eventsTrackIdleTimeoutMs)
+	}
+	var eventsExport *moqeventsexport.MoqEventsExport = nil
+	if *eventsExportUrl != "" {
+		var errEventsExport error
+		eventsExport, errEventsExport = moqeventsexport.New(*eventsExportUrl, *relayId, clock)
+		if errEventsExport != nil {
+			log.Fatal(fmt.Sprintf("Can not start events export. Err: %v", errEventsExport))
+		}
+		moqEvents.AddExporter(eventsExport)
+	}
+
+	// ANNOUNCE / SUBSCRIBE authorization
+	authorizer, errAuthorizer := loadAuthorizer(*authorizerConfigFile, clock)
+	if errAuthorizer != nil {
+		log.Fatal(fmt.Sprintf("Loading authorizer config. Err: %v", errAuthorizer))
+	}
+
+	// Settings for every MOQ connection
+	connConfig := moqconnectionmanagment.MoqConnectionConfig{ObjExpMs: *objExpMs, StallTimeoutMs: *sessionStallTimeoutMs, PublisherAnnounceTimeoutMs: *publisherAnnounceTimeoutMs, SubscriberSubscribeTimeoutMs: *subscriberSubscribeTimeoutMs, ObjectsIdleTimeoutMs: *sessionObjectsIdleTimeoutMs, ValidateObjSequences: *validateObjSequences, Bandwidth: bandwidth, ObjQueueSize: *subscriberObjQueueSize, ObjQueuePolicy: moqsession.MoqObjQueuePolicy(*subscriberObjQueuePolicy), SkipToLatestGroup: *subscriberSkipToLatestGroup, SubscriberRateBps: *subscriberRateBps, SubscriberBurstBytes: *subscriberBurstBytes, SubscriberRateMaxWaitMs: *subscriberRateMaxWaitMs, SubscriberPriorityMaxWaitMs: *subscriberPriorityMaxWaitMs, EgressBatchMaxObjectBytes: *subscriberBatchMaxObjectBytes, DuplicateSubscribePolicy: moqsession.MoqDuplicateSubscribePolicy(*duplicateSubscribePolicy), PurgeCacheOnUnAnnounce: *cachePurgeOnUnAnnounce, OriginLazyIdleTimeoutMs: *originLazyIdleTimeoutMs, OriginWarmPoolSize: *originWarmPoolSize, OriginWarmPoolTtlMs: *originWarmPoolTtlMs, DrainChannel: make(chan bool), DrainMs: *shutdownDrainMs, Metrics: relayMetrics, Events: moqEvents, Authorizer: authorizer, Hooks: moqHooks, SubscribeRateLimiter: subscribeRateLimiter, QuicStats: quicStats, Recorder: recorder, IngestPool: ingestPool, EgressPool: egressPool, IngestLogSampler: moqlogsampler.New(*logObjSampleIngest), EgressLogSampler: moqlogsampler.New(*logObjSampleEgress), Clock: clock}
 
 	// Load and create origins
-	moqOrigins, errOrigins := loadAndInitializeMoqOrigins(*moqOriginsConfigFile, moqtFwdTable, objects, *objExpMs)
+	moqOrigins, errOrigins := loadAndInitializeMoqOrigins(*moqOriginsConfigFile, moqtFwdTable, objects, connConfig)
 	if errOrigins != nil {
 		log.Error(fmt.Sprintf("Can not load/parse origins data from file %s. Err: %s", *moqOriginsConfigFile, errOrigins))
 	} else {
 		log.Info(fmt.Sprintf("Loaded origins: %s", moqOrigins.ToString()))
 	}
 
+	// Replay recorded tracks as a local publisher
+	var moqReplay *moqreplay.MoqReplay = nil
+	if *replayTrackDirs != "" {
+		var errReplay error
+		moqReplay, errReplay = moqreplay.New(moqreplay.MoqReplayConfig{TrackDirs: strings.Split(*replayTrackDirs, ","), TrackNamespace: *replayNamespace, Loop: *replayLoop}, moqtFwdTable, objects, connConfig)
+		if errReplay != nil {
+			log.Fatal(fmt.Sprintf("Can not start replay of %s. Err: %v", *replayTrackDirs, errReplay))
+		}
+	}
+
+	// Relay instances cluster (shares namespaces and objects through the bus, or proxies them to the namespace owners when sharding)
+	var moqCluster *moqcluster.MoqCluster = nil
+	if *clusterBusUrl != "" {
+		var errCluster error
+		moqCluster, errCluster = moqcluster.New(moqcluster.MoqClusterConfig{BusUrl: *clusterBusUrl, RelayId: *relayId, FetchUrl: *clusterFetchUrl, FetchToken: *clusterFetchToken, FetchAllowedHosts: strings.Split(*clusterFetchAllowedHosts, ","), FetchCAPath: *clusterFetchCaPath, Sharding: *clusterSharding, RelayUrl: *clusterRelayUrl}, moqtFwdTable, objects, moqOrigins, connConfig)
+		if errCluster != nil {
+			log.Fatal(fmt.Sprintf("Can not start cluster. Err: %v", errCluster))
+		}
+		if !*clusterSharding && *httpOriginListenAddr == "" {
+			log.Warning("Cluster enabled without http_origin_addr, the other instances can NOT fetch the objects of this one")
+		}
+		moqHooks.Register(moqCluster)
+	}
+
+	// Relays mesh (gossip membership, on demand sessions to the relays that announce the namespaces)
+	var moqMesh *moqmesh.MoqMesh = nil
+	if *meshBindAddr != "" {
+		var errMesh error
+		moqMesh, errMesh = moqmesh.New(moqmesh.MoqMeshConfig{BindAddr: *meshBindAddr, AdvertiseAddr: *meshAdvertiseAddr, Seeds: strings.Split(*meshSeeds, ","), RelayId: *relayId, RelayUrl: *meshRelayUrl, Secret: *meshSecret, CAPath: *meshCaPath}, moqtFwdTable, moqOrigins, clock)
+		if errMesh != nil {
+			log.Fatal(fmt.Sprintf("Can not start mesh. Err: %v", errMesh))
+		}
+	}
+
+	if *metricsListenAddr != "" {
+		registerMetricsCollectors(moqMetrics, moqtFwdTable, objects, admission, bandwidth, moqOrigins, ingestPool, egressPool, moqCluster, moqMesh)
+		go func() {
+			errMetricsSvr := moqMetrics.ListenAndServe()
+			if errMetricsSvr != nil {
+				log.Error(fmt.Sprintf("Error starting metrics server. Err: %v", errMetricsSvr))
+			}
+		}()
+	}
+
+	// Profiling / runtime debug
+	var moqDebug *moqdebug.MoqDebug = nil
+	if *debugListenAddr != "" {
+		moqDebug = moqdebug.New(*debugListenAddr, DEBUG_MODULE_PREFIXES, func() int {
+			return len(moqtFwdTable.ListSessions(moqhelpers.MoqRoleNotSet, "", ""))
+		}, clock)
+		go func() {
+			errDebugSvr := moqDebug.ListenAndServe()
+			if errDebugSvr != nil {
+				log.Error(fmt.Sprintf("Error starting debug server. Err: %v", errDebugSvr))
+			}
+		}()
+	}
+
+	// Admin API
+	var moqAdmin *moqadmin.MoqAdmin = nil
+	if *adminListenAddr != "" {
+		var errAdmin error
+		moqAdmin, errAdmin = loadAndInitializeMoqAdmin(*adminListenAddr, *adminTokensConfigFile, *adminAuditLogFile)
+		if errAdmin != nil {
+			log.Error(fmt.Sprintf("Can not start admin API. Err: %s", errAdmin))
+		} else {
+			registerAdminHandlers(moqAdmin, moqtFwdTable, objects, admission, moqOrigins, *moqOriginsConfigFile, moqEvents, recorder, moqMesh)
+			moqEvents.StartSummaries(*adminEventsSummaryPeriodMs, moqevents.MoqEventTypeTracks, func() interface{} {
+				return moqtFwdTable.Stats()
+			})
+			go func() {
+				errAdminSvr := moqAdmin.ListenAndServe()
+				if errAdminSvr != nil {
+					log.Error(fmt.Sprintf("Error starting admin API server. Err: %v", errAdminSvr))
+				}
+			}()
+		}
+	}
+
+	checkCORSOrigin, errCORS := newCORSOriginChecker(strings.Split(*corsAllowedOrigins, ","))
+	if errCORS != nil {
+		log.Fatal(fmt.Sprintf("Invalid CORS allowed origins. Err: %v", errCORS))
+	}
+
 	s := webtransport.Server{
-		CheckOrigin: CheckCORSOrigin,
+		CheckOrigin: checkCORSOrigin,
 		H3: http3.Server{Addr: *listenAddr,
 			QuicConfig: &quic.Config{
 				KeepAlivePeriod: time.Duration(*httpConnTimeoutMs/1000) * time.Second,
 				MaxIdleTimeout:  time.Duration(3*(*httpConnTimeoutMs/1000)) * time.Second,
+				Tracer:          quicStats.GetTracer(),
 			}}}
 
-	// Catch ctrl+C
-	c := make(chan os.Signal)
+	// Self-signed certificate (local development)
+	if *devMode {
+		if *acmeHosts != "" {
+			log.Fatal("Dev mode and ACME can NOT be used at the same time")
+		}
+		devCert, errDevCert := moqdevcert.Generate(clock.Now(), time.Duration(*devCertValidityMs)*time.Millisecond)
+		if errDevCert != nil {
+			log.Fatal(fmt.Sprintf("Can not generate dev certificate. Err: %v", errDevCert))
+		}
+		s.H3.TLSConfig = &tls.Config{Certificates: []tls.Certificate{devCert.Certificate}}
+		log.Info(fmt.Sprintf("Dev certificate for %s, valid until %s. SHA-256 hex: %s, base64: %s", strings.Join(moqdevcert.DEV_CERT_HOSTS, ", "), devCert.NotAfter.Format(time.RFC3339), devCert.GetFingerprintHex(), devCert.GetFingerprintBase64()))
+		fmt.Printf("\nWebTransport option for the dev certificate:\n%s\n\n", devCert.GetServerCertificateHashesJs())
+	}
+
+	// Certificates from ACME
+	var moqAcme *moqacme.MoqAcme = nil
+	if *acmeHosts != "" {
+		var errAcme error
+		moqAcme, errAcme = moqacme.New(strings.Split(*acmeHosts, ","), *acmeEmail, *acmeCacheDir, *acmeDirectoryUrl, moqacme.MoqAcmeChallenge(*acmeChallenge), *acmeChallengeAddr)
+		if errAcme != nil {
+			log.Fatal(fmt.Sprintf("Can not start ACME. Err: %v", errAcme))
+		}
+		s.H3.TLSConfig = moqAcme.GetTLSConfig()
+		go func() {
+			errAcmeSvr := moqAcme.ListenAndServe()
+			if errAcmeSvr != nil {
+				log.Error(fmt.Sprintf("Error starting ACME challenges server, certificates can NOT be obtained / renewed. Err: %v", errAcmeSvr))
+			}
+		}()
+	}
+
+	// Client certificates (mTLS)
+	clientCertIdentities, errClientCertIdentities := loadClientCertIdentitiesData(*clientCertIdentitiesConfigFile)
+	if errClientCertIdentities != nil {
+		log.Fatal(fmt.Sprintf("Can not load/parse client cert identities from file %s. Err: %s", *clientCertIdentitiesConfigFile, errClientCertIdentities))
+	}
+	if *tlsClientCaPath != "" {
+		if s.H3.TLSConfig == nil {
+			// Same as ListenAndServeTLS, it ignores TLSConfig
+			cert, errCert := tls.LoadX509KeyPair(*tlsCertPath, *tlsKeyPath)
+			if errCert != nil {
+				log.Fatal(fmt.Sprintf("Can not load TLS certificate. Err: %v", errCert))
+			}
+			s.H3.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		errClientCa := configureClientCerts(s.H3.TLSConfig, *tlsClientCaPath)
+		if errClientCa != nil {
+			log.Fatal(fmt.Sprintf("Can not load client CA %s. Err: %v", *tlsClientCaPath, errClientCa))
+		}
+	}
+
+	// Catch ctrl+C (drain sessions, a second signal closes immediately)
+	draining := atomic.Bool{}
+	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		log.Info(fmt.Sprintf("Intercepted KILL SIGTERM, draining sessions (%d) for up to %dms", admission.GetStats().Sessions, *shutdownDrainMs))
+		draining.Store(true)
+		close(connConfig.DrainChannel)
+
+		drainTimer := clock.NewTimer(time.Duration(*shutdownDrainMs) * time.Millisecond)
+		defer drainTimer.Stop()
+		checkTicker := clock.NewTicker(SHUTDOWN_DRAIN_CHECK_PERIOD_MS * time.Millisecond)
+		defer checkTicker.Stop()
+		bExit := false
+		for !bExit {
+			select {
+			case <-c:
+				log.Info("Intercepted second KILL SIGTERM, closing now")
+				bExit = true
+			case <-drainTimer.C():
+				log.Info(fmt.Sprintf("Drain time finished, closing remaining sessions (%d)", admission.GetStats().Sessions))
+				bExit = true
+			case <-checkTicker.C():
+				if admission.GetStats().Sessions <= 0 {
+					log.Info("All sessions finished")
+					bExit = true
+				}
+			}
+		}
 		// Exit server
-		log.Info("Intercepted KILL SIGTERM")
 		cancel()
 		s.Close()
 	}()
 
-	http.HandleFunc("/moq", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := s.Upgrade(w, r)
-		if err != nil {
-			log.Error(fmt.Sprintf("Upgrading failed. Err: %v", err))
-			w.WriteHeader(500)
-			return
+	// Reload origins config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info(fmt.Sprintf("Intercepted SIGHUP, reloading origins from %s", *moqOriginsConfigFile))
+			originsData, errOriginsReload := loadMoqOriginsData(*moqOriginsConfigFile)
+			if errOriginsReload != nil {
+				log.Error(fmt.Sprintf("Can not load/parse origins data from file %s, keeping current origins. Err: %s", *moqOriginsConfigFile, errOriginsReload))
+				continue
+			}
+			added, removed, changed := moqOrigins.Update(originsData)
+			log.Info(fmt.Sprintf("Reloaded origins (added: %d, removed: %d, changed: %d): %s", added, removed, changed, moqOrigins.ToString()))
 		}
+	}()
 
-		namespace := r.URL.Path
-		log.Info(fmt.Sprintf("%s - Accepted incoming WebTransport session. rawQuery: %s", namespace, r.URL.RawQuery))
+	// Endpoints (URL paths)
+	endpointsData, errEndpoints := loadEndpointsData(*endpointsConfigFile)
+	if errEndpoints != nil {
+		log.Fatal(fmt.Sprintf("Can not load/parse endpoints from file %s. Err: %s", *endpointsConfigFile, errEndpoints))
+	}
+	for _, endpoint := range endpointsData.Endpoints {
+		if endpoint.ClientCertRequired && *tlsClientCaPath == "" {
+			log.Fatal(fmt.Sprintf("Endpoint %s requires client certificates, tls_client_ca is needed", endpoint.Path))
+		}
+	}
 
-		moqconnectionmanagment.MoqConnectionManagment(false, "", "", ctx, conn, namespace, moqtFwdTable, objects, *objExpMs)
-	})
+	moqHandler := func(endpoint moqconnectionmanagment.MoqEndpointData) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// Admission control
+			ip := moqadmission.GetIp(r.RemoteAddr)
+			if !ipFilter.IsAllowed(ip) {
+				log.Warning(fmt.Sprintf("Rejected incoming WebTransport session from %s, IP NOT allowed", r.RemoteAddr))
+				admission.Reject(moqadmission.MoqRejectReasonIpDenied)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if sessionRateLimiter != nil && !sessionRateLimiter.Allow(ip) {
+				log.Warning(fmt.Sprintf("Rejected incoming WebTransport session from %s, too many new sessions from this IP", r.RemoteAddr))
+				admission.Reject(moqadmission.MoqRejectReasonSessionRate)
+				w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_S))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			if draining.Load() {
+				log.Warning(fmt.Sprintf("Rejected incoming WebTransport session from %s, relay draining", r.RemoteAddr))
+				admission.Reject(moqadmission.MoqRejectReasonDraining)
+				w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_S))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if bandwidth.IsSaturated() {
+				usage := bandwidth.GetUsage()
+				log.Warning(fmt.Sprintf("Rejected incoming WebTransport session, bandwidth budget saturated. Ingest: %d bps, egress: %d bps, budget: %d bps", usage.IngestBps, usage.EgressBps, usage.BudgetBps))
+				admission.Reject(moqadmission.MoqRejectReasonBandwidth)
+				w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_S))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if !checkCORSOrigin(r) {
+				log.Warning(fmt.Sprintf("Rejected incoming WebTransport session from %s, origin %s NOT allowed", r.RemoteAddr, r.Header.Get("Origin")))
+				admission.Reject(moqadmission.MoqRejectReasonOrigin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			clientCertIdentity := ""
+			var clientCertNamespaces []string = nil
+			if endpoint.ClientCertRequired {
+				if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+					log.Warning(fmt.Sprintf("Rejected incoming WebTransport session from %s, NO valid client certificate", r.RemoteAddr))
+					admission.Reject(moqadmission.MoqRejectReasonClientCert)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				found := false
+				clientCertIdentity, clientCertNamespaces, found = clientCertIdentities.GetClientCertNamespaces(r.TLS.PeerCertificates[0])
+				if !found {
+					log.Warning(fmt.Sprintf("Rejected incoming WebTransport session from %s, client certificate identities %v NOT allowed", r.RemoteAddr, moqconnectionmanagment.GetClientCertIdentities(r.TLS.PeerCertificates[0])))
+					admission.Reject(moqadmission.MoqRejectReasonClientCert)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+			_, errAdmission := admission.Acquire(ip)
+			if errAdmission != nil {
+				log.Warning(fmt.Sprintf("Rejected incoming WebTransport session from %s. Err: %v", r.RemoteAddr, errAdmission))
+				w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_S))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			defer admission.Release(ip)
 
-	log.Info(fmt.Sprintf("Serving WT. Addr: %s, Cert file: %s, Key file: %s", *listenAddr, *tlsCertPath, *tlsKeyPath))
-	errSvr := s.ListenAndServeTLS(*tlsCertPath, *tlsKeyPath)
+			metadata := moqsession.MoqSessionMetadata{RemoteAddr: r.RemoteAddr, UserAgent: r.UserAgent(), ClientCertIdentity: clientCertIdentity}
+			httpStreamer, isHttpStreamer := r.Body.(http3.HTTPStreamer)
+			if isHttpStreamer {
+				metadata.WtSessionId = uint64(httpStreamer.HTTPStream().StreamID())
+			}
+
+			conn, err := s.Upgrade(w, r)
+			if err != nil {
+				log.Error(fmt.Sprintf("Upgrading failed. Err: %v", err))
+				w.WriteHeader(500)
+				return
+			}
+
+			namespace := r.URL.Path
+			log.Info(fmt.Sprintf("%s - Accepted incoming WebTransport session. rawQuery: %s", namespace, r.URL.RawQuery))
+
+			endpointConnConfig := connConfig
+			endpointConnConfig.Endpoint = endpoint
+			endpointConnConfig.ClientCertNamespaces = clientCertNamespaces
+			moqconnectionmanagment.MoqConnectionManagment(false, "", "", ctx, conn, metadata, namespace, moqtFwdTable, objects, endpointConnConfig)
+		}
+	}
+	for _, endpoint := range endpointsData.Endpoints {
+		log.Info(fmt.Sprintf("Endpoint %s, roles: %v, auth required: %t, namespace: %s, client cert required: %t", endpoint.Path, endpoint.Roles, endpoint.AuthRequired, endpoint.TrackNamespace, endpoint.ClientCertRequired))
+		http.HandleFunc(endpoint.Path, moqHandler(endpoint))
+	}
+
+	// Health / readiness probes
+	serving := atomic.Bool{}
+	var moqHealth *moqhealth.MoqHealth = nil
+	if *healthListenAddr != "" {
+		moqHealth = moqhealth.New(*healthListenAddr)
+		registerHealthChecks(moqHealth, &serving, &draining, moqOrigins, objects)
+		go func() {
+			errHealthSvr := moqHealth.ListenAndServe()
+			if errHealthSvr != nil {
+				log.Error(fmt.Sprintf("Error starting health server. Err: %v", errHealthSvr))
+			}
+		}()
+	}
+
+	// CMAF ingest (standard encoders)
+	var moqCmafIngest *moqcmafingest.MoqCmafIngest = nil
+	if *cmafIngestListenAddr != "" || *cmafIngestPipe != "" {
+		cmafPublisher, errCmafPublisher := moqlocalpublisher.New(moqcmafingest.CMAF_SESSION_NAME, *cmafIngestNamespace, moqtFwdTable, objects, connConfig)
+		if errCmafPublisher != nil {
+			log.Fatal(fmt.Sprintf("Can not start CMAF ingest. Err: %v", errCmafPublisher))
+		}
+		moqCmafIngest = moqcmafingest.New(moqcmafingest.MoqCmafIngestConfig{ListenAddr: *cmafIngestListenAddr, PipePath: *cmafIngestPipe, PipeTrack: *cmafIngestPipeTrack, InitTrackSuffix: *cmafIngestInitTrackSuffix}, cmafPublisher, authorizer, clock)
+		go func() {
+			errCmafSvr := moqCmafIngest.ListenAndServe()
+			if errCmafSvr != nil {
+				log.Error(fmt.Sprintf("Error starting CMAF ingest server. Err: %v", errCmafSvr))
+			}
+		}()
+	}
+
+	// LL-HLS gateway (legacy players)
+	var moqHls *moqhls.MoqHls = nil
+	if *hlsListenAddr != "" {
+		moqHls = moqhls.New(moqhls.MoqHlsConfig{ListenAddr: *hlsListenAddr, PlaylistSegments: *hlsPlaylistSegments, PartTargetMs: *hlsPartTargetMs, BlockingTimeoutMs: *hlsBlockingTimeoutMs, InitTrackSuffix: *hlsInitTrackSuffix}, objects, authorizer, checkCORSOrigin, clock)
+		go func() {
+			errHlsSvr := moqHls.ListenAndServe()
+			if errHlsSvr != nil {
+				log.Error(fmt.Sprintf("Error starting LL-HLS server. Err: %v", errHlsSvr))
+			}
+		}()
+	}
+
+	// HTTP origin (CDN fronting)
+	var moqHttpOrigin *moqhttporigin.MoqHttpOrigin = nil
+	if *httpOriginListenAddr != "" {
+		moqHttpOrigin = moqhttporigin.New(moqhttporigin.MoqHttpOriginConfig{ListenAddr: *httpOriginListenAddr, CertPath: *tlsCertPath, KeyPath: *tlsKeyPath, TLSConfig: s.H3.TLSConfig}, objects, authorizer, checkCORSOrigin, clock)
+		go func() {
+			errHttpOriginSvr := moqHttpOrigin.ListenAndServe()
+			if errHttpOriginSvr != nil {
+				log.Error(fmt.Sprintf("Error starting HTTP origin server. Err: %v", errHttpOriginSvr))
+			}
+		}()
+	}
+
+	var errSvr error
+	serving.Store(true)
+	if *devMode {
+		log.Info(fmt.Sprintf("Serving WT. Addr: %s, dev certificate", *listenAddr))
+		errSvr = s.ListenAndServe()
+	} else if moqAcme != nil {
+		log.Info(fmt.Sprintf("Serving WT. Addr: %s, ACME hosts: %s", *listenAddr, *acmeHosts))
+		errSvr = s.ListenAndServe()
+	} else if s.H3.TLSConfig != nil {
+		log.Info(fmt.Sprintf("Serving WT. Addr: %s, Cert file: %s, Key file: %s, client CA: %s", *listenAddr, *tlsCertPath, *tlsKeyPath, *tlsClientCaPath))
+		errSvr = s.ListenAndServe()
+	} else {
+		log.Info(fmt.Sprintf("Serving WT. Addr: %s, Cert file: %s, Key file: %s", *listenAddr, *tlsCertPath, *tlsKeyPath))
+		errSvr = s.ListenAndServeTLS(*tlsCertPath, *tlsKeyPath)
+	}
+	serving.Store(false)
 	if errSvr != nil {
 		log.Error(fmt.Sprintf("Error starting server. Err: %v", errSvr))
 	}
 
+	moqReplay.Close()
+	moqCluster.Stop()
+	moqMesh.Stop()
+	if moqCmafIngest != nil {
+		moqCmafIngest.Close()
+	}
 	objects.Stop()
 	moqOrigins.Close()
+	moqtFwdTable.Stop()
+	moqEvents.Stop()
+	eventsExport.Stop()
+	recorder.Stop()
+	ingestPool.Stop()
+	egressPool.Stop()
+	if moqAdmin != nil {
+		moqAdmin.Close()
+	}
+	if moqAcme != nil {
+		moqAcme.Close()
+	}
+	if moqHealth != nil {
+		moqHealth.Close()
+	}
+	if moqHls != nil {
+		moqHls.Close()
+	}
+	if moqHttpOrigin != nil {
+		moqHttpOrigin.Close()
+	}
+	moqMetrics.Close()
+	if moqDebug != nil {
+		moqDebug.Close()
+	}
+}
+
+// Config helper
+
+// loadEnvVars Sets the flags (NOT already set in the command line) from MOQ_* env vars
+func loadEnvVars() (err error) {
+	cmdLineFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		cmdLineFlags[f.Name] = true
+	})
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || cmdLineFlags[f.Name] {
+			return
+		}
+		envVar := ENV_VARS_PREFIX + strings.ToUpper(f.Name)
+		value, found := os.LookupEnv(envVar)
+		if !found {
+			return
+		}
+		errSet := flag.Set(f.Name, value)
+		if errSet != nil {
+			err = errors.New(fmt.Sprintf("Invalid value of %s (%s). Err: %v", envVar, value, errSet))
+			return
+		}
+		log.Info(fmt.Sprintf("Setting %s from env var %s", f.Name, envVar))
+	})
+	return
+}
+
+// loadConfigFile Sets the flags (NOT already set in the command line / env vars) from the unified config file
+func loadConfigFile(configFilepath string) (err error) {
+	configJsonData, errConfigLoad := moqconfigfile.ReadFile(configFilepath)
+	if errConfigLoad != nil {
+		err = errConfigLoad
+		return
+	}
+	var configData map[string]json.RawMessage
+	errConfigParse := json.Unmarshal(configJsonData, &configData)
+	if errConfigParse != nil {
+		err = errConfigParse
+		return
+	}
+
+	cmdLineFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		cmdLineFlags[f.Name] = true
+	})
+
+	for section, sectionJsonData := range configData {
+		if section == CONFIG_ORIGINS_KEY {
+			continue
+		}
+		sectionFlags, validSection := configSections[section]
+		if !validSection {
+			err = errors.New(fmt.Sprintf("Unknown section %s", section))
+			return
+		}
+		var sectionData map[string]interface{}
+		decoder := json.NewDecoder(strings.NewReader(string(sectionJsonData)))
+		decoder.UseNumber()
+		errSectionParse := decoder.Decode(&sectionData)
+		if errSectionParse != nil {
+			err = errors.New(fmt.Sprintf("Parsing section %s. Err: %v", section, errSectionParse))
+			return
+		}
+		for name, value := range sectionData {
+			if !slices.Contains(sectionFlags, name) {
+				err = errors.New(fmt.Sprintf("Unknown setting %s in section %s", name, section))
+				return
+			}
+			if cmdLineFlags[name] {
+				log.Info(fmt.Sprintf("Config setting %s.%s overridden by command line / env var", section, name))
+				continue
+			}
+			switch value.(type) {
+			case string, json.Number, bool:
+			default:
+				err = errors.New(fmt.Sprintf("Invalid value type of %s.%s, only string, number or bool", section, name))
+				return
+			}
+			errSet := flag.Set(name, fmt.Sprintf("%v", value))
+			if errSet != nil {
+				err = errors.New(fmt.Sprintf("Invalid value of %s.%s (%v). Err: %v", section, name, value, errSet))
+				return
+			}
+		}
+	}
+
+	// Inline origins, they are loaded (and reloaded on SIGHUP) from this file
+	if _, found := configData[CONFIG_ORIGINS_KEY]; found {
+		if flag.Lookup("moq_origins_config").Value.String() != "" {
+			err = errors.New(fmt.Sprintf("Inline %s and moq_origins_config can NOT be used at the same time", CONFIG_ORIGINS_KEY))
+			return
+		}
+		flag.Set("moq_origins_config", configFilepath)
+	}
+	return
+}
+
+// Logging helper
+
+func newLogFormatter(logFormat string) (formatter log.Formatter, err error) {
+	switch logFormat {
+	case "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		err = errors.New(fmt.Sprintf("Unknown log format %s (text, json)", logFormat))
+	}
+	return
 }
 
 // CORS helper
 
-func CheckCORSOrigin(r *http.Request) bool {
-	// TODO: Allow only specific CORS origins
-	return true
+// newCORSOriginChecker Returns a function that checks the Origin header against allowedOrigins (exact or wildcard, case insensitive), empty allows all
+func newCORSOriginChecker(allowedOrigins []string) (checker func(r *http.Request) bool, err error) {
+	patterns := []string{}
+	for _, allowedOrigin := range allowedOrigins {
+		pattern := strings.ToLower(strings.TrimSpace(allowedOrigin))
+		if pattern == "" {
+			continue
+		}
+		_, errPattern := path.Match(pattern, "")
+		if errPattern != nil {
+			err = errors.New(fmt.Sprintf("Invalid allowed origin %s. Err: %v", allowedOrigin, errPattern))
+			return
+		}
+		patterns = append(patterns, pattern)
+	}
+	checker = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(patterns) == 0 || origin == "" {
+			return true
+		}
+		origin = strings.ToLower(origin)
+		for _, pattern := range patterns {
+			matched, _ := path.Match(pattern, origin)
+			if matched {
+				return true
+			}
+		}
+		return false
+	}
+	return
 }
 
 // Origins helper
 
-func loadAndInitializeMoqOrigins(originsFilepath string, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) (moqOrigins *moqorigins.MoqOrigins, err error) {
+func loadAndInitializeMoqOrigins(originsFilepath string, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig moqconnectionmanagment.MoqConnectionConfig) (moqOrigins *moqorigins.MoqOrigins, err error) {
 	moqOrigins = moqorigins.New()
+	originsData, err := loadMoqOriginsData(originsFilepath)
+	if err != nil {
+		originsData = moqorigins.MoqOriginsData{}
+	}
+
+	// Create origins (none if error, they can be added later by a reload)
+	moqOrigins.Initialize(originsData, moqtFwdTable, objects, connConfig)
+
+	return moqOrigins, err
+}
+
+func loadMoqOriginsData(originsFilepath string) (originsData moqorigins.MoqOriginsData, err error) {
 	if originsFilepath != "" {
 		// read file
-		originsJsonData, errOriginLoad := os.ReadFile(originsFilepath)
+		originsJsonData, errOriginLoad := moqconfigfile.ReadFile(originsFilepath)
 		if errOriginLoad != nil {
 			err = errOriginLoad
 			return
 		}
 		// Parse file
-		var originsData moqorigins.MoqOriginsData
 		errOriginParse := json.Unmarshal(originsJsonData, &originsData)
 		if errOriginParse != nil {
 			err = errOriginParse
@@ -141,20 +1076,489 @@ func loadAndInitializeMoqOrigins(originsFilepath string, moqtFwdTable *moqfwdtab
 
 		// Load certificates (if needed)
 		for i := range originsData.MoqOrigins {
-			if originsData.MoqOrigins[i].OriginCertPath != "" {
-				filePath := filepath.Join(filepath.Dir(originsFilepath), originsData.MoqOrigins[i].OriginCertPath)
-				data, errLoadCert := os.ReadFile(filePath)
-				if errLoadCert != nil {
-					err = errors.New(fmt.Sprintf("We could NOT load cert file %s. Err: %v", filePath, errLoadCert))
-					return
-				}
-				originsData.MoqOrigins[i].CertData = data
+			if !moqorigins.IsValidOriginDiscovery(originsData.MoqOrigins[i].Discovery) {
+				err = errors.New(fmt.Sprintf("Origin %s has an invalid discovery %s", originsData.MoqOrigins[i].Guid, originsData.MoqOrigins[i].Discovery))
+				return
+			}
+			errTokenProvider := moqorigins.IsValidOriginTokenProvider(originsData.MoqOrigins[i].TokenProvider)
+			if errTokenProvider != nil {
+				err = errors.New(fmt.Sprintf("Origin %s: %v", originsData.MoqOrigins[i].Guid, errTokenProvider))
+				return
+			}
+			err = loadMoqOriginCert(originsFilepath, &originsData.MoqOrigins[i])
+			if err != nil {
+				return
 			}
 		}
+	}
+	return
+}
+
+// loadMoqOriginCert Loads the origin certs (if any), paths are relative to the origins config file
+func loadMoqOriginCert(originsFilepath string, originData *moqorigins.MoqOriginData) (err error) {
+	originData.CertData, err = loadCertFile(originsFilepath, originData.OriginCertPath)
+	if err != nil {
+		return
+	}
+	if (originData.ClientCertPath == "") != (originData.ClientKeyPath == "") {
+		err = errors.New(fmt.Sprintf("Origin %s needs both clientcertpath and clientkeypath", originData.Guid))
+		return
+	}
+	originData.ClientCertData, err = loadCertFile(originsFilepath, originData.ClientCertPath)
+	if err != nil {
+		return
+	}
+	originData.ClientKeyData, err = loadCertFile(originsFilepath, originData.ClientKeyPath)
+	if err != nil {
+		return
+	}
+	for i := range originData.FailoverAddresses {
+		originData.FailoverAddresses[i].CertData, err = loadCertFile(originsFilepath, originData.FailoverAddresses[i].OriginCertPath)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
 
-		// Create origins
-		moqOrigins.Initialize(originsData, moqtFwdTable, objects, objExpMs)
+func loadCertFile(originsFilepath string, certPath string) (data []byte, err error) {
+	if certPath == "" {
+		return
+	}
+	filePath := filepath.Join(filepath.Dir(originsFilepath), certPath)
+	data, errLoadCert := os.ReadFile(filePath)
+	if errLoadCert != nil {
+		err = errors.New(fmt.Sprintf("We could NOT load cert file %s. Err: %v", filePath, errLoadCert))
+		return
 	}
+	return
+}
 
-	return moqOrigins, err
+// Endpoints helper
+
+func loadEndpointsData(endpointsFilepath string) (endpointsData moqconnectionmanagment.MoqEndpointsData, err error) {
+	if endpointsFilepath == "" {
+		endpointsData.Endpoints = []moqconnectionmanagment.MoqEndpointData{{Path: moqconnectionmanagment.ENDPOINT_DEFAULT_PATH}}
+		return
+	}
+	endpointsJsonData, errEndpointsLoad := os.ReadFile(endpointsFilepath)
+	if errEndpointsLoad != nil {
+		err = errEndpointsLoad
+		return
+	}
+	errEndpointsParse := json.Unmarshal(endpointsJsonData, &endpointsData)
+	if errEndpointsParse != nil {
+		err = errEndpointsParse
+		return
+	}
+	err = moqconnectionmanagment.IsValidEndpoints(endpointsData)
+	return
+}
+
+// Client certs helper
+
+// configureClientCerts Verifies the client certificates with the CA bundle if they are sent (endpoints with clientcertrequired reject sessions without them)
+func configureClientCerts(tlsConfig *tls.Config, clientCaFilepath string) (err error) {
+	caData, errCaLoad := os.ReadFile(clientCaFilepath)
+	if errCaLoad != nil {
+		err = errCaLoad
+		return
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		err = errors.New("No PEM certificates found")
+		return
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return
+}
+
+func loadClientCertIdentitiesData(identitiesFilepath string) (identitiesData moqconnectionmanagment.MoqClientCertIdentitiesData, err error) {
+	if identitiesFilepath == "" {
+		return
+	}
+	identitiesJsonData, errIdentitiesLoad := os.ReadFile(identitiesFilepath)
+	if errIdentitiesLoad != nil {
+		err = errIdentitiesLoad
+		return
+	}
+	errIdentitiesParse := json.Unmarshal(identitiesJsonData, &identitiesData)
+	if errIdentitiesParse != nil {
+		err = errIdentitiesParse
+		return
+	}
+	err = moqconnectionmanagment.IsValidClientCertIdentities(identitiesData)
+	return
+}
+
+// Auth helper
+
+func loadAuthorizer(authorizerFilepath string, clock moqclock.Clock) (authorizer moqauth.MoqAuthorizer, err error) {
+	var authorizerData moqauth.MoqAuthorizerData
+	if authorizerFilepath != "" {
+		authorizerJsonData, errAuthorizerLoad := os.ReadFile(authorizerFilepath)
+		if errAuthorizerLoad != nil {
+			err = errAuthorizerLoad
+			return
+		}
+		errAuthorizerParse := json.Unmarshal(authorizerJsonData, &authorizerData)
+		if errAuthorizerParse != nil {
+			err = errAuthorizerParse
+			return
+		}
+		// Paths relative to the authorizer config file
+		for i := range authorizerData.JwtKeys {
+			authorizerData.JwtKeys[i].PublicKeyData, err = loadCertFile(authorizerFilepath, authorizerData.JwtKeys[i].PublicKeyPath)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if authorizerData.Type == "" {
+		authorizerData.Type = moqauth.MoqAuthorizerTypeAllowAll
+	}
+	authorizer, err = moqauth.New(authorizerData, clock)
+	if err == nil {
+		log.Info(fmt.Sprintf("Authorizer: %s", authorizerData.Type))
+	}
+	return
+}
+
+// Health helper
+
+func registerHealthChecks(moqHealth *moqhealth.MoqHealth, serving *atomic.Bool, draining *atomic.Bool, moqOrigins *moqorigins.MoqOrigins, objects *moqmessageobjects.MoqMessageObjects) {
+	moqHealth.AddLivenessCheck("listener", func() error {
+		if !serving.Load() {
+			return errors.New("WebTransport listener NOT serving")
+		}
+		return nil
+	})
+	moqHealth.AddReadinessCheck("drain", func() error {
+		if draining.Load() {
+			return errors.New("Relay draining")
+		}
+		return nil
+	})
+	moqHealth.AddReadinessCheck("origins", moqOrigins.CheckHealth)
+	moqHealth.AddReadinessCheck("cache", objects.CheckHealth)
+}
+
+// Metrics helper
+
+// registerMetricsCollectors Adds the metrics read from the relay state when scraped
+func registerMetricsCollectors(moqMetrics *moqmetrics.MoqMetrics, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, admission *moqadmission.MoqAdmission, bandwidth *moqbandwidth.MoqBandwidthBudget, moqOrigins *moqorigins.MoqOrigins, ingestPool *moqworkerpool.MoqWorkerPool, egressPool *moqworkerpool.MoqWorkerPool, moqCluster *moqcluster.MoqCluster, moqMesh *moqmesh.MoqMesh) {
+	roleLabels := map[moqhelpers.MoqRole]string{moqhelpers.MoqRolePublisher: "publisher", moqhelpers.MoqRoleSubscriber: "subscriber", moqhelpers.MoqRoleBoth: "both"}
+
+	sessions := moqMetrics.NewGauge("moq_sessions", "Current MOQ sessions", "role")
+	subscriptions := moqMetrics.NewGauge("moq_subscriptions", "Current subscriptions (all sessions)")
+	activeTracks := moqMetrics.NewGauge("moq_active_tracks", "Current tracks received from publishers and origins")
+	queuedObjects := moqMetrics.NewGauge("moq_queued_objects", "Objects waiting to be sent (all subscribers)")
+	maxQueuedObjects := moqMetrics.NewGauge("moq_queued_objects_max", "Objects waiting to be sent in the most loaded subscriber")
+	droppedObjects := moqMetrics.NewGauge("moq_dropped_objects", "Objects dropped by the current sessions (queue full, skipped to latest group, send rate limit or waiting for higher priority streams)", "reason")
+	moqMetrics.AddCollector(func() {
+		for _, role := range roleLabels {
+			sessions.Set(0, role)
+		}
+		subscriptionsTotal, activeTracksTotal, queuedTotal, queuedMax := 0, 0, 0, 0
+		dropped := map[string]uint64{"queue": 0, "skipped": 0, "rate-limited": 0}
+		for _, sessionInfo := range moqtFwdTable.ListSessions(moqhelpers.MoqRoleNotSet, "", "") {
+			sessions.Add(1, roleLabels[sessionInfo.Role])
+			subscriptionsTotal += sessionInfo.Subscriptions
+			activeTracksTotal += sessionInfo.ActiveTracks
+			queuedTotal += sessionInfo.QueuedObjects
+			if sessionInfo.QueuedObjects > queuedMax {
+				queuedMax = sessionInfo.QueuedObjects
+			}
+			dropped["queue"] += sessionInfo.DroppedObjects
+			dropped["skipped"] += sessionInfo.SkippedObjects
+			dropped["rate-limited"] += sessionInfo.RateLimitedObjects
+			dropped["priority"] += sessionInfo.PriorityDroppedObjects
+		}
+		subscriptions.Set(float64(subscriptionsTotal))
+		activeTracks.Set(float64(activeTracksTotal))
+		queuedObjects.Set(float64(queuedTotal))
+		maxQueuedObjects.Set(float64(queuedMax))
+		for reason, count := range dropped {
+			droppedObjects.Set(float64(count), reason)
+		}
+	})
+
+	cacheObjects := moqMetrics.NewGauge("moq_cache_objects", "Objects in the memory cache")
+	cacheBytes := moqMetrics.NewGauge("moq_cache_bytes", "Payload bytes in the memory cache")
+	cacheMaxBytes := moqMetrics.NewGauge("moq_cache_max_bytes", "Memory cache cap (0 unlimited)")
+	moqMetrics.AddCollector(func() {
+		objectsNum, bytes, maxBytes := objects.GetSize()
+		cacheObjects.Set(float64(objectsNum))
+		cacheBytes.Set(float64(bytes))
+		cacheMaxBytes.Set(float64(maxBytes))
+	})
+
+	admissionRejected := moqMetrics.NewCounter("moq_admission_rejected_total", "WebTransport sessions rejected before starting", "reason")
+	bandwidthBps := moqMetrics.NewGauge("moq_bandwidth_bps", "Relay wide throughput in the last window (bits per second)", "direction")
+	moqMetrics.AddCollector(func() {
+		for reason, count := range admission.GetStats().Rejected {
+			admissionRejected.Set(float64(count), string(reason))
+		}
+		usage := bandwidth.GetUsage()
+		bandwidthBps.Set(float64(usage.IngestBps), "ingest")
+		bandwidthBps.Set(float64(usage.EgressBps), "egress")
+	})
+
+	workerPoolBusy := moqMetrics.NewGauge("moq_worker_pool_busy", "Object stream workers running a task (0 if the pool is disabled)", "pool")
+	workerPoolQueued := moqMetrics.NewGauge("moq_worker_pool_queued", "Object streams waiting for a worker", "pool")
+	workerPoolRejected := moqMetrics.NewCounter("moq_worker_pool_rejected_total", "Object streams rejected because the workers queue was full", "pool")
+	moqMetrics.AddCollector(func() {
+		for pool, stats := range map[string]moqworkerpool.MoqWorkerPoolStats{"ingest": ingestPool.GetStats(), "egress": egressPool.GetStats()} {
+			workerPoolBusy.Set(float64(stats.Busy), pool)
+			workerPoolQueued.Set(float64(stats.Queued), pool)
+			workerPoolRejected.Set(float64(stats.Rejected), pool)
+		}
+	})
+
+	clusterRemoteNamespaces := moqMetrics.NewGauge("moq_cluster_remote_namespaces", "Namespaces announced only in other cluster instances (0 if the cluster is disabled)")
+	clusterMessages := moqMetrics.NewCounter("moq_cluster_messages_total", "Cluster bus messages", "result")
+	clusterFetchedObjects := moqMetrics.NewCounter("moq_cluster_fetched_objects_total", "Objects fetched from other cluster instances")
+	clusterFetchedBytes := moqMetrics.NewCounter("moq_cluster_fetched_bytes_total", "Payload bytes fetched from other cluster instances")
+	clusterFetchErrors := moqMetrics.NewCounter("moq_cluster_fetch_errors_total", "Objects that could NOT be fetched from other cluster instances")
+	clusterMembers := moqMetrics.NewGauge("moq_cluster_members", "Other cluster instances known (sharding)")
+	clusterShardOrigins := moqMetrics.NewGauge("moq_cluster_shard_origins", "Origins to the owners of the namespaces (sharding)")
+	moqMetrics.AddCollector(func() {
+		stats := moqCluster.GetStats()
+		clusterRemoteNamespaces.Set(float64(stats.RemoteNamespaces))
+		clusterMessages.Set(float64(stats.MessagesSent), "sent")
+		clusterMessages.Set(float64(stats.MessagesReceived), "received")
+		clusterMessages.Set(float64(stats.MessagesDropped), "dropped")
+		clusterFetchedObjects.Set(float64(stats.ObjectsFetched))
+		clusterFetchedBytes.Set(float64(stats.FetchedBytes))
+		clusterFetchErrors.Set(float64(stats.FetchErrors))
+		clusterMembers.Set(float64(stats.Members))
+		clusterShardOrigins.Set(float64(stats.ShardOrigins))
+	})
+
+	meshMembers := moqMetrics.NewGauge("moq_mesh_members", "Other mesh relays alive (0 if the mesh is disabled)")
+	meshOrigins := moqMetrics.NewGauge("moq_mesh_origins", "Origins to the mesh relays that announce the namespaces")
+	meshMessages := moqMetrics.NewCounter("moq_mesh_messages_total", "Mesh gossip messages", "result")
+	moqMetrics.AddCollector(func() {
+		stats := moqMesh.GetStats()
+		meshMembers.Set(float64(stats.Members))
+		meshOrigins.Set(float64(stats.Origins))
+		meshMessages.Set(float64(stats.MessagesSent), "sent")
+		meshMessages.Set(float64(stats.MessagesReceived), "received")
+		meshMessages.Set(float64(stats.MessagesInvalid), "invalid")
+	})
+
+	originStatus := moqMetrics.NewGauge("moq_origin_status", "Origin sessions per connection status", "origin", "status")
+	originConnectAttempts := moqMetrics.NewCounter("moq_origin_connect_attempts_total", "Origin connection attempts", "origin")
+	originConnectFailures := moqMetrics.NewCounter("moq_origin_connect_failures_total", "Origin connection attempts that failed", "origin")
+	originReceivedBytes := moqMetrics.NewCounter("moq_origin_received_bytes_total", "Payload bytes received from the origin", "origin")
+	moqMetrics.AddCollector(func() {
+		originStatus.Reset()
+		for _, status := range moqOrigins.GetStatus() {
+			originStatus.Add(1, status.FriendlyName, string(status.Status))
+		}
+		// Removed origins disappear
+		originConnectAttempts.Reset()
+		originConnectFailures.Reset()
+		originReceivedBytes.Reset()
+		for _, metrics := range moqOrigins.GetMetrics() {
+			originConnectAttempts.Add(float64(metrics.ConnectAttempts), metrics.FriendlyName)
+			originConnectFailures.Add(float64(metrics.ConnectFailures), metrics.FriendlyName)
+			originReceivedBytes.Add(float64(metrics.ReceivedBytes), metrics.FriendlyName)
+		}
+	})
+}
+
+// Admin helper
+
+func loadAndInitializeAnnouncePolicies(policiesFilepath string, moqtFwdTable *moqfwdtable.MoqFwdTable) (err error) {
+	if policiesFilepath == "" {
+		return
+	}
+	policiesJsonData, errPoliciesLoad := os.ReadFile(policiesFilepath)
+	if errPoliciesLoad != nil {
+		err = errPoliciesLoad
+		return
+	}
+	var policiesData moqfwdtable.MoqAnnouncePoliciesData
+	errPoliciesParse := json.Unmarshal(policiesJsonData, &policiesData)
+	if errPoliciesParse != nil {
+		err = errPoliciesParse
+		return
+	}
+
+	return moqtFwdTable.SetAnnouncePolicies(policiesData)
+}
+
+func loadAndInitializeCacheQuotas(quotasFilepath string, objects *moqmessageobjects.MoqMessageObjects) (err error) {
+	if quotasFilepath == "" {
+		return
+	}
+	quotasJsonData, errQuotasLoad := os.ReadFile(quotasFilepath)
+	if errQuotasLoad != nil {
+		err = errQuotasLoad
+		return
+	}
+	var quotasData moqmessageobjects.MoqCacheQuotasData
+	errQuotasParse := json.Unmarshal(quotasJsonData, &quotasData)
+	if errQuotasParse != nil {
+		err = errQuotasParse
+		return
+	}
+
+	objects.SetQuotas(quotasData)
+	return
+}
+
+func registerAdminHandlers(moqAdmin *moqadmin.MoqAdmin, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, admission *moqadmission.MoqAdmission, moqOrigins *moqorigins.MoqOrigins, originsFilepath string, moqEvents *moqevents.MoqEvents, recorder *moqrecorder.MoqRecorder, moqMesh *moqmesh.MoqMesh) {
+	moqAdmin.Handle("/admin/events", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqEvents.ServeSSE(w, r)
+	})
+	moqAdmin.Handle("/admin/tracks", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, moqtFwdTable.Stats())
+	})
+	moqAdmin.Handle("/admin/namespaces", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, moqtFwdTable.ListNamespaces())
+	})
+	moqAdmin.Handle("/admin/sessions", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		// Filters: role (publisher, subscriber, both), namespace, track (needs namespace)
+		roles := map[string]moqhelpers.MoqRole{"": moqhelpers.MoqRoleNotSet, "publisher": moqhelpers.MoqRolePublisher, "subscriber": moqhelpers.MoqRoleSubscriber, "both": moqhelpers.MoqRoleBoth}
+		role, validRole := roles[r.URL.Query().Get("role")]
+		if !validRole {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		moqadmin.WriteJson(w, moqtFwdTable.ListSessions(role, r.URL.Query().Get("namespace"), r.URL.Query().Get("track")))
+	})
+	moqAdmin.Handle("/admin/sessions/kick", moqadmin.MoqAdminScopeSessionAdmin, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		// Params: session, code (MOQT session error code, default generic error), reason (optional)
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sessionName := r.URL.Query().Get("session")
+		if sessionName == "" {
+			http.Error(w, "Invalid params, session needed", http.StatusBadRequest)
+			return
+		}
+		errCode := moqhelpers.ErrorGeneric
+		if r.URL.Query().Get("code") != "" {
+			code, errParseCode := strconv.ParseUint(r.URL.Query().Get("code"), 0, 64)
+			if errParseCode != nil {
+				http.Error(w, "Invalid code", http.StatusBadRequest)
+				return
+			}
+			errCode = moqhelpers.MoqErrorCode(code)
+		}
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "Kicked by admin"
+		}
+		if !moqtFwdTable.KickSession(sessionName, errCode, reason) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		moqadmin.WriteJson(w, map[string]interface{}{"session": sessionName, "code": errCode, "reason": reason})
+	})
+	moqAdmin.Handle("/admin/admission", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, admission.GetStats())
+	})
+	moqAdmin.Handle("/admin/cache", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, objects.Stats())
+	})
+	moqAdmin.Handle("/admin/recordings", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, recorder.Stats())
+	})
+	moqAdmin.Handle("/admin/cache/purge", moqadmin.MoqAdminScopeCacheAdmin, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		// Params: namespace, track (optional), group (optional, needs track)
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		trackNamespace := r.URL.Query().Get("namespace")
+		trackName := r.URL.Query().Get("track")
+		group := r.URL.Query().Get("group")
+		if trackNamespace == "" || (group != "" && trackName == "") {
+			http.Error(w, "Invalid params, namespace needed (track needed for group)", http.StatusBadRequest)
+			return
+		}
+		purged := 0
+		if group != "" {
+			groupSequence, errGroup := strconv.ParseUint(group, 10, 64)
+			if errGroup != nil {
+				http.Error(w, "Invalid group", http.StatusBadRequest)
+				return
+			}
+			purged = objects.PurgeGroup(trackNamespace, trackName, groupSequence)
+		} else if trackName != "" {
+			purged = objects.PurgeTrack(trackNamespace, trackName)
+		} else {
+			purged = objects.PurgeNamespace(trackNamespace)
+		}
+		moqadmin.WriteJson(w, map[string]int{"purgedObjects": purged})
+	})
+	moqAdmin.Handle("/admin/origins/metrics", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, moqOrigins.GetMetrics())
+	})
+	moqAdmin.Handle("/admin/origins/status", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, moqOrigins.GetStatus())
+	})
+	moqAdmin.Handle("/admin/mesh/members", moqadmin.MoqAdminScopeReadOnly, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		moqadmin.WriteJson(w, moqMesh.GetMembers())
+	})
+	moqAdmin.Handle("/admin/origins", moqadmin.MoqAdminScopeOriginAdmin, func(w http.ResponseWriter, r *http.Request, tokenName string) {
+		// GET: list, POST: add (body origin json, same format as origins config), DELETE: remove (param guid)
+		switch r.Method {
+		case http.MethodGet:
+			moqadmin.WriteJson(w, moqOrigins.GetStatus())
+		case http.MethodPost:
+			var originData moqorigins.MoqOriginData
+			errParse := json.NewDecoder(r.Body).Decode(&originData)
+			if errParse != nil {
+				http.Error(w, fmt.Sprintf("Invalid origin json. Err: %v", errParse), http.StatusBadRequest)
+				return
+			}
+			errCert := loadMoqOriginCert(originsFilepath, &originData)
+			if errCert != nil {
+				http.Error(w, errCert.Error(), http.StatusBadRequest)
+				return
+			}
+			status, errAdd := moqOrigins.Add(originData)
+			if errAdd != nil {
+				http.Error(w, errAdd.Error(), http.StatusBadRequest)
+				return
+			}
+			moqadmin.WriteJson(w, status)
+		case http.MethodDelete:
+			status, found := moqOrigins.Remove(r.URL.Query().Get("guid"))
+			if !found {
+				http.Error(w, "Origin not found", http.StatusNotFound)
+				return
+			}
+			moqadmin.WriteJson(w, status)
+		default:
+			http.Error(w, "Only GET, POST or DELETE allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func loadAndInitializeMoqAdmin(listenAddr string, tokensFilepath string, auditLogFilepath string) (moqAdmin *moqadmin.MoqAdmin, err error) {
+	var tokensData moqadmin.MoqAdminTokensData
+	if tokensFilepath != "" {
+		tokensJsonData, errTokensLoad := os.ReadFile(tokensFilepath)
+		if errTokensLoad != nil {
+			err = errTokensLoad
+			return
+		}
+		errTokensParse := json.Unmarshal(tokensJsonData, &tokensData)
+		if errTokensParse != nil {
+			err = errTokensParse
+			return
+		}
+	}
+	if len(tokensData.Tokens) == 0 {
+		log.Warning("Admin API has NO tokens configured, all requests will be rejected")
+	}
+
+	return moqadmin.New(listenAddr, tokensData, auditLogFilepath)
 }
@@ -0,0 +1,113 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqacme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const ACME_SHUTDOWN_TIMEOUT_MS = 5000
+
+// How the ACME server validates we own the hostname (companion TCP listener, QUIC can NOT be used for it)
+type MoqAcmeChallenge string
+
+const (
+	// HTTP on port 80
+	MoqAcmeChallengeHttp01 MoqAcmeChallenge = "http-01"
+	// TLS on TCP port 443
+	MoqAcmeChallengeTlsAlpn01 MoqAcmeChallenge = "tls-alpn-01"
+)
+
+type MoqAcme struct {
+	challenge MoqAcmeChallenge
+	manager   *autocert.Manager
+
+	// Companion TCP listener that answers the challenges
+	server *http.Server
+}
+
+// New Creates the certificates manager (certificates are obtained on the first TLS handshake and renewed automatically)
+func New(hosts []string, email string, cacheDir string, directoryUrl string, challenge MoqAcmeChallenge, challengeAddr string) (moqAcme *MoqAcme, err error) {
+	if len(hosts) == 0 {
+		err = errors.New("ACME needs at least one hostname")
+		return
+	}
+	if !IsValidAcmeChallenge(challenge) {
+		err = errors.New(fmt.Sprintf("Invalid ACME challenge %s", challenge))
+		return
+	}
+	if cacheDir == "" {
+		err = errors.New("ACME needs a cache dir (certificates and account key)")
+		return
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directoryUrl != "" {
+		manager.Client = &acme.Client{DirectoryURL: directoryUrl}
+	}
+
+	moqAcme = &MoqAcme{challenge: challenge, manager: manager}
+	if challenge == MoqAcmeChallengeHttp01 {
+		moqAcme.server = &http.Server{Addr: challengeAddr, Handler: manager.HTTPHandler(nil)}
+	} else {
+		moqAcme.server = &http.Server{Addr: challengeAddr, TLSConfig: manager.TLSConfig(), Handler: http.NotFoundHandler()}
+	}
+	return
+}
+
+// ListenAndServe Answers the ACME challenges (blocking)
+func (moqAcme *MoqAcme) ListenAndServe() (err error) {
+	log.Info(fmt.Sprintf("Serving ACME %s challenges. Addr: %s", moqAcme.challenge, moqAcme.server.Addr))
+
+	if moqAcme.challenge == MoqAcmeChallengeHttp01 {
+		err = moqAcme.server.ListenAndServe()
+	} else {
+		listener, errListen := net.Listen("tcp", moqAcme.server.Addr)
+		if errListen != nil {
+			return errListen
+		}
+		err = moqAcme.server.Serve(tls.NewListener(listener, moqAcme.server.TLSConfig))
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return
+}
+
+// GetTLSConfig Returns the TLS config for the WebTransport server (certificates from ACME)
+func (moqAcme *MoqAcme) GetTLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: moqAcme.manager.GetCertificate}
+}
+
+func (moqAcme *MoqAcme) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ACME_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	return moqAcme.server.Shutdown(ctx)
+}
+
+// Helpers
+
+// IsValidAcmeChallenge Returns true if challenge is a supported ACME challenge
+func IsValidAcmeChallenge(challenge MoqAcmeChallenge) bool {
+	return challenge == MoqAcmeChallengeHttp01 || challenge == MoqAcmeChallengeTlsAlpn01
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqadmin
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const ADMIN_SHUTDOWN_TIMEOUT_MS = 5000
+
+// Web UI (static, it asks for a token and calls the admin API)
+const ADMIN_UI_PATH = "/admin/ui/"
+
+//go:embed ui
+var uiFiles embed.FS
+
+type MoqAdminScope string
+
+const (
+	MoqAdminScopeReadOnly     MoqAdminScope = "read-only"
+	MoqAdminScopeCacheAdmin   MoqAdminScope = "cache-admin"
+	MoqAdminScopeSessionAdmin MoqAdminScope = "session-admin"
+	MoqAdminScopeOriginAdmin  MoqAdminScope = "origin-admin"
+)
+
+type MoqAdminTokenData struct {
+	Name   string          `json:"name"`
+	Token  string          `json:"token"`
+	Scopes []MoqAdminScope `json:"scopes"`
+}
+
+type MoqAdminTokensData struct {
+	Tokens []MoqAdminTokenData `json:"tokens"`
+}
+
+type MoqAdmin struct {
+	tokens []MoqAdminTokenData
+
+	mux    *http.ServeMux
+	server *http.Server
+
+	// Audit log (every admin request)
+	audit *log.Logger
+
+	// Audit file (if any)
+	auditFile *os.File
+}
+
+// New Creates a new admin API server
+func New(listenAddr string, tokensData MoqAdminTokensData, auditLogFilepath string) (admin *MoqAdmin, err error) {
+	for _, tokenData := range tokensData.Tokens {
+		if tokenData.Name == "" || tokenData.Token == "" {
+			err = errors.New("Admin tokens need a name and a token")
+			return
+		}
+		for _, scope := range tokenData.Scopes {
+			if scope != MoqAdminScopeReadOnly && scope != MoqAdminScopeCacheAdmin && scope != MoqAdminScopeSessionAdmin && scope != MoqAdminScopeOriginAdmin {
+				err = errors.New(fmt.Sprintf("Admin token %s has an invalid scope %s", tokenData.Name, scope))
+				return
+			}
+		}
+	}
+
+	audit := log.New()
+	audit.SetFormatter(&log.JSONFormatter{})
+	var auditFile *os.File = nil
+	if auditLogFilepath != "" {
+		auditFile, err = os.OpenFile(auditLogFilepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return
+		}
+		audit.SetOutput(auditFile)
+	}
+
+	mux := http.NewServeMux()
+	admin = &MoqAdmin{tokens: tokensData.Tokens, mux: mux, server: &http.Server{Addr: listenAddr, Handler: mux}, audit: audit, auditFile: auditFile}
+
+	admin.Handle("/admin/whoami", MoqAdminScopeReadOnly, admin.whoAmI)
+
+	uiRoot, errUi := fs.Sub(uiFiles, "ui")
+	if errUi != nil {
+		err = errUi
+		return
+	}
+	uiHandler := http.StripPrefix(ADMIN_UI_PATH, http.FileServer(http.FS(uiRoot)))
+	mux.HandleFunc(ADMIN_UI_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		uiHandler.ServeHTTP(w, r)
+	})
+
+	return
+}
+
+// Handle Registers an admin handler that requires the indicated scope
+func (admin *MoqAdmin) Handle(path string, scope MoqAdminScope, handler func(w http.ResponseWriter, r *http.Request, tokenName string)) {
+	admin.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		tokenData, authorized := admin.authorize(r, scope)
+		if tokenData == nil {
+			admin.auditAction(r, "", scope, http.StatusUnauthorized)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !authorized {
+			admin.auditAction(r, tokenData.Name, scope, http.StatusForbidden)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		sw := statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(&sw, r, tokenData.Name)
+		admin.auditAction(r, tokenData.Name, scope, sw.status)
+	})
+}
+
+func (admin *MoqAdmin) ListenAndServe() error {
+	log.Info(fmt.Sprintf("Serving admin API. Addr: %s", admin.server.Addr))
+
+	err := admin.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+func (admin *MoqAdmin) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ADMIN_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	err = admin.server.Shutdown(ctx)
+
+	if admin.auditFile != nil {
+		admin.auditFile.Close()
+		admin.auditFile = nil
+	}
+	return
+}
+
+// WriteJson Helper to answer admin requests
+func WriteJson(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	errEncode := json.NewEncoder(w).Encode(data)
+	if errEncode != nil {
+		log.Error(fmt.Sprintf("Admin API encoding response. Err: %v", errEncode))
+	}
+}
+
+// Helpers
+
+func (admin *MoqAdmin) authorize(r *http.Request, scope MoqAdminScope) (tokenData *MoqAdminTokenData, authorized bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return
+	}
+	token := []byte(strings.TrimPrefix(authHeader, "Bearer "))
+
+	for i := range admin.tokens {
+		if subtle.ConstantTimeCompare([]byte(admin.tokens[i].Token), token) == 1 {
+			tokenData = &admin.tokens[i]
+			break
+		}
+	}
+	if tokenData == nil {
+		return
+	}
+
+	for _, tokenScope := range tokenData.Scopes {
+		// Any scope implies read-only
+		if tokenScope == scope || scope == MoqAdminScopeReadOnly {
+			authorized = true
+			break
+		}
+	}
+	return
+}
+
+func (admin *MoqAdmin) auditAction(r *http.Request, tokenName string, scope MoqAdminScope, status int) {
+	admin.audit.WithFields(log.Fields{
+		"token":  tokenName,
+		"scope":  scope,
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"query":  r.URL.RawQuery,
+		"remote": r.RemoteAddr,
+		"status": status,
+	}).Info("admin action")
+}
+
+func (admin *MoqAdmin) whoAmI(w http.ResponseWriter, r *http.Request, tokenName string) {
+	for _, tokenData := range admin.tokens {
+		if tokenData.Name == tokenName {
+			WriteJson(w, map[string]any{"name": tokenData.Name, "scopes": tokenData.Scopes})
+			return
+		}
+	}
+}
+
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusResponseWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Flush Needed by streaming handlers (ex: server-sent events)
+func (sw *statusResponseWriter) Flush() {
+	flusher, isFlusher := sw.ResponseWriter.(http.Flusher)
+	if isFlusher {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+'use strict';
+
+const REFRESH_PERIOD_MS = 2000;
+const ROLES = { 0: 'not set', 1: 'publisher', 2: 'subscriber', 3: 'both' };
+
+let refreshTimer = null;
+
+function getToken() {
+  return sessionStorage.getItem('moqAdminToken') || '';
+}
+
+async function adminRequest(path, method) {
+  const resp = await fetch(path, { method: method || 'GET', headers: { Authorization: 'Bearer ' + getToken() } });
+  if (!resp.ok) {
+    throw new Error(path + ': ' + resp.status + ' ' + (await resp.text()).trim());
+  }
+  return resp.json();
+}
+
+function setStatus(msg, isError) {
+  const status = document.getElementById('status');
+  status.textContent = msg;
+  status.className = isError ? 'error' : 'ok';
+}
+
+// Values are set as text (session names, user agents, etc come from clients)
+function cell(value, className) {
+  const td = document.createElement('td');
+  td.textContent = value === undefined || value === null ? '' : String(value);
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function buttonCell(label, onClick) {
+  const td = document.createElement('td');
+  const button = document.createElement('button');
+  button.textContent = label;
+  button.addEventListener('click', onClick);
+  td.appendChild(button);
+  return td;
+}
+
+function fillTable(tableId, rows, createCells) {
+  const tbody = document.querySelector('#' + tableId + ' tbody');
+  tbody.replaceChildren();
+  for (const row of rows || []) {
+    const tr = document.createElement('tr');
+    for (const td of createCells(row)) {
+      tr.appendChild(td);
+    }
+    tbody.appendChild(tr);
+  }
+}
+
+function formatMs(avg, max) {
+  return avg.toFixed(1) + ' / ' + max.toFixed(1);
+}
+
+function formatBytes(bytes) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return bytes.toFixed(i === 0 ? 0 : 1) + ' ' + units[i];
+}
+
+async function purge(namespace, track, group) {
+  const params = new URLSearchParams({ namespace: namespace });
+  if (track) {
+    params.set('track', track);
+  }
+  if (group) {
+    params.set('group', group);
+  }
+  if (!confirm('Purge cache of ' + params.toString() + '?')) {
+    return;
+  }
+  try {
+    const result = await adminRequest('/admin/cache/purge?' + params.toString(), 'POST');
+    setStatus('Purged ' + result.purgedObjects + ' objects', false);
+  } catch (err) {
+    setStatus(err.message, true);
+  }
+}
+
+async function kick(sessionName) {
+  const reason = prompt('Kick session ' + sessionName + '? Reason:', 'Kicked by admin');
+  if (reason === null) {
+    return;
+  }
+  try {
+    await adminRequest('/admin/sessions/kick?' + new URLSearchParams({ session: sessionName, reason: reason }).toString(), 'POST');
+    setStatus('Kicked ' + sessionName, false);
+  } catch (err) {
+    setStatus(err.message, true);
+  }
+}
+
+function renderTransport(transport) {
+  if (!transport) {
+    return [cell('-'), cell('-'), cell('-'), cell('-')];
+  }
+  return [
+    cell(formatMs(transport.smoothedRttMs, transport.minRttMs)),
+    cell(formatBytes(transport.congestionWindow) + ' (' + transport.congestionState + ')'),
+    cell(transport.packetsLost + ' / ' + transport.packetsSent),
+    cell(transport.streamsActive),
+  ];
+}
+
+function renderSessions(sessions) {
+  fillTable('sessions', sessions, (s) => [
+    cell(s.uniqueName, 'wrap'),
+    cell(ROLES[s.role]),
+    cell(s.state),
+    cell(s.remoteAddr),
+    cell(s.userAgent, 'wrap'),
+    cell(new Date(s.createdAt).toLocaleString()),
+    cell(s.idleMs),
+    cell(s.namespaces),
+    cell(s.subscriptions),
+    cell(s.queuedObjects),
+    cell(s.droppedObjects),
+    cell(s.receivedObjects + ' (' + formatBytes(s.receivedBytes) + ')'),
+    ...renderTransport(s.transport),
+    buttonCell('Kick', () => kick(s.uniqueName)),
+  ]);
+}
+
+function renderNamespaces(namespaces) {
+  fillTable('namespaces', namespaces, (n) => [
+    cell(n.trackNamespace, 'wrap'),
+    cell(n.publishers.join(', '), 'wrap'),
+    cell(n.policy),
+    buttonCell('Purge cache', () => purge(n.trackNamespace)),
+  ]);
+}
+
+function renderTracks(tracks) {
+  fillTable('tracks', tracks, (t) => [
+    cell(t.trackNamespace, 'wrap'),
+    cell(t.trackName, 'wrap'),
+    cell(t.publishers),
+    cell(t.subscribers),
+    cell((t.ingestBitrateBps / 1000).toFixed(0)),
+    cell(t.objectsReceivedPerSec),
+    cell(t.objectsForwardedPerSec),
+    cell(formatMs(t.objectReceiveMsAvg, t.objectReceiveMsMax)),
+    cell(formatMs(t.forwardLatencyMsAvg, t.forwardLatencyMsMax)),
+    cell(t.queuedObjects),
+    buttonCell('Purge cache', () => purge(t.trackNamespace, t.trackName)),
+  ]);
+}
+
+function renderCache(cache) {
+  const requests = cache.hits + cache.misses;
+  const hitRatio = requests > 0 ? ((100 * cache.hits) / requests).toFixed(1) + '%' : '-';
+  const maxBytes = cache.maxBytes > 0 ? formatBytes(cache.maxBytes) : 'unlimited';
+  document.getElementById('cache').textContent = cache.objects + ' objects, ' + formatBytes(cache.bytes) + ' of ' + maxBytes + ', hit ratio: ' + hitRatio + ', evicted: ' + cache.evictedObjects + ' objects';
+}
+
+function renderOrigins(statuses, metrics) {
+  const metricsByGuid = {};
+  for (const m of metrics || []) {
+    metricsByGuid[m.guid] = m;
+  }
+  fillTable('origins', statuses, (o) => {
+    const m = metricsByGuid[o.guid] || {};
+    const statusCell = cell(o.status, o.status === 'connected' ? 'ok' : o.status === 'disconnected' ? 'error' : '');
+    return [
+      cell(o.friendlyName),
+      cell(o.trackNamespace, 'wrap'),
+      cell(o.activeAddress || o.originAddress),
+      statusCell,
+      cell(o.statusAgeMs),
+      cell(o.lastError, 'wrap'),
+      cell(m.uptimeMs),
+      cell(m.connectAttempts + ' / ' + m.connectFailures),
+      cell(m.receivedObjects),
+    ];
+  });
+}
+
+async function refresh() {
+  try {
+    const [sessions, namespaces, tracks, cache, originsStatus, originsMetrics] = await Promise.all([
+      adminRequest('/admin/sessions'),
+      adminRequest('/admin/namespaces'),
+      adminRequest('/admin/tracks'),
+      adminRequest('/admin/cache'),
+      adminRequest('/admin/origins/status'),
+      adminRequest('/admin/origins/metrics'),
+    ]);
+    renderSessions(sessions);
+    renderNamespaces(namespaces);
+    renderTracks(tracks);
+    renderCache(cache);
+    renderOrigins(originsStatus, originsMetrics);
+    setStatus('Updated ' + new Date().toLocaleTimeString(), false);
+  } catch (err) {
+    setStatus(err.message, true);
+  }
+}
+
+function start() {
+  if (refreshTimer !== null) {
+    clearInterval(refreshTimer);
+  }
+  refresh();
+  refreshTimer = setInterval(refresh, REFRESH_PERIOD_MS);
+}
+
+document.getElementById('token-form').addEventListener('submit', (e) => {
+  e.preventDefault();
+  sessionStorage.setItem('moqAdminToken', document.getElementById('token').value);
+  start();
+});
+
+document.getElementById('purge-form').addEventListener('submit', (e) => {
+  e.preventDefault();
+  purge(document.getElementById('purge-namespace').value, document.getElementById('purge-track').value, document.getElementById('purge-group').value);
+});
+
+if (getToken() !== '') {
+  start();
+}
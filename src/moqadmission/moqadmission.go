@@ -0,0 +1,112 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqadmission
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Why an incoming session was rejected
+type MoqRejectReason string
+
+const (
+	MoqRejectReasonBandwidth        MoqRejectReason = "bandwidth"
+	MoqRejectReasonMaxSessions      MoqRejectReason = "max-sessions"
+	MoqRejectReasonMaxSessionsPerIp MoqRejectReason = "max-sessions-per-ip"
+	// Web origin NOT in the CORS allowlist
+	MoqRejectReasonOrigin MoqRejectReason = "origin"
+	// Relay shutting down
+	MoqRejectReasonDraining MoqRejectReason = "draining"
+	// Missing / NOT allowed client certificate
+	MoqRejectReasonClientCert MoqRejectReason = "client-cert"
+	// IP in the deny list / NOT in the allow list
+	MoqRejectReasonIpDenied MoqRejectReason = "ip-denied"
+	// Too many new sessions from the same IP
+	MoqRejectReasonSessionRate MoqRejectReason = "session-rate"
+)
+
+type MoqAdmissionStats struct {
+	Sessions         int                        `json:"sessions"`
+	MaxSessions      int                        `json:"maxSessions"`
+	MaxSessionsPerIp int                        `json:"maxSessionsPerIp"`
+	Rejected         map[MoqRejectReason]uint64 `json:"rejected"`
+}
+
+// MoqAdmission Limits concurrent sessions (total and per IP)
+type MoqAdmission struct {
+	// 0 means unlimited
+	maxSessions      int
+	maxSessionsPerIp int
+
+	sessions      int
+	sessionsPerIp map[string]int
+
+	rejected map[MoqRejectReason]uint64
+
+	lock *sync.Mutex
+}
+
+// New Creates a new admission control
+func New(maxSessions int, maxSessionsPerIp int) *MoqAdmission {
+	a := MoqAdmission{maxSessions: maxSessions, maxSessionsPerIp: maxSessionsPerIp, sessionsPerIp: map[string]int{}, rejected: map[MoqRejectReason]uint64{}, lock: new(sync.Mutex)}
+
+	return &a
+}
+
+// Acquire Reserves a session slot for that IP, Release needs to be called when the session finishes
+func (a *MoqAdmission) Acquire(ip string) (reason MoqRejectReason, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.maxSessions > 0 && a.sessions >= a.maxSessions {
+		reason = MoqRejectReasonMaxSessions
+		err = errors.New(fmt.Sprintf("Max sessions reached (%d)", a.maxSessions))
+	} else if a.maxSessionsPerIp > 0 && a.sessionsPerIp[ip] >= a.maxSessionsPerIp {
+		reason = MoqRejectReasonMaxSessionsPerIp
+		err = errors.New(fmt.Sprintf("Max sessions per IP reached for %s (%d)", ip, a.maxSessionsPerIp))
+	}
+	if err != nil {
+		a.rejected[reason]++
+		return
+	}
+
+	a.sessions++
+	a.sessionsPerIp[ip]++
+	return
+}
+
+func (a *MoqAdmission) Release(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.sessions--
+	a.sessionsPerIp[ip]--
+	if a.sessionsPerIp[ip] <= 0 {
+		delete(a.sessionsPerIp, ip)
+	}
+}
+
+// Reject Counts a session rejected by other reasons (ex: bandwidth)
+func (a *MoqAdmission) Reject(reason MoqRejectReason) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.rejected[reason]++
+}
+
+func (a *MoqAdmission) GetStats() MoqAdmissionStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	stats := MoqAdmissionStats{Sessions: a.sessions, MaxSessions: a.maxSessions, MaxSessionsPerIp: a.maxSessionsPerIp, Rejected: map[MoqRejectReason]uint64{}}
+	for reason, count := range a.rejected {
+		stats.Rejected[reason] = count
+	}
+	return stats
+}
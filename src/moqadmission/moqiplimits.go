@@ -0,0 +1,158 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqadmission
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of IPs without activity for this time are deleted (they are full again)
+const IP_RATE_IDLE_CLEANUP_MS = 60 * 1000
+
+// MoqIpFilter CIDR allow / deny lists (deny wins, empty allow list allows any IP)
+type MoqIpFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIpFilter Parses the CIDRs (a single IP is a /32 or /128)
+func NewIpFilter(allowCidrs []string, denyCidrs []string) (filter *MoqIpFilter, err error) {
+	filter = &MoqIpFilter{}
+	filter.allow, err = parseCidrs(allowCidrs)
+	if err != nil {
+		return
+	}
+	filter.deny, err = parseCidrs(denyCidrs)
+	return
+}
+
+// IsAllowed Returns false if the IP is in the deny list, or NOT in the allow list (if any)
+func (filter *MoqIpFilter) IsAllowed(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	if containsIp(filter.deny, ip) {
+		return false
+	}
+	return len(filter.allow) == 0 || containsIp(filter.allow, ip)
+}
+
+type moqIpBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// MoqIpRateLimiter Token bucket per IP (ex: new sessions per second)
+type MoqIpRateLimiter struct {
+	ratePerS float64
+	burst    float64
+
+	clock moqclock.Clock
+
+	// Protected
+	buckets     map[string]*moqIpBucket
+	lastCleanUp time.Time
+	lock        *sync.Mutex
+}
+
+// NewIpRateLimiter Creates a limiter of ratePerS events per second per IP, allowing bursts of burst events (min 1)
+func NewIpRateLimiter(ratePerS float64, burst uint64, clock moqclock.Clock) *MoqIpRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &MoqIpRateLimiter{ratePerS: ratePerS, burst: float64(burst), clock: clock, buckets: map[string]*moqIpBucket{}, lastCleanUp: clock.Now(), lock: new(sync.Mutex)}
+}
+
+// Allow Consumes a token of the IP, returns false if there are none
+func (limiter *MoqIpRateLimiter) Allow(ip string) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := limiter.clock.Now()
+	limiter.cleanUp(now)
+
+	bucket, found := limiter.buckets[ip]
+	if !found {
+		bucket = &moqIpBucket{tokens: limiter.burst, lastRefill: now}
+		limiter.buckets[ip] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * limiter.ratePerS
+	if bucket.tokens > limiter.burst {
+		bucket.tokens = limiter.burst
+	}
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// cleanUp Deletes the buckets that are full again (needs lock)
+func (limiter *MoqIpRateLimiter) cleanUp(now time.Time) {
+	if now.Sub(limiter.lastCleanUp) < IP_RATE_IDLE_CLEANUP_MS*time.Millisecond {
+		return
+	}
+	limiter.lastCleanUp = now
+	for ip, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*limiter.ratePerS >= limiter.burst {
+			delete(limiter.buckets, ip)
+		}
+	}
+}
+
+// GetIp Returns the IP of a remote address (host:port), or the address if it has no port
+func GetIp(remoteAddr string) string {
+	ip, _, errSplit := net.SplitHostPort(remoteAddr)
+	if errSplit != nil {
+		return remoteAddr
+	}
+	return ip
+}
+
+// Helpers
+
+func parseCidrs(cidrs []string) (ipNets []*net.IPNet, err error) {
+	ipNets = []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, errParse := net.ParseCIDR(cidr)
+		if errParse != nil {
+			err = errors.New(fmt.Sprintf("Invalid CIDR %s. Err: %v", cidr, errParse))
+			return
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return
+}
+
+func containsIp(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
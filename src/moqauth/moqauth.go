@@ -0,0 +1,231 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+
+	"golang.org/x/exp/slices"
+)
+
+// ErrUnauthorized Returned by the authorizers when the auth info does NOT allow the action
+var ErrUnauthorized = errors.New("Unauthorized")
+
+type MoqAuthAction string
+
+const (
+	MoqAuthActionAnnounce  MoqAuthAction = "announce"
+	MoqAuthActionSubscribe MoqAuthAction = "subscribe"
+)
+
+type MoqAuthorizerType string
+
+const (
+	// Every ANNOUNCE / SUBSCRIBE is allowed (default)
+	MoqAuthorizerTypeAllowAll MoqAuthorizerType = "allowall"
+	// Auth info has to be one of the configured tokens
+	MoqAuthorizerTypeTokens MoqAuthorizerType = "tokens"
+	// Auth info has to be a token signed with the configured secret (see CreateHmacToken)
+	MoqAuthorizerTypeHmac MoqAuthorizerType = "hmac"
+	// Auth info has to be a JWT signed with one of the configured keys / JWKS keys
+	MoqAuthorizerTypeJwt MoqAuthorizerType = "jwt"
+	// An external auth service decides (see MoqWebhookRequest / MoqWebhookResponse)
+	MoqAuthorizerTypeWebhook MoqAuthorizerType = "webhook"
+)
+
+// MoqAuthRequest What is authorized, and who is asking
+type MoqAuthRequest struct {
+	Action         MoqAuthAction
+	TrackNamespace string
+	// Empty for ANNOUNCE
+	TrackName string
+	AuthInfo  string
+
+	SessionName string
+	Role        moqhelpers.MoqRole
+	Metadata    moqsession.MoqSessionMetadata
+}
+
+// MoqAuthorizer Decides if ANNOUNCE / SUBSCRIBE messages are allowed, returning an error rejects them (Unauthorized)
+type MoqAuthorizer interface {
+	AuthorizeAnnounce(request MoqAuthRequest) error
+	AuthorizeSubscribe(request MoqAuthRequest) error
+}
+
+// MoqAuthTokenData Static token and what it allows
+type MoqAuthTokenData struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// Namespaces allowed, exact or wildcard (ex: "live/*"), empty any
+	TrackNamespaces []string `json:"tracknamespaces"`
+	// announce, subscribe, empty both
+	Actions []MoqAuthAction `json:"actions"`
+}
+
+type MoqAuthorizerData struct {
+	Type MoqAuthorizerType `json:"type"`
+	// tokens
+	Tokens []MoqAuthTokenData `json:"tokens"`
+	// hmac
+	HmacSecret string `json:"hmacsecret"`
+	// jwt, keys and / or JWKS URL, and expected iss / aud (empty NOT checked)
+	JwtKeys       []MoqAuthJwtKey `json:"jwtkeys"`
+	JwksUrl       string          `json:"jwksurl"`
+	JwksRefreshMs int64           `json:"jwksrefreshms"`
+	JwtIssuer     string          `json:"jwtissuer"`
+	JwtAudience   string          `json:"jwtaudience"`
+	// webhook, URL to POST to (and extra headers, ex: Authorization), timeout, default cache time of the decisions, and what to do if it fails (deny, allow)
+	WebhookUrl        string               `json:"webhookurl"`
+	WebhookHeaders    map[string]string    `json:"webhookheaders"`
+	WebhookTimeoutMs  int64                `json:"webhooktimeoutms"`
+	WebhookCacheMs    int64                `json:"webhookcachems"`
+	WebhookFailPolicy MoqWebhookFailPolicy `json:"webhookfailpolicy"`
+}
+
+// IsValidAuthorizer Checks the authorizer type and that it has the needed fields
+func IsValidAuthorizer(authorizerData MoqAuthorizerData) (err error) {
+	switch authorizerData.Type {
+	case "", MoqAuthorizerTypeAllowAll:
+	case MoqAuthorizerTypeTokens:
+		if len(authorizerData.Tokens) == 0 {
+			err = errors.New("Tokens authorizer needs tokens")
+			return
+		}
+		for _, tokenData := range authorizerData.Tokens {
+			if tokenData.Name == "" || tokenData.Token == "" {
+				err = errors.New("Authorizer tokens need a name and a token")
+				return
+			}
+			err = isValidActions(tokenData.Actions)
+			if err != nil {
+				err = errors.New(fmt.Sprintf("Authorizer token %s: %v", tokenData.Name, err))
+				return
+			}
+		}
+	case MoqAuthorizerTypeHmac:
+		if len(authorizerData.HmacSecret) < HMAC_MIN_SECRET_LENGTH {
+			err = errors.New(fmt.Sprintf("HMAC authorizer needs a hmacsecret of at least %d chars", HMAC_MIN_SECRET_LENGTH))
+		}
+	case MoqAuthorizerTypeJwt:
+		if len(authorizerData.JwtKeys) == 0 && authorizerData.JwksUrl == "" {
+			err = errors.New("JWT authorizer needs jwtkeys or jwksurl")
+			return
+		}
+		for _, keyData := range authorizerData.JwtKeys {
+			if (keyData.Secret == "") == (keyData.PublicKeyPath == "") {
+				err = errors.New(fmt.Sprintf("JWT key %s needs a secret or a publickeypath", keyData.Kid))
+				return
+			}
+			if keyData.Secret != "" && len(keyData.Secret) < HMAC_MIN_SECRET_LENGTH {
+				err = errors.New(fmt.Sprintf("JWT key %s needs a secret of at least %d chars", keyData.Kid, HMAC_MIN_SECRET_LENGTH))
+				return
+			}
+		}
+	case MoqAuthorizerTypeWebhook:
+		if authorizerData.WebhookUrl == "" {
+			err = errors.New("Webhook authorizer needs webhookurl")
+			return
+		}
+		if authorizerData.WebhookFailPolicy != "" && !IsValidWebhookFailPolicy(authorizerData.WebhookFailPolicy) {
+			err = errors.New(fmt.Sprintf("Invalid webhookfailpolicy %s", authorizerData.WebhookFailPolicy))
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Invalid authorizer type %s", authorizerData.Type))
+	}
+	return
+}
+
+// New Creates the authorizer indicated in authorizerData
+func New(authorizerData MoqAuthorizerData, clock moqclock.Clock) (authorizer MoqAuthorizer, err error) {
+	err = IsValidAuthorizer(authorizerData)
+	if err != nil {
+		return
+	}
+	switch authorizerData.Type {
+	case MoqAuthorizerTypeTokens:
+		authorizer = &MoqAuthorizerTokens{tokens: authorizerData.Tokens}
+	case MoqAuthorizerTypeHmac:
+		authorizer = &MoqAuthorizerHmac{secret: []byte(authorizerData.HmacSecret), clock: clock}
+	case MoqAuthorizerTypeJwt:
+		authorizer, err = newAuthorizerJwt(authorizerData, clock)
+	case MoqAuthorizerTypeWebhook:
+		authorizer = newAuthorizerWebhook(authorizerData, clock)
+	default:
+		authorizer = &MoqAuthorizerAllowAll{}
+	}
+	return
+}
+
+// MoqAuthorizerAllowAll Allows everything
+type MoqAuthorizerAllowAll struct{}
+
+func (a *MoqAuthorizerAllowAll) AuthorizeAnnounce(request MoqAuthRequest) error {
+	return nil
+}
+
+func (a *MoqAuthorizerAllowAll) AuthorizeSubscribe(request MoqAuthRequest) error {
+	return nil
+}
+
+// MoqAuthorizerTokens Allows the auth infos that are one of the configured tokens, for their namespaces and actions
+type MoqAuthorizerTokens struct {
+	tokens []MoqAuthTokenData
+}
+
+func (a *MoqAuthorizerTokens) AuthorizeAnnounce(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerTokens) AuthorizeSubscribe(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerTokens) authorize(request MoqAuthRequest) error {
+	if request.AuthInfo == "" {
+		return ErrUnauthorized
+	}
+	for _, tokenData := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(tokenData.Token), []byte(request.AuthInfo)) != 1 {
+			continue
+		}
+		if !isActionAllowed(tokenData.Actions, request.Action) || !isNamespaceAllowed(tokenData.TrackNamespaces, request.TrackNamespace) {
+			return errors.New(fmt.Sprintf("Token %s does NOT allow %s %s", tokenData.Name, request.Action, request.TrackNamespace))
+		}
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+// Helpers
+
+func isValidActions(actions []MoqAuthAction) (err error) {
+	for _, action := range actions {
+		if action != MoqAuthActionAnnounce && action != MoqAuthActionSubscribe {
+			err = errors.New(fmt.Sprintf("Invalid action %s", action))
+			return
+		}
+	}
+	return
+}
+
+func isActionAllowed(actions []MoqAuthAction, action MoqAuthAction) bool {
+	return len(actions) == 0 || slices.Contains(actions, action)
+}
+
+// isNamespaceAllowed Returns true if trackNamespace (or a wildcard subscription) is inside any of the patterns
+func isNamespaceAllowed(patterns []string, trackNamespace string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(patterns, func(pattern string) bool { return moqfwdtable.MatchesNamespace(pattern, trackNamespace) })
+}
@@ -0,0 +1,104 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"fmt"
+	"strings"
+)
+
+// Shorter secrets are easy to brute force
+const HMAC_MIN_SECRET_LENGTH = 32
+
+// MoqHmacClaims What a HMAC token allows, signed as JSON
+type MoqHmacClaims struct {
+	// Namespaces allowed, exact or wildcard (ex: "live/*"), empty any
+	TrackNamespaces []string `json:"tracknamespaces,omitempty"`
+	// announce, subscribe, empty both
+	Actions []MoqAuthAction `json:"actions,omitempty"`
+	// Expiration (unix time in seconds), 0 never
+	Exp int64 `json:"exp,omitempty"`
+}
+
+// MoqAuthorizerHmac Allows the auth infos that are tokens signed with the secret (HMAC-SHA256), for their claims
+type MoqAuthorizerHmac struct {
+	secret []byte
+
+	clock moqclock.Clock
+}
+
+// CreateHmacToken Returns a token for the claims, base64url(claims JSON) + "." + base64url(HMAC-SHA256(secret, first part))
+func CreateHmacToken(secret []byte, claims MoqHmacClaims) (token string, err error) {
+	claimsJson, errMarshal := json.Marshal(claims)
+	if errMarshal != nil {
+		err = errMarshal
+		return
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claimsJson)
+	token = payload + "." + base64.RawURLEncoding.EncodeToString(signHmac(secret, payload))
+	return
+}
+
+func (a *MoqAuthorizerHmac) AuthorizeAnnounce(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerHmac) AuthorizeSubscribe(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerHmac) authorize(request MoqAuthRequest) error {
+	claims, errVerify := a.verify(request.AuthInfo)
+	if errVerify != nil {
+		return errVerify
+	}
+	if claims.Exp > 0 && a.clock.Now().Unix() >= claims.Exp {
+		return errors.New("Token expired")
+	}
+	if !isActionAllowed(claims.Actions, request.Action) || !isNamespaceAllowed(claims.TrackNamespaces, request.TrackNamespace) {
+		return errors.New(fmt.Sprintf("Token does NOT allow %s %s", request.Action, request.TrackNamespace))
+	}
+	return nil
+}
+
+// verify Checks the signature and returns the token claims
+func (a *MoqAuthorizerHmac) verify(token string) (claims MoqHmacClaims, err error) {
+	payload, signatureStr, found := strings.Cut(token, ".")
+	if !found {
+		err = ErrUnauthorized
+		return
+	}
+	signature, errDecodeSignature := base64.RawURLEncoding.DecodeString(signatureStr)
+	if errDecodeSignature != nil || !hmac.Equal(signature, signHmac(a.secret, payload)) {
+		err = ErrUnauthorized
+		return
+	}
+	claimsJson, errDecodeClaims := base64.RawURLEncoding.DecodeString(payload)
+	if errDecodeClaims != nil {
+		err = errors.New(fmt.Sprintf("Invalid token claims encoding. Err: %v", errDecodeClaims))
+		return
+	}
+	errUnmarshal := json.Unmarshal(claimsJson, &claims)
+	if errUnmarshal != nil {
+		err = errors.New(fmt.Sprintf("Invalid token claims. Err: %v", errUnmarshal))
+		return
+	}
+	err = isValidActions(claims.Actions)
+	return
+}
+
+func signHmac(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,510 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// Default time JWKS keys are cached
+const JWKS_DEFAULT_REFRESH_MS = 60 * 60 * 1000
+
+// Min time between JWKS fetches triggered by unknown key IDs (so bad tokens can NOT flood the JWKS server)
+const JWKS_MIN_REFETCH_MS = 30 * 1000
+
+// Max time to fetch the JWKS
+const JWKS_FETCH_TIMEOUT_MS = 10 * 1000
+
+// Max size of a JWKS response
+const JWKS_MAX_SIZE_BYTES = 1024 * 1024
+
+// Clock skew allowed checking exp / nbf
+const JWT_LEEWAY_S = 30
+
+// MoqAuthJwtKey Key to verify JWT signatures, a shared secret (HS*) or a RSA / EC public key (RS*, ES*)
+type MoqAuthJwtKey struct {
+	// Matched with the token kid header, empty any
+	Kid    string `json:"kid"`
+	Secret string `json:"secret"`
+	// PEM public key (or certificate), relative to the authorizer config file
+	PublicKeyPath string `json:"publickeypath"`
+	PublicKeyData []byte `json:"-"`
+}
+
+type moqJwtKey struct {
+	kid string
+	// []byte (HS*), *rsa.PublicKey (RS*), *ecdsa.PublicKey (ES*)
+	key interface{}
+}
+
+type moqJwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// moqJwtClaims Registered claims checked, plus what the token allows (same as HMAC claims)
+type moqJwtClaims struct {
+	Exp float64     `json:"exp"`
+	Nbf float64     `json:"nbf"`
+	Iss string      `json:"iss"`
+	Aud interface{} `json:"aud"`
+	// Namespaces allowed, exact or wildcard (ex: "live/*"), empty any
+	TrackNamespaces []string `json:"tracknamespaces"`
+	// Track names allowed (SUBSCRIBE), empty any
+	TrackNames []string `json:"tracknames"`
+	// announce, subscribe, empty both
+	Actions []MoqAuthAction `json:"actions"`
+}
+
+type moqJwtAlg struct {
+	hash crypto.Hash
+	// HS, RS, ES
+	family string
+}
+
+var jwtAlgs = map[string]moqJwtAlg{
+	"HS256": {crypto.SHA256, "HS"}, "HS384": {crypto.SHA384, "HS"}, "HS512": {crypto.SHA512, "HS"},
+	"RS256": {crypto.SHA256, "RS"}, "RS384": {crypto.SHA384, "RS"}, "RS512": {crypto.SHA512, "RS"},
+	"ES256": {crypto.SHA256, "ES"}, "ES384": {crypto.SHA384, "ES"}, "ES512": {crypto.SHA512, "ES"},
+}
+
+// MoqAuthorizerJwt Allows the auth infos that are JWTs signed with one of the configured keys (or JWKS keys), NOT expired, and with claims that allow the action
+type MoqAuthorizerJwt struct {
+	keys          []moqJwtKey
+	jwksUrl       string
+	jwksRefreshMs int64
+	issuer        string
+	audience      string
+
+	clock moqclock.Clock
+
+	// Protected, the JWKS is fetched without the lock (only one fetch at a time, closes jwksFetchDone when it finishes)
+	jwksKeys      []moqJwtKey
+	jwksFetchedAt time.Time
+	jwksFetchDone chan bool
+	jwksLock      *sync.RWMutex
+}
+
+func newAuthorizerJwt(authorizerData MoqAuthorizerData, clock moqclock.Clock) (a *MoqAuthorizerJwt, err error) {
+	a = &MoqAuthorizerJwt{keys: []moqJwtKey{}, jwksUrl: authorizerData.JwksUrl, jwksRefreshMs: authorizerData.JwksRefreshMs, issuer: authorizerData.JwtIssuer, audience: authorizerData.JwtAudience, clock: clock, jwksKeys: []moqJwtKey{}, jwksLock: new(sync.RWMutex)}
+	if a.jwksRefreshMs <= 0 {
+		a.jwksRefreshMs = JWKS_DEFAULT_REFRESH_MS
+	}
+	for _, keyData := range authorizerData.JwtKeys {
+		key := moqJwtKey{kid: keyData.Kid}
+		if keyData.Secret != "" {
+			key.key = []byte(keyData.Secret)
+		} else {
+			key.key, err = parsePublicKeyPem(keyData.PublicKeyData)
+			if err != nil {
+				err = errors.New(fmt.Sprintf("JWT key %s: %v", keyData.Kid, err))
+				return
+			}
+		}
+		a.keys = append(a.keys, key)
+	}
+	if a.jwksUrl != "" {
+		// Failures are retried when tokens arrive
+		a.jwksLock.Lock()
+		fetchDone := a.startJwksFetch()
+		a.jwksLock.Unlock()
+		<-fetchDone
+	}
+	return
+}
+
+func (a *MoqAuthorizerJwt) AuthorizeAnnounce(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerJwt) AuthorizeSubscribe(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerJwt) authorize(request MoqAuthRequest) error {
+	claims, errVerify := a.verify(request.AuthInfo)
+	if errVerify != nil {
+		return errVerify
+	}
+	now := float64(a.clock.Now().Unix())
+	if claims.Exp == 0 {
+		return errors.New("Token without exp")
+	}
+	if now >= claims.Exp+JWT_LEEWAY_S {
+		return errors.New("Token expired")
+	}
+	if claims.Nbf > 0 && now < claims.Nbf-JWT_LEEWAY_S {
+		return errors.New("Token NOT valid yet")
+	}
+	if a.issuer != "" && claims.Iss != a.issuer {
+		return errors.New(fmt.Sprintf("Invalid token issuer %s", claims.Iss))
+	}
+	if a.audience != "" && !hasAudience(claims.Aud, a.audience) {
+		return errors.New("Invalid token audience")
+	}
+	if !isActionAllowed(claims.Actions, request.Action) || !isNamespaceAllowed(claims.TrackNamespaces, request.TrackNamespace) {
+		return errors.New(fmt.Sprintf("Token does NOT allow %s %s", request.Action, request.TrackNamespace))
+	}
+	if request.Action == MoqAuthActionSubscribe && len(claims.TrackNames) > 0 {
+		// Wildcard subscriptions get every track under the prefix, the token can NOT limit them
+		isWildcard, _ := moqfwdtable.GetWildcardPrefix(request.TrackNamespace)
+		if isWildcard {
+			return errors.New(fmt.Sprintf("Token only allows tracks %v, NOT wildcard %s", claims.TrackNames, request.TrackNamespace))
+		}
+		if !slices.Contains(claims.TrackNames, request.TrackName) {
+			return errors.New(fmt.Sprintf("Token does NOT allow %s track %s", request.Action, request.TrackName))
+		}
+	}
+	return nil
+}
+
+// verify Checks the token signature and returns its claims
+func (a *MoqAuthorizerJwt) verify(token string) (claims moqJwtClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		err = ErrUnauthorized
+		return
+	}
+	var header moqJwtHeader
+	err = decodeJwtPart(parts[0], &header)
+	if err != nil {
+		return
+	}
+	alg, validAlg := jwtAlgs[header.Alg]
+	if !validAlg {
+		err = errors.New(fmt.Sprintf("Token alg %s NOT supported", header.Alg))
+		return
+	}
+	signature, errDecodeSignature := base64.RawURLEncoding.DecodeString(parts[2])
+	if errDecodeSignature != nil {
+		err = ErrUnauthorized
+		return
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	verified := false
+	for _, key := range a.getKeys(header.Kid) {
+		if verifyJwtSignature(alg, key.key, signingInput, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		err = ErrUnauthorized
+		return
+	}
+	err = decodeJwtPart(parts[1], &claims)
+	if err != nil {
+		return
+	}
+	err = isValidActions(claims.Actions)
+	return
+}
+
+// getKeys Returns the keys that can have signed a token with this kid, fetching the JWKS again if it is old (the old keys are used meanwhile) or it does NOT have the kid (waits for the fetch)
+func (a *MoqAuthorizerJwt) getKeys(kid string) (keys []moqJwtKey) {
+	keys = filterJwtKeys(a.keys, kid)
+	if a.jwksUrl == "" {
+		return
+	}
+
+	a.jwksLock.RLock()
+	jwksKeys, isOld, isMissingKid := a.checkJwksKeys(kid)
+	a.jwksLock.RUnlock()
+
+	if isOld || isMissingKid {
+		a.jwksLock.Lock()
+		// Checked again, other request can have fetched them meanwhile
+		jwksKeys, isOld, isMissingKid = a.checkJwksKeys(kid)
+		var fetchDone chan bool = nil
+		if isOld || isMissingKid {
+			fetchDone = a.startJwksFetch()
+		}
+		a.jwksLock.Unlock()
+
+		if isMissingKid {
+			<-fetchDone
+			a.jwksLock.RLock()
+			jwksKeys = filterJwtKeys(a.jwksKeys, kid)
+			a.jwksLock.RUnlock()
+		}
+	}
+	keys = append(keys, jwksKeys...)
+	return
+}
+
+// checkJwksKeys Returns the JWKS keys for this kid, and if they have to be fetched again because they are old or the kid is missing (needs jwksLock)
+func (a *MoqAuthorizerJwt) checkJwksKeys(kid string) (jwksKeys []moqJwtKey, isOld bool, isMissingKid bool) {
+	sinceFetch := a.clock.Now().Sub(a.jwksFetchedAt)
+	jwksKeys = filterJwtKeys(a.jwksKeys, kid)
+	isOld = sinceFetch >= time.Duration(a.jwksRefreshMs)*time.Millisecond
+	// Waits for the current fetch, or starts a new one if the last one is NOT too recent
+	isMissingKid = len(jwksKeys) == 0 && (a.jwksFetchDone != nil || sinceFetch >= JWKS_MIN_REFETCH_MS*time.Millisecond)
+	return
+}
+
+// startJwksFetch Starts fetching the JWKS if it is NOT being fetched already, returns the channel closed when that fetch finishes (needs jwksLock)
+func (a *MoqAuthorizerJwt) startJwksFetch() chan bool {
+	if a.jwksFetchDone != nil {
+		return a.jwksFetchDone
+	}
+	a.jwksFetchedAt = a.clock.Now()
+	fetchDone := make(chan bool)
+	a.jwksFetchDone = fetchDone
+
+	go func() {
+		keys, errJwks := fetchJwks(a.jwksUrl)
+
+		a.jwksLock.Lock()
+		if errJwks != nil {
+			// Keeps using the previous keys
+			log.Warning(fmt.Sprintf("Fetching JWKS %s. Err: %v", a.jwksUrl, errJwks))
+		} else {
+			a.jwksKeys = keys
+			log.Info(fmt.Sprintf("Fetched JWKS %s, keys: %d", a.jwksUrl, len(keys)))
+		}
+		a.jwksFetchDone = nil
+		a.jwksLock.Unlock()
+
+		close(fetchDone)
+	}()
+	return fetchDone
+}
+
+// Helpers
+
+// fetchJwks Fetches and parses the JWKS keys
+func fetchJwks(jwksUrl string) (keys []moqJwtKey, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), JWKS_FETCH_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodGet, jwksUrl, nil)
+	if errReq != nil {
+		err = errReq
+		return
+	}
+	resp, errResp := http.DefaultClient.Do(req)
+	if errResp != nil {
+		err = errResp
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(fmt.Sprintf("JWKS server answered %d", resp.StatusCode))
+		return
+	}
+	body, errRead := io.ReadAll(io.LimitReader(resp.Body, JWKS_MAX_SIZE_BYTES))
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	keys, err = parseJwks(body)
+	return
+}
+
+type moqJwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// parseJwks Returns the signing keys of a JWKS (unknown key types are skipped)
+func parseJwks(data []byte) (keys []moqJwtKey, err error) {
+	var jwks struct {
+		Keys []moqJwk `json:"keys"`
+	}
+	err = json.Unmarshal(data, &jwks)
+	if err != nil {
+		return
+	}
+	keys = []moqJwtKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, errJwk := parseJwk(jwk)
+		if errJwk != nil {
+			log.Warning(fmt.Sprintf("Skipping JWKS key %s. Err: %v", jwk.Kid, errJwk))
+			continue
+		}
+		keys = append(keys, moqJwtKey{kid: jwk.Kid, key: key})
+	}
+	return
+}
+
+func parseJwk(jwk moqJwk) (key interface{}, err error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			err = errors.New("Invalid RSA key")
+			return
+		}
+		key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			err = errors.New(fmt.Sprintf("EC curve %s NOT supported", jwk.Crv))
+			return
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			err = errors.New("Invalid EC key")
+			return
+		}
+		key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "oct":
+		k, errK := base64.RawURLEncoding.DecodeString(jwk.K)
+		if errK != nil || len(k) == 0 {
+			err = errors.New("Invalid oct key")
+			return
+		}
+		key = k
+	default:
+		err = errors.New(fmt.Sprintf("Key type %s NOT supported", jwk.Kty))
+	}
+	return
+}
+
+// parsePublicKeyPem Returns the RSA / EC public key of a PEM public key or certificate
+func parsePublicKeyPem(data []byte) (key interface{}, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		err = errors.New("No PEM data found")
+		return
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, errCert := x509.ParseCertificate(block.Bytes)
+		if errCert != nil {
+			err = errCert
+			return
+		}
+		key = cert.PublicKey
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return
+		}
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		err = errors.New("Public key has to be RSA or EC")
+	}
+	return
+}
+
+func filterJwtKeys(keys []moqJwtKey, kid string) (filtered []moqJwtKey) {
+	filtered = []moqJwtKey{}
+	for _, key := range keys {
+		if kid == "" || key.kid == "" || key.kid == kid {
+			filtered = append(filtered, key)
+		}
+	}
+	return
+}
+
+// verifyJwtSignature Returns true if signature is valid, the key type has to match the alg (so a public key can NOT be used as HMAC secret)
+func verifyJwtSignature(alg moqJwtAlg, key interface{}, signingInput string, signature []byte) bool {
+	if alg.family == "HS" {
+		secret, isSecret := key.([]byte)
+		if !isSecret {
+			return false
+		}
+		mac := hmac.New(alg.hash.New, secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(signature, mac.Sum(nil))
+	}
+
+	hasher := alg.hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		return alg.family == "RS" && rsa.VerifyPKCS1v15(publicKey, alg.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// r || s, each one of the curve size
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if alg.family != "ES" || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(publicKey, digest, r, s)
+	}
+	return false
+}
+
+func decodeJwtPart(part string, data interface{}) (err error) {
+	partJson, errDecode := base64.RawURLEncoding.DecodeString(part)
+	if errDecode != nil {
+		err = ErrUnauthorized
+		return
+	}
+	errUnmarshal := json.Unmarshal(partJson, data)
+	if errUnmarshal != nil {
+		err = errors.New(fmt.Sprintf("Invalid token. Err: %v", errUnmarshal))
+	}
+	return
+}
+
+// hasAudience aud can be a string or a list of them
+func hasAudience(aud interface{}, audience string) bool {
+	switch audValue := aud.(type) {
+	case string:
+		return audValue == audience
+	case []interface{}:
+		for _, item := range audValue {
+			if itemStr, isStr := item.(string); isStr && itemStr == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
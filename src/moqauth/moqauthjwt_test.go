@@ -0,0 +1,238 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"facebookexperimental/moq-go-server/moqclock"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_JWKS_REFRESH_MS = 60 * 1000
+
+// Max time waiting for something that should NOT block
+const TEST_TIMEOUT = 5 * time.Second
+
+// testJwksServer Serves the JWKS of the indicated secrets (kid -> secret), fetches block while it is paused
+type testJwksServer struct {
+	*httptest.Server
+
+	secrets map[string]string
+	fetches int
+	paused  chan bool
+	// Receives a value per fetch (when it arrives)
+	fetched chan bool
+	lock    *sync.Mutex
+}
+
+// Old JWKS keys are used while the new ones are fetched, and all the requests share that fetch
+func TestJwksStaleKeysWhileFetching(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(1700000000, 0))
+	server := newTestJwksServer(t, map[string]string{"k1": "secret-1"})
+	a := newTestAuthorizerJwt(t, server, clock)
+
+	server.pause(map[string]string{"k1": "secret-1", "k2": "secret-2"})
+	clock.Advance(TEST_JWKS_REFRESH_MS * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := authorizeWithTimeout(t, a, createTestJwt(clock, "k1", "secret-1")); err != nil {
+			t.Fatalf("Token signed with the old key should be allowed while fetching, err: %v", err)
+		}
+	}
+	<-server.fetched
+
+	// New kid, waits for the current fetch
+	newKidResult := make(chan error, 1)
+	go func() {
+		newKidResult <- a.AuthorizeSubscribe(createTestRequest(createTestJwt(clock, "k2", "secret-2")))
+	}()
+	select {
+	case err := <-newKidResult:
+		t.Fatalf("Token with a new kid should wait for the fetch, err: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.resume()
+	select {
+	case err := <-newKidResult:
+		if err != nil {
+			t.Fatalf("Token with the fetched kid should be allowed, err: %v", err)
+		}
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatalf("Token with a new kid still waiting after the fetch")
+	}
+	if fetches := server.getFetches(); fetches != 2 {
+		t.Fatalf("JWKS fetches %d, want 2 (initial and refresh)", fetches)
+	}
+}
+
+// Unknown kids fetch the JWKS again, but NOT more often than JWKS_MIN_REFETCH_MS
+func TestJwksUnknownKidRefetch(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(1700000000, 0))
+	server := newTestJwksServer(t, map[string]string{"k1": "secret-1"})
+	a := newTestAuthorizerJwt(t, server, clock)
+	token := createTestJwt(clock, "k3", "secret-3")
+
+	if err := authorizeWithTimeout(t, a, token); err == nil {
+		t.Fatalf("Token with an unknown kid should NOT be allowed")
+	}
+	if fetches := server.getFetches(); fetches != 1 {
+		t.Fatalf("JWKS fetches %d, want 1 (refetch too recent)", fetches)
+	}
+
+	server.setSecrets(map[string]string{"k1": "secret-1", "k3": "secret-3"})
+	clock.Advance(JWKS_MIN_REFETCH_MS * time.Millisecond)
+	if err := authorizeWithTimeout(t, a, createTestJwt(clock, "k3", "secret-3")); err != nil {
+		t.Fatalf("Token with the refetched kid should be allowed, err: %v", err)
+	}
+	if fetches := server.getFetches(); fetches != 2 {
+		t.Fatalf("JWKS fetches %d, want 2", fetches)
+	}
+}
+
+// tracknames claim limits the tracks subscribed, so it can NOT be used for wildcard subscriptions (they get every track under the prefix)
+func TestJwtTrackNames(t *testing.T) {
+	tests := []struct {
+		name           string
+		trackNames     []string
+		trackNamespace string
+		trackName      string
+		wantErr        bool
+	}{
+		{name: "allowed track", trackNames: []string{"video"}, trackNamespace: "live", trackName: "video", wantErr: false},
+		{name: "other track", trackNames: []string{"video"}, trackNamespace: "live", trackName: "audio", wantErr: true},
+		{name: "wildcard with tracknames", trackNames: []string{"video"}, trackNamespace: "live/*", trackName: "video", wantErr: true},
+		{name: "wildcard without tracknames", trackNames: nil, trackNamespace: "live/*", trackName: "", wantErr: false},
+	}
+	clock := moqclock.NewFake(time.Unix(1700000000, 0))
+	server := newTestJwksServer(t, map[string]string{"k1": "secret-1"})
+	a := newTestAuthorizerJwt(t, server, clock)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{"exp": clock.Now().Add(time.Hour).Unix(), "tracknames": tt.trackNames}
+			request := MoqAuthRequest{Action: MoqAuthActionSubscribe, TrackNamespace: tt.trackNamespace, TrackName: tt.trackName, AuthInfo: createTestJwtWithClaims("k1", "secret-1", claims)}
+			err := a.AuthorizeSubscribe(request)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AuthorizeSubscribe %s/%s err %v, want error %t", tt.trackNamespace, tt.trackName, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Helpers
+
+func newTestJwksServer(t *testing.T, secrets map[string]string) *testJwksServer {
+	server := &testJwksServer{secrets: secrets, fetched: make(chan bool, 16), lock: new(sync.Mutex)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.lock.Lock()
+		server.fetches++
+		paused := server.paused
+		server.lock.Unlock()
+		server.fetched <- true
+
+		if paused != nil {
+			<-paused
+		}
+		server.lock.Lock()
+		jwks := createTestJwks(server.secrets)
+		server.lock.Unlock()
+		w.Write(jwks)
+	}))
+	t.Cleanup(func() {
+		server.resume()
+		server.Close()
+	})
+	return server
+}
+
+// pause Next fetches block until resume, and then they get these secrets
+func (server *testJwksServer) pause(secrets map[string]string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.paused = make(chan bool)
+	server.secrets = secrets
+}
+
+func (server *testJwksServer) resume() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.paused != nil {
+		close(server.paused)
+		server.paused = nil
+	}
+}
+
+func (server *testJwksServer) setSecrets(secrets map[string]string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.secrets = secrets
+}
+
+func (server *testJwksServer) getFetches() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return server.fetches
+}
+
+func newTestAuthorizerJwt(t *testing.T, server *testJwksServer, clock moqclock.Clock) *MoqAuthorizerJwt {
+	a, err := newAuthorizerJwt(MoqAuthorizerData{Type: MoqAuthorizerTypeJwt, JwksUrl: server.URL, JwksRefreshMs: TEST_JWKS_REFRESH_MS}, clock)
+	if err != nil {
+		t.Fatalf("Creating JWT authorizer, err: %v", err)
+	}
+	<-server.fetched
+	return a
+}
+
+// authorizeWithTimeout Fails the test if the authorization blocks
+func authorizeWithTimeout(t *testing.T, a *MoqAuthorizerJwt, token string) (err error) {
+	result := make(chan error, 1)
+	go func() {
+		result <- a.AuthorizeSubscribe(createTestRequest(token))
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatalf("Authorization blocked")
+	}
+	return
+}
+
+func createTestRequest(token string) MoqAuthRequest {
+	return MoqAuthRequest{Action: MoqAuthActionSubscribe, TrackNamespace: "live", TrackName: "video", AuthInfo: token}
+}
+
+func createTestJwks(secrets map[string]string) []byte {
+	keys := []moqJwk{}
+	for kid, secret := range secrets {
+		keys = append(keys, moqJwk{Kty: "oct", Kid: kid, K: base64.RawURLEncoding.EncodeToString([]byte(secret))})
+	}
+	jwks, _ := json.Marshal(map[string][]moqJwk{"keys": keys})
+	return jwks
+}
+
+// createTestJwt HS256 token valid for an hour
+func createTestJwt(clock moqclock.Clock, kid string, secret string) string {
+	return createTestJwtWithClaims(kid, secret, map[string]interface{}{"exp": clock.Now().Add(time.Hour).Unix()})
+}
+
+func createTestJwtWithClaims(kid string, secret string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(moqJwtHeader{Alg: "HS256", Kid: kid})
+	claimsJson, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
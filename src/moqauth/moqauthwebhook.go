@@ -0,0 +1,216 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default max time to wait for the auth service
+const WEBHOOK_DEFAULT_TIMEOUT_MS = 2000
+
+// Max decisions cached (expired ones are purged when it is reached)
+const WEBHOOK_CACHE_MAX_ENTRIES = 10000
+
+// Max size of an auth service response
+const WEBHOOK_MAX_RESPONSE_BYTES = 64 * 1024
+
+// What to do when the auth service does NOT answer (timeout, error, invalid response)
+type MoqWebhookFailPolicy string
+
+const (
+	MoqWebhookFailPolicyDeny  MoqWebhookFailPolicy = "deny"
+	MoqWebhookFailPolicyAllow MoqWebhookFailPolicy = "allow"
+)
+
+// MoqWebhookRequest Posted to the auth service
+type MoqWebhookRequest struct {
+	Action         MoqAuthAction      `json:"action"`
+	TrackNamespace string             `json:"tracknamespace"`
+	TrackName      string             `json:"trackname"`
+	AuthInfo       string             `json:"authinfo"`
+	SessionName    string             `json:"session"`
+	Role           moqhelpers.MoqRole `json:"role"`
+	RemoteAddr     string             `json:"remoteaddr"`
+	UserAgent      string             `json:"useragent"`
+}
+
+// MoqWebhookResponse Answer of the auth service
+type MoqWebhookResponse struct {
+	Allow bool `json:"allow"`
+	// Time the decision can be cached (0 default cache time)
+	TtlMs  int64  `json:"ttlms"`
+	Reason string `json:"reason"`
+}
+
+type moqWebhookDecision struct {
+	allow     bool
+	reason    string
+	expiresAt time.Time
+}
+
+// MoqAuthorizerWebhook Asks an external auth service, caching its decisions
+type MoqAuthorizerWebhook struct {
+	url        string
+	headers    map[string]string
+	timeoutMs  int64
+	cacheMs    int64
+	failPolicy MoqWebhookFailPolicy
+
+	client *http.Client
+	clock  moqclock.Clock
+
+	// Protected
+	cache map[string]moqWebhookDecision
+	lock  *sync.Mutex
+}
+
+func IsValidWebhookFailPolicy(policy MoqWebhookFailPolicy) bool {
+	return policy == MoqWebhookFailPolicyDeny || policy == MoqWebhookFailPolicyAllow
+}
+
+func newAuthorizerWebhook(authorizerData MoqAuthorizerData, clock moqclock.Clock) *MoqAuthorizerWebhook {
+	a := &MoqAuthorizerWebhook{url: authorizerData.WebhookUrl, headers: authorizerData.WebhookHeaders, timeoutMs: authorizerData.WebhookTimeoutMs, cacheMs: authorizerData.WebhookCacheMs, failPolicy: authorizerData.WebhookFailPolicy, clock: clock, cache: map[string]moqWebhookDecision{}, lock: new(sync.Mutex)}
+	if a.timeoutMs <= 0 {
+		a.timeoutMs = WEBHOOK_DEFAULT_TIMEOUT_MS
+	}
+	if a.failPolicy == "" {
+		a.failPolicy = MoqWebhookFailPolicyDeny
+	}
+	a.client = &http.Client{Timeout: time.Duration(a.timeoutMs) * time.Millisecond}
+	return a
+}
+
+func (a *MoqAuthorizerWebhook) AuthorizeAnnounce(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerWebhook) AuthorizeSubscribe(request MoqAuthRequest) error {
+	return a.authorize(request)
+}
+
+func (a *MoqAuthorizerWebhook) authorize(request MoqAuthRequest) error {
+	// Auth info is NOT kept in memory
+	cacheKey := getWebhookCacheKey(request)
+	decision, found := a.getCached(cacheKey)
+	if !found {
+		response, errCall := a.call(request)
+		if errCall != nil {
+			log.WithFields(log.Fields{"url": a.url, "failPolicy": a.failPolicy}).WithError(errCall).Warning("Auth webhook failed")
+			if a.failPolicy == MoqWebhookFailPolicyAllow {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("Auth service NOT available. Err: %v", errCall))
+		}
+		decision = moqWebhookDecision{allow: response.Allow, reason: response.Reason}
+		ttlMs := a.cacheMs
+		if response.TtlMs > 0 {
+			ttlMs = response.TtlMs
+		}
+		if ttlMs > 0 {
+			decision.expiresAt = a.clock.Now().Add(time.Duration(ttlMs) * time.Millisecond)
+			a.setCached(cacheKey, decision)
+		}
+	}
+	if !decision.allow {
+		return errors.New(fmt.Sprintf("Denied by auth service (%s)", decision.reason))
+	}
+	return nil
+}
+
+// call Posts the request to the auth service
+func (a *MoqAuthorizerWebhook) call(request MoqAuthRequest) (response MoqWebhookResponse, err error) {
+	webhookRequest := MoqWebhookRequest{Action: request.Action, TrackNamespace: request.TrackNamespace, TrackName: request.TrackName, AuthInfo: request.AuthInfo, SessionName: request.SessionName, Role: request.Role, RemoteAddr: request.Metadata.RemoteAddr, UserAgent: request.Metadata.UserAgent}
+	body, errMarshal := json.Marshal(webhookRequest)
+	if errMarshal != nil {
+		err = errMarshal
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if errReq != nil {
+		err = errReq
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range a.headers {
+		req.Header.Set(name, value)
+	}
+	resp, errResp := a.client.Do(req)
+	if errResp != nil {
+		err = errResp
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(fmt.Sprintf("Auth service answered %d", resp.StatusCode))
+		return
+	}
+	respBody, errRead := io.ReadAll(io.LimitReader(resp.Body, WEBHOOK_MAX_RESPONSE_BYTES))
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	err = json.Unmarshal(respBody, &response)
+	return
+}
+
+func (a *MoqAuthorizerWebhook) getCached(cacheKey string) (decision moqWebhookDecision, found bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	decision, found = a.cache[cacheKey]
+	if found && !a.clock.Now().Before(decision.expiresAt) {
+		delete(a.cache, cacheKey)
+		found = false
+	}
+	return
+}
+
+func (a *MoqAuthorizerWebhook) setCached(cacheKey string, decision moqWebhookDecision) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.cache) >= WEBHOOK_CACHE_MAX_ENTRIES {
+		now := a.clock.Now()
+		for key, cached := range a.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(a.cache, key)
+			}
+		}
+		if len(a.cache) >= WEBHOOK_CACHE_MAX_ENTRIES {
+			// All valid, start again
+			a.cache = map[string]moqWebhookDecision{}
+		}
+	}
+	a.cache[cacheKey] = decision
+}
+
+// Helpers
+
+func getWebhookCacheKey(request MoqAuthRequest) string {
+	hash := sha256.Sum256([]byte(string(request.Action) + "\n" + request.TrackNamespace + "\n" + request.TrackName + "\n" + request.AuthInfo))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqbandwidth
+
+import (
+	"facebookexperimental/moq-go-server/moqclock"
+	"sync"
+	"time"
+)
+
+const RATE_WINDOW_MS = 1000
+
+type MoqBandwidthUsage struct {
+	BudgetBps uint64
+	IngestBps uint64
+	EgressBps uint64
+	Saturated bool
+}
+
+// MoqBandwidthBudget Relay wide (ingest + egress) bandwidth budget
+type MoqBandwidthBudget struct {
+	// 0 means unlimited
+	budgetBps uint64
+
+	// Current window
+	windowStart       time.Time
+	windowIngestBytes uint64
+	windowEgressBytes uint64
+
+	// Last completed window
+	ingestBps uint64
+	egressBps uint64
+
+	clock moqclock.Clock
+
+	lock *sync.Mutex
+}
+
+// MoqTokenBucket Rate limiter (per session) with burst
+type MoqTokenBucket struct {
+	rateBps    uint64
+	burstBytes uint64
+
+	// Available bytes (negative after sending objects bigger than the burst)
+	tokens     float64
+	lastRefill time.Time
+
+	clock moqclock.Clock
+
+	lock *sync.Mutex
+}
+
+// New Creates a new bandwidth budget
+func New(budgetBps uint64, clock moqclock.Clock) *MoqBandwidthBudget {
+	b := MoqBandwidthBudget{budgetBps: budgetBps, windowStart: clock.Now(), clock: clock, lock: new(sync.Mutex)}
+
+	return &b
+}
+
+func (b *MoqBandwidthBudget) AddIngest(bytes uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rollWindow()
+	b.windowIngestBytes += bytes
+}
+
+func (b *MoqBandwidthBudget) AddEgress(bytes uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rollWindow()
+	b.windowEgressBytes += bytes
+}
+
+// IsSaturated Indicates total (ingest + egress) rate is at or over budget
+func (b *MoqBandwidthBudget) IsSaturated() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rollWindow()
+	return b.isSaturated()
+}
+
+// GetRemainingBps Remaining budget, 0 if saturated (or max uint64 if unlimited)
+func (b *MoqBandwidthBudget) GetRemainingBps() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rollWindow()
+	if b.budgetBps == 0 {
+		return ^uint64(0)
+	}
+	if b.isSaturated() {
+		return 0
+	}
+	return b.budgetBps - (b.ingestBps + b.egressBps)
+}
+
+func (b *MoqBandwidthBudget) GetUsage() MoqBandwidthUsage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rollWindow()
+	return MoqBandwidthUsage{BudgetBps: b.budgetBps, IngestBps: b.ingestBps, EgressBps: b.egressBps, Saturated: b.isSaturated()}
+}
+
+// NewTokenBucket Creates a new token bucket starting full
+func NewTokenBucket(rateBps uint64, burstBytes uint64, clock moqclock.Clock) *MoqTokenBucket {
+	tb := MoqTokenBucket{rateBps: rateBps, burstBytes: burstBytes, tokens: float64(burstBytes), lastRefill: clock.Now(), clock: clock, lock: new(sync.Mutex)}
+
+	return &tb
+}
+
+// Take Consumes the tokens for those bytes if available, if not returns the time to wait for them (nothing consumed)
+func (tb *MoqTokenBucket) Take(bytes uint64) (wait time.Duration) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill()
+
+	// Objects bigger than the burst only wait for a full bucket
+	needed := float64(bytes)
+	if needed > float64(tb.burstBytes) {
+		needed = float64(tb.burstBytes)
+	}
+	if tb.tokens >= needed {
+		tb.tokens -= float64(bytes)
+		return
+	}
+	wait = time.Duration((needed - tb.tokens) * 8 / float64(tb.rateBps) * float64(time.Second))
+	return
+}
+
+// Helpers
+
+func (tb *MoqTokenBucket) refill() {
+	now := tb.clock.Now()
+	tb.tokens += now.Sub(tb.lastRefill).Seconds() * float64(tb.rateBps) / 8
+	if tb.tokens > float64(tb.burstBytes) {
+		tb.tokens = float64(tb.burstBytes)
+	}
+	tb.lastRefill = now
+}
+
+func (b *MoqBandwidthBudget) isSaturated() bool {
+	return b.budgetBps > 0 && b.ingestBps+b.egressBps >= b.budgetBps
+}
+
+func (b *MoqBandwidthBudget) rollWindow() {
+	now := b.clock.Now()
+	elapsed := now.Sub(b.windowStart)
+	if elapsed < RATE_WINDOW_MS*time.Millisecond {
+		return
+	}
+	b.ingestBps = uint64(float64(b.windowIngestBytes*8) / elapsed.Seconds())
+	b.egressBps = uint64(float64(b.windowEgressBytes*8) / elapsed.Seconds())
+	b.windowIngestBytes = 0
+	b.windowEgressBytes = 0
+	b.windowStart = now
+}
@@ -0,0 +1,369 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqhelpers/quichelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// Max time to establish the session and receive the server SETUP
+const CLIENT_CONNECT_TIMEOUT_MS = 10 * 1000
+
+// Test payloads start with this magic and the time they were created (unix ns), so subscribers can measure the latency
+const TEST_PAYLOAD_MAGIC = "MOQT"
+const TEST_PAYLOAD_HEADER_SIZE = 4 + 8
+
+// Objects received and NOT returned by ReceiveObject yet, the stream readers wait when it is full
+const CLIENT_RECEIVED_OBJECTS_QUEUE_SIZE = 1024
+
+type MoqClientConfig struct {
+	// Relay WebTransport endpoint (example: https://localhost:4433/moq)
+	Url string
+	// PEM certificate (or CA) trusted besides the system ones, ex: the relay self-signed one
+	CertPath string
+	// Skip the relay certificate verification (local testing only)
+	Insecure bool
+}
+
+// MoqClientSession Session the client runs on, implemented by WebTransport sessions and the in-memory ones of moqtest
+type MoqClientSession interface {
+	Context() context.Context
+	OpenStreamSync(ctx context.Context) (webtransport.Stream, error)
+	OpenUniStreamSync(ctx context.Context) (webtransport.SendStream, error)
+	AcceptUniStream(ctx context.Context) (webtransport.ReceiveStream, error)
+	CloseWithError(code webtransport.SessionErrorCode, msg string) error
+}
+
+// MoqClient MOQT client session to a relay (test tools), control messages are read by the caller and writes are serialized
+type MoqClient struct {
+	session MoqClientSession
+	// Nil if the session was NOT dialed by the client
+	dialer        *webtransport.Dialer
+	controlStream webtransport.Stream
+
+	// Object streams are accepted and read in background since the first ReceiveObject
+	receivedObjects chan moqReceivedObject
+	receiveOnce     *sync.Once
+
+	controlLock *sync.Mutex
+}
+
+// moqReceivedObject Object (or error of its stream) waiting for ReceiveObject
+type moqReceivedObject struct {
+	header  moqobject.MoqObjectHeader
+	payload []byte
+	err     error
+}
+
+// Connect Establishes the WebTransport session and does the SETUP with role
+func Connect(ctx context.Context, config MoqClientConfig, role moqhelpers.MoqRole) (client *MoqClient, err error) {
+	tlsConfig, errTls := createTLSConfig(config)
+	if errTls != nil {
+		err = errTls
+		return
+	}
+	dialer := &webtransport.Dialer{RoundTripper: &http3.RoundTripper{TLSClientConfig: tlsConfig}}
+
+	connectCtx, cancel := context.WithTimeout(ctx, CLIENT_CONNECT_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+	_, session, errDial := dialer.Dial(connectCtx, config.Url, nil)
+	if errDial != nil {
+		dialer.Close()
+		err = errDial
+		return
+	}
+	client, err = setup(connectCtx, session, dialer, role)
+	return
+}
+
+// Setup Does the SETUP with role on an established session
+func Setup(ctx context.Context, session MoqClientSession, role moqhelpers.MoqRole) (client *MoqClient, err error) {
+	return setup(ctx, session, nil, role)
+}
+
+// Announce Sends the ANNOUNCE and waits for its answer (before reading other control messages)
+func (client *MoqClient) Announce(trackNamespace string, authInfo string) (err error) {
+	err = client.WriteControl(func(stream webtransport.Stream) error {
+		return moqhelpers.SendAnnounce(stream, moqhelpers.CreateAnnounce(trackNamespace, authInfo))
+	})
+	if err != nil {
+		return
+	}
+	moqMsg, moqMsgType, errReceive := client.ReceiveControlMessage()
+	if errReceive != nil {
+		if moqMsgType == moqhelpers.MoqIdMessageAnnounceError {
+			errReceive = errors.New("ANNOUNCE rejected")
+		}
+		err = errReceive
+		return
+	}
+	switch answer := moqMsg.(type) {
+	case moqhelpers.MoqMessageAnnounceOk:
+		if answer.TrackNamespace != trackNamespace {
+			err = errors.New(fmt.Sprintf("Received ANNOUNCE OK of namespace %s, expected %s", answer.TrackNamespace, trackNamespace))
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Expecting ANNOUNCE OK, received %T", moqMsg))
+	}
+	return
+}
+
+// Subscribe Sends the SUBSCRIBE (from the latest group) and waits for its answer (before reading other control messages), trackId identifies its objects
+func (client *MoqClient) Subscribe(trackNamespace string, trackName string, authInfo string) (trackId uint64, err error) {
+	moqSubscribe := moqhelpers.MoqMessageSubscribe{
+		TrackNamespace: trackNamespace,
+		TrackName:      trackName,
+		StartGroup:     moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeRelativePrevious, Value: 0},
+		StartObject:    moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeAbsolute, Value: 0},
+		EndGroup:       moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeNone},
+		EndObject:      moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeNone},
+		AuthInfo:       authInfo,
+	}
+	err = client.WriteControl(func(stream webtransport.Stream) error {
+		return moqhelpers.SendSubscribe(stream, moqSubscribe)
+	})
+	if err != nil {
+		return
+	}
+	moqMsg, _, errReceive := client.ReceiveControlMessage()
+	if errReceive != nil {
+		err = errReceive
+		return
+	}
+	switch answer := moqMsg.(type) {
+	case moqhelpers.MoqMessageSubscribeOk:
+		if answer.TrackNamespace != trackNamespace || answer.TrackName != trackName {
+			err = errors.New(fmt.Sprintf("Received SUBSCRIBE OK of %s/%s, expected %s/%s", answer.TrackNamespace, answer.TrackName, trackNamespace, trackName))
+			return
+		}
+		trackId = answer.TrackId
+	case moqhelpers.MoqMessageSubscribeError:
+		err = errors.New(fmt.Sprintf("SUBSCRIBE rejected (%d): %s", answer.ErrCode, answer.ErrMsg))
+	default:
+		err = errors.New(fmt.Sprintf("Expecting SUBSCRIBE OK, received %T", moqMsg))
+	}
+	return
+}
+
+// ReceiveControlMessage Reads the next control message (only one reader at a time)
+func (client *MoqClient) ReceiveControlMessage() (moqMsg interface{}, moqMsgType moqhelpers.MoqMessageType, err error) {
+	return moqhelpers.ReceiveMessage(client.controlStream)
+}
+
+// WriteControl Writes control messages, serialized with the other writers
+func (client *MoqClient) WriteControl(write func(stream webtransport.Stream) error) error {
+	client.controlLock.Lock()
+	defer client.controlLock.Unlock()
+
+	return write(client.controlStream)
+}
+
+// SendObject Sends an object in its own unidirectional stream using trackId (from the SUBSCRIBE OK sent)
+func (client *MoqClient) SendObject(ctx context.Context, trackId uint64, moqObjHeader moqobject.MoqObjectHeader, payload []byte) (err error) {
+	moqObj := moqobject.New(moqObjHeader, 0, time.Now())
+	moqObj.PayloadWrite(payload)
+	moqObj.SetEof()
+
+	stream, errOpen := client.session.OpenUniStreamSync(ctx)
+	if errOpen != nil {
+		err = errOpen
+		return
+	}
+	err = moqhelpers.SendObject(stream, moqObj, trackId)
+	if err != nil {
+		stream.CancelWrite(0)
+		return
+	}
+	err = stream.Close()
+	return
+}
+
+// ReceiveObject Waits for the next object completely received, err is the error of its stream (ex: reset) or why it stopped waiting.
+// It can be called from several goroutines, the object streams (batched ones carry several objects) are read in background
+func (client *MoqClient) ReceiveObject(ctx context.Context) (moqObjHeader moqobject.MoqObjectHeader, payload []byte, err error) {
+	client.receiveOnce.Do(func() {
+		go client.acceptObjectStreams()
+	})
+
+	select {
+	case received := <-client.receivedObjects:
+		moqObjHeader, payload, err = received.header, received.payload, received.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-client.session.Context().Done():
+		err = client.session.Context().Err()
+	}
+	return
+}
+
+// Context Returns the session context (done when the session ends)
+func (client *MoqClient) Context() context.Context {
+	return client.session.Context()
+}
+
+// Close Closes the session with reason
+func (client *MoqClient) Close(reason string) {
+	client.session.CloseWithError(0, reason)
+	if client.dialer != nil {
+		client.dialer.Close()
+	}
+}
+
+func setup(ctx context.Context, session MoqClientSession, dialer *webtransport.Dialer, role moqhelpers.MoqRole) (client *MoqClient, err error) {
+	client = &MoqClient{session: session, dialer: dialer, receivedObjects: make(chan moqReceivedObject, CLIENT_RECEIVED_OBJECTS_QUEUE_SIZE), receiveOnce: new(sync.Once), controlLock: new(sync.Mutex)}
+	err = client.sendSetup(ctx, role)
+	if err != nil {
+		client.Close("Setup failed")
+		client = nil
+	}
+	return
+}
+
+func (client *MoqClient) acceptObjectStreams() {
+	for {
+		stream, errAccept := client.session.AcceptUniStream(client.session.Context())
+		if errAccept != nil {
+			// Session closed
+			return
+		}
+		go client.receiveStreamObjects(quichelpers.NewBufferedReceiveStream(stream))
+	}
+}
+
+// receiveStreamObjects Reads the object of the stream, or all of them if they have length (batched stream)
+func (client *MoqClient) receiveStreamObjects(stream webtransport.ReceiveStream) {
+	for first := true; ; first = false {
+		moqMsg, _, errReceive := moqhelpers.ReceiveMessage(stream)
+		if errReceive == io.EOF && !first {
+			// End of batched stream
+			return
+		}
+
+		received := moqReceivedObject{err: errReceive}
+		var payloadStream quichelpers.IWtReadableStream = stream
+		batched := false
+		if errReceive == nil {
+			switch moqObjMsg := moqMsg.(type) {
+			case moqobject.MoqObjectHeader:
+				received.header = moqObjMsg
+			case moqhelpers.MoqMessageObjectWithLength:
+				received.header = moqObjMsg.MoqObjectHeader
+				payloadStream = quichelpers.NewLimitedReader(stream, moqObjMsg.PayloadLength)
+				batched = true
+			default:
+				stream.CancelRead(0)
+				received.err = errors.New(fmt.Sprintf("Expecting object, received %T", moqMsg))
+			}
+		}
+		if received.err == nil {
+			moqObj := moqobject.New(received.header, 0, time.Now())
+			received.err = moqhelpers.ReadObjPayloadToEOS(payloadStream, moqObj)
+			if received.err == nil {
+				received.payload, received.err = io.ReadAll(moqObj.NewReader())
+			}
+		}
+
+		select {
+		case client.receivedObjects <- received:
+		case <-client.session.Context().Done():
+			return
+		}
+		if !batched || received.err != nil {
+			return
+		}
+	}
+}
+
+func (client *MoqClient) sendSetup(ctx context.Context, role moqhelpers.MoqRole) (err error) {
+	stream, errOpen := client.session.OpenStreamSync(ctx)
+	if errOpen != nil {
+		err = errOpen
+		return
+	}
+	stream = quichelpers.NewBufferedStream(stream)
+	client.controlStream = stream
+
+	err = moqhelpers.SendClientSetup(stream, moqhelpers.CreateClientSetup(role))
+	if err != nil {
+		return
+	}
+	moqMsg, _, errReceive := moqhelpers.ReceiveMessage(stream)
+	if errReceive != nil {
+		err = errReceive
+		return
+	}
+	serverSetup, isServerSetup := moqMsg.(moqhelpers.MoqMessageServerSetup)
+	if !isServerSetup {
+		err = errors.New(fmt.Sprintf("Expecting server SETUP, received %T", moqMsg))
+		return
+	}
+	if serverSetup.Version != moqhelpers.MOQ_SUPPORTED_VERSION {
+		err = errors.New(fmt.Sprintf("Server version %d not supported, expected %d", serverSetup.Version, moqhelpers.MOQ_SUPPORTED_VERSION))
+	}
+	return
+}
+
+// Test payloads
+
+// CreateTestPayload Returns a payload of size bytes (at least the header) that carries its creation time
+func CreateTestPayload(size int, now time.Time) []byte {
+	if size < TEST_PAYLOAD_HEADER_SIZE {
+		size = TEST_PAYLOAD_HEADER_SIZE
+	}
+	payload := make([]byte, size)
+	copy(payload, TEST_PAYLOAD_MAGIC)
+	binary.BigEndian.PutUint64(payload[len(TEST_PAYLOAD_MAGIC):], uint64(now.UnixNano()))
+	return payload
+}
+
+// ParseTestPayload Returns the creation time of a test payload, ok false if it is NOT one
+func ParseTestPayload(payload []byte) (createdAt time.Time, ok bool) {
+	if len(payload) < TEST_PAYLOAD_HEADER_SIZE || string(payload[:len(TEST_PAYLOAD_MAGIC)]) != TEST_PAYLOAD_MAGIC {
+		return
+	}
+	createdAt = time.Unix(0, int64(binary.BigEndian.Uint64(payload[len(TEST_PAYLOAD_MAGIC):])))
+	ok = true
+	return
+}
+
+// Helpers
+
+func createTLSConfig(config MoqClientConfig) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{InsecureSkipVerify: config.Insecure}
+	if config.CertPath != "" {
+		certData, errRead := os.ReadFile(config.CertPath)
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		pool, errPool := x509.SystemCertPool()
+		if errPool != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(certData) {
+			err = errors.New(fmt.Sprintf("No PEM certificates found in %s", config.CertPath))
+			return
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return
+}
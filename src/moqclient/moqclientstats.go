@@ -0,0 +1,87 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqclient
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MoqLatencySummary Latency percentiles of the samples of a period
+type MoqLatencySummary struct {
+	Count uint64
+	Min   time.Duration
+	Avg   time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// MoqLatencyStats Collects latency samples (thread safe)
+type MoqLatencyStats struct {
+	// Protected
+	samples []time.Duration
+	lock    *sync.Mutex
+}
+
+func NewLatencyStats() *MoqLatencyStats {
+	return &MoqLatencyStats{samples: []time.Duration{}, lock: new(sync.Mutex)}
+}
+
+// Add Adds a sample
+func (ls *MoqLatencyStats) Add(latency time.Duration) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	ls.samples = append(ls.samples, latency)
+}
+
+// Collect Returns the summary of the samples added since the last collect and removes them
+func (ls *MoqLatencyStats) Collect() (summary MoqLatencySummary) {
+	ls.lock.Lock()
+	samples := ls.samples
+	ls.samples = []time.Duration{}
+	ls.lock.Unlock()
+
+	if len(samples) <= 0 {
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	total := time.Duration(0)
+	for _, sample := range samples {
+		total += sample
+	}
+	summary.Count = uint64(len(samples))
+	summary.Min = samples[0]
+	summary.Avg = total / time.Duration(len(samples))
+	summary.P50 = getPercentile(samples, 50)
+	summary.P95 = getPercentile(samples, 95)
+	summary.P99 = getPercentile(samples, 99)
+	summary.Max = samples[len(samples)-1]
+	return
+}
+
+func (summary MoqLatencySummary) GetDebugStr() string {
+	if summary.Count <= 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("min: %v, avg: %v, p50: %v, p95: %v, p99: %v, max: %v (%d samples)", summary.Min, summary.Avg, summary.P50, summary.P95, summary.P99, summary.Max, summary.Count)
+}
+
+// Helpers
+
+// getPercentile Nearest rank percentile of sorted samples
+func getPercentile(sortedSamples []time.Duration, percentile int) time.Duration {
+	rank := (len(sortedSamples)*percentile + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sortedSamples[rank-1]
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqclock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock Source of time used by cache, sessions and timeouts
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Real clock
+
+type realClock struct{}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+// New Creates a clock backed by the system time
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Fake clock (only moves when Advance is called)
+
+type FakeClock struct {
+	now     time.Time
+	waiters []*fakeWaiter
+
+	lock *sync.Mutex
+}
+
+type fakeWaiter struct {
+	clock    *FakeClock
+	deadline time.Time
+	// 0 for timers
+	period  time.Duration
+	ch      chan time.Time
+	stopped bool
+}
+
+// NewFake Creates a fake clock starting at the indicated time
+func NewFake(start time.Time) *FakeClock {
+	return &FakeClock{now: start, waiters: []*fakeWaiter{}, lock: new(sync.Mutex)}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{f.addWaiter(d, d)}
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{f.addWaiter(d, 0)}
+}
+
+// Advance Moves the clock forward firing all timers / tickers due
+func (f *FakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+
+	activeWaiters := []*fakeWaiter{}
+	for _, w := range f.waiters {
+		for !w.stopped && !w.deadline.After(f.now) {
+			// Same as time pkg, drop ticks if receiver is not ready
+			select {
+			case w.ch <- w.deadline:
+			default:
+			}
+			if w.period == 0 {
+				w.stopped = true
+			} else {
+				w.deadline = w.deadline.Add(w.period)
+			}
+		}
+		if !w.stopped {
+			activeWaiters = append(activeWaiters, w)
+		}
+	}
+	f.waiters = activeWaiters
+}
+
+func (f *FakeClock) addWaiter(d time.Duration, period time.Duration) *fakeWaiter {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	w := &fakeWaiter{clock: f, deadline: f.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *fakeWaiter) stop() bool {
+	w.clock.lock.Lock()
+	defer w.clock.lock.Unlock()
+
+	wasActive := !w.stopped
+	w.stopped = true
+	return wasActive
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.stop()
+}
+
+type fakeTimer struct {
+	*fakeWaiter
+}
+
+func (t fakeTimer) Stop() bool {
+	return t.stop()
+}
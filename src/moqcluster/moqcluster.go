@@ -0,0 +1,805 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqhooks"
+	"facebookexperimental/moq-go-server/moqlocalpublisher"
+	"facebookexperimental/moq-go-server/moqlocalsubscriber"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqorigins"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Messages waiting to be published to the bus, new ones are dropped when full
+const CLUSTER_PUBLISH_QUEUE_SIZE = 4096
+
+// Objects waiting to be fetched from other instances, new ones are dropped when full
+const CLUSTER_FETCH_QUEUE_SIZE = 1024
+
+// Parallel fetches from other instances
+const CLUSTER_FETCH_WORKERS = 8
+
+// Timeout of the bus connections and of the fetch requests
+const CLUSTER_TIMEOUT_MS = 5000
+
+// Wait before connecting to the bus again after an error
+const CLUSTER_RECONNECT_MS = 1000
+
+// Period the announced namespaces and the subscribed remote tracks (or the members when sharding) are published (the other instances remove them if they are NOT refreshed)
+const CLUSTER_ANNOUNCE_PERIOD_MS = 2000
+
+// Remote namespaces / track subscriptions / members NOT refreshed for this time are removed (ex: instance crashed)
+const CLUSTER_NAMESPACE_EXPIRATION_MS = 3 * CLUSTER_ANNOUNCE_PERIOD_MS
+
+// Max payload fetched from another instance
+const CLUSTER_FETCH_MAX_BYTES = 64 * 1024 * 1024
+
+// Name of the local publisher sessions of the remote namespaces and of the local subscriber session of the remote subscriptions (also their remote address in the admin API), prefix of the origins to the namespace owners when sharding
+const CLUSTER_SESSION_NAME = "cluster"
+
+type moqClusterMessageType string
+
+const (
+	// Namespaces announced in the instance (sent when announced and periodically)
+	moqClusterMessageAnnounce moqClusterMessageType = "announce"
+	// Namespaces NOT announced anymore in the instance
+	moqClusterMessageUnAnnounce moqClusterMessageType = "unannounce"
+	// Tracks of remote namespaces with subscribers in the instance (sent when subscribed and periodically), the instances that announce them subscribe upstream so their publishers send the objects
+	moqClusterMessageSubscribe moqClusterMessageType = "subscribe"
+	// Object received in the instance (complete), other instances can fetch it from FetchUrl
+	moqClusterMessageObject moqClusterMessageType = "object"
+	// Instance stopped, its namespaces are removed (and it is NOT a member anymore)
+	moqClusterMessageLeave moqClusterMessageType = "leave"
+	// Instance of a sharded cluster and its relay URL (sent periodically), the namespaces are assigned to the members
+	moqClusterMessageMember moqClusterMessageType = "member"
+)
+
+// moqClusterMessage Message of the cluster bus, the instances ignore their own ones
+type moqClusterMessage struct {
+	RelayId string                `json:"relayId"`
+	Type    moqClusterMessageType `json:"type"`
+	// Announce / unannounce
+	TrackNamespaces []string `json:"trackNamespaces,omitempty"`
+	// Subscribe
+	Tracks []moqClusterTrack `json:"tracks,omitempty"`
+	// Object
+	TrackNamespace string `json:"trackNamespace,omitempty"`
+	TrackName      string `json:"trackName,omitempty"`
+	GroupSequence  uint64 `json:"groupSequence,omitempty"`
+	ObjectSequence uint64 `json:"objectSequence,omitempty"`
+	SendOrder      uint64 `json:"sendOrder,omitempty"`
+	CacheKey       string `json:"cacheKey,omitempty"`
+	PayloadBytes   uint64 `json:"payloadBytes,omitempty"`
+	FetchUrl       string `json:"fetchUrl,omitempty"`
+	// Member
+	RelayUrl string `json:"relayUrl,omitempty"`
+}
+
+type moqClusterTrack struct {
+	TrackNamespace string `json:"trackNamespace"`
+	TrackName      string `json:"trackName"`
+}
+
+// Cluster bus client
+type moqClusterBus interface {
+	publish(data []byte) error
+	// run Calls onMessage with every message of the bus until close (it connects again after errors)
+	run(onMessage func(data []byte))
+	close()
+}
+
+type MoqClusterConfig struct {
+	// Pub/sub bus shared by the instances: NATS (nats://) or Redis (redis://)
+	BusUrl  string
+	RelayId string
+	// Base URL of the HTTP origin of this instance (https://host:port), the other instances fetch its objects from [FetchUrl]/objects/...
+	FetchUrl string
+	// Sent as Authorization: Bearer in the fetch requests (HTTP origins with authorizer), empty none
+	FetchToken string
+	// Hosts the objects can be fetched from (the fetch URLs come from the bus): host (any port), host:port or *.domain
+	FetchAllowedHosts []string
+	// PEM CA bundle added to the system ones to verify the HTTP origins (and the relay URLs when sharding) of the other instances, empty system ones
+	FetchCAPath string
+	// Every namespace is owned by one instance (consistent hashing), the others proxy its publishers and subscribers to it with relay sessions instead of sharing the objects through the bus
+	Sharding bool
+	// MoQ URL of this instance reachable by the other ones (https://host:port/moq or moq://host:port), needed when sharding
+	RelayUrl string
+}
+
+// MoqClusterStats Counters of the cluster bus
+type MoqClusterStats struct {
+	RemoteNamespaces int    `json:"remoteNamespaces"`
+	MessagesSent     uint64 `json:"messagesSent"`
+	MessagesReceived uint64 `json:"messagesReceived"`
+	MessagesDropped  uint64 `json:"messagesDropped"`
+	ObjectsFetched   uint64 `json:"objectsFetched"`
+	FetchedBytes     uint64 `json:"fetchedBytes"`
+	FetchErrors      uint64 `json:"fetchErrors"`
+	// Fetch queue full
+	FetchesDropped uint64 `json:"fetchesDropped"`
+	// Objects of tracks without local subscribers, or already cached
+	FetchesNotNeeded uint64 `json:"fetchesNotNeeded"`
+	// Sharding: other instances and origins to the owners of the namespaces
+	Members      int `json:"members"`
+	ShardOrigins int `json:"shardOrigins"`
+}
+
+// moqClusterRemoteNamespace Namespace announced in other instances, served by a local publisher that publishes the objects fetched from them
+type moqClusterRemoteNamespace struct {
+	publisher *moqlocalpublisher.MoqLocalPublisher
+	// Instances that announced it and when they refreshed it
+	relays map[string]time.Time
+}
+
+// MoqCluster Shares the announced namespaces and the received objects between relay instances through a pub/sub bus (NATS or Redis), subscribers of any instance get the objects published in another one (fetched from its HTTP origin on demand, or through the owner of the namespace when sharding), nil disabled
+type MoqCluster struct {
+	moqhooks.MoqHooksBase
+
+	config MoqClusterConfig
+	bus    moqClusterBus
+	// For the logs (without credentials)
+	redactedUrl string
+	httpClient  *http.Client
+
+	moqtFwdTable *moqfwdtable.MoqFwdTable
+	objects      *moqmessageobjects.MoqMessageObjects
+	moqOrigins   *moqorigins.MoqOrigins
+	connConfig   moqconnectionmanagment.MoqConnectionConfig
+	// CA of the relay URLs of the other instances (sharding)
+	relayCertData []byte
+
+	publishQueue chan moqClusterMessage
+	fetchQueue   chan moqClusterMessage
+	done         chan bool
+	workers      *sync.WaitGroup
+
+	messagesSent     atomic.Uint64
+	messagesReceived atomic.Uint64
+	messagesDropped  atomic.Uint64
+	objectsFetched   atomic.Uint64
+	fetchErrors      atomic.Uint64
+	fetchedBytes     atomic.Uint64
+	fetchesDropped   atomic.Uint64
+	fetchesNotNeeded atomic.Uint64
+
+	// Protected
+	remoteNamespaces map[string]*moqClusterRemoteNamespace
+	// Tracks of the local namespaces subscribed by other instances, and when each instance refreshed it
+	remoteSubscriptions map[moqClusterTrack]map[string]time.Time
+	// Keeps the remote subscriptions upstream (created on the first one)
+	subscriber *moqlocalsubscriber.MoqLocalSubscriber
+	// Sharding: other instances, ring of the namespace owners, namespaces announced by the local publishers (session -> announced at) and origins to the owners (by guid)
+	members             map[string]moqClusterMember
+	ring                *moqClusterRing
+	publishedNamespaces map[string]map[string]time.Time
+	shardOrigins        map[string]moqClusterShardOrigin
+	stopped             bool
+	lock                *sync.Mutex
+	// Serializes the changes of the origins to the owners
+	shardLock *sync.Mutex
+}
+
+// New Connects to the cluster bus and starts sharing the namespaces / objects of this instance (or its membership when sharding, the origins to the owners are added to moqOrigins), register it in the hooks so it gets the local announces, subscribes and objects
+func New(config MoqClusterConfig, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, moqOrigins *moqorigins.MoqOrigins, connConfig moqconnectionmanagment.MoqConnectionConfig) (mc *MoqCluster, err error) {
+	if config.Sharding && config.RelayUrl == "" {
+		err = errors.New("Cluster relay URL (MoQ URL of this instance) is required when sharding")
+		return
+	}
+	if !config.Sharding && config.FetchUrl == "" {
+		err = errors.New("Cluster fetch URL (HTTP origin of this instance) is required")
+		return
+	}
+	allowedHosts := []string{}
+	for _, host := range config.FetchAllowedHosts {
+		if host != "" {
+			allowedHosts = append(allowedHosts, strings.ToLower(host))
+		}
+	}
+	config.FetchAllowedHosts = allowedHosts
+	if !config.Sharding && len(config.FetchAllowedHosts) == 0 {
+		err = errors.New("Cluster fetch allowed hosts (HTTP origins of the other instances) are required")
+		return
+	}
+	parsedUrl, errParse := url.Parse(config.BusUrl)
+	if errParse != nil {
+		err = errParse
+		return
+	}
+	var bus moqClusterBus = nil
+	switch parsedUrl.Scheme {
+	case "nats":
+		bus, err = newNatsBus(parsedUrl)
+	case "redis":
+		bus, err = newRedisBus(parsedUrl)
+	default:
+		err = errors.New(fmt.Sprintf("Invalid cluster bus URL scheme %q, valid: nats, redis", parsedUrl.Scheme))
+	}
+	if err != nil {
+		return
+	}
+	tlsConfig, errTls := createFetchTlsConfig(config.FetchCAPath)
+	if errTls != nil {
+		err = errTls
+		return
+	}
+	var relayCertData []byte = nil
+	if config.Sharding && config.FetchCAPath != "" {
+		relayCertData, err = os.ReadFile(config.FetchCAPath)
+		if err != nil {
+			return
+		}
+	}
+
+	mc = &MoqCluster{config: config, bus: bus, redactedUrl: parsedUrl.Redacted(), httpClient: &http.Client{Timeout: CLUSTER_TIMEOUT_MS * time.Millisecond, Transport: &http.Transport{TLSClientConfig: tlsConfig}, CheckRedirect: noRedirects}, moqtFwdTable: moqtFwdTable, objects: objects, moqOrigins: moqOrigins, connConfig: connConfig, relayCertData: relayCertData, publishQueue: make(chan moqClusterMessage, CLUSTER_PUBLISH_QUEUE_SIZE), fetchQueue: make(chan moqClusterMessage, CLUSTER_FETCH_QUEUE_SIZE), done: make(chan bool), workers: new(sync.WaitGroup), remoteNamespaces: map[string]*moqClusterRemoteNamespace{}, remoteSubscriptions: map[moqClusterTrack]map[string]time.Time{}, members: map[string]moqClusterMember{}, publishedNamespaces: map[string]map[string]time.Time{}, shardOrigins: map[string]moqClusterShardOrigin{}, lock: new(sync.Mutex), shardLock: new(sync.Mutex)}
+	mc.rebuildRing()
+
+	go mc.bus.run(mc.onMessage)
+	mc.workers.Add(1)
+	go mc.runPublisher()
+	go mc.runAnnounces()
+	if config.Sharding {
+		log.Info(fmt.Sprintf("Cluster bus %s, sharding namespaces, relay URL %s", mc.redactedUrl, config.RelayUrl))
+		return
+	}
+	mc.workers.Add(CLUSTER_FETCH_WORKERS)
+	for i := 0; i < CLUSTER_FETCH_WORKERS; i++ {
+		go mc.runFetcher()
+	}
+
+	log.Info(fmt.Sprintf("Cluster bus %s, objects served from %s", mc.redactedUrl, config.FetchUrl))
+	return
+}
+
+// GetStats Returns the cluster counters (nil returns zeros)
+func (mc *MoqCluster) GetStats() (stats MoqClusterStats) {
+	if mc == nil {
+		return
+	}
+	mc.lock.Lock()
+	stats.RemoteNamespaces = len(mc.remoteNamespaces)
+	stats.Members = len(mc.members)
+	stats.ShardOrigins = len(mc.shardOrigins)
+	mc.lock.Unlock()
+
+	stats.MessagesSent = mc.messagesSent.Load()
+	stats.MessagesReceived = mc.messagesReceived.Load()
+	stats.MessagesDropped = mc.messagesDropped.Load()
+	stats.ObjectsFetched = mc.objectsFetched.Load()
+	stats.FetchErrors = mc.fetchErrors.Load()
+	stats.FetchedBytes = mc.fetchedBytes.Load()
+	stats.FetchesDropped = mc.fetchesDropped.Load()
+	stats.FetchesNotNeeded = mc.fetchesNotNeeded.Load()
+	return
+}
+
+// Stop Tells the other instances this one left, closes the remote namespaces publishers (and the origins to the owners) and disconnects from the bus
+func (mc *MoqCluster) Stop() {
+	if mc == nil {
+		return
+	}
+	mc.lock.Lock()
+	if mc.stopped {
+		mc.lock.Unlock()
+		return
+	}
+	mc.stopped = true
+	// Sent by the publisher thread before it exits
+	select {
+	case mc.publishQueue <- moqClusterMessage{RelayId: mc.config.RelayId, Type: moqClusterMessageLeave}:
+	default:
+	}
+	close(mc.publishQueue)
+	close(mc.fetchQueue)
+	close(mc.done)
+	remoteNamespaces := mc.remoteNamespaces
+	mc.remoteNamespaces = map[string]*moqClusterRemoteNamespace{}
+	subscriber := mc.subscriber
+	mc.lock.Unlock()
+
+	mc.removeShardOrigins()
+	mc.workers.Wait()
+	mc.bus.close()
+	for _, remoteNamespace := range remoteNamespaces {
+		remoteNamespace.publisher.Close()
+	}
+	if subscriber != nil {
+		subscriber.Close()
+	}
+}
+
+// Hooks (local sessions)
+
+// OnAnnounce Publishes the namespace, a local publisher takes it over from the other instances (their local publisher session is closed so the announce is NOT rejected as duplicated)
+func (mc *MoqCluster) OnAnnounce(moqSession *moqsession.MoqSession, announce moqhelpers.MoqMessageAnnounce) error {
+	if mc.config.Sharding {
+		mc.addPublishedNamespace(announce.TrackNamespace, moqSession.UniqueName, announce.RelayTrace)
+		return nil
+	}
+	mc.lock.Lock()
+	remoteNamespace, found := mc.remoteNamespaces[announce.TrackNamespace]
+	if found {
+		delete(mc.remoteNamespaces, announce.TrackNamespace)
+	}
+	mc.lock.Unlock()
+
+	if found {
+		log.WithFields(log.Fields{"namespace": announce.TrackNamespace, "session": moqSession.UniqueName}).Info("Cluster namespace announced locally, closing its cluster publisher")
+		remoteNamespace.publisher.Close()
+	}
+	mc.publish(moqClusterMessage{Type: moqClusterMessageAnnounce, TrackNamespaces: []string{announce.TrackNamespace}})
+	return nil
+}
+
+// OnObject Publishes where the other instances can fetch the object (it is complete)
+func (mc *MoqCluster) OnObject(moqSession *moqsession.MoqSession, trackNamespace string, trackName string, header moqobject.MoqObjectHeader, payloadBytes uint64) {
+	if mc.config.Sharding {
+		// They are sent by the relay sessions
+		return
+	}
+	cacheKey := moqconnectionmanagment.CreateObjectCacheKey(trackNamespace, trackName, header)
+	mc.publish(moqClusterMessage{Type: moqClusterMessageObject, TrackNamespace: trackNamespace, TrackName: trackName, GroupSequence: header.GroupSequence, ObjectSequence: header.ObjectSequence, SendOrder: header.SendOrder, CacheKey: cacheKey, PayloadBytes: payloadBytes, FetchUrl: mc.config.FetchUrl})
+}
+
+// OnSessionClose Publishes the namespaces that only this session announced
+func (mc *MoqCluster) OnSessionClose(moqSession *moqsession.MoqSession) {
+	if mc.config.Sharding {
+		mc.removePublishedSession(moqSession.UniqueName)
+		return
+	}
+	unAnnounced := []string{}
+	for _, namespaceInfo := range mc.moqtFwdTable.ListNamespaces() {
+		if !moqSession.HasNamespace(namespaceInfo.TrackNamespace) {
+			continue
+		}
+		otherPublishers := false
+		for _, publisher := range namespaceInfo.Publishers {
+			otherPublishers = otherPublishers || publisher != moqSession.UniqueName
+		}
+		if !otherPublishers {
+			unAnnounced = append(unAnnounced, namespaceInfo.TrackNamespace)
+		}
+	}
+	if len(unAnnounced) > 0 {
+		mc.publish(moqClusterMessage{Type: moqClusterMessageUnAnnounce, TrackNamespaces: unAnnounced})
+	}
+}
+
+// Bus messages
+
+// publish Queues a message to be sent (it never blocks)
+func (mc *MoqCluster) publish(msg moqClusterMessage) {
+	msg.RelayId = mc.config.RelayId
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	if mc.stopped {
+		return
+	}
+	select {
+	case mc.publishQueue <- msg:
+	default:
+		mc.messagesDropped.Add(1)
+		log.WithField("type", msg.Type).Warning("Cluster publish queue full, message dropped")
+	}
+}
+
+// onMessage Called by the bus thread (it should NOT block)
+func (mc *MoqCluster) onMessage(data []byte) {
+	msg := moqClusterMessage{}
+	errUnmarshal := json.Unmarshal(data, &msg)
+	if errUnmarshal != nil {
+		log.WithError(errUnmarshal).Error("Invalid cluster message")
+		return
+	}
+	if msg.RelayId == mc.config.RelayId {
+		return
+	}
+	mc.messagesReceived.Add(1)
+
+	if mc.config.Sharding {
+		// Instances that do NOT shard are ignored (all need the same mode)
+		switch msg.Type {
+		case moqClusterMessageMember:
+			mc.addMember(msg.RelayId, msg.RelayUrl)
+		case moqClusterMessageLeave:
+			go mc.removeMembers(msg.RelayId, false)
+		}
+		return
+	}
+	switch msg.Type {
+	case moqClusterMessageAnnounce:
+		for _, trackNamespace := range msg.TrackNamespaces {
+			mc.addRemoteNamespace(trackNamespace, msg.RelayId)
+		}
+	case moqClusterMessageUnAnnounce:
+		for _, trackNamespace := range msg.TrackNamespaces {
+			mc.removeRemoteNamespaces(msg.RelayId, func(remoteTrackNamespace string) bool { return remoteTrackNamespace == trackNamespace }, false)
+		}
+	case moqClusterMessageSubscribe:
+		for _, track := range msg.Tracks {
+			mc.addRemoteSubscription(track, msg.RelayId)
+		}
+	case moqClusterMessageLeave:
+		mc.removeRemoteNamespaces(msg.RelayId, func(string) bool { return true }, false)
+		mc.removeRemoteSubscriptions(msg.RelayId, false)
+	case moqClusterMessageObject:
+		mc.receivedObject(msg)
+	case moqClusterMessageMember:
+		// Sharded instances are ignored (all need the same mode)
+	default:
+		log.WithFields(log.Fields{"relayId": msg.RelayId, "type": msg.Type}).Debug("Unknown cluster message type")
+	}
+}
+
+// addRemoteNamespace Creates (or refreshes) the local publisher of a namespace announced in another instance, NOT if it is announced locally
+func (mc *MoqCluster) addRemoteNamespace(trackNamespace string, relayId string) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	if mc.stopped {
+		return
+	}
+	remoteNamespace, found := mc.remoteNamespaces[trackNamespace]
+	if found {
+		remoteNamespace.relays[relayId] = mc.connConfig.Clock.Now()
+		return
+	}
+	for _, namespaceInfo := range mc.moqtFwdTable.ListNamespaces() {
+		if namespaceInfo.TrackNamespace == trackNamespace {
+			// Local publishers win
+			return
+		}
+	}
+	publisher, errPublisher := moqlocalpublisher.New(CLUSTER_SESSION_NAME, trackNamespace, mc.moqtFwdTable, mc.objects, mc.connConfig)
+	if errPublisher != nil {
+		log.WithFields(log.Fields{"namespace": trackNamespace, "relayId": relayId}).WithError(errPublisher).Error("Creating cluster publisher")
+		return
+	}
+	publisher.SetAutoAddTracks(true)
+	publisher.SetOnSubscribe(func(trackName string) {
+		mc.publish(moqClusterMessage{Type: moqClusterMessageSubscribe, Tracks: []moqClusterTrack{{TrackNamespace: trackNamespace, TrackName: trackName}}})
+	})
+	mc.remoteNamespaces[trackNamespace] = &moqClusterRemoteNamespace{publisher: publisher, relays: map[string]time.Time{relayId: mc.connConfig.Clock.Now()}}
+	log.WithFields(log.Fields{"namespace": trackNamespace, "relayId": relayId}).Info("Added cluster namespace")
+}
+
+// removeRemoteNamespaces Removes the instance from the matching namespaces (all the instances if expired), the ones without instances are closed
+func (mc *MoqCluster) removeRemoteNamespaces(relayId string, matches func(trackNamespace string) bool, expired bool) {
+	closed := []*moqlocalpublisher.MoqLocalPublisher{}
+
+	mc.lock.Lock()
+	now := mc.connConfig.Clock.Now()
+	for trackNamespace, remoteNamespace := range mc.remoteNamespaces {
+		if !matches(trackNamespace) {
+			continue
+		}
+		for remoteRelayId, refreshedAt := range remoteNamespace.relays {
+			if remoteRelayId == relayId || (expired && now.Sub(refreshedAt) >= CLUSTER_NAMESPACE_EXPIRATION_MS*time.Millisecond) {
+				delete(remoteNamespace.relays, remoteRelayId)
+			}
+		}
+		if len(remoteNamespace.relays) == 0 {
+			delete(mc.remoteNamespaces, trackNamespace)
+			closed = append(closed, remoteNamespace.publisher)
+		}
+	}
+	mc.lock.Unlock()
+
+	for _, publisher := range closed {
+		log.WithField("namespace", publisher.GetTrackNamespace()).Info("Removed cluster namespace")
+		publisher.Close()
+	}
+}
+
+// addRemoteSubscription Subscribes (or refreshes) upstream a track of a local namespace subscribed in another instance
+func (mc *MoqCluster) addRemoteSubscription(track moqClusterTrack, relayId string) {
+	mc.lock.Lock()
+	_, remote := mc.remoteNamespaces[track.TrackNamespace]
+	if mc.stopped || remote {
+		mc.lock.Unlock()
+		return
+	}
+	relays, found := mc.remoteSubscriptions[track]
+	if !found {
+		relays = map[string]time.Time{}
+		mc.remoteSubscriptions[track] = relays
+	}
+	relays[relayId] = mc.connConfig.Clock.Now()
+	if mc.subscriber == nil {
+		subscriber, errSubscriber := moqlocalsubscriber.New(CLUSTER_SESSION_NAME, mc.moqtFwdTable, mc.connConfig)
+		if errSubscriber != nil {
+			mc.lock.Unlock()
+			log.WithError(errSubscriber).Error("Creating cluster subscriber")
+			return
+		}
+		mc.subscriber = subscriber
+	}
+	subscriber := mc.subscriber
+	mc.lock.Unlock()
+
+	// Nothing if it is already subscribed, failed ones are retried on the next refresh
+	errSubscribe := subscriber.Subscribe(track.TrackNamespace, track.TrackName)
+	if errSubscribe != nil {
+		log.WithFields(log.Fields{"namespace": track.TrackNamespace, "track": track.TrackName, "relayId": relayId}).WithError(errSubscribe).Debug("Subscribing cluster track")
+	}
+}
+
+// removeRemoteSubscriptions Removes the instance from the remote subscriptions (all the instances if expired), the tracks without instances are unsubscribed
+func (mc *MoqCluster) removeRemoteSubscriptions(relayId string, expired bool) {
+	unSubscribed := []moqClusterTrack{}
+
+	mc.lock.Lock()
+	now := mc.connConfig.Clock.Now()
+	for track, relays := range mc.remoteSubscriptions {
+		for remoteRelayId, refreshedAt := range relays {
+			if remoteRelayId == relayId || (expired && now.Sub(refreshedAt) >= CLUSTER_NAMESPACE_EXPIRATION_MS*time.Millisecond) {
+				delete(relays, remoteRelayId)
+			}
+		}
+		if len(relays) == 0 {
+			delete(mc.remoteSubscriptions, track)
+			unSubscribed = append(unSubscribed, track)
+		}
+	}
+	subscriber := mc.subscriber
+	mc.lock.Unlock()
+
+	for _, track := range unSubscribed {
+		if subscriber != nil {
+			subscriber.UnSubscribe(track.TrackNamespace, track.TrackName)
+		}
+	}
+}
+
+// receivedObject Queues the fetch of an object of another instance if this one has subscribers of its track and it is NOT cached
+func (mc *MoqCluster) receivedObject(msg moqClusterMessage) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	_, found := mc.remoteNamespaces[msg.TrackNamespace]
+	if mc.stopped || !found || !mc.moqtFwdTable.HasTrackSubscribers(msg.TrackNamespace, msg.TrackName) {
+		mc.fetchesNotNeeded.Add(1)
+		return
+	}
+	select {
+	case mc.fetchQueue <- msg:
+	default:
+		mc.fetchesDropped.Add(1)
+		log.WithField("cacheKey", msg.CacheKey).Warning("Cluster fetch queue full, object NOT fetched")
+	}
+}
+
+// Threads
+
+// runPublisher Sends the queued messages until stopped
+func (mc *MoqCluster) runPublisher() {
+	defer mc.workers.Done()
+
+	for msg := range mc.publishQueue {
+		data, errMarshal := json.Marshal(msg)
+		if errMarshal == nil {
+			errMarshal = mc.bus.publish(data)
+		}
+		if errMarshal != nil {
+			mc.messagesDropped.Add(1)
+			log.WithFields(log.Fields{"url": mc.redactedUrl, "type": msg.Type}).WithError(errMarshal).Debug("Publishing cluster message")
+			continue
+		}
+		mc.messagesSent.Add(1)
+	}
+}
+
+// runAnnounces Publishes the local namespaces and expires the remote ones NOT refreshed (or the membership when sharding)
+func (mc *MoqCluster) runAnnounces() {
+	ticker := mc.connConfig.Clock.NewTicker(CLUSTER_ANNOUNCE_PERIOD_MS * time.Millisecond)
+	defer ticker.Stop()
+
+	if mc.config.Sharding {
+		mc.publish(moqClusterMessage{Type: moqClusterMessageMember, RelayUrl: mc.config.RelayUrl})
+	}
+	for {
+		select {
+		case <-ticker.C():
+			if mc.config.Sharding {
+				mc.publish(moqClusterMessage{Type: moqClusterMessageMember, RelayUrl: mc.config.RelayUrl})
+				mc.removeMembers("", true)
+				mc.reconcileShards()
+				continue
+			}
+			localNamespaces := mc.getLocalNamespaces()
+			if len(localNamespaces) > 0 {
+				mc.publish(moqClusterMessage{Type: moqClusterMessageAnnounce, TrackNamespaces: localNamespaces})
+			}
+			subscribedTracks := mc.getSubscribedRemoteTracks()
+			if len(subscribedTracks) > 0 {
+				mc.publish(moqClusterMessage{Type: moqClusterMessageSubscribe, Tracks: subscribedTracks})
+			}
+			mc.removeRemoteNamespaces("", func(string) bool { return true }, true)
+			mc.removeRemoteSubscriptions("", true)
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+// runFetcher Fetches the queued objects from the instances that received them and publishes them locally
+func (mc *MoqCluster) runFetcher() {
+	defer mc.workers.Done()
+
+	for msg := range mc.fetchQueue {
+		_, cached := mc.objects.Get(msg.CacheKey)
+		if cached {
+			mc.fetchesNotNeeded.Add(1)
+			continue
+		}
+		errFetch := mc.fetchObject(msg)
+		if errFetch != nil {
+			mc.fetchErrors.Add(1)
+			log.WithFields(log.Fields{"cacheKey": msg.CacheKey, "relayId": msg.RelayId}).WithError(errFetch).Error("Fetching cluster object")
+		}
+	}
+}
+
+// getLocalNamespaces Returns the namespaces announced in this instance (NOT the remote ones)
+func (mc *MoqCluster) getLocalNamespaces() (trackNamespaces []string) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	trackNamespaces = []string{}
+	for _, namespaceInfo := range mc.moqtFwdTable.ListNamespaces() {
+		_, remote := mc.remoteNamespaces[namespaceInfo.TrackNamespace]
+		if !remote {
+			trackNamespaces = append(trackNamespaces, namespaceInfo.TrackNamespace)
+		}
+	}
+	return
+}
+
+// getSubscribedRemoteTracks Returns the tracks of the remote namespaces with subscribers in this instance
+func (mc *MoqCluster) getSubscribedRemoteTracks() (tracks []moqClusterTrack) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	tracks = []moqClusterTrack{}
+	for trackNamespace, remoteNamespace := range mc.remoteNamespaces {
+		for _, trackName := range remoteNamespace.publisher.GetTracks() {
+			if mc.moqtFwdTable.HasTrackSubscribers(trackNamespace, trackName) {
+				tracks = append(tracks, moqClusterTrack{TrackNamespace: trackNamespace, TrackName: trackName})
+			}
+		}
+	}
+	return
+}
+
+func (mc *MoqCluster) fetchObject(msg moqClusterMessage) (err error) {
+	mc.lock.Lock()
+	remoteNamespace, found := mc.remoteNamespaces[msg.TrackNamespace]
+	mc.lock.Unlock()
+	if !found {
+		return
+	}
+
+	err = checkFetchUrl(msg.FetchUrl, mc.config.FetchAllowedHosts)
+	if err != nil {
+		return
+	}
+	fetchUrl := strings.TrimSuffix(msg.FetchUrl, "/") + "/objects/" + url.PathEscape(msg.TrackNamespace) + "/" + url.PathEscape(msg.TrackName) + "/" + strconv.FormatUint(msg.GroupSequence, 10) + "/" + strconv.FormatUint(msg.ObjectSequence, 10)
+	req, errReq := http.NewRequest(http.MethodGet, fetchUrl, nil)
+	if errReq != nil {
+		err = errReq
+		return
+	}
+	if mc.config.FetchToken != "" {
+		req.Header.Set("Authorization", "Bearer "+mc.config.FetchToken)
+	}
+	resp, errGet := mc.httpClient.Do(req)
+	if errGet != nil {
+		err = errGet
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(fmt.Sprintf("Fetch %s returned %s", msg.CacheKey, resp.Status))
+		return
+	}
+	payload, errRead := io.ReadAll(io.LimitReader(resp.Body, CLUSTER_FETCH_MAX_BYTES+1))
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	if len(payload) > CLUSTER_FETCH_MAX_BYTES {
+		err = errors.New(fmt.Sprintf("Fetched object %s bigger than %d bytes", msg.CacheKey, CLUSTER_FETCH_MAX_BYTES))
+		return
+	}
+
+	_, err = remoteNamespace.publisher.AddTrack(msg.TrackName)
+	if err == nil {
+		err = remoteNamespace.publisher.PublishObject(msg.TrackName, msg.GroupSequence, msg.ObjectSequence, msg.SendOrder, payload)
+	}
+	if err == nil {
+		mc.objectsFetched.Add(1)
+		mc.fetchedBytes.Add(uint64(len(payload)))
+	}
+	return
+}
+
+// Helpers
+
+// checkFetchUrl Returns an error if the fetch URL (it comes from the bus) is NOT http(s) or its host is NOT in allowedHosts (lowercase host, host:port or *.domain)
+func checkFetchUrl(fetchUrl string, allowedHosts []string) (err error) {
+	parsedUrl, errParse := url.Parse(fetchUrl)
+	if errParse != nil {
+		err = errParse
+		return
+	}
+	if (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") || parsedUrl.User != nil || parsedUrl.Host == "" {
+		err = errors.New(fmt.Sprintf("Invalid fetch URL %s, it has to be http(s)://host[:port] without credentials", parsedUrl.Redacted()))
+		return
+	}
+	host := strings.ToLower(parsedUrl.Host)
+	hostname := strings.ToLower(parsedUrl.Hostname())
+	for _, allowedHost := range allowedHosts {
+		if allowedHost == host || allowedHost == hostname {
+			return
+		}
+		if strings.HasPrefix(allowedHost, "*.") && strings.HasSuffix(hostname, allowedHost[1:]) {
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("Fetch URL host %s is NOT allowed", parsedUrl.Host))
+	return
+}
+
+// noRedirects Does NOT follow the redirects of the fetches, they could point outside the allowed hosts
+func noRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// createFetchTlsConfig Returns the system CAs plus the ones of caPath (nil if empty)
+func createFetchTlsConfig(caPath string) (tlsConfig *tls.Config, err error) {
+	if caPath == "" {
+		return
+	}
+	caPem, errRead := os.ReadFile(caPath)
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	pool, errPool := x509.SystemCertPool()
+	if errPool != nil {
+		err = errPool
+		return
+	}
+	if !pool.AppendCertsFromPEM(caPem) {
+		err = errors.New(fmt.Sprintf("NO certificates found in %s", caPath))
+		return
+	}
+	tlsConfig = &tls.Config{RootCAs: pool}
+	return
+}
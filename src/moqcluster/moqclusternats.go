@@ -0,0 +1,124 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcluster
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqnats"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subject if the URL does NOT have a path
+const NATS_DEFAULT_SUBJECT = "moq.cluster"
+
+const NATS_CLIENT_NAME = "moq-go-server-cluster"
+
+// natsBus Publishes and receives the cluster messages in a NATS subject, a single connection is used for both
+type natsBus struct {
+	config moqnats.MoqNatsConfig
+	done   chan bool
+
+	// Protected (publish uses the connection of the reader thread)
+	conn   *moqnats.MoqNatsConn
+	closed bool
+	lock   *sync.Mutex
+}
+
+func newNatsBus(natsUrl *url.URL) (bus *natsBus, err error) {
+	config, err := moqnats.ParseUrl(natsUrl, NATS_DEFAULT_SUBJECT, NATS_CLIENT_NAME)
+	if err != nil {
+		return
+	}
+	bus = &natsBus{config: config, done: make(chan bool), lock: new(sync.Mutex)}
+	return
+}
+
+func (bus *natsBus) publish(data []byte) (err error) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.conn == nil {
+		err = errors.New(fmt.Sprintf("NOT connected to NATS %s", bus.config.Addr))
+		return
+	}
+	err = bus.conn.Publish([]moqnats.MoqNatsMessage{{Subject: bus.config.Subject, Data: data}}, CLUSTER_TIMEOUT_MS*time.Millisecond)
+	if err != nil {
+		// The reader thread connects again
+		bus.conn.Close()
+	}
+	return
+}
+
+func (bus *natsBus) run(onMessage func(data []byte)) {
+	for {
+		conn, errConnect := bus.connect()
+		if errConnect == nil {
+			log.Info(fmt.Sprintf("Connected to cluster NATS %s, subject %s", bus.config.Addr, bus.config.Subject))
+			errConnect = conn.ReadMessages(func(subject string, data []byte) {
+				onMessage(data)
+			}, CLUSTER_TIMEOUT_MS*time.Millisecond)
+			bus.setConn(nil)
+			conn.Close()
+		}
+		select {
+		case <-bus.done:
+			return
+		default:
+		}
+		log.WithField("addr", bus.config.Addr).WithError(errConnect).Error("Cluster NATS connection")
+
+		select {
+		case <-bus.done:
+			return
+		case <-time.After(CLUSTER_RECONNECT_MS * time.Millisecond):
+		}
+	}
+}
+
+func (bus *natsBus) close() {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.closed {
+		return
+	}
+	bus.closed = true
+	close(bus.done)
+	if bus.conn != nil {
+		bus.conn.Close()
+	}
+}
+
+// connect Connects and subscribes to the cluster subject
+func (bus *natsBus) connect() (conn *moqnats.MoqNatsConn, err error) {
+	conn, err = moqnats.Connect(bus.config, true, CLUSTER_TIMEOUT_MS*time.Millisecond)
+	if err != nil {
+		return
+	}
+	if !bus.setConn(conn) {
+		conn.Close()
+		err = errors.New("Cluster bus closed")
+	}
+	return
+}
+
+// setConn Sets the connection used to publish, false if the bus is closed
+func (bus *natsBus) setConn(conn *moqnats.MoqNatsConn) bool {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.closed && conn != nil {
+		return false
+	}
+	bus.conn = conn
+	return true
+}
@@ -0,0 +1,78 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcluster
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// Points of every instance in the ring, more spread the namespaces evenly (and move less of them when an instance joins / leaves)
+const CLUSTER_RING_VIRTUAL_NODES = 128
+
+type moqClusterRingPoint struct {
+	hash    uint32
+	relayId string
+}
+
+// moqClusterRing Consistent hashing ring of the cluster instances, every instance with the same members gets the same owner for a namespace
+type moqClusterRing struct {
+	points []moqClusterRingPoint
+}
+
+func newClusterRing(relayIds []string) *moqClusterRing {
+	ring := moqClusterRing{points: make([]moqClusterRingPoint, 0, len(relayIds)*CLUSTER_RING_VIRTUAL_NODES)}
+	for _, relayId := range relayIds {
+		for i := 0; i < CLUSTER_RING_VIRTUAL_NODES; i++ {
+			ring.points = append(ring.points, moqClusterRingPoint{hash: ringHash(relayId + "#" + strconv.Itoa(i)), relayId: relayId})
+		}
+	}
+	slices.SortFunc(ring.points, func(a moqClusterRingPoint, b moqClusterRingPoint) int {
+		if a.hash != b.hash {
+			if a.hash < b.hash {
+				return -1
+			}
+			return 1
+		}
+		// Same hash in 2 instances (unlikely), any order is fine as long as all instances use the same
+		if a.relayId < b.relayId {
+			return -1
+		} else if a.relayId > b.relayId {
+			return 1
+		}
+		return 0
+	})
+	return &ring
+}
+
+// owner Returns the instance that owns the namespace (first point clockwise from its hash), empty if the ring has no instances
+func (ring *moqClusterRing) owner(trackNamespace string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	hash := ringHash(trackNamespace)
+	i, _ := slices.BinarySearchFunc(ring.points, hash, func(point moqClusterRingPoint, hash uint32) int {
+		if point.hash < hash {
+			return -1
+		} else if point.hash > hash {
+			return 1
+		}
+		return 0
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].relayId
+}
+
+// ringHash First 4 bytes of the MD5 (ketama), spreads well similar keys (ex: relay-1#0, relay-1#1)
+func ringHash(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,315 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcluster
+
+import (
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqorigins"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// moqClusterMember Other instance of the cluster (sharding)
+type moqClusterMember struct {
+	relayUrl    string
+	refreshedAt time.Time
+}
+
+// moqClusterShardOrigin Origin created to the owner of a namespace: push (announces the namespace of a local publisher) or pull (on demand, forwards the local subscribers)
+type moqClusterShardOrigin struct {
+	trackNamespace string
+	relayId        string
+	relayUrl       string
+	push           bool
+	createdAt      time.Time
+}
+
+// OnSubscribe Creates the on demand origin to the owner of the namespace (sharding) before the SUBSCRIBE is forwarded, so it connects if there are NO local publishers
+func (mc *MoqCluster) OnSubscribe(moqSession *moqsession.MoqSession, subscribe moqhelpers.MoqMessageSubscribe) error {
+	if !mc.config.Sharding {
+		return nil
+	}
+	isWildcard, _ := moqfwdtable.GetWildcardPrefix(subscribe.TrackNamespace)
+	if isWildcard {
+		// Its namespaces can be owned by any instance
+		return nil
+	}
+	mc.addPullOrigin(subscribe.TrackNamespace)
+	return nil
+}
+
+// addMember Adds (or refreshes) another instance, the namespaces are reassigned if it is new or its URL changed
+func (mc *MoqCluster) addMember(relayId string, relayUrl string) {
+	mc.lock.Lock()
+	member, found := mc.members[relayId]
+	changed := !found || member.relayUrl != relayUrl
+	mc.members[relayId] = moqClusterMember{relayUrl: relayUrl, refreshedAt: mc.connConfig.Clock.Now()}
+	if changed {
+		mc.rebuildRing()
+	}
+	mc.lock.Unlock()
+
+	if changed {
+		log.WithFields(log.Fields{"relayId": relayId, "relayUrl": relayUrl}).Info("Cluster member joined")
+		go mc.reconcileShards()
+	}
+}
+
+// removeMembers Removes the instance (all the instances NOT refreshed if expired), the namespaces are reassigned if any was removed
+func (mc *MoqCluster) removeMembers(relayId string, expired bool) {
+	removed := []string{}
+
+	mc.lock.Lock()
+	now := mc.connConfig.Clock.Now()
+	for memberRelayId, member := range mc.members {
+		if memberRelayId == relayId || (expired && now.Sub(member.refreshedAt) >= CLUSTER_NAMESPACE_EXPIRATION_MS*time.Millisecond) {
+			delete(mc.members, memberRelayId)
+			removed = append(removed, memberRelayId)
+		}
+	}
+	if len(removed) > 0 {
+		mc.rebuildRing()
+	}
+	mc.lock.Unlock()
+
+	for _, removedRelayId := range removed {
+		log.WithField("relayId", removedRelayId).Info("Cluster member left")
+	}
+	if len(removed) > 0 {
+		mc.reconcileShards()
+	}
+}
+
+// rebuildRing Creates the ring with the current members and this instance (needs lock)
+func (mc *MoqCluster) rebuildRing() {
+	relayIds := []string{mc.config.RelayId}
+	for relayId := range mc.members {
+		relayIds = append(relayIds, relayId)
+	}
+	mc.ring = newClusterRing(relayIds)
+}
+
+// getOwner Returns the instance that owns the namespace and its URL (empty if it is this one) (needs lock)
+func (mc *MoqCluster) getOwner(trackNamespace string) (relayId string, relayUrl string) {
+	relayId = mc.ring.owner(trackNamespace)
+	if relayId != mc.config.RelayId {
+		relayUrl = mc.members[relayId].relayUrl
+	}
+	return
+}
+
+// isClusterRelay Returns true if the relay trace comes from an instance of the cluster (ex: a push origin of another instance) (needs lock)
+func (mc *MoqCluster) isClusterRelay(relayTrace []string) bool {
+	for _, relayId := range relayTrace {
+		_, found := mc.members[relayId]
+		if found || relayId == mc.config.RelayId {
+			return true
+		}
+	}
+	return false
+}
+
+// addPublishedNamespace Tracks a namespace announced by a publisher of this instance, it is pushed to its owner
+func (mc *MoqCluster) addPublishedNamespace(trackNamespace string, sessionName string, relayTrace []string) {
+	mc.lock.Lock()
+	if mc.stopped || mc.isClusterRelay(relayTrace) {
+		mc.lock.Unlock()
+		return
+	}
+	sessions, found := mc.publishedNamespaces[trackNamespace]
+	if !found {
+		sessions = map[string]time.Time{}
+		mc.publishedNamespaces[trackNamespace] = sessions
+	}
+	sessions[sessionName] = mc.connConfig.Clock.Now()
+	mc.lock.Unlock()
+
+	if !found {
+		// The hook is called before the namespace is added, the push origin announces it when it is
+		go mc.reconcileShards()
+	}
+}
+
+// removePublishedSession Removes the namespaces announced by the session, their push origins are closed
+func (mc *MoqCluster) removePublishedSession(sessionName string) {
+	changed := false
+
+	mc.lock.Lock()
+	for trackNamespace, sessions := range mc.publishedNamespaces {
+		_, found := sessions[sessionName]
+		if !found {
+			continue
+		}
+		delete(sessions, sessionName)
+		if len(sessions) == 0 {
+			delete(mc.publishedNamespaces, trackNamespace)
+			changed = true
+		}
+	}
+	mc.lock.Unlock()
+
+	if changed {
+		go mc.reconcileShards()
+	}
+}
+
+// addPullOrigin Creates the on demand origin to the owner of the namespace, nothing if this instance owns it, publishes it or already has it
+func (mc *MoqCluster) addPullOrigin(trackNamespace string) {
+	mc.shardLock.Lock()
+	defer mc.shardLock.Unlock()
+
+	mc.lock.Lock()
+	relayId, relayUrl := mc.getOwner(trackNamespace)
+	_, published := mc.publishedNamespaces[trackNamespace]
+	guid := createShardOriginGuid(false, relayId, trackNamespace)
+	_, found := mc.shardOrigins[guid]
+	if mc.stopped || relayUrl == "" || published || found {
+		mc.lock.Unlock()
+		return
+	}
+	shardOrigin := moqClusterShardOrigin{trackNamespace: trackNamespace, relayId: relayId, relayUrl: relayUrl, createdAt: mc.connConfig.Clock.Now()}
+	mc.shardOrigins[guid] = shardOrigin
+	mc.lock.Unlock()
+
+	_, errAdd := mc.moqOrigins.Add(mc.createShardOriginData(guid, shardOrigin))
+	if errAdd != nil {
+		log.WithFields(log.Fields{"namespace": trackNamespace, "relayId": relayId}).WithError(errAdd).Error("Adding cluster pull origin")
+		mc.lock.Lock()
+		delete(mc.shardOrigins, guid)
+		mc.lock.Unlock()
+	}
+}
+
+// reconcileShards Moves the origins to the current owners of their namespaces: push origins for the local publishers, pull origins for the local subscribers (removed when they do NOT have subscriptions anymore). Origins removed outside the cluster (ex: origins reload) are added again
+func (mc *MoqCluster) reconcileShards() {
+	mc.shardLock.Lock()
+	defer mc.shardLock.Unlock()
+
+	existing := map[string]bool{}
+	for _, status := range mc.moqOrigins.GetStatus() {
+		existing[status.Guid] = true
+	}
+	announced := map[string][]string{}
+	for _, namespaceInfo := range mc.moqtFwdTable.ListNamespaces() {
+		announced[namespaceInfo.TrackNamespace] = namespaceInfo.Publishers
+	}
+
+	mc.lock.Lock()
+	if mc.stopped {
+		mc.lock.Unlock()
+		return
+	}
+	now := mc.connConfig.Clock.Now()
+	desired := map[string]moqClusterShardOrigin{}
+	moved := []string{}
+	for trackNamespace, sessions := range mc.publishedNamespaces {
+		for sessionName, announcedAt := range sessions {
+			// UNANNOUNCED (the hook is called before it is added, so give it some time)
+			if !slices.Contains(announced[trackNamespace], sessionName) && now.Sub(announcedAt) >= CLUSTER_ANNOUNCE_PERIOD_MS*time.Millisecond {
+				delete(sessions, sessionName)
+			}
+		}
+		if len(sessions) == 0 {
+			delete(mc.publishedNamespaces, trackNamespace)
+			continue
+		}
+		relayId, relayUrl := mc.getOwner(trackNamespace)
+		if relayUrl == "" {
+			continue
+		}
+		guid := createShardOriginGuid(true, relayId, trackNamespace)
+		shardOrigin, found := mc.shardOrigins[guid]
+		if !found {
+			shardOrigin = moqClusterShardOrigin{trackNamespace: trackNamespace, relayId: relayId, relayUrl: relayUrl, push: true, createdAt: now}
+		}
+		desired[guid] = shardOrigin
+	}
+	for _, shardOrigin := range mc.shardOrigins {
+		if shardOrigin.push {
+			continue
+		}
+		_, published := mc.publishedNamespaces[shardOrigin.trackNamespace]
+		relayId, relayUrl := mc.getOwner(shardOrigin.trackNamespace)
+		if published || relayUrl == "" {
+			continue
+		}
+		demand := mc.moqtFwdTable.GetNamespaceDemand(shardOrigin.trackNamespace)
+		if demand == 0 && now.Sub(shardOrigin.createdAt) >= CLUSTER_NAMESPACE_EXPIRATION_MS*time.Millisecond {
+			continue
+		}
+		if relayId != shardOrigin.relayId {
+			shardOrigin = moqClusterShardOrigin{trackNamespace: shardOrigin.trackNamespace, relayId: relayId, relayUrl: relayUrl, createdAt: now}
+			if demand > 0 {
+				moved = append(moved, shardOrigin.trackNamespace)
+			}
+		}
+		desired[createShardOriginGuid(false, relayId, shardOrigin.trackNamespace)] = shardOrigin
+	}
+	current := mc.shardOrigins
+	mc.shardOrigins = desired
+	mc.lock.Unlock()
+
+	for guid, shardOrigin := range current {
+		_, keep := desired[guid]
+		if !keep && existing[guid] {
+			mc.moqOrigins.Remove(guid)
+			log.WithFields(log.Fields{"namespace": shardOrigin.trackNamespace, "relayId": shardOrigin.relayId, "push": shardOrigin.push}).Info("Removed cluster origin")
+		}
+	}
+	for guid, shardOrigin := range desired {
+		if existing[guid] {
+			continue
+		}
+		_, errAdd := mc.moqOrigins.Add(mc.createShardOriginData(guid, shardOrigin))
+		if errAdd != nil {
+			log.WithFields(log.Fields{"namespace": shardOrigin.trackNamespace, "relayId": shardOrigin.relayId, "push": shardOrigin.push}).WithError(errAdd).Error("Adding cluster origin")
+			continue
+		}
+		_, wasCurrent := current[guid]
+		if !wasCurrent {
+			log.WithFields(log.Fields{"namespace": shardOrigin.trackNamespace, "relayId": shardOrigin.relayId, "push": shardOrigin.push}).Info("Added cluster origin")
+		}
+	}
+	for _, trackNamespace := range moved {
+		// The subscriptions of the previous owner are resubscribed when it connects
+		mc.moqOrigins.Demand(trackNamespace)
+	}
+}
+
+// removeShardOrigins Closes all the origins to the owners (stop)
+func (mc *MoqCluster) removeShardOrigins() {
+	mc.shardLock.Lock()
+	defer mc.shardLock.Unlock()
+
+	mc.lock.Lock()
+	current := mc.shardOrigins
+	mc.shardOrigins = map[string]moqClusterShardOrigin{}
+	mc.lock.Unlock()
+
+	for guid := range current {
+		mc.moqOrigins.Remove(guid)
+	}
+}
+
+func (mc *MoqCluster) createShardOriginData(guid string, shardOrigin moqClusterShardOrigin) moqorigins.MoqOriginData {
+	return moqorigins.MoqOriginData{Guid: guid, FriendlyName: CLUSTER_SESSION_NAME + "-" + shardOrigin.relayId, TrackNamespace: shardOrigin.trackNamespace, OriginAddress: shardOrigin.relayUrl, Lazy: !shardOrigin.push, Push: shardOrigin.push, CertData: mc.relayCertData}
+}
+
+// Helpers
+
+func createShardOriginGuid(push bool, relayId string, trackNamespace string) string {
+	direction := "pull"
+	if push {
+		direction = "push"
+	}
+	return fmt.Sprintf("%s-%s-%s-%s", CLUSTER_SESSION_NAME, direction, relayId, trackNamespace)
+}
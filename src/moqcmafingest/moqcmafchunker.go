@@ -0,0 +1,187 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcmafingest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Bigger boxes are rejected (protects from broken / malicious inputs)
+const CMAF_MAX_BOX_BYTES = 64 * 1024 * 1024
+
+const CMAF_BOX_HEADER_SIZE = 8
+
+// ISOBMFF sample flags: sample_is_non_sync_sample
+const CMAF_SAMPLE_FLAG_NON_SYNC = 0x10000
+
+// moqCmafChunker Splits a fMP4 (CMAF) byte stream in init segments (ftyp + moov) and chunks (boxes up to and including mdat)
+type moqCmafChunker struct {
+	reader io.Reader
+	// Boxes of the chunk (or init segment) in progress
+	pending []byte
+	// A styp box was found since the last chunk (segment boundary)
+	segmentStart bool
+	// The stream signals segments with styp boxes, if NOT segments start at chunks with a sync sample
+	hasStyp bool
+}
+
+// moqCmafChunk Init segment or media chunk
+type moqCmafChunk struct {
+	data   []byte
+	isInit bool
+	// First chunk of a segment (media chunks)
+	segmentStart bool
+}
+
+func newCmafChunker(reader io.Reader) *moqCmafChunker {
+	return &moqCmafChunker{reader: reader, pending: []byte{}}
+}
+
+// next Returns the next init segment or chunk, io.EOF at the end of the stream (incomplete chunks are discarded)
+func (c *moqCmafChunker) next() (chunk moqCmafChunk, err error) {
+	for {
+		boxType, box, errBox := c.readBox()
+		if errBox != nil {
+			err = errBox
+			return
+		}
+		c.pending = append(c.pending, box...)
+
+		switch boxType {
+		case "ftyp":
+			// Init segment starts, anything before is dropped
+			c.pending = box
+		case "moov":
+			chunk = moqCmafChunk{data: c.pending, isInit: true}
+			c.pending = []byte{}
+			return
+		case "styp":
+			c.hasStyp = true
+			c.segmentStart = true
+		case "moof":
+			if !c.hasStyp && isSyncMoof(box) {
+				c.segmentStart = true
+			}
+		case "mdat":
+			chunk = moqCmafChunk{data: c.pending, segmentStart: c.segmentStart}
+			c.pending = []byte{}
+			c.segmentStart = false
+			return
+		}
+	}
+}
+
+func (c *moqCmafChunker) readBox() (boxType string, box []byte, err error) {
+	header := make([]byte, CMAF_BOX_HEADER_SIZE)
+	_, errRead := io.ReadFull(c.reader, header)
+	if errRead != nil {
+		if errRead == io.ErrUnexpectedEOF {
+			errRead = io.EOF
+		}
+		err = errRead
+		return
+	}
+	boxType = string(header[4:8])
+	size := uint64(binary.BigEndian.Uint32(header[0:4]))
+	if size == 1 {
+		largeSize := make([]byte, 8)
+		_, errRead = io.ReadFull(c.reader, largeSize)
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		header = append(header, largeSize...)
+		size = binary.BigEndian.Uint64(largeSize)
+	}
+	if size < uint64(len(header)) || size > CMAF_MAX_BOX_BYTES {
+		// Size 0 (box until the end of the file) is NOT valid in a live stream
+		err = errors.New(fmt.Sprintf("Invalid size %d of box %q", size, boxType))
+		return
+	}
+	box = make([]byte, size)
+	copy(box, header)
+	_, err = io.ReadFull(c.reader, box[len(header):])
+	return
+}
+
+// Helpers
+
+// isSyncMoof Returns true if the first sample of the (first track of the) fragment is a sync sample, also when it can NOT be known
+func isSyncMoof(moof []byte) bool {
+	traf := findChildBox(moof[CMAF_BOX_HEADER_SIZE:], "traf")
+	if traf == nil {
+		return true
+	}
+	var defaultFlags *uint32 = nil
+	tfhd := findChildBox(traf[CMAF_BOX_HEADER_SIZE:], "tfhd")
+	if tfhd != nil && len(tfhd) >= 16 {
+		tfhdFlags := binary.BigEndian.Uint32(tfhd[8:12]) & 0xffffff
+		// track_ID, then optional fields in this order
+		pos := 16
+		for _, field := range []struct {
+			flag uint32
+			size int
+		}{{0x1, 8}, {0x2, 4}, {0x8, 4}, {0x10, 4}} {
+			if tfhdFlags&field.flag != 0 {
+				pos += field.size
+			}
+		}
+		if tfhdFlags&0x20 != 0 && len(tfhd) >= pos+4 {
+			flags := binary.BigEndian.Uint32(tfhd[pos:])
+			defaultFlags = &flags
+		}
+	}
+	trun := findChildBox(traf[CMAF_BOX_HEADER_SIZE:], "trun")
+	if trun != nil && len(trun) >= 16 {
+		trunFlags := binary.BigEndian.Uint32(trun[8:12]) & 0xffffff
+		// sample_count, then optional fields
+		pos := 16
+		if trunFlags&0x1 != 0 {
+			pos += 4
+		}
+		if trunFlags&0x4 != 0 && len(trun) >= pos+4 {
+			return binary.BigEndian.Uint32(trun[pos:])&CMAF_SAMPLE_FLAG_NON_SYNC == 0
+		}
+		if trunFlags&0x4 != 0 {
+			pos += 4
+		}
+		if trunFlags&0x400 != 0 {
+			// Flags of the first sample
+			if trunFlags&0x100 != 0 {
+				pos += 4
+			}
+			if trunFlags&0x200 != 0 {
+				pos += 4
+			}
+			if len(trun) >= pos+4 {
+				return binary.BigEndian.Uint32(trun[pos:])&CMAF_SAMPLE_FLAG_NON_SYNC == 0
+			}
+		}
+	}
+	if defaultFlags != nil {
+		return *defaultFlags&CMAF_SAMPLE_FLAG_NON_SYNC == 0
+	}
+	return true
+}
+
+// findChildBox Returns the first box of that type in data (a list of boxes), nil if NOT found
+func findChildBox(data []byte, boxType string) []byte {
+	for len(data) >= CMAF_BOX_HEADER_SIZE {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		if size < CMAF_BOX_HEADER_SIZE || size > uint64(len(data)) {
+			return nil
+		}
+		if string(data[4:8]) == boxType {
+			return data[:size]
+		}
+		data = data[size:]
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcmafingest
+
+import (
+	"context"
+	"errors"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqlocalpublisher"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const CMAF_SHUTDOWN_TIMEOUT_MS = 5000
+
+// Wait before opening the pipe again when its writer closes it (ex: encoder restart)
+const CMAF_PIPE_REOPEN_DELAY_MS = 1000
+
+// Name (remote address in the admin API) of the ingest publisher session, also used in the authorization requests
+const CMAF_SESSION_NAME = "cmaf-ingest"
+
+// Pipe path that reads from the standard input
+const CMAF_PIPE_STDIN = "-"
+
+const CMAF_HTTP_PATH_PREFIX = "/cmaf/"
+
+type MoqCmafIngestConfig struct {
+	// Plain HTTP (TCP) listener, empty disables it
+	ListenAddr string
+	// File / FIFO with a continuous fMP4 stream ("-" stdin), empty disables it
+	PipePath  string
+	PipeTrack string
+	// Init segments are published in the track name + this suffix
+	InitTrackSuffix string
+}
+
+// MoqCmafIngest Publishes CMAF (fMP4) received over HTTP or read from a pipe in a namespace, every segment is a group and every chunk (moof + mdat) an object
+type MoqCmafIngest struct {
+	server    *http.Server
+	config    MoqCmafIngestConfig
+	publisher *moqlocalpublisher.MoqLocalPublisher
+
+	// nil allows everything
+	authorizer moqauth.MoqAuthorizer
+
+	// Protected
+	tracks   map[string]*cmafTrack
+	pipeFile *os.File
+	closed   bool
+	lock     *sync.Mutex
+
+	clock moqclock.Clock
+}
+
+// Sequences of a published track, the lock serializes the segments of the track
+type cmafTrack struct {
+	trackName      string
+	groupSequence  uint64
+	objectSequence uint64
+	started        bool
+	lock           *sync.Mutex
+}
+
+// New Creates the CMAF ingest bridge, it publishes using publisher (its namespace)
+func New(config MoqCmafIngestConfig, publisher *moqlocalpublisher.MoqLocalPublisher, authorizer moqauth.MoqAuthorizer, clock moqclock.Clock) *MoqCmafIngest {
+	ci := &MoqCmafIngest{config: config, publisher: publisher, authorizer: authorizer, tracks: map[string]*cmafTrack{}, lock: new(sync.Mutex), clock: clock}
+	if config.ListenAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc(CMAF_HTTP_PATH_PREFIX, ci.serveIngest)
+		ci.server = &http.Server{Addr: config.ListenAddr, Handler: mux}
+	}
+	if config.PipePath != "" {
+		go ci.readPipe()
+	}
+	return ci
+}
+
+// ListenAndServe Serves the HTTP ingest (returns at once if it is disabled)
+func (ci *MoqCmafIngest) ListenAndServe() error {
+	if ci.server == nil {
+		return nil
+	}
+	log.Info(fmt.Sprintf("Serving CMAF ingest. Addr: %s, namespace: %s", ci.server.Addr, ci.publisher.GetTrackNamespace()))
+
+	err := ci.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+// Close Stops the HTTP ingest and the pipe reader (it is NOT waited, it can be blocked opening a FIFO) and removes the publisher
+func (ci *MoqCmafIngest) Close() (err error) {
+	ci.lock.Lock()
+	ci.closed = true
+	if ci.pipeFile != nil {
+		ci.pipeFile.Close()
+	}
+	ci.lock.Unlock()
+
+	if ci.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), CMAF_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+		defer cancel()
+		err = ci.server.Shutdown(ctx)
+	}
+	ci.publisher.Close()
+	return
+}
+
+// HTTP ingest
+
+// serveIngest Receives a file (PUT / POST /cmaf/[track]/[file name]), media segments can be sent chunked (every chunk is published as soon as it is received)
+func (ci *MoqCmafIngest) serveIngest(w http.ResponseWriter, r *http.Request) {
+	trackName, fileName, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, CMAF_HTTP_PATH_PREFIX), "/")
+	if trackName == "" || fileName == "" {
+		http.Error(w, "Expected path "+CMAF_HTTP_PATH_PREFIX+"[track]/[file name]", http.StatusNotFound)
+		return
+	}
+	if ci.authorizer != nil {
+		errAuthorize := ci.authorizer.AuthorizeAnnounce(moqauth.MoqAuthRequest{Action: moqauth.MoqAuthActionAnnounce, TrackNamespace: ci.publisher.GetTrackNamespace(), AuthInfo: r.URL.Query().Get("token"), SessionName: CMAF_SESSION_NAME, Role: moqhelpers.MoqRolePublisher, Metadata: moqsession.MoqSessionMetadata{RemoteAddr: r.RemoteAddr, UserAgent: r.UserAgent()}})
+		if errAuthorize != nil {
+			http.Error(w, "Unauthorized", http.StatusForbidden)
+			return
+		}
+	}
+	if r.Method == http.MethodDelete {
+		// Encoders remove old segments, objects expire from the cache
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method NOT allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	extension := path.Ext(fileName)
+	if extension == ".m3u8" || extension == ".mpd" {
+		// Manifests are NOT needed, players use the relay tracks
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	reqLog := log.WithFields(log.Fields{"session": ci.publisher.GetSessionName(), "track": trackName, "file": fileName, "remoteAddr": r.RemoteAddr})
+	published, errIngest := ci.ingest(newCmafChunker(r.Body), trackName, true, reqLog)
+	if errIngest != nil && errIngest != io.EOF {
+		reqLog.WithField("publishedChunks", published).WithError(errIngest).Error("Ingesting CMAF")
+		http.Error(w, errIngest.Error(), http.StatusBadRequest)
+		return
+	}
+	reqLog.WithField("publishedChunks", published).Debug("Ingested CMAF file")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Pipe ingest
+
+func (ci *MoqCmafIngest) readPipe() {
+	pipeLog := log.WithFields(log.Fields{"session": ci.publisher.GetSessionName(), "track": ci.config.PipeTrack, "pipe": ci.config.PipePath})
+	for {
+		var pipeFile *os.File = os.Stdin
+		if ci.config.PipePath != CMAF_PIPE_STDIN {
+			// FIFOs block until a writer opens them
+			var errOpen error
+			pipeFile, errOpen = os.Open(ci.config.PipePath)
+			if errOpen != nil {
+				pipeLog.WithError(errOpen).Error("Opening CMAF pipe")
+			}
+		}
+		if !ci.setPipeFile(pipeFile) {
+			if pipeFile != nil {
+				pipeFile.Close()
+			}
+			return
+		}
+
+		if pipeFile != nil {
+			pipeLog.Info("Reading CMAF pipe")
+			published, errIngest := ci.ingest(newCmafChunker(pipeFile), ci.config.PipeTrack, false, pipeLog)
+			pipeFile.Close()
+			if errIngest != nil && errIngest != io.EOF && !ci.isClosed() {
+				pipeLog.WithField("publishedChunks", published).WithError(errIngest).Error("Ingesting CMAF")
+			} else {
+				pipeLog.WithField("publishedChunks", published).Info("End of CMAF pipe")
+			}
+		}
+		if ci.config.PipePath == CMAF_PIPE_STDIN || !ci.setPipeFile(nil) {
+			return
+		}
+		<-ci.clock.NewTimer(CMAF_PIPE_REOPEN_DELAY_MS * time.Millisecond).C()
+	}
+}
+
+// setPipeFile Keeps the file being read (to close it on exit), returns false if the ingest is closed
+func (ci *MoqCmafIngest) setPipeFile(pipeFile *os.File) bool {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	ci.pipeFile = pipeFile
+	return !ci.closed
+}
+
+func (ci *MoqCmafIngest) isClosed() bool {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	return ci.closed
+}
+
+// Publishing
+
+// ingest Publishes the init segments and chunks of the stream, if isSegment the stream is a single segment (new group) if NOT groups start with the segments signaled in the stream
+func (ci *MoqCmafIngest) ingest(chunker *moqCmafChunker, trackName string, isSegment bool, streamLog *log.Entry) (published int, err error) {
+	track := ci.getTrack(trackName)
+	initTrack := ci.getTrack(trackName + ci.config.InitTrackSuffix)
+
+	track.lock.Lock()
+	defer track.lock.Unlock()
+
+	firstChunk := true
+	for {
+		chunk, errChunk := chunker.next()
+		if errChunk != nil {
+			err = errChunk
+			return
+		}
+		if chunk.isInit {
+			// Latest init segment is the last object of the init track
+			err = ci.publish(initTrack, chunk.data, true)
+		} else {
+			err = ci.publish(track, chunk.data, (isSegment && firstChunk) || (!isSegment && chunk.segmentStart))
+			firstChunk = false
+		}
+		if err != nil {
+			return
+		}
+		published++
+	}
+}
+
+// publish Publishes a chunk in the track, in a new group if newGroup (or if it is the first one)
+func (ci *MoqCmafIngest) publish(track *cmafTrack, data []byte, newGroup bool) (err error) {
+	if !track.started {
+		_, err = ci.publisher.AddTrack(track.trackName)
+		if err != nil {
+			return
+		}
+		track.started = true
+	} else if newGroup {
+		track.groupSequence++
+		track.objectSequence = 0
+	}
+	err = ci.publisher.PublishObject(track.trackName, track.groupSequence, track.objectSequence, 0, data)
+	if err == nil {
+		track.objectSequence++
+	}
+	return
+}
+
+func (ci *MoqCmafIngest) getTrack(trackName string) *cmafTrack {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	track, found := ci.tracks[trackName]
+	if !found {
+		track = &cmafTrack{trackName: trackName, lock: new(sync.Mutex)}
+		ci.tracks[trackName] = track
+	}
+	return track
+}
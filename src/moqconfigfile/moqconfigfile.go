@@ -0,0 +1,84 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqconfigfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Numbers are kept as written (json.Number) so big integers do NOT become floats
+var numberRegexp = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// ReadFile Reads a config file and returns it as JSON, the format comes from the extension: YAML (.yaml, .yml), TOML (.toml) or JSON (any other)
+func ReadFile(configFilepath string) (jsonData []byte, err error) {
+	data, errRead := os.ReadFile(configFilepath)
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	return ToJson(data, filepath.Ext(configFilepath))
+}
+
+// ToJson Converts the config data in the format of the extension (.yaml, .yml, .toml, any other is JSON and returned as is) to JSON
+func ToJson(data []byte, ext string) (jsonData []byte, err error) {
+	var value interface{} = nil
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		value, err = parseYaml(string(data))
+	case ".toml":
+		value, err = parseToml(string(data))
+	default:
+		jsonData = data
+		return
+	}
+	if err != nil {
+		return
+	}
+	return json.Marshal(value)
+}
+
+// Helpers
+
+// parseNumber Returns the number (json.Number) of a literal, ok false if it is NOT one
+func parseNumber(literal string) (number json.Number, ok bool) {
+	if !numberRegexp.MatchString(literal) {
+		return
+	}
+	number = json.Number(strings.TrimPrefix(literal, "+"))
+	ok = true
+	return
+}
+
+// unquoteDouble Returns the value of a double quoted string (JSON escapes)
+func unquoteDouble(quoted string) (value string, err error) {
+	errUnmarshal := json.Unmarshal([]byte(quoted), &value)
+	if errUnmarshal != nil {
+		err = errors.New(fmt.Sprintf("Invalid string %s", quoted))
+	}
+	return
+}
+
+// findClosingQuote Returns the index of the quote that closes the string started at start (-1 if NOT found), backslash escapes only in double quoted ones
+func findClosingQuote(s string, start int) int {
+	quote := s[start]
+	for i := start + 1; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
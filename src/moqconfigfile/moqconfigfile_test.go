@@ -0,0 +1,126 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqconfigfile
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const TEST_EXAMPLE_CONFIG_PATH = "../../config/example-config"
+
+func TestExampleConfigs(t *testing.T) {
+	wantJson, err := ReadFile(TEST_EXAMPLE_CONFIG_PATH + ".json")
+	if err != nil {
+		t.Fatalf("ReadFile json err %v", err)
+	}
+	for _, ext := range []string{".yaml", ".toml"} {
+		t.Run(ext, func(t *testing.T) {
+			gotJson, err := ReadFile(TEST_EXAMPLE_CONFIG_PATH + ext)
+			if err != nil {
+				t.Fatalf("ReadFile err %v", err)
+			}
+			checkJson(t, gotJson, string(wantJson))
+		})
+	}
+}
+
+func TestYaml(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantJson string
+		wantErr  bool
+	}{
+		{name: "empty", data: "# only comments\n", wantJson: `{}`},
+		{name: "scalars", data: "---\na: 1\nb: -2.5e3\nc: true\nd: ~\ne: text # comment\nf: \"quoted # not comment\"\ng: 'it''s'\nh: :4433\ni: https://host:4433/moq\nj:\n", wantJson: `{"a": 1, "b": -2.5e3, "c": true, "d": null, "e": "text", "f": "quoted # not comment", "g": "it's", "h": ":4433", "i": "https://host:4433/moq", "j": null}`},
+		{name: "big integer", data: "a: 1073741824000\n", wantJson: `{"a": 1073741824000}`},
+		{name: "nested mappings", data: "a:\n  b:\n    c: 1\n  d: 2\ne: 3\n", wantJson: `{"a": {"b": {"c": 1}, "d": 2}, "e": 3}`},
+		{name: "sequences", data: "a:\n  - 1\n  - x\nb:\n- y\n-\n  - z\n", wantJson: `{"a": [1, "x"], "b": ["y", ["z"]]}`},
+		{name: "sequence of mappings", data: "origins:\n  - guid: a\n    discovery: srv\n    command:\n      - get-token\n      - --audience\n  - guid: b\n    failoveraddresses:\n      - originaddress: https://b:4433\n        priority: 1\n", wantJson: `{"origins": [{"guid": "a", "discovery": "srv", "command": ["get-token", "--audience"]}, {"guid": "b", "failoveraddresses": [{"originaddress": "https://b:4433", "priority": 1}]}]}`},
+		{name: "flow collections", data: "a: [1, \"x, y\", [true], {b: c, 'd': [ ]}] # comment\nb: {}\n", wantJson: `{"a": [1, "x, y", [true], {"b": "c", "d": []}], "b": {}}`},
+		{name: "quoted key", data: "\"a b\": 1\n", wantJson: `{"a b": 1}`},
+		{name: "duplicated key", data: "a: 1\na: 2\n", wantErr: true},
+		{name: "bad indentation", data: "a:\n    b: 1\n  c: 2\n", wantErr: true},
+		{name: "tab indentation", data: "a:\n\tb: 1\n", wantErr: true},
+		{name: "anchor", data: "a: &x 1\n", wantErr: true},
+		{name: "block scalar", data: "a: |\n  text\n", wantErr: true},
+		{name: "unterminated flow", data: "a: [1, 2\n", wantErr: true},
+		{name: "unterminated string", data: "a: \"text\n", wantErr: true},
+		{name: "NOT a mapping entry", data: "a: 1\ntext\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotJson, err := ToJson([]byte(tt.data), ".yaml")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToJson err %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil {
+				checkJson(t, gotJson, tt.wantJson)
+			}
+		})
+	}
+}
+
+func TestToml(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantJson string
+		wantErr  bool
+	}{
+		{name: "empty", data: "# only comments\n", wantJson: `{}`},
+		{name: "scalars", data: "a = 1\nb = -2.5e3\nc = true\nd = \"quoted # not comment\" # comment\ne = 'C:\\path'\nf = 1_000_000\n", wantJson: `{"a": 1, "b": -2.5e3, "c": true, "d": "quoted # not comment", "e": "C:\\path", "f": 1000000}`},
+		{name: "tables", data: "top = 1\n[a]\nb = 2\n[a.c]\nd = 3\n[\"e f\"]\ng.h = 4\n", wantJson: `{"top": 1, "a": {"b": 2, "c": {"d": 3}}, "e f": {"g": {"h": 4}}}`},
+		{name: "arrays of tables", data: "[[origins]]\nguid = \"a\"\n[origins.tokenprovider]\ntype = \"exec\"\n[[origins]]\nguid = \"b\"\n[origins.tokenprovider]\ntype = \"file\"\n[[origins.failoveraddresses]]\npriority = 1\n", wantJson: `{"origins": [{"guid": "a", "tokenprovider": {"type": "exec"}}, {"guid": "b", "tokenprovider": {"type": "file"}, "failoveraddresses": [{"priority": 1}]}]}`},
+		{name: "arrays and inline tables", data: "a = [\n  1, # one\n  \"x\",\n  [true],\n]\nb = {c = 1, d.e = \"f\"}\nc = []\n", wantJson: `{"a": [1, "x", [true]], "b": {"c": 1, "d": {"e": "f"}}, "c": []}`},
+		{name: "duplicated key", data: "a = 1\na = 2\n", wantErr: true},
+		{name: "duplicated table", data: "[a]\n[a]\n", wantErr: true},
+		{name: "key of a value", data: "a = 1\n[a.b]\n", wantErr: true},
+		{name: "date", data: "a = 1979-05-27\n", wantErr: true},
+		{name: "hex", data: "a = 0xff\n", wantErr: true},
+		{name: "multi line string", data: "a = \"\"\"\ntext\"\"\"\n", wantErr: true},
+		{name: "two values in a line", data: "a = 1 b = 2\n", wantErr: true},
+		{name: "unterminated string", data: "a = \"text\n", wantErr: true},
+		{name: "missing value", data: "a =\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotJson, err := ToJson([]byte(tt.data), ".toml")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToJson err %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil {
+				checkJson(t, gotJson, tt.wantJson)
+			}
+		})
+	}
+}
+
+// Helpers
+
+// checkJson Compares the values of the JSON documents (numbers as written)
+func checkJson(t *testing.T, gotJson []byte, wantJson string) {
+	t.Helper()
+	var got, want interface{}
+	for _, doc := range []struct {
+		data  string
+		value *interface{}
+	}{{string(gotJson), &got}, {wantJson, &want}} {
+		decoder := json.NewDecoder(strings.NewReader(doc.data))
+		decoder.UseNumber()
+		err := decoder.Decode(doc.value)
+		if err != nil {
+			t.Fatalf("Decoding %s err %v", doc.data, err)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("JSON %s, want %s", gotJson, wantJson)
+	}
+}
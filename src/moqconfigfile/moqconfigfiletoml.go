@@ -0,0 +1,375 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqconfigfile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TOML subset needed by the config files: tables, arrays of tables, dotted keys, strings (basic and literal), integers and floats (decimal), booleans, arrays and inline tables.
+// NOT supported: multi line strings, dates / times, hex / octal / binary integers, inf and nan
+
+type tomlParser struct {
+	data string
+	pos  int
+	root map[string]interface{}
+	// Tables defined with a header (path joined by \x00), a table can NOT be defined twice
+	definedTables map[string]bool
+}
+
+// parseToml Returns the value of a TOML document (map[string]interface{}, []interface{}, string, json.Number or bool)
+func parseToml(data string) (value interface{}, err error) {
+	p := &tomlParser{data: strings.ReplaceAll(data, "\r\n", "\n"), root: map[string]interface{}{}, definedTables: map[string]bool{}}
+	err = p.parse()
+	if err != nil {
+		err = errors.New(fmt.Sprintf("line %d: %v", p.lineNumber(), err))
+		return
+	}
+	value = p.root
+	return
+}
+
+func (p *tomlParser) parse() (err error) {
+	current := p.root
+	for {
+		p.skipSpacesNewlinesAndComments()
+		if p.pos >= len(p.data) {
+			return
+		}
+		if strings.HasPrefix(p.data[p.pos:], "[[") {
+			p.pos += 2
+			current, err = p.parseArrayTableHeader()
+		} else if p.data[p.pos] == '[' {
+			p.pos++
+			current, err = p.parseTableHeader()
+		} else {
+			err = p.parseKeyValue(current)
+		}
+		if err != nil {
+			return
+		}
+		err = p.expectEndOfLine()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parseTableHeader Parses "[a.b]" (after "["), returns the table
+func (p *tomlParser) parseTableHeader() (table map[string]interface{}, err error) {
+	keys, errKeys := p.parseKeys()
+	if errKeys != nil {
+		err = errKeys
+		return
+	}
+	if !p.consume("]") {
+		err = errors.New("expected ] after table name")
+		return
+	}
+	path := strings.Join(keys, "\x00")
+	if p.definedTables[path] {
+		err = errors.New(fmt.Sprintf("table %s defined twice", strings.Join(keys, ".")))
+		return
+	}
+	p.definedTables[path] = true
+	return getTomlTable(p.root, keys)
+}
+
+// parseArrayTableHeader Parses "[[a.b]]" (after "[["), returns the new table appended to the array
+func (p *tomlParser) parseArrayTableHeader() (table map[string]interface{}, err error) {
+	keys, errKeys := p.parseKeys()
+	if errKeys != nil {
+		err = errKeys
+		return
+	}
+	if !p.consume("]]") {
+		err = errors.New("expected ]] after array of tables name")
+		return
+	}
+	parent, errParent := getTomlTable(p.root, keys[:len(keys)-1])
+	if errParent != nil {
+		err = errParent
+		return
+	}
+	last := keys[len(keys)-1]
+	existing, found := parent[last]
+	array, isArray := existing.([]interface{})
+	if found && !isArray {
+		err = errors.New(fmt.Sprintf("%s is NOT an array of tables", strings.Join(keys, ".")))
+		return
+	}
+	table = map[string]interface{}{}
+	parent[last] = append(array, table)
+	// Its sub tables can be defined again
+	prefix := strings.Join(keys, "\x00") + "\x00"
+	for path := range p.definedTables {
+		if strings.HasPrefix(path, prefix) {
+			delete(p.definedTables, path)
+		}
+	}
+	return
+}
+
+// parseKeyValue Parses "a.b = value" and sets it in table
+func (p *tomlParser) parseKeyValue(table map[string]interface{}) (err error) {
+	keys, errKeys := p.parseKeys()
+	if errKeys != nil {
+		err = errKeys
+		return
+	}
+	if !p.consume("=") {
+		err = errors.New("expected = after key")
+		return
+	}
+	value, errValue := p.parseValue()
+	if errValue != nil {
+		err = errValue
+		return
+	}
+	parent, errParent := getTomlTable(table, keys[:len(keys)-1])
+	if errParent != nil {
+		err = errParent
+		return
+	}
+	last := keys[len(keys)-1]
+	if _, found := parent[last]; found {
+		err = errors.New(fmt.Sprintf("key %s defined twice", strings.Join(keys, ".")))
+		return
+	}
+	parent[last] = value
+	return
+}
+
+// parseKeys Parses a dotted key (bare or quoted parts)
+func (p *tomlParser) parseKeys() (keys []string, err error) {
+	keys = []string{}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.data) {
+			err = errors.New("expected key")
+			return
+		}
+		key := ""
+		if p.data[p.pos] == '"' || p.data[p.pos] == '\'' {
+			key, err = p.parseString()
+			if err != nil {
+				return
+			}
+		} else {
+			start := p.pos
+			for p.pos < len(p.data) && isTomlBareKeyChar(p.data[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				err = errors.New(fmt.Sprintf("invalid key at %q", p.rest()))
+				return
+			}
+			key = p.data[start:p.pos]
+		}
+		keys = append(keys, key)
+		p.skipSpaces()
+		if !p.consume(".") {
+			return
+		}
+	}
+}
+
+// parseValue Parses a string, number, bool, array or inline table
+func (p *tomlParser) parseValue() (value interface{}, err error) {
+	p.skipSpaces()
+	if p.pos >= len(p.data) {
+		err = errors.New("expected value")
+		return
+	}
+	switch p.data[p.pos] {
+	case '"', '\'':
+		return p.parseString()
+	case '[':
+		p.pos++
+		array := []interface{}{}
+		for {
+			p.skipSpacesNewlinesAndComments()
+			if p.consume("]") {
+				break
+			}
+			item, errItem := p.parseValue()
+			if errItem != nil {
+				err = errItem
+				return
+			}
+			array = append(array, item)
+			p.skipSpacesNewlinesAndComments()
+			if !p.consume(",") && !strings.HasPrefix(p.rest(), "]") {
+				err = errors.New("expected , or ] in array")
+				return
+			}
+		}
+		value = array
+	case '{':
+		p.pos++
+		table := map[string]interface{}{}
+		p.skipSpaces()
+		if !p.consume("}") {
+			for {
+				err = p.parseKeyValue(table)
+				if err != nil {
+					return
+				}
+				p.skipSpaces()
+				if p.consume("}") {
+					break
+				}
+				if !p.consume(",") {
+					err = errors.New("expected , or } in inline table")
+					return
+				}
+			}
+		}
+		value = table
+	default:
+		start := p.pos
+		for p.pos < len(p.data) && !strings.ContainsRune(" \t\n,]}#", rune(p.data[p.pos])) {
+			p.pos++
+		}
+		literal := p.data[start:p.pos]
+		switch literal {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		default:
+			number, isNumber := parseNumber(strings.ReplaceAll(literal, "_", ""))
+			if !isNumber || strings.HasPrefix(literal, "_") || strings.HasSuffix(literal, "_") || strings.Contains(literal, "__") {
+				err = errors.New(fmt.Sprintf("unsupported value %q (only strings, decimal numbers, booleans, arrays and inline tables)", literal))
+				return
+			}
+			value = number
+		}
+	}
+	return
+}
+
+// parseString Parses a basic (") or literal (') string
+func (p *tomlParser) parseString() (value string, err error) {
+	quote := p.data[p.pos]
+	if strings.HasPrefix(p.rest(), strings.Repeat(string(quote), 3)) {
+		err = errors.New("multi line strings are NOT supported")
+		return
+	}
+	if quote == '\'' {
+		end := strings.IndexAny(p.data[p.pos+1:], "'\n")
+		if end < 0 || p.data[p.pos+1+end] != '\'' {
+			err = errors.New("unterminated literal string")
+			return
+		}
+		value = p.data[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return
+	}
+	closing := findClosingQuote(p.data, p.pos)
+	if closing < 0 || strings.Contains(p.data[p.pos:closing], "\n") {
+		err = errors.New("unterminated string")
+		return
+	}
+	value, err = unquoteDouble(p.data[p.pos : closing+1])
+	p.pos = closing + 1
+	return
+}
+
+// expectEndOfLine Skips the spaces and the comment after a key / value or a header, error if anything else is left in the line
+func (p *tomlParser) expectEndOfLine() (err error) {
+	p.skipSpaces()
+	if strings.HasPrefix(p.rest(), "#") {
+		p.skipComment()
+	}
+	if p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		err = errors.New(fmt.Sprintf("unexpected %q", p.rest()))
+	}
+	return
+}
+
+func (p *tomlParser) skipSpaces() {
+	for p.pos < len(p.data) && (p.data[p.pos] == ' ' || p.data[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipSpacesNewlinesAndComments() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\n':
+			p.pos++
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// consume Skips token if the data continues with it
+func (p *tomlParser) consume(token string) bool {
+	if !strings.HasPrefix(p.rest(), token) {
+		return false
+	}
+	p.pos += len(token)
+	return true
+}
+
+func (p *tomlParser) rest() string {
+	return p.data[p.pos:]
+}
+
+func (p *tomlParser) lineNumber() int {
+	return strings.Count(p.data[:min(p.pos, len(p.data))], "\n") + 1
+}
+
+// Helpers
+
+// getTomlTable Returns the table of the keys path from table (created if needed), for arrays of tables their last one
+func getTomlTable(table map[string]interface{}, keys []string) (ret map[string]interface{}, err error) {
+	ret = table
+	for i, key := range keys {
+		value, found := ret[key]
+		if !found {
+			child := map[string]interface{}{}
+			ret[key] = child
+			ret = child
+			continue
+		}
+		switch typedValue := value.(type) {
+		case map[string]interface{}:
+			ret = typedValue
+		case []interface{}:
+			lastTable, isTable := interface{}(nil), false
+			if len(typedValue) > 0 {
+				lastTable = typedValue[len(typedValue)-1]
+			}
+			ret, isTable = lastTable.(map[string]interface{})
+			if !isTable {
+				err = errors.New(fmt.Sprintf("%s is NOT a table", strings.Join(keys[:i+1], ".")))
+				return
+			}
+		default:
+			err = errors.New(fmt.Sprintf("%s is NOT a table", strings.Join(keys[:i+1], ".")))
+			return
+		}
+	}
+	return
+}
+
+func isTomlBareKeyChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
@@ -0,0 +1,371 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqconfigfile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// YAML subset needed by the config files: block mappings and sequences (space indentation), flow sequences / mappings, plain, single and double quoted scalars and comments.
+// NOT supported: anchors / aliases, tags, block scalars (| >), multi line flow collections and several documents
+
+type yamlLine struct {
+	number  int
+	indent  int
+	content string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYaml Returns the value of a YAML document (map[string]interface{}, []interface{}, string, json.Number, bool or nil)
+func parseYaml(data string) (value interface{}, err error) {
+	p := &yamlParser{lines: []yamlLine{}}
+	for i, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		content := strings.TrimLeft(line, " ")
+		if strings.TrimSpace(content) == "" || strings.HasPrefix(content, "#") || (i == 0 && strings.TrimSpace(content) == "---") {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			err = errors.New(fmt.Sprintf("line %d: tabs can NOT be used for indentation", i+1))
+			return
+		}
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: len(line) - len(content), content: strings.TrimRight(content, " \t")})
+	}
+	if len(p.lines) == 0 {
+		value = map[string]interface{}{}
+		return
+	}
+	value, err = p.parseBlock(p.lines[0].indent)
+	if err == nil && p.pos < len(p.lines) {
+		err = p.lineError(p.lines[p.pos], "unexpected indentation")
+	}
+	return
+}
+
+// parseBlock Parses the mapping or sequence that starts in the current line
+func (p *yamlParser) parseBlock(indent int) (value interface{}, err error) {
+	if isYamlSequenceItem(p.lines[p.pos].content) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseMapping(indent int) (value interface{}, err error) {
+	mapping := map[string]interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		if isYamlSequenceItem(line.content) {
+			err = p.lineError(line, "sequence item in a mapping")
+			return
+		}
+		key, rest, errKey := splitYamlKey(line.content)
+		if errKey != nil {
+			err = p.lineError(line, errKey.Error())
+			return
+		}
+		if _, found := mapping[key]; found {
+			err = p.lineError(line, fmt.Sprintf("duplicated key %s", key))
+			return
+		}
+		p.pos++
+		if rest != "" {
+			mapping[key], err = parseYamlScalar(rest)
+			if err != nil {
+				err = p.lineError(line, err.Error())
+				return
+			}
+			continue
+		}
+		mapping[key] = nil
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			// Sequences can be at the same indentation as their key
+			if next.indent > indent || (next.indent == indent && isYamlSequenceItem(next.content)) {
+				mapping[key], err = p.parseBlock(next.indent)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		err = p.lineError(p.lines[p.pos], "unexpected indentation")
+		return
+	}
+	value = mapping
+	return
+}
+
+func (p *yamlParser) parseSequence(indent int) (value interface{}, err error) {
+	sequence := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYamlSequenceItem(p.lines[p.pos].content) {
+		line := p.lines[p.pos]
+		rest := strings.TrimLeft(line.content[1:], " ")
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			p.pos++
+			var item interface{} = nil
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				item, err = p.parseBlock(p.lines[p.pos].indent)
+				if err != nil {
+					return
+				}
+			}
+			sequence = append(sequence, item)
+			continue
+		}
+		if isYamlSequenceItem(rest) || isYamlMappingEntry(rest) {
+			// The item is a block that starts in this line (after "- ")
+			p.lines[p.pos] = yamlLine{number: line.number, indent: line.indent + len(line.content) - len(rest), content: rest}
+			item, errItem := p.parseBlock(p.lines[p.pos].indent)
+			if errItem != nil {
+				err = errItem
+				return
+			}
+			sequence = append(sequence, item)
+			continue
+		}
+		p.pos++
+		item, errItem := parseYamlScalar(rest)
+		if errItem != nil {
+			err = p.lineError(line, errItem.Error())
+			return
+		}
+		sequence = append(sequence, item)
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		err = p.lineError(p.lines[p.pos], "unexpected indentation")
+		return
+	}
+	value = sequence
+	return
+}
+
+func (p *yamlParser) lineError(line yamlLine, msg string) error {
+	return errors.New(fmt.Sprintf("line %d: %s", line.number, msg))
+}
+
+// Helpers
+
+func isYamlSequenceItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+func isYamlMappingEntry(content string) bool {
+	_, _, err := splitYamlKey(content)
+	return err == nil
+}
+
+// splitYamlKey Returns the key and the value (empty if it is a block in the next lines) of a mapping entry
+func splitYamlKey(content string) (key string, rest string, err error) {
+	keyEnd := -1
+	if content[0] == '"' || content[0] == '\'' {
+		closing := findYamlClosingQuote(content, 0)
+		if closing < 0 || !strings.HasPrefix(content[closing+1:], ":") {
+			err = errors.New("invalid quoted key")
+			return
+		}
+		key, err = parseYamlQuoted(content[:closing+1])
+		if err != nil {
+			return
+		}
+		keyEnd = closing + 1
+	} else {
+		keyEnd = strings.Index(content, ": ")
+		if keyEnd < 0 && strings.HasSuffix(content, ":") {
+			keyEnd = len(content) - 1
+		}
+		if keyEnd <= 0 || strings.ContainsAny(content[:1], "[{&*!|>%@`#") {
+			err = errors.New("expected key: value")
+			return
+		}
+		key = strings.TrimRight(content[:keyEnd], " ")
+	}
+	if keyEnd+1 < len(content) && content[keyEnd+1] != ' ' {
+		err = errors.New("expected key: value")
+		return
+	}
+	rest = strings.TrimSpace(content[keyEnd+1:])
+	if strings.HasPrefix(rest, "#") {
+		rest = ""
+	}
+	return
+}
+
+// parseYamlScalar Parses the value after "key: " or "- " (scalar or flow collection)
+func parseYamlScalar(s string) (value interface{}, err error) {
+	switch s[0] {
+	case '[', '{':
+		i := 0
+		value, err = parseYamlFlow(s, &i)
+		if err == nil && !isYamlComment(s[i:]) {
+			err = errors.New(fmt.Sprintf("unexpected %s after flow collection", s[i:]))
+		}
+		return
+	case '"', '\'':
+		closing := findYamlClosingQuote(s, 0)
+		if closing < 0 || !isYamlComment(s[closing+1:]) {
+			err = errors.New(fmt.Sprintf("invalid quoted string %s", s))
+			return
+		}
+		return parseYamlQuoted(s[:closing+1])
+	case '&', '*', '!', '|', '>', '%', '@', '`':
+		err = errors.New(fmt.Sprintf("unsupported value %s (anchors, aliases, tags and block scalars are NOT supported)", s))
+		return
+	}
+	commentStart := strings.Index(s, " #")
+	if commentStart >= 0 {
+		s = strings.TrimRight(s[:commentStart], " ")
+	}
+	value = parseYamlPlain(s)
+	return
+}
+
+// parseYamlFlow Parses the flow value (collection, quoted or plain scalar) that starts at s[*i], *i is left after it
+func parseYamlFlow(s string, i *int) (value interface{}, err error) {
+	skipYamlSpaces(s, i)
+	if *i >= len(s) {
+		err = errors.New("unterminated flow collection")
+		return
+	}
+	switch s[*i] {
+	case '[':
+		sequence := []interface{}{}
+		*i++
+		for {
+			skipYamlSpaces(s, i)
+			if *i < len(s) && s[*i] == ']' {
+				*i++
+				break
+			}
+			item, errItem := parseYamlFlow(s, i)
+			if errItem != nil {
+				err = errItem
+				return
+			}
+			sequence = append(sequence, item)
+			if !nextYamlFlowItem(s, i, ']') {
+				err = errors.New("expected , or ] in flow sequence")
+				return
+			}
+		}
+		value = sequence
+	case '{':
+		mapping := map[string]interface{}{}
+		*i++
+		for {
+			skipYamlSpaces(s, i)
+			if *i < len(s) && s[*i] == '}' {
+				*i++
+				break
+			}
+			keyValue, errKey := parseYamlFlow(s, i)
+			if errKey != nil {
+				err = errKey
+				return
+			}
+			key, isString := keyValue.(string)
+			skipYamlSpaces(s, i)
+			if !isString || *i >= len(s) || s[*i] != ':' {
+				err = errors.New("expected key: value in flow mapping")
+				return
+			}
+			*i++
+			mapping[key], err = parseYamlFlow(s, i)
+			if err != nil {
+				return
+			}
+			if !nextYamlFlowItem(s, i, '}') {
+				err = errors.New("expected , or } in flow mapping")
+				return
+			}
+		}
+		value = mapping
+	case '"', '\'':
+		closing := findYamlClosingQuote(s, *i)
+		if closing < 0 {
+			err = errors.New(fmt.Sprintf("invalid quoted string %s", s[*i:]))
+			return
+		}
+		value, err = parseYamlQuoted(s[*i : closing+1])
+		*i = closing + 1
+	default:
+		start := *i
+		for *i < len(s) && !strings.ContainsRune(",]}", rune(s[*i])) && !(s[*i] == ':' && (*i+1 == len(s) || s[*i+1] == ' ')) {
+			*i++
+		}
+		value = parseYamlPlain(strings.TrimSpace(s[start:*i]))
+	}
+	return
+}
+
+// nextYamlFlowItem Skips the separator after a flow item, false if it is NOT , or the end
+func nextYamlFlowItem(s string, i *int, end byte) bool {
+	skipYamlSpaces(s, i)
+	if *i < len(s) && s[*i] == ',' {
+		*i++
+		return true
+	}
+	return *i < len(s) && s[*i] == end
+}
+
+func skipYamlSpaces(s string, i *int) {
+	for *i < len(s) && s[*i] == ' ' {
+		*i++
+	}
+}
+
+func isYamlComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// findYamlClosingQuote Like findClosingQuote, a doubled single quote is an escaped quote in single quoted strings
+func findYamlClosingQuote(s string, start int) int {
+	if s[start] == '"' {
+		return findClosingQuote(s, start)
+	}
+	for i := start + 1; i < len(s); i++ {
+		if s[i] == '\'' {
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func parseYamlQuoted(quoted string) (value string, err error) {
+	if quoted[0] == '"' {
+		return unquoteDouble(quoted)
+	}
+	value = strings.ReplaceAll(quoted[1:len(quoted)-1], "''", "'")
+	return
+}
+
+// parseYamlPlain Returns the value of a plain scalar: null, bool, number or string
+func parseYamlPlain(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	number, isNumber := parseNumber(s)
+	if isNumber {
+		return number
+	}
+	return s
+}
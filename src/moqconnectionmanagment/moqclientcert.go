@@ -0,0 +1,86 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqconnectionmanagment
+
+import (
+	"crypto/x509"
+	"errors"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"fmt"
+
+	"golang.org/x/exp/slices"
+)
+
+// MoqClientCertIdentityData Client certificate identity (subject CN, DNS / URI / email SAN) and the namespaces it can announce / subscribe
+type MoqClientCertIdentityData struct {
+	Identity string `json:"identity"`
+	// Exact or wildcard (ex: "live/studio1/*")
+	TrackNamespaces []string `json:"tracknamespaces"`
+}
+
+type MoqClientCertIdentitiesData struct {
+	Identities []MoqClientCertIdentityData `json:"identities"`
+}
+
+// IsValidClientCertIdentities Checks the identities are unique and have namespaces
+func IsValidClientCertIdentities(identitiesData MoqClientCertIdentitiesData) (err error) {
+	identities := map[string]bool{}
+	for _, identityData := range identitiesData.Identities {
+		if identityData.Identity == "" || len(identityData.TrackNamespaces) == 0 {
+			err = errors.New("Client cert identities need an identity and tracknamespaces")
+			return
+		}
+		if identities[identityData.Identity] {
+			err = errors.New(fmt.Sprintf("Duplicated client cert identity %s", identityData.Identity))
+			return
+		}
+		identities[identityData.Identity] = true
+	}
+	return
+}
+
+// GetClientCertNamespaces Returns the first configured identity of the certificate and its namespaces (without identities configured any verified certificate can use any namespace, nil namespaces)
+func (identitiesData *MoqClientCertIdentitiesData) GetClientCertNamespaces(cert *x509.Certificate) (identity string, namespaces []string, found bool) {
+	certIdentities := GetClientCertIdentities(cert)
+	if len(identitiesData.Identities) == 0 {
+		if len(certIdentities) > 0 {
+			identity = certIdentities[0]
+		}
+		found = true
+		return
+	}
+	for _, certIdentity := range certIdentities {
+		for _, identityData := range identitiesData.Identities {
+			if identityData.Identity == certIdentity {
+				return certIdentity, identityData.TrackNamespaces, true
+			}
+		}
+	}
+	return
+}
+
+// isClientCertNamespaceAllowed Returns true if trackNamespace (or a wildcard subscription) is inside any of the client certificate namespaces (nil any)
+func isClientCertNamespaceAllowed(namespaces []string, trackNamespace string) bool {
+	if namespaces == nil {
+		return true
+	}
+	return slices.ContainsFunc(namespaces, func(pattern string) bool { return moqfwdtable.MatchesNamespace(pattern, trackNamespace) })
+}
+
+// GetClientCertIdentities Returns the identities of a certificate, subject CN first
+func GetClientCertIdentities(cert *x509.Certificate) (identities []string) {
+	identities = []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, cert.EmailAddresses...)
+	return
+}
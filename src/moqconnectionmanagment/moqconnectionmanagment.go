@@ -7,17 +7,34 @@ LICENSE file in the root directory of this source tree.
 package moqconnectionmanagment
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"facebookexperimental/moq-go-server/moqadmission"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqbandwidth"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqcontrolwriter"
+	"facebookexperimental/moq-go-server/moqegressscheduler"
+	"facebookexperimental/moq-go-server/moqevents"
 	"facebookexperimental/moq-go-server/moqfwdtable"
 	"facebookexperimental/moq-go-server/moqhelpers"
 	"facebookexperimental/moq-go-server/moqhelpers/quichelpers"
+	"facebookexperimental/moq-go-server/moqhooks"
+	"facebookexperimental/moq-go-server/moqlogsampler"
 	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqmetrics"
 	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqquicstats"
+	"facebookexperimental/moq-go-server/moqrecorder"
 	"facebookexperimental/moq-go-server/moqsession"
+	"facebookexperimental/moq-go-server/moqworkerpool"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/quic-go/webtransport-go"
 
@@ -25,42 +42,207 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func MoqConnectionManagment(isOrigin bool, originTrackNameSpace string, originAuthInfo string, ctx context.Context, session *webtransport.Session, namespace string, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) {
+const IDLE_CHECK_PERIOD_MS = 1000
+
+// Batched streams are closed after this number of objects (a new one is opened for the next)
+const EGRESS_BATCH_MAX_OBJECTS_PER_STREAM = 256
+
+// MoqTransportSession Session MOQ runs on, implemented by WebTransport sessions and raw QUIC connections (moqrawquic)
+type MoqTransportSession interface {
+	Context() context.Context
+	RemoteAddr() net.Addr
+	OpenStream() (webtransport.Stream, error)
+	AcceptStream(ctx context.Context) (webtransport.Stream, error)
+	AcceptUniStream(ctx context.Context) (webtransport.ReceiveStream, error)
+	OpenUniStreamSync(ctx context.Context) (webtransport.SendStream, error)
+	CloseWithError(code webtransport.SessionErrorCode, msg string) error
+}
+
+// Relay wide settings for every MOQ connection
+type MoqConnectionConfig struct {
+	// Object TTL
+	ObjExpMs uint64
+	// Close session if no activity for this time (0 disabled)
+	StallTimeoutMs uint64
+	// Close sessions that do not announce (publishers) / subscribe (subscribers) after setup, or without objects (0 disabled)
+	PublisherAnnounceTimeoutMs   uint64
+	SubscriberSubscribeTimeoutMs uint64
+	ObjectsIdleTimeoutMs         uint64
+	// Warn about broken group / object sequences from publishers
+	ValidateObjSequences bool
+	// Relay wide ingest + egress budget
+	Bandwidth *moqbandwidth.MoqBandwidthBudget
+	// Max objects waiting to be sent per subscriber, and what to do when full
+	ObjQueueSize   int
+	ObjQueuePolicy moqsession.MoqObjQueuePolicy
+	// Slow subscribers skip to the newest group (instead of receiving stale objects)
+	SkipToLatestGroup bool
+	// Send rate limit per subscriber (0 unlimited), burst, and max time an object waits for it
+	SubscriberRateBps       uint64
+	SubscriberBurstBytes    uint64
+	SubscriberRateMaxWaitMs uint64
+	// Max time an object stream of a subscriber waits for its higher priority ones (lower send order, newer group) to be written before it is dropped (0 forever)
+	SubscriberPriorityMaxWaitMs uint64
+	// Consecutive objects of the same track / group up to this size share a stream (sent with their length), 0 disabled
+	EgressBatchMaxObjectBytes uint64
+	// SUBSCRIBE for an already subscribed track
+	DuplicateSubscribePolicy moqsession.MoqDuplicateSubscribePolicy
+	// Delete the cached objects of a namespace when it is unannounced
+	PurgeCacheOnUnAnnounce bool
+	// Origins only, previous groups requested on the first SUBSCRIBE of a track to warm up the cache (0 disabled)
+	OriginWarmUpGroups uint64
+	// Origins only, on demand origins are disconnected after this time without subscriptions
+	OriginLazyIdleTimeoutMs uint64
+	// Origins only, idle on demand origin sessions kept connected (most used origins first, 0 disabled) and for how long
+	OriginWarmPoolSize  int
+	OriginWarmPoolTtlMs uint64
+	// Origins only, parallel sessions to the same origin share this pool name (empty no pool)
+	OriginPool string
+	// Origins only, announce the local namespaces to the origin (instead of getting its namespace from it)
+	OriginPush bool
+	// Origins only, PATH sent in the client SETUP (raw QUIC origins, WebTransport uses the URL path)
+	OriginSetupPath string
+	// Origins only, called when the MOQ session is created (ex: to collect its counters)
+	OriginOnSession func(moqSession *moqsession.MoqSession)
+	// Closed when the relay starts draining (graceful shutdown), incoming sessions are sent GOAWAY and closed after DrainMs
+	DrainChannel chan bool
+	DrainMs      uint64
+	// Relay wide counters (nil disabled)
+	Metrics *moqmetrics.MoqRelayMetrics
+	// Relay events stream for dashboards (nil disabled)
+	Events *moqevents.MoqEvents
+	// Decides who can ANNOUNCE / SUBSCRIBE what (nil allows everything)
+	Authorizer moqauth.MoqAuthorizer
+	// Application / plugin callbacks (nil none)
+	Hooks *moqhooks.MoqHooksRegistry
+	// Incoming sessions only, policy of the URL path they connected to
+	Endpoint MoqEndpointData
+	// Incoming sessions only, namespaces allowed by their client certificate identity (nil any)
+	ClientCertNamespaces []string
+	// Incoming sessions only, SUBSCRIBE messages per IP limit (nil unlimited)
+	SubscribeRateLimiter *moqadmission.MoqIpRateLimiter
+	// Per object Info logs, 1 in N objects per track is logged (nil all), errors / warnings are always logged
+	IngestLogSampler *moqlogsampler.MoqLogSampler
+	EgressLogSampler *moqlogsampler.MoqLogSampler
+	// QUIC connections stats (RTT, congestion window, losses), nil disabled
+	QuicStats *moqquicstats.MoqQuicStats
+	// Persists the objects of the recorded namespaces to disk (nil disabled)
+	Recorder *moqrecorder.MoqRecorder
+	// Relay wide workers that receive the object streams of publishers / send the objects to subscribers (nil a goroutine per stream)
+	IngestPool *moqworkerpool.MoqWorkerPool
+	EgressPool *moqworkerpool.MoqWorkerPool
+
+	Clock moqclock.Clock
+}
+
+func MoqConnectionManagment(isOrigin bool, originTrackNameSpace string, originAuthInfo string, ctx context.Context, session MoqTransportSession, metadata moqsession.MoqSessionMetadata, namespace string, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig MoqConnectionConfig) {
 	var err error = nil
 	var stream webtransport.Stream
 	var version moqhelpers.MoqVersion
 	var role moqhelpers.MoqRole
 
+	if isOrigin {
+		// Origins are configured by the relay operator, what they send is trusted
+		connConfig.Authorizer = nil
+		connConfig.SubscribeRateLimiter = nil
+	}
+
+	// Until the session is created it is identified by its namespace (path or origin name)
+	sessionLog := log.WithFields(log.Fields{"session": namespace, "origin": isOrigin})
+
 	if !isOrigin {
-		stream, version, role, err = startServerSetup(ctx, session, namespace)
+		stream, version, role, err = startServerSetup(ctx, session, connConfig.Endpoint, sessionLog)
 	} else {
-		stream, version, role, err = startClientSetup(ctx, session, namespace)
+		stream, version, role, err = startClientSetup(ctx, session, connConfig.OriginSetupPath, sessionLog)
 	}
 	if err != nil {
 		return
 	}
 
-	moqSession := moqsession.New(namespace+"/"+uuid.New().String(), version, role)
+	if metadata.RemoteAddr == "" {
+		metadata.RemoteAddr = session.RemoteAddr().String()
+	}
+	moqSession := moqsession.New(namespace+"/"+uuid.New().String(), version, role, metadata, connConfig.ObjQueueSize, connConfig.ObjQueuePolicy, connConfig.SkipToLatestGroup, connConfig.Clock)
+	sessionLog = log.WithFields(log.Fields{"session": moqSession.UniqueName, "origin": isOrigin, "role": role})
+	moqSession.SetCloser(func(errCode moqhelpers.MoqErrorCode, errMsg string) {
+		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: errCode, ErrMsg: errMsg})
+	})
+	transportStats := connConfig.QuicStats.Get(session.Context())
+	// Control stream (accepted by the relay, opened by origins)
+	transportStats.StreamOpened(!isOrigin)
+	moqSession.SetTransportStats(transportStats)
 	errAddSession := moqtFwdTable.AddSession(moqSession)
 	if errAddSession != nil {
-		log.Error(fmt.Sprintf("%s - Error adding session %s. Err: %v", moqSession.UniqueName, moqSession.UniqueName, errAddSession))
+		sessionLog.WithError(errAddSession).Error("Error adding session")
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGeneric, ErrMsg: "Adding session"})
 		return
 	}
 	if isOrigin {
-		moqSession.AddTrackNamespace(moqhelpers.CreateAnnounce(originTrackNameSpace, originAuthInfo))
+		if !connConfig.OriginPush {
+			moqSession.AddTrackNamespace(moqhelpers.CreateAnnounce(originTrackNameSpace, originAuthInfo))
+		}
+		if originAuthInfo != "" {
+			moqSession.SetAuthIdentity(originAuthInfo)
+		}
+		moqSession.SetWarmUpGroups(connConfig.OriginWarmUpGroups)
+		moqSession.SetOriginPool(connConfig.OriginPool)
+		if connConfig.OriginOnSession != nil {
+			connConfig.OriginOnSession(moqSession)
+		}
+	}
+	moqSession.SetState(moqsession.MoqSessionStateEstablished)
+	connConfig.Metrics.SessionStarted(role, isOrigin)
+	connConfig.Events.SessionConnected(moqSession, isOrigin)
+	sessionLog.WithFields(log.Fields{"version": version, "trackNamespace": originTrackNameSpace, "remoteAddr": metadata.RemoteAddr, "userAgent": metadata.UserAgent, "wtSessionId": metadata.WtSessionId}).Info("Created new session")
+
+	// All outbound control messages go through it (serialized)
+	controlWriter := moqcontrolwriter.New(stream, func(errWrite error) {
+		sessionLog.WithError(errWrite).Error("Writing to control stream, closing session")
+		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGeneric, ErrMsg: "Writing control stream"})
+	})
+
+	if connConfig.StallTimeoutMs > 0 {
+		// It will exit when session finishes
+		go startStallWatchdog(session, moqSession, sessionLog, connConfig)
+	}
+	if !isOrigin && connConfig.DrainChannel != nil {
+		// It will exit when session finishes
+		go startGoAwayOnDrain(session, controlWriter, sessionLog, connConfig)
+	}
+	if !isOrigin && (connConfig.PublisherAnnounceTimeoutMs > 0 || connConfig.SubscriberSubscribeTimeoutMs > 0 || connConfig.ObjectsIdleTimeoutMs > 0) {
+		// It will exit when session finishes
+		go startIdleWatchdog(session, moqSession, sessionLog, connConfig)
 	}
-	log.Info(fmt.Sprintf("%s - Created new session. Role: %d, version: %d, TrackNamespace: %s", moqSession.UniqueName, role, version, originTrackNameSpace))
-
 	if role == moqhelpers.MoqRolePublisher || role == moqhelpers.MoqRoleBoth {
 		// They will exit when session finishes
-		go startListeningObjects(session, moqSession, moqtFwdTable, objects, objExpMs)
-		go startForwardSubscribes(stream, moqSession)
+		go startListeningObjects(session, moqSession, sessionLog, moqtFwdTable, objects, connConfig)
+		go startForwardSubscribes(controlWriter, moqSession, sessionLog, connConfig.Endpoint)
 	}
 	if role == moqhelpers.MoqRoleSubscriber || role == moqhelpers.MoqRoleBoth {
 		// It will exit when session finishes
-		go startForwardingObjects(session, moqSession, objects)
-		go startForwardSubscribeResponses(stream, moqSession)
+		go startForwardingObjects(session, moqSession, sessionLog, moqtFwdTable, objects, connConfig)
+		go startForwardSubscribeResponses(controlWriter, moqSession, sessionLog, connConfig.Endpoint)
+	}
+	if isOrigin && connConfig.OriginPush {
+		// Upstream relay will SUBSCRIBE to the local namespaces we announce
+		moqtFwdTable.AddPushSession(moqSession.UniqueName, originTrackNameSpace, func(trackNamespace string, announce bool) {
+			errMoqTx := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+				if announce {
+					moqAnnounce := moqhelpers.CreateAnnounce(trackNamespace, originAuthInfo)
+					moqAnnounce.RelayTrace = []string{moqtFwdTable.RelayId}
+					return moqhelpers.SendAnnounce(stream, moqAnnounce)
+				}
+				return moqhelpers.SendUnAnnounce(stream, moqhelpers.MoqMessageUnAnnounce{TrackNamespace: trackNamespace})
+			})
+			if errMoqTx != nil {
+				sessionLog.WithFields(log.Fields{"namespace": trackNamespace, "announce": announce}).WithError(errMoqTx).Error("Pushing namespace upstream")
+			}
+		})
+	} else if isOrigin {
+		// Subscribes waiting for this origin to connect (on demand origins)
+		moqtFwdTable.ForwardParkedSubscribes(moqSession)
+		// Subscriptions left without publisher by a previous origin session (reconnection / failover)
+		moqtFwdTable.ResubscribeOrphanTracks(originTrackNameSpace, moqSession)
 	}
 
 	var errorSessionMoq moqhelpers.MoqError
@@ -68,80 +250,110 @@ func MoqConnectionManagment(isOrigin bool, originTrackNameSpace string, originAu
 		moqMsg, moqMsgType, moqMsgErr := moqhelpers.ReceiveMessage(stream)
 		if moqMsgErr != nil {
 			if moqMsgErr == io.EOF {
-				log.Info(fmt.Sprintf("%s - Found end of stream", moqSession.UniqueName))
+				sessionLog.Info("Found end of stream")
 			} else {
-				log.Error(fmt.Sprintf("%s - Receiving message. Err: %v", moqSession.UniqueName, moqMsgErr))
+				sessionLog.WithError(moqMsgErr).Error("Receiving message")
 				errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
 				errorSessionMoq.ErrMsg = "Error receiving message"
 			}
 			break
 		}
+		moqSession.Touch()
+		moqSession.ControlMessageReceived(moqMsgType)
+		// Relay namespaces from here, the ones sent to the session are mapped back
+		moqMsg = connConfig.Endpoint.MapMessage(moqMsg, true)
+
 		if moqMsgType == moqhelpers.MoqIdMessageAnnounce {
-			errorSessionMoq = processAnnounce(moqMsg, stream, moqSession)
+			errorSessionMoq = processAnnounce(moqMsg, controlWriter, moqSession, sessionLog, moqtFwdTable, connConfig)
 			if errorSessionMoq.ErrCode != moqhelpers.NoError {
 				break
 			}
 		} else if moqMsgType == moqhelpers.MoqIdSubscribe {
-			errorSessionMoq = processSubscribe(moqMsg, stream, moqSession, moqtFwdTable)
+			errorSessionMoq = processSubscribe(moqMsg, controlWriter, moqSession, sessionLog, moqtFwdTable, objects, connConfig)
 			if errorSessionMoq.ErrCode != moqhelpers.NoError {
 				break
 			}
 		} else if moqMsgType == moqhelpers.MoqIdSubscribeOk {
-			errorSessionMoq = processSubscribeOk(moqMsg, stream, moqSession, moqtFwdTable)
+			errorSessionMoq = processSubscribeOk(moqMsg, controlWriter, moqSession, sessionLog, moqtFwdTable)
 			if errorSessionMoq.ErrCode != moqhelpers.NoError {
 				break
 			}
 		} else if moqMsgType == moqhelpers.MoqIdMessageAnnounceOk {
-			errorSessionMoq = processAnnounceOk(moqMsg, stream, moqSession, moqtFwdTable)
+			errorSessionMoq = processAnnounceOk(moqMsg, controlWriter, moqSession, sessionLog, moqtFwdTable)
 			if errorSessionMoq.ErrCode != moqhelpers.NoError {
 				break
 			}
 		} else if moqMsgType == moqhelpers.MoqIdSubscribeError {
-			errorSessionMoq = processSubscribeError(moqMsg, stream, moqSession, moqtFwdTable)
+			errorSessionMoq = processSubscribeError(moqMsg, controlWriter, moqSession, sessionLog, moqtFwdTable)
+			if errorSessionMoq.ErrCode != moqhelpers.NoError {
+				break
+			}
+		} else if moqMsgType == moqhelpers.MoqIdMessageUnAnnounce {
+			errorSessionMoq = processUnAnnounce(moqMsg, moqSession, sessionLog, moqtFwdTable, objects, connConfig)
+			if errorSessionMoq.ErrCode != moqhelpers.NoError {
+				break
+			}
+		} else if moqMsgType == moqhelpers.MoqIdUnSubscribe {
+			errorSessionMoq = processUnSubscribe(moqMsg, moqSession, sessionLog, moqtFwdTable)
 			if errorSessionMoq.ErrCode != moqhelpers.NoError {
 				break
 			}
+		} else if moqMsgType == moqhelpers.MoqIdMessageGoAway && isOrigin {
+			// Upstream relay is going away, the origin reconnects (or fails over)
+			sessionLog.Info("Received GOAWAY from origin, closing session")
+			break
 		} else {
 			//TODO: Process other messages (such as errors)
-			log.Error(fmt.Sprintf("%s - Non expected message received %d", moqSession.UniqueName, moqMsgType))
+			sessionLog.WithField("msgType", moqMsgType).Error("Non expected message received")
 		}
 	}
 
+	// No more forwarding to / from this session
+	moqSession.SetState(moqsession.MoqSessionStateDraining)
+	connConfig.Metrics.SessionEnded(role, isOrigin, connConfig.Clock.Now().Sub(moqSession.CreatedAt))
+	connConfig.Hooks.OnSessionClose(moqSession)
+	connConfig.Events.SessionDisconnected(moqSession, isOrigin, connConfig.Clock.Now().Sub(moqSession.CreatedAt))
+
 	errRemoveSession := moqtFwdTable.RemoveSession(moqSession.UniqueName)
 	if errRemoveSession != nil {
-		log.Error(fmt.Sprintf("%s - Error removing session %s", moqSession.UniqueName, moqSession.UniqueName))
+		sessionLog.Error("Error removing session")
 	}
+	// Already done by RemoveSession if the session was found
+	moqSession.StopThreads()
+	controlWriter.Close()
 
 	if errorSessionMoq.ErrCode != moqhelpers.NoError {
 		terminateSessionWithError(session, errorSessionMoq)
 	}
 }
 
-func startClientSetup(ctx context.Context, session *webtransport.Session, namespace string) (controlStream webtransport.Stream, version moqhelpers.MoqVersion, role moqhelpers.MoqRole, err error) {
+func startClientSetup(ctx context.Context, session MoqTransportSession, path string, sessionLog *log.Entry) (controlStream webtransport.Stream, version moqhelpers.MoqVersion, role moqhelpers.MoqRole, err error) {
 	stream, errOpen := session.OpenStream()
-	isErr, _ := processWTError(errOpen, namespace, "Creating bidirectional CONTROL stream")
+	isErr, _ := processWTError(errOpen, sessionLog, "Creating bidirectional CONTROL stream")
 	if isErr {
 		err = errOpen
 		return
 	}
+	stream = quichelpers.NewBufferedStream(stream)
 
 	// Get data from origin (I'm an origin subscriber)
 	moqClientSetup := moqhelpers.CreateClientSetup(moqhelpers.MoqRoleBoth)
+	moqClientSetup.Path = path
 	errMoqTxSetup := moqhelpers.SendClientSetup(stream, moqClientSetup)
 	if errMoqTxSetup != nil {
-		log.Error(fmt.Sprintf("origin-%s - Error sending client setup", namespace))
+		sessionLog.Error("Error sending client setup")
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Error sending client setup"})
 		err = errMoqTxSetup
 		return
 	}
-	log.Info(fmt.Sprintf("origin-%s - Sent client SETUP %v", namespace, moqClientSetup))
+	sessionLog.WithField("moqMsg", moqClientSetup).Info("Sent client SETUP")
 
 	moqMsg, moqMsgType, moqMsgErr := moqhelpers.ReceiveMessage(stream)
 	if moqMsgErr != nil {
 		if moqMsgErr == io.EOF {
-			log.Info(fmt.Sprintf("origin-%s - Found end of stream", namespace))
+			sessionLog.Info("Found end of stream")
 		} else {
-			log.Error(fmt.Sprintf("origin-%s - Receiving server SETUP message. Err: %v", namespace, moqMsgErr))
+			sessionLog.WithError(moqMsgErr).Error("Receiving server SETUP message")
 			terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGeneric, ErrMsg: "Receiving server SETUP message"})
 		}
 		err = moqMsgErr
@@ -150,25 +362,25 @@ func startClientSetup(ctx context.Context, session *webtransport.Session, namesp
 
 	moqSetupServer, moqSetUpConv := moqMsg.(moqhelpers.MoqMessageServerSetup)
 	if moqMsgType != moqhelpers.MoqIdMessageServerSetup || !moqSetUpConv {
-		errMsg := fmt.Sprintf("origin-%s - Expecting server SETUP message. Received %d", namespace, moqMsgType)
-		log.Error(errMsg)
+		errMsg := fmt.Sprintf("Expecting server SETUP message. Received %d", moqMsgType)
+		sessionLog.Error(errMsg)
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Not received server SETUP message"})
 		err = errors.New(errMsg)
 		return
 	}
-	log.Info(fmt.Sprintf("origin-%s - Received server SETUP %v", namespace, moqSetupServer))
+	sessionLog.WithField("moqMsg", moqSetupServer).Info("Received server SETUP")
 
 	if moqSetupServer.Role != moqhelpers.MoqRoleBoth {
-		errMsg := fmt.Sprintf("origin-%s - Error invalid session type %d", namespace, moqSetupServer.Role)
-		log.Error(errMsg)
+		errMsg := fmt.Sprintf("Error invalid session type %d", moqSetupServer.Role)
+		sessionLog.Error(errMsg)
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Invalid session type"})
 		err = errors.New(errMsg)
 		return
 	}
 
 	if moqSetupServer.Version != moqhelpers.MOQ_SUPPORTED_VERSION {
-		errMsg := fmt.Sprintf("origin-%s - Error version %d not supported, expected %d", namespace, moqSetupServer.Version, moqhelpers.MOQ_SUPPORTED_VERSION)
-		log.Error(errMsg)
+		errMsg := fmt.Sprintf("Error version %d not supported, expected %d", moqSetupServer.Version, moqhelpers.MOQ_SUPPORTED_VERSION)
+		sessionLog.Error(errMsg)
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Invalid session version"})
 		err = errors.New(errMsg)
 		return
@@ -181,21 +393,22 @@ func startClientSetup(ctx context.Context, session *webtransport.Session, namesp
 	return
 }
 
-func startServerSetup(ctx context.Context, session *webtransport.Session, namespace string) (controlStream webtransport.Stream, version moqhelpers.MoqVersion, role moqhelpers.MoqRole, err error) {
+func startServerSetup(ctx context.Context, session MoqTransportSession, endpoint MoqEndpointData, sessionLog *log.Entry) (controlStream webtransport.Stream, version moqhelpers.MoqVersion, role moqhelpers.MoqRole, err error) {
 	// Accept bidirectional streams (control stream)
 	stream, errAccept := session.AcceptStream(ctx)
-	isErr, _ := processWTError(errAccept, namespace, "Accepting bidirectional CONTROL stream")
+	isErr, _ := processWTError(errAccept, sessionLog, "Accepting bidirectional CONTROL stream")
 	if isErr {
 		err = errAccept
 		return
 	}
+	stream = quichelpers.NewBufferedStream(stream)
 
 	moqMsg, moqMsgType, moqMsgErr := moqhelpers.ReceiveMessage(stream)
 	if moqMsgErr != nil {
 		if moqMsgErr == io.EOF {
-			log.Info(fmt.Sprintf("%s - Found end of stream", namespace))
+			sessionLog.Info("Found end of stream")
 		} else {
-			log.Error(fmt.Sprintf("%s - Receiving client SETUP message. Err: %v", namespace, moqMsgErr))
+			sessionLog.WithError(moqMsgErr).Error("Receiving client SETUP message")
 			terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGeneric, ErrMsg: "Receiving SETUP message"})
 		}
 		err = moqMsgErr
@@ -204,25 +417,33 @@ func startServerSetup(ctx context.Context, session *webtransport.Session, namesp
 
 	moqSetup, moqSetUpConv := moqMsg.(moqhelpers.MoqMessageClientSetup)
 	if moqMsgType != moqhelpers.MoqIdMessageClientSetup || !moqSetUpConv {
-		errMsg := fmt.Sprintf("%s - Expecting client SETUP message. Received %d", namespace, moqMsgType)
-		log.Error(errMsg)
+		errMsg := fmt.Sprintf("Expecting client SETUP message. Received %d", moqMsgType)
+		sessionLog.Error(errMsg)
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Not received SETUP message"})
 		err = errors.New(errMsg)
 		return
 	}
-	log.Info(fmt.Sprintf("%s - Received client SETUP %v", namespace, moqSetup))
+	sessionLog.WithField("moqMsg", moqSetup).Info("Received client SETUP")
 
 	if moqSetup.Role != moqhelpers.MoqRolePublisher && moqSetup.Role != moqhelpers.MoqRoleSubscriber && moqSetup.Role != moqhelpers.MoqRoleBoth {
-		errMsg := fmt.Sprintf("%s - Error invalid session type %d", namespace, moqSetup.Role)
-		log.Error(errMsg)
+		errMsg := fmt.Sprintf("Error invalid session type %d", moqSetup.Role)
+		sessionLog.Error(errMsg)
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Invalid session type"})
 		err = errors.New(errMsg)
 		return
 	}
 
+	if !endpoint.IsRoleAllowed(moqSetup.Role) {
+		errMsg := fmt.Sprintf("Error session type %d NOT allowed in endpoint %s", moqSetup.Role, endpoint.Path)
+		sessionLog.Error(errMsg)
+		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorUnauthorized, ErrMsg: "Session type not allowed in this endpoint"})
+		err = errors.New(errMsg)
+		return
+	}
+
 	moqSetupResponse, errMoqCreateSetup := moqhelpers.CreateSetupResponse(moqSetup)
 	if errMoqCreateSetup != nil {
-		log.Error(fmt.Sprintf("%s - Processing client SETUP. Err: %v", namespace, errMoqCreateSetup))
+		sessionLog.WithError(errMoqCreateSetup).Error("Processing client SETUP")
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Processing SETUP message"})
 		err = errMoqCreateSetup
 		return
@@ -230,10 +451,10 @@ func startServerSetup(ctx context.Context, session *webtransport.Session, namesp
 
 	errMoqTxSetup := moqhelpers.SendServerSetup(stream, moqSetupResponse)
 	if errMoqTxSetup != nil {
-		log.Error(fmt.Sprintf("%s - Sending server SETUP. Err: %v", namespace, errMoqTxSetup))
+		sessionLog.WithError(errMoqTxSetup).Error("Sending server SETUP")
 		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorProtocolViolation, ErrMsg: "Sending server SETUP message"})
 	}
-	log.Info(fmt.Sprintf("%s - Sent server SETUP %v", namespace, moqSetupResponse))
+	sessionLog.WithField("moqMsg", moqSetupResponse).Info("Sent server SETUP")
 
 	role = moqSetup.Role
 	version = moqSetupResponse.Version
@@ -242,15 +463,16 @@ func startServerSetup(ctx context.Context, session *webtransport.Session, namesp
 	return
 }
 
-func terminateSessionWithError(session *webtransport.Session, errMoq moqhelpers.MoqError) {
+func terminateSessionWithError(session MoqTransportSession, errMoq moqhelpers.MoqError) {
 	session.CloseWithError(webtransport.SessionErrorCode(errMoq.ErrCode), errMoq.ErrMsg)
 }
 
-func createObjectCacheKey(trackNamespace string, trackName string, moqObjectHeader moqobject.MoqObjectHeader) string {
+// CreateObjectCacheKey Returns the key of an object in the objects cache
+func CreateObjectCacheKey(trackNamespace string, trackName string, moqObjectHeader moqobject.MoqObjectHeader) string {
 	return trackNamespace + "/" + trackName + "/" + strconv.FormatUint(moqObjectHeader.GroupSequence, 10) + "/" + strconv.FormatUint(moqObjectHeader.ObjectSequence, 10)
 }
 
-func processAnnounce(moqMsg interface{}, stream quichelpers.IWtWritableStream, moqSession *moqsession.MoqSession) (errorSessionMoq moqhelpers.MoqError) {
+func processAnnounce(moqMsg interface{}, controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable, connConfig MoqConnectionConfig) (errorSessionMoq moqhelpers.MoqError) {
 	moqAnnounceError := moqhelpers.MoqMessageAnnounceError{}
 
 	moqAnnounce, moqAnnounceConv := moqMsg.(moqhelpers.MoqMessageAnnounce)
@@ -258,26 +480,97 @@ func processAnnounce(moqMsg interface{}, stream quichelpers.IWtWritableStream, m
 		// Break session
 		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 		errorSessionMoq.ErrMsg = "Error casting ANNOUNCE"
-		log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+		sessionLog.Error(errorSessionMoq.ErrMsg)
 	} else {
-		log.Info(fmt.Sprintf("%s - Received ANNOUNCE message %v", moqSession.UniqueName, moqAnnounce))
+		sessionLog = sessionLog.WithField("namespace", moqAnnounce.TrackNamespace)
+		sessionLog.WithField("moqMsg", moqAnnounce).Info("Received ANNOUNCE message")
+		connConfig.Metrics.AnnounceReceived()
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
-		if moqSession.Role != moqhelpers.MoqRolePublisher {
+		// Relays (both) can push their namespaces
+		if moqSession.Role != moqhelpers.MoqRolePublisher && moqSession.Role != moqhelpers.MoqRoleBoth {
 			// Break session
 			errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 			errorSessionMoq.ErrMsg = "Error received ANNOUNCE from NON publisher"
-			log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+			sessionLog.Error(errorSessionMoq.ErrMsg)
 		}
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
-		errAddAnnounceTrack := moqSession.AddTrackNamespace(moqAnnounce)
-		if errAddAnnounceTrack != nil {
+		errLoop := moqtFwdTable.DetectLoop(moqAnnounce.RelayTrace)
+		if errLoop != nil {
+			// Announce error
+			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceLoopDetected, ErrMsg: "Relay loop detected"}
+			sessionLog.WithError(errLoop).Error(moqAnnounceError.ErrMsg)
+		}
+
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce && moqAnnounce.AuthToken != nil {
+			authInfo, errAuthToken := moqSession.ResolveAuthToken(*moqAnnounce.AuthToken)
+			if errAuthToken != nil {
+				// Announce error
+				moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceUnauthorized, ErrMsg: "Invalid authorization token"}
+				sessionLog.WithError(errAuthToken).Error(moqAnnounceError.ErrMsg)
+			} else {
+				moqAnnounce.AuthInfo = authInfo
+			}
+		}
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce && moqAnnounce.AuthInfo != "" {
+			moqSession.SetAuthIdentity(moqAnnounce.AuthInfo)
+		}
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce && connConfig.Endpoint.AuthRequired && moqAnnounce.AuthInfo == "" {
 			// Announce error
-			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{ErrCode: moqhelpers.ErrorAnnounceAddingTrack, ErrMsg: "Error Adding new track on ANNOUNCE"}
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, moqAnnounceError.ErrMsg, errAddAnnounceTrack))
+			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceUnauthorized, ErrMsg: "Authorization required"}
+			sessionLog.WithField("endpoint", connConfig.Endpoint.Path).Error(moqAnnounceError.ErrMsg)
+		}
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce && !connConfig.Endpoint.IsNamespaceAllowed(moqAnnounce.TrackNamespace) {
+			// Announce error
+			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceUnauthorized, ErrMsg: "Namespace not allowed in this endpoint"}
+			sessionLog.WithFields(log.Fields{"endpoint": connConfig.Endpoint.Path, "allowedNamespace": connConfig.Endpoint.TrackNamespace}).Error(moqAnnounceError.ErrMsg)
+		}
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce && !isClientCertNamespaceAllowed(connConfig.ClientCertNamespaces, moqAnnounce.TrackNamespace) {
+			// Announce error
+			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceUnauthorized, ErrMsg: "Namespace not allowed for this client certificate"}
+			sessionLog.WithFields(log.Fields{"clientCertIdentity": moqSession.Metadata.ClientCertIdentity, "allowedNamespaces": connConfig.ClientCertNamespaces}).Error(moqAnnounceError.ErrMsg)
+		}
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce && connConfig.Authorizer != nil {
+			errAuthorize := connConfig.Authorizer.AuthorizeAnnounce(moqauth.MoqAuthRequest{Action: moqauth.MoqAuthActionAnnounce, TrackNamespace: moqAnnounce.TrackNamespace, AuthInfo: moqAnnounce.AuthInfo, SessionName: moqSession.UniqueName, Role: moqSession.Role, Metadata: moqSession.Metadata})
+			if errAuthorize != nil {
+				// Announce error
+				moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceUnauthorized, ErrMsg: "Unauthorized"}
+				sessionLog.WithError(errAuthorize).Error("ANNOUNCE NOT authorized")
+			}
+		}
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce {
+			errHook := connConfig.Hooks.OnAnnounce(moqSession, moqAnnounce)
+			if errHook != nil {
+				// Announce error
+				moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceUnauthorized, ErrMsg: errHook.Error()}
+				sessionLog.WithError(errHook).Error("ANNOUNCE rejected by hook")
+			}
+		}
+
+		reannounced := moqSession.HasTrackNamespace(moqAnnounce.TrackNamespace)
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce {
+			errAnnouncePolicy := moqtFwdTable.AddAnnouncePublisher(moqAnnounce.TrackNamespace, moqSession.UniqueName)
+			if errAnnouncePolicy != nil {
+				// Announce error
+				moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceDuplicated, ErrMsg: "Namespace already announced"}
+				sessionLog.WithError(errAnnouncePolicy).Error(moqAnnounceError.ErrMsg)
+			}
+		}
+
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce {
+			errAddAnnounceTrack := moqSession.AddTrackNamespace(moqAnnounce)
+			if errAddAnnounceTrack != nil {
+				// Announce error
+				moqAnnounceError = moqhelpers.MoqMessageAnnounceError{ErrCode: moqhelpers.ErrorAnnounceAddingTrack, ErrMsg: "Error Adding new track on ANNOUNCE"}
+				sessionLog.WithError(errAddAnnounceTrack).Error(moqAnnounceError.ErrMsg)
+				if !reannounced {
+					// Rollback, the session can NOT be the publisher (or block other publishers) of a namespace it does NOT have
+					moqtFwdTable.RemoveAnnouncePublisher(moqAnnounce.TrackNamespace, moqSession.UniqueName)
+				}
+			}
 		}
 
 		if errorSessionMoq.ErrCode == moqhelpers.NoError {
@@ -285,25 +578,32 @@ func processAnnounce(moqMsg interface{}, stream quichelpers.IWtWritableStream, m
 			if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce {
 				// Send announce OK
 				moqAnnounceOk := moqhelpers.CreateAnnounceOK(moqAnnounce)
-				errMoqTxAnnounceOk := moqhelpers.SendAnnounceOK(stream, moqAnnounceOk)
+				errMoqTxAnnounceOk := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+					return moqhelpers.SendAnnounceOK(stream, connConfig.Endpoint.MapMessage(moqAnnounceOk, false).(moqhelpers.MoqMessageAnnounceOk))
+				})
 				if errMoqTxAnnounceOk != nil {
 					// Break session
 					errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
 					errorSessionMoq.ErrMsg = "Error sending ANNOUNCE OK"
-					log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errMoqTxAnnounceOk))
+					sessionLog.WithError(errMoqTxAnnounceOk).Error(errorSessionMoq.ErrMsg)
 				} else {
-					log.Info(fmt.Sprintf("%s - Sent ANNOUNCE OK message %v", moqSession.UniqueName, moqAnnounceOk))
+					sessionLog.WithField("moqMsg", moqAnnounceOk).Info("Sent ANNOUNCE OK message")
+					connConfig.Events.Announce(moqSession.UniqueName, moqAnnounceError, moqAnnounce.TrackNamespace)
 				}
 			} else {
 				// Send announce Error
-				errMoqTxAnnounceError := moqhelpers.SendAnnounceError(stream, moqAnnounceError)
+				errMoqTxAnnounceError := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+					return moqhelpers.SendAnnounceError(stream, connConfig.Endpoint.MapMessage(moqAnnounceError, false).(moqhelpers.MoqMessageAnnounceError))
+				})
 				if errMoqTxAnnounceError != nil {
 					// Break session
 					errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
 					errorSessionMoq.ErrMsg = "Error sending ANNOUNCE error"
-					log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errMoqTxAnnounceError))
+					sessionLog.WithError(errMoqTxAnnounceError).Error(errorSessionMoq.ErrMsg)
 				} else {
-					log.Info(fmt.Sprintf("%s - Sent ANNOUNCE error message %v", moqSession.UniqueName, moqAnnounceError))
+					sessionLog.WithField("moqMsg", moqAnnounceError).Info("Sent ANNOUNCE error message")
+					connConfig.Metrics.AnnounceRejected(moqAnnounceError.ErrCode)
+					connConfig.Events.Announce(moqSession.UniqueName, moqAnnounceError, moqAnnounce.TrackNamespace)
 				}
 			}
 		}
@@ -312,29 +612,104 @@ func processAnnounce(moqMsg interface{}, stream quichelpers.IWtWritableStream, m
 	return
 }
 
-func processAnnounceOk(moqMsg interface{}, stream quichelpers.IWtWritableStream, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
+func processAnnounceOk(moqMsg interface{}, controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
 	moqAnnounceOk, moqAnnounceConv := moqMsg.(moqhelpers.MoqMessageAnnounceOk)
 	if !moqAnnounceConv {
 		// Break session
 		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 		errorSessionMoq.ErrMsg = "Error casting ANNOUNCE OK"
-		log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+		sessionLog.Error(errorSessionMoq.ErrMsg)
 	} else {
-		log.Info(fmt.Sprintf("%s - Received ANNOUNCE OK message %v", moqSession.UniqueName, moqAnnounceOk))
+		sessionLog = sessionLog.WithField("namespace", moqAnnounceOk.TrackNamespace)
+		sessionLog.WithField("moqMsg", moqAnnounceOk).Info("Received ANNOUNCE OK message")
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
-		if moqSession.Role != moqhelpers.MoqRolePublisher {
+		// Relays (both) answer the namespaces we push to them
+		if moqSession.Role != moqhelpers.MoqRolePublisher && moqSession.Role != moqhelpers.MoqRoleBoth {
 			// Break session
 			errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 			errorSessionMoq.ErrMsg = "Error received ANNOUNCE OK from NON publisher"
-			log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+			sessionLog.Error(errorSessionMoq.ErrMsg)
 		}
 	}
 	return
 }
 
-func processSubscribe(moqMsg interface{}, stream quichelpers.IWtWritableStream, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
+func processUnAnnounce(moqMsg interface{}, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig MoqConnectionConfig) (errorSessionMoq moqhelpers.MoqError) {
+	moqUnAnnounce, moqUnAnnounceConv := moqMsg.(moqhelpers.MoqMessageUnAnnounce)
+	if !moqUnAnnounceConv {
+		// Break session
+		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
+		errorSessionMoq.ErrMsg = "Error casting UNANNOUNCE"
+		sessionLog.Error(errorSessionMoq.ErrMsg)
+	} else {
+		sessionLog = sessionLog.WithField("namespace", moqUnAnnounce.TrackNamespace)
+		sessionLog.WithField("moqMsg", moqUnAnnounce).Info("Received UNANNOUNCE message")
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError {
+		if moqSession.Role != moqhelpers.MoqRolePublisher && moqSession.Role != moqhelpers.MoqRoleBoth {
+			// Break session
+			errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
+			errorSessionMoq.ErrMsg = "Error received UNANNOUNCE from NON publisher"
+			sessionLog.Error(errorSessionMoq.ErrMsg)
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError {
+		// Retires the namespace and all its track aliases
+		errRemoveNamespace := moqSession.RemoveTrackNamespace(moqUnAnnounce.TrackNamespace)
+		if errRemoveNamespace != nil {
+			sessionLog.WithError(errRemoveNamespace).Error("Removing namespace on UNANNOUNCE")
+		} else {
+			moqtFwdTable.TrackNamespaceRemoved(moqUnAnnounce.TrackNamespace, moqSession.UniqueName)
+			if connConfig.PurgeCacheOnUnAnnounce {
+				purged := objects.PurgeNamespace(moqUnAnnounce.TrackNamespace)
+				sessionLog.WithField("deletedObjects", purged).Info("Purged cache on UNANNOUNCE")
+			}
+		}
+	}
+	return
+}
+
+func processUnSubscribe(moqMsg interface{}, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
+	moqUnSubscribe, moqUnSubscribeConv := moqMsg.(moqhelpers.MoqMessageUnSubscribe)
+	if !moqUnSubscribeConv {
+		// Break session
+		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
+		errorSessionMoq.ErrMsg = "Error casting UNSUBSCRIBE"
+		sessionLog.Error(errorSessionMoq.ErrMsg)
+	} else {
+		sessionLog = sessionLog.WithFields(log.Fields{"namespace": moqUnSubscribe.TrackNamespace, "track": moqUnSubscribe.TrackName})
+		sessionLog.WithField("moqMsg", moqUnSubscribe).Info("Received UNSUBSCRIBE message")
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError {
+		if moqSession.Role != moqhelpers.MoqRoleSubscriber && moqSession.Role != moqhelpers.MoqRoleBoth {
+			// Break session
+			errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
+			errorSessionMoq.ErrMsg = "Error received UNSUBSCRIBE from NON subscriber"
+			sessionLog.Error(errorSessionMoq.ErrMsg)
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError {
+		isWildcard, prefix := moqfwdtable.GetWildcardPrefix(moqUnSubscribe.TrackNamespace)
+		if isWildcard {
+			moqtFwdTable.RemoveWildcardSubscriber(prefix, moqSession.UniqueName)
+			return
+		}
+		moqtFwdTable.RemoveTrackSubscriber(moqUnSubscribe.TrackNamespace, moqUnSubscribe.TrackName, moqSession.UniqueName)
+		errRemoveSubscribe := moqSession.RemoveSubscribeRequest(moqUnSubscribe.TrackNamespace, moqUnSubscribe.TrackName)
+		if errRemoveSubscribe != nil {
+			sessionLog.WithError(errRemoveSubscribe).Error("Removing subscription on UNSUBSCRIBE")
+		}
+	}
+	return
+}
+
+func processSubscribe(moqMsg interface{}, controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig MoqConnectionConfig) (errorSessionMoq moqhelpers.MoqError) {
 	moqSubscribeError := moqhelpers.MoqMessageSubscribeError{}
 
 	moqSubscribe, moqSubscribeConv := moqMsg.(moqhelpers.MoqMessageSubscribe)
@@ -342,10 +717,12 @@ func processSubscribe(moqMsg interface{}, stream quichelpers.IWtWritableStream,
 		// Break session
 		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 		errorSessionMoq.ErrMsg = "Error casting SUBSCRIBE"
-		log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+		sessionLog.Error(errorSessionMoq.ErrMsg)
 
 	} else {
-		log.Info(fmt.Sprintf("%s - Received SUBSCRIBE message %v", moqSession.UniqueName, moqSubscribe))
+		sessionLog = sessionLog.WithFields(log.Fields{"namespace": moqSubscribe.TrackNamespace, "track": moqSubscribe.TrackName})
+		sessionLog.WithField("moqMsg", moqSubscribe).Info("Received SUBSCRIBE message")
+		connConfig.Metrics.SubscribeReceived()
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
@@ -353,15 +730,105 @@ func processSubscribe(moqMsg interface{}, stream quichelpers.IWtWritableStream,
 			// Break session
 			errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 			errorSessionMoq.ErrMsg = "Error received SUBSCRIBE from NON subscriber"
-			log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+			sessionLog.Error(errorSessionMoq.ErrMsg)
 		}
 	}
 
-	if errorSessionMoq.ErrCode == moqhelpers.NoError {
-		errAddingSubscribeReq := moqSession.AddSubscribeRequest(moqSubscribe)
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && connConfig.SubscribeRateLimiter != nil {
+		ip := moqadmission.GetIp(moqSession.Metadata.RemoteAddr)
+		if !connConfig.SubscribeRateLimiter.Allow(ip) {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeRateLimited, ErrMsg: "Too many SUBSCRIBE messages"}
+			sessionLog.WithField("ip", ip).Warning(moqSubscribeError.ErrMsg)
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
+		errLoop := moqtFwdTable.DetectLoop(moqSubscribe.RelayTrace)
+		if errLoop != nil {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeLoopDetected, ErrMsg: "Relay loop detected"}
+			sessionLog.WithError(errLoop).Error(moqSubscribeError.ErrMsg)
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && moqSubscribe.AuthToken != nil {
+		authInfo, errAuthToken := moqSession.ResolveAuthToken(*moqSubscribe.AuthToken)
+		if errAuthToken != nil {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeUnauthorized, ErrMsg: "Invalid authorization token"}
+			sessionLog.WithError(errAuthToken).Error(moqSubscribeError.ErrMsg)
+		} else {
+			// Forwarded upstream as plain auth info (aliases are per session)
+			moqSubscribe.AuthInfo = authInfo
+			moqSubscribe.AuthToken = nil
+		}
+	}
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && moqSubscribe.AuthInfo != "" {
+		moqSession.SetAuthIdentity(moqSubscribe.AuthInfo)
+	}
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && connConfig.Endpoint.AuthRequired && moqSubscribe.AuthInfo == "" {
+		moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeUnauthorized, ErrMsg: "Authorization required"}
+		sessionLog.WithField("endpoint", connConfig.Endpoint.Path).Error(moqSubscribeError.ErrMsg)
+	}
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && !connConfig.Endpoint.IsNamespaceAllowed(moqSubscribe.TrackNamespace) {
+		moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeUnauthorized, ErrMsg: "Namespace not allowed in this endpoint"}
+		sessionLog.WithFields(log.Fields{"endpoint": connConfig.Endpoint.Path, "allowedNamespace": connConfig.Endpoint.TrackNamespace}).Error(moqSubscribeError.ErrMsg)
+	}
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && !isClientCertNamespaceAllowed(connConfig.ClientCertNamespaces, moqSubscribe.TrackNamespace) {
+		moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeUnauthorized, ErrMsg: "Namespace not allowed for this client certificate"}
+		sessionLog.WithFields(log.Fields{"clientCertIdentity": moqSession.Metadata.ClientCertIdentity, "allowedNamespaces": connConfig.ClientCertNamespaces}).Error(moqSubscribeError.ErrMsg)
+	}
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && connConfig.Authorizer != nil {
+		errAuthorize := connConfig.Authorizer.AuthorizeSubscribe(moqauth.MoqAuthRequest{Action: moqauth.MoqAuthActionSubscribe, TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, AuthInfo: moqSubscribe.AuthInfo, SessionName: moqSession.UniqueName, Role: moqSession.Role, Metadata: moqSession.Metadata})
+		if errAuthorize != nil {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeUnauthorized, ErrMsg: "Unauthorized"}
+			sessionLog.WithError(errAuthorize).Error("SUBSCRIBE NOT authorized")
+		}
+	}
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
+		errHook := connConfig.Hooks.OnSubscribe(moqSession, moqSubscribe)
+		if errHook != nil {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeUnauthorized, ErrMsg: errHook.Error()}
+			sessionLog.WithError(errHook).Error("SUBSCRIBE rejected by hook")
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
+		isWildcard, prefix := moqfwdtable.GetWildcardPrefix(moqSubscribe.TrackNamespace)
+		if isWildcard {
+			// SUBSCRIBE OK will be sent per matched track
+			sessionLog.WithField("prefix", prefix).Info("Added wildcard subscription")
+			moqtFwdTable.AddWildcardSubscriber(prefix, moqSession)
+			connConfig.Events.Subscribe(moqSession.UniqueName, moqSubscribeError, moqSubscribe.TrackNamespace, moqSubscribe.TrackName)
+			return
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
+		duplicated, validated, localTrackId, errAddingSubscribeReq := moqSession.AddSubscribeRequest(moqSubscribe, connConfig.DuplicateSubscribePolicy)
 		if errAddingSubscribeReq != nil {
-			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeAddingTrack, ErrMsg: "Error Adding new subscription on SUBSCRIBE"}
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, moqSubscribeError.ErrMsg, errAddingSubscribeReq))
+			if duplicated {
+				moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeDuplicated, ErrMsg: "Track already subscribed"}
+			} else {
+				moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeAddingTrack, ErrMsg: "Error Adding new subscription on SUBSCRIBE"}
+			}
+			sessionLog.WithError(errAddingSubscribeReq).Error(moqSubscribeError.ErrMsg)
+		} else if duplicated {
+			// Update, upstream subscription is already in place
+			sessionLog.WithField("validated", validated).Info("Updated subscription")
+			if validated {
+				moqSubscribeOk := moqhelpers.MoqMessageSubscribeOk{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, TrackId: localTrackId, Expires: moqSession.GetSubscriptionExpires(moqSubscribe.TrackNamespace, moqSubscribe.TrackName)}
+				errMoqTxSubscribeOk := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+					return moqhelpers.SendSubscribeOk(stream, connConfig.Endpoint.MapMessage(moqSubscribeOk, false).(moqhelpers.MoqMessageSubscribeOk))
+				})
+				if errMoqTxSubscribeOk != nil {
+					// Break session
+					errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
+					errorSessionMoq.ErrMsg = "Error sending SUBSCRIBE OK for updated subscription"
+					sessionLog.WithError(errMoqTxSubscribeOk).Error(errorSessionMoq.ErrMsg)
+				}
+			}
+			return
+		} else {
+			moqtFwdTable.AddTrackSubscriber(moqSubscribe.TrackNamespace, moqSubscribe.TrackName, moqSession)
 		}
 	}
 
@@ -369,37 +836,77 @@ func processSubscribe(moqMsg interface{}, stream quichelpers.IWtWritableStream,
 		// Session NOT broken
 		if moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
 			// Forward every subscribe to publishers of that stream
-			errForwardSubscribe := moqtFwdTable.ForwardSubscribe(moqSubscribe)
+			errForwardSubscribe := moqtFwdTable.ForwardSubscribe(moqSubscribe, moqSession.UniqueName)
 			if errForwardSubscribe != nil {
 				moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: errForwardSubscribe.Error()}
+				// Rejected, the client can subscribe again to the same track
+				moqSession.RemoveSubscribeRequest(moqSubscribe.TrackNamespace, moqSubscribe.TrackName)
+				moqtFwdTable.RemoveTrackSubscriber(moqSubscribe.TrackNamespace, moqSubscribe.TrackName, moqSession.UniqueName)
+			} else {
+				// If we already have this track in cache answer directly (if NOT answered already by the upstream subscription)
+				errorSessionMoq = answerSubscribeFromCache(moqSubscribe, controlWriter, moqSession, sessionLog, objects, connConfig.Endpoint)
 			}
 		}
 
 		// Send subscribe error if needed
 		if moqSubscribeError.ErrCode != moqhelpers.NoErrorSubscribe {
-			errMoqTxSubscribeError := moqhelpers.SendSubscribeError(stream, moqSubscribeError)
+			errMoqTxSubscribeError := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+				return moqhelpers.SendSubscribeError(stream, connConfig.Endpoint.MapMessage(moqSubscribeError, false).(moqhelpers.MoqMessageSubscribeError))
+			})
 			if errMoqTxSubscribeError != nil {
 				// Break session
 				errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
 				errorSessionMoq.ErrMsg = "Error sending SUBSCRIBE error"
-				log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errMoqTxSubscribeError))
+				sessionLog.WithError(errMoqTxSubscribeError).Error(errorSessionMoq.ErrMsg)
 			} else {
-				log.Info(fmt.Sprintf("%s - Sent SUBSCRIBE error message %v", moqSession.UniqueName, moqSubscribeError))
+				sessionLog.WithField("moqMsg", moqSubscribeError).Info("Sent SUBSCRIBE error message")
+				connConfig.Metrics.SubscribeRejected(moqSubscribeError.ErrCode)
 			}
 		}
+		connConfig.Events.Subscribe(moqSession.UniqueName, moqSubscribeError, moqSubscribe.TrackNamespace, moqSubscribe.TrackName)
 	}
 	return
 }
 
-func processSubscribeOk(moqMsg interface{}, stream quichelpers.IWtWritableStream, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
+// answerSubscribeFromCache Sends SUBSCRIBE_OK without waiting for the upstream answer if the track is in the cache (already forwarded upstream, if it fails the subscription is reset).
+// Expires is unknown until the upstream answer (0), and draft-01 SUBSCRIBE_OK can NOT carry the largest group / object
+func answerSubscribeFromCache(moqSubscribe moqhelpers.MoqMessageSubscribe, controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, objects *moqmessageobjects.MoqMessageObjects, endpoint MoqEndpointData) (errorSessionMoq moqhelpers.MoqError) {
+	found, trackId, _, _ := objects.GetTrackLargest(moqSubscribe.TrackNamespace, moqSubscribe.TrackName)
+	if !found {
+		return
+	}
+
+	moqSubscribeOk := moqhelpers.MoqMessageSubscribeOk{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, TrackId: trackId, Expires: 0}
+	updated, localTrackId := moqSession.HasPendingTrackSubscriptionUpdate(moqSubscribeOk.TrackNamespace, moqSubscribeOk.TrackName, moqSubscribeOk.TrackId, moqSubscribeOk.Expires)
+	if !updated {
+		return
+	}
+	moqSubscribeOk.TrackId = localTrackId
+
+	errMoqTxSubscribeOk := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+		return moqhelpers.SendSubscribeOk(stream, endpoint.MapMessage(moqSubscribeOk, false).(moqhelpers.MoqMessageSubscribeOk))
+	})
+	if errMoqTxSubscribeOk != nil {
+		// Break session
+		errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
+		errorSessionMoq.ErrMsg = "Error sending SUBSCRIBE OK from cache"
+		sessionLog.WithError(errMoqTxSubscribeOk).Error(errorSessionMoq.ErrMsg)
+	} else {
+		sessionLog.WithField("moqMsg", moqSubscribeOk).Info("Sent SUBSCRIBE OK from cache message")
+	}
+	return
+}
+
+func processSubscribeOk(moqMsg interface{}, controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
 	moqSubscribeOk, moqSubscribeConv := moqMsg.(moqhelpers.MoqMessageSubscribeOk)
 	if !moqSubscribeConv {
 		// Break session
 		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 		errorSessionMoq.ErrMsg = "Error casting SUBSCRIBE OK"
-		log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+		sessionLog.Error(errorSessionMoq.ErrMsg)
 	} else {
-		log.Info(fmt.Sprintf("%s - Received SUBSCRIBE OK message %v", moqSession.UniqueName, moqSubscribeOk))
+		sessionLog = sessionLog.WithFields(log.Fields{"namespace": moqSubscribeOk.TrackNamespace, "track": moqSubscribeOk.TrackName})
+		sessionLog.WithField("moqMsg", moqSubscribeOk).Info("Received SUBSCRIBE OK message")
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
@@ -407,18 +914,16 @@ func processSubscribeOk(moqMsg interface{}, stream quichelpers.IWtWritableStream
 			// Break session
 			errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 			errorSessionMoq.ErrMsg = "Error received SUBSCRIBE OK from NON publisher"
-			log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+			sessionLog.Error(errorSessionMoq.ErrMsg)
 		}
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
-		// Forward and subscription
-		errForwardSubscribe := moqtFwdTable.ForwardSubscribeOk(moqSubscribeOk)
+		// Forward to the subscriber that requested it
+		errForwardSubscribe := moqtFwdTable.ForwardSubscribeOk(moqSubscribeOk, moqSession.UniqueName)
 		if errForwardSubscribe != nil {
-			// Break session
-			errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
-			errorSessionMoq.ErrMsg = errForwardSubscribe.Error()
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errForwardSubscribe))
+			// Subscriber can be gone, publisher session is still valid
+			sessionLog.WithError(errForwardSubscribe).Error("Forwarding SUBSCRIBE OK")
 		}
 	}
 
@@ -429,23 +934,26 @@ func processSubscribeOk(moqMsg interface{}, stream quichelpers.IWtWritableStream
 			// Break session
 			errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
 			errorSessionMoq.ErrMsg = errAddingTrackInfo.Error()
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errAddingTrackInfo))
+			sessionLog.WithError(errAddingTrackInfo).Error(errorSessionMoq.ErrMsg)
+		} else {
+			moqtFwdTable.TrackAdded(moqSubscribeOk.TrackNamespace, moqSubscribeOk.TrackName)
 		}
 	}
 
 	return
 }
 
-func processSubscribeError(moqMsg interface{}, stream quichelpers.IWtWritableStream, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
+func processSubscribeError(moqMsg interface{}, controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
 	moqSubscribeError, moqSubscribeConv := moqMsg.(moqhelpers.MoqMessageSubscribeError)
 	if !moqSubscribeConv {
 		// Break session
 		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 		errorSessionMoq.ErrMsg = "Error casting SUBSCRIBE Error"
-		log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+		sessionLog.Error(errorSessionMoq.ErrMsg)
 
 	} else {
-		log.Info(fmt.Sprintf("%s - Received SUBSCRIBE Error message %v", moqSession.UniqueName, moqSubscribeError))
+		sessionLog = sessionLog.WithFields(log.Fields{"namespace": moqSubscribeError.TrackNamespace, "track": moqSubscribeError.TrackName})
+		sessionLog.WithField("moqMsg", moqSubscribeError).Info("Received SUBSCRIBE Error message")
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
@@ -453,17 +961,15 @@ func processSubscribeError(moqMsg interface{}, stream quichelpers.IWtWritableStr
 			// Break session
 			errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
 			errorSessionMoq.ErrMsg = "Error received SUBSCRIBE Error from NON publisher"
-			log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+			sessionLog.Error(errorSessionMoq.ErrMsg)
 		}
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
-		errForwardSubscribe := moqtFwdTable.ForwardSubscribeError(moqSubscribeError)
+		errForwardSubscribe := moqtFwdTable.ForwardSubscribeError(moqSubscribeError, moqSession.UniqueName)
 		if errForwardSubscribe != nil {
-			// Break session
-			errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
-			errorSessionMoq.ErrMsg = errForwardSubscribe.Error()
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errForwardSubscribe))
+			// Subscriber can be gone, publisher session is still valid
+			sessionLog.WithError(errForwardSubscribe).Error("Forwarding SUBSCRIBE error")
 		}
 	}
 	return
@@ -471,30 +977,42 @@ func processSubscribeError(moqMsg interface{}, stream quichelpers.IWtWritableStr
 
 // Thread for publisher (forward subscribes)
 
-func startForwardSubscribes(stream quichelpers.IWtWritableStream, moqSession *moqsession.MoqSession) {
+func startForwardSubscribes(controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, endpoint MoqEndpointData) {
 	bExit := false
 	for bExit == false {
 		// Get next object cache key
-		fwdSubscribe, stop := moqSession.GetNewSubscribe()
+		fwdSubscribe, unSubscribe, stop := moqSession.GetNewSubscribe()
 		if stop {
 			bExit = true
+		} else if unSubscribe {
+			moqUnSubscribe := moqhelpers.MoqMessageUnSubscribe{TrackNamespace: fwdSubscribe.TrackNamespace, TrackName: fwdSubscribe.TrackName}
+			errSendUnSubscribe := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+				return moqhelpers.SendUnSubscribe(stream, endpoint.MapMessage(moqUnSubscribe, false).(moqhelpers.MoqMessageUnSubscribe))
+			})
+			if errSendUnSubscribe != nil {
+				sessionLog.WithError(errSendUnSubscribe).Error("Forwarding UNSUBSCRIBE")
+			} else {
+				sessionLog.WithField("moqMsg", moqUnSubscribe).Info("Forwarded UNSUBSCRIBE message")
+			}
 		} else {
-			// TODO we need to add mutex here
-			errSendSubscribe := moqhelpers.SendSubscribe(stream, fwdSubscribe)
+			errSendSubscribe := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+				return moqhelpers.SendSubscribe(stream, endpoint.MapMessage(fwdSubscribe, false).(moqhelpers.MoqMessageSubscribe))
+			})
 			if errSendSubscribe != nil {
-				log.Error(fmt.Sprintf("%s - Forwarding SUBSCRIBE. Err: %v", moqSession.UniqueName, errSendSubscribe))
+				sessionLog.WithError(errSendSubscribe).Error("Forwarding SUBSCRIBE")
 			} else {
-				log.Info(fmt.Sprintf("%s - Forwarded SUBSCRIBE message %v", moqSession.UniqueName, fwdSubscribe))
+				sessionLog.WithField("moqMsg", fwdSubscribe).Info("Forwarded SUBSCRIBE message")
+				moqSession.AddForwardedSubscribe()
 			}
 		}
 	}
 
-	log.Info(fmt.Sprintf("%s(-) - Exit Forwarding subscribes thread", moqSession.UniqueName))
+	sessionLog.Info("Exit Forwarding subscribes thread")
 }
 
 // Thread for subscribers (forward subscribes responses)
 
-func startForwardSubscribeResponses(stream quichelpers.IWtWritableStream, moqSession *moqsession.MoqSession) {
+func startForwardSubscribeResponses(controlWriter *moqcontrolwriter.MoqControlWriter, moqSession *moqsession.MoqSession, sessionLog *log.Entry, endpoint MoqEndpointData) {
 	bExit := false
 	for bExit == false {
 		// Get next object cache key
@@ -502,134 +1020,600 @@ func startForwardSubscribeResponses(stream quichelpers.IWtWritableStream, moqSes
 		if stop {
 			bExit = true
 		} else {
-			// TODO we need to add mutex here
+			subscribeResp = endpoint.MapMessage(subscribeResp, false)
 			var errSendSubscribe error
 			if subscribeRespType == moqhelpers.MoqIdSubscribeOk {
-				errSendSubscribe = moqhelpers.SendSubscribeOk(stream, subscribeResp.(moqhelpers.MoqMessageSubscribeOk))
+				errSendSubscribe = controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+					return moqhelpers.SendSubscribeOk(stream, subscribeResp.(moqhelpers.MoqMessageSubscribeOk))
+				})
 			} else if subscribeRespType == moqhelpers.MoqIdSubscribeError {
-				errSendSubscribe = moqhelpers.SendSubscribeError(stream, subscribeResp.(moqhelpers.MoqMessageSubscribeError))
+				errSendSubscribe = controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+					return moqhelpers.SendSubscribeError(stream, subscribeResp.(moqhelpers.MoqMessageSubscribeError))
+				})
+			} else if subscribeRespType == moqhelpers.MoqIdSubscribeRst {
+				errSendSubscribe = controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+					return moqhelpers.SendSubscribeRst(stream, subscribeResp.(moqhelpers.MoqMessageSubscribeRst))
+				})
 			} else {
 				errSendSubscribe = errors.New(fmt.Sprintf("We can NOT forward this message type %d as subscribe response", subscribeRespType))
 			}
 			if errSendSubscribe != nil {
-				log.Error(fmt.Sprintf("%s - Forwarding SUBSCRIBE response. Err: %v", moqSession.UniqueName, errSendSubscribe))
+				sessionLog.WithError(errSendSubscribe).Error("Forwarding SUBSCRIBE response")
 			} else {
-				log.Info(fmt.Sprintf("%s - Forwarded SUBSCRIBE response message %v", moqSession.UniqueName, subscribeResp))
+				sessionLog.WithField("moqMsg", subscribeResp).Info("Forwarded SUBSCRIBE response message")
 			}
 		}
 	}
 
-	log.Info(fmt.Sprintf("%s(-) - Exit Forwarding subscribes thread", moqSession.UniqueName))
+	sessionLog.Info("Exit Forwarding subscribes thread")
 }
 
 // Thread for publisher (receive objects)
 
-func startListeningObjects(session *webtransport.Session, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) {
+func startListeningObjects(session MoqTransportSession, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig MoqConnectionConfig) {
 	for {
 		uniStream, errAccUni := session.AcceptUniStream(session.Context())
-		isErr, _ := processWTError(errAccUni, moqSession.UniqueName, "Session closed, not accepting more uni streams")
+		isErr, _ := processWTError(errAccUni, sessionLog, "Session closed, not accepting more uni streams")
 		if isErr {
 			break
 		}
-		log.Info(fmt.Sprintf("%s(%v) - Accepting incoming uni stream", moqSession.UniqueName, uniStream.StreamID()))
-
-		go func(uniStream *webtransport.ReceiveStream, session *webtransport.Session, moqtFwdTable *moqfwdtable.MoqFwdTable) {
-			moqMsg, moqMsgType, moqMsgErr := moqhelpers.ReceiveMessage(*uniStream)
-			if moqMsgErr != nil {
-				if moqMsgErr == io.EOF {
-					log.Info(fmt.Sprintf("%s - Found end of stream", moqSession.UniqueName))
-				} else {
-					log.Error(fmt.Sprintf("%s - Receiving OBJECT message. Err: %v", moqSession.UniqueName, moqMsgErr))
-				}
-				return
+		sessionLog.WithField("streamID", uniStream.StreamID()).Debug("Accepting incoming uni stream")
+		uniStream = quichelpers.NewBufferedReceiveStream(uniStream)
+		moqSession.Touch()
+		moqSession.GetTransportStats().StreamOpened(true)
+
+		receiveObject := func(uniStream *webtransport.ReceiveStream, session MoqTransportSession, moqtFwdTable *moqfwdtable.MoqFwdTable) {
+			defer moqSession.GetTransportStats().StreamClosed()
+
+			streamLog := sessionLog.WithField("streamID", (*uniStream).StreamID())
+			// Objects with length (batched streams) can be followed by more objects, the others use the stream until its end
+			for next := true; next; {
+				next = receiveStreamObject(*uniStream, moqSession, streamLog, moqtFwdTable, objects, connConfig)
 			}
+		}
+		if !connConfig.IngestPool.Submit(func() { receiveObject(&uniStream, session, moqtFwdTable) }) {
+			sessionLog.WithField("streamID", uniStream.StreamID()).Warning("Rejected incoming uni stream, ingest workers queue full")
+			uniStream.CancelRead(webtransport.StreamErrorCode(moqhelpers.ErrorGeneric))
+			moqSession.GetTransportStats().StreamClosed()
+		}
+	}
+	sessionLog.Info("Exit ListeningObjects thread")
 
-			// TODO: Assuming object per QUIC stream
-
-			moqObjHeader, moqObjHeaderConv := moqMsg.(moqobject.MoqObjectHeader)
-			if moqMsgType != moqhelpers.MoqIdMessageObject || !moqObjHeaderConv {
-				log.Error(fmt.Sprintf("%s - Expecting OBJECT message. Received %d", moqSession.UniqueName, moqMsgType))
-				return
-			}
+	return
+}
 
-			// Validate object
-			foundTrack, trackNamespace, trackName := moqSession.GetTrackInfo(moqObjHeader.TrackId)
-			if !foundTrack {
-				log.Error(fmt.Sprintf("%s - TrackId %d, is NOT in this publishing session", moqSession.UniqueName, moqObjHeader.TrackId))
-				return
-			}
+// receiveStreamObject Receives the next object of the stream, next is true if more objects can follow it (objects with length)
+func receiveStreamObject(uniStream webtransport.ReceiveStream, moqSession *moqsession.MoqSession, streamLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig MoqConnectionConfig) (next bool) {
+	moqMsg, moqMsgType, moqMsgErr := moqhelpers.ReceiveMessage(uniStream)
+	if moqMsgErr != nil {
+		if moqMsgErr == io.EOF {
+			streamLog.Debug("Found end of stream")
+		} else {
+			streamLog.WithError(moqMsgErr).Error("Receiving OBJECT message")
+		}
+		return
+	}
 
-			// Create cache key
-			cacheKey := createObjectCacheKey(trackNamespace, trackName, moqObjHeader)
-			moqObj, errAddingMoqObj := objects.Create(cacheKey, moqObjHeader, objExpMs/1000)
-			if errAddingMoqObj != nil {
-				log.Error(fmt.Sprintf("%s(%v) - Received obj error, key: %s, Obj header: %s. Err: %v", moqSession.UniqueName, (*uniStream).StreamID(), cacheKey, moqObjHeader.GetDebugStr(), errAddingMoqObj))
-			} else {
-				log.Info(fmt.Sprintf("%s(%v) - Received obj header, key: %s, Obj: %s", moqSession.UniqueName, (*uniStream).StreamID(), cacheKey, moqObjHeader.GetDebugStr()))
-			}
+	// Object without length uses the rest of the stream
+	var moqObjHeader moqobject.MoqObjectHeader
+	var payloadStream quichelpers.IWtReadableStream = uniStream
+	var payloadReader *quichelpers.LimitedReader = nil
+	if moqObjWithLength, isObjWithLength := moqMsg.(moqhelpers.MoqMessageObjectWithLength); isObjWithLength {
+		moqObjHeader = moqObjWithLength.MoqObjectHeader
+		payloadReader = quichelpers.NewLimitedReader(uniStream, moqObjWithLength.PayloadLength)
+		payloadStream = payloadReader
+		// Next object after reading the whole payload
+		defer func() {
+			next = payloadReader.GetRemaining() == 0
+		}()
+	} else if moqObjHeaderMsg, isObjHeader := moqMsg.(moqobject.MoqObjectHeader); isObjHeader && moqMsgType == moqhelpers.MoqIdMessageObject {
+		moqObjHeader = moqObjHeaderMsg
+	} else {
+		streamLog.WithField("msgType", moqMsgType).Error("Expecting OBJECT message")
+		return
+	}
 
-			// Notify new cache key
-			moqtFwdTable.ReceivedObject(cacheKey)
+	// Validate object
+	foundTrack, trackNamespace, trackName := moqSession.GetTrackInfo(moqObjHeader.TrackId)
+	if !foundTrack {
+		streamLog.WithField("trackId", moqObjHeader.TrackId).Error("TrackId is NOT in this publishing session")
+		if payloadReader != nil {
+			io.Copy(io.Discard, payloadReader)
+		}
+		return
+	}
+	streamLog = streamLog.WithFields(log.Fields{"namespace": trackNamespace, "track": trackName})
+	logObj := connConfig.IngestLogSampler.Sample(trackNamespace, trackName)
 
-			errObjPayload := moqhelpers.ReadObjPayloadToEOS(*uniStream, moqObj)
-			if errObjPayload != nil {
-				log.Error(fmt.Sprintf("%s(%v) - Error receiving obj payload. Err: %v", moqSession.UniqueName, (*uniStream).StreamID(), errObjPayload))
-				return
-			}
-			log.Info(fmt.Sprintf("%s(%v) - Received obj, Obj: %s", moqSession.UniqueName, (*uniStream).StreamID(), moqObj.GetDebugStr()))
+	if connConfig.ValidateObjSequences {
+		errSequence := moqSession.ValidateObjectSequence(moqObjHeader)
+		if errSequence != nil {
+			streamLog.WithField("totalViolations", moqSession.GetSequenceViolations()).WithError(errSequence).Warning("Object sequence violation")
+		}
+	}
 
-		}(&uniStream, session, moqtFwdTable)
+	// Create cache key
+	cacheKey := CreateObjectCacheKey(trackNamespace, trackName, moqObjHeader)
+	moqObj, errAddingMoqObj := objects.Create(trackNamespace, trackName, cacheKey, moqObjHeader, connConfig.ObjExpMs/1000)
+	if errAddingMoqObj == moqmessageobjects.ErrDuplicatedObject && objects.GetDedupPolicy() == moqmessageobjects.MoqObjDedupPolicyPayload {
+		receiveDuplicatedObject(payloadStream, moqObj, moqSession, trackNamespace, trackName, cacheKey, moqObjHeader, streamLog, logObj, moqtFwdTable, objects, connConfig)
+		moqSession.TouchObjects()
+		return
+	}
+	if errAddingMoqObj == moqmessageobjects.ErrDuplicatedObject {
+		// Redundant publisher, already received
+		if logObj {
+			streamLog.WithFields(log.Fields{"cacheKey": cacheKey, "obj": moqObjHeader.GetDebugStr()}).Info("Discarded duplicated obj")
+		}
+		if payloadReader != nil {
+			// The next objects of the stream are still needed
+			io.Copy(io.Discard, payloadReader)
+		} else {
+			uniStream.CancelRead(webtransport.StreamErrorCode(moqhelpers.NoError))
+		}
+		moqSession.TouchObjects()
+		return
+	}
+	if errAddingMoqObj != nil {
+		// Drop the object, the session continues
+		streamLog.WithFields(log.Fields{"cacheKey": cacheKey, "obj": moqObjHeader.GetDebugStr()}).WithError(errAddingMoqObj).Warning("Dropped obj")
+		if payloadReader != nil {
+			io.Copy(io.Discard, payloadReader)
+		} else {
+			uniStream.CancelRead(webtransport.StreamErrorCode(moqhelpers.ErrorGeneric))
+		}
+		return
+	}
+	if logObj {
+		streamLog.WithFields(log.Fields{"cacheKey": cacheKey, "obj": moqObjHeader.GetDebugStr()}).Info("Received obj header")
 	}
-	log.Info(fmt.Sprintf("%s(-) - Exit ListeningObjects thread", moqSession.UniqueName))
 
+	// Notify new cache key
+	moqtFwdTable.ReceivedObject(trackNamespace, trackName, cacheKey, moqObjHeader)
+
+	errObjPayload := moqhelpers.ReadObjPayloadToEOS(payloadStream, moqObj)
+	connConfig.Bandwidth.AddIngest(uint64(moqObj.GetPayloadSize()))
+	moqtFwdTable.ReceivedObjectPayload(trackNamespace, trackName, uint64(moqObj.GetPayloadSize()))
+	moqSession.AddReceivedObject(uint64(moqObj.GetPayloadSize()))
+	connConfig.Metrics.ObjectReceived(uint64(moqObj.GetPayloadSize()))
+	if errObjPayload == moqhelpers.ErrObjectAborted {
+		// Over the cache quota, the session continues
+		streamLog.WithField("obj", moqObj.GetDebugStr()).Warning("Dropped obj, over namespace cache bytes quota")
+		if payloadReader != nil {
+			io.Copy(io.Discard, payloadReader)
+		} else {
+			uniStream.CancelRead(webtransport.StreamErrorCode(moqhelpers.ErrorGeneric))
+		}
+		return
+	}
+	if errObjPayload != nil {
+		streamLog.WithError(errObjPayload).Error("Error receiving obj payload")
+		return
+	}
+	if logObj {
+		streamLog.WithField("obj", moqObj.GetDebugStr()).Info("Received obj")
+	}
+	moqtFwdTable.ReceivedObjectEof(trackNamespace, trackName, connConfig.Clock.Now().Sub(moqObj.ReceivedAt))
+	connConfig.Recorder.Record(trackNamespace, trackName, moqObj)
+	connConfig.Events.ObjectReceived(trackNamespace, trackName)
+	moqSession.TouchObjects()
+	connConfig.Hooks.OnObject(moqSession, trackNamespace, trackName, moqObjHeader, uint64(moqObj.GetPayloadSize()))
 	return
 }
 
-func startForwardingObjects(session *webtransport.Session, moqSession *moqsession.MoqSession, objects *moqmessageobjects.MoqMessageObjects) {
+// receiveDuplicatedObject Receives an object already cached, it is discarded if the payload is the same, if not it replaces the cached one and it is forwarded
+func receiveDuplicatedObject(stream quichelpers.IWtReadableStream, cachedObj *moqobject.MoqObject, moqSession *moqsession.MoqSession, trackNamespace string, trackName string, cacheKey string, moqObjHeader moqobject.MoqObjectHeader, streamLog *log.Entry, logObj bool, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig MoqConnectionConfig) {
+	receivedObj := moqobject.New(moqObjHeader, connConfig.ObjExpMs/1000, connConfig.Clock.Now())
+	errObjPayload := moqhelpers.ReadObjPayloadToEOS(stream, receivedObj)
+	connConfig.Bandwidth.AddIngest(uint64(receivedObj.GetPayloadSize()))
+	moqSession.AddReceivedObject(uint64(receivedObj.GetPayloadSize()))
+	connConfig.Metrics.ObjectReceived(uint64(receivedObj.GetPayloadSize()))
+	if errObjPayload != nil {
+		streamLog.WithError(errObjPayload).Error("Error receiving duplicated obj payload")
+		return
+	}
+	connConfig.Hooks.OnObject(moqSession, trackNamespace, trackName, moqObjHeader, uint64(receivedObj.GetPayloadSize()))
+
+	// Waits until the cached object is complete
+	cachedPayload, errCachedPayload := io.ReadAll(cachedObj.NewReader())
+	receivedPayload, _ := io.ReadAll(receivedObj.NewReader())
+	if errCachedPayload == nil && bytes.Equal(cachedPayload, receivedPayload) {
+		if logObj {
+			streamLog.WithFields(log.Fields{"cacheKey": cacheKey, "obj": moqObjHeader.GetDebugStr()}).Info("Discarded duplicated obj (same payload)")
+		}
+		return
+	}
+
+	moqObj, errReplacing := objects.Replace(trackNamespace, trackName, cacheKey, moqObjHeader, connConfig.ObjExpMs/1000)
+	if errReplacing != nil {
+		streamLog.WithFields(log.Fields{"cacheKey": cacheKey, "obj": moqObjHeader.GetDebugStr()}).WithError(errReplacing).Warning("Dropped obj with different payload than cached")
+		return
+	}
+	streamLog.WithFields(log.Fields{"cacheKey": cacheKey, "obj": moqObjHeader.GetDebugStr()}).Warning("Received obj with different payload than cached, replaced")
+
+	moqtFwdTable.ReceivedObject(trackNamespace, trackName, cacheKey, moqObjHeader)
+	moqObj.PayloadWrite(receivedPayload)
+	moqObj.SetEof()
+	moqtFwdTable.ReceivedObjectPayload(trackNamespace, trackName, uint64(moqObj.GetPayloadSize()))
+}
+
+func startForwardingObjects(session MoqTransportSession, moqSession *moqsession.MoqSession, sessionLog *log.Entry, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig MoqConnectionConfig) {
+	var rateLimiter *moqbandwidth.MoqTokenBucket = nil
+	if connConfig.SubscriberRateBps > 0 {
+		rateLimiter = moqbandwidth.NewTokenBucket(connConfig.SubscriberRateBps, connConfig.SubscriberBurstBytes, connConfig.Clock)
+	}
+
+	// Writes of the object streams ordered by priority
+	scheduler := moqegressscheduler.New(connConfig.Clock)
+
+	// Open batched streams by local track id
+	batches := map[uint64]*moqEgressBatch{}
+
 	bExit := false
 	for bExit == false {
 		// Get next object cache key
-		cacheKey := moqSession.GetNewObject()
-		if cacheKey == "" {
+		cacheKey, localTrackId, stop := moqSession.GetNewObject()
+		if stop {
 			bExit = true
 		} else {
 			moqObj, found := objects.Get(cacheKey)
 			if !found {
-				log.Error(fmt.Sprintf("%s - Not found OBJECT key %s in cache", moqSession.UniqueName, cacheKey))
+				sessionLog.WithField("cacheKey", cacheKey).Error("Not found OBJECT in cache")
+			} else if rateLimiter != nil && !waitForSendRate(session, moqSession, rateLimiter, moqObj, connConfig) {
+				sessionLog.WithField("obj", moqObj.GetDebugStr()).Warning("Dropped OBJECT, over send rate limit")
+				moqSession.AddRateLimitedObject()
 			} else {
-				go func(moqObj *moqobject.MoqObject, session *webtransport.Session, moqSession *moqsession.MoqSession) {
-					sUni, errOpenStream := session.OpenUniStreamSync(session.Context())
-					if errOpenStream != nil {
-						log.Error(fmt.Sprintf("%s(-) - Opening stream to send OBJECT %s", moqSession.UniqueName, moqObj.GetDebugStr()))
-					} else {
-						log.Info(fmt.Sprintf("%s(%v) - Sending OBJECT %s", moqSession.UniqueName, sUni.StreamID(), moqObj.GetDebugStr()))
-						errSendObj := moqhelpers.SendObject(sUni, moqObj)
-						if errSendObj != nil {
-							log.Error(fmt.Sprintf("%s(%v) - Sending OBJECT %s. Err: %v", moqSession.UniqueName, sUni.StreamID(), moqObj.GetDebugStr(), errSendObj))
-						} else {
-							log.Info(fmt.Sprintf("%s(%v) - Sent OBJECT %s", moqSession.UniqueName, sUni.StreamID(), moqObj.GetDebugStr()))
-						}
-						sUni.Close()
+				foundTrack, trackNamespace, trackName := moqSession.GetSubscribedTrackInfo(localTrackId)
+				if foundTrack {
+					moqtFwdTable.ForwardingObject(trackNamespace, trackName, connConfig.Clock.Now().Sub(moqObj.ReceivedAt))
+				}
+				logObj := connConfig.EgressLogSampler.Sample(trackNamespace, trackName)
+				if isBatchCandidate(moqObj, connConfig.EgressBatchMaxObjectBytes) {
+					// Written in order by the egress task of the track
+					queueBatchedObject(session, moqSession, scheduler, batches, moqObj, localTrackId, sessionLog, logObj, connConfig)
+				} else {
+					// NOT consecutive anymore
+					queueBatchedObject(session, moqSession, scheduler, batches, nil, localTrackId, sessionLog, logObj, connConfig)
+					if !connConfig.EgressPool.Submit(func() {
+						sendObject(session, moqSession, scheduler, moqObj, localTrackId, sessionLog, logObj, connConfig)
+					}) {
+						sessionLog.WithField("obj", moqObj.GetDebugStr()).Warning("Dropped OBJECT, egress workers queue full")
 					}
-				}(moqObj, session, moqSession)
+				}
 			}
 		}
 	}
+	for localTrackId := range batches {
+		queueBatchedObject(session, moqSession, scheduler, batches, nil, localTrackId, sessionLog, false, connConfig)
+	}
+
+	if moqSession.IsSlowSubscriber() {
+		sessionLog.WithField("droppedObjects", moqSession.GetDroppedObjects()).Error("Slow subscriber, objects queue full, closing it")
+		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGeneric, ErrMsg: "Slow subscriber"})
+	}
 
-	log.Info(fmt.Sprintf("%s(-) - Exit Forwarding Objects thread", moqSession.UniqueName))
+	sessionLog.Info("Exit Forwarding Objects thread")
 
 	return
 }
 
+// sendObject Sends the object in its own stream (until the end of its payload), its writes wait for the higher priority streams of the session
+func sendObject(session MoqTransportSession, moqSession *moqsession.MoqSession, scheduler *moqegressscheduler.MoqEgressScheduler, moqObj *moqobject.MoqObject, localTrackId uint64, sessionLog *log.Entry, logObj bool, connConfig MoqConnectionConfig) {
+	sUniStream, errOpenStream := session.OpenUniStreamSync(session.Context())
+	if errOpenStream != nil {
+		sessionLog.WithField("obj", moqObj.GetDebugStr()).WithError(errOpenStream).Error("Opening stream to send OBJECT")
+		return
+	}
+	// quic-go (v0.41) sends the streams round robin and has NO priorities API
+	sUni := moqegressscheduler.NewScheduledStream(session.Context(), sUniStream, scheduler, getEgressPriority(moqObj), time.Duration(connConfig.SubscriberPriorityMaxWaitMs)*time.Millisecond)
+	moqSession.GetTransportStats().StreamOpened(false)
+	defer moqSession.GetTransportStats().StreamClosed()
+	streamLog := sessionLog.WithField("streamID", sUni.StreamID())
+	if logObj {
+		streamLog.WithField("obj", moqObj.GetDebugStr()).Info("Sending OBJECT")
+	}
+	errSendObj := moqhelpers.SendObject(sUni, moqObj, localTrackId)
+	connConfig.Bandwidth.AddEgress(uint64(moqObj.GetPayloadSize()))
+	if errors.Is(errSendObj, moqegressscheduler.ErrMaxWait) {
+		streamLog.WithField("obj", moqObj.GetDebugStr()).Warning("Dropped OBJECT, waited too long for higher priority ones")
+		moqSession.AddPriorityDroppedObject()
+		sUni.CancelWrite(webtransport.StreamErrorCode(moqhelpers.ErrorGeneric))
+		return
+	}
+	if errSendObj != nil {
+		streamLog.WithField("obj", moqObj.GetDebugStr()).WithError(errSendObj).Error("Sending OBJECT")
+		sUni.CancelWrite(webtransport.StreamErrorCode(moqhelpers.ErrorGeneric))
+		return
+	}
+	if logObj {
+		streamLog.WithField("obj", moqObj.GetDebugStr()).Info("Sent OBJECT")
+	}
+	moqSession.TouchObjects()
+	connConfig.Metrics.ObjectForwarded(uint64(moqObj.GetPayloadSize()))
+	sUni.Close()
+}
+
+// moqEgressBatch Stream shared by consecutive small objects of a track / group. Written by a single egress pool task at a time, the forwarding thread only queues objects
+type moqEgressBatch struct {
+	// Only used by the running task
+	stream        webtransport.SendStream
+	groupSequence uint64
+	objects       int
+
+	// Objects waiting for the task, nil object closes the stream (protected)
+	queue []moqEgressBatchItem
+	// A task is draining the queue (protected)
+	running bool
+
+	lock *sync.Mutex
+}
+
+type moqEgressBatchItem struct {
+	moqObj *moqobject.MoqObject
+	logObj bool
+}
+
+// isBatchCandidate Objects NOT known to be bigger than maxBytes (0 disabled) go to the batch of the track, it does NOT wait for the payload
+func isBatchCandidate(moqObj *moqobject.MoqObject, maxBytes uint64) bool {
+	return maxBytes > 0 && uint64(moqObj.GetPayloadSize()) <= maxBytes
+}
+
+// isBatchedObject Objects up to maxBytes are batched, it waits until the object is complete or bigger than maxBytes (its length is sent before the payload). Only called from the egress task of the track
+func isBatchedObject(moqObj *moqobject.MoqObject, maxBytes uint64) bool {
+	reader := moqObj.NewChunkReader()
+	size := uint64(0)
+	for {
+		chunk, err := reader.NextChunk()
+		size += uint64(len(chunk))
+		if size > maxBytes {
+			return false
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			// Aborted, it fails in its own stream
+			return false
+		}
+	}
+}
+
+// queueBatchedObject Queues the object (nil closes the open stream) for the egress task of the track, it starts the task in the egress pool if it is NOT running
+func queueBatchedObject(session MoqTransportSession, moqSession *moqsession.MoqSession, scheduler *moqegressscheduler.MoqEgressScheduler, batches map[uint64]*moqEgressBatch, moqObj *moqobject.MoqObject, localTrackId uint64, sessionLog *log.Entry, logObj bool, connConfig MoqConnectionConfig) {
+	batch, found := batches[localTrackId]
+	if !found {
+		if moqObj == nil {
+			return
+		}
+		batch = &moqEgressBatch{lock: new(sync.Mutex)}
+		batches[localTrackId] = batch
+	}
+
+	batch.lock.Lock()
+	batch.queue = append(batch.queue, moqEgressBatchItem{moqObj: moqObj, logObj: logObj})
+	if batch.running {
+		batch.lock.Unlock()
+		return
+	}
+	batch.running = true
+	batch.lock.Unlock()
+
+	if connConfig.EgressPool.Submit(func() {
+		sendBatchedObjects(session, moqSession, scheduler, batch, localTrackId, sessionLog, connConfig)
+	}) {
+		return
+	}
+	// NO task running, safe to use the stream here
+	batch.lock.Lock()
+	dropped := batch.queue
+	batch.queue = nil
+	batch.running = false
+	batch.lock.Unlock()
+	for _, droppedItem := range dropped {
+		if droppedItem.moqObj != nil {
+			sessionLog.WithField("obj", droppedItem.moqObj.GetDebugStr()).Warning("Dropped OBJECT, egress workers queue full")
+		}
+	}
+	closeEgressBatch(batch, moqSession)
+}
+
+// sendBatchedObjects Egress task of the track, sends the queued objects (with length) in the open stream of the track until the queue is empty. A new stream is opened for a new group, bigger objects are sent in their own stream
+func sendBatchedObjects(session MoqTransportSession, moqSession *moqsession.MoqSession, scheduler *moqegressscheduler.MoqEgressScheduler, batch *moqEgressBatch, localTrackId uint64, sessionLog *log.Entry, connConfig MoqConnectionConfig) {
+	for {
+		batch.lock.Lock()
+		if len(batch.queue) == 0 {
+			batch.running = false
+			batch.lock.Unlock()
+			return
+		}
+		item := batch.queue[0]
+		batch.queue = batch.queue[1:]
+		batch.lock.Unlock()
+
+		if item.moqObj == nil {
+			closeEgressBatch(batch, moqSession)
+		} else if !isBatchedObject(item.moqObj, connConfig.EgressBatchMaxObjectBytes) {
+			closeEgressBatch(batch, moqSession)
+			sendObject(session, moqSession, scheduler, item.moqObj, localTrackId, sessionLog, item.logObj, connConfig)
+		} else {
+			sendBatchedObject(session, moqSession, scheduler, batch, item.moqObj, localTrackId, sessionLog, item.logObj, connConfig)
+		}
+	}
+}
+
+// sendBatchedObject Sends the complete object (with length) in the open stream of the batch, a new stream is opened for a new group
+func sendBatchedObject(session MoqTransportSession, moqSession *moqsession.MoqSession, scheduler *moqegressscheduler.MoqEgressScheduler, batch *moqEgressBatch, moqObj *moqobject.MoqObject, localTrackId uint64, sessionLog *log.Entry, logObj bool, connConfig MoqConnectionConfig) {
+	maxWait := time.Duration(connConfig.SubscriberPriorityMaxWaitMs) * time.Millisecond
+	if batch.stream != nil && (batch.groupSequence != moqObj.GroupSequence || batch.objects >= EGRESS_BATCH_MAX_OBJECTS_PER_STREAM) {
+		closeEgressBatch(batch, moqSession)
+	}
+	if batch.stream == nil {
+		sUni, errOpenStream := session.OpenUniStreamSync(session.Context())
+		if errOpenStream != nil {
+			sessionLog.WithField("obj", moqObj.GetDebugStr()).WithError(errOpenStream).Error("Opening stream to send batched OBJECT")
+			return
+		}
+		moqSession.GetTransportStats().StreamOpened(false)
+		batch.stream = moqegressscheduler.NewScheduledStream(session.Context(), sUni, scheduler, getEgressPriority(moqObj), maxWait)
+		batch.groupSequence = moqObj.GroupSequence
+		batch.objects = 0
+	} else if scheduledStream, isScheduled := batch.stream.(*moqegressscheduler.MoqScheduledStream); isScheduled {
+		scheduledStream.SetPriority(getEgressPriority(moqObj), maxWait)
+	}
+
+	streamLog := sessionLog.WithField("streamID", batch.stream.StreamID())
+	if logObj {
+		streamLog.WithFields(log.Fields{"obj": moqObj.GetDebugStr(), "batchedObjects": batch.objects}).Info("Sending batched OBJECT")
+	}
+	errSendObj := moqhelpers.SendObjectWithLength(batch.stream, moqObj, localTrackId)
+	connConfig.Bandwidth.AddEgress(uint64(moqObj.GetPayloadSize()))
+	if errSendObj != nil {
+		if errors.Is(errSendObj, moqegressscheduler.ErrMaxWait) {
+			streamLog.WithField("obj", moqObj.GetDebugStr()).Warning("Dropped batched OBJECT, waited too long for higher priority ones")
+			moqSession.AddPriorityDroppedObject()
+		} else {
+			streamLog.WithField("obj", moqObj.GetDebugStr()).WithError(errSendObj).Error("Sending batched OBJECT")
+		}
+		batch.stream.CancelWrite(webtransport.StreamErrorCode(moqhelpers.ErrorGeneric))
+		batch.stream = nil
+		moqSession.GetTransportStats().StreamClosed()
+		return
+	}
+	batch.objects++
+	if logObj {
+		streamLog.WithField("obj", moqObj.GetDebugStr()).Info("Sent batched OBJECT")
+	}
+	moqSession.TouchObjects()
+	connConfig.Metrics.ObjectForwarded(uint64(moqObj.GetPayloadSize()))
+}
+
+// closeEgressBatch Closes the open stream of the batch (if any). Only called from the egress task of the track (or when it is NOT running)
+func closeEgressBatch(batch *moqEgressBatch, moqSession *moqsession.MoqSession) {
+	if batch.stream == nil {
+		return
+	}
+	batch.stream.Close()
+	batch.stream = nil
+	moqSession.GetTransportStats().StreamClosed()
+}
+
+// getEgressPriority Priority of the stream of the object in the egress scheduler of the session
+func getEgressPriority(moqObj *moqobject.MoqObject) moqegressscheduler.MoqEgressPriority {
+	return moqegressscheduler.MoqEgressPriority{SendOrder: moqObj.SendOrder, GroupSequence: moqObj.GroupSequence, ObjectSequence: moqObj.ObjectSequence}
+}
+
+// waitForSendRate Delays the object until the rate limit allows it, returns false if it should be dropped (higher priority objects waiting, or waited too long)
+func waitForSendRate(session MoqTransportSession, moqSession *moqsession.MoqSession, rateLimiter *moqbandwidth.MoqTokenBucket, moqObj *moqobject.MoqObject, connConfig MoqConnectionConfig) bool {
+	maxWait := time.Duration(connConfig.SubscriberRateMaxWaitMs) * time.Millisecond
+	waited := time.Duration(0)
+	for {
+		wait := rateLimiter.Take(uint64(moqObj.GetPayloadSize()))
+		if wait == 0 {
+			return true
+		}
+		if waited+wait > maxWait || moqSession.HasHigherPriorityQueued(moqObj.SendOrder) {
+			return false
+		}
+
+		timer := connConfig.Clock.NewTimer(wait)
+		select {
+		case <-session.Context().Done():
+			timer.Stop()
+			return false
+		case <-timer.C():
+		}
+		waited += wait
+	}
+}
+
+// Thread that closes half-dead sessions (no activity) before QUIC idle timeout
+
+func startStallWatchdog(session MoqTransportSession, moqSession *moqsession.MoqSession, sessionLog *log.Entry, connConfig MoqConnectionConfig) {
+	stallTimeout := time.Duration(connConfig.StallTimeoutMs) * time.Millisecond
+	ticker := connConfig.Clock.NewTicker(stallTimeout / 2)
+	defer ticker.Stop()
+
+	bExit := false
+	for !bExit {
+		select {
+		case <-session.Context().Done():
+			bExit = true
+		case <-ticker.C():
+			idleTime := moqSession.GetIdleTime()
+			if idleTime > stallTimeout {
+				sessionLog.WithField("idleMs", idleTime.Milliseconds()).Error("Session stalled, no activity, closing it")
+				terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGeneric, ErrMsg: "Session stalled"})
+				bExit = true
+			}
+		}
+	}
+
+	sessionLog.Info("Exit stall watchdog thread")
+}
+
+// Thread that sends GOAWAY when the relay starts draining, and closes the session if it is still open after the drain time
+
+func startGoAwayOnDrain(session MoqTransportSession, controlWriter *moqcontrolwriter.MoqControlWriter, sessionLog *log.Entry, connConfig MoqConnectionConfig) {
+	select {
+	case <-session.Context().Done():
+		sessionLog.Info("Exit GOAWAY thread")
+		return
+	case <-connConfig.DrainChannel:
+	}
+
+	errMoqTx := controlWriter.Send(func(stream quichelpers.IWtWritableStream) error {
+		return moqhelpers.SendGoAway(stream)
+	})
+	if errMoqTx != nil {
+		sessionLog.WithError(errMoqTx).Error("Sending GOAWAY")
+	} else {
+		sessionLog.Info("Sent GOAWAY, relay draining")
+	}
+
+	timer := connConfig.Clock.NewTimer(time.Duration(connConfig.DrainMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-session.Context().Done():
+	case <-timer.C():
+		sessionLog.WithField("drainMs", connConfig.DrainMs).Warning("Session still open after GOAWAY, closing it")
+		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGoAwayTimeout, ErrMsg: "GOAWAY timeout"})
+	}
+	sessionLog.Info("Exit GOAWAY thread")
+}
+
+// Thread that closes sessions not doing anything useful for their role (frees forward table entries)
+
+func startIdleWatchdog(session MoqTransportSession, moqSession *moqsession.MoqSession, sessionLog *log.Entry, connConfig MoqConnectionConfig) {
+	ticker := connConfig.Clock.NewTicker(IDLE_CHECK_PERIOD_MS * time.Millisecond)
+	defer ticker.Stop()
+
+	bExit := false
+	for !bExit {
+		select {
+		case <-session.Context().Done():
+			bExit = true
+		case <-ticker.C():
+			idle, reason := moqSession.CheckIdle(time.Duration(connConfig.PublisherAnnounceTimeoutMs)*time.Millisecond, time.Duration(connConfig.SubscriberSubscribeTimeoutMs)*time.Millisecond, time.Duration(connConfig.ObjectsIdleTimeoutMs)*time.Millisecond)
+			if idle {
+				sessionLog.WithField("reason", reason).Error("Session idle, closing it")
+				terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorGeneric, ErrMsg: "Session idle"})
+				bExit = true
+			}
+		}
+	}
+
+	sessionLog.Info("Exit idle watchdog thread")
+}
+
 // Check error helpers
-func processWTError(err error, uniqueSessionName string, errMsg string) (isErr bool, isEndSession bool) {
+func processWTError(err error, sessionLog *log.Entry, errMsg string) (isErr bool, isEndSession bool) {
 	if err != nil {
 		isErr = true
 		if errors.Is(err, context.Canceled) {
 			isEndSession = true
-			log.Info(fmt.Sprintf("%s - Exiting MOQ because connection finished", uniqueSessionName))
+			sessionLog.Info("Exiting MOQ because connection finished")
 		} else {
-			log.Error(fmt.Sprintf("%s - %s: %v", uniqueSessionName, errMsg, err))
+			sessionLog.WithError(err).Error(errMsg)
 		}
 	}
 	return
@@ -0,0 +1,140 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqconnectionmanagment
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Default endpoint (any role, no auth, any namespace)
+const ENDPOINT_DEFAULT_PATH = "/moq"
+
+var endpointRoles = map[string]moqhelpers.MoqRole{"publisher": moqhelpers.MoqRolePublisher, "subscriber": moqhelpers.MoqRoleSubscriber, "both": moqhelpers.MoqRoleBoth}
+
+// MoqEndpointData WebTransport URL path and what sessions connected to it can do (zero value allows everything)
+type MoqEndpointData struct {
+	Path string `json:"path"`
+	// SETUP roles allowed (publisher, subscriber, both), empty any
+	Roles []string `json:"roles"`
+	// ANNOUNCE / SUBSCRIBE need auth info (or a resolvable auth token)
+	AuthRequired bool `json:"authrequired"`
+	// Namespaces that can be announced / subscribed (ex: "live/*"), empty any. Checked after the namespace prefix is added
+	TrackNamespace string `json:"tracknamespace"`
+	// Added to the namespaces received from the sessions (ex: "live/" maps "room1" to "live/room1") and removed from the ones sent to them, empty none
+	NamespacePrefix string `json:"namespaceprefix"`
+	// Sessions need a client certificate signed by the client CA (and one of the configured identities)
+	ClientCertRequired bool `json:"clientcertrequired"`
+}
+
+type MoqEndpointsData struct {
+	Endpoints []MoqEndpointData `json:"endpoints"`
+}
+
+// IsValidEndpoints Checks the paths (unique, starting with /) and the roles
+func IsValidEndpoints(endpointsData MoqEndpointsData) (err error) {
+	if len(endpointsData.Endpoints) == 0 {
+		err = errors.New("Endpoints list is empty")
+		return
+	}
+	paths := map[string]bool{}
+	for _, endpoint := range endpointsData.Endpoints {
+		if !strings.HasPrefix(endpoint.Path, "/") {
+			err = errors.New(fmt.Sprintf("Invalid endpoint path %s, it has to start with /", endpoint.Path))
+			return
+		}
+		if paths[endpoint.Path] {
+			err = errors.New(fmt.Sprintf("Duplicated endpoint path %s", endpoint.Path))
+			return
+		}
+		paths[endpoint.Path] = true
+		if strings.Contains(endpoint.NamespacePrefix, moqfwdtable.WILDCARD_SUFFIX) {
+			err = errors.New(fmt.Sprintf("Invalid namespace prefix %s in endpoint %s, it can NOT have %s", endpoint.NamespacePrefix, endpoint.Path, moqfwdtable.WILDCARD_SUFFIX))
+			return
+		}
+		for _, roleStr := range endpoint.Roles {
+			if _, found := endpointRoles[roleStr]; !found {
+				err = errors.New(fmt.Sprintf("Invalid role %s in endpoint %s", roleStr, endpoint.Path))
+				return
+			}
+		}
+	}
+	return
+}
+
+// IsRoleAllowed Returns true if a session with this SETUP role can use the endpoint
+func (endpoint *MoqEndpointData) IsRoleAllowed(role moqhelpers.MoqRole) bool {
+	if len(endpoint.Roles) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(endpoint.Roles, func(roleStr string) bool { return endpointRoles[roleStr] == role })
+}
+
+// IsNamespaceAllowed Returns true if trackNamespace (or a wildcard subscription) is inside the endpoint namespace
+func (endpoint *MoqEndpointData) IsNamespaceAllowed(trackNamespace string) bool {
+	if endpoint.TrackNamespace == "" {
+		return true
+	}
+	return moqfwdtable.MatchesNamespace(endpoint.TrackNamespace, trackNamespace)
+}
+
+// MapNamespace Relay namespace of a namespace received from a session of the endpoint
+func (endpoint *MoqEndpointData) MapNamespace(trackNamespace string) string {
+	return endpoint.NamespacePrefix + trackNamespace
+}
+
+// UnmapNamespace Namespace sent to a session of the endpoint for a relay namespace
+func (endpoint *MoqEndpointData) UnmapNamespace(trackNamespace string) string {
+	return strings.TrimPrefix(trackNamespace, endpoint.NamespacePrefix)
+}
+
+// MapMessage Returns the control message with its namespace mapped, to the relay namespace if it was received from the session or to the session namespace if it is sent to it
+func (endpoint *MoqEndpointData) MapMessage(moqMsg interface{}, received bool) interface{} {
+	if endpoint.NamespacePrefix == "" {
+		return moqMsg
+	}
+	mapNamespace := endpoint.UnmapNamespace
+	if received {
+		mapNamespace = endpoint.MapNamespace
+	}
+
+	switch msg := moqMsg.(type) {
+	case moqhelpers.MoqMessageAnnounce:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageAnnounceOk:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageAnnounceError:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageUnAnnounce:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageSubscribe:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageSubscribeOk:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageSubscribeError:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageSubscribeRst:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	case moqhelpers.MoqMessageUnSubscribe:
+		msg.TrackNamespace = mapNamespace(msg.TrackNamespace)
+		return msg
+	}
+	return moqMsg
+}
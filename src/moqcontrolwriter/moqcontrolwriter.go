@@ -0,0 +1,78 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcontrolwriter
+
+import (
+	"bytes"
+	"errors"
+	"facebookexperimental/moq-go-server/moqhelpers/quichelpers"
+	"sync"
+)
+
+const CONTROL_WRITER_QUEUE_SIZE = 1024
+
+// MoqControlWriter Serializes all outbound control messages of a session (single writer goroutine)
+type MoqControlWriter struct {
+	stream quichelpers.IWtWritableStream
+
+	// Full messages to write
+	channelMessages chan []byte
+
+	// Closed when writer finishes
+	done      chan bool
+	closeOnce *sync.Once
+
+	// Called (once) if writing to the stream fails
+	onError func(err error)
+}
+
+// New Creates a new control writer and starts its writing goroutine
+func New(stream quichelpers.IWtWritableStream, onError func(err error)) *MoqControlWriter {
+	cw := MoqControlWriter{stream: stream, channelMessages: make(chan []byte, CONTROL_WRITER_QUEUE_SIZE), done: make(chan bool), closeOnce: new(sync.Once), onError: onError}
+
+	go cw.run()
+
+	return &cw
+}
+
+// Send Serializes the message (written by writeMsg) and queues it to be written
+func (cw *MoqControlWriter) Send(writeMsg func(stream quichelpers.IWtWritableStream) error) (err error) {
+	var msgBuffer bytes.Buffer
+	err = writeMsg(&msgBuffer)
+	if err != nil {
+		return
+	}
+
+	select {
+	case cw.channelMessages <- msgBuffer.Bytes():
+	case <-cw.done:
+		err = errors.New("Control writer is closed")
+	}
+	return
+}
+
+func (cw *MoqControlWriter) Close() {
+	cw.closeOnce.Do(func() {
+		close(cw.done)
+	})
+}
+
+func (cw *MoqControlWriter) run() {
+	for {
+		select {
+		case msg := <-cw.channelMessages:
+			_, errWrite := cw.stream.Write(msg)
+			if errWrite != nil {
+				cw.Close()
+				cw.onError(errWrite)
+				return
+			}
+		case <-cw.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqdebug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+const DEBUG_SHUTDOWN_TIMEOUT_MS = 5000
+
+// Max size of the goroutines dump
+const GOROUTINES_DUMP_MAX_BYTES = 64 * 1024 * 1024
+
+type MoqDebugRuntime struct {
+	GoVersion    string `json:"goVersion"`
+	NumCPU       int    `json:"numCpu"`
+	GoMaxProcs   int    `json:"goMaxProcs"`
+	Goroutines   int    `json:"goroutines"`
+	UptimeMs     int64  `json:"uptimeMs"`
+	HeapAlloc    uint64 `json:"heapAlloc"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"numGc"`
+	PauseTotalNs uint64 `json:"pauseTotalNs"`
+	// Process CPU time since start (all threads)
+	CpuUserMs   int64 `json:"cpuUserMs"`
+	CpuSystemMs int64 `json:"cpuSystemMs"`
+}
+
+// MoqDebugGoroutineGroup Goroutines started by the same function and currently running the same one
+type MoqDebugGoroutineGroup struct {
+	CreatedBy string `json:"createdBy"`
+	Function  string `json:"function"`
+	Count     int    `json:"count"`
+	// Per session (only for goroutines of this server)
+	PerSession float64 `json:"perSession"`
+}
+
+type MoqDebugGoroutines struct {
+	Sessions   int                      `json:"sessions"`
+	Goroutines int                      `json:"goroutines"`
+	Groups     []MoqDebugGoroutineGroup `json:"groups"`
+}
+
+// MoqDebug pprof and runtime debug endpoints (bind it to a private address, profiles expose internals)
+type MoqDebug struct {
+	server *http.Server
+
+	// Current sessions, to find the goroutines that do NOT finish with their sessions
+	getSessions func() int
+	// Package prefixes of this server goroutines
+	modulePrefixes []string
+	startedAt      time.Time
+
+	clock moqclock.Clock
+}
+
+// New Creates the debug server
+func New(listenAddr string, modulePrefixes []string, getSessions func() int, clock moqclock.Clock) *MoqDebug {
+	mux := http.NewServeMux()
+	moqDebug := &MoqDebug{server: &http.Server{Addr: listenAddr, Handler: mux}, getSessions: getSessions, modulePrefixes: modulePrefixes, startedAt: clock.Now(), clock: clock}
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, moqDebug.GetRuntime())
+	})
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, moqDebug.GetGoroutines())
+	})
+	return moqDebug
+}
+
+// GetRuntime Returns Go runtime info and memory stats
+func (moqDebug *MoqDebug) GetRuntime() MoqDebugRuntime {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+
+	return MoqDebugRuntime{GoVersion: runtime.Version(), NumCPU: runtime.NumCPU(), GoMaxProcs: runtime.GOMAXPROCS(0), Goroutines: runtime.NumGoroutine(), UptimeMs: moqDebug.clock.Now().Sub(moqDebug.startedAt).Milliseconds(), HeapAlloc: memStats.HeapAlloc, HeapInuse: memStats.HeapInuse, HeapObjects: memStats.HeapObjects, Sys: memStats.Sys, NumGC: memStats.NumGC, PauseTotalNs: memStats.PauseTotalNs, CpuUserMs: usage.Utime.Nano() / int64(time.Millisecond), CpuSystemMs: usage.Stime.Nano() / int64(time.Millisecond)}
+}
+
+// GetGoroutines Returns the goroutines grouped by creator and current function, biggest groups first. Groups of this server with a per session count that keeps growing are leaking
+func (moqDebug *MoqDebug) GetGoroutines() (goroutines MoqDebugGoroutines) {
+	goroutines.Sessions = moqDebug.getSessions()
+	goroutines.Groups = []MoqDebugGoroutineGroup{}
+
+	groupsIndex := map[string]int{}
+	for _, stack := range getStacks() {
+		createdBy, function := parseStack(stack)
+		goroutines.Goroutines++
+
+		key := createdBy + "\n" + function
+		index, found := groupsIndex[key]
+		if !found {
+			index = len(goroutines.Groups)
+			groupsIndex[key] = index
+			goroutines.Groups = append(goroutines.Groups, MoqDebugGoroutineGroup{CreatedBy: createdBy, Function: function})
+		}
+		goroutines.Groups[index].Count++
+	}
+
+	for i := range goroutines.Groups {
+		group := &goroutines.Groups[i]
+		if goroutines.Sessions > 0 && (moqDebug.isModuleFunction(group.CreatedBy) || moqDebug.isModuleFunction(group.Function)) {
+			group.PerSession = float64(group.Count) / float64(goroutines.Sessions)
+		}
+	}
+	slices.SortStableFunc(goroutines.Groups, func(a MoqDebugGoroutineGroup, b MoqDebugGoroutineGroup) int {
+		return b.Count - a.Count
+	})
+	return
+}
+
+func (moqDebug *MoqDebug) ListenAndServe() error {
+	host, _, errSplit := net.SplitHostPort(moqDebug.server.Addr)
+	if errSplit == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		log.Warning(fmt.Sprintf("Debug endpoints listening on all interfaces (%s), they should NOT be public", moqDebug.server.Addr))
+	}
+	log.Info(fmt.Sprintf("Serving debug endpoints. Addr: %s", moqDebug.server.Addr))
+
+	err := moqDebug.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+func (moqDebug *MoqDebug) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DEBUG_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	return moqDebug.server.Shutdown(ctx)
+}
+
+func (moqDebug *MoqDebug) isModuleFunction(function string) bool {
+	return slices.ContainsFunc(moqDebug.modulePrefixes, func(prefix string) bool { return strings.HasPrefix(function, prefix) })
+}
+
+// Helpers
+
+// getStacks Returns the stack of every goroutine
+func getStacks() (stacks []string) {
+	buf := make([]byte, 1024*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= GOROUTINES_DUMP_MAX_BYTES {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	return strings.Split(strings.TrimSpace(string(buf)), "\n\n")
+}
+
+// parseStack Returns the function that started the goroutine and the one it is running (ex: "goroutine 7 [select]:\nmain.f(...)\n\t/src/main.go:10 +0x1\ncreated by main.main in goroutine 1\n...")
+func parseStack(stack string) (createdBy string, function string) {
+	lines := strings.Split(stack, "\n")
+	if len(lines) > 1 {
+		function = trimCall(lines[1])
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "created by ") {
+			createdBy = strings.TrimPrefix(line, "created by ")
+			// Go 1.21 adds the parent goroutine
+			if index := strings.Index(createdBy, " in goroutine "); index >= 0 {
+				createdBy = createdBy[:index]
+			}
+		}
+	}
+	return
+}
+
+// trimCall Removes the arguments of a stack frame function call
+func trimCall(line string) string {
+	if index := strings.LastIndex(line, "("); index > 0 {
+		return line[:index]
+	}
+	return line
+}
+
+func writeJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	errEncode := json.NewEncoder(w).Encode(data)
+	if errEncode != nil {
+		log.Error(fmt.Sprintf("Debug endpoint encoding response. Err: %v", errEncode))
+	}
+}
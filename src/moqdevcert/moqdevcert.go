@@ -0,0 +1,105 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqdevcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// Browsers only accept serverCertificateHashes of certificates valid for 14 days or less
+const DEV_CERT_MAX_VALIDITY = 14 * 24 * time.Hour
+
+// Hosts the dev certificate is valid for
+var DEV_CERT_HOSTS = []string{"localhost", "127.0.0.1", "::1"}
+
+type MoqDevCert struct {
+	Certificate tls.Certificate
+	// SHA-256 of the DER certificate
+	Fingerprint [sha256.Size]byte
+	NotAfter    time.Time
+}
+
+// Generate Creates an ECDSA P-256 self-signed certificate (the only type allowed by serverCertificateHashes)
+func Generate(now time.Time, validity time.Duration) (devCert MoqDevCert, err error) {
+	if validity <= 0 || validity > DEV_CERT_MAX_VALIDITY {
+		err = errors.New(fmt.Sprintf("Dev certificate validity has to be > 0 and <= %v, got %v", DEV_CERT_MAX_VALIDITY, validity))
+		return
+	}
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		err = errKey
+		return
+	}
+	serial, errSerial := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if errSerial != nil {
+		err = errSerial
+		return
+	}
+
+	// Backdated a bit for clock skew, NOT counted in the validity
+	notBefore := now.Add(-time.Minute)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "moq-go-server dev"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range DEV_CERT_HOSTS {
+		ip := net.ParseIP(host)
+		if ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, errCert := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if errCert != nil {
+		err = errCert
+		return
+	}
+	devCert.Certificate = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	devCert.Fingerprint = sha256.Sum256(der)
+	devCert.NotAfter = template.NotAfter
+	return
+}
+
+// GetFingerprintHex Returns the fingerprint as hex
+func (devCert *MoqDevCert) GetFingerprintHex() string {
+	return hex.EncodeToString(devCert.Fingerprint[:])
+}
+
+// GetFingerprintBase64 Returns the fingerprint as base64
+func (devCert *MoqDevCert) GetFingerprintBase64() string {
+	return base64.StdEncoding.EncodeToString(devCert.Fingerprint[:])
+}
+
+// GetServerCertificateHashesJs Returns the WebTransport constructor option that accepts this certificate
+func (devCert *MoqDevCert) GetServerCertificateHashesJs() string {
+	bytesStr := make([]string, len(devCert.Fingerprint))
+	for i, b := range devCert.Fingerprint {
+		bytesStr[i] = fmt.Sprintf("%d", b)
+	}
+	return fmt.Sprintf("serverCertificateHashes: [{algorithm: \"sha-256\", value: new Uint8Array([%s])}]", strings.Join(bytesStr, ", "))
+}
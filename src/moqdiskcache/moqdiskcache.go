@@ -0,0 +1,205 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqdiskcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// File header: trackId, groupSeq, objSeq, sendOrder, receivedAt (unix ns), maxAgeS
+const DISK_OBJECT_HEADER_SIZE = 6 * 8
+
+const DISK_OBJECT_FILE_EXTENSION = ".moqobj"
+
+type moqDiskEntry struct {
+	fileName   string
+	receivedAt time.Time
+	maxAgeS    uint64
+	size       uint64
+}
+
+type MoqDiskCacheStats struct {
+	Objects uint64 `json:"objects"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// MoqDiskCache Objects stored in a local directory (second cache tier)
+type MoqDiskCache struct {
+	dir string
+
+	entries       map[string]*moqDiskEntry
+	lastFileIndex uint64
+	totalBytes    uint64
+
+	lock *sync.Mutex
+}
+
+// New Creates a new disk cache in dir, previous objects files in that dir are deleted
+func New(dir string) (diskCache *MoqDiskCache, err error) {
+	errMkDir := os.MkdirAll(dir, 0o755)
+	if errMkDir != nil {
+		err = errMkDir
+		return
+	}
+	oldFiles, errGlob := filepath.Glob(filepath.Join(dir, "*"+DISK_OBJECT_FILE_EXTENSION))
+	if errGlob != nil {
+		err = errGlob
+		return
+	}
+	for _, oldFile := range oldFiles {
+		os.Remove(oldFile)
+	}
+
+	diskCache = &MoqDiskCache{dir: dir, entries: map[string]*moqDiskEntry{}, lock: new(sync.Mutex)}
+
+	log.Info(fmt.Sprintf("Disk cache tier at %s, deleted %d old objects", dir, len(oldFiles)))
+	return
+}
+
+// Store Writes a closed object to disk
+func (dc *MoqDiskCache) Store(cacheKey string, moqObj *moqobject.MoqObject) (err error) {
+	if !moqObj.GetEof() {
+		err = errors.New(fmt.Sprintf("Can NOT store on disk an open object, key: %s", cacheKey))
+		return
+	}
+
+	payload := make([]byte, 0, moqObj.GetPayloadSize())
+	payloadReader := moqObj.NewReader()
+	buf := make([]byte, 32*1024)
+	for {
+		n, errRead := payloadReader.Read(buf)
+		payload = append(payload, buf[:n]...)
+		if errRead != nil {
+			break
+		}
+	}
+
+	header := make([]byte, DISK_OBJECT_HEADER_SIZE)
+	binary.BigEndian.PutUint64(header[0:], moqObj.TrackId)
+	binary.BigEndian.PutUint64(header[8:], moqObj.GroupSequence)
+	binary.BigEndian.PutUint64(header[16:], moqObj.ObjectSequence)
+	binary.BigEndian.PutUint64(header[24:], moqObj.SendOrder)
+	binary.BigEndian.PutUint64(header[32:], uint64(moqObj.ReceivedAt.UnixNano()))
+	binary.BigEndian.PutUint64(header[40:], moqObj.MaxAgeS)
+
+	dc.lock.Lock()
+	dc.lastFileIndex++
+	fileName := filepath.Join(dc.dir, fmt.Sprintf("%d%s", dc.lastFileIndex, DISK_OBJECT_FILE_EXTENSION))
+	dc.lock.Unlock()
+
+	errWrite := os.WriteFile(fileName, append(header, payload...), 0o644)
+	if errWrite != nil {
+		err = errWrite
+		return
+	}
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.removeEntry(cacheKey)
+	dc.entries[cacheKey] = &moqDiskEntry{fileName: fileName, receivedAt: moqObj.ReceivedAt, maxAgeS: moqObj.MaxAgeS, size: uint64(len(payload))}
+	dc.totalBytes += uint64(len(payload))
+	return
+}
+
+// Load Reads an object from disk, the returned object is closed (EOF)
+func (dc *MoqDiskCache) Load(cacheKey string) (moqObj *moqobject.MoqObject, found bool, err error) {
+	dc.lock.Lock()
+	entry, foundEntry := dc.entries[cacheKey]
+	dc.lock.Unlock()
+	if !foundEntry {
+		return
+	}
+
+	data, errRead := os.ReadFile(entry.fileName)
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	if len(data) < DISK_OBJECT_HEADER_SIZE {
+		err = errors.New(fmt.Sprintf("Corrupted disk object, key: %s, size: %d", cacheKey, len(data)))
+		return
+	}
+
+	objHeader := moqobject.MoqObjectHeader{TrackId: binary.BigEndian.Uint64(data[0:]), GroupSequence: binary.BigEndian.Uint64(data[8:]), ObjectSequence: binary.BigEndian.Uint64(data[16:]), SendOrder: binary.BigEndian.Uint64(data[24:])}
+	receivedAt := time.Unix(0, int64(binary.BigEndian.Uint64(data[32:])))
+	maxAgeS := binary.BigEndian.Uint64(data[40:])
+
+	moqObj = moqobject.New(objHeader, maxAgeS, receivedAt)
+	moqObj.PayloadWrite(data[DISK_OBJECT_HEADER_SIZE:])
+	moqObj.SetEof()
+	found = true
+	return
+}
+
+// Remove Deletes an object from disk
+func (dc *MoqDiskCache) Remove(cacheKey string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.removeEntry(cacheKey)
+}
+
+// RemoveWithPrefix Deletes all objects which cache key starts with prefix, returns the number of deleted objects
+func (dc *MoqDiskCache) RemoveWithPrefix(prefix string) (deleted int) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	for cacheKey := range dc.entries {
+		if strings.HasPrefix(cacheKey, prefix) {
+			dc.removeEntry(cacheKey)
+			deleted++
+		}
+	}
+	return
+}
+
+// CleanUp Deletes the expired objects, returns the number of deleted objects
+func (dc *MoqDiskCache) CleanUp(now time.Time) (deleted int) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	for cacheKey, entry := range dc.entries {
+		if entry.receivedAt.Add(time.Second * time.Duration(entry.maxAgeS)).Before(now) {
+			dc.removeEntry(cacheKey)
+			deleted++
+		}
+	}
+	return
+}
+
+func (dc *MoqDiskCache) GetStats() MoqDiskCacheStats {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	return MoqDiskCacheStats{Objects: uint64(len(dc.entries)), Bytes: dc.totalBytes}
+}
+
+// removeEntry (needs lock)
+func (dc *MoqDiskCache) removeEntry(cacheKey string) {
+	entry, found := dc.entries[cacheKey]
+	if !found {
+		return
+	}
+	delete(dc.entries, cacheKey)
+	dc.totalBytes -= entry.size
+
+	errRemove := os.Remove(entry.fileName)
+	if errRemove != nil {
+		log.Error(fmt.Sprintf("Deleting disk object %s (%s). Err: %v", cacheKey, entry.fileName, errRemove))
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqegressscheduler
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"sync"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// ErrMaxWait Returned by the writes of a stream that waited too long for the higher priority ones (the object should be dropped)
+var ErrMaxWait = errors.New("Waited too long for higher priority streams")
+
+// MoqEgressPriority Priority of an object stream: lower send order first, then newer group, then lower object sequence
+type MoqEgressPriority struct {
+	SendOrder      uint64
+	GroupSequence  uint64
+	ObjectSequence uint64
+}
+
+// Before Indicates p goes before other
+func (p MoqEgressPriority) Before(other MoqEgressPriority) bool {
+	if p.SendOrder != other.SendOrder {
+		return p.SendOrder < other.SendOrder
+	}
+	if p.GroupSequence != other.GroupSequence {
+		return p.GroupSequence > other.GroupSequence
+	}
+	return p.ObjectSequence < other.ObjectSequence
+}
+
+// MoqEgressScheduler Orders the stream writes of a session by priority. quic-go (v0.41) sends the streams with data round robin and has NO priorities API, so only one write is passed to it at a time and the waiting one with the highest priority goes next: when the session is bandwidth limited the data of the higher priority streams is sent first
+type MoqEgressScheduler struct {
+	// A write is in progress (protected)
+	busy bool
+	// Writes waiting for it (protected)
+	waiting moqEgressWaiters
+	// Arrival order, same priority writes are FIFO (protected)
+	sequence uint64
+
+	clock moqclock.Clock
+	lock  *sync.Mutex
+}
+
+type moqEgressWaiter struct {
+	priority MoqEgressPriority
+	sequence uint64
+	// Closed when it gets the turn
+	ready chan bool
+	index int
+}
+
+// New Creates the scheduler of a session
+func New(clock moqclock.Clock) *MoqEgressScheduler {
+	return &MoqEgressScheduler{waiting: moqEgressWaiters{}, clock: clock, lock: new(sync.Mutex)}
+}
+
+// Acquire Blocks until it is the turn of a write with that priority (Release has to be called after it), returns false if the deadline (zero none) passes or ctx is done before
+func (es *MoqEgressScheduler) Acquire(ctx context.Context, priority MoqEgressPriority, deadline time.Time) bool {
+	es.lock.Lock()
+	if !es.busy {
+		es.busy = true
+		es.lock.Unlock()
+		return true
+	}
+	waiter := &moqEgressWaiter{priority: priority, sequence: es.sequence, ready: make(chan bool)}
+	es.sequence++
+	heap.Push(&es.waiting, waiter)
+	es.lock.Unlock()
+
+	var timeout <-chan time.Time = nil
+	if !deadline.IsZero() {
+		timer := es.clock.NewTimer(deadline.Sub(es.clock.Now()))
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case <-waiter.ready:
+		return true
+	case <-ctx.Done():
+	case <-timeout:
+	}
+
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	if waiter.index < 0 {
+		// Got the turn at the same time, passed to the next one
+		es.releaseLocked()
+		return false
+	}
+	heap.Remove(&es.waiting, waiter.index)
+	return false
+}
+
+// Release Ends the current write, the waiting one with the highest priority goes next
+func (es *MoqEgressScheduler) Release() {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	es.releaseLocked()
+}
+
+// GetWaiting Writes waiting for their turn
+func (es *MoqEgressScheduler) GetWaiting() int {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	return len(es.waiting)
+}
+
+// releaseLocked Gives the turn to the highest priority waiting write (needs lock)
+func (es *MoqEgressScheduler) releaseLocked() {
+	if len(es.waiting) == 0 {
+		es.busy = false
+		return
+	}
+	next := heap.Pop(&es.waiting).(*moqEgressWaiter)
+	close(next.ready)
+}
+
+// MoqScheduledStream Stream whose writes wait for their turn in the scheduler (priority of the object being written)
+type MoqScheduledStream struct {
+	webtransport.SendStream
+
+	scheduler *MoqEgressScheduler
+	ctx       context.Context
+	priority  MoqEgressPriority
+	deadline  time.Time
+}
+
+// NewScheduledStream Wraps stream, every write waits for its turn, up to maxWait (0 forever) from now. A nil scheduler returns the stream as is
+func NewScheduledStream(ctx context.Context, stream webtransport.SendStream, scheduler *MoqEgressScheduler, priority MoqEgressPriority, maxWait time.Duration) webtransport.SendStream {
+	if scheduler == nil {
+		return stream
+	}
+	ret := &MoqScheduledStream{SendStream: stream, scheduler: scheduler, ctx: ctx, priority: priority}
+	ret.SetPriority(priority, maxWait)
+	return ret
+}
+
+// SetPriority Priority of the next writes (streams shared by several objects), the max wait starts again
+func (ss *MoqScheduledStream) SetPriority(priority MoqEgressPriority, maxWait time.Duration) {
+	ss.priority = priority
+	ss.deadline = time.Time{}
+	if maxWait > 0 {
+		ss.deadline = ss.scheduler.clock.Now().Add(maxWait)
+	}
+}
+
+func (ss *MoqScheduledStream) Write(p []byte) (n int, err error) {
+	if !ss.scheduler.Acquire(ss.ctx, ss.priority, ss.deadline) {
+		err = ErrMaxWait
+		if ss.ctx.Err() != nil {
+			err = ss.ctx.Err()
+		}
+		return
+	}
+	defer ss.scheduler.Release()
+
+	return ss.SendStream.Write(p)
+}
+
+// Helpers
+
+// moqEgressWaiters Heap of waiting writes, highest priority first
+type moqEgressWaiters []*moqEgressWaiter
+
+func (w moqEgressWaiters) Len() int {
+	return len(w)
+}
+
+func (w moqEgressWaiters) Less(i, j int) bool {
+	if w[i].priority == w[j].priority {
+		return w[i].sequence < w[j].sequence
+	}
+	return w[i].priority.Before(w[j].priority)
+}
+
+func (w moqEgressWaiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *moqEgressWaiters) Push(x interface{}) {
+	waiter := x.(*moqEgressWaiter)
+	waiter.index = len(*w)
+	*w = append(*w, waiter)
+}
+
+func (w *moqEgressWaiters) Pop() interface{} {
+	old := *w
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	waiter.index = -1
+	*w = old[:len(old)-1]
+	return waiter
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqegressscheduler
+
+import (
+	"context"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"testing"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+const TEST_TIMEOUT = 5 * time.Second
+
+// testSendStream Only Write is used by the scheduled stream
+type testSendStream struct {
+	webtransport.SendStream
+
+	written chan []byte
+}
+
+func (s *testSendStream) Write(p []byte) (int, error) {
+	s.written <- p
+	return len(p), nil
+}
+
+func TestAcquireOrder(t *testing.T) {
+	es := New(moqclock.NewFake(time.Unix(0, 0)))
+	if !es.Acquire(context.Background(), MoqEgressPriority{SendOrder: 10}, time.Time{}) {
+		t.Fatalf("First Acquire false, want true")
+	}
+
+	// Arrival order, expected grant order is by name
+	waiters := []struct {
+		name     string
+		priority MoqEgressPriority
+	}{
+		{name: "e old video", priority: MoqEgressPriority{SendOrder: 2, GroupSequence: 1, ObjectSequence: 0}},
+		{name: "c new video", priority: MoqEgressPriority{SendOrder: 2, GroupSequence: 2, ObjectSequence: 0}},
+		{name: "a audio", priority: MoqEgressPriority{SendOrder: 1, GroupSequence: 1, ObjectSequence: 5}},
+		{name: "d new video next object", priority: MoqEgressPriority{SendOrder: 2, GroupSequence: 2, ObjectSequence: 1}},
+		{name: "b audio same priority", priority: MoqEgressPriority{SendOrder: 1, GroupSequence: 1, ObjectSequence: 5}},
+	}
+	granted := make(chan string, len(waiters))
+	for i, waiter := range waiters {
+		go func(name string, priority MoqEgressPriority) {
+			if es.Acquire(context.Background(), priority, time.Time{}) {
+				granted <- name
+			}
+		}(waiter.name, waiter.priority)
+		waitForWaiting(t, es, i+1)
+	}
+
+	wantOrder := []string{"a audio", "b audio same priority", "c new video", "d new video next object", "e old video"}
+	for _, want := range wantOrder {
+		es.Release()
+		select {
+		case name := <-granted:
+			if name != want {
+				t.Fatalf("Granted %s, want %s", name, want)
+			}
+		case <-time.After(TEST_TIMEOUT):
+			t.Fatalf("Timeout waiting for %s", want)
+		}
+	}
+	es.Release()
+	if !es.Acquire(context.Background(), MoqEgressPriority{}, time.Time{}) {
+		t.Fatalf("Acquire after releasing all false, want true")
+	}
+}
+
+func TestAcquireMaxWait(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	es := New(clock)
+	es.Acquire(context.Background(), MoqEgressPriority{SendOrder: 1}, time.Time{})
+
+	result := make(chan bool, 1)
+	go func() {
+		result <- es.Acquire(context.Background(), MoqEgressPriority{SendOrder: 2}, clock.Now().Add(time.Second))
+	}()
+	waitForWaiting(t, es, 1)
+	start := time.Now()
+	for {
+		clock.Advance(time.Second)
+		select {
+		case acquired := <-result:
+			if acquired {
+				t.Fatalf("Acquire after max wait true, want false")
+			}
+			if es.GetWaiting() != 0 {
+				t.Fatalf("Waiting %d, want 0", es.GetWaiting())
+			}
+			// The holder releases, nobody waiting
+			es.Release()
+			if !es.Acquire(context.Background(), MoqEgressPriority{}, time.Time{}) {
+				t.Fatalf("Acquire after release false, want true")
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Since(start) > TEST_TIMEOUT {
+			t.Fatalf("Timeout waiting for max wait")
+		}
+	}
+}
+
+func TestScheduledStream(t *testing.T) {
+	es := New(moqclock.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lowStream := &testSendStream{written: make(chan []byte, 1)}
+	highStream := &testSendStream{written: make(chan []byte, 1)}
+	low := NewScheduledStream(ctx, lowStream, es, MoqEgressPriority{SendOrder: 2}, 0)
+	high := NewScheduledStream(ctx, highStream, es, MoqEgressPriority{SendOrder: 1}, 0)
+
+	// Transport blocked writing a lower priority stream
+	es.Acquire(ctx, MoqEgressPriority{SendOrder: 3}, time.Time{})
+	lowDone := make(chan error, 1)
+	go func() {
+		_, err := low.Write([]byte("low"))
+		lowDone <- err
+	}()
+	waitForWaiting(t, es, 1)
+	highDone := make(chan error, 1)
+	go func() {
+		_, err := high.Write([]byte("high"))
+		highDone <- err
+	}()
+	waitForWaiting(t, es, 2)
+
+	es.Release()
+	select {
+	case <-highStream.written:
+	case <-lowStream.written:
+		t.Fatalf("Lower priority stream written first")
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatalf("Timeout waiting for the write")
+	}
+	for _, done := range []chan error{highDone, lowDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Write err %v, want nil", err)
+			}
+		case <-time.After(TEST_TIMEOUT):
+			t.Fatalf("Timeout waiting for the write")
+		}
+	}
+
+	// Max wait
+	es.Acquire(ctx, MoqEgressPriority{}, time.Time{})
+	expiring := NewScheduledStream(ctx, lowStream, es, MoqEgressPriority{SendOrder: 2}, time.Millisecond)
+	_, err := expiring.Write([]byte("late"))
+	if !errors.Is(err, ErrMaxWait) {
+		t.Fatalf("Write err %v, want %v", err, ErrMaxWait)
+	}
+	// Session closed
+	cancel()
+	_, err = low.Write([]byte("closed"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Write err %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNilScheduler(t *testing.T) {
+	stream := &testSendStream{written: make(chan []byte, 1)}
+	if NewScheduledStream(context.Background(), stream, nil, MoqEgressPriority{}, 0) != stream {
+		t.Fatalf("Nil scheduler wrapped the stream, want it as is")
+	}
+}
+
+// Helpers
+
+func waitForWaiting(t *testing.T, es *MoqEgressScheduler, waiting int) {
+	t.Helper()
+	start := time.Now()
+	for es.GetWaiting() != waiting {
+		if time.Since(start) > TEST_TIMEOUT {
+			t.Fatalf("Waiting %d, want %d", es.GetWaiting(), waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
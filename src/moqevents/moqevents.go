@@ -0,0 +1,384 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqevents
+
+import (
+	"encoding/json"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Events waiting to be sent per client, new ones are dropped for that client when full
+const EVENTS_CLIENT_QUEUE_SIZE = 256
+
+// SSE comment sent when there are no events (keeps proxies from closing the connection)
+const EVENTS_KEEP_ALIVE_MS = 15 * 1000
+
+// Period of the check that finds tracks without objects for the track idle timeout
+const EVENTS_TRACK_IDLE_CHECK_MS = 1000
+
+type MoqEventType string
+
+const (
+	MoqEventTypeSessionConnected    MoqEventType = "session-connected"
+	MoqEventTypeSessionDisconnected MoqEventType = "session-disconnected"
+	MoqEventTypeAnnounce            MoqEventType = "announce"
+	MoqEventTypeSubscribe           MoqEventType = "subscribe"
+	// First object of a track received by the relay (also after the track was idle)
+	MoqEventTypeTrackFirstObject MoqEventType = "track-first-object"
+	// No objects of the track received for the track idle timeout
+	MoqEventTypeTrackIdle MoqEventType = "track-idle"
+	// Periodic per track summary (objects / bytes per second, subscribers, etc)
+	MoqEventTypeTracks MoqEventType = "tracks"
+)
+
+type MoqEvent struct {
+	Id   uint64       `json:"id"`
+	Type MoqEventType `json:"type"`
+	Time time.Time    `json:"time"`
+	Data interface{}  `json:"data"`
+}
+
+type MoqSessionEventData struct {
+	Session    string             `json:"session"`
+	Role       moqhelpers.MoqRole `json:"role"`
+	Origin     bool               `json:"origin"`
+	RemoteAddr string             `json:"remoteAddr"`
+	UserAgent  string             `json:"userAgent"`
+	// Only disconnected
+	DurationMs int64 `json:"durationMs,omitempty"`
+}
+
+type MoqAnnounceEventData struct {
+	Session        string `json:"session"`
+	TrackNamespace string `json:"trackNamespace"`
+	Accepted       bool   `json:"accepted"`
+	// Only NOT accepted
+	ErrCode uint64 `json:"errCode,omitempty"`
+	ErrMsg  string `json:"errMsg,omitempty"`
+}
+
+type MoqSubscribeEventData struct {
+	Session        string `json:"session"`
+	TrackNamespace string `json:"trackNamespace"`
+	TrackName      string `json:"trackName"`
+	Accepted       bool   `json:"accepted"`
+	// Only NOT accepted
+	ErrCode uint64 `json:"errCode,omitempty"`
+	ErrMsg  string `json:"errMsg,omitempty"`
+}
+
+type MoqTrackEventData struct {
+	TrackNamespace string `json:"trackNamespace"`
+	TrackName      string `json:"trackName"`
+	// Only idle, time since the first object
+	ActiveMs int64 `json:"activeMs,omitempty"`
+}
+
+// MoqEventsExporter Receives the published events (except the periodic summaries), it is called with the events lock held so it must NOT block
+type MoqEventsExporter interface {
+	Export(event MoqEvent)
+}
+
+// Objects activity of a track (first object / idle events)
+type moqEventsTrack struct {
+	firstObjectAt time.Time
+	lastObjectAt  time.Time
+}
+
+// MoqEvents Fans out relay events to the connected clients (server-sent events) and exporters, nil disabled
+type MoqEvents struct {
+	clock moqclock.Clock
+
+	// Protected
+	clients      map[uint64]chan MoqEvent
+	exporters    []MoqEventsExporter
+	nextClientId uint64
+	nextEventId  uint64
+	stopped      bool
+	lock         *sync.Mutex
+
+	// Protected (0 timeout disables the track events)
+	tracks           map[moqsession.MoqTrack]*moqEventsTrack
+	trackIdleTimeout time.Duration
+	tracksLock       *sync.Mutex
+
+	stopChannel chan bool
+}
+
+// New Creates the events fan-out
+func New(clock moqclock.Clock) *MoqEvents {
+	return &MoqEvents{clock: clock, clients: map[uint64]chan MoqEvent{}, exporters: []MoqEventsExporter{}, tracks: map[moqsession.MoqTrack]*moqEventsTrack{}, tracksLock: new(sync.Mutex), stopChannel: make(chan bool), lock: new(sync.Mutex)}
+}
+
+// AddExporter Sends the published events also to exporter (ex: event bus)
+func (e *MoqEvents) AddExporter(exporter MoqEventsExporter) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.exporters = append(e.exporters, exporter)
+}
+
+func (e *MoqEvents) SessionConnected(moqSession *moqsession.MoqSession, isOrigin bool) {
+	if e == nil {
+		return
+	}
+	e.Publish(MoqEventTypeSessionConnected, MoqSessionEventData{Session: moqSession.UniqueName, Role: moqSession.Role, Origin: isOrigin, RemoteAddr: moqSession.Metadata.RemoteAddr, UserAgent: moqSession.Metadata.UserAgent})
+}
+
+func (e *MoqEvents) SessionDisconnected(moqSession *moqsession.MoqSession, isOrigin bool, duration time.Duration) {
+	if e == nil {
+		return
+	}
+	e.Publish(MoqEventTypeSessionDisconnected, MoqSessionEventData{Session: moqSession.UniqueName, Role: moqSession.Role, Origin: isOrigin, RemoteAddr: moqSession.Metadata.RemoteAddr, UserAgent: moqSession.Metadata.UserAgent, DurationMs: duration.Milliseconds()})
+}
+
+func (e *MoqEvents) Announce(sessionName string, announceError moqhelpers.MoqMessageAnnounceError, trackNamespace string) {
+	if e == nil {
+		return
+	}
+	e.Publish(MoqEventTypeAnnounce, MoqAnnounceEventData{Session: sessionName, TrackNamespace: trackNamespace, Accepted: announceError.ErrCode == moqhelpers.NoErrorAnnounce, ErrCode: uint64(announceError.ErrCode), ErrMsg: announceError.ErrMsg})
+}
+
+func (e *MoqEvents) Subscribe(sessionName string, subscribeError moqhelpers.MoqMessageSubscribeError, trackNamespace string, trackName string) {
+	if e == nil {
+		return
+	}
+	e.Publish(MoqEventTypeSubscribe, MoqSubscribeEventData{Session: sessionName, TrackNamespace: trackNamespace, TrackName: trackName, Accepted: subscribeError.ErrCode == moqhelpers.NoErrorSubscribe, ErrCode: uint64(subscribeError.ErrCode), ErrMsg: subscribeError.ErrMsg})
+}
+
+// ObjectReceived Tracks the objects activity of a track, publishes the first object event (also after the track was idle)
+func (e *MoqEvents) ObjectReceived(trackNamespace string, trackName string) {
+	if e == nil {
+		return
+	}
+	now := e.clock.Now()
+	track := moqsession.MoqTrack{TrackNamespace: trackNamespace, TrackName: trackName}
+
+	e.tracksLock.Lock()
+	if e.trackIdleTimeout <= 0 {
+		e.tracksLock.Unlock()
+		return
+	}
+	trackActivity, found := e.tracks[track]
+	if found {
+		trackActivity.lastObjectAt = now
+	} else {
+		e.tracks[track] = &moqEventsTrack{firstObjectAt: now, lastObjectAt: now}
+	}
+	e.tracksLock.Unlock()
+
+	if !found {
+		e.Publish(MoqEventTypeTrackFirstObject, MoqTrackEventData{TrackNamespace: trackNamespace, TrackName: trackName})
+	}
+}
+
+// StartTrackIdleCheck Enables the track events, publishes track idle when a track does NOT receive objects for idleTimeoutMs (0 disables them)
+func (e *MoqEvents) StartTrackIdleCheck(idleTimeoutMs uint64) {
+	if e == nil || idleTimeoutMs <= 0 {
+		return
+	}
+	e.tracksLock.Lock()
+	e.trackIdleTimeout = time.Duration(idleTimeoutMs) * time.Millisecond
+	e.tracksLock.Unlock()
+
+	go func() {
+		ticker := e.clock.NewTicker(EVENTS_TRACK_IDLE_CHECK_MS * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stopChannel:
+				return
+			case <-ticker.C():
+				for _, idleData := range e.removeIdleTracks() {
+					e.Publish(MoqEventTypeTrackIdle, idleData)
+				}
+			}
+		}
+	}()
+}
+
+// Publish Sends an event to all the connected clients and exporters (it never blocks)
+func (e *MoqEvents) Publish(eventType MoqEventType, data interface{}) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.clients) == 0 && len(e.exporters) == 0 {
+		return
+	}
+	e.nextEventId++
+	event := MoqEvent{Id: e.nextEventId, Type: eventType, Time: e.clock.Now(), Data: data}
+	if eventType != MoqEventTypeTracks {
+		for _, exporter := range e.exporters {
+			exporter.Export(event)
+		}
+	}
+	for clientId, client := range e.clients {
+		select {
+		case client <- event:
+		default:
+			log.Debug(fmt.Sprintf("Dropped event %d for slow events client %d", event.Id, clientId))
+		}
+	}
+}
+
+// HasClients Returns true if any client is connected
+func (e *MoqEvents) HasClients() bool {
+	if e == nil {
+		return false
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return len(e.clients) > 0
+}
+
+// StartSummaries Publishes the result of getSummary (ex: per track stats) every periodMs, only while clients are connected
+func (e *MoqEvents) StartSummaries(periodMs uint64, eventType MoqEventType, getSummary func() interface{}) {
+	if e == nil || periodMs <= 0 {
+		return
+	}
+	go func() {
+		ticker := e.clock.NewTicker(time.Duration(periodMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stopChannel:
+				return
+			case <-ticker.C():
+				if e.HasClients() {
+					e.Publish(eventType, getSummary())
+				}
+			}
+		}
+	}()
+}
+
+// ServeSSE Streams the events to the client as server-sent events until it disconnects
+func (e *MoqEvents) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, isFlusher := w.(http.Flusher)
+	if !isFlusher {
+		http.Error(w, "Streaming NOT supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientId, client, added := e.addClient()
+	if !added {
+		http.Error(w, "Relay shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer e.removeClient(clientId)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := e.clock.NewTicker(EVENTS_KEEP_ALIVE_MS * time.Millisecond)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C():
+			_, errWrite := fmt.Fprint(w, ": keep-alive\n\n")
+			if errWrite != nil {
+				return
+			}
+		case event, ok := <-client:
+			if !ok {
+				// Stopped
+				return
+			}
+			data, errMarshal := json.Marshal(event)
+			if errMarshal != nil {
+				log.Error(fmt.Sprintf("Encoding event %s. Err: %v", event.Type, errMarshal))
+				continue
+			}
+			_, errWrite := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+			if errWrite != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// Stop Disconnects the clients and stops the summaries
+func (e *MoqEvents) Stop() {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.stopped {
+		return
+	}
+	e.stopped = true
+	close(e.stopChannel)
+	for clientId, client := range e.clients {
+		close(client)
+		delete(e.clients, clientId)
+	}
+}
+
+// Helpers
+
+func (e *MoqEvents) addClient() (clientId uint64, client chan MoqEvent, added bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.stopped {
+		return
+	}
+	e.nextClientId++
+	clientId = e.nextClientId
+	client = make(chan MoqEvent, EVENTS_CLIENT_QUEUE_SIZE)
+	e.clients[clientId] = client
+	added = true
+	return
+}
+
+func (e *MoqEvents) removeClient(clientId uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	delete(e.clients, clientId)
+}
+
+// removeIdleTracks Removes the tracks without objects for the idle timeout (next object is a first object again)
+func (e *MoqEvents) removeIdleTracks() (idleTracks []MoqTrackEventData) {
+	now := e.clock.Now()
+
+	e.tracksLock.Lock()
+	defer e.tracksLock.Unlock()
+
+	idleTracks = []MoqTrackEventData{}
+	for track, trackActivity := range e.tracks {
+		if now.Sub(trackActivity.lastObjectAt) >= e.trackIdleTimeout {
+			idleTracks = append(idleTracks, MoqTrackEventData{TrackNamespace: track.TrackNamespace, TrackName: track.TrackName, ActiveMs: trackActivity.lastObjectAt.Sub(trackActivity.firstObjectAt).Milliseconds()})
+			delete(e.tracks, track)
+		}
+	}
+	return
+}
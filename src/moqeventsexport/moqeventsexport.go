@@ -0,0 +1,169 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqeventsexport
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqevents"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Events waiting to be exported, new ones are dropped when full
+const EVENTS_EXPORT_QUEUE_SIZE = 4096
+
+// Max events sent in a single request / write
+const EVENTS_EXPORT_BATCH_MAX = 100
+
+// Wait after a failed send before sending the next batch (the failed one is dropped)
+const EVENTS_EXPORT_RETRY_MS = 1000
+
+// Timeout of the connections / requests to the event bus
+const EVENTS_EXPORT_TIMEOUT_MS = 5000
+
+// Exported event, it adds the relay that generated it (several relays can export to the same bus)
+type moqExportedEvent struct {
+	RelayId string `json:"relayId"`
+	moqevents.MoqEvent
+}
+
+// Event bus client
+type moqEventsSink interface {
+	send(events []moqExportedEvent) error
+	close()
+}
+
+// MoqEventsExport Publishes the relay lifecycle events (sessions, announces, subscribes, tracks first object / idle) to an event bus: NATS (nats://) or Kafka through its REST proxy (http(s)://), nil disabled
+type MoqEventsExport struct {
+	relayId string
+	sink    moqEventsSink
+	// For the logs (without credentials)
+	redactedUrl string
+
+	queue chan moqExportedEvent
+	done  chan bool
+
+	// Protected
+	stopped bool
+	lock    *sync.Mutex
+
+	clock moqclock.Clock
+}
+
+// New Creates the exporter for the event bus of exportUrl and starts its sender thread
+func New(exportUrl string, relayId string, clock moqclock.Clock) (ee *MoqEventsExport, err error) {
+	parsedUrl, errParse := url.Parse(exportUrl)
+	if errParse != nil {
+		err = errParse
+		return
+	}
+	var sink moqEventsSink = nil
+	switch parsedUrl.Scheme {
+	case "nats":
+		sink, err = newNatsSink(parsedUrl)
+	case "http", "https":
+		sink, err = newKafkaRestSink(parsedUrl)
+	default:
+		err = errors.New(fmt.Sprintf("Invalid events export URL scheme %q, valid: nats, http, https", parsedUrl.Scheme))
+	}
+	if err != nil {
+		return
+	}
+
+	ee = &MoqEventsExport{relayId: relayId, sink: sink, redactedUrl: parsedUrl.Redacted(), queue: make(chan moqExportedEvent, EVENTS_EXPORT_QUEUE_SIZE), done: make(chan bool), lock: new(sync.Mutex), clock: clock}
+	go ee.runSender()
+
+	log.Info(fmt.Sprintf("Exporting events to %s", ee.redactedUrl))
+	return
+}
+
+// Export Queues an event to be sent (it never blocks)
+func (ee *MoqEventsExport) Export(event moqevents.MoqEvent) {
+	if ee == nil {
+		return
+	}
+	ee.lock.Lock()
+	defer ee.lock.Unlock()
+
+	if ee.stopped {
+		return
+	}
+	select {
+	case ee.queue <- moqExportedEvent{RelayId: ee.relayId, MoqEvent: event}:
+	default:
+		log.WithFields(log.Fields{"id": event.Id, "type": event.Type}).Warning("Events export queue full, event NOT exported")
+	}
+}
+
+// Stop Sends the queued events and disconnects from the event bus
+func (ee *MoqEventsExport) Stop() {
+	if ee == nil {
+		return
+	}
+	ee.lock.Lock()
+	if ee.stopped {
+		ee.lock.Unlock()
+		return
+	}
+	ee.stopped = true
+	close(ee.queue)
+	ee.lock.Unlock()
+
+	<-ee.done
+}
+
+// Sender thread
+
+func (ee *MoqEventsExport) runSender() {
+	for {
+		event, ok := <-ee.queue
+		if !ok {
+			ee.sink.close()
+			close(ee.done)
+			return
+		}
+		batch := []moqExportedEvent{event}
+		for len(batch) < EVENTS_EXPORT_BATCH_MAX && ok {
+			select {
+			case event, ok = <-ee.queue:
+				if ok {
+					batch = append(batch, event)
+				}
+			default:
+				ok = false
+			}
+		}
+
+		errSend := ee.sink.send(batch)
+		if errSend != nil {
+			log.WithFields(log.Fields{"url": ee.redactedUrl, "droppedEvents": len(batch)}).WithError(errSend).Error("Exporting events")
+			<-ee.clock.NewTimer(EVENTS_EXPORT_RETRY_MS * time.Millisecond).C()
+		}
+	}
+}
+
+// Helpers
+
+// getEventKey Returns the key that keeps the events of the same namespace (or session) in order (ex: Kafka partition)
+func getEventKey(event moqevents.MoqEvent) string {
+	switch data := event.Data.(type) {
+	case moqevents.MoqSessionEventData:
+		return data.Session
+	case moqevents.MoqAnnounceEventData:
+		return data.TrackNamespace
+	case moqevents.MoqSubscribeEventData:
+		return data.TrackNamespace
+	case moqevents.MoqTrackEventData:
+		return data.TrackNamespace
+	}
+	return string(event.Type)
+}
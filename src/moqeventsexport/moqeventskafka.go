@@ -0,0 +1,84 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqeventsexport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const KAFKA_REST_CONTENT_TYPE = "application/vnd.kafka.json.v2+json"
+const KAFKA_REST_ACCEPT = "application/vnd.kafka.v2+json"
+
+type kafkaRestRecord struct {
+	Key   string           `json:"key"`
+	Value moqExportedEvent `json:"value"`
+}
+
+type kafkaRestRequest struct {
+	Records []kafkaRestRecord `json:"records"`
+}
+
+// kafkaRestSink Produces the events to a Kafka topic through the Confluent REST proxy (POST [proxy]/topics/[topic], API v2)
+type kafkaRestSink struct {
+	topicUrl string
+	client   *http.Client
+}
+
+func newKafkaRestSink(topicUrl *url.URL) (sink *kafkaRestSink, err error) {
+	if !strings.Contains(topicUrl.Path, "/topics/") {
+		err = errors.New(fmt.Sprintf("Kafka REST proxy URL %s does NOT have a topic (/topics/[topic])", topicUrl.Redacted()))
+		return
+	}
+	sink = &kafkaRestSink{topicUrl: topicUrl.String(), client: &http.Client{Timeout: EVENTS_EXPORT_TIMEOUT_MS * time.Millisecond}}
+	return
+}
+
+func (sink *kafkaRestSink) send(events []moqExportedEvent) (err error) {
+	request := kafkaRestRequest{Records: make([]kafkaRestRecord, 0, len(events))}
+	for _, event := range events {
+		request.Records = append(request.Records, kafkaRestRecord{Key: getEventKey(event.MoqEvent), Value: event})
+	}
+	body, errMarshal := json.Marshal(request)
+	if errMarshal != nil {
+		err = errMarshal
+		return
+	}
+
+	httpRequest, errRequest := http.NewRequest(http.MethodPost, sink.topicUrl, bytes.NewReader(body))
+	if errRequest != nil {
+		err = errRequest
+		return
+	}
+	httpRequest.Header.Set("Content-Type", KAFKA_REST_CONTENT_TYPE)
+	httpRequest.Header.Set("Accept", KAFKA_REST_ACCEPT)
+	response, errPost := sink.client.Do(httpRequest)
+	if errPost != nil {
+		err = errPost
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		err = errors.New(fmt.Sprintf("Kafka REST proxy returned %d: %s", response.StatusCode, strings.TrimSpace(string(responseBody))))
+		return
+	}
+	io.Copy(io.Discard, response.Body)
+	return
+}
+
+func (sink *kafkaRestSink) close() {
+	sink.client.CloseIdleConnections()
+}
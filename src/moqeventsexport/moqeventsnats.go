@@ -0,0 +1,113 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqeventsexport
+
+import (
+	"encoding/json"
+	"facebookexperimental/moq-go-server/moqnats"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subject prefix if the URL does NOT have a path (events go to [prefix].[event type])
+const NATS_DEFAULT_SUBJECT_PREFIX = "moq.events"
+
+const NATS_CLIENT_NAME = "moq-go-server"
+
+// natsSink Publishes the events to a NATS server, the connection is opened again after errors
+type natsSink struct {
+	config moqnats.MoqNatsConfig
+
+	// Protected (the reader thread clears it when the connection fails)
+	conn *moqnats.MoqNatsConn
+	lock *sync.Mutex
+}
+
+func newNatsSink(natsUrl *url.URL) (sink *natsSink, err error) {
+	config, err := moqnats.ParseUrl(natsUrl, NATS_DEFAULT_SUBJECT_PREFIX, NATS_CLIENT_NAME)
+	if err != nil {
+		return
+	}
+	sink = &natsSink{config: config, lock: new(sync.Mutex)}
+	return
+}
+
+func (sink *natsSink) send(events []moqExportedEvent) (err error) {
+	messages := []moqnats.MoqNatsMessage{}
+	for _, event := range events {
+		data, errMarshal := json.Marshal(event)
+		if errMarshal != nil {
+			err = errMarshal
+			return
+		}
+		messages = append(messages, moqnats.MoqNatsMessage{Subject: sink.config.Subject + "." + string(event.Type), Data: data})
+	}
+
+	conn, errConnect := sink.getConn()
+	if errConnect != nil {
+		err = errConnect
+		return
+	}
+	err = conn.Publish(messages, EVENTS_EXPORT_TIMEOUT_MS*time.Millisecond)
+	if err != nil {
+		sink.closeConn(conn)
+	}
+	return
+}
+
+func (sink *natsSink) close() {
+	sink.lock.Lock()
+	conn := sink.conn
+	sink.lock.Unlock()
+
+	if conn != nil {
+		sink.closeConn(conn)
+	}
+}
+
+// getConn Returns the current connection, or connects
+func (sink *natsSink) getConn() (conn *moqnats.MoqNatsConn, err error) {
+	sink.lock.Lock()
+	conn = sink.conn
+	sink.lock.Unlock()
+	if conn != nil {
+		return
+	}
+
+	conn, err = moqnats.Connect(sink.config, false, EVENTS_EXPORT_TIMEOUT_MS*time.Millisecond)
+	if err != nil {
+		return
+	}
+
+	sink.lock.Lock()
+	sink.conn = conn
+	sink.lock.Unlock()
+	go sink.runReader(conn)
+
+	log.Info(fmt.Sprintf("Connected to NATS %s, subjects %s.*", sink.config.Addr, sink.config.Subject))
+	return
+}
+
+func (sink *natsSink) closeConn(conn *moqnats.MoqNatsConn) {
+	sink.lock.Lock()
+	if sink.conn == conn {
+		sink.conn = nil
+	}
+	sink.lock.Unlock()
+
+	conn.Close()
+}
+
+// runReader Answers the server PINGs (keep alive) and logs its errors until the connection is closed
+func (sink *natsSink) runReader(conn *moqnats.MoqNatsConn) {
+	conn.ReadMessages(nil, EVENTS_EXPORT_TIMEOUT_MS*time.Millisecond)
+	sink.closeConn(conn)
+}
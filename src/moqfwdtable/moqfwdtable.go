@@ -8,22 +8,205 @@ package moqfwdtable
 
 import (
 	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
 	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
 	"facebookexperimental/moq-go-server/moqsession"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+const PENDING_SUBSCRIBES_CHECK_PERIOD_MS = 1000
+
+// Window used to compute per track rates
+const TRACK_STATS_WINDOW_MS = 1000
+
+// Subscribe namespace suffix to receive all tracks under a prefix (ex: "conference123/*")
+const WILDCARD_SUFFIX = "*"
+
+// What to do when 2 publishers ANNOUNCE the same namespace
+type MoqAnnouncePolicy string
+
+const (
+	MoqAnnouncePolicyRejectSecond   MoqAnnouncePolicy = "reject-second"
+	MoqAnnouncePolicyReplacePrimary MoqAnnouncePolicy = "replace-primary"
+	MoqAnnouncePolicyActiveStandby  MoqAnnouncePolicy = "active-standby"
 )
 
+type MoqAnnouncePoliciesData struct {
+	Default MoqAnnouncePolicy `json:"default"`
+	// Per namespace overrides
+	Namespaces map[string]MoqAnnouncePolicy `json:"namespaces"`
+}
+
+type MoqTrackStats struct {
+	TrackNamespace         string `json:"trackNamespace"`
+	TrackName              string `json:"trackName"`
+	Publishers             int    `json:"publishers"`
+	Subscribers            int    `json:"subscribers"`
+	ObjectsForwardedPerSec uint64 `json:"objectsForwardedPerSec"`
+	BytesForwardedPerSec   uint64 `json:"bytesForwardedPerSec"`
+	ObjectsForwarded       uint64 `json:"objectsForwarded"`
+	BytesForwarded         uint64 `json:"bytesForwarded"`
+	// Objects waiting to be sent (all subscribers)
+	QueuedObjects int `json:"queuedObjects"`
+	// Ingest (from publishers)
+	ObjectsReceivedPerSec uint64 `json:"objectsReceivedPerSec"`
+	BytesReceivedPerSec   uint64 `json:"bytesReceivedPerSec"`
+	IngestBitrateBps      uint64 `json:"ingestBitrateBps"`
+	ObjectsReceived       uint64 `json:"objectsReceived"`
+	BytesReceived         uint64 `json:"bytesReceived"`
+	// Time from object header to end of payload at ingest, last window (in milliseconds)
+	ObjectReceiveMsAvg float64 `json:"objectReceiveMsAvg"`
+	ObjectReceiveMsMax float64 `json:"objectReceiveMsMax"`
+	// Time from object header received to starting to send it to a subscriber (queue + rate limit), last window (in milliseconds)
+	ForwardLatencyMsAvg float64 `json:"forwardLatencyMsAvg"`
+	ForwardLatencyMsMax float64 `json:"forwardLatencyMsMax"`
+}
+
+// MoqNamespaceInfo Announced namespace and its publisher sessions (primary first, then standby)
+type MoqNamespaceInfo struct {
+	TrackNamespace string            `json:"trackNamespace"`
+	Publishers     []string          `json:"publishers"`
+	Policy         MoqAnnouncePolicy `json:"policy"`
+}
+
+type moqTrackCounters struct {
+	track moqsession.MoqTrack
+
+	objectsForwarded uint64
+	bytesForwarded   uint64
+
+	objectsReceived uint64
+	bytesReceived   uint64
+
+	// Current window
+	windowStart   time.Time
+	windowObjects uint64
+	windowBytes   uint64
+
+	windowObjectsReceived uint64
+	windowBytesReceived   uint64
+	windowReceiveTime     moqDurationWindow
+	windowForwardLatency  moqDurationWindow
+
+	// Last completed window
+	objectsPerSec uint64
+	bytesPerSec   uint64
+
+	objectsReceivedPerSec uint64
+	bytesReceivedPerSec   uint64
+	receiveTime           moqDurationWindow
+	forwardLatency        moqDurationWindow
+}
+
+// Durations of a window
+type moqDurationWindow struct {
+	count uint64
+	sum   time.Duration
+	max   time.Duration
+}
+
+// SUBSCRIBE forwarded to a publisher, shared by all local subscribers of that track
+type moqUpstreamSubscription struct {
+	requestId            uint64
+	publisherSessionName string
+	trackNamespace       string
+	trackName            string
+	requestedAt          time.Time
+	// Sent again to renew it
+	subscribe moqhelpers.MoqMessageSubscribe
+
+	// Subscribers waiting for the publisher answer
+	waitingSubscribers []string
+	// Local subscribers using it (refcount)
+	subscribers map[string]bool
+
+	answered    bool
+	subscribeOk moqhelpers.MoqMessageSubscribeOk
+	// From SUBSCRIBE_OK Expires (zero never)
+	expiresAt time.Time
+	// Renewal SUBSCRIBE sent, subscribers already validated
+	renewing bool
+}
+
+// Upstream SUBSCRIBE failure, new subscribes of that track are rejected until it expires
+type moqFailedSubscribe struct {
+	subscribeError moqhelpers.MoqMessageSubscribeError
+	expiresAt      time.Time
+}
+
+// SUBSCRIBE waiting for a publisher of its namespace to be connected (on demand origins)
+type moqParkedSubscribe struct {
+	subscribe             moqhelpers.MoqMessageSubscribe
+	subscriberSessionName string
+	requestedAt           time.Time
+}
+
+// Relay session that receives the local namespaces (push origins)
+type moqPushSession struct {
+	namespacePattern string
+	// Called to ANNOUNCE (true) / UNANNOUNCE (false) a local namespace upstream
+	onAnnounce func(trackNamespace string, announce bool)
+}
+
 type MoqFwdTable struct {
+	// Unique ID of this relay (loop detection)
+	RelayId string
+
 	sessions map[string]*moqsession.MoqSession
 
+	// Subscribers per track, trackNamespace/trackName -> sessionName -> session
+	trackSubscribers map[string]map[string]*moqsession.MoqSession
+
+	// Wildcard subscribers, prefix -> sessionName -> session
+	wildcardSubscribers map[string]map[string]*moqsession.MoqSession
+
+	// Per track counters, trackNamespace/trackName -> counters
+	trackCounters map[string]*moqTrackCounters
+	countersLock  *sync.Mutex
+
+	// Local publishers per namespace, primary first (then standbys)
+	namespacePublishers map[string][]string
+	announcePolicies    MoqAnnouncePoliciesData
+
+	// Forwarded subscribes by publisher session and track
+	upstreamSubscriptions      map[string]*moqUpstreamSubscription
+	lastRequestId              uint64
+	subscribeResponseTimeoutMs uint64
+	// Renew expiring upstream subscriptions (instead of ending them)
+	autoRenewSubscriptions bool
+	// Negative cache of failed upstream subscribes (no publishers / timeout), trackNamespace/trackName -> failure
+	failedSubscribes         map[string]moqFailedSubscribe
+	subscribeNegativeCacheMs uint64
+
+	// Called when a SUBSCRIBE does NOT find any publisher, returns true if a publisher for that namespace is being connected
+	onSubscribeDemand func(trackNamespace string) bool
+	// Subscribes waiting for that publisher, trackNamespace -> subscribes
+	parkedSubscribes map[string][]moqParkedSubscribe
+
+	// Sessions that receive local ANNOUNCEs, sessionName -> push session
+	pushSessions map[string]moqPushSession
+
+	// Housekeeping thread channel
+	cleanUpChannel chan bool
+
+	clock moqclock.Clock
+
 	// FilesLock Lock used to write / read files
 	lock *sync.RWMutex
 }
 
 // New Creates a new moq forward table
-func New() *MoqFwdTable {
-	mft := MoqFwdTable{sessions: map[string]*moqsession.MoqSession{}, lock: new(sync.RWMutex)}
+func New(relayId string, subscribeResponseTimeoutMs uint64, subscribeNegativeCacheMs uint64, autoRenewSubscriptions bool, clock moqclock.Clock) *MoqFwdTable {
+	mft := MoqFwdTable{RelayId: relayId, sessions: map[string]*moqsession.MoqSession{}, trackSubscribers: map[string]map[string]*moqsession.MoqSession{}, wildcardSubscribers: map[string]map[string]*moqsession.MoqSession{}, namespacePublishers: map[string][]string{}, trackCounters: map[string]*moqTrackCounters{}, countersLock: new(sync.Mutex), announcePolicies: MoqAnnouncePoliciesData{Default: MoqAnnouncePolicyRejectSecond, Namespaces: map[string]MoqAnnouncePolicy{}}, upstreamSubscriptions: map[string]*moqUpstreamSubscription{}, subscribeResponseTimeoutMs: subscribeResponseTimeoutMs, autoRenewSubscriptions: autoRenewSubscriptions, failedSubscribes: map[string]moqFailedSubscribe{}, subscribeNegativeCacheMs: subscribeNegativeCacheMs, parkedSubscribes: map[string][]moqParkedSubscribe{}, pushSessions: map[string]moqPushSession{}, cleanUpChannel: make(chan bool), clock: clock, lock: new(sync.RWMutex)}
+
+	go mft.runPendingSubscribesCheckEvery(PENDING_SUBSCRIBES_CHECK_PERIOD_MS, mft.cleanUpChannel)
 
 	return &mft
 }
@@ -42,15 +225,59 @@ func (mft *MoqFwdTable) AddSession(session *moqsession.MoqSession) (err error) {
 	return nil
 }
 
+// KickSession Closes a session with an error code and reason (its cleanup is done when the connection finishes), returns false if the session does NOT exist
+func (mft *MoqFwdTable) KickSession(sessionName string, errCode moqhelpers.MoqErrorCode, reason string) (found bool) {
+	mft.lock.RLock()
+	session, found := mft.sessions[sessionName]
+	mft.lock.RUnlock()
+
+	if !found {
+		return
+	}
+	log.WithFields(log.Fields{"session": sessionName, "errCode": errCode, "reason": reason}).Warning("Kicking session")
+	if !session.Close(errCode, reason) {
+		log.WithField("session", sessionName).Error("Session can NOT be closed, no transport")
+	}
+	return
+}
+
 func (mft *MoqFwdTable) RemoveSession(sessionName string) (err error) {
 	mft.lock.Lock()
 	defer mft.lock.Unlock()
 
 	session, found := mft.sessions[sessionName]
 	if found {
+		// Promote standbys (if any)
+		for trackNamespace := range mft.namespacePublishers {
+			mft.removeAnnouncePublisher(trackNamespace, sessionName)
+		}
+
+		// Tracks of this session disappear for wildcard subscribers
+		mft.removeWildcardTracks(session.GetActiveTracks())
+		for prefix := range mft.wildcardSubscribers {
+			mft.removeWildcardSubscriber(prefix, sessionName)
+		}
+
+		// Upstream subscriptions only used by this session
+		mft.releaseUpstreamSubscriber(sessionName, nil)
+
 		delete(mft.sessions, sessionName)
+		delete(mft.pushSessions, sessionName)
 		// Indicates sending thread to finish
 		session.StopThreads()
+		// Subscribes waiting for this session answer will NOT be answered
+		mft.removeUpstreamSubscriptionsFromPublisher(sessionName)
+		// Stop sending objects to it
+		for trackKey := range mft.trackSubscribers {
+			mft.removeTrackSubscriber(trackKey, sessionName)
+		}
+		// Other sessions of its origin pool take its tracks
+		poolSessions := mft.getPoolSessions(session.GetOriginPool(), sessionName)
+		if len(poolSessions) > 0 {
+			for _, trackNamespace := range session.GetTrackNamespaces() {
+				mft.resubscribeOrphanTracks(trackNamespace, poolSessions)
+			}
+		}
 	}
 	if !found {
 		err = errors.New(fmt.Sprintf("We could NOT find session to delete %s", sessionName))
@@ -59,43 +286,391 @@ func (mft *MoqFwdTable) RemoveSession(sessionName string) (err error) {
 	return err
 }
 
-func (mft *MoqFwdTable) ReceivedObject(cacheKey string) (err error) {
+func (mft *MoqFwdTable) ReceivedObject(trackNamespace string, trackName string, cacheKey string, moqObjHeader moqobject.MoqObjectHeader) (err error) {
 	mft.lock.RLock()
 	defer mft.lock.RUnlock()
 
+	trackKey := createTrackKey(trackNamespace, trackName)
+	subscribers := mft.trackSubscribers[trackKey]
+	for _, session := range subscribers {
+		session.ReceivedObject(trackNamespace, trackName, cacheKey, moqObjHeader)
+	}
+
+	mft.addTrackCounters(trackNamespace, trackName, uint64(len(subscribers)), 0)
+	mft.addTrackIngestCounters(trackNamespace, trackName, 1, 0)
+	return
+}
+
+// ListSessions Returns info of the sessions that match all the filters (MoqRoleNotSet / empty means any)
+func (mft *MoqFwdTable) ListSessions(role moqhelpers.MoqRole, trackNamespace string, trackName string) (sessionsInfo []moqsession.MoqSessionInfo) {
+	mft.lock.RLock()
+	defer mft.lock.RUnlock()
+
+	sessionsInfo = []moqsession.MoqSessionInfo{}
 	for _, session := range mft.sessions {
-		if (session.Role == moqhelpers.MoqRoleSubscriber || session.Role == moqhelpers.MoqRoleBoth) && session.NeedsToBeDForwarded(cacheKey) {
-			session.ReceivedObject(cacheKey)
+		if role != moqhelpers.MoqRoleNotSet && session.Role != role {
+			continue
 		}
+		if trackNamespace != "" && trackName == "" && !session.HasNamespace(trackNamespace) {
+			continue
+		}
+		if trackNamespace != "" && trackName != "" && !session.HasTrack(trackNamespace, trackName) {
+			continue
+		}
+		sessionsInfo = append(sessionsInfo, session.GetInfo())
 	}
+
+	slices.SortFunc(sessionsInfo, func(a moqsession.MoqSessionInfo, b moqsession.MoqSessionInfo) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
 	return
 }
 
-func (mft *MoqFwdTable) ForwardSubscribe(subscribe moqhelpers.MoqMessageSubscribe) (err error) {
-	anyPublishers := false
+// HasTrackSubscribers Returns true if any session is subscribed to the track
+func (mft *MoqFwdTable) HasTrackSubscribers(trackNamespace string, trackName string) bool {
+	mft.lock.RLock()
+	defer mft.lock.RUnlock()
+
+	return len(mft.trackSubscribers[createTrackKey(trackNamespace, trackName)]) > 0
+}
+
+// ReceivedObjectPayload Accounts the bytes that will be forwarded to the subscribers of the track
+func (mft *MoqFwdTable) ReceivedObjectPayload(trackNamespace string, trackName string, bytes uint64) {
+	mft.lock.RLock()
+	defer mft.lock.RUnlock()
+
+	subscribers := mft.trackSubscribers[createTrackKey(trackNamespace, trackName)]
+	mft.addTrackCounters(trackNamespace, trackName, 0, bytes*uint64(len(subscribers)))
+	mft.addTrackIngestCounters(trackNamespace, trackName, 0, bytes)
+}
+
+// ReceivedObjectEof Accounts the time it took to receive an object (from header to end of payload)
+func (mft *MoqFwdTable) ReceivedObjectEof(trackNamespace string, trackName string, receiveTime time.Duration) {
+	mft.countersLock.Lock()
+	defer mft.countersLock.Unlock()
+
+	counters := mft.getTrackCounters(moqsession.MoqTrack{TrackNamespace: trackNamespace, TrackName: trackName})
+	counters.rollWindow(mft.clock.Now())
+	counters.windowReceiveTime.add(receiveTime)
+}
+
+// ForwardingObject Accounts the time an object waited in the relay (from header received to start sending it to a subscriber)
+func (mft *MoqFwdTable) ForwardingObject(trackNamespace string, trackName string, latency time.Duration) {
+	mft.countersLock.Lock()
+	defer mft.countersLock.Unlock()
+
+	counters := mft.getTrackCounters(moqsession.MoqTrack{TrackNamespace: trackNamespace, TrackName: trackName})
+	counters.rollWindow(mft.clock.Now())
+	counters.windowForwardLatency.add(latency)
+}
+
+// ListNamespaces Returns the announced namespaces (sorted)
+func (mft *MoqFwdTable) ListNamespaces() (namespacesInfo []MoqNamespaceInfo) {
+	mft.lock.RLock()
+	defer mft.lock.RUnlock()
+
+	namespacesInfo = []MoqNamespaceInfo{}
+	for trackNamespace, publishers := range mft.namespacePublishers {
+		namespacesInfo = append(namespacesInfo, MoqNamespaceInfo{TrackNamespace: trackNamespace, Publishers: slices.Clone(publishers), Policy: mft.getAnnouncePolicy(trackNamespace)})
+	}
+	slices.SortFunc(namespacesInfo, func(a MoqNamespaceInfo, b MoqNamespaceInfo) int {
+		return strings.Compare(a.TrackNamespace, b.TrackNamespace)
+	})
+	return
+}
+
+// Stats Returns per track counters (sorted by track)
+func (mft *MoqFwdTable) Stats() (stats []MoqTrackStats) {
 	mft.lock.RLock()
 	defer mft.lock.RUnlock()
 
-	// Forward to local publishers
+	publishers := map[moqsession.MoqTrack]int{}
+	subscribedTracks := []moqsession.MoqTrack{}
 	for _, session := range mft.sessions {
-		if session.Role == moqhelpers.MoqRolePublisher {
-			if session.HasTrackNamespace(subscribe.TrackNamespace) {
-				session.ForwardSubscribe(subscribe)
-				anyPublishers = true
+		for _, track := range session.GetActiveTracks() {
+			publishers[track]++
+		}
+		subscribedTracks = append(subscribedTracks, session.GetSubscribedTracks()...)
+	}
+
+	mft.countersLock.Lock()
+	defer mft.countersLock.Unlock()
+
+	stats = []MoqTrackStats{}
+
+	// Tracks with publishers or subscribers, even if they did not receive objects yet
+	for track := range publishers {
+		mft.getTrackCounters(track)
+	}
+	for _, track := range subscribedTracks {
+		mft.getTrackCounters(track)
+	}
+
+	for trackKey, counters := range mft.trackCounters {
+		counters.rollWindow(mft.clock.Now())
+		subscribers := mft.trackSubscribers[trackKey]
+		if publishers[counters.track] == 0 && len(subscribers) == 0 {
+			// Track gone
+			delete(mft.trackCounters, trackKey)
+			continue
+		}
+
+		trackStats := MoqTrackStats{TrackNamespace: counters.track.TrackNamespace, TrackName: counters.track.TrackName, Publishers: publishers[counters.track], Subscribers: len(subscribers), ObjectsForwardedPerSec: counters.objectsPerSec, BytesForwardedPerSec: counters.bytesPerSec, ObjectsForwarded: counters.objectsForwarded, BytesForwarded: counters.bytesForwarded}
+		trackStats.ObjectsReceivedPerSec = counters.objectsReceivedPerSec
+		trackStats.BytesReceivedPerSec = counters.bytesReceivedPerSec
+		trackStats.IngestBitrateBps = counters.bytesReceivedPerSec * 8
+		trackStats.ObjectsReceived = counters.objectsReceived
+		trackStats.BytesReceived = counters.bytesReceived
+		trackStats.ObjectReceiveMsAvg, trackStats.ObjectReceiveMsMax = counters.receiveTime.getMs()
+		trackStats.ForwardLatencyMsAvg, trackStats.ForwardLatencyMsMax = counters.forwardLatency.getMs()
+		for _, session := range subscribers {
+			trackStats.QueuedObjects += session.GetQueuedObjects(counters.track.TrackNamespace, counters.track.TrackName)
+		}
+		stats = append(stats, trackStats)
+	}
+
+	slices.SortFunc(stats, func(a MoqTrackStats, b MoqTrackStats) int {
+		return strings.Compare(createTrackKey(a.TrackNamespace, a.TrackName), createTrackKey(b.TrackNamespace, b.TrackName))
+	})
+	return
+}
+
+// AddTrackSubscriber Adds a subscriber session to the objects fan-out of a track
+func (mft *MoqFwdTable) AddTrackSubscriber(trackNamespace string, trackName string, session *moqsession.MoqSession) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	trackKey := createTrackKey(trackNamespace, trackName)
+	subscribers, found := mft.trackSubscribers[trackKey]
+	if !found {
+		subscribers = map[string]*moqsession.MoqSession{}
+		mft.trackSubscribers[trackKey] = subscribers
+	}
+	subscribers[session.UniqueName] = session
+}
+
+// RemoveTrackSubscriber Removes the subscriber from the track, unsubscribes upstream if it was the last one
+func (mft *MoqFwdTable) RemoveTrackSubscriber(trackNamespace string, trackName string, sessionName string) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	mft.removeTrackSubscriber(createTrackKey(trackNamespace, trackName), sessionName)
+	mft.releaseUpstreamSubscriber(sessionName, &moqsession.MoqTrack{TrackNamespace: trackNamespace, TrackName: trackName})
+}
+
+// SetAnnouncePolicies Sets the duplicated ANNOUNCE policies (default and per namespace)
+func (mft *MoqFwdTable) SetAnnouncePolicies(policiesData MoqAnnouncePoliciesData) (err error) {
+	if policiesData.Default == "" {
+		policiesData.Default = MoqAnnouncePolicyRejectSecond
+	}
+	if policiesData.Namespaces == nil {
+		policiesData.Namespaces = map[string]MoqAnnouncePolicy{}
+	}
+	if !isValidAnnouncePolicy(policiesData.Default) {
+		err = errors.New(fmt.Sprintf("Invalid default announce policy %s", policiesData.Default))
+		return
+	}
+	for trackNamespace, policy := range policiesData.Namespaces {
+		if !isValidAnnouncePolicy(policy) {
+			err = errors.New(fmt.Sprintf("Invalid announce policy %s for namespace %s", policy, trackNamespace))
+			return
+		}
+	}
+
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	mft.announcePolicies = policiesData
+	return
+}
+
+// AddAnnouncePublisher Applies the namespace announce policy to a new local publisher of that namespace
+func (mft *MoqFwdTable) AddAnnouncePublisher(trackNamespace string, sessionName string) (err error) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	// New publisher, previous failures do NOT apply
+	for trackKey, failedSubscribe := range mft.failedSubscribes {
+		if failedSubscribe.subscribeError.TrackNamespace == trackNamespace {
+			delete(mft.failedSubscribes, trackKey)
+		}
+	}
+
+	publishers := mft.namespacePublishers[trackNamespace]
+	if slices.Contains(publishers, sessionName) {
+		return
+	}
+	if len(publishers) == 0 {
+		mft.namespacePublishers[trackNamespace] = []string{sessionName}
+		mft.announceToPushSessions(trackNamespace, true)
+		return
+	}
+
+	policy := mft.getAnnouncePolicy(trackNamespace)
+	if policy == MoqAnnouncePolicyRejectSecond {
+		err = errors.New(fmt.Sprintf("Namespace %s already announced by %s", trackNamespace, publishers[0]))
+	} else if policy == MoqAnnouncePolicyReplacePrimary {
+		for _, prevSessionName := range publishers {
+			prevSession, found := mft.sessions[prevSessionName]
+			if found {
+				prevSession.RemoveTrackNamespace(trackNamespace)
+				mft.removeWildcardTracksInNamespace(trackNamespace)
+			}
+			log.WithFields(log.Fields{"session": prevSessionName, "namespace": trackNamespace, "newPublisher": sessionName}).Info("Replaced as publisher of namespace")
+		}
+		mft.namespacePublishers[trackNamespace] = []string{sessionName}
+	} else {
+		// Standby, it receives subscribes when all previous publishers are gone
+		mft.namespacePublishers[trackNamespace] = append(publishers, sessionName)
+		log.WithFields(log.Fields{"session": sessionName, "namespace": trackNamespace, "primary": publishers[0]}).Info("Standby publisher of namespace")
+	}
+	return
+}
+
+// AddPushSession Announces upstream (via onAnnounce) the local namespaces that match the pattern, the current ones and the future ones (also when they are unannounced)
+func (mft *MoqFwdTable) AddPushSession(sessionName string, namespacePattern string, onAnnounce func(trackNamespace string, announce bool)) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	mft.pushSessions[sessionName] = moqPushSession{namespacePattern: namespacePattern, onAnnounce: onAnnounce}
+	for trackNamespace := range mft.namespacePublishers {
+		if MatchesNamespace(namespacePattern, trackNamespace) {
+			onAnnounce(trackNamespace, true)
+		}
+	}
+}
+
+func (mft *MoqFwdTable) RemoveAnnouncePublisher(trackNamespace string, sessionName string) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	mft.removeAnnouncePublisher(trackNamespace, sessionName)
+}
+
+// AddWildcardSubscriber Subscribes the session to all current and future tracks under the prefix
+func (mft *MoqFwdTable) AddWildcardSubscriber(prefix string, session *moqsession.MoqSession) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	subscribers, found := mft.wildcardSubscribers[prefix]
+	if !found {
+		subscribers = map[string]*moqsession.MoqSession{}
+		mft.wildcardSubscribers[prefix] = subscribers
+	}
+	subscribers[session.UniqueName] = session
+
+	// Tracks already active
+	for _, publisherSession := range mft.sessions {
+		for _, track := range publisherSession.GetActiveTracks() {
+			if matchesWildcard(prefix, track) {
+				mft.addWildcardTrack(session, track)
 			}
 		}
 	}
+}
+
+func (mft *MoqFwdTable) RemoveWildcardSubscriber(prefix string, sessionName string) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	session, found := mft.sessions[sessionName]
+	if found {
+		removedTracks := session.RemoveWildcardSubscriptions(func(track moqsession.MoqTrack) bool { return matchesWildcard(prefix, track) })
+		for _, track := range removedTracks {
+			mft.removeTrackSubscriber(createTrackKey(track.TrackNamespace, track.TrackName), sessionName)
+		}
+	}
+	mft.removeWildcardSubscriber(prefix, sessionName)
+}
+
+// TrackAdded Notifies a new active track (sends SUBSCRIBE_OK to matching wildcard subscribers)
+func (mft *MoqFwdTable) TrackAdded(trackNamespace string, trackName string) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	track := moqsession.MoqTrack{TrackNamespace: trackNamespace, TrackName: trackName}
+	for prefix, subscribers := range mft.wildcardSubscribers {
+		if matchesWildcard(prefix, track) {
+			for _, session := range subscribers {
+				mft.addWildcardTrack(session, track)
+			}
+		}
+	}
+}
+
+// TrackNamespaceRemoved Notifies a namespace is gone from a session (cleans up wildcard subscriptions of its tracks, promotes standbys)
+func (mft *MoqFwdTable) TrackNamespaceRemoved(trackNamespace string, sessionName string) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	mft.removeWildcardTracksInNamespace(trackNamespace)
+	mft.removeAnnouncePublisher(trackNamespace, sessionName)
+}
+
+// DetectLoop Checks if a message already went through this relay (or through too many)
+func (mft *MoqFwdTable) DetectLoop(relayTrace []string) (err error) {
+	if slices.Contains(relayTrace, mft.RelayId) {
+		err = errors.New(fmt.Sprintf("Relay loop detected, this relay %s is already in the trace %v", mft.RelayId, relayTrace))
+	} else if len(relayTrace) >= moqhelpers.MAX_RELAY_HOPS {
+		err = errors.New(fmt.Sprintf("Relay max hops %d reached, trace %v", moqhelpers.MAX_RELAY_HOPS, relayTrace))
+	}
+	return
+}
+
+func (mft *MoqFwdTable) ForwardSubscribe(subscribe moqhelpers.MoqMessageSubscribe, subscriberSessionName string) (err error) {
+	anyPublishers := false
+
+	// Add ourselves to the trace of forwarded subscribes
+	subscribe.RelayTrace = append(slices.Clone(subscribe.RelayTrace), mft.RelayId)
+
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	failedSubscribe, foundFailed := mft.failedSubscribes[createTrackKey(subscribe.TrackNamespace, subscribe.TrackName)]
+	if foundFailed && failedSubscribe.expiresAt.After(mft.clock.Now()) {
+		err = errors.New(fmt.Sprintf("Recent SUBSCRIBE for %s/%s failed (%s), try again later", subscribe.TrackNamespace, subscribe.TrackName, failedSubscribe.subscribeError.ErrMsg))
+		return
+	}
+
+	// Forward to local (primary) publisher
+	publishers := mft.namespacePublishers[subscribe.TrackNamespace]
+	if len(publishers) > 0 {
+		session, found := mft.sessions[publishers[0]]
+		if found && session.HasTrackNamespace(subscribe.TrackNamespace) {
+			mft.addUpstreamSubscriber(subscribe, subscriberSessionName, session)
+			anyPublishers = true
+		}
+	}
 
 	if !anyPublishers {
 		// If not found locally forward to relays
+		relaySessions := []*moqsession.MoqSession{}
 		for _, session := range mft.sessions {
 			if session.Role == moqhelpers.MoqRoleBoth {
 				if session.HasTrackNamespace(subscribe.TrackNamespace) {
-					session.ForwardSubscribe(subscribe)
-					anyPublishers = true
+					relaySessions = append(relaySessions, session)
 				}
 			}
 		}
+		for _, session := range mft.shardPoolSessions(relaySessions, subscribe.TrackNamespace, subscribe.TrackName) {
+			mft.addUpstreamSubscriber(subscribe, subscriberSessionName, session)
+			anyPublishers = true
+		}
+	}
+	if !anyPublishers {
+		// Relays that offer a prefix of the namespace (longest prefix wins)
+		for _, session := range mft.shardPoolSessions(mft.findPrefixRelaySessions(subscribe.TrackNamespace), subscribe.TrackNamespace, subscribe.TrackName) {
+			// Next subscribes of this namespace will match directly
+			session.AddTrackNamespace(moqhelpers.CreateAnnounce(subscribe.TrackNamespace, ""))
+			mft.addUpstreamSubscriber(subscribe, subscriberSessionName, session)
+			anyPublishers = true
+		}
+	}
+	if !anyPublishers && mft.onSubscribeDemand != nil && mft.onSubscribeDemand(subscribe.TrackNamespace) {
+		// Forwarded when the publisher connects (or rejected on timeout)
+		mft.parkedSubscribes[subscribe.TrackNamespace] = append(mft.parkedSubscribes[subscribe.TrackNamespace], moqParkedSubscribe{subscribe: subscribe, subscriberSessionName: subscriberSessionName, requestedAt: mft.clock.Now()})
+		log.WithFields(log.Fields{"session": subscriberSessionName, "namespace": subscribe.TrackNamespace, "track": subscribe.TrackName}).Info("Waiting for a publisher to connect to forward SUBSCRIBE")
+		anyPublishers = true
 	}
 	if !anyPublishers {
 		err = errors.New(fmt.Sprintf("We could NOT find any publishers for TrackNamespace %s", subscribe.TrackNamespace))
@@ -104,50 +679,728 @@ func (mft *MoqFwdTable) ForwardSubscribe(subscribe moqhelpers.MoqMessageSubscrib
 	return
 }
 
-func (mft *MoqFwdTable) ForwardSubscribeOk(subscribeOk moqhelpers.MoqMessageSubscribeOk) (err error) {
-	anyUpdatedPublishers := false
+// SetOnSubscribeDemand Sets the function called when a SUBSCRIBE does NOT find any publisher, if it returns true the SUBSCRIBE waits for a publisher of that namespace (see ForwardParkedSubscribes)
+func (mft *MoqFwdTable) SetOnSubscribeDemand(onSubscribeDemand func(trackNamespace string) bool) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	mft.onSubscribeDemand = onSubscribeDemand
+}
+
+// ForwardParkedSubscribes Forwards the subscribes waiting for a publisher to that (just connected) publisher session
+func (mft *MoqFwdTable) ForwardParkedSubscribes(publisherSession *moqsession.MoqSession) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	for trackNamespace, parkedSubscribes := range mft.parkedSubscribes {
+		if !publisherSession.HasTrackNamespace(trackNamespace) {
+			if !slices.Contains(mft.findPrefixRelaySessions(trackNamespace), publisherSession) {
+				continue
+			}
+			publisherSession.AddTrackNamespace(moqhelpers.CreateAnnounce(trackNamespace, ""))
+		}
+		delete(mft.parkedSubscribes, trackNamespace)
+		for _, parked := range parkedSubscribes {
+			mft.addUpstreamSubscriber(parked.subscribe, parked.subscriberSessionName, publisherSession)
+		}
+	}
+}
+
+// ResubscribeOrphanTracks Forwards to that publisher (or to other sessions of its pool) the subscriptions of the namespace that have NO upstream subscription (ex: previous origin session finished), subscribers keep their subscriptions
+func (mft *MoqFwdTable) ResubscribeOrphanTracks(trackNamespace string, publisherSession *moqsession.MoqSession) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	mft.resubscribeOrphanTracks(trackNamespace, append(mft.getPoolSessions(publisherSession.GetOriginPool(), publisherSession.UniqueName), publisherSession))
+}
+
+// resubscribeOrphanTracks (needs lock)
+func (mft *MoqFwdTable) resubscribeOrphanTracks(trackNamespace string, publisherSessions []*moqsession.MoqSession) {
+	resubscribedSessions := map[string]bool{}
+	for _, subscribers := range mft.trackSubscribers {
+		for _, subscriberSession := range subscribers {
+			if resubscribedSessions[subscriberSession.UniqueName] {
+				continue
+			}
+			resubscribedSessions[subscriberSession.UniqueName] = true
+
+			for _, track := range subscriberSession.GetSubscribedTracks() {
+				if !MatchesNamespace(trackNamespace, track.TrackNamespace) || mft.hasUpstreamSubscription(track) {
+					continue
+				}
+				for _, publisherSession := range mft.shardPoolSessions(publisherSessions, track.TrackNamespace, track.TrackName) {
+					log.WithFields(log.Fields{"session": subscriberSession.UniqueName, "namespace": track.TrackNamespace, "track": track.TrackName, "publisher": publisherSession.UniqueName}).Info("Resubscribing orphan track")
+					subscribe := moqhelpers.MoqMessageSubscribe{TrackNamespace: track.TrackNamespace, TrackName: track.TrackName, RelayTrace: []string{mft.RelayId}}
+					mft.addUpstreamSubscriber(subscribe, subscriberSession.UniqueName, publisherSession)
+				}
+			}
+		}
+	}
+}
+
+// GetNamespaceDemand Returns the number of upstream subscriptions (plus subscribes waiting for a publisher) of that namespace
+func (mft *MoqFwdTable) GetNamespaceDemand(trackNamespace string) (demand int) {
 	mft.lock.RLock()
 	defer mft.lock.RUnlock()
 
-	// TODO: Moqbug I need a way to identify the subscribe answer from publisher to source subscriber session
-	// Here is sending OK to all subscribed
+	for _, upstream := range mft.upstreamSubscriptions {
+		if MatchesNamespace(trackNamespace, upstream.trackNamespace) {
+			demand++
+		}
+	}
+	for parkedTrackNamespace, parkedSubscribes := range mft.parkedSubscribes {
+		if MatchesNamespace(trackNamespace, parkedTrackNamespace) {
+			demand += len(parkedSubscribes)
+		}
+	}
+	return
+}
+
+func (mft *MoqFwdTable) ForwardSubscribeOk(subscribeOk moqhelpers.MoqMessageSubscribeOk, publisherSessionName string) (err error) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	upstream, found := mft.upstreamSubscriptions[createUpstreamKey(publisherSessionName, subscribeOk.TrackNamespace, subscribeOk.TrackName)]
+	if !found || upstream.answered {
+		err = errors.New(fmt.Sprintf("We could NOT find any pending SUBSCRIBE for %s/%s from %s", subscribeOk.TrackNamespace, subscribeOk.TrackName, publisherSessionName))
+		return
+	}
+
+	if subscribeOk.Expires > 0 {
+		upstream.expiresAt = mft.clock.Now().Add(time.Duration(subscribeOk.Expires) * time.Millisecond)
+		if mft.autoRenewSubscriptions {
+			// Relay takes care of renewing it
+			subscribeOk.Expires = 0
+		}
+	}
+	upstream.answered = true
+	upstream.renewing = false
+	upstream.subscribeOk = subscribeOk
+	for _, subscriberSessionName := range upstream.waitingSubscribers {
+		mft.answerSubscriber(subscriberSessionName, subscribeOk)
+	}
+	upstream.waitingSubscribers = []string{}
+
+	return
+}
+
+func (mft *MoqFwdTable) ForwardSubscribeError(subscribeError moqhelpers.MoqMessageSubscribeError, publisherSessionName string) (err error) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	key := createUpstreamKey(publisherSessionName, subscribeError.TrackNamespace, subscribeError.TrackName)
+	upstream, found := mft.upstreamSubscriptions[key]
+	if !found || upstream.answered {
+		err = errors.New(fmt.Sprintf("We could NOT find any pending SUBSCRIBE for %s/%s from %s", subscribeError.TrackNamespace, subscribeError.TrackName, publisherSessionName))
+		return
+	}
+
+	delete(mft.upstreamSubscriptions, key)
+	mft.failUpstreamSubscription(upstream, subscribeError)
+	if subscribeError.ErrCode == moqhelpers.ErrorSubscribeNoPublishers {
+		mft.addFailedSubscribe(subscribeError)
+	}
+
+	return
+}
+
+func (mft *MoqFwdTable) Stop() {
+	// Send finish signal
+	mft.cleanUpChannel <- true
+
+	// Wait to finish
+	<-mft.cleanUpChannel
+}
+
+// Upstream subscriptions (one per publisher and track, shared by all local subscribers)
+
+func (mft *MoqFwdTable) addUpstreamSubscriber(subscribe moqhelpers.MoqMessageSubscribe, subscriberSessionName string, publisherSession *moqsession.MoqSession) {
+	key := createUpstreamKey(publisherSession.UniqueName, subscribe.TrackNamespace, subscribe.TrackName)
+	upstream, found := mft.upstreamSubscriptions[key]
+	if !found {
+		// First subscriber, subscribe upstream
+		mft.lastRequestId++
+		upstream = &moqUpstreamSubscription{requestId: mft.lastRequestId, publisherSessionName: publisherSession.UniqueName, trackNamespace: subscribe.TrackNamespace, trackName: subscribe.TrackName, requestedAt: mft.clock.Now(), subscribe: subscribe, waitingSubscribers: []string{subscriberSessionName}, subscribers: map[string]bool{subscriberSessionName: true}}
+		mft.upstreamSubscriptions[key] = upstream
+		publisherSession.ForwardSubscribe(createWarmUpSubscribe(subscribe, publisherSession.GetWarmUpGroups()))
+
+		log.WithFields(log.Fields{"session": subscriberSessionName, "requestId": upstream.requestId, "namespace": subscribe.TrackNamespace, "track": subscribe.TrackName, "publisher": publisherSession.UniqueName}).Info("Forwarding SUBSCRIBE request")
+		return
+	}
+
+	upstream.subscribers[subscriberSessionName] = true
+	if upstream.answered {
+		mft.answerSubscriber(subscriberSessionName, upstream.subscribeOk)
+	} else if !slices.Contains(upstream.waitingSubscribers, subscriberSessionName) {
+		upstream.waitingSubscribers = append(upstream.waitingSubscribers, subscriberSessionName)
+	}
+	log.WithFields(log.Fields{"session": subscriberSessionName, "requestId": upstream.requestId, "namespace": subscribe.TrackNamespace, "track": subscribe.TrackName, "publisher": publisherSession.UniqueName, "subscribers": len(upstream.subscribers)}).Info("Reusing SUBSCRIBE request")
+}
+
+// releaseUpstreamSubscriber Removes the subscriber from the upstream subscriptions of the track (nil for all), unsubscribes upstream when nobody is left
+func (mft *MoqFwdTable) releaseUpstreamSubscriber(subscriberSessionName string, track *moqsession.MoqTrack) {
+	mft.removeParkedSubscribes(func(parked moqParkedSubscribe) bool {
+		return parked.subscriberSessionName == subscriberSessionName && (track == nil || (parked.subscribe.TrackNamespace == track.TrackNamespace && parked.subscribe.TrackName == track.TrackName))
+	})
+
+	for key, upstream := range mft.upstreamSubscriptions {
+		if !upstream.subscribers[subscriberSessionName] {
+			continue
+		}
+		if track != nil && (upstream.trackNamespace != track.TrackNamespace || upstream.trackName != track.TrackName) {
+			continue
+		}
+
+		delete(upstream.subscribers, subscriberSessionName)
+		waitingSubscribers := []string{}
+		for _, waitingSubscriber := range upstream.waitingSubscribers {
+			if waitingSubscriber != subscriberSessionName {
+				waitingSubscribers = append(waitingSubscribers, waitingSubscriber)
+			}
+		}
+		upstream.waitingSubscribers = waitingSubscribers
+
+		if len(upstream.subscribers) == 0 {
+			delete(mft.upstreamSubscriptions, key)
+			publisherSession, found := mft.sessions[upstream.publisherSessionName]
+			if found {
+				log.WithFields(log.Fields{"session": upstream.publisherSessionName, "namespace": upstream.trackNamespace, "track": upstream.trackName, "requestId": upstream.requestId}).Info("Last subscriber left, sending UNSUBSCRIBE")
+				publisherSession.ForwardUnSubscribe(moqhelpers.MoqMessageUnSubscribe{TrackNamespace: upstream.trackNamespace, TrackName: upstream.trackName})
+			}
+		}
+	}
+}
+
+func (mft *MoqFwdTable) answerSubscriber(subscriberSessionName string, subscribeOk moqhelpers.MoqMessageSubscribeOk) {
+	session, found := mft.sessions[subscriberSessionName]
+	if !found {
+		return
+	}
+
+	// Only first answer is sent (subscribe can be forwarded to several publishers)
+	updated, localTrackId := session.HasPendingTrackSubscriptionUpdate(subscribeOk.TrackNamespace, subscribeOk.TrackName, subscribeOk.TrackId, subscribeOk.Expires)
+	if updated {
+		// Subscriber only knows its own track alias
+		subscribeOk.TrackId = localTrackId
+		session.ForwardSubscribeResponseOk(subscribeOk)
+	}
+}
+
+// hasUpstreamSubscription Returns true if the track is subscribed upstream to any publisher (needs lock)
+func (mft *MoqFwdTable) hasUpstreamSubscription(track moqsession.MoqTrack) bool {
+	for _, upstream := range mft.upstreamSubscriptions {
+		if upstream.trackNamespace == track.TrackNamespace && upstream.trackName == track.TrackName {
+			return true
+		}
+	}
+	return false
+}
+
+// shardPoolSessions Keeps only one session per origin pool: the one that already has that track subscribed, or the one with less upstream subscriptions (needs lock)
+func (mft *MoqFwdTable) shardPoolSessions(sessions []*moqsession.MoqSession, trackNamespace string, trackName string) (sharded []*moqsession.MoqSession) {
+	selectedPoolSessions := map[string]*moqsession.MoqSession{}
+	for _, session := range sessions {
+		pool := session.GetOriginPool()
+		if pool == "" {
+			sharded = append(sharded, session)
+			continue
+		}
+		selected, found := selectedPoolSessions[pool]
+		if !found {
+			selectedPoolSessions[pool] = session
+			continue
+		}
+		_, selectedHasTrack := mft.upstreamSubscriptions[createUpstreamKey(selected.UniqueName, trackNamespace, trackName)]
+		_, hasTrack := mft.upstreamSubscriptions[createUpstreamKey(session.UniqueName, trackNamespace, trackName)]
+		if hasTrack || (!selectedHasTrack && mft.getUpstreamSubscriptionsCount(session.UniqueName) < mft.getUpstreamSubscriptionsCount(selected.UniqueName)) {
+			selectedPoolSessions[pool] = session
+		}
+	}
+	for _, session := range selectedPoolSessions {
+		sharded = append(sharded, session)
+	}
+	return
+}
+
+// getPoolSessions Returns the sessions of that origin pool but exceptSessionName (needs lock)
+func (mft *MoqFwdTable) getPoolSessions(pool string, exceptSessionName string) (sessions []*moqsession.MoqSession) {
+	if pool == "" {
+		return
+	}
 	for _, session := range mft.sessions {
-		if session.Role == moqhelpers.MoqRoleSubscriber || session.Role == moqhelpers.MoqRoleBoth {
-			updated := session.HasPendingTrackSubscriptionUpdate(subscribeOk.TrackNamespace, subscribeOk.TrackName, subscribeOk.TrackId, subscribeOk.Expires)
-			if updated {
-				session.ForwardSubscribeResponseOk(subscribeOk)
-				anyUpdatedPublishers = true
+		if session.UniqueName != exceptSessionName && session.GetOriginPool() == pool {
+			sessions = append(sessions, session)
+		}
+	}
+	return
+}
+
+func (mft *MoqFwdTable) getUpstreamSubscriptionsCount(publisherSessionName string) (count int) {
+	for _, upstream := range mft.upstreamSubscriptions {
+		if upstream.publisherSessionName == publisherSessionName {
+			count++
+		}
+	}
+	return
+}
+
+func (mft *MoqFwdTable) isWaitingUpstream(subscriberSessionName string, trackNamespace string, trackName string) bool {
+	for _, upstream := range mft.upstreamSubscriptions {
+		if upstream.trackNamespace == trackNamespace && upstream.trackName == trackName && slices.Contains(upstream.waitingSubscribers, subscriberSessionName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mft *MoqFwdTable) failUpstreamSubscription(upstream *moqUpstreamSubscription, subscribeError moqhelpers.MoqMessageSubscribeError) {
+	for _, subscriberSessionName := range upstream.waitingSubscribers {
+		// Wait for other publishers answers (if any)
+		if mft.isWaitingUpstream(subscriberSessionName, upstream.trackNamespace, upstream.trackName) {
+			continue
+		}
+
+		session, found := mft.sessions[subscriberSessionName]
+		if !found {
+			continue
+		}
+		mft.rejectSubscriber(session, subscribeError)
+	}
+}
+
+// rejectSubscriber Sends SUBSCRIBE_ERROR to a subscriber waiting for the answer, or SUBSCRIBE_RST if it was already answered from the cache (needs lock)
+func (mft *MoqFwdTable) rejectSubscriber(session *moqsession.MoqSession, subscribeError moqhelpers.MoqMessageSubscribeError) {
+	trackKey := createTrackKey(subscribeError.TrackNamespace, subscribeError.TrackName)
+	if session.HasPendingTrackSubscriptionDelete(subscribeError.TrackNamespace, subscribeError.TrackName) {
+		mft.removeTrackSubscriber(trackKey, session.UniqueName)
+		session.ForwardSubscribeResponseError(subscribeError)
+		return
+	}
+	ended, finalGroup, finalObject := session.EndSubscription(subscribeError.TrackNamespace, subscribeError.TrackName)
+	if ended {
+		mft.removeTrackSubscriber(trackKey, session.UniqueName)
+		session.ForwardSubscribeRst(moqhelpers.MoqMessageSubscribeRst{TrackNamespace: subscribeError.TrackNamespace, TrackName: subscribeError.TrackName, ErrCode: subscribeError.ErrCode, ErrMsg: subscribeError.ErrMsg, FinalGroup: finalGroup, FinalObject: finalObject})
+	}
+}
+
+func (mft *MoqFwdTable) removeUpstreamSubscriptionsFromPublisher(publisherSessionName string) {
+	for key, upstream := range mft.upstreamSubscriptions {
+		if upstream.publisherSessionName == publisherSessionName {
+			delete(mft.upstreamSubscriptions, key)
+			mft.failUpstreamSubscription(upstream, moqhelpers.MoqMessageSubscribeError{TrackNamespace: upstream.trackNamespace, TrackName: upstream.trackName, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: "Publisher session finished"})
+		}
+	}
+}
+
+// Housekeeping
+
+func (mft *MoqFwdTable) runPendingSubscribesCheckEvery(periodMs uint64, cleanUpChannelBidi chan bool) {
+	timeCh := mft.clock.NewTicker(time.Millisecond * time.Duration(periodMs))
+	defer timeCh.Stop()
+	exit := false
+
+	for !exit {
+		select {
+		// Wait for the next tick
+		case tm := <-timeCh.C():
+			mft.expirePendingSubscribes(tm)
+			mft.expireSubscriptions(tm)
+
+		case <-cleanUpChannelBidi:
+			exit = true
+		}
+	}
+	// Indicates finished
+	cleanUpChannelBidi <- true
+
+	log.Info("Exited pending subscribes check thread")
+}
+
+func (mft *MoqFwdTable) expirePendingSubscribes(now time.Time) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	expiredUpstreams := []*moqUpstreamSubscription{}
+	for key, upstream := range mft.upstreamSubscriptions {
+		if !upstream.answered && upstream.requestedAt.Add(time.Duration(mft.subscribeResponseTimeoutMs)*time.Millisecond).Before(now) {
+			delete(mft.upstreamSubscriptions, key)
+			expiredUpstreams = append(expiredUpstreams, upstream)
+		}
+	}
+
+	for _, upstream := range expiredUpstreams {
+		log.WithFields(log.Fields{"session": upstream.publisherSessionName, "requestId": upstream.requestId, "namespace": upstream.trackNamespace, "track": upstream.trackName, "waitingSubscribers": upstream.waitingSubscribers}).Error("SUBSCRIBE request NOT answered")
+		subscribeError := moqhelpers.MoqMessageSubscribeError{TrackNamespace: upstream.trackNamespace, TrackName: upstream.trackName, ErrCode: moqhelpers.ErrorSubscribeTimeout, ErrMsg: "Timeout waiting for publisher answer"}
+		mft.failUpstreamSubscription(upstream, subscribeError)
+		if upstream.renewing {
+			mft.endUpstreamSubscription(upstream, moqhelpers.ErrorSubscribeTimeout, "Timeout renewing subscription")
+		} else {
+			mft.addFailedSubscribe(subscribeError)
+		}
+	}
+
+	for trackKey, failedSubscribe := range mft.failedSubscribes {
+		if !failedSubscribe.expiresAt.After(now) {
+			delete(mft.failedSubscribes, trackKey)
+		}
+	}
+
+	expiredParked := mft.removeParkedSubscribes(func(parked moqParkedSubscribe) bool {
+		return parked.requestedAt.Add(time.Duration(mft.subscribeResponseTimeoutMs) * time.Millisecond).Before(now)
+	})
+	for _, parked := range expiredParked {
+		log.WithFields(log.Fields{"session": parked.subscriberSessionName, "namespace": parked.subscribe.TrackNamespace, "track": parked.subscribe.TrackName}).Error("SUBSCRIBE expired waiting for a publisher to connect")
+		session, found := mft.sessions[parked.subscriberSessionName]
+		if !found {
+			continue
+		}
+		mft.rejectSubscriber(session, moqhelpers.MoqMessageSubscribeError{TrackNamespace: parked.subscribe.TrackNamespace, TrackName: parked.subscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeTimeout, ErrMsg: "Timeout waiting for publisher to connect"})
+	}
+}
+
+// removeParkedSubscribes Removes the parked subscribes that match, returns them (needs lock)
+func (mft *MoqFwdTable) removeParkedSubscribes(match func(parked moqParkedSubscribe) bool) (removed []moqParkedSubscribe) {
+	for trackNamespace, parkedSubscribes := range mft.parkedSubscribes {
+		kept := []moqParkedSubscribe{}
+		for _, parked := range parkedSubscribes {
+			if match(parked) {
+				removed = append(removed, parked)
+			} else {
+				kept = append(kept, parked)
 			}
 		}
+		if len(kept) == 0 {
+			delete(mft.parkedSubscribes, trackNamespace)
+		} else {
+			mft.parkedSubscribes[trackNamespace] = kept
+		}
+	}
+	return
+}
+
+// addFailedSubscribe Rejects the new subscribes of that track for a while (needs lock)
+func (mft *MoqFwdTable) addFailedSubscribe(subscribeError moqhelpers.MoqMessageSubscribeError) {
+	if mft.subscribeNegativeCacheMs == 0 {
+		return
+	}
+	mft.failedSubscribes[createTrackKey(subscribeError.TrackNamespace, subscribeError.TrackName)] = moqFailedSubscribe{subscribeError: subscribeError, expiresAt: mft.clock.Now().Add(time.Duration(mft.subscribeNegativeCacheMs) * time.Millisecond)}
+	log.WithFields(log.Fields{"namespace": subscribeError.TrackNamespace, "track": subscribeError.TrackName, "durationMs": mft.subscribeNegativeCacheMs, "error": subscribeError.ErrMsg}).Info("Caching SUBSCRIBE failure")
+}
+
+// expireSubscriptions Renews or ends the upstream subscriptions past their SUBSCRIBE_OK Expires
+func (mft *MoqFwdTable) expireSubscriptions(now time.Time) {
+	mft.lock.Lock()
+	defer mft.lock.Unlock()
+
+	for key, upstream := range mft.upstreamSubscriptions {
+		if !upstream.answered || upstream.expiresAt.IsZero() || upstream.expiresAt.After(now) {
+			continue
+		}
+		publisherSession, found := mft.sessions[upstream.publisherSessionName]
+		if mft.autoRenewSubscriptions && found {
+			log.WithFields(log.Fields{"session": upstream.publisherSessionName, "namespace": upstream.trackNamespace, "track": upstream.trackName, "requestId": upstream.requestId}).Info("Subscription expired, renewing it")
+			upstream.answered = false
+			upstream.renewing = true
+			upstream.requestedAt = now
+			upstream.expiresAt = time.Time{}
+			publisherSession.ForwardSubscribe(upstream.subscribe)
+			continue
+		}
+
+		log.WithFields(log.Fields{"session": upstream.publisherSessionName, "namespace": upstream.trackNamespace, "track": upstream.trackName, "requestId": upstream.requestId, "subscribers": len(upstream.subscribers)}).Info("Subscription expired, ending it")
+		delete(mft.upstreamSubscriptions, key)
+		mft.endUpstreamSubscription(upstream, moqhelpers.ErrorSubscribeExpired, "Subscription expired")
+		if found {
+			publisherSession.ForwardUnSubscribe(moqhelpers.MoqMessageUnSubscribe{TrackNamespace: upstream.trackNamespace, TrackName: upstream.trackName})
+		}
+	}
+}
+
+// endUpstreamSubscription Terminates the subscription of all (validated) subscribers sending SUBSCRIBE_RST
+func (mft *MoqFwdTable) endUpstreamSubscription(upstream *moqUpstreamSubscription, errCode moqhelpers.MoqErrorCodeSubscribe, errMsg string) {
+	for subscriberSessionName := range upstream.subscribers {
+		session, found := mft.sessions[subscriberSessionName]
+		if !found {
+			continue
+		}
+		ended, finalGroup, finalObject := session.EndSubscription(upstream.trackNamespace, upstream.trackName)
+		if ended {
+			mft.removeTrackSubscriber(createTrackKey(upstream.trackNamespace, upstream.trackName), session.UniqueName)
+			session.ForwardSubscribeRst(moqhelpers.MoqMessageSubscribeRst{TrackNamespace: upstream.trackNamespace, TrackName: upstream.trackName, ErrCode: errCode, ErrMsg: errMsg, FinalGroup: finalGroup, FinalObject: finalObject})
+		}
+	}
+}
+
+func (mft *MoqFwdTable) removeTrackSubscriber(trackKey string, sessionName string) {
+	subscribers, found := mft.trackSubscribers[trackKey]
+	if found {
+		delete(subscribers, sessionName)
+		if len(subscribers) == 0 {
+			delete(mft.trackSubscribers, trackKey)
+		}
+	}
+}
+
+// Track counters
+
+func (mft *MoqFwdTable) addTrackCounters(trackNamespace string, trackName string, objects uint64, bytes uint64) {
+	mft.countersLock.Lock()
+	defer mft.countersLock.Unlock()
+
+	counters := mft.getTrackCounters(moqsession.MoqTrack{TrackNamespace: trackNamespace, TrackName: trackName})
+	counters.rollWindow(mft.clock.Now())
+	counters.objectsForwarded += objects
+	counters.bytesForwarded += bytes
+	counters.windowObjects += objects
+	counters.windowBytes += bytes
+}
+
+func (mft *MoqFwdTable) addTrackIngestCounters(trackNamespace string, trackName string, objects uint64, bytes uint64) {
+	mft.countersLock.Lock()
+	defer mft.countersLock.Unlock()
+
+	counters := mft.getTrackCounters(moqsession.MoqTrack{TrackNamespace: trackNamespace, TrackName: trackName})
+	counters.rollWindow(mft.clock.Now())
+	counters.objectsReceived += objects
+	counters.bytesReceived += bytes
+	counters.windowObjectsReceived += objects
+	counters.windowBytesReceived += bytes
+}
+
+func (mft *MoqFwdTable) getTrackCounters(track moqsession.MoqTrack) *moqTrackCounters {
+	trackKey := createTrackKey(track.TrackNamespace, track.TrackName)
+	counters, found := mft.trackCounters[trackKey]
+	if !found {
+		counters = &moqTrackCounters{track: track, windowStart: mft.clock.Now()}
+		mft.trackCounters[trackKey] = counters
+	}
+	return counters
+}
+
+func (c *moqTrackCounters) rollWindow(now time.Time) {
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < TRACK_STATS_WINDOW_MS*time.Millisecond {
+		return
 	}
+	c.objectsPerSec = uint64(float64(c.windowObjects) / elapsed.Seconds())
+	c.bytesPerSec = uint64(float64(c.windowBytes) / elapsed.Seconds())
+	c.objectsReceivedPerSec = uint64(float64(c.windowObjectsReceived) / elapsed.Seconds())
+	c.bytesReceivedPerSec = uint64(float64(c.windowBytesReceived) / elapsed.Seconds())
+	c.receiveTime = c.windowReceiveTime
+	c.forwardLatency = c.windowForwardLatency
+	c.windowObjects = 0
+	c.windowBytes = 0
+	c.windowObjectsReceived = 0
+	c.windowBytesReceived = 0
+	c.windowReceiveTime = moqDurationWindow{}
+	c.windowForwardLatency = moqDurationWindow{}
+	c.windowStart = now
+}
 
-	if !anyUpdatedPublishers {
-		err = errors.New(fmt.Sprintf("We could NOT find any publishers for %s", subscribeOk.TrackNamespace))
+func (w *moqDurationWindow) add(d time.Duration) {
+	w.count++
+	w.sum += d
+	if d > w.max {
+		w.max = d
 	}
+}
 
+// getMs Returns the average and max (in milliseconds)
+func (w *moqDurationWindow) getMs() (avgMs float64, maxMs float64) {
+	if w.count == 0 {
+		return
+	}
+	avgMs = float64(w.sum.Microseconds()) / float64(w.count) / 1000
+	maxMs = float64(w.max.Microseconds()) / 1000
 	return
 }
 
-func (mft *MoqFwdTable) ForwardSubscribeError(subscribeError moqhelpers.MoqMessageSubscribeError) (err error) {
-	anyDeletedPublishers := false
-	mft.lock.RLock()
-	defer mft.lock.RUnlock()
+// Announce policies
 
-	// TODO: Moqbug I need a way to identify the subscribe answer from publisher to source subscriber session
-	// Here is sending OK to all subscribed
-	for _, session := range mft.sessions {
-		if session.Role == moqhelpers.MoqRoleSubscriber || session.Role == moqhelpers.MoqRoleBoth {
-			deleted := session.HasPendingTrackSubscriptionDelete(subscribeError.TrackNamespace, subscribeError.TrackName)
-			if deleted {
-				session.ForwardSubscribeResponseError(subscribeError)
-				anyDeletedPublishers = true
+func (mft *MoqFwdTable) getAnnouncePolicy(trackNamespace string) MoqAnnouncePolicy {
+	policy, found := mft.announcePolicies.Namespaces[trackNamespace]
+	if !found {
+		policy = mft.announcePolicies.Default
+	}
+	return policy
+}
+
+func (mft *MoqFwdTable) removeAnnouncePublisher(trackNamespace string, sessionName string) {
+	publishers := mft.namespacePublishers[trackNamespace]
+	index := slices.Index(publishers, sessionName)
+	if index < 0 {
+		return
+	}
+	publishers = slices.Delete(slices.Clone(publishers), index, index+1)
+	if len(publishers) == 0 {
+		delete(mft.namespacePublishers, trackNamespace)
+		mft.announceToPushSessions(trackNamespace, false)
+		return
+	}
+	mft.namespacePublishers[trackNamespace] = publishers
+
+	if index == 0 {
+		// Failover, the standby receives all current subscriptions of that namespace
+		newPrimary, found := mft.sessions[publishers[0]]
+		if found {
+			log.WithFields(log.Fields{"session": newPrimary.UniqueName, "namespace": trackNamespace}).Info("Promoted to primary publisher of namespace")
+			mft.resubscribeNamespace(trackNamespace, newPrimary)
+		}
+	}
+}
+
+func (mft *MoqFwdTable) resubscribeNamespace(trackNamespace string, publisherSession *moqsession.MoqSession) {
+	resubscribedSessions := map[string]bool{}
+	for _, subscribers := range mft.trackSubscribers {
+		for _, subscriberSession := range subscribers {
+			if resubscribedSessions[subscriberSession.UniqueName] {
+				continue
+			}
+			resubscribedSessions[subscriberSession.UniqueName] = true
+
+			for _, track := range subscriberSession.GetSubscribedTracks() {
+				if track.TrackNamespace == trackNamespace {
+					subscribe := moqhelpers.MoqMessageSubscribe{TrackNamespace: track.TrackNamespace, TrackName: track.TrackName, RelayTrace: []string{mft.RelayId}}
+					mft.addUpstreamSubscriber(subscribe, subscriberSession.UniqueName, publisherSession)
+				}
 			}
 		}
 	}
+}
 
-	if !anyDeletedPublishers {
-		err = errors.New(fmt.Sprintf("We could NOT find any publishers for %s", subscribeError.TrackNamespace))
+// announceToPushSessions (needs lock)
+func (mft *MoqFwdTable) announceToPushSessions(trackNamespace string, announce bool) {
+	for sessionName, pushSession := range mft.pushSessions {
+		if MatchesNamespace(pushSession.namespacePattern, trackNamespace) {
+			log.WithFields(log.Fields{"session": sessionName, "namespace": trackNamespace, "announce": announce}).Info("Pushing local namespace upstream")
+			pushSession.onAnnounce(trackNamespace, announce)
+		}
 	}
+}
+
+func isValidAnnouncePolicy(policy MoqAnnouncePolicy) bool {
+	return policy == MoqAnnouncePolicyRejectSecond || policy == MoqAnnouncePolicyReplacePrimary || policy == MoqAnnouncePolicyActiveStandby
+}
+
+// Wildcards
 
+func (mft *MoqFwdTable) addWildcardTrack(session *moqsession.MoqSession, track moqsession.MoqTrack) {
+	added, localTrackId, err := session.AddWildcardSubscription(track.TrackNamespace, track.TrackName)
+	if err != nil {
+		log.WithFields(log.Fields{"session": session.UniqueName, "namespace": track.TrackNamespace, "track": track.TrackName}).WithError(err).Error("Adding wildcard track")
+		return
+	}
+	if !added {
+		return
+	}
+
+	trackKey := createTrackKey(track.TrackNamespace, track.TrackName)
+	subscribers, found := mft.trackSubscribers[trackKey]
+	if !found {
+		subscribers = map[string]*moqsession.MoqSession{}
+		mft.trackSubscribers[trackKey] = subscribers
+	}
+	subscribers[session.UniqueName] = session
+
+	session.ForwardSubscribeResponseOk(moqhelpers.MoqMessageSubscribeOk{TrackNamespace: track.TrackNamespace, TrackName: track.TrackName, TrackId: localTrackId, Expires: 0})
+}
+
+func (mft *MoqFwdTable) removeWildcardTracks(tracks []moqsession.MoqTrack) {
+	for _, subscribers := range mft.wildcardSubscribers {
+		for _, session := range subscribers {
+			removedTracks := session.RemoveWildcardSubscriptions(func(track moqsession.MoqTrack) bool { return slices.Contains(tracks, track) })
+			for _, track := range removedTracks {
+				mft.removeTrackSubscriber(createTrackKey(track.TrackNamespace, track.TrackName), session.UniqueName)
+			}
+		}
+	}
+}
+
+func (mft *MoqFwdTable) removeWildcardTracksInNamespace(trackNamespace string) {
+	for _, subscribers := range mft.wildcardSubscribers {
+		for _, session := range subscribers {
+			removedTracks := session.RemoveWildcardSubscriptions(func(track moqsession.MoqTrack) bool { return track.TrackNamespace == trackNamespace })
+			for _, track := range removedTracks {
+				mft.removeTrackSubscriber(createTrackKey(track.TrackNamespace, track.TrackName), session.UniqueName)
+			}
+		}
+	}
+}
+
+func (mft *MoqFwdTable) removeWildcardSubscriber(prefix string, sessionName string) {
+	subscribers, found := mft.wildcardSubscribers[prefix]
+	if found {
+		delete(subscribers, sessionName)
+		if len(subscribers) == 0 {
+			delete(mft.wildcardSubscribers, prefix)
+		}
+	}
+}
+
+// GetWildcardPrefix Returns the prefix if the namespace is a wildcard subscription
+func GetWildcardPrefix(trackNamespace string) (isWildcard bool, prefix string) {
+	if strings.HasSuffix(trackNamespace, WILDCARD_SUFFIX) {
+		isWildcard = true
+		prefix = strings.TrimSuffix(trackNamespace, WILDCARD_SUFFIX)
+	}
+	return
+}
+
+// MatchesNamespace Returns true if trackNamespace is pattern, or starts with its prefix if pattern is a prefix pattern (ex: "vod/*")
+func MatchesNamespace(pattern string, trackNamespace string) bool {
+	isWildcard, prefix := GetWildcardPrefix(pattern)
+	if isWildcard {
+		return strings.HasPrefix(trackNamespace, prefix)
+	}
+	return pattern == trackNamespace
+}
+
+// findPrefixRelaySessions Returns the relay sessions with the longest prefix pattern that matches trackNamespace (needs lock)
+func (mft *MoqFwdTable) findPrefixRelaySessions(trackNamespace string) (sessions []*moqsession.MoqSession) {
+	longestPrefix := -1
+	for _, session := range mft.sessions {
+		if session.Role != moqhelpers.MoqRoleBoth {
+			continue
+		}
+		for _, pattern := range session.GetTrackNamespaces() {
+			isWildcard, prefix := GetWildcardPrefix(pattern)
+			if !isWildcard || !strings.HasPrefix(trackNamespace, prefix) || len(prefix) < longestPrefix {
+				continue
+			}
+			if len(prefix) > longestPrefix {
+				longestPrefix = len(prefix)
+				sessions = []*moqsession.MoqSession{}
+			}
+			if !slices.Contains(sessions, session) {
+				sessions = append(sessions, session)
+			}
+		}
+	}
 	return
 }
+
+// matchesWildcard Returns true if the track namespace is under the wildcard prefix (same as any other namespace pattern, the track name is NOT matched)
+func matchesWildcard(prefix string, track moqsession.MoqTrack) bool {
+	return MatchesNamespace(prefix+WILDCARD_SUFFIX, track.TrackNamespace)
+}
+
+func createTrackKey(trackNamespace string, trackName string) string {
+	return trackNamespace + "/" + trackName
+}
+
+func createUpstreamKey(publisherSessionName string, trackNamespace string, trackName string) string {
+	return publisherSessionName + "|" + createTrackKey(trackNamespace, trackName)
+}
+
+// createWarmUpSubscribe Starts the upstream subscription warmUpGroups groups back (cache warm up), explicit (absolute) or further starts are kept
+func createWarmUpSubscribe(subscribe moqhelpers.MoqMessageSubscribe, warmUpGroups uint64) moqhelpers.MoqMessageSubscribe {
+	if warmUpGroups == 0 || subscribe.StartGroup.Type == moqhelpers.MoqLocationTypeAbsolute {
+		return subscribe
+	}
+	if subscribe.StartGroup.Type == moqhelpers.MoqLocationTypeRelativePrevious && subscribe.StartGroup.Value >= warmUpGroups {
+		return subscribe
+	}
+	subscribe.StartGroup = moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeRelativePrevious, Value: warmUpGroups}
+	subscribe.StartObject = moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeAbsolute, Value: 0}
+	return subscribe
+}
@@ -0,0 +1,267 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqfwdtable
+
+import (
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subscribers of the fan-out benchmark track and their queue size (drop oldest, nobody reads them)
+const BENCH_FANOUT_SUBSCRIBERS = 100
+const BENCH_FANOUT_QUEUE_SIZE = 64
+
+const TEST_NAMESPACE = "live"
+const TEST_TRACK_NAME = "channel-1/video-1080p"
+
+const TEST_RELAY_ID = "test-relay"
+const TEST_SUBSCRIBE_RESPONSE_TIMEOUT_MS = 5000
+const TEST_SUBSCRIBE_EXPIRES_MS = 1500
+
+// Upstream subscription past its SUBSCRIBE_OK Expires is ended (SUBSCRIBE_RST to subscribers and UNSUBSCRIBE upstream) or renewed
+func TestSubscriptionExpires(t *testing.T) {
+	tests := []struct {
+		name      string
+		autoRenew bool
+		// Expires the subscribers are answered with
+		wantSubscriberExpires uint64
+	}{
+		{name: "ends it", autoRenew: false, wantSubscriberExpires: TEST_SUBSCRIBE_EXPIRES_MS},
+		{name: "renews it", autoRenew: true, wantSubscriberExpires: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := moqclock.NewFake(time.Unix(0, 0))
+			fwdTable := New(TEST_RELAY_ID, TEST_SUBSCRIBE_RESPONSE_TIMEOUT_MS, 0, tt.autoRenew, clock)
+			defer fwdTable.Stop()
+			publisher, subscriber := subscribeTestTrack(t, fwdTable, clock)
+
+			if err := fwdTable.ForwardSubscribeOk(moqhelpers.MoqMessageSubscribeOk{TrackNamespace: TEST_NAMESPACE, TrackName: TEST_TRACK_NAME, TrackId: 1, Expires: TEST_SUBSCRIBE_EXPIRES_MS}, publisher.UniqueName); err != nil {
+				t.Fatalf("Forwarding SUBSCRIBE_OK, err: %v", err)
+			}
+			subscribeOk, msgType, _ := subscriber.GetNewSubscribeResponse()
+			if msgType != moqhelpers.MoqIdSubscribeOk || subscribeOk.(moqhelpers.MoqMessageSubscribeOk).Expires != tt.wantSubscriberExpires {
+				t.Fatalf("Subscriber answer %d %+v, want SUBSCRIBE_OK with expires %d", msgType, subscribeOk, tt.wantSubscriberExpires)
+			}
+
+			clock.Advance(TEST_SUBSCRIBE_EXPIRES_MS*time.Millisecond - time.Millisecond)
+			fwdTable.expireSubscriptions(clock.Now())
+			if !isAnsweredUpstream(fwdTable) {
+				t.Fatalf("Subscription should NOT expire before its expires")
+			}
+
+			clock.Advance(time.Millisecond)
+			fwdTable.expireSubscriptions(clock.Now())
+			if isAnsweredUpstream(fwdTable) {
+				t.Fatalf("Subscription should expire after its expires")
+			}
+			subscribe, unSubscribe, _ := publisher.GetNewSubscribe()
+			if subscribe.TrackName != TEST_TRACK_NAME || unSubscribe == tt.autoRenew {
+				t.Fatalf("Publisher got %+v (unsubscribe %t), want unsubscribe %t", subscribe, unSubscribe, !tt.autoRenew)
+			}
+			if tt.autoRenew {
+				if !fwdTable.HasTrackSubscribers(TEST_NAMESPACE, TEST_TRACK_NAME) {
+					t.Fatalf("Renewed subscription should keep its subscribers")
+				}
+				return
+			}
+			subscribeRst, msgType, _ := subscriber.GetNewSubscribeResponse()
+			if msgType != moqhelpers.MoqIdSubscribeRst || subscribeRst.(moqhelpers.MoqMessageSubscribeRst).ErrCode != moqhelpers.ErrorSubscribeExpired {
+				t.Fatalf("Subscriber got %d %+v, want SUBSCRIBE_RST expired", msgType, subscribeRst)
+			}
+		})
+	}
+}
+
+// Upstream subscription NOT answered in time is rejected to its subscribers
+func TestSubscribeResponseTimeout(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	fwdTable := New(TEST_RELAY_ID, TEST_SUBSCRIBE_RESPONSE_TIMEOUT_MS, 0, false, clock)
+	defer fwdTable.Stop()
+	_, subscriber := subscribeTestTrack(t, fwdTable, clock)
+
+	clock.Advance(TEST_SUBSCRIBE_RESPONSE_TIMEOUT_MS * time.Millisecond)
+	fwdTable.expirePendingSubscribes(clock.Now())
+	if !fwdTable.HasTrackSubscribers(TEST_NAMESPACE, TEST_TRACK_NAME) {
+		t.Fatalf("SUBSCRIBE should NOT time out before the response timeout")
+	}
+
+	clock.Advance(time.Millisecond)
+	fwdTable.expirePendingSubscribes(clock.Now())
+	if fwdTable.HasTrackSubscribers(TEST_NAMESPACE, TEST_TRACK_NAME) {
+		t.Fatalf("SUBSCRIBE should time out after the response timeout")
+	}
+	subscribeError, msgType, _ := subscriber.GetNewSubscribeResponse()
+	if msgType != moqhelpers.MoqIdSubscribeError || subscribeError.(moqhelpers.MoqMessageSubscribeError).ErrCode != moqhelpers.ErrorSubscribeTimeout {
+		t.Fatalf("Subscriber got %d %+v, want SUBSCRIBE_ERROR timeout", msgType, subscribeError)
+	}
+}
+
+// Subscriber answered from the cache (before the upstream answer) gets SUBSCRIBE_RST if the upstream SUBSCRIBE fails
+func TestSubscribeAnsweredFromCacheUpstreamError(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	fwdTable := New(TEST_RELAY_ID, TEST_SUBSCRIBE_RESPONSE_TIMEOUT_MS, 0, false, clock)
+	defer fwdTable.Stop()
+	publisher, subscriber := subscribeTestTrack(t, fwdTable, clock)
+	if updated, _ := subscriber.HasPendingTrackSubscriptionUpdate(TEST_NAMESPACE, TEST_TRACK_NAME, 1, 0); !updated {
+		t.Fatalf("Subscription should be pending before the cache answer")
+	}
+
+	if err := fwdTable.ForwardSubscribeError(moqhelpers.MoqMessageSubscribeError{TrackNamespace: TEST_NAMESPACE, TrackName: TEST_TRACK_NAME, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: "Track not found"}, publisher.UniqueName); err != nil {
+		t.Fatalf("Forwarding SUBSCRIBE_ERROR, err: %v", err)
+	}
+	subscribeRst, msgType, _ := subscriber.GetNewSubscribeResponse()
+	if msgType != moqhelpers.MoqIdSubscribeRst || subscribeRst.(moqhelpers.MoqMessageSubscribeRst).ErrCode != moqhelpers.ErrorSubscribeNoPublishers {
+		t.Fatalf("Subscriber got %d %+v, want SUBSCRIBE_RST no publishers", msgType, subscribeRst)
+	}
+	if fwdTable.HasTrackSubscribers(TEST_NAMESPACE, TEST_TRACK_NAME) || subscriber.HasTrack(TEST_NAMESPACE, TEST_TRACK_NAME) {
+		t.Fatalf("Reset subscription should be removed")
+	}
+}
+
+// Wildcard subscriptions match the namespaces under the prefix, NOT the tracks of the parent namespace (namespace/name)
+func TestWildcardSubscriberMatchesNamespace(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	fwdTable := New(TEST_RELAY_ID, TEST_SUBSCRIBE_RESPONSE_TIMEOUT_MS, 0, false, clock)
+	defer fwdTable.Stop()
+	publisher := moqsession.New("publisher", moqhelpers.MOQ_SUPPORTED_VERSION, moqhelpers.MoqRolePublisher, moqsession.MoqSessionMetadata{}, 16, moqsession.MoqObjQueuePolicyDropOldest, false, clock)
+	subscriber := moqsession.New("subscriber", moqhelpers.MOQ_SUPPORTED_VERSION, moqhelpers.MoqRoleSubscriber, moqsession.MoqSessionMetadata{}, 16, moqsession.MoqObjQueuePolicyDropOldest, false, clock)
+	for _, session := range []*moqsession.MoqSession{publisher, subscriber} {
+		if err := fwdTable.AddSession(session); err != nil {
+			t.Fatalf("Adding session %s, err: %v", session.UniqueName, err)
+		}
+	}
+	tracks := []moqsession.MoqTrack{{TrackNamespace: "live", TrackName: "room1"}, {TrackNamespace: "live/room1", TrackName: "video"}}
+	for i, track := range tracks {
+		publisher.AddTrackNamespace(moqhelpers.CreateAnnounce(track.TrackNamespace, ""))
+		if err := publisher.AddTrackInfo(track.TrackNamespace, track.TrackName, uint64(i)); err != nil {
+			t.Fatalf("Adding track %+v, err: %v", track, err)
+		}
+	}
+
+	_, prefix := GetWildcardPrefix("live/*")
+	fwdTable.AddWildcardSubscriber(prefix, subscriber)
+	fwdTable.TrackAdded("live", "room2")
+	fwdTable.TrackAdded("live/room2", "audio")
+
+	wantTracks := map[moqsession.MoqTrack]bool{{TrackNamespace: "live/room1", TrackName: "video"}: true, {TrackNamespace: "live/room2", TrackName: "audio"}: true}
+	for _, track := range append(tracks, moqsession.MoqTrack{TrackNamespace: "live", TrackName: "room2"}, moqsession.MoqTrack{TrackNamespace: "live/room2", TrackName: "audio"}) {
+		if subscribed := subscriber.HasTrack(track.TrackNamespace, track.TrackName); subscribed != wantTracks[track] {
+			t.Fatalf("Track %s/%s subscribed %t, want %t", track.TrackNamespace, track.TrackName, subscribed, wantTracks[track])
+		}
+	}
+}
+
+// BenchmarkFwdTableFanOut Object received in a track with BENCH_FANOUT_SUBSCRIBERS subscribers (queued in all of them)
+func BenchmarkFwdTableFanOut(b *testing.B) {
+	disableLogs(b)
+	clock := moqclock.New()
+	fwdTable := New("bench-relay", 0, 0, false, clock)
+	defer fwdTable.Stop()
+
+	for _, session := range getFanOutSubscribers(b, clock) {
+		fwdTable.AddTrackSubscriber(TEST_NAMESPACE, TEST_TRACK_NAME, session)
+	}
+
+	header := moqobject.MoqObjectHeader{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		header.ObjectSequence = uint64(i)
+		cacheKey := TEST_NAMESPACE + "/" + TEST_TRACK_NAME + "/0/" + strconv.FormatUint(header.ObjectSequence, 10)
+		if fwdTable.ReceivedObject(TEST_NAMESPACE, TEST_TRACK_NAME, cacheKey, header) != nil {
+			b.Fatal("Fanning out object")
+		}
+	}
+}
+
+// Helpers
+
+// Sessions are big (internal channels), created once and shared by all the runs of the fan-out benchmark
+var fanOutSubscribers []*moqsession.MoqSession
+var fanOutSubscribersOnce sync.Once
+
+func getFanOutSubscribers(tb testing.TB, clock moqclock.Clock) []*moqsession.MoqSession {
+	fanOutSubscribersOnce.Do(func() {
+		fanOutSubscribers = []*moqsession.MoqSession{}
+		for i := 0; i < BENCH_FANOUT_SUBSCRIBERS; i++ {
+			session := newSubscriberSession(tb, fmt.Sprintf("subscriber-%d", i), BENCH_FANOUT_QUEUE_SIZE, clock)
+			// Answered, so it gets the objects
+			session.HasPendingTrackSubscriptionUpdate(TEST_NAMESPACE, TEST_TRACK_NAME, 1, 0)
+			fanOutSubscribers = append(fanOutSubscribers, session)
+		}
+	})
+	return fanOutSubscribers
+}
+
+// subscribeTestTrack Subscriber SUBSCRIBE to the test track forwarded to the publisher of its namespace
+func subscribeTestTrack(t *testing.T, fwdTable *MoqFwdTable, clock moqclock.Clock) (publisher *moqsession.MoqSession, subscriber *moqsession.MoqSession) {
+	publisher = moqsession.New("publisher", moqhelpers.MOQ_SUPPORTED_VERSION, moqhelpers.MoqRolePublisher, moqsession.MoqSessionMetadata{}, 16, moqsession.MoqObjQueuePolicyDropOldest, false, clock)
+	publisher.SetState(moqsession.MoqSessionStateEstablished)
+	publisher.AddTrackNamespace(moqhelpers.CreateAnnounce(TEST_NAMESPACE, ""))
+	subscriber = newSubscriberSession(t, "subscriber", 16, clock)
+	for _, session := range []*moqsession.MoqSession{publisher, subscriber} {
+		if err := fwdTable.AddSession(session); err != nil {
+			t.Fatalf("Adding session %s, err: %v", session.UniqueName, err)
+		}
+	}
+	if err := fwdTable.AddAnnouncePublisher(TEST_NAMESPACE, publisher.UniqueName); err != nil {
+		t.Fatalf("Adding publisher, err: %v", err)
+	}
+
+	fwdTable.AddTrackSubscriber(TEST_NAMESPACE, TEST_TRACK_NAME, subscriber)
+	if err := fwdTable.ForwardSubscribe(moqhelpers.MoqMessageSubscribe{TrackNamespace: TEST_NAMESPACE, TrackName: TEST_TRACK_NAME}, subscriber.UniqueName); err != nil {
+		t.Fatalf("Forwarding SUBSCRIBE, err: %v", err)
+	}
+	subscribe, unSubscribe, _ := publisher.GetNewSubscribe()
+	if subscribe.TrackName != TEST_TRACK_NAME || unSubscribe {
+		t.Fatalf("Publisher got %+v (unsubscribe %t), want SUBSCRIBE", subscribe, unSubscribe)
+	}
+	return
+}
+
+// newSubscriberSession Established session subscribed to the test track
+func newSubscriberSession(tb testing.TB, name string, queueSize int, clock moqclock.Clock) *moqsession.MoqSession {
+	session := moqsession.New(name, moqhelpers.MOQ_SUPPORTED_VERSION, moqhelpers.MoqRoleSubscriber, moqsession.MoqSessionMetadata{}, queueSize, moqsession.MoqObjQueuePolicyDropOldest, false, clock)
+	session.SetState(moqsession.MoqSessionStateEstablished)
+	_, _, _, err := session.AddSubscribeRequest(moqhelpers.MoqMessageSubscribe{TrackNamespace: TEST_NAMESPACE, TrackName: TEST_TRACK_NAME}, moqsession.MoqDuplicateSubscribePolicyReject)
+	if err != nil {
+		tb.Fatalf("Subscribing, err: %v", err)
+	}
+	return session
+}
+
+// isAnsweredUpstream Returns true if the test track has an answered upstream subscription
+func isAnsweredUpstream(fwdTable *MoqFwdTable) bool {
+	fwdTable.lock.RLock()
+	defer fwdTable.lock.RUnlock()
+
+	for _, upstream := range fwdTable.upstreamSubscriptions {
+		if upstream.answered && upstream.trackNamespace == TEST_NAMESPACE && upstream.trackName == TEST_TRACK_NAME {
+			return true
+		}
+	}
+	return false
+}
+
+// disableLogs Logs are NOT free, they distort the benchmark numbers
+func disableLogs(tb testing.TB) {
+	level := log.GetLevel()
+	log.SetLevel(log.FatalLevel)
+	tb.Cleanup(func() {
+		log.SetLevel(level)
+	})
+}
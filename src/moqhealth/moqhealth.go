@@ -0,0 +1,150 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqhealth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const HEALTH_SHUTDOWN_TIMEOUT_MS = 5000
+
+// MoqHealthCheck Returns an error if the component is NOT healthy
+type MoqHealthCheck func() error
+
+type MoqHealthCheckResult struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type MoqHealthResult struct {
+	Ok     bool                   `json:"ok"`
+	Checks []MoqHealthCheckResult `json:"checks"`
+}
+
+type moqHealthNamedCheck struct {
+	name  string
+	check MoqHealthCheck
+}
+
+// MoqHealth Plain HTTP (TCP) listener for load balancer probes, /healthz (liveness) and /readyz (readiness)
+type MoqHealth struct {
+	server *http.Server
+
+	// Protected
+	livenessChecks  []moqHealthNamedCheck
+	readinessChecks []moqHealthNamedCheck
+	lock            *sync.RWMutex
+}
+
+// New Creates the health server (with no checks it is always healthy)
+func New(listenAddr string) *MoqHealth {
+	mux := http.NewServeMux()
+	health := &MoqHealth{server: &http.Server{Addr: listenAddr, Handler: mux}, livenessChecks: []moqHealthNamedCheck{}, readinessChecks: []moqHealthNamedCheck{}, lock: new(sync.RWMutex)}
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		health.writeResult(w, r, health.CheckLiveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		health.writeResult(w, r, health.CheckReadiness())
+	})
+	return health
+}
+
+// AddLivenessCheck Adds a check to /healthz (also to /readyz, a NOT alive relay is NOT ready)
+func (health *MoqHealth) AddLivenessCheck(name string, check MoqHealthCheck) {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	health.livenessChecks = append(health.livenessChecks, moqHealthNamedCheck{name: name, check: check})
+}
+
+// AddReadinessCheck Adds a check to /readyz
+func (health *MoqHealth) AddReadinessCheck(name string, check MoqHealthCheck) {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	health.readinessChecks = append(health.readinessChecks, moqHealthNamedCheck{name: name, check: check})
+}
+
+// CheckLiveness Runs the liveness checks
+func (health *MoqHealth) CheckLiveness() MoqHealthResult {
+	health.lock.RLock()
+	checks := append([]moqHealthNamedCheck{}, health.livenessChecks...)
+	health.lock.RUnlock()
+
+	return runChecks(checks)
+}
+
+// CheckReadiness Runs the liveness and readiness checks
+func (health *MoqHealth) CheckReadiness() MoqHealthResult {
+	health.lock.RLock()
+	checks := append(append([]moqHealthNamedCheck{}, health.livenessChecks...), health.readinessChecks...)
+	health.lock.RUnlock()
+
+	return runChecks(checks)
+}
+
+func (health *MoqHealth) ListenAndServe() error {
+	log.Info(fmt.Sprintf("Serving health checks. Addr: %s", health.server.Addr))
+
+	err := health.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+func (health *MoqHealth) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	return health.server.Shutdown(ctx)
+}
+
+func (health *MoqHealth) writeResult(w http.ResponseWriter, r *http.Request, result MoqHealthResult) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if result.Ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	errEncode := json.NewEncoder(w).Encode(result)
+	if errEncode != nil {
+		log.Error(fmt.Sprintf("Health check encoding response. Err: %v", errEncode))
+	}
+}
+
+// Helpers
+
+func runChecks(checks []moqHealthNamedCheck) (result MoqHealthResult) {
+	result = MoqHealthResult{Ok: true, Checks: []MoqHealthCheckResult{}}
+	for _, namedCheck := range checks {
+		checkResult := MoqHealthCheckResult{Name: namedCheck.name, Ok: true}
+		errCheck := namedCheck.check()
+		if errCheck != nil {
+			checkResult.Ok = false
+			checkResult.Error = errCheck.Error()
+			result.Ok = false
+		}
+		result.Checks = append(result.Checks, checkResult)
+	}
+	return
+}
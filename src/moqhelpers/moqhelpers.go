@@ -7,6 +7,7 @@ LICENSE file in the root directory of this source tree.
 package moqhelpers
 
 import (
+	"bytes"
 	"errors"
 	"facebookexperimental/moq-go-server/moqhelpers/quichelpers"
 	"facebookexperimental/moq-go-server/moqobject"
@@ -21,6 +22,9 @@ const READ_BLOCK_SIZE_BYTES = 1024
 const MAX_PROTOCOL_VERSIONS = 10
 const MAX_PARAMS = 256
 const MOQ_MAX_STRING_LENGTH = 1024
+const MOQ_MAX_AUTH_TOKEN_LENGTH = 8192
+const MOQ_MAX_UNKNOWN_PARAM_LENGTH = 64 * 1024
+const MAX_RELAY_HOPS = 16
 
 type MoqVersion uint
 
@@ -38,8 +42,30 @@ const (
 	MoqParamsRole              MoqParams = 0x0
 	MoqParamsPath              MoqParams = 0x1
 	MoqParamsAuthorizationInfo MoqParams = 0x2
+	// Structured token (MoQ common auth token), value is length prefixed
+	MoqParamsAuthorizationToken MoqParams = 0x3
+	// List of relay IDs the message went through (loop detection), value is length prefixed
+	MoqParamsRelayTrace MoqParams = 0x4
 )
 
+// Authorization token
+
+type MoqAuthTokenAliasType uint64
+
+const (
+	MoqAuthTokenAliasTypeDelete   MoqAuthTokenAliasType = 0x0
+	MoqAuthTokenAliasTypeRegister MoqAuthTokenAliasType = 0x1
+	MoqAuthTokenAliasTypeUseAlias MoqAuthTokenAliasType = 0x2
+	MoqAuthTokenAliasTypeUseValue MoqAuthTokenAliasType = 0x3
+)
+
+type MoqAuthToken struct {
+	AliasType MoqAuthTokenAliasType
+	Alias     uint64
+	TokenType uint64
+	Value     string
+}
+
 type MoqRole uint
 
 const (
@@ -76,6 +102,12 @@ const (
 	MoqIdMessageAnnounceOk    MoqMessageType = 0x7
 	MoqIdMessageAnnounceError MoqMessageType = 0x8
 	MoqIdMessageUnAnnounce    MoqMessageType = 0x9
+	MoqIdUnSubscribe          MoqMessageType = 0xa
+	MoqIdSubscribeRst         MoqMessageType = 0xc
+	MoqIdMessageGoAway        MoqMessageType = 0x10
+
+	// Relay extension in the private range (0xff00 - 0xfffe, NOT used by the drafts, 0x2 is OBJECT without length in draft-01), object with its payload length so several objects can share a stream (batched egress)
+	MoqIdMessageObjectWithLength MoqMessageType = 0xff01
 
 	InternalId MoqMessageType = 0xffff
 )
@@ -86,6 +118,8 @@ const (
 type MoqMessageClientSetup struct {
 	SupportedClientVersions []MoqVersion
 	Role                    MoqRole
+	// Only used in raw QUIC (WebTransport uses the URL path)
+	Path string
 }
 
 type MoqMessageServerSetup struct {
@@ -115,6 +149,8 @@ type MoqError struct {
 type MoqMessageAnnounce struct {
 	TrackNamespace string
 	AuthInfo       string
+	AuthToken      *MoqAuthToken
+	RelayTrace     []string
 }
 
 type MoqMessageAnnounceOk struct {
@@ -124,9 +160,12 @@ type MoqMessageAnnounceOk struct {
 type MoqErrorCodeAnnounce uint64
 
 const (
-	NoErrorAnnounce          MoqErrorCodeAnnounce = 0x0
-	ErrorAnnounceGeneric     MoqErrorCodeAnnounce = 0x1
-	ErrorAnnounceAddingTrack MoqErrorCodeAnnounce = 0x2
+	NoErrorAnnounce           MoqErrorCodeAnnounce = 0x0
+	ErrorAnnounceGeneric      MoqErrorCodeAnnounce = 0x1
+	ErrorAnnounceAddingTrack  MoqErrorCodeAnnounce = 0x2
+	ErrorAnnounceUnauthorized MoqErrorCodeAnnounce = 0x3
+	ErrorAnnounceLoopDetected MoqErrorCodeAnnounce = 0x4
+	ErrorAnnounceDuplicated   MoqErrorCodeAnnounce = 0x5
 )
 
 type MoqMessageAnnounceError struct {
@@ -135,6 +174,20 @@ type MoqMessageAnnounceError struct {
 	ErrMsg         string
 }
 
+type MoqMessageUnAnnounce struct {
+	TrackNamespace string
+}
+
+// GoAway (server asks the client to move to a new session, no fields in draft-01)
+type MoqMessageGoAway struct {
+}
+
+// Object with payload length (the payload follows, then the next object or the end of stream)
+type MoqMessageObjectWithLength struct {
+	moqobject.MoqObjectHeader
+	PayloadLength uint64
+}
+
 // Subscribe
 
 type MoqMessageSubscribe struct {
@@ -145,6 +198,8 @@ type MoqMessageSubscribe struct {
 	EndGroup       MoqLocation
 	EndObject      MoqLocation
 	AuthInfo       string
+	AuthToken      *MoqAuthToken
+	RelayTrace     []string
 }
 
 type MoqMessageSubscribeOk struct {
@@ -161,6 +216,12 @@ const (
 	ErrorSubscribeGeneric      MoqErrorCodeSubscribe = 0x1
 	ErrorSubscribeAddingTrack  MoqErrorCodeSubscribe = 0x2
 	ErrorSubscribeNoPublishers MoqErrorCodeSubscribe = 0x3
+	ErrorSubscribeUnauthorized MoqErrorCodeSubscribe = 0x4
+	ErrorSubscribeLoopDetected MoqErrorCodeSubscribe = 0x5
+	ErrorSubscribeTimeout      MoqErrorCodeSubscribe = 0x6
+	ErrorSubscribeExpired      MoqErrorCodeSubscribe = 0x7
+	ErrorSubscribeDuplicated   MoqErrorCodeSubscribe = 0x8
+	ErrorSubscribeRateLimited  MoqErrorCodeSubscribe = 0x9
 )
 
 type MoqMessageSubscribeError struct {
@@ -170,6 +231,21 @@ type MoqMessageSubscribeError struct {
 	ErrMsg         string
 }
 
+// Subscription terminated by the publisher (or relay)
+type MoqMessageSubscribeRst struct {
+	TrackNamespace string
+	TrackName      string
+	ErrCode        MoqErrorCodeSubscribe
+	ErrMsg         string
+	FinalGroup     uint64
+	FinalObject    uint64
+}
+
+type MoqMessageUnSubscribe struct {
+	TrackNamespace string
+	TrackName      string
+}
+
 func CreateAnnounceOK(moqAnnounce MoqMessageAnnounce) (moqAnnounceOk MoqMessageAnnounceOk) {
 	moqAnnounceOk.TrackNamespace = moqAnnounce.TrackNamespace
 
@@ -225,6 +301,8 @@ func ReceiveMessage(stream quichelpers.IWtReadableStream) (moqMessage interface{
 
 	if msgType == uint64(MoqIdMessageObject) {
 		moqMessage, err = receiveObjectHeader(stream)
+	} else if msgType == uint64(MoqIdMessageObjectWithLength) {
+		moqMessage, err = receiveObjectWithLength(stream)
 	} else if msgType == uint64(MoqIdMessageClientSetup) {
 		moqMessage, err = receiveClientSetUp(stream)
 	} else if msgType == uint64(MoqIdMessageServerSetup) {
@@ -239,6 +317,14 @@ func ReceiveMessage(stream quichelpers.IWtReadableStream) (moqMessage interface{
 		moqMessage, err = receiveSubscribeError(stream)
 	} else if msgType == uint64(MoqIdMessageAnnounceOk) {
 		moqMessage, err = receiveAnnounceOk(stream)
+	} else if msgType == uint64(MoqIdMessageUnAnnounce) {
+		moqMessage, err = receiveUnAnnounce(stream)
+	} else if msgType == uint64(MoqIdUnSubscribe) {
+		moqMessage, err = receiveUnSubscribe(stream)
+	} else if msgType == uint64(MoqIdSubscribeRst) {
+		moqMessage, err = receiveSubscribeRst(stream)
+	} else if msgType == uint64(MoqIdMessageGoAway) {
+		moqMessage = MoqMessageGoAway{}
 	} else {
 		err = errors.New(fmt.Sprintf("MOQ not supported message type %d", msgType))
 	}
@@ -258,6 +344,39 @@ func receiveAnnounceOk(stream quichelpers.IWtReadableStream) (moqAnnounceOk MoqM
 	return
 }
 
+func receiveUnAnnounce(stream quichelpers.IWtReadableStream) (moqUnAnnounce MoqMessageUnAnnounce, err error) {
+	// rx UNANNOUNCE
+
+	trackNamespace, errTrackNamespace := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errTrackNamespace != nil {
+		err = errors.New(fmt.Sprintf("MOQ UNANNOUNCE reading TrackNmespace, err: %v", errTrackNamespace))
+		return
+	}
+	moqUnAnnounce.TrackNamespace = trackNamespace
+
+	return
+}
+
+func receiveUnSubscribe(stream quichelpers.IWtReadableStream) (moqUnSubscribe MoqMessageUnSubscribe, err error) {
+	// rx UNSUBSCRIBE
+
+	trackNamespace, errTrackNamespace := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errTrackNamespace != nil {
+		err = errors.New(fmt.Sprintf("MOQ UNSUBSCRIBE reading TrackNmespace, err: %v", errTrackNamespace))
+		return
+	}
+	moqUnSubscribe.TrackNamespace = trackNamespace
+
+	trackName, errTrackName := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errTrackName != nil {
+		err = errors.New(fmt.Sprintf("MOQ UNSUBSCRIBE reading trackName, err: %v", errTrackName))
+		return
+	}
+	moqUnSubscribe.TrackName = trackName
+
+	return
+}
+
 func receiveSubscribeOk(stream quichelpers.IWtReadableStream) (moqSubscribeOk MoqMessageSubscribeOk, err error) {
 	// rx SUBSCRIBE OK
 
@@ -326,6 +445,54 @@ func receiveSubscribeError(stream quichelpers.IWtReadableStream) (moqSubscribeEr
 	return
 }
 
+func receiveSubscribeRst(stream quichelpers.IWtReadableStream) (moqSubscribeRst MoqMessageSubscribeRst, err error) {
+	// rx SUBSCRIBE RST
+
+	trackNamespace, errTrackNamespace := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errTrackNamespace != nil {
+		err = errors.New(fmt.Sprintf("MOQ SUBSCRIBE RST reading TrackNmespace, err: %v", errTrackNamespace))
+		return
+	}
+	moqSubscribeRst.TrackNamespace = trackNamespace
+
+	trackName, errTrackName := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errTrackName != nil {
+		err = errors.New(fmt.Sprintf("MOQ SUBSCRIBE RST reading trackName, err: %v", errTrackName))
+		return
+	}
+	moqSubscribeRst.TrackName = trackName
+
+	errorCode, errErrorCode := quichelpers.ReadVarint(stream)
+	if errErrorCode != nil {
+		err = errors.New(fmt.Sprintf("MOQ SUBSCRIBE RST reading ErrorCode, err: %v", errErrorCode))
+		return
+	}
+	moqSubscribeRst.ErrCode = MoqErrorCodeSubscribe(errorCode)
+
+	errReason, errErrorReason := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errErrorReason != nil {
+		err = errors.New(fmt.Sprintf("MOQ SUBSCRIBE RST reading ErrorReason, err: %v", errErrorReason))
+		return
+	}
+	moqSubscribeRst.ErrMsg = errReason
+
+	finalGroup, errFinalGroup := quichelpers.ReadVarint(stream)
+	if errFinalGroup != nil {
+		err = errors.New(fmt.Sprintf("MOQ SUBSCRIBE RST reading FinalGroup, err: %v", errFinalGroup))
+		return
+	}
+	moqSubscribeRst.FinalGroup = finalGroup
+
+	finalObject, errFinalObject := quichelpers.ReadVarint(stream)
+	if errFinalObject != nil {
+		err = errors.New(fmt.Sprintf("MOQ SUBSCRIBE RST reading FinalObject, err: %v", errFinalObject))
+		return
+	}
+	moqSubscribeRst.FinalObject = finalObject
+
+	return
+}
+
 func receiveSubscribe(stream quichelpers.IWtReadableStream) (moqSubscribe MoqMessageSubscribe, err error) {
 	// rx SUBSCRIBE
 
@@ -370,7 +537,7 @@ func receiveSubscribe(stream quichelpers.IWtReadableStream) (moqSubscribe MoqMes
 			err = errors.New(fmt.Sprintf("MOQ SUBSCRIBE reading start object value, err: %v", errStarObjectValue))
 			return
 		}
-		moqSubscribe.StartGroup.Value = startObjectValue
+		moqSubscribe.StartObject.Value = startObjectValue
 	}
 
 	endGroupMode, errEndGroupMode := quichelpers.ReadVarint(stream)
@@ -412,6 +579,15 @@ func receiveSubscribe(stream quichelpers.IWtReadableStream) (moqSubscribe MoqMes
 	if found {
 		moqSubscribe.AuthInfo = foundObj.(string)
 	}
+	foundObj, found = params[uint64(MoqParamsAuthorizationToken)]
+	if found {
+		authToken := foundObj.(MoqAuthToken)
+		moqSubscribe.AuthToken = &authToken
+	}
+	foundObj, found = params[uint64(MoqParamsRelayTrace)]
+	if found {
+		moqSubscribe.RelayTrace = foundObj.([]string)
+	}
 
 	return
 }
@@ -435,6 +611,15 @@ func receiveAnnounce(stream quichelpers.IWtReadableStream) (moqAnnounce MoqMessa
 	if found {
 		moqAnnounce.AuthInfo = foundObj.(string)
 	}
+	foundObj, found = params[uint64(MoqParamsAuthorizationToken)]
+	if found {
+		authToken := foundObj.(MoqAuthToken)
+		moqAnnounce.AuthToken = &authToken
+	}
+	foundObj, found = params[uint64(MoqParamsRelayTrace)]
+	if found {
+		moqAnnounce.RelayTrace = foundObj.([]string)
+	}
 
 	return
 }
@@ -489,6 +674,10 @@ func receiveClientSetUp(stream quichelpers.IWtReadableStream) (moqSetup MoqMessa
 	if found {
 		moqSetup.Role = MoqRole(foundObj.(uint64))
 	}
+	foundObj, found = params[uint64(MoqParamsPath)]
+	if found {
+		moqSetup.Path = foundObj.(string)
+	}
 
 	return
 }
@@ -527,6 +716,28 @@ func receiveObjectHeader(stream quichelpers.IWtReadableStream) (moqObjHeader moq
 	return
 }
 
+func receiveObjectWithLength(stream quichelpers.IWtReadableStream) (moqObjWithLength MoqMessageObjectWithLength, err error) {
+	moqObjHeader, errHeader := receiveObjectHeader(stream)
+	if errHeader != nil {
+		err = errHeader
+		return
+	}
+
+	payloadLength, errPayloadLength := quichelpers.ReadVarint(stream)
+	if errPayloadLength != nil {
+		err = errors.New(fmt.Sprintf("MOQ OBJECT reading payload length, err: %v", errPayloadLength))
+		return
+	}
+
+	moqObjWithLength.MoqObjectHeader = moqObjHeader
+	moqObjWithLength.PayloadLength = payloadLength
+
+	return
+}
+
+// ErrObjectAborted Returned by ReadObjPayloadToEOS when the object is aborted while its payload is received (the rest of the payload is NOT read)
+var ErrObjectAborted = errors.New("Object aborted")
+
 func ReadObjPayloadToEOS(stream quichelpers.IWtReadableStream, moqObj *moqobject.MoqObject) error {
 	// rx Obj payload
 
@@ -535,8 +746,9 @@ func ReadObjPayloadToEOS(stream quichelpers.IWtReadableStream, moqObj *moqobject
 	n := 0
 	for {
 		n, err = stream.Read(buf)
-		if (err == nil || err == io.EOF) && n > 0 {
-			moqObj.PayloadWrite(buf[:n])
+		if (err == nil || err == io.EOF) && n > 0 && moqObj.PayloadWrite(buf[:n]) < n {
+			// Aborted while receiving it (ex: over the cache quota)
+			err = ErrObjectAborted
 		}
 		if err != nil {
 			break
@@ -547,6 +759,8 @@ func ReadObjPayloadToEOS(stream quichelpers.IWtReadableStream, moqObj *moqobject
 		moqObj.SetEof()
 		return nil
 	}
+	// Unblock the readers of this object
+	moqObj.Abort()
 	return err
 }
 
@@ -563,7 +777,11 @@ func SendAnnounce(stream quichelpers.IWtWritableStream, moqAnnounce MoqMessageAn
 	}
 
 	// Number of params
-	err = quichelpers.WriteVarint(stream, uint64(1))
+	numParams := 1
+	if len(moqAnnounce.RelayTrace) > 0 {
+		numParams++
+	}
+	err = quichelpers.WriteVarint(stream, uint64(numParams))
 	if err != nil {
 		return err
 	}
@@ -576,6 +794,13 @@ func SendAnnounce(stream quichelpers.IWtWritableStream, moqAnnounce MoqMessageAn
 	if err != nil {
 		return err
 	}
+	// [1]Relay trace
+	if len(moqAnnounce.RelayTrace) > 0 {
+		err = writeRelayTraceParam(stream, moqAnnounce.RelayTrace)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -601,7 +826,11 @@ func SendClientSetup(stream quichelpers.IWtWritableStream, moqSetup MoqMessageCl
 	}
 
 	// Number of params
-	err = quichelpers.WriteVarint(stream, uint64(1))
+	numParams := 1
+	if moqSetup.Path != "" {
+		numParams++
+	}
+	err = quichelpers.WriteVarint(stream, uint64(numParams))
 	if err != nil {
 		return err
 	}
@@ -627,6 +856,18 @@ func SendClientSetup(stream quichelpers.IWtWritableStream, moqSetup MoqMessageCl
 	if err != nil {
 		return err
 	}
+
+	if moqSetup.Path != "" {
+		// Param Path
+		err = quichelpers.WriteVarint(stream, uint64(MoqParamsPath))
+		if err != nil {
+			return err
+		}
+		err = quichelpers.WriteString(stream, moqSetup.Path)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -794,7 +1035,11 @@ func SendSubscribe(stream quichelpers.IWtWritableStream, moqSubscribe MoqMessage
 	}
 
 	// Params
-	err = quichelpers.WriteVarint(stream, uint64(1))
+	numParams := 1
+	if len(moqSubscribe.RelayTrace) > 0 {
+		numParams++
+	}
+	err = quichelpers.WriteVarint(stream, uint64(numParams))
 	if err != nil {
 		return err
 	}
@@ -807,7 +1052,48 @@ func SendSubscribe(stream quichelpers.IWtWritableStream, moqSubscribe MoqMessage
 	if err != nil {
 		return err
 	}
+	// [1] Relay trace
+	if len(moqSubscribe.RelayTrace) > 0 {
+		err = writeRelayTraceParam(stream, moqSubscribe.RelayTrace)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func SendUnAnnounce(stream quichelpers.IWtWritableStream, moqUnAnnounce MoqMessageUnAnnounce) error {
+
+	err := quichelpers.WriteVarint(stream, uint64(MoqIdMessageUnAnnounce))
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteString(stream, moqUnAnnounce.TrackNamespace)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func SendGoAway(stream quichelpers.IWtWritableStream) error {
+	return quichelpers.WriteVarint(stream, uint64(MoqIdMessageGoAway))
+}
+
+func SendUnSubscribe(stream quichelpers.IWtWritableStream, moqUnSubscribe MoqMessageUnSubscribe) error {
 
+	err := quichelpers.WriteVarint(stream, uint64(MoqIdUnSubscribe))
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteString(stream, moqUnSubscribe.TrackNamespace)
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteString(stream, moqUnSubscribe.TrackName)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -836,13 +1122,62 @@ func SendSubscribeError(stream quichelpers.IWtWritableStream, moqSubscribeError
 	return nil
 }
 
-func SendObject(stream quichelpers.IWtWritableStream, moqObj *moqobject.MoqObject) error {
+func SendSubscribeRst(stream quichelpers.IWtWritableStream, moqSubscribeRst MoqMessageSubscribeRst) error {
+
+	err := quichelpers.WriteVarint(stream, uint64(MoqIdSubscribeRst))
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteString(stream, moqSubscribeRst.TrackNamespace)
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteString(stream, moqSubscribeRst.TrackName)
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteVarint(stream, uint64(moqSubscribeRst.ErrCode))
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteString(stream, moqSubscribeRst.ErrMsg)
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteVarint(stream, moqSubscribeRst.FinalGroup)
+	if err != nil {
+		return err
+	}
+	err = quichelpers.WriteVarint(stream, moqSubscribeRst.FinalObject)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SendObject Sends the object using the subscriber track alias (trackId)
+func SendObject(stream quichelpers.IWtWritableStream, moqObj *moqobject.MoqObject, trackId uint64) error {
+	return sendObject(stream, moqObj, trackId, false)
+}
+
+// SendObjectWithLength Sends a complete object with its payload length, so more objects can be sent after it in the same stream
+func SendObjectWithLength(stream quichelpers.IWtWritableStream, moqObj *moqobject.MoqObject, trackId uint64) error {
+	if !moqObj.GetEof() {
+		return errors.New(fmt.Sprintf("MOQ OBJECT %s payload length unknown, object NOT complete", moqObj.GetDebugStr()))
+	}
+	return sendObject(stream, moqObj, trackId, true)
+}
 
-	err := quichelpers.WriteVarint(stream, uint64(MoqIdMessageObject))
+func sendObject(stream quichelpers.IWtWritableStream, moqObj *moqobject.MoqObject, trackId uint64, withLength bool) error {
+	msgType := MoqIdMessageObject
+	if withLength {
+		msgType = MoqIdMessageObjectWithLength
+	}
+	err := quichelpers.WriteVarint(stream, uint64(msgType))
 	if err != nil {
 		return err
 	}
-	err = quichelpers.WriteVarint(stream, moqObj.TrackId)
+	err = quichelpers.WriteVarint(stream, trackId)
 	if err != nil {
 		return err
 	}
@@ -858,19 +1193,30 @@ func SendObject(stream quichelpers.IWtWritableStream, moqObj *moqobject.MoqObjec
 	if err != nil {
 		return err
 	}
+	if withLength {
+		err = quichelpers.WriteVarint(stream, uint64(moqObj.GetPayloadSize()))
+		if err != nil {
+			return err
+		}
+	}
 
-	dataBlock := make([]byte, READ_BLOCK_SIZE_BYTES)
-	srcReader := moqObj.NewReader()
-	readBytes := 0
-	totalSent := 0
+	// Writes the shared object chunks (NO copy per subscriber)
+	srcReader := moqObj.NewChunkReader()
 	var errRead error = nil
 	for errRead == nil {
-		readBytes, errRead = srcReader.Read(dataBlock)
-		if readBytes > 0 {
-			stream.Write(dataBlock[:readBytes])
-			totalSent += readBytes
+		var chunk []byte
+		chunk, errRead = srcReader.NextChunk()
+		if len(chunk) > 0 {
+			_, errWrite := stream.Write(chunk)
+			if errWrite != nil {
+				return errWrite
+			}
 		}
 	}
+	if errRead != io.EOF {
+		// Incomplete object (publisher failed)
+		return errRead
+	}
 	return nil
 }
 
@@ -901,6 +1247,50 @@ func readParameters(stream quichelpers.IWtReadableStream) (parameters map[uint64
 			}
 			parameters[paramId] = authInfo
 
+		} else if MoqParams(paramId) == MoqParamsAuthorizationToken {
+			length, errLength := quichelpers.ReadVarint(stream)
+			if errLength != nil {
+				err = errors.New(fmt.Sprintf("MOQ parameters auth token reading param length info, err: %v", errLength))
+				return
+			}
+			if length > MOQ_MAX_AUTH_TOKEN_LENGTH {
+				err = errors.New(fmt.Sprintf("MOQ parameters auth token length exceeds limit of %d, received: %d", MOQ_MAX_AUTH_TOKEN_LENGTH, length))
+				return
+			}
+			tokenBuffer := make([]byte, length)
+			errReadingToken := quichelpers.ReadBytes(stream, tokenBuffer)
+			if errReadingToken != nil {
+				err = errors.New(fmt.Sprintf("MOQ parameters reading auth token, err: %v", errReadingToken))
+				return
+			}
+			authToken, errAuthToken := parseAuthToken(tokenBuffer)
+			if errAuthToken != nil {
+				err = errors.New(fmt.Sprintf("MOQ parameters parsing auth token, err: %v", errAuthToken))
+				return
+			}
+			parameters[paramId] = authToken
+
+		} else if MoqParams(paramId) == MoqParamsPath {
+			path, errPath := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+			if errPath != nil {
+				err = errors.New(fmt.Sprintf("MOQ parameters reading path, err: %v", errPath))
+				return
+			}
+			parameters[paramId] = path
+
+		} else if MoqParams(paramId) == MoqParamsRelayTrace {
+			relayTraceData, errRelayTraceData := quichelpers.ReadString(stream, MAX_RELAY_HOPS*(MOQ_MAX_STRING_LENGTH+2))
+			if errRelayTraceData != nil {
+				err = errors.New(fmt.Sprintf("MOQ parameters reading relay trace, err: %v", errRelayTraceData))
+				return
+			}
+			relayTrace, errRelayTrace := parseRelayTrace([]byte(relayTraceData))
+			if errRelayTrace != nil {
+				err = errors.New(fmt.Sprintf("MOQ parameters parsing relay trace, err: %v", errRelayTrace))
+				return
+			}
+			parameters[paramId] = relayTrace
+
 		} else if MoqParams(paramId) == MoqParamsRole {
 			_, errLength := quichelpers.ReadVarint(stream)
 			if errLength != nil {
@@ -920,6 +1310,10 @@ func readParameters(stream quichelpers.IWtReadableStream) (parameters map[uint64
 				err = errors.New(fmt.Sprintf("MOQ parameters reading param length info, err: %v", errLength))
 				return
 			}
+			if length > MOQ_MAX_UNKNOWN_PARAM_LENGTH {
+				err = errors.New(fmt.Sprintf("MOQ parameters unknown param %d length exceeds limit of %d, received: %d", paramId, MOQ_MAX_UNKNOWN_PARAM_LENGTH, length))
+				return
+			}
 			tmpBuffer := make([]byte, length)
 			errReadingUnknown := quichelpers.ReadBytes(stream, tmpBuffer)
 			if errReadingUnknown != nil {
@@ -930,3 +1324,88 @@ func readParameters(stream quichelpers.IWtReadableStream) (parameters map[uint64
 	}
 	return
 }
+
+func parseAuthToken(data []byte) (authToken MoqAuthToken, err error) {
+	reader := bytes.NewReader(data)
+
+	aliasType, errAliasType := quichelpers.ReadVarint(reader)
+	if errAliasType != nil {
+		err = errors.New(fmt.Sprintf("reading alias type, err: %v", errAliasType))
+		return
+	}
+	authToken.AliasType = MoqAuthTokenAliasType(aliasType)
+
+	if authToken.AliasType == MoqAuthTokenAliasTypeDelete || authToken.AliasType == MoqAuthTokenAliasTypeRegister || authToken.AliasType == MoqAuthTokenAliasTypeUseAlias {
+		alias, errAlias := quichelpers.ReadVarint(reader)
+		if errAlias != nil {
+			err = errors.New(fmt.Sprintf("reading token alias, err: %v", errAlias))
+			return
+		}
+		authToken.Alias = alias
+	} else if authToken.AliasType != MoqAuthTokenAliasTypeUseValue {
+		err = errors.New(fmt.Sprintf("invalid alias type %d", aliasType))
+		return
+	}
+
+	if authToken.AliasType == MoqAuthTokenAliasTypeRegister || authToken.AliasType == MoqAuthTokenAliasTypeUseValue {
+		tokenType, errTokenType := quichelpers.ReadVarint(reader)
+		if errTokenType != nil {
+			err = errors.New(fmt.Sprintf("reading token type, err: %v", errTokenType))
+			return
+		}
+		authToken.TokenType = tokenType
+
+		// Token value is the rest of the param
+		authToken.Value = string(data[len(data)-reader.Len():])
+		return
+	}
+
+	if reader.Len() > 0 {
+		err = errors.New(fmt.Sprintf("unexpected %d bytes after token alias", reader.Len()))
+	}
+	return
+}
+
+func parseRelayTrace(data []byte) (relayTrace []string, err error) {
+	reader := bytes.NewReader(data)
+
+	numRelays, errNumRelays := quichelpers.ReadVarint(reader)
+	if errNumRelays != nil {
+		err = errors.New(fmt.Sprintf("reading number of relays, err: %v", errNumRelays))
+		return
+	}
+	if numRelays > MAX_RELAY_HOPS {
+		err = errors.New(fmt.Sprintf("exceeded max number of relays %d, received: %d", MAX_RELAY_HOPS, numRelays))
+		return
+	}
+	relayTrace = []string{}
+	for i := 0; i < int(numRelays); i++ {
+		relayId, errRelayId := quichelpers.ReadString(reader, MOQ_MAX_STRING_LENGTH)
+		if errRelayId != nil {
+			err = errors.New(fmt.Sprintf("reading relay id in position %d, err: %v", i, errRelayId))
+			return
+		}
+		relayTrace = append(relayTrace, relayId)
+	}
+	return
+}
+
+func writeRelayTraceParam(stream quichelpers.IWtWritableStream, relayTrace []string) error {
+	var relayTraceData bytes.Buffer
+	err := quichelpers.WriteVarint(&relayTraceData, uint64(len(relayTrace)))
+	if err != nil {
+		return err
+	}
+	for _, relayId := range relayTrace {
+		err = quichelpers.WriteString(&relayTraceData, relayId)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = quichelpers.WriteVarint(stream, uint64(MoqParamsRelayTrace))
+	if err != nil {
+		return err
+	}
+	return quichelpers.WriteString(stream, relayTraceData.String())
+}
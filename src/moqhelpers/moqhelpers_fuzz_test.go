@@ -0,0 +1,247 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqhelpers
+
+import (
+	"bytes"
+	"facebookexperimental/moq-go-server/moqhelpers/quichelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Max bytes returned by a single read of the fuzz stream, reads are split to exercise the partial read paths
+const FUZZ_STREAM_MAX_READ_SIZE = 7
+
+// fuzzStream In-memory readable stream that returns the data in small reads and then io.EOF
+type fuzzStream struct {
+	data  []byte
+	reads int
+}
+
+func newFuzzStream(data []byte) *fuzzStream {
+	return &fuzzStream{data: data}
+}
+
+func (stream *fuzzStream) Read(p []byte) (n int, err error) {
+	if len(stream.data) <= 0 {
+		err = io.EOF
+		return
+	}
+	stream.reads++
+	size := min(len(p), len(stream.data), 1+stream.reads%FUZZ_STREAM_MAX_READ_SIZE)
+	n = copy(p, stream.data[:size])
+	stream.data = stream.data[n:]
+	return
+}
+
+// FuzzReceiveMessage Any message (data starts with the message type), object payloads are read to the end of the stream
+func FuzzReceiveMessage(f *testing.F) {
+	for _, seed := range getMessageSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stream := newFuzzStream(data)
+		moqMsg, _, err := ReceiveMessage(stream)
+		if err != nil {
+			return
+		}
+		moqObjHeader, isObject := moqMsg.(moqobject.MoqObjectHeader)
+		if isObject {
+			ReadObjPayloadToEOS(stream, moqobject.New(moqObjHeader, 0, time.Now()))
+		}
+	})
+}
+
+// FuzzReceiveSubscribe SUBSCRIBE body, parsed ones have to be sent and parsed again with the same values
+func FuzzReceiveSubscribe(f *testing.F) {
+	for _, seed := range getSeedsOfType(f, MoqIdSubscribe) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		subscribe, err := receiveSubscribe(newFuzzStream(data))
+		if err != nil {
+			return
+		}
+		var buffer bytes.Buffer
+		if errSend := SendSubscribe(&buffer, subscribe); errSend != nil {
+			t.Fatalf("Sending parsed SUBSCRIBE %+v, err: %v", subscribe, errSend)
+		}
+		roundTrip := receiveSent(t, buffer.Bytes()).(MoqMessageSubscribe)
+		if roundTrip.TrackNamespace != subscribe.TrackNamespace || roundTrip.TrackName != subscribe.TrackName || roundTrip.StartGroup != subscribe.StartGroup || roundTrip.StartObject != subscribe.StartObject || roundTrip.EndGroup != subscribe.EndGroup || roundTrip.EndObject != subscribe.EndObject || roundTrip.AuthInfo != subscribe.AuthInfo || !slices.Equal(roundTrip.RelayTrace, subscribe.RelayTrace) {
+			t.Fatalf("SUBSCRIBE round trip mismatch, parsed: %+v, sent and parsed again: %+v", subscribe, roundTrip)
+		}
+	})
+}
+
+// FuzzReceiveSetUp Client SETUP body, parsed ones have to be sent and parsed again with the same values (and answered with a server SETUP that parses)
+func FuzzReceiveSetUp(f *testing.F) {
+	for _, seed := range getSeedsOfType(f, MoqIdMessageClientSetup) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		setup, err := receiveClientSetUp(newFuzzStream(data))
+		if err != nil {
+			return
+		}
+		var buffer bytes.Buffer
+		if errSend := SendClientSetup(&buffer, setup); errSend != nil {
+			t.Fatalf("Sending parsed client SETUP %+v, err: %v", setup, errSend)
+		}
+		roundTrip := receiveSent(t, buffer.Bytes()).(MoqMessageClientSetup)
+		if !slices.Equal(roundTrip.SupportedClientVersions, setup.SupportedClientVersions) || roundTrip.Role != setup.Role || roundTrip.Path != setup.Path {
+			t.Fatalf("Client SETUP round trip mismatch, parsed: %+v, sent and parsed again: %+v", setup, roundTrip)
+		}
+
+		setupResponse, errResponse := CreateSetupResponse(setup)
+		if errResponse != nil {
+			return
+		}
+		buffer.Reset()
+		if errSend := SendServerSetup(&buffer, setupResponse); errSend != nil {
+			t.Fatalf("Sending server SETUP %+v, err: %v", setupResponse, errSend)
+		}
+		roundTripResponse := receiveSent(t, buffer.Bytes()).(MoqMessageServerSetup)
+		if roundTripResponse.Version != setupResponse.Version || roundTripResponse.Role != setupResponse.Role {
+			t.Fatalf("Server SETUP round trip mismatch, sent: %+v, parsed: %+v", setupResponse, roundTripResponse)
+		}
+	})
+}
+
+// FuzzReadParameters Parameters block, parsed ones (as the parameters of an ANNOUNCE) have to be sent and parsed again with the same values
+func FuzzReadParameters(f *testing.F) {
+	for _, seed := range getParametersSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := readParameters(newFuzzStream(data))
+		if err != nil {
+			return
+		}
+		// Empty namespace
+		announce, errAnnounce := receiveAnnounce(newFuzzStream(append([]byte{0}, data...)))
+		if errAnnounce != nil {
+			t.Fatalf("Parameters parsed alone but NOT in an ANNOUNCE, err: %v", errAnnounce)
+		}
+		var buffer bytes.Buffer
+		if errSend := SendAnnounce(&buffer, announce); errSend != nil {
+			t.Fatalf("Sending parsed ANNOUNCE %+v, err: %v", announce, errSend)
+		}
+		roundTrip := receiveSent(t, buffer.Bytes()).(MoqMessageAnnounce)
+		if roundTrip.TrackNamespace != announce.TrackNamespace || roundTrip.AuthInfo != announce.AuthInfo || !slices.Equal(roundTrip.RelayTrace, announce.RelayTrace) {
+			t.Fatalf("ANNOUNCE parameters round trip mismatch, parsed: %+v, sent and parsed again: %+v", announce, roundTrip)
+		}
+	})
+}
+
+// Seeds (valid messages)
+
+func getMessageSeeds(tb testing.TB) (seeds [][]byte) {
+	seeds = [][]byte{}
+	for _, send := range getSeedSenders() {
+		var buffer bytes.Buffer
+		if err := send(&buffer); err != nil {
+			tb.Fatalf("Creating seed, err: %v", err)
+		}
+		seeds = append(seeds, buffer.Bytes())
+	}
+	return
+}
+
+// getSeedsOfType Returns the seeds of the message type without it (bodies)
+func getSeedsOfType(tb testing.TB, msgType MoqMessageType) (seeds [][]byte) {
+	seeds = [][]byte{}
+	var typeBuffer bytes.Buffer
+	quichelpers.WriteVarint(&typeBuffer, uint64(msgType))
+	for _, seed := range getMessageSeeds(tb) {
+		if bytes.HasPrefix(seed, typeBuffer.Bytes()) {
+			seeds = append(seeds, seed[typeBuffer.Len():])
+		}
+	}
+	return
+}
+
+// getParametersSeeds Returns the parameters of the ANNOUNCE seeds (body without the namespace)
+func getParametersSeeds(tb testing.TB) (seeds [][]byte) {
+	seeds = [][]byte{}
+	for _, seed := range getSeedsOfType(tb, MoqIdMessageAnnounce) {
+		stream := newFuzzStream(seed)
+		if _, err := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH); err != nil {
+			tb.Fatalf("Reading seed namespace, err: %v", err)
+		}
+		seeds = append(seeds, stream.data)
+	}
+	return
+}
+
+func getSeedSenders() []func(stream quichelpers.IWtWritableStream) error {
+	moqObj := moqobject.New(moqobject.MoqObjectHeader{TrackId: 1, GroupSequence: 2, ObjectSequence: 3, SendOrder: 4}, 0, time.Now())
+	moqObj.PayloadWrite([]byte("payload"))
+	moqObj.SetEof()
+
+	return []func(stream quichelpers.IWtWritableStream) error{
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendClientSetup(stream, CreateClientSetup(MoqRoleBoth))
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			setup := CreateClientSetup(MoqRolePublisher)
+			setup.Path = "/moq"
+			return SendClientSetup(stream, setup)
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendServerSetup(stream, MoqMessageServerSetup{Version: MOQ_SUPPORTED_VERSION, Role: MoqRoleBoth})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendAnnounce(stream, CreateAnnounce("namespace", "auth"))
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			announce := CreateAnnounce("namespace", "")
+			announce.RelayTrace = []string{"relay-a", "relay-b"}
+			return SendAnnounce(stream, announce)
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendAnnounceOK(stream, MoqMessageAnnounceOk{TrackNamespace: "namespace"})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendUnAnnounce(stream, MoqMessageUnAnnounce{TrackNamespace: "namespace"})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendSubscribe(stream, MoqMessageSubscribe{TrackNamespace: "namespace", TrackName: "track", StartGroup: MoqLocation{Type: MoqLocationTypeRelativePrevious, Value: 1}, StartObject: MoqLocation{Type: MoqLocationTypeAbsolute, Value: 0}, AuthInfo: "auth"})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendSubscribe(stream, MoqMessageSubscribe{TrackNamespace: "namespace", TrackName: "track", StartGroup: MoqLocation{Type: MoqLocationTypeAbsolute, Value: 100}, StartObject: MoqLocation{Type: MoqLocationTypeAbsolute, Value: 5}, EndGroup: MoqLocation{Type: MoqLocationTypeAbsolute, Value: 200}, EndObject: MoqLocation{Type: MoqLocationTypeRelativeNext, Value: 0}, RelayTrace: []string{"relay-a"}})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendSubscribeOk(stream, MoqMessageSubscribeOk{TrackNamespace: "namespace", TrackName: "track", TrackId: 1, Expires: 1000})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendSubscribeError(stream, MoqMessageSubscribeError{TrackNamespace: "namespace", TrackName: "track", ErrCode: ErrorSubscribeNoPublishers, ErrMsg: "error"})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendSubscribeRst(stream, MoqMessageSubscribeRst{TrackNamespace: "namespace", TrackName: "track", ErrMsg: "reset", FinalGroup: 10, FinalObject: 2})
+		},
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendUnSubscribe(stream, MoqMessageUnSubscribe{TrackNamespace: "namespace", TrackName: "track"})
+		},
+		SendGoAway,
+		func(stream quichelpers.IWtWritableStream) error {
+			return SendObject(stream, moqObj, 1)
+		},
+	}
+}
+
+// receiveSent Parses a message created by this server, it has to be valid
+func receiveSent(t *testing.T, data []byte) interface{} {
+	moqMsg, _, err := ReceiveMessage(newFuzzStream(data))
+	if err != nil {
+		t.Fatalf("Parsing a sent message, err: %v", err)
+	}
+	return moqMsg
+}
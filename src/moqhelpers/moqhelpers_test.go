@@ -0,0 +1,88 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqhelpers
+
+import (
+	"bytes"
+	"facebookexperimental/moq-go-server/moqhelpers/quichelpers"
+	"testing"
+)
+
+// Start object value was stored in the start group
+func TestReceiveSubscribeStartObject(t *testing.T) {
+	subscribe := MoqMessageSubscribe{TrackNamespace: "namespace", TrackName: "track", StartGroup: MoqLocation{Type: MoqLocationTypeAbsolute, Value: 100}, StartObject: MoqLocation{Type: MoqLocationTypeAbsolute, Value: 5}, EndGroup: MoqLocation{Type: MoqLocationTypeNone}, EndObject: MoqLocation{Type: MoqLocationTypeNone}}
+	var buffer bytes.Buffer
+	if err := SendSubscribe(&buffer, subscribe); err != nil {
+		t.Fatalf("Sending SUBSCRIBE, err: %v", err)
+	}
+
+	moqMsg, msgType, err := ReceiveMessage(newFuzzStream(buffer.Bytes()))
+	if err != nil || msgType != MoqIdSubscribe {
+		t.Fatalf("Receiving SUBSCRIBE, type %d, err: %v", msgType, err)
+	}
+	received := moqMsg.(MoqMessageSubscribe)
+	if received.StartGroup != subscribe.StartGroup {
+		t.Fatalf("Start group %+v, want %+v", received.StartGroup, subscribe.StartGroup)
+	}
+	if received.StartObject != subscribe.StartObject {
+		t.Fatalf("Start object %+v, want %+v", received.StartObject, subscribe.StartObject)
+	}
+}
+
+// Unknown parameters length was allocated without any limit
+func TestReadParametersUnknownParamLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  uint64
+		wantErr bool
+	}{
+		{name: "empty", length: 0, wantErr: false},
+		{name: "under the limit", length: 16, wantErr: false},
+		{name: "at the limit", length: MOQ_MAX_UNKNOWN_PARAM_LENGTH, wantErr: false},
+		{name: "over the limit", length: MOQ_MAX_UNKNOWN_PARAM_LENGTH + 1, wantErr: true},
+		{name: "max varint", length: 1<<62 - 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			// 1 param, unknown id, length and value
+			quichelpers.WriteVarint(&buffer, 1)
+			quichelpers.WriteVarint(&buffer, 0x3f)
+			quichelpers.WriteVarint(&buffer, tt.length)
+			if !tt.wantErr {
+				buffer.Write(make([]byte, tt.length))
+			}
+
+			parameters, err := readParameters(newFuzzStream(buffer.Bytes()))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readParameters err %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && len(parameters) != 0 {
+				t.Fatalf("Unknown parameters should be skipped, got %v", parameters)
+			}
+		})
+	}
+}
+
+// BenchmarkReceiveObjectHeader Object message header parsed from a buffered object stream (a header per object received)
+func BenchmarkReceiveObjectHeader(b *testing.B) {
+	var data bytes.Buffer
+	quichelpers.WriteVarint(&data, uint64(MoqIdMessageObject))
+	for _, varint := range []uint64{0x10, 0x1234, 0x12345678, 0x1234567890} {
+		quichelpers.WriteVarint(&data, varint)
+	}
+	stream := bytes.NewReader(data.Bytes())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream.Reset(data.Bytes())
+		_, msgType, err := ReceiveMessage(quichelpers.NewBufferedReader(stream))
+		if err != nil || msgType != MoqMessageType(MoqIdMessageObject) {
+			b.Fatal("Receiving object header")
+		}
+	}
+}
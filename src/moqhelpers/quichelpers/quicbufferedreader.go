@@ -0,0 +1,119 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package quichelpers
+
+import (
+	"github.com/quic-go/webtransport-go"
+)
+
+// Bytes read from the stream at once, enough for most message headers. Bigger reads (ex: object payload) bypass the buffer
+const READ_BUFFER_SIZE_BYTES = 512
+
+// BufferedReader Reads the stream in blocks, so parsing varints / strings byte by byte does NOT cost a stream read per byte.
+// It can read ahead of the current message, all the next reads of the stream have to use it
+type BufferedReader struct {
+	stream IWtReadableStream
+	buf    []byte
+	start  int
+	end    int
+	// Error of the last stream read, returned after the buffered bytes
+	err error
+}
+
+// bufferedStream Control stream with buffered reads
+type bufferedStream struct {
+	webtransport.Stream
+	reader *BufferedReader
+}
+
+// bufferedReceiveStream Object stream with buffered reads
+type bufferedReceiveStream struct {
+	webtransport.ReceiveStream
+	reader *BufferedReader
+}
+
+func NewBufferedReader(stream IWtReadableStream) *BufferedReader {
+	return &BufferedReader{stream: stream, buf: make([]byte, READ_BUFFER_SIZE_BYTES)}
+}
+
+// NewBufferedStream Wraps a bidirectional stream, writes are NOT buffered
+func NewBufferedStream(stream webtransport.Stream) webtransport.Stream {
+	return &bufferedStream{Stream: stream, reader: NewBufferedReader(stream)}
+}
+
+func NewBufferedReceiveStream(stream webtransport.ReceiveStream) webtransport.ReceiveStream {
+	return &bufferedReceiveStream{ReceiveStream: stream, reader: NewBufferedReader(stream)}
+}
+
+func (r *BufferedReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	if r.start == r.end {
+		if r.err != nil {
+			return 0, r.takeErr()
+		}
+		if len(p) >= len(r.buf) {
+			return r.stream.Read(p)
+		}
+		r.fill()
+		if r.start == r.end {
+			return 0, r.takeErr()
+		}
+	}
+	n = copy(p, r.buf[r.start:r.end])
+	r.start += n
+	return
+}
+
+// ReadByte Implements io.ByteReader (used by ReadByte / ReadVarint)
+func (r *BufferedReader) ReadByte() (b byte, err error) {
+	if r.start == r.end {
+		if r.err == nil {
+			r.fill()
+		}
+		if r.start == r.end {
+			err = r.takeErr()
+			return
+		}
+	}
+	b = r.buf[r.start]
+	r.start++
+	return
+}
+
+// fill Reads the available stream bytes (blocks only if there are none)
+func (r *BufferedReader) fill() {
+	r.start = 0
+	r.end = 0
+	for r.end == 0 && r.err == nil {
+		r.end, r.err = r.stream.Read(r.buf)
+	}
+}
+
+// takeErr Stream errors are NOT sticky, ex: the read can be retried after a deadline error
+func (r *BufferedReader) takeErr() (err error) {
+	err = r.err
+	r.err = nil
+	return
+}
+
+func (s *bufferedStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *bufferedStream) ReadByte() (byte, error) {
+	return s.reader.ReadByte()
+}
+
+func (s *bufferedReceiveStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *bufferedReceiveStream) ReadByte() (byte, error) {
+	return s.reader.ReadByte()
+}
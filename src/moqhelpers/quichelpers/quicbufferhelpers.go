@@ -9,6 +9,8 @@ package quichelpers
 import (
 	"errors"
 	"fmt"
+	"io"
+	"unsafe"
 )
 
 type IWtReadableStream interface {
@@ -27,22 +29,17 @@ const (
 	maxVarInt8 = 4611686018427387903
 )
 
+// ReadBytes Fills buffer reading directly into it (io.ReadFull semantics), io.EOF if the stream ended before any byte, io.ErrUnexpectedEOF if it ended in the middle
 func ReadBytes(stream IWtReadableStream, buffer []byte) error {
-	readSize := 0
-	totalSize := len(buffer)
-	var err error = nil
-	for readSize < totalSize && err == nil {
-		n := 0
-		tmpBuffer := make([]byte, totalSize-readSize)
-		n, err = stream.Read(tmpBuffer)
-		copy(buffer[readSize:readSize+n], tmpBuffer[0:n])
-
-		readSize += n
-	}
+	_, err := io.ReadFull(stream, buffer)
 	return err
 }
 
 func ReadByte(stream IWtReadableStream) (ret byte, err error) {
+	// Buffered streams, NO stream read per byte
+	if byteReader, ok := stream.(io.ByteReader); ok {
+		return byteReader.ReadByte()
+	}
 	tmpBuffer := []byte{0}
 	err = ReadBytes(stream, tmpBuffer)
 	if err == nil {
@@ -159,12 +156,20 @@ func ReadString(stream IWtReadableStream, max_allowed_length uint) (string, erro
 		return "", errors.New(fmt.Sprintf("String length exceeds limit of %d, received: %d", max_allowed_length, strLength))
 	}
 
+	if strLength == 0 {
+		return "", nil
+	}
 	strBytes := make([]byte, strLength)
 	errStr := ReadBytes(stream, strBytes)
 	if errStr != nil {
+		if errStr == io.EOF {
+			// Length received, NOT the end of the stream between messages
+			errStr = io.ErrUnexpectedEOF
+		}
 		return "", errStr
 	}
-	return string(strBytes), nil
+	// strBytes is NOT used after this, the string takes it without copying (as strings.Builder does)
+	return unsafe.String(&strBytes[0], len(strBytes)), nil
 }
 
 func WriteString(stream IWtWritableStream, str string) error {
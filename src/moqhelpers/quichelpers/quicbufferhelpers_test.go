@@ -0,0 +1,130 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package quichelpers
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// Max bytes returned by a single read of the bench stream (QUIC returns what already arrived, usually less than asked)
+const BENCH_STREAM_MAX_READ_SIZE = 100
+
+// Object header sized varints (1, 2, 4 and 8 bytes)
+var benchVarints = []uint64{0x10, 0x1234, 0x12345678, 0x1234567890}
+
+// benchStream In-memory readable stream that returns the data in reads of up to BENCH_STREAM_MAX_READ_SIZE, reset rewinds it (NO allocations)
+type benchStream struct {
+	data   []byte
+	offset int
+}
+
+func newBenchStream(data []byte) *benchStream {
+	return &benchStream{data: data}
+}
+
+func (stream *benchStream) Read(p []byte) (n int, err error) {
+	if stream.offset >= len(stream.data) {
+		err = io.EOF
+		return
+	}
+	n = copy(p, stream.data[stream.offset:min(len(stream.data), stream.offset+BENCH_STREAM_MAX_READ_SIZE)])
+	stream.offset += n
+	return
+}
+
+func (stream *benchStream) reset() {
+	stream.offset = 0
+}
+
+// BenchmarkReadBytes 4KB block (ex: parameter value) received in several reads
+func BenchmarkReadBytes(b *testing.B) {
+	stream := newBenchStream(bytes.Repeat([]byte{0xab}, 4*1024))
+	buffer := make([]byte, 4*1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buffer)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream.reset()
+		if ReadBytes(stream, buffer) != nil {
+			b.Fatal("Reading bytes")
+		}
+	}
+}
+
+// BenchmarkReadString Track name sized string
+func BenchmarkReadString(b *testing.B) {
+	var data bytes.Buffer
+	WriteString(&data, "live/channel-1/video-1080p")
+	stream := newBenchStream(data.Bytes())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream.reset()
+		_, err := ReadString(stream, 1024)
+		if err != nil {
+			b.Fatal("Reading string")
+		}
+	}
+}
+
+// BenchmarkReadVarint Varints from an unbuffered stream (a read per byte)
+func BenchmarkReadVarint(b *testing.B) {
+	stream := newBenchStream(getVarints())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream.reset()
+		readVarints(b, stream)
+	}
+}
+
+// BenchmarkReadVarintBuffered Same varints from a buffered stream (control / object streams)
+func BenchmarkReadVarintBuffered(b *testing.B) {
+	stream := newBenchStream(getVarints())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream.reset()
+		readVarints(b, NewBufferedReader(stream))
+	}
+}
+
+// BenchmarkWriteVarint Same varints encoded in a reused buffer
+func BenchmarkWriteVarint(b *testing.B) {
+	var data bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data.Reset()
+		for _, varint := range benchVarints {
+			if WriteVarint(&data, varint) != nil {
+				b.Fatal("Writing varint")
+			}
+		}
+	}
+}
+
+// Helpers
+
+func getVarints() []byte {
+	var data bytes.Buffer
+	for _, varint := range benchVarints {
+		WriteVarint(&data, varint)
+	}
+	return data.Bytes()
+}
+
+func readVarints(b *testing.B, stream IWtReadableStream) {
+	for _, expected := range benchVarints {
+		varint, err := ReadVarint(stream)
+		if err != nil || varint != expected {
+			b.Fatal("Reading varint")
+		}
+	}
+}
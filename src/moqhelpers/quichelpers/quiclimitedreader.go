@@ -0,0 +1,48 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package quichelpers
+
+import (
+	"io"
+)
+
+// LimitedReader Reads the next length bytes of the stream (ex: payload of an object with length) and then returns io.EOF, the stream can have more data after them.
+// If the stream ends before length bytes it returns io.ErrUnexpectedEOF
+type LimitedReader struct {
+	stream    IWtReadableStream
+	remaining uint64
+}
+
+func NewLimitedReader(stream IWtReadableStream, length uint64) *LimitedReader {
+	return &LimitedReader{stream: stream, remaining: length}
+}
+
+func (r *LimitedReader) Read(p []byte) (n int, err error) {
+	if r.remaining == 0 {
+		err = io.EOF
+		return
+	}
+	if uint64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err = r.stream.Read(p)
+	r.remaining -= uint64(n)
+	if err == io.EOF {
+		if r.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		} else {
+			// Next read returns io.EOF
+			err = nil
+		}
+	}
+	return
+}
+
+// GetRemaining Bytes NOT read yet
+func (r *LimitedReader) GetRemaining() uint64 {
+	return r.remaining
+}
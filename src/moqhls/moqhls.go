@@ -0,0 +1,483 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqhls
+
+import (
+	"context"
+	"errors"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const HLS_SHUTDOWN_TIMEOUT_MS = 5000
+
+// Blocking requests (playlist reloads, preload hint parts) check the cache with this period
+const HLS_BLOCKING_POLL_MS = 50
+
+// Completed segments closest to the live edge that also list their parts
+const HLS_PART_SEGMENTS = 2
+
+// A blocking playlist reload can NOT ask for segments further than this from the live edge
+const HLS_MAX_MSN_AHEAD = 2
+
+const HLS_COPY_BUFFER_SIZE = 32 * 1024
+
+const HLS_PLAYLIST_CONTENT_TYPE = "application/vnd.apple.mpegurl"
+
+// Session name used in the authorization requests of the HLS clients
+const HLS_AUTH_SESSION_NAME = "hls"
+
+type MoqHlsConfig struct {
+	ListenAddr string
+	// Completed segments (groups) listed in the playlist
+	PlaylistSegments int
+	// Min part target duration (parts are objects, their duration is estimated from their arrival times)
+	PartTargetMs uint64
+	// Max time blocking playlist reloads / preload hint parts wait
+	BlockingTimeoutMs uint64
+	// If set tracks are fMP4 (CMAF) and their init segment is the latest object of the track name + this suffix, if NOT tracks are MPEG-TS
+	InitTrackSuffix string
+}
+
+// MoqHls Plain HTTP (TCP) LL-HLS gateway, exposes cached tracks as playlists (groups are segments, objects are parts)
+type MoqHls struct {
+	server *http.Server
+	config MoqHlsConfig
+
+	objects *moqmessageobjects.MoqMessageObjects
+	// nil allows everything
+	authorizer moqauth.MoqAuthorizer
+	// Web origins allowed (CORS), nil any
+	checkOrigin func(r *http.Request) bool
+
+	clock moqclock.Clock
+}
+
+type hlsTrack struct {
+	trackNamespace string
+	trackName      string
+	authInfo       string
+}
+
+// Consecutive objects of a group
+type hlsGroup struct {
+	groupSequence uint64
+	objects       []*moqobject.MoqObject
+}
+
+type hlsPart struct {
+	moqObj      *moqobject.MoqObject
+	duration    time.Duration
+	independent bool
+}
+
+type hlsSegment struct {
+	groupSequence uint64
+	startAt       time.Time
+	duration      time.Duration
+	// Only near the live edge
+	parts []hlsPart
+}
+
+// New Creates the LL-HLS gateway
+func New(config MoqHlsConfig, objects *moqmessageobjects.MoqMessageObjects, authorizer moqauth.MoqAuthorizer, checkOrigin func(r *http.Request) bool, clock moqclock.Clock) *MoqHls {
+	mux := http.NewServeMux()
+	hls := &MoqHls{server: &http.Server{Addr: config.ListenAddr, Handler: mux}, config: config, objects: objects, authorizer: authorizer, checkOrigin: checkOrigin, clock: clock}
+
+	mux.HandleFunc("/hls/playlist.m3u8", hls.servePlaylist)
+	mux.HandleFunc("/hls/init.mp4", hls.serveInit)
+	mux.HandleFunc("/hls/segment"+hls.getMediaExtension(), hls.serveSegment)
+	mux.HandleFunc("/hls/part"+hls.getMediaExtension(), hls.servePart)
+	return hls
+}
+
+func (hls *MoqHls) ListenAndServe() error {
+	log.Info(fmt.Sprintf("Serving LL-HLS. Addr: %s", hls.server.Addr))
+
+	err := hls.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+func (hls *MoqHls) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HLS_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	return hls.server.Shutdown(ctx)
+}
+
+// Handlers
+
+func (hls *MoqHls) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	track, ok := hls.checkRequest(w, r)
+	if !ok {
+		return
+	}
+
+	groups := hls.getGroups(track)
+	msnStr := r.URL.Query().Get("_HLS_msn")
+	if msnStr != "" {
+		// Blocking playlist reload, wait until it has the segment (or part) requested
+		msn, errMsn := strconv.ParseUint(msnStr, 10, 64)
+		if errMsn != nil {
+			http.Error(w, "Invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := int64(-1)
+		partStr := r.URL.Query().Get("_HLS_part")
+		if partStr != "" {
+			partUint, errPart := strconv.ParseUint(partStr, 10, 32)
+			if errPart != nil {
+				http.Error(w, "Invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+			part = int64(partUint)
+		}
+		if len(groups) > 0 && msn > groups[len(groups)-1].groupSequence+HLS_MAX_MSN_AHEAD {
+			http.Error(w, "_HLS_msn too far from the live edge", http.StatusBadRequest)
+			return
+		}
+		hls.waitFor(r, func() bool {
+			groups = hls.getGroups(track)
+			return hasPlaylistPart(groups, msn, part)
+		})
+	}
+	if len(groups) == 0 {
+		http.Error(w, "Track NOT found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", HLS_PLAYLIST_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, hls.createPlaylist(track, groups))
+}
+
+func (hls *MoqHls) serveInit(w http.ResponseWriter, r *http.Request) {
+	track, ok := hls.checkRequest(w, r)
+	if !ok {
+		return
+	}
+	if hls.config.InitTrackSuffix == "" {
+		http.Error(w, "Init segments NOT configured", http.StatusNotFound)
+		return
+	}
+
+	initTrackName := track.trackName + hls.config.InitTrackSuffix
+	found, _, largestGroup, largestObject := hls.objects.GetTrackLargest(track.trackNamespace, initTrackName)
+	if !found {
+		http.Error(w, "Init segment NOT found", http.StatusNotFound)
+		return
+	}
+	hls.writeObjects(w, hls.objects.GetTrackRange(track.trackNamespace, initTrackName, largestGroup, largestObject, largestGroup, largestObject))
+}
+
+func (hls *MoqHls) serveSegment(w http.ResponseWriter, r *http.Request) {
+	track, ok := hls.checkRequest(w, r)
+	if !ok {
+		return
+	}
+	groupSequence, errGroup := strconv.ParseUint(r.URL.Query().Get("group"), 10, 64)
+	if errGroup != nil {
+		http.Error(w, "Invalid group", http.StatusBadRequest)
+		return
+	}
+
+	// Only complete groups (a newer one started)
+	found, _, largestGroup, _ := hls.objects.GetTrackLargest(track.trackNamespace, track.trackName)
+	if !found || largestGroup <= groupSequence {
+		http.Error(w, "Segment NOT found", http.StatusNotFound)
+		return
+	}
+	hls.writeObjects(w, hls.objects.GetTrackRange(track.trackNamespace, track.trackName, groupSequence, 0, groupSequence, math.MaxUint64))
+}
+
+func (hls *MoqHls) servePart(w http.ResponseWriter, r *http.Request) {
+	track, ok := hls.checkRequest(w, r)
+	if !ok {
+		return
+	}
+	groupSequence, errGroup := strconv.ParseUint(r.URL.Query().Get("group"), 10, 64)
+	objectSequence, errObject := strconv.ParseUint(r.URL.Query().Get("object"), 10, 64)
+	if errGroup != nil || errObject != nil {
+		http.Error(w, "Invalid group / object", http.StatusBadRequest)
+		return
+	}
+
+	// Preload hint parts are requested before the object arrives
+	cacheKeys := []string{}
+	hls.waitFor(r, func() bool {
+		cacheKeys = hls.objects.GetTrackRange(track.trackNamespace, track.trackName, groupSequence, objectSequence, groupSequence, objectSequence)
+		return len(cacheKeys) > 0
+	})
+	hls.writeObjects(w, cacheKeys)
+}
+
+// Helpers
+
+// checkRequest Validates the method, CORS origin, track and authorization, it writes the error response if NOT ok
+func (hls *MoqHls) checkRequest(w http.ResponseWriter, r *http.Request) (track hlsTrack, ok bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if hls.checkOrigin != nil && !hls.checkOrigin(r) {
+		http.Error(w, "Origin NOT allowed", http.StatusForbidden)
+		return
+	}
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+
+	query := r.URL.Query()
+	track = hlsTrack{trackNamespace: query.Get("namespace"), trackName: query.Get("track"), authInfo: query.Get("token")}
+	if track.trackNamespace == "" || track.trackName == "" {
+		http.Error(w, "namespace and track are required", http.StatusBadRequest)
+		return
+	}
+	if hls.authorizer != nil {
+		errAuthorize := hls.authorizer.AuthorizeSubscribe(moqauth.MoqAuthRequest{Action: moqauth.MoqAuthActionSubscribe, TrackNamespace: track.trackNamespace, TrackName: track.trackName, AuthInfo: track.authInfo, SessionName: HLS_AUTH_SESSION_NAME, Role: moqhelpers.MoqRoleSubscriber, Metadata: moqsession.MoqSessionMetadata{RemoteAddr: r.RemoteAddr, UserAgent: r.UserAgent()}})
+		if errAuthorize != nil {
+			http.Error(w, "Unauthorized", http.StatusForbidden)
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// waitFor Returns true when isReady, false after BlockingTimeoutMs or if the client disconnects
+func (hls *MoqHls) waitFor(r *http.Request, isReady func() bool) bool {
+	if isReady() {
+		return true
+	}
+	timeoutAt := hls.clock.Now().Add(time.Duration(hls.config.BlockingTimeoutMs) * time.Millisecond)
+	ticker := hls.clock.NewTicker(HLS_BLOCKING_POLL_MS * time.Millisecond)
+	defer ticker.Stop()
+
+	for hls.clock.Now().Before(timeoutAt) {
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-ticker.C():
+		}
+		if isReady() {
+			return true
+		}
+	}
+	return false
+}
+
+// getGroups Returns the last run of consecutive cached groups of the track, the last one is the live edge (it can be in progress)
+func (hls *MoqHls) getGroups(track hlsTrack) (groups []hlsGroup) {
+	groups = []hlsGroup{}
+	for _, moqObj := range hls.objects.GetTrackObjects(track.trackNamespace, track.trackName) {
+		if len(groups) == 0 || groups[len(groups)-1].groupSequence != moqObj.GroupSequence {
+			if len(groups) > 0 && moqObj.GroupSequence != groups[len(groups)-1].groupSequence+1 {
+				// Missing group, media sequence numbers have to be consecutive
+				groups = []hlsGroup{}
+			}
+			groups = append(groups, hlsGroup{groupSequence: moqObj.GroupSequence, objects: []*moqobject.MoqObject{}})
+		}
+		groups[len(groups)-1].objects = append(groups[len(groups)-1].objects, moqObj)
+	}
+	return
+}
+
+// hasPlaylistPart Returns true if the playlist of these groups has the segment msn complete, or its part (index in the segment, -1 whole segment)
+func hasPlaylistPart(groups []hlsGroup, msn uint64, part int64) bool {
+	if len(groups) == 0 {
+		return false
+	}
+	liveGroup := groups[len(groups)-1]
+	if liveGroup.groupSequence > msn {
+		return true
+	}
+	if liveGroup.groupSequence < msn || part < 0 {
+		return false
+	}
+	// Parts of the live group are listed once the next object arrives (duration known)
+	return int64(len(liveGroup.objects)-1) > part
+}
+
+// createSegments Returns the segments to list, the last one is the live edge (only parts)
+func (hls *MoqHls) createSegments(groups []hlsGroup) (segments []hlsSegment) {
+	segments = []hlsSegment{}
+	liveIndex := len(groups) - 1
+	firstIndex := liveIndex - hls.config.PlaylistSegments
+	if firstIndex < 0 {
+		firstIndex = 0
+	}
+	for groupIndex := firstIndex; groupIndex <= liveIndex; groupIndex++ {
+		group := groups[groupIndex]
+		segment := hlsSegment{groupSequence: group.groupSequence, startAt: group.objects[0].ReceivedAt, parts: []hlsPart{}}
+		if groupIndex < liveIndex {
+			segment.duration = getDuration(group.objects[0], groups[groupIndex+1].objects[0])
+		}
+		if groupIndex >= liveIndex-HLS_PART_SEGMENTS {
+			for objIndex, moqObj := range group.objects {
+				var next *moqobject.MoqObject = nil
+				if objIndex+1 < len(group.objects) {
+					next = group.objects[objIndex+1]
+				} else if groupIndex < liveIndex {
+					next = groups[groupIndex+1].objects[0]
+				}
+				if next == nil {
+					// Duration NOT known yet (preload hint)
+					break
+				}
+				segment.parts = append(segment.parts, hlsPart{moqObj: moqObj, duration: getDuration(moqObj, next), independent: objIndex == 0})
+			}
+		}
+		segments = append(segments, segment)
+	}
+	return
+}
+
+func (hls *MoqHls) createPlaylist(track hlsTrack, groups []hlsGroup) string {
+	segments := hls.createSegments(groups)
+	liveGroup := groups[len(groups)-1]
+
+	targetDuration := time.Second
+	partTarget := time.Duration(hls.config.PartTargetMs) * time.Millisecond
+	for _, segment := range segments {
+		if segment.duration > targetDuration {
+			targetDuration = segment.duration
+		}
+		for _, part := range segment.parts {
+			if part.duration > partTarget {
+				partTarget = part.duration
+			}
+		}
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:9\n")
+	playlist.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int64(math.Ceil(targetDuration.Seconds()))))
+	playlist.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds()))
+	playlist.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds()))
+	playlist.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].groupSequence))
+	if hls.config.InitTrackSuffix != "" {
+		playlist.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", hls.createUri("init.mp4", track, nil)))
+	}
+	playlist.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", segments[0].startAt.UTC().Format("2006-01-02T15:04:05.000Z07:00")))
+	for segmentIndex, segment := range segments {
+		for _, part := range segment.parts {
+			partUri := hls.createUri("part"+hls.getMediaExtension(), track, url.Values{"group": {strconv.FormatUint(part.moqObj.GroupSequence, 10)}, "object": {strconv.FormatUint(part.moqObj.ObjectSequence, 10)}})
+			independent := ""
+			if part.independent {
+				independent = ",INDEPENDENT=YES"
+			}
+			playlist.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s\"%s\n", part.duration.Seconds(), partUri, independent))
+		}
+		if segmentIndex < len(segments)-1 {
+			playlist.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", segment.duration.Seconds()))
+			playlist.WriteString(hls.createUri("segment"+hls.getMediaExtension(), track, url.Values{"group": {strconv.FormatUint(segment.groupSequence, 10)}}) + "\n")
+		}
+	}
+	// Latest object (being received), its duration is NOT known yet
+	latestObj := liveGroup.objects[len(liveGroup.objects)-1]
+	hintUri := hls.createUri("part"+hls.getMediaExtension(), track, url.Values{"group": {strconv.FormatUint(latestObj.GroupSequence, 10)}, "object": {strconv.FormatUint(latestObj.ObjectSequence, 10)}})
+	playlist.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", hintUri))
+
+	return playlist.String()
+}
+
+// createUri Returns a URI relative to the playlist with the track (and token) params
+func (hls *MoqHls) createUri(resource string, track hlsTrack, params url.Values) string {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("namespace", track.trackNamespace)
+	params.Set("track", track.trackName)
+	if track.authInfo != "" {
+		params.Set("token", track.authInfo)
+	}
+	return resource + "?" + params.Encode()
+}
+
+// writeObjects Writes the payloads of the objects (in order) as they arrive
+func (hls *MoqHls) writeObjects(w http.ResponseWriter, cacheKeys []string) {
+	moqObjs := []*moqobject.MoqObject{}
+	for _, cacheKey := range cacheKeys {
+		moqObj, found := hls.objects.Get(cacheKey)
+		if found {
+			moqObjs = append(moqObjs, moqObj)
+		}
+	}
+	if len(moqObjs) == 0 {
+		http.Error(w, "NOT found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", hls.getMediaContentType())
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, HLS_COPY_BUFFER_SIZE)
+	for _, moqObj := range moqObjs {
+		reader := moqObj.NewReader()
+		for {
+			n, errRead := reader.Read(buffer)
+			if n > 0 {
+				_, errWrite := w.Write(buffer[:n])
+				if errWrite != nil {
+					log.Debug(fmt.Sprintf("Writing HLS object %s. Err: %v", moqObj.GetDebugStr(), errWrite))
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			if errRead == io.EOF {
+				break
+			}
+			if errRead != nil {
+				log.Error(fmt.Sprintf("Reading HLS object %s. Err: %v", moqObj.GetDebugStr(), errRead))
+				return
+			}
+		}
+	}
+}
+
+func (hls *MoqHls) getMediaExtension() string {
+	if hls.config.InitTrackSuffix != "" {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+func (hls *MoqHls) getMediaContentType() string {
+	if hls.config.InitTrackSuffix != "" {
+		return "video/mp4"
+	}
+	return "video/mp2t"
+}
+
+func getDuration(moqObj *moqobject.MoqObject, next *moqobject.MoqObject) time.Duration {
+	duration := next.ReceivedAt.Sub(moqObj.ReceivedAt)
+	if duration < 0 {
+		duration = 0
+	}
+	return duration
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqhooks
+
+import (
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqsession"
+	"sync"
+)
+
+// MoqHooks Application / plugin callbacks on MOQ events (custom auth, billing, analytics). They are called from the session goroutines, so they should NOT block
+type MoqHooks interface {
+	// OnAnnounce Called after the relay checks passed, returning an error rejects the ANNOUNCE (unauthorized, with the error as message)
+	OnAnnounce(moqSession *moqsession.MoqSession, announce moqhelpers.MoqMessageAnnounce) error
+	// OnSubscribe Called after the relay checks passed, returning an error rejects the SUBSCRIBE (unauthorized, with the error as message)
+	OnSubscribe(moqSession *moqsession.MoqSession, subscribe moqhelpers.MoqMessageSubscribe) error
+	// OnObject Called when an object payload was received from a publisher (or origin)
+	OnObject(moqSession *moqsession.MoqSession, trackNamespace string, trackName string, header moqobject.MoqObjectHeader, payloadBytes uint64)
+	// OnSessionClose Called when the session is removed from the relay
+	OnSessionClose(moqSession *moqsession.MoqSession)
+}
+
+// MoqHooksBase No-op implementation, embed it to implement only some of the callbacks
+type MoqHooksBase struct{}
+
+func (MoqHooksBase) OnAnnounce(moqSession *moqsession.MoqSession, announce moqhelpers.MoqMessageAnnounce) error {
+	return nil
+}
+
+func (MoqHooksBase) OnSubscribe(moqSession *moqsession.MoqSession, subscribe moqhelpers.MoqMessageSubscribe) error {
+	return nil
+}
+
+func (MoqHooksBase) OnObject(moqSession *moqsession.MoqSession, trackNamespace string, trackName string, header moqobject.MoqObjectHeader, payloadBytes uint64) {
+}
+
+func (MoqHooksBase) OnSessionClose(moqSession *moqsession.MoqSession) {}
+
+// MoqHooksRegistry Hooks registered on the server, called in registration order (the first veto wins)
+type MoqHooksRegistry struct {
+	// Protected
+	hooks []MoqHooks
+	lock  *sync.RWMutex
+}
+
+// New Creates an empty registry
+func New() *MoqHooksRegistry {
+	return &MoqHooksRegistry{hooks: []MoqHooks{}, lock: new(sync.RWMutex)}
+}
+
+// Register Adds hooks to the server
+func (registry *MoqHooksRegistry) Register(hooks MoqHooks) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.hooks = append(registry.hooks, hooks)
+}
+
+func (registry *MoqHooksRegistry) OnAnnounce(moqSession *moqsession.MoqSession, announce moqhelpers.MoqMessageAnnounce) (err error) {
+	for _, hooks := range registry.getHooks() {
+		err = hooks.OnAnnounce(moqSession, announce)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (registry *MoqHooksRegistry) OnSubscribe(moqSession *moqsession.MoqSession, subscribe moqhelpers.MoqMessageSubscribe) (err error) {
+	for _, hooks := range registry.getHooks() {
+		err = hooks.OnSubscribe(moqSession, subscribe)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (registry *MoqHooksRegistry) OnObject(moqSession *moqsession.MoqSession, trackNamespace string, trackName string, header moqobject.MoqObjectHeader, payloadBytes uint64) {
+	for _, hooks := range registry.getHooks() {
+		hooks.OnObject(moqSession, trackNamespace, trackName, header, payloadBytes)
+	}
+}
+
+func (registry *MoqHooksRegistry) OnSessionClose(moqSession *moqsession.MoqSession) {
+	for _, hooks := range registry.getHooks() {
+		hooks.OnSessionClose(moqSession)
+	}
+}
+
+// getHooks Returns the registered hooks (nil registry has none)
+func (registry *MoqHooksRegistry) getHooks() []MoqHooks {
+	if registry == nil {
+		return nil
+	}
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return registry.hooks
+}
@@ -0,0 +1,224 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqhttporigin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const HTTP_ORIGIN_SHUTDOWN_TIMEOUT_MS = 5000
+
+const HTTP_ORIGIN_COPY_BUFFER_SIZE = 32 * 1024
+
+const HTTP_ORIGIN_PATH_PREFIX = "/objects/"
+
+// Session name used in the authorization requests of the HTTP clients
+const HTTP_ORIGIN_AUTH_SESSION_NAME = "http-origin"
+
+type MoqHttpOriginConfig struct {
+	ListenAddr string
+	// Used if TLSConfig is nil
+	CertPath string
+	KeyPath  string
+	// Same TLS config as the relay (dev certificate, ACME, client CA), nil uses the cert files
+	TLSConfig *tls.Config
+}
+
+// MoqHttpOrigin HTTPS (TCP) listener that serves the cached objects (GET /objects/[namespace]/[track]/[group]/[object]) with cache headers, so a standard CDN can front the relay
+type MoqHttpOrigin struct {
+	server *http.Server
+	config MoqHttpOriginConfig
+
+	objects *moqmessageobjects.MoqMessageObjects
+	// nil allows everything
+	authorizer moqauth.MoqAuthorizer
+	// Web origins allowed (CORS), nil any
+	checkOrigin func(r *http.Request) bool
+
+	clock moqclock.Clock
+}
+
+// New Creates the HTTP origin
+func New(config MoqHttpOriginConfig, objects *moqmessageobjects.MoqMessageObjects, authorizer moqauth.MoqAuthorizer, checkOrigin func(r *http.Request) bool, clock moqclock.Clock) *MoqHttpOrigin {
+	mux := http.NewServeMux()
+	ho := &MoqHttpOrigin{server: &http.Server{Addr: config.ListenAddr, Handler: mux}, config: config, objects: objects, authorizer: authorizer, checkOrigin: checkOrigin, clock: clock}
+	if config.TLSConfig != nil {
+		ho.server.TLSConfig = config.TLSConfig.Clone()
+		// The relay one is for HTTP3, let ServeTLS set the HTTP2 / HTTP1.1 ones
+		ho.server.TLSConfig.NextProtos = nil
+	}
+
+	mux.HandleFunc(HTTP_ORIGIN_PATH_PREFIX, ho.serveObject)
+	return ho
+}
+
+func (ho *MoqHttpOrigin) ListenAndServe() (err error) {
+	log.Info(fmt.Sprintf("Serving HTTP origin. Addr: %s", ho.server.Addr))
+
+	if ho.server.TLSConfig != nil {
+		err = ho.server.ListenAndServeTLS("", "")
+	} else {
+		err = ho.server.ListenAndServeTLS(ho.config.CertPath, ho.config.KeyPath)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return
+}
+
+func (ho *MoqHttpOrigin) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HTTP_ORIGIN_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	return ho.server.Shutdown(ctx)
+}
+
+// Handlers
+
+func (ho *MoqHttpOrigin) serveObject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ho.checkOrigin != nil && !ho.checkOrigin(r) {
+		http.Error(w, "Origin NOT allowed", http.StatusForbidden)
+		return
+	}
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+
+	trackNamespace, trackName, moqObjHeader, errPath := parseObjectPath(r.URL.EscapedPath())
+	if errPath != nil {
+		http.Error(w, errPath.Error(), http.StatusBadRequest)
+		return
+	}
+	if ho.authorizer != nil {
+		errAuthorize := ho.authorizer.AuthorizeSubscribe(moqauth.MoqAuthRequest{Action: moqauth.MoqAuthActionSubscribe, TrackNamespace: trackNamespace, TrackName: trackName, AuthInfo: getAuthInfo(r), SessionName: HTTP_ORIGIN_AUTH_SESSION_NAME, Role: moqhelpers.MoqRoleSubscriber, Metadata: moqsession.MoqSessionMetadata{RemoteAddr: r.RemoteAddr, UserAgent: r.UserAgent()}})
+		if errAuthorize != nil {
+			http.Error(w, "Unauthorized", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Same key as the relay cache (it also reads the disk tier)
+	moqObj, found := ho.objects.Get(moqconnectionmanagment.CreateObjectCacheKey(trackNamespace, trackName, moqObjHeader))
+	age := time.Duration(0)
+	if found {
+		age = ho.clock.Now().Sub(moqObj.ReceivedAt)
+	}
+	if !found || age >= time.Duration(moqObj.MaxAgeS)*time.Second {
+		// It can be published later, it must NOT be cached
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "NOT found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// Objects never change, CDNs can keep them until they expire from the relay cache
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", moqObj.MaxAgeS))
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	w.Header().Set("Last-Modified", moqObj.ReceivedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Moq-Send-Order", strconv.FormatUint(moqObj.SendOrder, 10))
+	if moqObj.GetEof() {
+		w.Header().Set("Content-Length", strconv.Itoa(moqObj.GetPayloadSize()))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	ho.writeObject(w, moqObj)
+}
+
+// writeObject Streams the payload, objects still being received are sent chunked as their bytes arrive
+func (ho *MoqHttpOrigin) writeObject(w http.ResponseWriter, moqObj *moqobject.MoqObject) {
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, HTTP_ORIGIN_COPY_BUFFER_SIZE)
+	reader := moqObj.NewReader()
+	for {
+		n, errRead := reader.Read(buffer)
+		if n > 0 {
+			_, errWrite := w.Write(buffer[:n])
+			if errWrite != nil {
+				log.Debug(fmt.Sprintf("Writing HTTP origin object %s. Err: %v", moqObj.GetDebugStr(), errWrite))
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if errRead == io.EOF {
+			return
+		}
+		if errRead != nil {
+			// Aborted by the publisher, break the response so the CDN does NOT cache a truncated object
+			log.Error(fmt.Sprintf("Reading HTTP origin object %s. Err: %v", moqObj.GetDebugStr(), errRead))
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// Helpers
+
+// getAuthInfo Returns the bearer token of the Authorization header, or the token query param if there is NOT one
+func getAuthInfo(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// parseObjectPath Parses /objects/[namespace]/[track]/[group]/[object] (escaped path), the namespace can have "/"
+func parseObjectPath(escapedPath string) (trackNamespace string, trackName string, moqObjHeader moqobject.MoqObjectHeader, err error) {
+	parts := strings.Split(strings.TrimPrefix(escapedPath, HTTP_ORIGIN_PATH_PREFIX), "/")
+	if len(parts) < 4 {
+		err = errors.New("Expected path " + HTTP_ORIGIN_PATH_PREFIX + "[namespace]/[track]/[group]/[object]")
+		return
+	}
+	groupSequence, errGroup := strconv.ParseUint(parts[len(parts)-2], 10, 64)
+	objectSequence, errObject := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	if errGroup != nil || errObject != nil {
+		err = errors.New(fmt.Sprintf("Invalid group / object sequence %s/%s", parts[len(parts)-2], parts[len(parts)-1]))
+		return
+	}
+	trackName, errTrack := url.PathUnescape(parts[len(parts)-3])
+	if errTrack != nil {
+		err = errors.New(fmt.Sprintf("Invalid track %s. Err: %v", parts[len(parts)-3], errTrack))
+		return
+	}
+	trackNamespace, errNamespace := url.PathUnescape(strings.Join(parts[:len(parts)-3], "/"))
+	if errNamespace != nil {
+		err = errors.New(fmt.Sprintf("Invalid namespace. Err: %v", errNamespace))
+		return
+	}
+	if trackNamespace == "" || trackName == "" {
+		err = errors.New("namespace and track are required")
+		return
+	}
+	moqObjHeader = moqobject.MoqObjectHeader{GroupSequence: groupSequence, ObjectSequence: objectSequence}
+	return
+}
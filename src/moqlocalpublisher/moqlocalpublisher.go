@@ -0,0 +1,243 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqlocalpublisher
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// MoqLocalPublisher Publisher session inside the relay (ex: replay, ingest bridges), subscribers use its namespace and tracks the same way as the ones of remote publishers
+type MoqLocalPublisher struct {
+	trackNamespace string
+	moqSession     *moqsession.MoqSession
+
+	moqtFwdTable *moqfwdtable.MoqFwdTable
+	objects      *moqmessageobjects.MoqMessageObjects
+	connConfig   moqconnectionmanagment.MoqConnectionConfig
+
+	// Protected
+	tracks        map[string]uint64
+	nextTrackId   uint64
+	autoAddTracks bool
+	// Called (from the answer subscribes thread) after answering a SUBSCRIBE OK, nil none
+	onSubscribe func(trackName string)
+	closed      bool
+	lock        *sync.RWMutex
+}
+
+// New Creates a local publisher session (name is also its remote address in the admin API) and announces its namespace
+func New(name string, trackNamespace string, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig moqconnectionmanagment.MoqConnectionConfig) (lp *MoqLocalPublisher, err error) {
+	moqSession := moqsession.New(name+"/"+uuid.New().String(), moqhelpers.MOQ_SUPPORTED_VERSION, moqhelpers.MoqRolePublisher, moqsession.MoqSessionMetadata{RemoteAddr: name}, connConfig.ObjQueueSize, connConfig.ObjQueuePolicy, connConfig.SkipToLatestGroup, connConfig.Clock)
+	errAddSession := moqtFwdTable.AddSession(moqSession)
+	if errAddSession != nil {
+		err = errAddSession
+		return
+	}
+	errAnnounce := moqtFwdTable.AddAnnouncePublisher(trackNamespace, moqSession.UniqueName)
+	if errAnnounce == nil {
+		errAnnounce = moqSession.AddTrackNamespace(moqhelpers.CreateAnnounce(trackNamespace, ""))
+	}
+	if errAnnounce != nil {
+		moqtFwdTable.RemoveSession(moqSession.UniqueName)
+		err = errors.New(fmt.Sprintf("Can NOT announce namespace %s. Err: %v", trackNamespace, errAnnounce))
+		return
+	}
+	moqSession.SetState(moqsession.MoqSessionStateEstablished)
+	connConfig.Events.SessionConnected(moqSession, false)
+	connConfig.Events.Announce(moqSession.UniqueName, moqhelpers.MoqMessageAnnounceError{}, trackNamespace)
+
+	lp = &MoqLocalPublisher{trackNamespace: trackNamespace, moqSession: moqSession, moqtFwdTable: moqtFwdTable, objects: objects, connConfig: connConfig, tracks: map[string]uint64{}, lock: new(sync.RWMutex)}
+	go lp.answerSubscribes()
+
+	lp.getLog().Info("Created local publisher session")
+	return
+}
+
+// GetSessionName Returns the unique name of the publisher session
+func (lp *MoqLocalPublisher) GetSessionName() string {
+	return lp.moqSession.UniqueName
+}
+
+// GetTrackNamespace Returns the announced namespace
+func (lp *MoqLocalPublisher) GetTrackNamespace() string {
+	return lp.trackNamespace
+}
+
+// AddTrack Adds a track that can be subscribed (if it already exists it returns its trackId)
+func (lp *MoqLocalPublisher) AddTrack(trackName string) (trackId uint64, err error) {
+	lp.lock.Lock()
+	trackId, found := lp.tracks[trackName]
+	if found {
+		lp.lock.Unlock()
+		return
+	}
+	trackId = lp.nextTrackId
+	err = lp.moqSession.AddTrackInfo(lp.trackNamespace, trackName, trackId)
+	if err == nil {
+		lp.tracks[trackName] = trackId
+		lp.nextTrackId++
+	}
+	lp.lock.Unlock()
+
+	if err == nil {
+		// Wildcard subscribers
+		lp.moqtFwdTable.TrackAdded(lp.trackNamespace, trackName)
+	}
+	return
+}
+
+// SetAutoAddTracks If enabled the SUBSCRIBEs to tracks NOT added yet add them (ex: tracks published by another relay instance, NOT known in advance)
+func (lp *MoqLocalPublisher) SetAutoAddTracks(autoAddTracks bool) {
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+
+	lp.autoAddTracks = autoAddTracks
+}
+
+// SetOnSubscribe Sets the function called with the track name every time a SUBSCRIBE is answered OK (ex: to request the objects from elsewhere), it should NOT block
+func (lp *MoqLocalPublisher) SetOnSubscribe(onSubscribe func(trackName string)) {
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+
+	lp.onSubscribe = onSubscribe
+}
+
+// GetTracks Returns the names of the added tracks
+func (lp *MoqLocalPublisher) GetTracks() (trackNames []string) {
+	lp.lock.RLock()
+	defer lp.lock.RUnlock()
+
+	trackNames = make([]string, 0, len(lp.tracks))
+	for trackName := range lp.tracks {
+		trackNames = append(trackNames, trackName)
+	}
+	return
+}
+
+// PublishObject Adds an object to the relay (cache and subscribers) as if it was received from a remote publisher
+func (lp *MoqLocalPublisher) PublishObject(trackName string, groupSequence uint64, objectSequence uint64, sendOrder uint64, payload []byte) (err error) {
+	lp.lock.RLock()
+	trackId, found := lp.tracks[trackName]
+	closed := lp.closed
+	lp.lock.RUnlock()
+	if closed {
+		err = errors.New(fmt.Sprintf("Local publisher %s is closed", lp.moqSession.UniqueName))
+		return
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("Track %s/%s NOT added to local publisher %s", lp.trackNamespace, trackName, lp.moqSession.UniqueName))
+		return
+	}
+
+	receivedAt := lp.connConfig.Clock.Now()
+	moqObjHeader := moqobject.MoqObjectHeader{TrackId: trackId, GroupSequence: groupSequence, ObjectSequence: objectSequence, SendOrder: sendOrder}
+	cacheKey := moqconnectionmanagment.CreateObjectCacheKey(lp.trackNamespace, trackName, moqObjHeader)
+	moqObj, errAddingMoqObj := lp.objects.Create(lp.trackNamespace, trackName, cacheKey, moqObjHeader, lp.connConfig.ObjExpMs/1000)
+	if errAddingMoqObj != nil {
+		err = errAddingMoqObj
+		return
+	}
+	lp.moqtFwdTable.ReceivedObject(lp.trackNamespace, trackName, cacheKey, moqObjHeader)
+
+	moqObj.PayloadWrite(payload)
+	moqObj.SetEof()
+
+	lp.connConfig.Bandwidth.AddIngest(uint64(len(payload)))
+	lp.moqtFwdTable.ReceivedObjectPayload(lp.trackNamespace, trackName, uint64(len(payload)))
+	lp.moqSession.AddReceivedObject(uint64(len(payload)))
+	lp.connConfig.Metrics.ObjectReceived(uint64(len(payload)))
+	lp.moqtFwdTable.ReceivedObjectEof(lp.trackNamespace, trackName, lp.connConfig.Clock.Now().Sub(receivedAt))
+	lp.connConfig.Events.ObjectReceived(lp.trackNamespace, trackName)
+	lp.moqSession.TouchObjects()
+	return
+}
+
+// Close Removes the publisher session (same as a remote publisher disconnecting)
+func (lp *MoqLocalPublisher) Close() {
+	lp.lock.Lock()
+	if lp.closed {
+		lp.lock.Unlock()
+		return
+	}
+	lp.closed = true
+	lp.lock.Unlock()
+
+	lp.moqSession.SetState(moqsession.MoqSessionStateDraining)
+	lp.connConfig.Events.SessionDisconnected(lp.moqSession, false, lp.connConfig.Clock.Now().Sub(lp.moqSession.CreatedAt))
+	// Also stops the answer subscribes thread
+	errRemoveSession := lp.moqtFwdTable.RemoveSession(lp.moqSession.UniqueName)
+	if errRemoveSession != nil {
+		lp.getLog().WithError(errRemoveSession).Error("Error removing session")
+	}
+	lp.getLog().Info("Closed local publisher session")
+}
+
+func (lp *MoqLocalPublisher) getLog() *log.Entry {
+	return log.WithFields(log.Fields{"session": lp.moqSession.UniqueName, "namespace": lp.trackNamespace})
+}
+
+// Thread that answers the SUBSCRIBEs forwarded to this publisher (same as a remote publisher would do)
+
+func (lp *MoqLocalPublisher) answerSubscribes() {
+	bExit := false
+	for bExit == false {
+		fwdSubscribe, unSubscribe, stop := lp.moqSession.GetNewSubscribe()
+		if stop {
+			bExit = true
+		} else if unSubscribe {
+			lp.getLog().WithField("track", fwdSubscribe.TrackName).Info("Received UNSUBSCRIBE")
+		} else {
+			lp.lock.RLock()
+			trackId, found := lp.tracks[fwdSubscribe.TrackName]
+			autoAddTracks := lp.autoAddTracks
+			onSubscribe := lp.onSubscribe
+			lp.lock.RUnlock()
+
+			if !found && autoAddTracks && fwdSubscribe.TrackNamespace == lp.trackNamespace {
+				var errAddTrack error
+				trackId, errAddTrack = lp.AddTrack(fwdSubscribe.TrackName)
+				found = errAddTrack == nil
+				if errAddTrack != nil {
+					lp.getLog().WithField("track", fwdSubscribe.TrackName).WithError(errAddTrack).Error("Adding track on SUBSCRIBE")
+				}
+			}
+			if !found || fwdSubscribe.TrackNamespace != lp.trackNamespace {
+				moqSubscribeError := moqhelpers.MoqMessageSubscribeError{TrackNamespace: fwdSubscribe.TrackNamespace, TrackName: fwdSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: "Track NOT found"}
+				errForward := lp.moqtFwdTable.ForwardSubscribeError(moqSubscribeError, lp.moqSession.UniqueName)
+				if errForward != nil {
+					lp.getLog().WithError(errForward).Error("Forwarding SUBSCRIBE error")
+				}
+				continue
+			}
+			moqSubscribeOk := moqhelpers.MoqMessageSubscribeOk{TrackNamespace: lp.trackNamespace, TrackName: fwdSubscribe.TrackName, TrackId: trackId, Expires: 0}
+			errForward := lp.moqtFwdTable.ForwardSubscribeOk(moqSubscribeOk, lp.moqSession.UniqueName)
+			if errForward != nil {
+				// Subscriber can be gone
+				lp.getLog().WithError(errForward).Error("Forwarding SUBSCRIBE OK")
+			} else {
+				lp.getLog().WithField("moqMsg", moqSubscribeOk).Info("Answered SUBSCRIBE OK")
+				lp.moqSession.AddForwardedSubscribe()
+				if onSubscribe != nil {
+					onSubscribe(fwdSubscribe.TrackName)
+				}
+			}
+		}
+	}
+
+	lp.getLog().Info("Exit answer subscribes thread")
+}
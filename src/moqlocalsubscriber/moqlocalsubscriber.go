@@ -0,0 +1,162 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqlocalsubscriber
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// MoqLocalSubscriber Subscriber session inside the relay (ex: demand of other relay instances), it keeps its tracks subscribed upstream so the publishers send their objects to the relay (cache and other subscribers), the objects are NOT sent anywhere
+type MoqLocalSubscriber struct {
+	moqSession *moqsession.MoqSession
+
+	moqtFwdTable *moqfwdtable.MoqFwdTable
+	connConfig   moqconnectionmanagment.MoqConnectionConfig
+
+	// Protected
+	closed bool
+	lock   *sync.Mutex
+}
+
+// New Creates a local subscriber session (name is also its remote address in the admin API)
+func New(name string, moqtFwdTable *moqfwdtable.MoqFwdTable, connConfig moqconnectionmanagment.MoqConnectionConfig) (ls *MoqLocalSubscriber, err error) {
+	moqSession := moqsession.New(name+"/"+uuid.New().String(), moqhelpers.MOQ_SUPPORTED_VERSION, moqhelpers.MoqRoleSubscriber, moqsession.MoqSessionMetadata{RemoteAddr: name}, connConfig.ObjQueueSize, connConfig.ObjQueuePolicy, connConfig.SkipToLatestGroup, connConfig.Clock)
+	err = moqtFwdTable.AddSession(moqSession)
+	if err != nil {
+		return
+	}
+	moqSession.SetState(moqsession.MoqSessionStateEstablished)
+	connConfig.Events.SessionConnected(moqSession, false)
+
+	ls = &MoqLocalSubscriber{moqSession: moqSession, moqtFwdTable: moqtFwdTable, connConfig: connConfig, lock: new(sync.Mutex)}
+	go ls.discardObjects()
+	go ls.receiveSubscribeResponses()
+
+	ls.getLog().Info("Created local subscriber session")
+	return
+}
+
+// GetSessionName Returns the unique name of the subscriber session
+func (ls *MoqLocalSubscriber) GetSessionName() string {
+	return ls.moqSession.UniqueName
+}
+
+// Subscribe Subscribes to the track (forwarded to its publishers as any SUBSCRIBE), nothing if it is already subscribed
+func (ls *MoqLocalSubscriber) Subscribe(trackNamespace string, trackName string) (err error) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	if ls.closed {
+		err = errors.New(fmt.Sprintf("Local subscriber %s is closed", ls.moqSession.UniqueName))
+		return
+	}
+	subscribe := moqhelpers.MoqMessageSubscribe{TrackNamespace: trackNamespace, TrackName: trackName, RelayTrace: []string{ls.moqtFwdTable.RelayId}}
+	duplicated, _, _, errAdd := ls.moqSession.AddSubscribeRequest(subscribe, moqsession.MoqDuplicateSubscribePolicyReject)
+	if duplicated {
+		return
+	}
+	if errAdd != nil {
+		err = errAdd
+		return
+	}
+	ls.moqtFwdTable.AddTrackSubscriber(trackNamespace, trackName, ls.moqSession)
+	err = ls.moqtFwdTable.ForwardSubscribe(subscribe, ls.moqSession.UniqueName)
+	if err != nil {
+		ls.removeSubscription(trackNamespace, trackName)
+		return
+	}
+	ls.getLog().WithFields(log.Fields{"namespace": trackNamespace, "track": trackName}).Info("Local subscriber subscribed")
+	return
+}
+
+// UnSubscribe Removes the subscription of the track (unsubscribed upstream if it was the last subscriber)
+func (ls *MoqLocalSubscriber) UnSubscribe(trackNamespace string, trackName string) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	if ls.closed {
+		return
+	}
+	ls.removeSubscription(trackNamespace, trackName)
+	ls.getLog().WithFields(log.Fields{"namespace": trackNamespace, "track": trackName}).Info("Local subscriber unsubscribed")
+}
+
+// GetSubscribedTracks Returns the subscribed tracks (also the ones waiting for SUBSCRIBE OK)
+func (ls *MoqLocalSubscriber) GetSubscribedTracks() []moqsession.MoqTrack {
+	return ls.moqSession.GetSubscribedTracks()
+}
+
+// Close Removes the subscriber session (same as a remote subscriber disconnecting)
+func (ls *MoqLocalSubscriber) Close() {
+	ls.lock.Lock()
+	if ls.closed {
+		ls.lock.Unlock()
+		return
+	}
+	ls.closed = true
+	ls.lock.Unlock()
+
+	ls.moqSession.SetState(moqsession.MoqSessionStateDraining)
+	ls.connConfig.Events.SessionDisconnected(ls.moqSession, false, ls.connConfig.Clock.Now().Sub(ls.moqSession.CreatedAt))
+	// Also stops the threads
+	errRemoveSession := ls.moqtFwdTable.RemoveSession(ls.moqSession.UniqueName)
+	if errRemoveSession != nil {
+		ls.getLog().WithError(errRemoveSession).Error("Error removing session")
+	}
+	ls.getLog().Info("Closed local subscriber session")
+}
+
+// removeSubscription (needs lock)
+func (ls *MoqLocalSubscriber) removeSubscription(trackNamespace string, trackName string) {
+	ls.moqtFwdTable.RemoveTrackSubscriber(trackNamespace, trackName, ls.moqSession.UniqueName)
+	ls.moqSession.RemoveSubscribeRequest(trackNamespace, trackName)
+}
+
+func (ls *MoqLocalSubscriber) getLog() *log.Entry {
+	return log.WithField("session", ls.moqSession.UniqueName)
+}
+
+// Threads
+
+// discardObjects Empties the objects queue, they are already in the cache
+func (ls *MoqLocalSubscriber) discardObjects() {
+	for {
+		_, _, stop := ls.moqSession.GetNewObject()
+		if stop {
+			return
+		}
+	}
+}
+
+// receiveSubscribeResponses Removes the subscriptions that failed or were reset by the publisher (they can be subscribed again)
+func (ls *MoqLocalSubscriber) receiveSubscribeResponses() {
+	for {
+		moqSubscribeResponse, _, stop := ls.moqSession.GetNewSubscribeResponse()
+		if stop {
+			break
+		}
+		switch response := moqSubscribeResponse.(type) {
+		case moqhelpers.MoqMessageSubscribeError:
+			ls.getLog().WithField("moqMsg", response).Warning("Local subscriber SUBSCRIBE error")
+			ls.UnSubscribe(response.TrackNamespace, response.TrackName)
+		case moqhelpers.MoqMessageSubscribeRst:
+			ls.getLog().WithField("moqMsg", response).Info("Local subscriber subscription reset")
+			ls.UnSubscribe(response.TrackNamespace, response.TrackName)
+		}
+	}
+
+	ls.getLog().Info("Exit subscribe responses thread")
+}
@@ -0,0 +1,58 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqlogsampler
+
+import (
+	"sync"
+)
+
+// Tracks with counters, when reached counters start again (avoids growing with old tracks)
+const LOG_SAMPLER_MAX_TRACKS = 10000
+
+// MoqLogSampler Decides which objects are logged, 1 in every N per track (errors should always be logged)
+type MoqLogSampler struct {
+	// 0 none, 1 all
+	every uint64
+
+	// Protected
+	counters map[string]uint64
+	lock     *sync.Mutex
+}
+
+// New Creates a sampler that logs 1 in every objects per track (0 none, 1 all)
+func New(every uint64) *MoqLogSampler {
+	return &MoqLogSampler{every: every, counters: map[string]uint64{}, lock: new(sync.Mutex)}
+}
+
+// Sample Returns true if this object of the track should be logged (nil sampler logs all)
+func (ls *MoqLogSampler) Sample(trackNamespace string, trackName string) bool {
+	if ls == nil || ls.every == 1 {
+		return true
+	}
+	if ls.every == 0 {
+		return false
+	}
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	trackKey := trackNamespace + "/" + trackName
+	counter, found := ls.counters[trackKey]
+	if !found && len(ls.counters) >= LOG_SAMPLER_MAX_TRACKS {
+		ls.counters = map[string]uint64{}
+	}
+	ls.counters[trackKey] = counter + 1
+	return counter%ls.every == 0
+}
+
+// GetEvery Returns the sampling rate (1 in every)
+func (ls *MoqLogSampler) GetEvery() uint64 {
+	if ls == nil {
+		return 1
+	}
+	return ls.every
+}
@@ -0,0 +1,557 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqorigins"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Period this instance increases its heartbeat and gossips the members it knows
+const MESH_GOSSIP_PERIOD_MS = 1000
+
+// Members gossiped to every period (random ones, seeds are added while there are NO members)
+const MESH_GOSSIP_FANOUT = 3
+
+// Members whose heartbeat did NOT increase for this time are removed (ex: instance crashed)
+const MESH_MEMBER_TIMEOUT_MS = 5 * MESH_GOSSIP_PERIOD_MS
+
+// Max gossip message (UDP datagram), bigger ones are NOT sent (too many members / namespaces)
+const MESH_MAX_MESSAGE_BYTES = 65000
+
+// Name of the origins to the peers (guid and friendly name prefix)
+const MESH_SESSION_NAME = "mesh"
+
+type MoqMeshConfig struct {
+	// UDP address the gossip is received in (example: ":7946")
+	BindAddr string
+	// UDP address the other members send the gossip to, empty the source address of the messages of this instance
+	AdvertiseAddr string
+	// Gossip addresses (host:port) of some members used to join the mesh
+	Seeds   []string
+	RelayId string
+	// MoQ URL of this instance reachable by the other members (https://host:port/moq or moq://host:port), they connect to it to subscribe to its namespaces
+	RelayUrl string
+	// Shared by all the members, the messages are signed with it (HMAC-SHA256), empty NOT signed
+	Secret string
+	// PEM CA bundle added to the system ones to verify the relay URLs of the other members, empty system ones
+	CAPath string
+}
+
+// MoqMeshMember State of a member gossiped in the mesh, the one with the highest heartbeat wins
+type MoqMeshMember struct {
+	RelayId    string `json:"relayId"`
+	RelayUrl   string `json:"relayUrl"`
+	GossipAddr string `json:"gossipAddr"`
+	Heartbeat  uint64 `json:"heartbeat"`
+	// Namespaces announced in the member (its publishers)
+	TrackNamespaces []string `json:"trackNamespaces"`
+	// Member stopped (kept until it expires so older states do NOT add it again)
+	Left bool `json:"left,omitempty"`
+}
+
+// MoqMeshStats Counters of the mesh
+type MoqMeshStats struct {
+	Members          int    `json:"members"`
+	Origins          int    `json:"origins"`
+	MessagesSent     uint64 `json:"messagesSent"`
+	MessagesReceived uint64 `json:"messagesReceived"`
+	// Not signed with the secret, malformed or too big to be sent
+	MessagesInvalid uint64 `json:"messagesInvalid"`
+}
+
+// moqMeshMessage Gossip message, the first member is the sender
+type moqMeshMessage struct {
+	Members []MoqMeshMember `json:"members"`
+}
+
+type moqMeshMemberExt struct {
+	MoqMeshMember
+	// When its heartbeat increased
+	updatedAt time.Time
+}
+
+// moqMeshOrigin On demand origin to the member that announces a namespace
+type moqMeshOrigin struct {
+	trackNamespace string
+	relayId        string
+	relayUrl       string
+}
+
+// MoqMesh Relay instances that discover each other with gossip (UDP) and exchange the namespaces announced in each one. The namespaces of the other members are served with on demand origins (relay sessions) to them, added and removed automatically, nil disabled
+type MoqMesh struct {
+	config        MoqMeshConfig
+	conn          *net.UDPConn
+	relayCertData []byte
+
+	moqtFwdTable *moqfwdtable.MoqFwdTable
+	moqOrigins   *moqorigins.MoqOrigins
+	clock        moqclock.Clock
+
+	done    chan bool
+	workers *sync.WaitGroup
+
+	messagesSent     atomic.Uint64
+	messagesReceived atomic.Uint64
+	messagesInvalid  atomic.Uint64
+
+	// Protected
+	self    MoqMeshMember
+	members map[string]*moqMeshMemberExt
+	origins map[string]moqMeshOrigin
+	stopped bool
+	lock    *sync.Mutex
+	// Serializes the changes of the origins
+	originsLock *sync.Mutex
+}
+
+// New Starts receiving and sending the gossip, the origins to the other members are added to moqOrigins
+func New(config MoqMeshConfig, moqtFwdTable *moqfwdtable.MoqFwdTable, moqOrigins *moqorigins.MoqOrigins, clock moqclock.Clock) (mesh *MoqMesh, err error) {
+	if config.RelayUrl == "" {
+		err = errors.New("Mesh relay URL (MoQ URL of this instance) is required")
+		return
+	}
+	var relayCertData []byte = nil
+	if config.CAPath != "" {
+		relayCertData, err = os.ReadFile(config.CAPath)
+		if err != nil {
+			return
+		}
+	}
+	bindAddr, errResolve := net.ResolveUDPAddr("udp", config.BindAddr)
+	if errResolve != nil {
+		err = errResolve
+		return
+	}
+	conn, errListen := net.ListenUDP("udp", bindAddr)
+	if errListen != nil {
+		err = errListen
+		return
+	}
+	seeds := []string{}
+	for _, seed := range config.Seeds {
+		if strings.TrimSpace(seed) != "" {
+			seeds = append(seeds, strings.TrimSpace(seed))
+		}
+	}
+	config.Seeds = seeds
+
+	self := MoqMeshMember{RelayId: config.RelayId, RelayUrl: config.RelayUrl, GossipAddr: config.AdvertiseAddr, TrackNamespaces: []string{}}
+	mesh = &MoqMesh{config: config, conn: conn, relayCertData: relayCertData, moqtFwdTable: moqtFwdTable, moqOrigins: moqOrigins, clock: clock, done: make(chan bool), workers: new(sync.WaitGroup), self: self, members: map[string]*moqMeshMemberExt{}, origins: map[string]moqMeshOrigin{}, lock: new(sync.Mutex), originsLock: new(sync.Mutex)}
+
+	mesh.workers.Add(2)
+	go mesh.runReceiver()
+	go mesh.runGossip()
+
+	log.Info(fmt.Sprintf("Mesh gossip listening on %s, seeds %v, relay URL %s", conn.LocalAddr().String(), config.Seeds, config.RelayUrl))
+	return
+}
+
+// GetMembers Returns the other members alive (nil returns none)
+func (mesh *MoqMesh) GetMembers() (members []MoqMeshMember) {
+	members = []MoqMeshMember{}
+	if mesh == nil {
+		return
+	}
+	mesh.lock.Lock()
+	defer mesh.lock.Unlock()
+
+	for _, member := range mesh.members {
+		if !member.Left {
+			members = append(members, member.MoqMeshMember)
+		}
+	}
+	slices.SortFunc(members, func(a MoqMeshMember, b MoqMeshMember) int {
+		return strings.Compare(a.RelayId, b.RelayId)
+	})
+	return
+}
+
+// GetStats Returns the mesh counters (nil returns zeros)
+func (mesh *MoqMesh) GetStats() (stats MoqMeshStats) {
+	if mesh == nil {
+		return
+	}
+	stats.Members = len(mesh.GetMembers())
+	mesh.lock.Lock()
+	stats.Origins = len(mesh.origins)
+	mesh.lock.Unlock()
+
+	stats.MessagesSent = mesh.messagesSent.Load()
+	stats.MessagesReceived = mesh.messagesReceived.Load()
+	stats.MessagesInvalid = mesh.messagesInvalid.Load()
+	return
+}
+
+// Stop Tells the members this instance left, removes the origins to them and stops the gossip
+func (mesh *MoqMesh) Stop() {
+	if mesh == nil {
+		return
+	}
+	mesh.lock.Lock()
+	if mesh.stopped {
+		mesh.lock.Unlock()
+		return
+	}
+	mesh.stopped = true
+	mesh.self.Heartbeat++
+	mesh.self.Left = true
+	mesh.self.TrackNamespaces = []string{}
+	targets := []string{}
+	for _, member := range mesh.members {
+		if !member.Left && member.GossipAddr != "" {
+			targets = append(targets, member.GossipAddr)
+		}
+	}
+	mesh.lock.Unlock()
+
+	mesh.sendGossip(targets)
+	close(mesh.done)
+	mesh.conn.Close()
+	mesh.workers.Wait()
+	mesh.removeOrigins()
+}
+
+// mergeMembers Applies the received states (newer heartbeats), the sender without gossip address uses the source of the message. Returns true if the members or their namespaces changed
+func (mesh *MoqMesh) mergeMembers(msg moqMeshMessage, sourceAddr string) (changed bool) {
+	mesh.lock.Lock()
+	defer mesh.lock.Unlock()
+
+	if mesh.stopped {
+		return
+	}
+	now := mesh.clock.Now()
+	for i, state := range msg.Members {
+		if state.RelayId == "" || state.RelayId == mesh.config.RelayId {
+			continue
+		}
+		if i == 0 && state.GossipAddr == "" {
+			state.GossipAddr = sourceAddr
+		}
+		member, found := mesh.members[state.RelayId]
+		if found && state.Heartbeat <= member.Heartbeat {
+			continue
+		}
+		if state.TrackNamespaces == nil {
+			state.TrackNamespaces = []string{}
+		}
+		if !found {
+			if state.Left {
+				continue
+			}
+			log.WithFields(log.Fields{"relayId": state.RelayId, "relayUrl": state.RelayUrl, "gossipAddr": state.GossipAddr}).Info("Mesh member joined")
+			changed = true
+		} else if state.Left && !member.Left {
+			log.WithField("relayId", state.RelayId).Info("Mesh member left")
+			changed = true
+		} else if member.Left && !state.Left {
+			log.WithFields(log.Fields{"relayId": state.RelayId, "relayUrl": state.RelayUrl}).Info("Mesh member joined again")
+			changed = true
+		} else if state.RelayUrl != member.RelayUrl || !slices.Equal(state.TrackNamespaces, member.TrackNamespaces) {
+			changed = true
+		}
+		mesh.members[state.RelayId] = &moqMeshMemberExt{MoqMeshMember: state, updatedAt: now}
+	}
+	return
+}
+
+// expireMembers Removes the members whose heartbeat did NOT increase (the left ones are kept for the same time)
+func (mesh *MoqMesh) expireMembers() {
+	mesh.lock.Lock()
+	defer mesh.lock.Unlock()
+
+	now := mesh.clock.Now()
+	for relayId, member := range mesh.members {
+		if now.Sub(member.updatedAt) < MESH_MEMBER_TIMEOUT_MS*time.Millisecond {
+			continue
+		}
+		delete(mesh.members, relayId)
+		if !member.Left {
+			log.WithField("relayId", relayId).Warning("Mesh member timed out")
+		}
+	}
+}
+
+// createGossip Increases the heartbeat of this instance (with its current namespaces) and returns the message and the members to send it to
+func (mesh *MoqMesh) createGossip() (msg moqMeshMessage, targets []string) {
+	trackNamespaces := []string{}
+	for _, namespaceInfo := range mesh.moqtFwdTable.ListNamespaces() {
+		trackNamespaces = append(trackNamespaces, namespaceInfo.TrackNamespace)
+	}
+
+	mesh.lock.Lock()
+	defer mesh.lock.Unlock()
+
+	if mesh.stopped {
+		return
+	}
+	mesh.self.Heartbeat++
+	mesh.self.TrackNamespaces = trackNamespaces
+	msg.Members = append(msg.Members, mesh.self)
+	alive := []string{}
+	for _, member := range mesh.members {
+		msg.Members = append(msg.Members, member.MoqMeshMember)
+		if !member.Left && member.GossipAddr != "" {
+			alive = append(alive, member.GossipAddr)
+		}
+	}
+	rand.Shuffle(len(alive), func(i int, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	if len(alive) > MESH_GOSSIP_FANOUT {
+		alive = alive[:MESH_GOSSIP_FANOUT]
+	}
+	targets = alive
+	if len(mesh.members) == 0 {
+		// Joining (or alone after a partition)
+		targets = append(targets, mesh.config.Seeds...)
+	}
+	return
+}
+
+// sendGossip Sends the state of this instance and the members it knows to the targets
+func (mesh *MoqMesh) sendGossip(targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	msg := moqMeshMessage{}
+	mesh.lock.Lock()
+	msg.Members = append(msg.Members, mesh.self)
+	for _, member := range mesh.members {
+		msg.Members = append(msg.Members, member.MoqMeshMember)
+	}
+	mesh.lock.Unlock()
+	mesh.send(msg, targets)
+}
+
+func (mesh *MoqMesh) send(msg moqMeshMessage, targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	data, errMarshal := json.Marshal(msg)
+	if errMarshal != nil {
+		mesh.messagesInvalid.Add(1)
+		log.WithError(errMarshal).Error("Encoding mesh gossip")
+		return
+	}
+	data = mesh.sign(data)
+	if len(data) > MESH_MAX_MESSAGE_BYTES {
+		mesh.messagesInvalid.Add(1)
+		log.Error(fmt.Sprintf("Mesh gossip of %d bytes is bigger than %d (too many members / namespaces), NOT sent", len(data), MESH_MAX_MESSAGE_BYTES))
+		return
+	}
+	for _, target := range targets {
+		addr, errResolve := net.ResolveUDPAddr("udp", target)
+		if errResolve == nil {
+			_, errResolve = mesh.conn.WriteToUDP(data, addr)
+		}
+		if errResolve != nil {
+			log.WithField("addr", target).WithError(errResolve).Debug("Sending mesh gossip")
+			continue
+		}
+		mesh.messagesSent.Add(1)
+	}
+}
+
+// sign Prepends the HMAC of the data (nothing if there is NO secret)
+func (mesh *MoqMesh) sign(data []byte) []byte {
+	if mesh.config.Secret == "" {
+		return data
+	}
+	mac := hmac.New(sha256.New, []byte(mesh.config.Secret))
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
+
+// verify Returns the data without the HMAC, false if it is NOT valid
+func (mesh *MoqMesh) verify(signed []byte) (data []byte, valid bool) {
+	if mesh.config.Secret == "" {
+		return signed, true
+	}
+	if len(signed) < sha256.Size {
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(mesh.config.Secret))
+	mac.Write(signed[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), signed[:sha256.Size]) {
+		return
+	}
+	return signed[sha256.Size:], true
+}
+
+// Origins
+
+// reconcileOrigins Adds an on demand origin per namespace announced in other members (NOT locally), to the member with the lowest relay id if several announce it, and removes the rest. Origins removed outside the mesh (ex: origins reload) are added again
+func (mesh *MoqMesh) reconcileOrigins() {
+	mesh.originsLock.Lock()
+	defer mesh.originsLock.Unlock()
+
+	existing := map[string]bool{}
+	for _, status := range mesh.moqOrigins.GetStatus() {
+		existing[status.Guid] = true
+	}
+	local := map[string]bool{}
+	for _, namespaceInfo := range mesh.moqtFwdTable.ListNamespaces() {
+		local[namespaceInfo.TrackNamespace] = true
+	}
+
+	mesh.lock.Lock()
+	if mesh.stopped {
+		mesh.lock.Unlock()
+		return
+	}
+	owners := map[string]*moqMeshMemberExt{}
+	for _, member := range mesh.members {
+		if member.Left {
+			continue
+		}
+		for _, trackNamespace := range member.TrackNamespaces {
+			owner, found := owners[trackNamespace]
+			if !local[trackNamespace] && (!found || member.RelayId < owner.RelayId) {
+				owners[trackNamespace] = member
+			}
+		}
+	}
+	desired := map[string]moqMeshOrigin{}
+	for trackNamespace, owner := range owners {
+		desired[createOriginGuid(owner.RelayId, trackNamespace)] = moqMeshOrigin{trackNamespace: trackNamespace, relayId: owner.RelayId, relayUrl: owner.RelayUrl}
+	}
+	current := mesh.origins
+	mesh.origins = desired
+	mesh.lock.Unlock()
+
+	moved := []string{}
+	for guid, origin := range current {
+		desiredOrigin, keep := desired[guid]
+		if keep && desiredOrigin.relayUrl == origin.relayUrl {
+			continue
+		}
+		if existing[guid] {
+			mesh.moqOrigins.Remove(guid)
+			existing[guid] = false
+		}
+		if !keep {
+			log.WithFields(log.Fields{"namespace": origin.trackNamespace, "relayId": origin.relayId}).Info("Removed mesh origin")
+		}
+		if mesh.moqtFwdTable.GetNamespaceDemand(origin.trackNamespace) > 0 {
+			moved = append(moved, origin.trackNamespace)
+		}
+	}
+	for guid, origin := range desired {
+		if existing[guid] {
+			continue
+		}
+		_, errAdd := mesh.moqOrigins.Add(mesh.createOriginData(guid, origin))
+		if errAdd != nil {
+			log.WithFields(log.Fields{"namespace": origin.trackNamespace, "relayId": origin.relayId}).WithError(errAdd).Error("Adding mesh origin")
+			continue
+		}
+		_, wasCurrent := current[guid]
+		if !wasCurrent {
+			log.WithFields(log.Fields{"namespace": origin.trackNamespace, "relayId": origin.relayId}).Info("Added mesh origin")
+		}
+	}
+	for _, trackNamespace := range moved {
+		// The subscriptions of the previous member are resubscribed when the new origin connects
+		mesh.moqOrigins.Demand(trackNamespace)
+	}
+}
+
+// removeOrigins Closes all the origins to the members (stop)
+func (mesh *MoqMesh) removeOrigins() {
+	mesh.originsLock.Lock()
+	defer mesh.originsLock.Unlock()
+
+	mesh.lock.Lock()
+	current := mesh.origins
+	mesh.origins = map[string]moqMeshOrigin{}
+	mesh.lock.Unlock()
+
+	for guid := range current {
+		mesh.moqOrigins.Remove(guid)
+	}
+}
+
+func (mesh *MoqMesh) createOriginData(guid string, origin moqMeshOrigin) moqorigins.MoqOriginData {
+	return moqorigins.MoqOriginData{Guid: guid, FriendlyName: MESH_SESSION_NAME + "-" + origin.relayId, TrackNamespace: origin.trackNamespace, OriginAddress: origin.relayUrl, Lazy: true, CertData: mesh.relayCertData}
+}
+
+// Threads
+
+// runReceiver Merges the received gossip until stopped
+func (mesh *MoqMesh) runReceiver() {
+	defer mesh.workers.Done()
+
+	buffer := make([]byte, MESH_MAX_MESSAGE_BYTES)
+	for {
+		size, sourceAddr, errRead := mesh.conn.ReadFromUDP(buffer)
+		if errRead != nil {
+			select {
+			case <-mesh.done:
+				return
+			default:
+			}
+			log.WithError(errRead).Error("Receiving mesh gossip")
+			continue
+		}
+		data, valid := mesh.verify(buffer[:size])
+		msg := moqMeshMessage{}
+		if valid {
+			valid = json.Unmarshal(data, &msg) == nil && len(msg.Members) > 0
+		}
+		if !valid {
+			mesh.messagesInvalid.Add(1)
+			log.WithField("addr", sourceAddr.String()).Debug("Invalid mesh gossip")
+			continue
+		}
+		mesh.messagesReceived.Add(1)
+		if mesh.mergeMembers(msg, sourceAddr.String()) {
+			go mesh.reconcileOrigins()
+		}
+	}
+}
+
+// runGossip Sends the gossip, expires the members and updates the origins every period until stopped
+func (mesh *MoqMesh) runGossip() {
+	defer mesh.workers.Done()
+
+	ticker := mesh.clock.NewTicker(MESH_GOSSIP_PERIOD_MS * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		msg, targets := mesh.createGossip()
+		mesh.send(msg, targets)
+		mesh.expireMembers()
+		mesh.reconcileOrigins()
+
+		select {
+		case <-ticker.C():
+		case <-mesh.done:
+			return
+		}
+	}
+}
+
+// Helpers
+
+func createOriginGuid(relayId string, trackNamespace string) string {
+	return fmt.Sprintf("%s-%s-%s", MESH_SESSION_NAME, relayId, trackNamespace)
+}
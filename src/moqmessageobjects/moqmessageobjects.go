@@ -7,15 +7,145 @@ LICENSE file in the root directory of this source tree.
 package moqmessageobjects
 
 import (
+	"container/heap"
+	"container/list"
 	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqdiskcache"
 	"facebookexperimental/moq-go-server/moqobject"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 )
 
+// What to do when an object with the same cache key is received again (redundant publishers)
+type MoqObjDedupPolicy string
+
+const (
+	// Replace the cached object (if complete) and forward it again
+	MoqObjDedupPolicyNone MoqObjDedupPolicy = "none"
+	// Discard the second copy
+	MoqObjDedupPolicyKey MoqObjDedupPolicy = "key"
+	// Discard the second copy if the payload is the same, if not replace the cached object and forward it
+	MoqObjDedupPolicyPayload MoqObjDedupPolicy = "payload"
+)
+
+// The cache is NOT healthy if the housekeeping did not run for this number of periods
+const HEALTH_MAX_MISSED_CLEANUPS = 3
+
+// ErrDuplicatedObject Returned by Create when the cache key is already cached (dedup enabled)
+var ErrDuplicatedObject = errors.New("Duplicated object")
+
+// MoqCacheQuota Max cache usage of a namespace (0 unlimited)
+type MoqCacheQuota struct {
+	MaxBytes   uint64 `json:"maxBytes"`
+	MaxObjects uint64 `json:"maxObjects"`
+}
+
+// MoqCacheQuotasData Cache quotas, default (applied to each namespace) and per namespace overrides
+type MoqCacheQuotasData struct {
+	Default MoqCacheQuota `json:"default"`
+	// Per namespace overrides
+	Namespaces map[string]MoqCacheQuota `json:"namespaces"`
+}
+
+type MoqCacheNamespaceStats struct {
+	Objects           uint64 `json:"objects"`
+	Bytes             uint64 `json:"bytes"`
+	Hits              uint64 `json:"hits"`
+	Misses            uint64 `json:"misses"`
+	OldestObjectAgeMs int64  `json:"oldestObjectAgeMs"`
+	NewestObjectAgeMs int64  `json:"newestObjectAgeMs"`
+}
+
+type MoqCacheStats struct {
+	Objects              uint64                             `json:"objects"`
+	Bytes                uint64                             `json:"bytes"`
+	MaxBytes             uint64                             `json:"maxBytes"`
+	Hits                 uint64                             `json:"hits"`
+	Misses               uint64                             `json:"misses"`
+	DiskHits             uint64                             `json:"diskHits"`
+	EvictedObjects       uint64                             `json:"evictedObjects"`
+	EvictedBytes         uint64                             `json:"evictedBytes"`
+	QuotaRejectedObjects uint64                             `json:"quotaRejectedObjects"`
+	DuplicatedObjects    uint64                             `json:"duplicatedObjects"`
+	Disk                 *moqdiskcache.MoqDiskCacheStats    `json:"disk,omitempty"`
+	Namespaces           map[string]*MoqCacheNamespaceStats `json:"namespaces"`
+}
+
+type moqCacheRequests struct {
+	hits   uint64
+	misses uint64
+}
+
+type moqNamespaceUsage struct {
+	// Updated on every payload write (without the map lock)
+	bytes   atomic.Int64
+	objects uint64
+	// Bytes quota of the namespace (0 unlimited), checked on every payload write (without the map lock)
+	maxBytes atomic.Uint64
+}
+
+// Track / position of a cached object
+type moqCacheKeyInfo struct {
+	trackNamespace string
+	trackName      string
+	groupSequence  uint64
+	objectSequence uint64
+	// Payload bytes counted in the cache size, updated on every payload write (without the map lock), negative once the object is removed
+	storedBytes atomic.Int64
+	// Unique per created object, a replaced cache key gets a new one
+	generation uint64
+}
+
+type moqIndexedObject struct {
+	objectSequence uint64
+	cacheKey       string
+}
+
+// moqTrackIndex Cached objects of a track ordered by group and object sequence
+type moqTrackIndex struct {
+	// Sorted
+	groups []uint64
+	// Group -> objects sorted by object sequence
+	objects map[uint64][]moqIndexedObject
+}
+
+// Largest group / object received of a track
+type moqTrackLatest struct {
+	trackId        uint64
+	groupSequence  uint64
+	objectSequence uint64
+}
+
+// Time when a cached object has to be deleted (or moved to the disk tier), it does NOT reference the object so removed objects are released before it expires
+type moqExpiration struct {
+	at         time.Time
+	cacheKey   string
+	generation uint64
+	spill      bool
+}
+
+// moqExpirationHeap Min-heap of expirations (container/heap)
+type moqExpirationHeap []moqExpiration
+
+func (h moqExpirationHeap) Len() int            { return len(h) }
+func (h moqExpirationHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h moqExpirationHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *moqExpirationHeap) Push(x interface{}) { *h = append(*h, x.(moqExpiration)) }
+func (h *moqExpirationHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[0 : n-1]
+	return item
+}
+
 // File Definition of files
 type MoqMessageObjects struct {
 	dataMap map[string]*moqobject.MoqObject
@@ -23,13 +153,63 @@ type MoqMessageObjects struct {
 	// FilesLock Lock used to write / read files
 	mapLock *sync.RWMutex
 
+	// Memory cap (0 unlimited), evicts least recently used (closed) objects
+	maxBytes   uint64
+	totalBytes atomic.Int64
+	// Cache keys of closed objects (open ones are added on EOF), most recently used first
+	lru         *list.List
+	lruElements map[string]*list.Element
+	lruLock     *sync.Mutex
+
+	evictedObjects uint64
+	evictedBytes   uint64
+
+	// Per namespace quotas
+	quotas            MoqCacheQuotasData
+	namespacesUsage   map[string]*moqNamespaceUsage
+	quotaRejectedObjs uint64
+
+	// Per track ordered index (range queries)
+	cacheKeysInfo map[string]*moqCacheKeyInfo
+	// Last generation assigned to a created object
+	lastGeneration uint64
+	tracksIndex    map[string]*moqTrackIndex
+	// Per track latest pointer (updated on create)
+	tracksLatest map[string]moqTrackLatest
+
+	// Objects with a cache key already cached
+	dedupPolicy       MoqObjDedupPolicy
+	duplicatedObjects uint64
+
+	// Namespaces which objects are compressed in memory (text-like tracks)
+	compressedNamespaces map[string]bool
+
+	// Disk tier (optional), receives the evicted objects and the ones older than diskSpillAfterS (0 only evicted)
+	disk            *moqdiskcache.MoqDiskCache
+	diskSpillAfterS uint64
+
+	// Get counters, per namespace (kept after its objects are deleted)
+	namespacesRequests map[string]*moqCacheRequests
+	diskHits           uint64
+	// Misses of cache keys that do NOT belong to any known namespace
+	unknownNamespaceMisses uint64
+	statsLock              *sync.Mutex
+
+	// Objects ordered by expiration (housekeeping)
+	expirations moqExpirationHeap
+
 	// Housekeeping thread channel
 	cleanUpChannel chan bool
+	// Housekeeping period and last run (protected by statsLock)
+	housekeepingPeriodMs uint64
+	lastCleanUpAt        time.Time
+
+	clock moqclock.Clock
 }
 
 // New Creates a new mem files map
-func New(housekeepingPeriodMs uint64) *MoqMessageObjects {
-	moqtObjs := MoqMessageObjects{dataMap: map[string]*moqobject.MoqObject{}, mapLock: new(sync.RWMutex), cleanUpChannel: make(chan bool)}
+func New(housekeepingPeriodMs uint64, maxBytes uint64, clock moqclock.Clock) *MoqMessageObjects {
+	moqtObjs := MoqMessageObjects{dataMap: map[string]*moqobject.MoqObject{}, mapLock: new(sync.RWMutex), maxBytes: maxBytes, lru: list.New(), lruElements: map[string]*list.Element{}, lruLock: new(sync.Mutex), quotas: MoqCacheQuotasData{Namespaces: map[string]MoqCacheQuota{}}, namespacesUsage: map[string]*moqNamespaceUsage{}, dedupPolicy: MoqObjDedupPolicyNone, compressedNamespaces: map[string]bool{}, cacheKeysInfo: map[string]*moqCacheKeyInfo{}, tracksIndex: map[string]*moqTrackIndex{}, tracksLatest: map[string]moqTrackLatest{}, expirations: moqExpirationHeap{}, namespacesRequests: map[string]*moqCacheRequests{}, statsLock: new(sync.Mutex), cleanUpChannel: make(chan bool), housekeepingPeriodMs: housekeepingPeriodMs, lastCleanUpAt: clock.Now(), clock: clock}
 
 	if housekeepingPeriodMs > 0 {
 		moqtObjs.startCleanUp(housekeepingPeriodMs)
@@ -38,28 +218,400 @@ func New(housekeepingPeriodMs uint64) *MoqMessageObjects {
 	return &moqtObjs
 }
 
-func (moqtObjs *MoqMessageObjects) Create(cacheKey string, objHeader moqobject.MoqObjectHeader, defObjExpirationS uint64) (moqObj *moqobject.MoqObject, err error) {
+// SetQuotas Sets the per namespace cache quotas
+func (moqtObjs *MoqMessageObjects) SetQuotas(quotasData MoqCacheQuotasData) {
+	moqtObjs.mapLock.Lock()
+	defer moqtObjs.mapLock.Unlock()
+
+	if quotasData.Namespaces == nil {
+		quotasData.Namespaces = map[string]MoqCacheQuota{}
+	}
+	moqtObjs.quotas = quotasData
+	for trackNamespace, usage := range moqtObjs.namespacesUsage {
+		usage.maxBytes.Store(moqtObjs.getQuota(trackNamespace).MaxBytes)
+	}
+
+	log.Info(fmt.Sprintf("Loaded cache quotas, default: %d bytes / %d objects, namespace overrides: %d", quotasData.Default.MaxBytes, quotasData.Default.MaxObjects, len(quotasData.Namespaces)))
+}
+
+// SetDedupPolicy Sets what to do when a cache key is received again
+func (moqtObjs *MoqMessageObjects) SetDedupPolicy(dedupPolicy MoqObjDedupPolicy) {
+	moqtObjs.mapLock.Lock()
+	defer moqtObjs.mapLock.Unlock()
+
+	moqtObjs.dedupPolicy = dedupPolicy
+}
+
+func (moqtObjs *MoqMessageObjects) GetDedupPolicy() MoqObjDedupPolicy {
+	moqtObjs.mapLock.RLock()
+	defer moqtObjs.mapLock.RUnlock()
+
+	return moqtObjs.dedupPolicy
+}
+
+// SetCompressedNamespaces Sets the namespaces which objects payloads are compressed when complete
+func (moqtObjs *MoqMessageObjects) SetCompressedNamespaces(trackNamespaces []string) {
+	moqtObjs.mapLock.Lock()
+	defer moqtObjs.mapLock.Unlock()
+
+	moqtObjs.compressedNamespaces = map[string]bool{}
+	for _, trackNamespace := range trackNamespaces {
+		moqtObjs.compressedNamespaces[trackNamespace] = true
+	}
+}
+
+// SetDiskTier Sets the disk tier used to store the objects that do NOT fit in memory
+func (moqtObjs *MoqMessageObjects) SetDiskTier(disk *moqdiskcache.MoqDiskCache, diskSpillAfterS uint64) {
+	moqtObjs.mapLock.Lock()
+	defer moqtObjs.mapLock.Unlock()
+
+	moqtObjs.disk = disk
+	moqtObjs.diskSpillAfterS = diskSpillAfterS
+}
+
+// Create Adds a new object to the cache, returns error if the object can NOT be cached (it should be dropped).
+// If dedup is enabled and the cache key is cached it returns ErrDuplicatedObject and the cached object
+func (moqtObjs *MoqMessageObjects) Create(trackNamespace string, trackName string, cacheKey string, objHeader moqobject.MoqObjectHeader, defObjExpirationS uint64) (moqObj *moqobject.MoqObject, err error) {
+	return moqtObjs.create(trackNamespace, trackName, cacheKey, objHeader, defObjExpirationS, true)
+}
+
+// Replace Same as Create but it replaces the cached object (if complete) regardless of the dedup policy
+func (moqtObjs *MoqMessageObjects) Replace(trackNamespace string, trackName string, cacheKey string, objHeader moqobject.MoqObjectHeader, defObjExpirationS uint64) (moqObj *moqobject.MoqObject, err error) {
+	return moqtObjs.create(trackNamespace, trackName, cacheKey, objHeader, defObjExpirationS, false)
+}
+
+func (moqtObjs *MoqMessageObjects) create(trackNamespace string, trackName string, cacheKey string, objHeader moqobject.MoqObjectHeader, defObjExpirationS uint64, dedup bool) (moqObj *moqobject.MoqObject, err error) {
 	moqtObjs.mapLock.Lock()
 	defer moqtObjs.mapLock.Unlock()
 
 	foundObj, found := moqtObjs.dataMap[cacheKey]
+	if found && dedup && moqtObjs.dedupPolicy != MoqObjDedupPolicyNone {
+		moqtObjs.duplicatedObjects++
+		moqObj = foundObj
+		err = ErrDuplicatedObject
+		return
+	}
 	if found && !foundObj.GetEof() {
 		err = errors.New("We can NOT override on open object")
 		return
 	}
 
-	moqObj = moqobject.New(objHeader, defObjExpirationS)
+	// The replaced object usage is freed, but only if the new one fits
+	freedObjects := uint64(0)
+	freedBytes := int64(0)
+	if found {
+		freedObjects = 1
+		freedBytes = max(moqtObjs.cacheKeysInfo[cacheKey].storedBytes.Load(), 0)
+	}
+	errQuota := moqtObjs.checkQuota(trackNamespace, freedObjects, freedBytes)
+	if errQuota != nil {
+		moqtObjs.quotaRejectedObjs++
+		err = errQuota
+		return
+	}
+
+	if found {
+		moqtObjs.removeObject(cacheKey)
+	}
+
+	if moqtObjs.disk != nil {
+		moqtObjs.disk.Remove(cacheKey)
+	}
+
+	moqObj = moqobject.New(objHeader, defObjExpirationS, moqtObjs.clock.Now())
+	if moqtObjs.compressedNamespaces[trackNamespace] {
+		moqObj.SetCompressOnEof()
+	}
 	moqtObjs.dataMap[cacheKey] = moqObj
+	moqtObjs.lastGeneration++
+	generation := moqtObjs.lastGeneration
+	keyInfo := &moqCacheKeyInfo{trackNamespace: trackNamespace, trackName: trackName, groupSequence: objHeader.GroupSequence, objectSequence: objHeader.ObjectSequence, generation: generation}
+	moqtObjs.cacheKeysInfo[cacheKey] = keyInfo
+	moqtObjs.getTrackIndex(trackNamespace, trackName).add(objHeader.GroupSequence, objHeader.ObjectSequence, cacheKey)
+	moqtObjs.updateTrackLatest(trackNamespace, trackName, objHeader)
+	usage := moqtObjs.getNamespaceUsage(trackNamespace)
+	usage.objects++
+	moqtObjs.statsLock.Lock()
+	if _, foundRequests := moqtObjs.namespacesRequests[trackNamespace]; !foundRequests {
+		moqtObjs.namespacesRequests[trackNamespace] = &moqCacheRequests{}
+	}
+	moqtObjs.statsLock.Unlock()
+	heap.Push(&moqtObjs.expirations, moqExpiration{at: moqObj.ReceivedAt.Add(time.Second * time.Duration(moqObj.MaxAgeS)), cacheKey: cacheKey, generation: generation})
+	if moqtObjs.disk != nil && moqtObjs.diskSpillAfterS > 0 && moqtObjs.diskSpillAfterS < moqObj.MaxAgeS {
+		heap.Push(&moqtObjs.expirations, moqExpiration{at: moqObj.ReceivedAt.Add(time.Second * time.Duration(moqtObjs.diskSpillAfterS)), cacheKey: cacheKey, generation: generation, spill: true})
+	}
+
+	moqObj.SetOnPayloadWrite(func(n int) {
+		if !moqtObjs.payloadAdded(cacheKey, keyInfo, usage, int64(n)) {
+			// Over the namespace bytes quota, NOT cached anymore and the publisher stops sending it
+			moqObj.Abort()
+		}
+	})
+	moqObj.SetOnEof(func() {
+		moqtObjs.objectClosed(cacheKey, keyInfo)
+	})
 
 	return
 }
 
+// Get Returns the object from memory, or from the disk tier if it is NOT in memory
 func (moqtObjs *MoqMessageObjects) Get(cacheKey string) (moqObjRet *moqobject.MoqObject, found bool) {
+	moqtObjs.mapLock.RLock()
+	moqObjRet, found = moqtObjs.dataMap[cacheKey]
+	if found {
+		moqtObjs.lruLock.Lock()
+		element, foundElement := moqtObjs.lruElements[cacheKey]
+		if foundElement {
+			moqtObjs.lru.MoveToFront(element)
+		}
+		moqtObjs.lruLock.Unlock()
+	}
+	trackNamespace := ""
+	keyInfo, foundNamespace := moqtObjs.cacheKeysInfo[cacheKey]
+	if foundNamespace {
+		trackNamespace = keyInfo.trackNamespace
+	}
+	disk := moqtObjs.disk
+	moqtObjs.mapLock.RUnlock()
+
+	foundDisk := false
+	if !found && disk != nil {
+		var errLoad error
+		moqObjRet, foundDisk, errLoad = disk.Load(cacheKey)
+		if errLoad != nil {
+			log.Error(fmt.Sprintf("Loading object %s from disk. Err: %v", cacheKey, errLoad))
+		}
+		found = foundDisk
+	}
+
+	moqtObjs.statsLock.Lock()
+	defer moqtObjs.statsLock.Unlock()
+
+	if !foundNamespace {
+		trackNamespace, foundNamespace = moqtObjs.findNamespace(cacheKey)
+	}
+	if foundDisk {
+		moqtObjs.diskHits++
+	}
+	if !foundNamespace {
+		if !found {
+			moqtObjs.unknownNamespaceMisses++
+		}
+	} else if found {
+		moqtObjs.namespacesRequests[trackNamespace].hits++
+	} else {
+		moqtObjs.namespacesRequests[trackNamespace].misses++
+	}
+
+	return
+}
+
+// GetSize Returns the number of cached objects and their bytes (cheaper than Stats)
+func (moqtObjs *MoqMessageObjects) GetSize() (objects uint64, bytes uint64, maxBytes uint64) {
 	moqtObjs.mapLock.RLock()
 	defer moqtObjs.mapLock.RUnlock()
 
-	moqObjRet, found = moqtObjs.dataMap[cacheKey]
+	return uint64(len(moqtObjs.dataMap)), moqtObjs.getTotalBytes(), moqtObjs.maxBytes
+}
+
+// Stats Returns cache counters, global and per namespace
+func (moqtObjs *MoqMessageObjects) Stats() (stats MoqCacheStats) {
+	moqtObjs.mapLock.RLock()
+	defer moqtObjs.mapLock.RUnlock()
+
+	now := moqtObjs.clock.Now()
+	stats = MoqCacheStats{Objects: uint64(len(moqtObjs.dataMap)), Bytes: moqtObjs.getTotalBytes(), MaxBytes: moqtObjs.maxBytes, EvictedObjects: moqtObjs.evictedObjects, EvictedBytes: moqtObjs.evictedBytes, QuotaRejectedObjects: moqtObjs.quotaRejectedObjs, DuplicatedObjects: moqtObjs.duplicatedObjects, Namespaces: map[string]*MoqCacheNamespaceStats{}}
+	if moqtObjs.disk != nil {
+		diskStats := moqtObjs.disk.GetStats()
+		stats.Disk = &diskStats
+	}
+
+	for trackNamespace, usage := range moqtObjs.namespacesUsage {
+		stats.Namespaces[trackNamespace] = &MoqCacheNamespaceStats{Objects: usage.objects, Bytes: uint64(max(usage.bytes.Load(), 0)), OldestObjectAgeMs: -1, NewestObjectAgeMs: -1}
+	}
+	for cacheKey, obj := range moqtObjs.dataMap {
+		namespaceStats, found := stats.Namespaces[moqtObjs.cacheKeysInfo[cacheKey].trackNamespace]
+		if !found {
+			continue
+		}
+		ageMs := now.Sub(obj.ReceivedAt).Milliseconds()
+		if namespaceStats.OldestObjectAgeMs < 0 || ageMs > namespaceStats.OldestObjectAgeMs {
+			namespaceStats.OldestObjectAgeMs = ageMs
+		}
+		if namespaceStats.NewestObjectAgeMs < 0 || ageMs < namespaceStats.NewestObjectAgeMs {
+			namespaceStats.NewestObjectAgeMs = ageMs
+		}
+	}
+
+	moqtObjs.statsLock.Lock()
+	defer moqtObjs.statsLock.Unlock()
+
+	stats.DiskHits = moqtObjs.diskHits
+	stats.Misses = moqtObjs.unknownNamespaceMisses
+	for trackNamespace, requests := range moqtObjs.namespacesRequests {
+		stats.Hits += requests.hits
+		stats.Misses += requests.misses
+		namespaceStats, found := stats.Namespaces[trackNamespace]
+		if !found {
+			namespaceStats = &MoqCacheNamespaceStats{OldestObjectAgeMs: -1, NewestObjectAgeMs: -1}
+			stats.Namespaces[trackNamespace] = namespaceStats
+		}
+		namespaceStats.Hits = requests.hits
+		namespaceStats.Misses = requests.misses
+	}
+	return
+}
+
+// PurgeNamespace Deletes all the objects of a namespace (memory and disk), returns the number of deleted objects
+func (moqtObjs *MoqMessageObjects) PurgeNamespace(trackNamespace string) (purged int) {
+	moqtObjs.mapLock.Lock()
+	keysToPurge := []string{}
+	for cacheKey, keyInfo := range moqtObjs.cacheKeysInfo {
+		if keyInfo.trackNamespace == trackNamespace {
+			keysToPurge = append(keysToPurge, cacheKey)
+		}
+	}
+	disk := moqtObjs.disk
+	moqtObjs.purgeKeys(keysToPurge)
+	moqtObjs.mapLock.Unlock()
+
+	purged = len(keysToPurge)
+	if disk != nil {
+		purged += disk.RemoveWithPrefix(trackNamespace + "/")
+	}
+	log.Info(fmt.Sprintf("CACHE MOQ namespace %s purged, deleted objects: %d", trackNamespace, purged))
+	return
+}
+
+// PurgeTrack Deletes all the objects of a track (memory and disk), returns the number of deleted objects
+func (moqtObjs *MoqMessageObjects) PurgeTrack(trackNamespace string, trackName string) (purged int) {
+	moqtObjs.mapLock.Lock()
+	keysToPurge := []string{}
+	trackIndex, found := moqtObjs.tracksIndex[getTrackKey(trackNamespace, trackName)]
+	if found {
+		for _, groupObjects := range trackIndex.objects {
+			for _, indexedObj := range groupObjects {
+				keysToPurge = append(keysToPurge, indexedObj.cacheKey)
+			}
+		}
+	}
+	disk := moqtObjs.disk
+	moqtObjs.purgeKeys(keysToPurge)
+	moqtObjs.mapLock.Unlock()
+
+	purged = len(keysToPurge)
+	if disk != nil {
+		purged += disk.RemoveWithPrefix(getTrackKey(trackNamespace, trackName) + "/")
+	}
+	log.Info(fmt.Sprintf("CACHE MOQ track %s/%s purged, deleted objects: %d", trackNamespace, trackName, purged))
+	return
+}
+
+// PurgeGroup Deletes all the objects of a group (memory and disk), returns the number of deleted objects
+func (moqtObjs *MoqMessageObjects) PurgeGroup(trackNamespace string, trackName string, groupSequence uint64) (purged int) {
+	moqtObjs.mapLock.Lock()
+	keysToPurge := []string{}
+	trackIndex, found := moqtObjs.tracksIndex[getTrackKey(trackNamespace, trackName)]
+	if found {
+		for _, indexedObj := range trackIndex.objects[groupSequence] {
+			keysToPurge = append(keysToPurge, indexedObj.cacheKey)
+		}
+	}
+	disk := moqtObjs.disk
+	moqtObjs.purgeKeys(keysToPurge)
+	moqtObjs.mapLock.Unlock()
+
+	purged = len(keysToPurge)
+	if disk != nil {
+		purged += disk.RemoveWithPrefix(fmt.Sprintf("%s/%d/", getTrackKey(trackNamespace, trackName), groupSequence))
+	}
+	log.Info(fmt.Sprintf("CACHE MOQ group %s/%s/%d purged, deleted objects: %d", trackNamespace, trackName, groupSequence, purged))
+	return
+}
+
+// purgeKeys (needs map write lock)
+func (moqtObjs *MoqMessageObjects) purgeKeys(keysToPurge []string) {
+	for _, cacheKey := range keysToPurge {
+		moqtObjs.removeObject(cacheKey)
+	}
+}
+
+func IsValidObjDedupPolicy(policy MoqObjDedupPolicy) bool {
+	return policy == MoqObjDedupPolicyNone || policy == MoqObjDedupPolicyKey || policy == MoqObjDedupPolicyPayload
+}
+
+// findNamespace Finds the namespace of a cache key NOT in memory, longest namespace first (needs stats lock)
+func (moqtObjs *MoqMessageObjects) findNamespace(cacheKey string) (trackNamespace string, found bool) {
+	for namespace := range moqtObjs.namespacesRequests {
+		if strings.HasPrefix(cacheKey, namespace+"/") && (!found || len(namespace) > len(trackNamespace)) {
+			trackNamespace = namespace
+			found = true
+		}
+	}
+	return
+}
+
+// GetTrackLargest Returns the largest group / object received for a track (while the track has objects in the cache)
+func (moqtObjs *MoqMessageObjects) GetTrackLargest(trackNamespace string, trackName string) (found bool, trackId uint64, largestGroup uint64, largestObject uint64) {
+	moqtObjs.mapLock.RLock()
+	defer moqtObjs.mapLock.RUnlock()
+
+	latest, found := moqtObjs.tracksLatest[getTrackKey(trackNamespace, trackName)]
+	if !found {
+		return
+	}
+	trackId = latest.trackId
+	largestGroup = latest.groupSequence
+	largestObject = latest.objectSequence
+	return
+}
+
+// GetTrackRange Returns the cache keys of a track from startGroup/startObject to endGroup/endObject (both included), ordered by group and object
+func (moqtObjs *MoqMessageObjects) GetTrackRange(trackNamespace string, trackName string, startGroup uint64, startObject uint64, endGroup uint64, endObject uint64) (cacheKeys []string) {
+	moqtObjs.mapLock.RLock()
+	defer moqtObjs.mapLock.RUnlock()
 
+	cacheKeys = []string{}
+	trackIndex, foundTrackIndex := moqtObjs.tracksIndex[getTrackKey(trackNamespace, trackName)]
+	if !foundTrackIndex {
+		return
+	}
+	startGroupIndex, _ := slices.BinarySearch(trackIndex.groups, startGroup)
+	for _, group := range trackIndex.groups[startGroupIndex:] {
+		if group > endGroup {
+			break
+		}
+		for _, indexedObj := range trackIndex.objects[group] {
+			if group == startGroup && indexedObj.objectSequence < startObject {
+				continue
+			}
+			if group == endGroup && indexedObj.objectSequence > endObject {
+				break
+			}
+			cacheKeys = append(cacheKeys, indexedObj.cacheKey)
+		}
+	}
+	return
+}
+
+// GetTrackObjects Returns the in memory objects of a track ordered by group and object (it does NOT count as cache requests)
+func (moqtObjs *MoqMessageObjects) GetTrackObjects(trackNamespace string, trackName string) (moqObjs []*moqobject.MoqObject) {
+	moqtObjs.mapLock.RLock()
+	defer moqtObjs.mapLock.RUnlock()
+
+	moqObjs = []*moqobject.MoqObject{}
+	trackIndex, foundTrackIndex := moqtObjs.tracksIndex[getTrackKey(trackNamespace, trackName)]
+	if !foundTrackIndex {
+		return
+	}
+	for _, group := range trackIndex.groups {
+		for _, indexedObj := range trackIndex.objects[group] {
+			moqObj, found := moqtObjs.dataMap[indexedObj.cacheKey]
+			if found {
+				moqObjs = append(moqObjs, moqObj)
+			}
+		}
+	}
 	return
 }
 
@@ -67,6 +619,318 @@ func (moqtObjs *MoqMessageObjects) Stop() {
 	moqtObjs.stopCleanUp()
 }
 
+// CheckHealth Returns an error if the housekeeping stopped running or the cache is over its memory cap
+func (moqtObjs *MoqMessageObjects) CheckHealth() (err error) {
+	moqtObjs.statsLock.Lock()
+	lastCleanUpAt := moqtObjs.lastCleanUpAt
+	moqtObjs.statsLock.Unlock()
+
+	if moqtObjs.housekeepingPeriodMs > 0 {
+		sinceCleanUp := moqtObjs.clock.Now().Sub(lastCleanUpAt)
+		if sinceCleanUp > time.Duration(HEALTH_MAX_MISSED_CLEANUPS*moqtObjs.housekeepingPeriodMs)*time.Millisecond {
+			err = errors.New(fmt.Sprintf("Cache housekeeping did not run for %v", sinceCleanUp))
+			return
+		}
+	}
+
+	totalBytes := moqtObjs.getTotalBytes()
+	if moqtObjs.maxBytes > 0 && totalBytes > moqtObjs.maxBytes {
+		err = errors.New(fmt.Sprintf("Cache over its memory cap, %d bytes (max %d)", totalBytes, moqtObjs.maxBytes))
+	}
+	return
+}
+
+// Memory cap
+
+// payloadAdded Updates the cache size (without the map lock unless it is over the cap or the namespace quota), bytes is negative when the object is compressed.
+// Returns false if the object does NOT fit in the namespace bytes quota (it is removed from the cache)
+func (moqtObjs *MoqMessageObjects) payloadAdded(cacheKey string, keyInfo *moqCacheKeyInfo, usage *moqNamespaceUsage, bytes int64) (ok bool) {
+	ok = true
+	for {
+		storedBytes := keyInfo.storedBytes.Load()
+		if storedBytes < 0 {
+			// Already deleted / replaced
+			return
+		}
+		if keyInfo.storedBytes.CompareAndSwap(storedBytes, storedBytes+bytes) {
+			break
+		}
+	}
+	// If the object is removed meanwhile the removal already subtracted these bytes
+	usage.bytes.Add(bytes)
+	moqtObjs.totalBytes.Add(bytes)
+
+	maxBytes := usage.maxBytes.Load()
+	if bytes > 0 && maxBytes > 0 && usage.bytes.Load() > int64(maxBytes) {
+		ok = moqtObjs.evictIfOverQuota(cacheKey, keyInfo.trackNamespace)
+	}
+	moqtObjs.evictIfOverCap()
+	return
+}
+
+// objectClosed Adds the object to the LRU (eviction candidates) when all its bytes are received
+func (moqtObjs *MoqMessageObjects) objectClosed(cacheKey string, keyInfo *moqCacheKeyInfo) {
+	moqtObjs.lruLock.Lock()
+	// Checked under the LRU lock, removeObject marks it removed before deleting it from the LRU
+	if keyInfo.storedBytes.Load() >= 0 {
+		moqtObjs.lruElements[cacheKey] = moqtObjs.lru.PushFront(cacheKey)
+	}
+	moqtObjs.lruLock.Unlock()
+
+	moqtObjs.evictIfOverCap()
+}
+
+// evictIfOverCap Takes the map lock and evicts only if the cache is over its memory cap
+func (moqtObjs *MoqMessageObjects) evictIfOverCap() {
+	if moqtObjs.maxBytes == 0 || moqtObjs.getTotalBytes() <= moqtObjs.maxBytes {
+		return
+	}
+
+	moqtObjs.mapLock.Lock()
+	evictedObjs := moqtObjs.evictIfNeeded()
+	moqtObjs.mapLock.Unlock()
+
+	// Disk IO outside the map lock
+	moqtObjs.spillToDisk(evictedObjs)
+}
+
+// getTotalBytes Cache size (it can be negative for a moment while an object is removed during a payload write)
+func (moqtObjs *MoqMessageObjects) getTotalBytes() uint64 {
+	return uint64(max(moqtObjs.totalBytes.Load(), 0))
+}
+
+// evictIfOverQuota Takes the map lock and evicts least recently used (closed) objects of the namespace until it is under its bytes quota.
+// If the open objects alone are over it, the object that is growing (cacheKey) is removed and it returns false
+func (moqtObjs *MoqMessageObjects) evictIfOverQuota(cacheKey string, trackNamespace string) (ok bool) {
+	ok = true
+	moqtObjs.mapLock.Lock()
+	evictedObjs := map[string]*moqobject.MoqObject{}
+	usage, foundUsage := moqtObjs.namespacesUsage[trackNamespace]
+	if foundUsage && usage.maxBytes.Load() > 0 {
+		maxBytes := int64(usage.maxBytes.Load())
+		usedBytes := usage.bytes.Load()
+		keysToEvict := []string{}
+		moqtObjs.lruLock.Lock()
+		for element := moqtObjs.lru.Back(); element != nil && usedBytes > maxBytes; element = element.Prev() {
+			lruKey := element.Value.(string)
+			lruKeyInfo := moqtObjs.cacheKeysInfo[lruKey]
+			if lruKeyInfo.trackNamespace == trackNamespace {
+				keysToEvict = append(keysToEvict, lruKey)
+				usedBytes -= max(lruKeyInfo.storedBytes.Load(), 0)
+			}
+		}
+		moqtObjs.lruLock.Unlock()
+
+		for _, lruKey := range keysToEvict {
+			log.Info("CACHE MOQ object evicted (namespace bytes quota), deleted: ", lruKey)
+			evictedObjs[lruKey] = moqtObjs.dataMap[lruKey]
+			moqtObjs.evictedBytes += moqtObjs.removeObject(lruKey)
+			moqtObjs.evictedObjects++
+		}
+		if usedBytes > maxBytes {
+			log.Warning(fmt.Sprintf("CACHE MOQ object over namespace %s bytes quota (%d), deleted: %s", trackNamespace, maxBytes, cacheKey))
+			moqtObjs.removeObject(cacheKey)
+			moqtObjs.quotaRejectedObjs++
+			ok = false
+		}
+	}
+	moqtObjs.mapLock.Unlock()
+
+	// Disk IO outside the map lock
+	moqtObjs.spillToDisk(evictedObjs)
+	return
+}
+
+// Namespace quotas (need map write lock)
+
+func (moqtObjs *MoqMessageObjects) getQuota(trackNamespace string) MoqCacheQuota {
+	quota, found := moqtObjs.quotas.Namespaces[trackNamespace]
+	if !found {
+		quota = moqtObjs.quotas.Default
+	}
+	return quota
+}
+
+// checkQuota Returns an error if a new object does NOT fit in the namespace quota, once the freed objects / bytes (replaced object) are deleted
+func (moqtObjs *MoqMessageObjects) checkQuota(trackNamespace string, freedObjects uint64, freedBytes int64) (err error) {
+	quota := moqtObjs.getQuota(trackNamespace)
+	usage, foundUsage := moqtObjs.namespacesUsage[trackNamespace]
+	if !foundUsage {
+		return
+	}
+	if quota.MaxObjects > 0 && usage.objects-freedObjects >= quota.MaxObjects {
+		err = errors.New(fmt.Sprintf("Namespace %s over cache objects quota (%d)", trackNamespace, quota.MaxObjects))
+		return
+	}
+	if quota.MaxBytes > 0 && usage.bytes.Load()-freedBytes >= int64(quota.MaxBytes) {
+		err = errors.New(fmt.Sprintf("Namespace %s over cache bytes quota (%d)", trackNamespace, quota.MaxBytes))
+		return
+	}
+	return
+}
+
+// Tracks index (needs map write lock)
+
+func getTrackKey(trackNamespace string, trackName string) string {
+	return trackNamespace + "/" + trackName
+}
+
+func (moqtObjs *MoqMessageObjects) getTrackIndex(trackNamespace string, trackName string) *moqTrackIndex {
+	trackKey := getTrackKey(trackNamespace, trackName)
+	trackIndex, found := moqtObjs.tracksIndex[trackKey]
+	if !found {
+		trackIndex = &moqTrackIndex{groups: []uint64{}, objects: map[uint64][]moqIndexedObject{}}
+		moqtObjs.tracksIndex[trackKey] = trackIndex
+	}
+	return trackIndex
+}
+
+func (moqtObjs *MoqMessageObjects) updateTrackLatest(trackNamespace string, trackName string, objHeader moqobject.MoqObjectHeader) {
+	trackKey := getTrackKey(trackNamespace, trackName)
+	latest, found := moqtObjs.tracksLatest[trackKey]
+	if found && (objHeader.GroupSequence < latest.groupSequence || (objHeader.GroupSequence == latest.groupSequence && objHeader.ObjectSequence < latest.objectSequence)) {
+		return
+	}
+	moqtObjs.tracksLatest[trackKey] = moqTrackLatest{trackId: objHeader.TrackId, groupSequence: objHeader.GroupSequence, objectSequence: objHeader.ObjectSequence}
+}
+
+func (ti *moqTrackIndex) add(groupSequence uint64, objectSequence uint64, cacheKey string) {
+	groupIndex, foundGroup := slices.BinarySearch(ti.groups, groupSequence)
+	if !foundGroup {
+		ti.groups = slices.Insert(ti.groups, groupIndex, groupSequence)
+	}
+	groupObjects := ti.objects[groupSequence]
+	objIndex, foundObj := slices.BinarySearchFunc(groupObjects, objectSequence, compareIndexedObject)
+	if foundObj {
+		groupObjects[objIndex].cacheKey = cacheKey
+	} else {
+		groupObjects = slices.Insert(groupObjects, objIndex, moqIndexedObject{objectSequence: objectSequence, cacheKey: cacheKey})
+	}
+	ti.objects[groupSequence] = groupObjects
+}
+
+// remove Returns true when the track does NOT have more objects
+func (ti *moqTrackIndex) remove(groupSequence uint64, objectSequence uint64) (empty bool) {
+	groupObjects := ti.objects[groupSequence]
+	objIndex, foundObj := slices.BinarySearchFunc(groupObjects, objectSequence, compareIndexedObject)
+	if foundObj {
+		groupObjects = slices.Delete(groupObjects, objIndex, objIndex+1)
+	}
+	if len(groupObjects) > 0 {
+		ti.objects[groupSequence] = groupObjects
+	} else {
+		delete(ti.objects, groupSequence)
+		groupIndex, foundGroup := slices.BinarySearch(ti.groups, groupSequence)
+		if foundGroup {
+			ti.groups = slices.Delete(ti.groups, groupIndex, groupIndex+1)
+		}
+	}
+	return len(ti.groups) == 0
+}
+
+func compareIndexedObject(indexedObj moqIndexedObject, objectSequence uint64) int {
+	if indexedObj.objectSequence < objectSequence {
+		return -1
+	} else if indexedObj.objectSequence > objectSequence {
+		return 1
+	}
+	return 0
+}
+
+func (moqtObjs *MoqMessageObjects) getNamespaceUsage(trackNamespace string) *moqNamespaceUsage {
+	usage, found := moqtObjs.namespacesUsage[trackNamespace]
+	if !found {
+		usage = &moqNamespaceUsage{}
+		usage.maxBytes.Store(moqtObjs.getQuota(trackNamespace).MaxBytes)
+		moqtObjs.namespacesUsage[trackNamespace] = usage
+	}
+	return usage
+}
+
+// evictIfNeeded Deletes least recently used objects until under the cap, open objects (still receiving) are NOT in the LRU so they are NOT evicted. Returns the evicted objects
+func (moqtObjs *MoqMessageObjects) evictIfNeeded() (evictedObjs map[string]*moqobject.MoqObject) {
+	evictedObjs = map[string]*moqobject.MoqObject{}
+	totalBytes := moqtObjs.getTotalBytes()
+	if moqtObjs.maxBytes == 0 || totalBytes <= moqtObjs.maxBytes {
+		return
+	}
+
+	keysToEvict := []string{}
+	bytesToEvict := uint64(0)
+	moqtObjs.lruLock.Lock()
+	for element := moqtObjs.lru.Back(); element != nil && totalBytes-bytesToEvict > moqtObjs.maxBytes; element = element.Prev() {
+		cacheKey := element.Value.(string)
+		keysToEvict = append(keysToEvict, cacheKey)
+		bytesToEvict += uint64(max(moqtObjs.cacheKeysInfo[cacheKey].storedBytes.Load(), 0))
+	}
+	moqtObjs.lruLock.Unlock()
+
+	for _, cacheKey := range keysToEvict {
+		log.Info("CACHE MOQ object evicted (max bytes), deleted: ", cacheKey)
+		evictedObjs[cacheKey] = moqtObjs.dataMap[cacheKey]
+		moqtObjs.evictedBytes += moqtObjs.removeObject(cacheKey)
+		moqtObjs.evictedObjects++
+	}
+	return
+}
+
+// spillToDisk Stores the objects removed from memory in the disk tier (if enabled)
+func (moqtObjs *MoqMessageObjects) spillToDisk(objs map[string]*moqobject.MoqObject) {
+	moqtObjs.mapLock.RLock()
+	disk := moqtObjs.disk
+	moqtObjs.mapLock.RUnlock()
+
+	if disk == nil {
+		return
+	}
+	for cacheKey, obj := range objs {
+		errStore := disk.Store(cacheKey, obj)
+		if errStore != nil {
+			log.Error(fmt.Sprintf("Storing object %s on disk. Err: %v", cacheKey, errStore))
+		} else {
+			log.Info("CACHE MOQ object moved to disk: ", cacheKey)
+		}
+	}
+}
+
+// removeObject Deletes the object from the cache (needs map write lock), returns its size
+func (moqtObjs *MoqMessageObjects) removeObject(cacheKey string) (bytes uint64) {
+	_, found := moqtObjs.dataMap[cacheKey]
+	if !found {
+		return
+	}
+	keyInfo := moqtObjs.cacheKeysInfo[cacheKey]
+	// Next payload writes of this object are NOT counted
+	storedBytes := keyInfo.storedBytes.Swap(-1)
+	bytes = uint64(storedBytes)
+	moqtObjs.totalBytes.Add(-storedBytes)
+	delete(moqtObjs.dataMap, cacheKey)
+	delete(moqtObjs.cacheKeysInfo, cacheKey)
+	usage, foundUsage := moqtObjs.namespacesUsage[keyInfo.trackNamespace]
+	if foundUsage {
+		usage.bytes.Add(-storedBytes)
+		usage.objects--
+		if usage.objects == 0 {
+			delete(moqtObjs.namespacesUsage, keyInfo.trackNamespace)
+		}
+	}
+	trackKey := getTrackKey(keyInfo.trackNamespace, keyInfo.trackName)
+	trackIndex, foundTrackIndex := moqtObjs.tracksIndex[trackKey]
+	if foundTrackIndex && trackIndex.remove(keyInfo.groupSequence, keyInfo.objectSequence) {
+		delete(moqtObjs.tracksIndex, trackKey)
+		delete(moqtObjs.tracksLatest, trackKey)
+	}
+
+	moqtObjs.lruLock.Lock()
+	element, foundElement := moqtObjs.lruElements[cacheKey]
+	if foundElement {
+		moqtObjs.lru.Remove(element)
+		delete(moqtObjs.lruElements, cacheKey)
+	}
+	moqtObjs.lruLock.Unlock()
+	return
+}
+
 // Housekeeping
 
 func (moqtObjs *MoqMessageObjects) startCleanUp(periodMs uint64) {
@@ -86,15 +950,20 @@ func (moqtObjs *MoqMessageObjects) stopCleanUp() {
 }
 
 func (moqtObjs *MoqMessageObjects) runCleanupEvery(periodMs uint64, cleanUpChannelBidi chan bool) {
-	timeCh := time.NewTicker(time.Millisecond * time.Duration(periodMs))
+	timeCh := moqtObjs.clock.NewTicker(time.Millisecond * time.Duration(periodMs))
+	defer timeCh.Stop()
 	exit := false
 
 	for !exit {
 		select {
 		// Wait for the next tick
-		case tm := <-timeCh.C:
+		case tm := <-timeCh.C():
 			moqtObjs.cacheCleanUp(tm)
 
+			moqtObjs.statsLock.Lock()
+			moqtObjs.lastCleanUpAt = tm
+			moqtObjs.statsLock.Unlock()
+
 		case <-cleanUpChannelBidi:
 			exit = true
 		}
@@ -106,31 +975,50 @@ func (moqtObjs *MoqMessageObjects) runCleanupEvery(periodMs uint64, cleanUpChann
 }
 
 func (moqtObjs *MoqMessageObjects) cacheCleanUp(now time.Time) {
-	objectsToDel := map[string]*moqobject.MoqObject{}
-
-	// TODO: This is a brute force approach, optimization recommended
+	objectsToSpill := map[string]*moqobject.MoqObject{}
+	// Open objects (still receiving) are checked again next round
+	openExpirations := []moqExpiration{}
 
 	moqtObjs.mapLock.Lock()
-	defer moqtObjs.mapLock.Unlock()
 
 	numStartElements := len(moqtObjs.dataMap)
 
-	// Check for expired files
-	for key, obj := range moqtObjs.dataMap {
-		if obj.MaxAgeS >= 0 && obj.GetEof() {
-			if obj.ReceivedAt.Add(time.Second * time.Duration(obj.MaxAgeS)).Before(now) {
-				objectsToDel[key] = obj
-			}
+	// Only the expired objects are visited
+	for moqtObjs.expirations.Len() > 0 && moqtObjs.expirations[0].at.Before(now) {
+		expiration := heap.Pop(&moqtObjs.expirations).(moqExpiration)
+		keyInfo, found := moqtObjs.cacheKeysInfo[expiration.cacheKey]
+		if !found || keyInfo.generation != expiration.generation {
+			// Already deleted / replaced
+			continue
+		}
+		obj := moqtObjs.dataMap[expiration.cacheKey]
+		if !obj.GetEof() {
+			openExpirations = append(openExpirations, expiration)
+			continue
+		}
+		moqtObjs.removeObject(expiration.cacheKey)
+		if expiration.spill {
+			// Move old object to disk
+			objectsToSpill[expiration.cacheKey] = obj
+		} else {
+			log.Info("CLEANUP MOQ object expired, deleted: ", expiration.cacheKey)
 		}
 	}
-	// Delete expired files
-	for keyToDel := range objectsToDel {
-		// Delete from array
-		delete(moqtObjs.dataMap, keyToDel)
-		log.Info("CLEANUP MOQ object expired, deleted: ", keyToDel)
+	for _, expiration := range openExpirations {
+		heap.Push(&moqtObjs.expirations, expiration)
 	}
 
 	numEndElements := len(moqtObjs.dataMap)
 
-	log.Info(fmt.Sprintf("Finished cleanup MOQ objects round expired. Elements at start: %d, elements at end: %d", numStartElements, numEndElements))
+	log.Info(fmt.Sprintf("Finished cleanup MOQ objects round expired. Elements at start: %d, elements at end: %d, bytes: %d, evicted (max bytes) objects: %d, evicted bytes: %d", numStartElements, numEndElements, moqtObjs.getTotalBytes(), moqtObjs.evictedObjects, moqtObjs.evictedBytes))
+
+	disk := moqtObjs.disk
+	moqtObjs.mapLock.Unlock()
+
+	if disk != nil {
+		moqtObjs.spillToDisk(objectsToSpill)
+		numDiskDeleted := disk.CleanUp(now)
+		diskStats := disk.GetStats()
+		log.Info(fmt.Sprintf("Finished cleanup MOQ disk objects round expired. Deleted: %d, elements at end: %d, bytes: %d", numDiskDeleted, diskStats.Objects, diskStats.Bytes))
+	}
 }
@@ -0,0 +1,216 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmessageobjects
+
+import (
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Objects cached by each cache benchmark goroutine before purging its track (keeps the memory bounded for any b.N)
+const BENCH_CACHE_OBJECTS_PER_TRACK = 1024
+const BENCH_CACHE_HOUSEKEEPING_PERIOD_MS = 1000
+
+const TEST_NAMESPACE = "live"
+const TEST_TRACK_NAME = "channel-1/video-1080p"
+
+// Max age of the test objects
+const TEST_OBJ_EXPIRATION_S = 2
+
+// Complete objects are removed once they are older than their max age, open ones stay until they are complete
+func TestCacheExpiration(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	// No housekeeping thread, clean up runs when the test says so
+	objects := New(0, 0, clock)
+
+	completeKey := getCacheKey(TEST_NAMESPACE, TEST_TRACK_NAME, moqobject.MoqObjectHeader{ObjectSequence: 0})
+	complete := createTestObject(t, objects, completeKey, moqobject.MoqObjectHeader{ObjectSequence: 0})
+	complete.SetEof()
+	openKey := getCacheKey(TEST_NAMESPACE, TEST_TRACK_NAME, moqobject.MoqObjectHeader{ObjectSequence: 1})
+	open := createTestObject(t, objects, openKey, moqobject.MoqObjectHeader{ObjectSequence: 1})
+
+	clock.Advance(TEST_OBJ_EXPIRATION_S * time.Second)
+	objects.cacheCleanUp(clock.Now())
+	checkCached(t, objects, completeKey, true)
+	checkCached(t, objects, openKey, true)
+
+	clock.Advance(time.Millisecond)
+	objects.cacheCleanUp(clock.Now())
+	checkCached(t, objects, completeKey, false)
+	checkCached(t, objects, openKey, true)
+
+	open.SetEof()
+	objects.cacheCleanUp(clock.Now())
+	checkCached(t, objects, openKey, false)
+
+	if numObjects, bytes, _ := objects.GetSize(); numObjects != 0 || bytes != 0 {
+		t.Fatalf("Cache should be empty, objects: %d, bytes: %d", numObjects, bytes)
+	}
+}
+
+// Expiration of a replaced object does NOT remove the new one
+func TestCacheExpirationReplacedObject(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	objects := New(0, 0, clock)
+
+	header := moqobject.MoqObjectHeader{}
+	cacheKey := getCacheKey(TEST_NAMESPACE, TEST_TRACK_NAME, header)
+	createTestObject(t, objects, cacheKey, header).SetEof()
+
+	clock.Advance(time.Second)
+	replaced, err := objects.Replace(TEST_NAMESPACE, TEST_TRACK_NAME, cacheKey, header, TEST_OBJ_EXPIRATION_S)
+	if err != nil {
+		t.Fatalf("Replacing object, err: %v", err)
+	}
+	replaced.SetEof()
+
+	// First object expiration
+	clock.Advance(TEST_OBJ_EXPIRATION_S*time.Second - time.Second + time.Millisecond)
+	objects.cacheCleanUp(clock.Now())
+	checkCached(t, objects, cacheKey, true)
+
+	// Replaced object expiration
+	clock.Advance(time.Second)
+	objects.cacheCleanUp(clock.Now())
+	checkCached(t, objects, cacheKey, false)
+}
+
+// A replace rejected by the namespace quota keeps the cached object
+func TestCacheQuotaReplace(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	objects := New(0, 0, clock)
+	objects.SetQuotas(MoqCacheQuotasData{Default: MoqCacheQuota{MaxObjects: 2}})
+
+	headers := []moqobject.MoqObjectHeader{{ObjectSequence: 0}, {ObjectSequence: 1}}
+	for _, header := range headers {
+		createTestObject(t, objects, getCacheKey(TEST_NAMESPACE, TEST_TRACK_NAME, header), header).SetEof()
+	}
+	cacheKey := getCacheKey(TEST_NAMESPACE, TEST_TRACK_NAME, headers[0])
+	replaced, err := objects.Replace(TEST_NAMESPACE, TEST_TRACK_NAME, cacheKey, headers[0], TEST_OBJ_EXPIRATION_S)
+	if err != nil {
+		t.Fatalf("Replacing object in a full namespace, err: %v", err)
+	}
+	replaced.SetEof()
+
+	objects.SetQuotas(MoqCacheQuotasData{Default: MoqCacheQuota{MaxObjects: 1}})
+	if _, err := objects.Replace(TEST_NAMESPACE, TEST_TRACK_NAME, cacheKey, headers[0], TEST_OBJ_EXPIRATION_S); err == nil {
+		t.Fatalf("Replaced object over the namespace quota")
+	}
+	checkCached(t, objects, cacheKey, true)
+}
+
+// Payload over the namespace bytes quota evicts closed objects of that namespace (NOT of others), if the open objects alone are over it the growing one is aborted
+func TestCacheQuotaPayload(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	objects := New(0, 0, clock)
+	payload := []byte("payload")
+	objects.SetQuotas(MoqCacheQuotasData{Default: MoqCacheQuota{MaxBytes: uint64(len(payload) + 1)}})
+
+	otherKey := getCacheKey("other", TEST_TRACK_NAME, moqobject.MoqObjectHeader{})
+	other, err := objects.Create("other", TEST_TRACK_NAME, otherKey, moqobject.MoqObjectHeader{}, TEST_OBJ_EXPIRATION_S)
+	if err != nil {
+		t.Fatalf("Creating object %s, err: %v", otherKey, err)
+	}
+	other.PayloadWrite(payload)
+	other.SetEof()
+	closedKey := getCacheKey(TEST_NAMESPACE, TEST_TRACK_NAME, moqobject.MoqObjectHeader{ObjectSequence: 0})
+	createTestObject(t, objects, closedKey, moqobject.MoqObjectHeader{ObjectSequence: 0}).SetEof()
+
+	openKey := getCacheKey(TEST_NAMESPACE, TEST_TRACK_NAME, moqobject.MoqObjectHeader{ObjectSequence: 1})
+	open := createTestObject(t, objects, openKey, moqobject.MoqObjectHeader{ObjectSequence: 1})
+	checkCached(t, objects, closedKey, false)
+	checkCached(t, objects, openKey, true)
+	if open.GetEof() {
+		t.Fatalf("Open object aborted, want closed objects evicted first")
+	}
+
+	open.PayloadWrite(payload)
+	checkCached(t, objects, openKey, false)
+	if !open.GetEof() {
+		t.Fatalf("Open object over the namespace bytes quota NOT aborted")
+	}
+	if written := open.PayloadWrite(payload); written != 0 {
+		t.Fatalf("Written %d bytes to an aborted object, want 0", written)
+	}
+	checkCached(t, objects, otherKey, true)
+	if stats := objects.Stats(); stats.Bytes != uint64(len(payload)) || stats.QuotaRejectedObjects != 1 {
+		t.Fatalf("Cache bytes %d, quota rejected objects %d, want %d, 1", stats.Bytes, stats.QuotaRejectedObjects, len(payload))
+	}
+}
+
+// BenchmarkCacheCreateGet Objects created and read back (as the subscribers do) by all the goroutines at the same time, so the cache locks are contended
+func BenchmarkCacheCreateGet(b *testing.B) {
+	disableLogs(b)
+	objects := New(BENCH_CACHE_HOUSEKEEPING_PERIOD_MS, 0, moqclock.New())
+	defer objects.Stop()
+
+	var goroutines atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// A track per goroutine so purging it does NOT remove the objects of the others
+		trackName := fmt.Sprintf("%s-%d", TEST_TRACK_NAME, goroutines.Add(1))
+		header := moqobject.MoqObjectHeader{}
+		for pb.Next() {
+			cacheKey := getCacheKey(TEST_NAMESPACE, trackName, header)
+			moqObj, err := objects.Create(TEST_NAMESPACE, trackName, cacheKey, header, 10)
+			if err != nil {
+				b.Fatal(fmt.Sprintf("Creating object, err: %v", err))
+			}
+			moqObj.SetEof()
+			if _, found := objects.Get(cacheKey); !found {
+				b.Fatal("Getting object")
+			}
+
+			header.ObjectSequence++
+			if header.ObjectSequence >= BENCH_CACHE_OBJECTS_PER_TRACK {
+				objects.PurgeTrack(TEST_NAMESPACE, trackName)
+				header.GroupSequence++
+				header.ObjectSequence = 0
+			}
+		}
+	})
+}
+
+// Helpers
+
+func createTestObject(t *testing.T, objects *MoqMessageObjects, cacheKey string, header moqobject.MoqObjectHeader) *moqobject.MoqObject {
+	moqObj, err := objects.Create(TEST_NAMESPACE, TEST_TRACK_NAME, cacheKey, header, TEST_OBJ_EXPIRATION_S)
+	if err != nil {
+		t.Fatalf("Creating object %s, err: %v", cacheKey, err)
+	}
+	moqObj.PayloadWrite([]byte("payload"))
+	return moqObj
+}
+
+func checkCached(t *testing.T, objects *MoqMessageObjects, cacheKey string, want bool) {
+	t.Helper()
+	if _, found := objects.Get(cacheKey); found != want {
+		t.Fatalf("Object %s cached %t, want %t (clock %v)", cacheKey, found, want, objects.clock.Now())
+	}
+}
+
+// getCacheKey Same format as the relay cache keys (namespace/track/group/object)
+func getCacheKey(trackNamespace string, trackName string, header moqobject.MoqObjectHeader) string {
+	return trackNamespace + "/" + trackName + "/" + strconv.FormatUint(header.GroupSequence, 10) + "/" + strconv.FormatUint(header.ObjectSequence, 10)
+}
+
+// disableLogs Logs are NOT free, they distort the benchmark numbers
+func disableLogs(tb testing.TB) {
+	level := log.GetLevel()
+	log.SetLevel(log.FatalLevel)
+	tb.Cleanup(func() {
+		log.SetLevel(level)
+	})
+}
@@ -0,0 +1,368 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmetrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+)
+
+const METRICS_SHUTDOWN_TIMEOUT_MS = 5000
+
+// Prometheus text exposition format
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+type MoqMetricType string
+
+const (
+	MoqMetricTypeCounter   MoqMetricType = "counter"
+	MoqMetricTypeGauge     MoqMetricType = "gauge"
+	MoqMetricTypeHistogram MoqMetricType = "histogram"
+)
+
+// MoqMetrics Registry of metrics served in Prometheus text format on /metrics
+type MoqMetrics struct {
+	server *http.Server
+
+	// Protected
+	families   []moqMetricFamily
+	names      map[string]bool
+	collectors []func()
+	lock       *sync.Mutex
+}
+
+type moqMetricFamily interface {
+	write(w *bufio.Writer)
+}
+
+// New Creates the metrics registry, and the server if listenAddr is NOT empty
+func New(listenAddr string) *MoqMetrics {
+	m := &MoqMetrics{families: []moqMetricFamily{}, names: map[string]bool{}, collectors: []func(){}, lock: new(sync.Mutex)}
+	if listenAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+			m.Write(w)
+		})
+		m.server = &http.Server{Addr: listenAddr, Handler: mux}
+	}
+	return m
+}
+
+// NewCounter Registers a counter (only goes up)
+func (m *MoqMetrics) NewCounter(name string, help string, labelNames ...string) *MoqCounter {
+	counter := &MoqCounter{moqMetricVec: newMetricVec(name, help, MoqMetricTypeCounter, labelNames)}
+	m.register(name, counter)
+	return counter
+}
+
+// NewGauge Registers a gauge
+func (m *MoqMetrics) NewGauge(name string, help string, labelNames ...string) *MoqGauge {
+	gauge := &MoqGauge{moqMetricVec: newMetricVec(name, help, MoqMetricTypeGauge, labelNames)}
+	m.register(name, gauge)
+	return gauge
+}
+
+// NewHistogram Registers a histogram with these (ascending) bucket upper bounds
+func (m *MoqMetrics) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *MoqHistogram {
+	histogram := &MoqHistogram{name: name, help: help, labelNames: labelNames, buckets: buckets, series: map[string]*moqHistogramSeries{}, lock: new(sync.Mutex)}
+	if len(labelNames) == 0 {
+		// Exposed as 0 from the start
+		histogram.getSeries([]string{})
+	}
+	m.register(name, histogram)
+	return histogram
+}
+
+// AddCollector Adds a function called before writing the metrics (to update values kept elsewhere, ex: cache size)
+func (m *MoqMetrics) AddCollector(collect func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.collectors = append(m.collectors, collect)
+}
+
+// Write Writes all metrics in Prometheus text format
+func (m *MoqMetrics) Write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, collect := range m.collectors {
+		collect()
+	}
+	bw := bufio.NewWriter(w)
+	for _, family := range m.families {
+		family.write(bw)
+	}
+	errFlush := bw.Flush()
+	if errFlush != nil {
+		log.Warning(fmt.Sprintf("Writing metrics. Err: %v", errFlush))
+	}
+}
+
+func (m *MoqMetrics) ListenAndServe() error {
+	if m.server == nil {
+		return errors.New("Metrics server NOT configured")
+	}
+	log.Info(fmt.Sprintf("Serving metrics. Addr: %s", m.server.Addr))
+
+	err := m.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+func (m *MoqMetrics) Close() (err error) {
+	if m.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), METRICS_SHUTDOWN_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	return m.server.Shutdown(ctx)
+}
+
+func (m *MoqMetrics) register(name string, family moqMetricFamily) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.names[name] {
+		// Programming error
+		log.Panic(fmt.Sprintf("Metric %s registered twice", name))
+	}
+	m.names[name] = true
+	m.families = append(m.families, family)
+}
+
+// Counters / gauges
+
+type moqMetricSeries struct {
+	labelValues []string
+	value       float64
+}
+
+type moqMetricVec struct {
+	name       string
+	help       string
+	metricType MoqMetricType
+	labelNames []string
+
+	// Protected
+	series map[string]*moqMetricSeries
+	lock   *sync.Mutex
+}
+
+func newMetricVec(name string, help string, metricType MoqMetricType, labelNames []string) moqMetricVec {
+	vec := moqMetricVec{name: name, help: help, metricType: metricType, labelNames: labelNames, series: map[string]*moqMetricSeries{}, lock: new(sync.Mutex)}
+	if len(labelNames) == 0 {
+		// Exposed as 0 from the start
+		vec.getSeries([]string{})
+	}
+	return vec
+}
+
+// Reset Deletes all series (ex: collectors of labels that can disappear)
+func (vec *moqMetricVec) Reset() {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	vec.series = map[string]*moqMetricSeries{}
+}
+
+func (vec *moqMetricVec) getSeries(labelValues []string) *moqMetricSeries {
+	if len(labelValues) != len(vec.labelNames) {
+		// Programming error
+		log.Panic(fmt.Sprintf("Metric %s needs %d label values, got %d", vec.name, len(vec.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	series, found := vec.series[key]
+	if !found {
+		series = &moqMetricSeries{labelValues: append([]string{}, labelValues...)}
+		vec.series[key] = series
+	}
+	return series
+}
+
+func (vec *moqMetricVec) add(value float64, labelValues []string) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	vec.getSeries(labelValues).value += value
+}
+
+func (vec *moqMetricVec) set(value float64, labelValues []string) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	vec.getSeries(labelValues).value = value
+}
+
+func (vec *moqMetricVec) write(w *bufio.Writer) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	writeHeader(w, vec.name, vec.help, vec.metricType)
+	keys := maps.Keys(vec.series)
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := vec.series[key]
+		writeSample(w, vec.name, vec.labelNames, series.labelValues, "", "", series.value)
+	}
+}
+
+type MoqCounter struct {
+	moqMetricVec
+}
+
+func (counter *MoqCounter) Inc(labelValues ...string) {
+	counter.add(1, labelValues)
+}
+
+func (counter *MoqCounter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	counter.add(value, labelValues)
+}
+
+// Set Only for counters kept elsewhere (collectors)
+func (counter *MoqCounter) Set(value float64, labelValues ...string) {
+	counter.set(value, labelValues)
+}
+
+type MoqGauge struct {
+	moqMetricVec
+}
+
+func (gauge *MoqGauge) Set(value float64, labelValues ...string) {
+	gauge.set(value, labelValues)
+}
+
+func (gauge *MoqGauge) Add(value float64, labelValues ...string) {
+	gauge.add(value, labelValues)
+}
+
+// Histograms
+
+type moqHistogramSeries struct {
+	labelValues []string
+	// Per bucket (NOT cumulative)
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type MoqHistogram struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	// Protected
+	series map[string]*moqHistogramSeries
+	lock   *sync.Mutex
+}
+
+func (histogram *MoqHistogram) Observe(value float64, labelValues ...string) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	series := histogram.getSeries(labelValues)
+	bucketIndex := sort.SearchFloat64s(histogram.buckets, value)
+	if bucketIndex < len(histogram.buckets) {
+		series.counts[bucketIndex]++
+	}
+	series.count++
+	series.sum += value
+}
+
+func (histogram *MoqHistogram) getSeries(labelValues []string) *moqHistogramSeries {
+	if len(labelValues) != len(histogram.labelNames) {
+		// Programming error
+		log.Panic(fmt.Sprintf("Metric %s needs %d label values, got %d", histogram.name, len(histogram.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	series, found := histogram.series[key]
+	if !found {
+		series = &moqHistogramSeries{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+	return series
+}
+
+func (histogram *MoqHistogram) write(w *bufio.Writer) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	writeHeader(w, histogram.name, histogram.help, MoqMetricTypeHistogram)
+	keys := maps.Keys(histogram.series)
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := histogram.series[key]
+		cumulative := uint64(0)
+		for i, upperBound := range histogram.buckets {
+			cumulative += series.counts[i]
+			writeSample(w, histogram.name+"_bucket", histogram.labelNames, series.labelValues, "le", formatFloat(upperBound), float64(cumulative))
+		}
+		writeSample(w, histogram.name+"_bucket", histogram.labelNames, series.labelValues, "le", "+Inf", float64(series.count))
+		writeSample(w, histogram.name+"_sum", histogram.labelNames, series.labelValues, "", "", series.sum)
+		writeSample(w, histogram.name+"_count", histogram.labelNames, series.labelValues, "", "", float64(series.count))
+	}
+}
+
+// Helpers
+
+func writeHeader(w *bufio.Writer, name string, help string, metricType MoqMetricType) {
+	w.WriteString(fmt.Sprintf("# HELP %s %s\n", name, strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help)))
+	w.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, metricType))
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames []string, labelValues []string, extraLabelName string, extraLabelValue string, value float64) {
+	labels := []string{}
+	for i, labelName := range labelNames {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", labelName, escapeLabelValue(labelValues[i])))
+	}
+	if extraLabelName != "" {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", extraLabelName, extraLabelValue))
+	}
+	if len(labels) > 0 {
+		w.WriteString(fmt.Sprintf("%s{%s} %s\n", name, strings.Join(labels, ","), formatFloat(value)))
+	} else {
+		w.WriteString(fmt.Sprintf("%s %s\n", name, formatFloat(value)))
+	}
+}
+
+func escapeLabelValue(labelValue string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(labelValue)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	if math.IsInf(value, -1) {
+		return "-Inf"
+	}
+	if math.IsNaN(value) {
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
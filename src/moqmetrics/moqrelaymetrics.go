@@ -0,0 +1,113 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmetrics
+
+import (
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Object payload sizes (bytes), from audio frames to video key frames
+var OBJECT_SIZE_BUCKETS = []float64{256, 1024, 4 * 1024, 16 * 1024, 64 * 1024, 256 * 1024, 1024 * 1024, 4 * 1024 * 1024}
+
+// Session durations (seconds)
+var SESSION_DURATION_BUCKETS = []float64{1, 10, 60, 5 * 60, 30 * 60, 2 * 60 * 60, 12 * 60 * 60}
+
+var roleLabels = map[moqhelpers.MoqRole]string{moqhelpers.MoqRolePublisher: "publisher", moqhelpers.MoqRoleSubscriber: "subscriber", moqhelpers.MoqRoleBoth: "both"}
+
+// MoqRelayMetrics Relay wide counters updated by the MOQ sessions (the rest of the metrics are collected when scraped)
+type MoqRelayMetrics struct {
+	sessions         *MoqCounter
+	sessionDuration  *MoqHistogram
+	objectsReceived  *MoqCounter
+	bytesReceived    *MoqCounter
+	objectSize       *MoqHistogram
+	objectsForwarded *MoqCounter
+	bytesForwarded   *MoqCounter
+	announces        *MoqCounter
+	announceErrors   *MoqCounter
+	subscribes       *MoqCounter
+	subscribeErrors  *MoqCounter
+}
+
+// NewRelayMetrics Registers the relay counters
+func NewRelayMetrics(m *MoqMetrics) *MoqRelayMetrics {
+	return &MoqRelayMetrics{
+		sessions:         m.NewCounter("moq_sessions_total", "MOQ sessions established", "role", "origin"),
+		sessionDuration:  m.NewHistogram("moq_session_duration_seconds", "Duration of the finished MOQ sessions", SESSION_DURATION_BUCKETS, "role", "origin"),
+		objectsReceived:  m.NewCounter("moq_objects_received_total", "Objects received from publishers and origins"),
+		bytesReceived:    m.NewCounter("moq_objects_received_bytes_total", "Payload bytes received from publishers and origins"),
+		objectSize:       m.NewHistogram("moq_object_size_bytes", "Payload size of the received objects", OBJECT_SIZE_BUCKETS),
+		objectsForwarded: m.NewCounter("moq_objects_forwarded_total", "Objects sent to subscribers"),
+		bytesForwarded:   m.NewCounter("moq_objects_forwarded_bytes_total", "Payload bytes sent to subscribers"),
+		announces:        m.NewCounter("moq_announces_total", "ANNOUNCE messages received"),
+		announceErrors:   m.NewCounter("moq_announce_errors_total", "ANNOUNCE error messages sent, per error code", "code"),
+		subscribes:       m.NewCounter("moq_subscribes_total", "SUBSCRIBE messages received"),
+		subscribeErrors:  m.NewCounter("moq_subscribe_errors_total", "SUBSCRIBE error messages sent by the relay, per error code", "code"),
+	}
+}
+
+func (rm *MoqRelayMetrics) SessionStarted(role moqhelpers.MoqRole, isOrigin bool) {
+	if rm == nil {
+		return
+	}
+	rm.sessions.Inc(roleLabels[role], strconv.FormatBool(isOrigin))
+}
+
+func (rm *MoqRelayMetrics) SessionEnded(role moqhelpers.MoqRole, isOrigin bool, duration time.Duration) {
+	if rm == nil {
+		return
+	}
+	rm.sessionDuration.Observe(duration.Seconds(), roleLabels[role], strconv.FormatBool(isOrigin))
+}
+
+func (rm *MoqRelayMetrics) ObjectReceived(payloadBytes uint64) {
+	if rm == nil {
+		return
+	}
+	rm.objectsReceived.Inc()
+	rm.bytesReceived.Add(float64(payloadBytes))
+	rm.objectSize.Observe(float64(payloadBytes))
+}
+
+func (rm *MoqRelayMetrics) ObjectForwarded(payloadBytes uint64) {
+	if rm == nil {
+		return
+	}
+	rm.objectsForwarded.Inc()
+	rm.bytesForwarded.Add(float64(payloadBytes))
+}
+
+func (rm *MoqRelayMetrics) AnnounceReceived() {
+	if rm == nil {
+		return
+	}
+	rm.announces.Inc()
+}
+
+func (rm *MoqRelayMetrics) AnnounceRejected(errCode moqhelpers.MoqErrorCodeAnnounce) {
+	if rm == nil {
+		return
+	}
+	rm.announceErrors.Inc(fmt.Sprintf("%d", errCode))
+}
+
+func (rm *MoqRelayMetrics) SubscribeReceived() {
+	if rm == nil {
+		return
+	}
+	rm.subscribes.Inc()
+}
+
+func (rm *MoqRelayMetrics) SubscribeRejected(errCode moqhelpers.MoqErrorCodeSubscribe) {
+	if rm == nil {
+		return
+	}
+	rm.subscribeErrors.Inc(fmt.Sprintf("%d", errCode))
+}
@@ -0,0 +1,209 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqnats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const NATS_DEFAULT_PORT = "4222"
+
+// Subscription id of the subject (only one per connection)
+const NATS_SUBSCRIPTION_ID = "1"
+
+type natsConnectOptions struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	// false: do NOT receive the messages published by this connection
+	Echo      bool   `json:"echo"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// MoqNatsConfig NATS server and subject from a nats://[user:pass@ | token@]host[:port][/subject/path] URL
+type MoqNatsConfig struct {
+	Addr string
+	// URL path with . instead of /
+	Subject string
+
+	options natsConnectOptions
+}
+
+// MoqNatsMessage Message to publish
+type MoqNatsMessage struct {
+	Subject string
+	Data    []byte
+}
+
+// MoqNatsConn Connection to a NATS server (core NATS text protocol), publishes and PONGs are written under the same lock
+type MoqNatsConn struct {
+	Addr string
+
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   *sync.Mutex
+}
+
+// ParseUrl Returns the config of the URL, the subject is defaultSubject if the URL does NOT have a path
+func ParseUrl(natsUrl *url.URL, defaultSubject string, clientName string) (config MoqNatsConfig, err error) {
+	config.Addr = natsUrl.Host
+	if natsUrl.Port() == "" {
+		config.Addr = net.JoinHostPort(natsUrl.Hostname(), NATS_DEFAULT_PORT)
+	}
+	config.Subject = strings.ReplaceAll(strings.Trim(natsUrl.Path, "/"), "/", ".")
+	if config.Subject == "" {
+		config.Subject = defaultSubject
+	}
+	if strings.ContainsAny(config.Subject, " \t\r\n*>") {
+		err = errors.New(fmt.Sprintf("Invalid NATS subject %q", config.Subject))
+		return
+	}
+	config.options = natsConnectOptions{Name: clientName, Lang: "go", Version: "1.0.0", Echo: false}
+	if natsUrl.User != nil {
+		pass, hasPass := natsUrl.User.Password()
+		if hasPass {
+			config.options.User = natsUrl.User.Username()
+			config.options.Pass = pass
+		} else {
+			config.options.AuthToken = natsUrl.User.Username()
+		}
+	}
+	return
+}
+
+// Connect Connects (INFO, CONNECT, SUB to the config subject if subscribe, PING / PONG checks the credentials)
+func Connect(config MoqNatsConfig, subscribe bool, timeout time.Duration) (nc *MoqNatsConn, err error) {
+	conn, err := net.DialTimeout("tcp", config.Addr, timeout)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	info, errInfo := reader.ReadString('\n')
+	if errInfo == nil && !strings.HasPrefix(info, "INFO ") {
+		errInfo = errors.New(fmt.Sprintf("Unexpected NATS greeting %q", strings.TrimSpace(info)))
+	}
+	if errInfo != nil {
+		conn.Close()
+		err = errInfo
+		return
+	}
+	options, _ := json.Marshal(config.options)
+	handshake := "CONNECT " + string(options) + "\r\n"
+	if subscribe {
+		handshake += "SUB " + config.Subject + " " + NATS_SUBSCRIPTION_ID + "\r\n"
+	}
+	_, err = conn.Write([]byte(handshake + "PING\r\n"))
+	if err == nil {
+		err = waitPong(reader)
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	nc = &MoqNatsConn{Addr: config.Addr, conn: conn, reader: reader, lock: new(sync.Mutex)}
+	return
+}
+
+// Publish Writes all the messages at once
+func (nc *MoqNatsConn) Publish(messages []MoqNatsMessage, timeout time.Duration) error {
+	var buffer bytes.Buffer
+	for _, message := range messages {
+		fmt.Fprintf(&buffer, "PUB %s %d\r\n", message.Subject, len(message.Data))
+		buffer.Write(message.Data)
+		buffer.WriteString("\r\n")
+	}
+	return nc.write(buffer.Bytes(), timeout)
+}
+
+// ReadMessages Calls onMessage (if set) with the subject and payload of every MSG and answers the server PINGs (keep alive) until the connection fails
+func (nc *MoqNatsConn) ReadMessages(onMessage func(subject string, data []byte), timeout time.Duration) (err error) {
+	for {
+		line, errRead := nc.reader.ReadString('\n')
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "MSG ") {
+			// MSG [subject] [sid] [reply-to] [#bytes]
+			fields := strings.Fields(line)
+			size, errSize := strconv.Atoi(fields[len(fields)-1])
+			if len(fields) < 4 || errSize != nil || size < 0 {
+				err = errors.New(fmt.Sprintf("Invalid NATS MSG %q", line))
+				return
+			}
+			payload := make([]byte, size+2)
+			_, err = io.ReadFull(nc.reader, payload)
+			if err != nil {
+				return
+			}
+			if onMessage != nil {
+				onMessage(fields[1], payload[:size])
+			}
+		} else if line == "PING" {
+			err = nc.write([]byte("PONG\r\n"), timeout)
+			if err != nil {
+				return
+			}
+		} else if strings.HasPrefix(line, "-ERR") {
+			log.WithField("addr", nc.Addr).Error(fmt.Sprintf("NATS error: %s", line))
+		}
+	}
+}
+
+// Close Closes the connection (ReadMessages returns)
+func (nc *MoqNatsConn) Close() {
+	nc.conn.Close()
+}
+
+func (nc *MoqNatsConn) write(data []byte, timeout time.Duration) (err error) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	nc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = nc.conn.Write(data)
+	return
+}
+
+// waitPong Reads until the PONG of the PING sent after CONNECT (errors are returned, ex: authorization)
+func waitPong(reader *bufio.Reader) (err error) {
+	for {
+		line, errRead := reader.ReadString('\n')
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			return
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			err = errors.New(fmt.Sprintf("NATS error: %s", line))
+			return
+		}
+	}
+}
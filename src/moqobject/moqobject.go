@@ -7,12 +7,18 @@ LICENSE file in the root directory of this source tree.
 package moqobject
 
 import (
+	"bytes"
+	"compress/flate"
 	"fmt"
 	"io"
 	"sync"
 	"time"
 )
 
+// Capacity of the payload chunks, they double (up to max) as the payload grows
+const OBJ_MIN_CHUNK_SIZE_BYTES = 4 * 1024
+const OBJ_MAX_CHUNK_SIZE_BYTES = 1024 * 1024
+
 // Object header
 type MoqObjectHeader struct {
 	TrackId        uint64
@@ -27,29 +33,60 @@ type MoqObject struct {
 	ReceivedAt time.Time
 	MaxAgeS    uint64
 
-	// Mutable (protected)
-	buffer []byte
+	// Payload, written bytes are immutable so readers reference them without copying (protected)
+	chunks [][]byte
+	// Bytes in chunks (protected)
+	storedSize int
 
 	// Mutable (protected)
 	eof bool
+	// Publisher stream failed before EOF (protected)
+	aborted bool
+
+	// Compress the payload when EOF (protected)
+	compressOnEof bool
+	// Chunks have the compressed payload, payloadSize is the original size (protected)
+	compressed  bool
+	payloadSize int
+
+	// Called after payload bytes are added (cache accounting)
+	onPayloadWrite func(n int)
+	// Called once when no more bytes will be added (EOF or abort)
+	onEof func()
 
 	// Lock to protect mutable fields
 	lock *sync.RWMutex
+	// Signaled when payload bytes are added or EOF (readers wait on it)
+	dataCond *sync.Cond
 }
 
 func (m *MoqObjectHeader) GetDebugStr() string {
 	return fmt.Sprintf("TrackId: %d, groupSeq: %d, dbjSeq: %d, sendOrder: %d", m.TrackId, m.GroupSequence, m.ObjectSequence, m.SendOrder)
 }
 
-// FileReader Defines a reader
-type moqMessageObjectReader struct {
+// MoqObjectChunkReader Returns the payload as references to the object chunks (zero copy), many readers share the same chunks
+type MoqObjectChunkReader struct {
+	// Payload bytes returned
 	offset int
+	// Position in the chunks (uncompressed objects)
+	chunkIndex  int
+	chunkOffset int
+	// Decompressed payload (compressed objects only)
+	plain []byte
 	*MoqObject
 }
 
+// FileReader Defines a reader
+type moqMessageObjectReader struct {
+	chunkReader *MoqObjectChunkReader
+	// Part of the last chunk NOT read yet
+	pending []byte
+}
+
 // New message object
-func New(objHeader MoqObjectHeader, maxAgeS uint64) *MoqObject {
-	moqtObj := MoqObject{MoqObjectHeader: MoqObjectHeader{TrackId: objHeader.TrackId, GroupSequence: objHeader.GroupSequence, ObjectSequence: objHeader.ObjectSequence, SendOrder: objHeader.SendOrder}, ReceivedAt: time.Now(), MaxAgeS: maxAgeS, eof: false, buffer: []byte{}, lock: new(sync.RWMutex)}
+func New(objHeader MoqObjectHeader, maxAgeS uint64, receivedAt time.Time) *MoqObject {
+	moqtObj := MoqObject{MoqObjectHeader: MoqObjectHeader{TrackId: objHeader.TrackId, GroupSequence: objHeader.GroupSequence, ObjectSequence: objHeader.ObjectSequence, SendOrder: objHeader.SendOrder}, ReceivedAt: receivedAt, MaxAgeS: maxAgeS, eof: false, chunks: [][]byte{}, lock: new(sync.RWMutex)}
+	moqtObj.dataCond = sync.NewCond(moqtObj.lock.RLocker())
 
 	return &moqtObj
 }
@@ -58,24 +95,149 @@ func (m *MoqObject) GetDebugStr() string {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return fmt.Sprintf("%s, bytesRead: %d", m.MoqObjectHeader.GetDebugStr(), len(m.buffer))
+	return fmt.Sprintf("%s, bytesRead: %d, compressed: %t", m.MoqObjectHeader.GetDebugStr(), m.getPayloadSize(), m.compressed)
 }
 
-// Write bytes
+// Write bytes (copied), returns 0 (NOT written) if the object is aborted
 func (m *MoqObject) PayloadWrite(p []byte) int {
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	if m.aborted {
+		m.lock.Unlock()
+		return 0
+	}
+	m.appendPayload(p)
+	onPayloadWrite := m.onPayloadWrite
+	m.lock.Unlock()
+	m.dataCond.Broadcast()
 
-	m.buffer = append(m.buffer, p...)
+	if onPayloadWrite != nil {
+		onPayloadWrite(len(p))
+	}
 	return len(p)
 }
 
+// appendPayload Copies p after the written bytes, to the free capacity of the last chunk or to a new chunk (needs lock)
+func (m *MoqObject) appendPayload(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	last := len(m.chunks) - 1
+	if last >= 0 && len(m.chunks[last])+len(p) <= cap(m.chunks[last]) {
+		// Readers only reference the bytes before len, appending in place is safe
+		m.chunks[last] = append(m.chunks[last], p...)
+	} else {
+		// Chunks are NOT reused, readers can reference them after the object is released
+		chunkSize := max(len(p), min(max(OBJ_MIN_CHUNK_SIZE_BYTES, m.storedSize), OBJ_MAX_CHUNK_SIZE_BYTES))
+		m.chunks = append(m.chunks, append(make([]byte, 0, chunkSize), p...))
+	}
+	m.storedSize += len(p)
+}
+
+// SetOnPayloadWrite Sets the function called every time payload bytes are added
+func (m *MoqObject) SetOnPayloadWrite(onPayloadWrite func(n int)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.onPayloadWrite = onPayloadWrite
+}
+
+// SetOnEof Sets the function called when the object is closed (EOF or aborted)
+func (m *MoqObject) SetOnEof(onEof func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.onEof = onEof
+}
+
+// SetCompressOnEof Compress the payload in memory when all bytes are received (readers get it decompressed)
+func (m *MoqObject) SetCompressOnEof() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.compressOnEof = true
+}
+
+// Current payload size
+func (m *MoqObject) GetPayloadSize() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.getPayloadSize()
+}
+
+// GetStoredSize Bytes used in memory by the payload (compressed size for compressed objects)
+func (m *MoqObject) GetStoredSize() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.storedSize
+}
+
 // NO more bytes will be added
 func (m *MoqObject) SetEof() {
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	wasEof := m.eof
+	m.eof = true
+	storedDelta := 0
+	if m.compressOnEof && !m.compressed {
+		storedDelta = m.compress()
+	}
+	onPayloadWrite := m.onPayloadWrite
+	onEof := m.onEof
+	m.lock.Unlock()
+	m.dataCond.Broadcast()
+
+	if onPayloadWrite != nil && storedDelta != 0 {
+		onPayloadWrite(storedDelta)
+	}
+	if onEof != nil && !wasEof {
+		onEof()
+	}
+}
+
+// compress Replaces the chunks by the compressed payload if smaller, returns the stored size change (needs lock)
+func (m *MoqObject) compress() (storedDelta int) {
+	var compressedBuffer bytes.Buffer
+	compressor, errCompressor := flate.NewWriter(&compressedBuffer, flate.DefaultCompression)
+	if errCompressor != nil {
+		return
+	}
+	for _, chunk := range m.chunks {
+		compressor.Write(chunk)
+	}
+	if compressor.Close() != nil || compressedBuffer.Len() >= m.storedSize {
+		return
+	}
+
+	storedDelta = compressedBuffer.Len() - m.storedSize
+	m.payloadSize = m.storedSize
+	// Readers already referencing the old chunks keep them
+	m.chunks = [][]byte{compressedBuffer.Bytes()}
+	m.storedSize = compressedBuffer.Len()
+	m.compressed = true
+	return
+}
+
+func (m *MoqObject) getPayloadSize() int {
+	if m.compressed {
+		return m.payloadSize
+	}
+	return m.storedSize
+}
 
+// Abort NO more bytes will be added, the payload is incomplete (readers get io.ErrUnexpectedEOF)
+func (m *MoqObject) Abort() {
+	m.lock.Lock()
+	wasEof := m.eof
 	m.eof = true
+	m.aborted = true
+	onEof := m.onEof
+	m.lock.Unlock()
+	m.dataCond.Broadcast()
+
+	if onEof != nil && !wasEof {
+		onEof()
+	}
 }
 
 // Get EOF
@@ -86,29 +248,71 @@ func (m *MoqObject) GetEof() bool {
 	return m.eof
 }
 
-// Returns a new reader
+// Returns a new reader (copies the payload to the read buffers)
 func (m *MoqObject) NewReader() io.Reader {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	return &moqMessageObjectReader{chunkReader: m.NewChunkReader()}
+}
 
-	return &moqMessageObjectReader{
-		offset:    0,
-		MoqObject: m,
-	}
+// NewChunkReader Returns a new zero copy reader
+func (m *MoqObject) NewChunkReader() *MoqObjectChunkReader {
+	return &MoqObjectChunkReader{MoqObject: m}
 }
 
-// Read Reads bytes from object
-func (r *moqMessageObjectReader) Read(p []byte) (int, error) {
+// NextChunk Returns the next payload bytes, blocks until there are new bytes or EOF. The returned slice is shared and can NOT be modified
+func (r *MoqObjectChunkReader) NextChunk() ([]byte, error) {
 	r.MoqObject.lock.RLock()
 	defer r.MoqObject.lock.RUnlock()
 
-	if r.offset >= len(r.MoqObject.buffer) {
-		if r.MoqObject.eof {
-			return 0, io.EOF
+	for r.offset >= r.MoqObject.storedSize && !r.MoqObject.eof {
+		r.MoqObject.dataCond.Wait()
+	}
+	var chunk []byte
+	if r.MoqObject.compressed {
+		if r.plain == nil {
+			plain, errDecompress := io.ReadAll(flate.NewReader(bytes.NewReader(r.MoqObject.chunks[0])))
+			if errDecompress != nil {
+				return nil, errDecompress
+			}
+			r.plain = plain
+		}
+		if r.offset < len(r.plain) {
+			chunk = r.plain[r.offset:]
+		}
+	} else {
+		for r.chunkIndex < len(r.MoqObject.chunks) && r.chunkOffset >= len(r.MoqObject.chunks[r.chunkIndex]) {
+			if r.chunkIndex == len(r.MoqObject.chunks)-1 {
+				// Last chunk can still grow
+				break
+			}
+			r.chunkIndex++
+			r.chunkOffset = 0
+		}
+		if r.chunkIndex < len(r.MoqObject.chunks) && r.chunkOffset < len(r.MoqObject.chunks[r.chunkIndex]) {
+			chunk = r.MoqObject.chunks[r.chunkIndex][r.chunkOffset:]
+			r.chunkOffset += len(chunk)
+		}
+	}
+	if len(chunk) == 0 {
+		if r.MoqObject.aborted {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, io.EOF
+	}
+	r.offset += len(chunk)
+	// Capacity limited, appending to it can NOT overwrite the object bytes
+	return chunk[:len(chunk):len(chunk)], nil
+}
+
+// Read Reads bytes from object, blocks until there are new bytes or EOF
+func (r *moqMessageObjectReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		chunk, err := r.chunkReader.NextChunk()
+		if err != nil {
+			return 0, err
 		}
-		return 0, nil
+		r.pending = chunk
 	}
-	n := copy(p, r.MoqObject.buffer[r.offset:])
-	r.offset += n
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
 	return n, nil
 }
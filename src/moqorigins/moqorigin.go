@@ -10,19 +10,67 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"facebookexperimental/moq-go-server/moqclock"
 	"facebookexperimental/moq-go-server/moqconnectionmanagment"
 	"facebookexperimental/moq-go-server/moqfwdtable"
 	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqrawquic"
+	"facebookexperimental/moq-go-server/moqsession"
 	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 )
 
 const RECONNECT_DELAY_MS = 3000
 
+// How often an on demand origin checks if it still has subscriptions
+const LAZY_IDLE_CHECK_PERIOD_MS = 1000
+
+// How often an origin connected to a failover address checks if a preferred address is available again
+const FAILBACK_CHECK_PERIOD_MS = 10000
+const FAILBACK_PROBE_TIMEOUT_MS = 3000
+
+// How often DNS discovered origins are resolved again (while connected)
+const DNS_REFRESH_PERIOD_MS = 30000
+
+// Used when a raw QUIC origin address (moq://) has no port
+const RAW_QUIC_DEFAULT_PORT = "443"
+
+// How originaddress is resolved
+type MoqOriginDiscovery string
+
+const (
+	// Used as is
+	MoqOriginDiscoveryNone MoqOriginDiscovery = ""
+	// Host is a SRV record name (ex: https://_moq._udp.example.com/moq), targets and ports are used from its records
+	MoqOriginDiscoverySrv MoqOriginDiscovery = "srv"
+	// Host resolves to several A / AAAA records (ex: https://relays.example.com:4433/moq), every IP is an endpoint
+	MoqOriginDiscoveryA MoqOriginDiscovery = "a"
+)
+
+type MoqOriginConnStatus string
+
+const (
+	MoqOriginConnStatusIdle       MoqOriginConnStatus = "idle"
+	MoqOriginConnStatusConnecting MoqOriginConnStatus = "connecting"
+	MoqOriginConnStatusConnected  MoqOriginConnStatus = "connected"
+	// On demand origin without subscriptions kept connected (warm pool)
+	MoqOriginConnStatusWarm         MoqOriginConnStatus = "warm"
+	MoqOriginConnStatusDisconnected MoqOriginConnStatus = "disconnected"
+	MoqOriginConnStatusClosed       MoqOriginConnStatus = "closed"
+)
+
 type MoqOriginData struct {
 	FriendlyName   string `json:"friendlyname"`
 	Guid           string `json:"guid"`
@@ -30,7 +78,62 @@ type MoqOriginData struct {
 	AuthInfo       string `json:"authinfo"`
 	OriginAddress  string `json:"originaddress"`
 	OriginCertPath string `json:"origincertpath"`
+	// Previous groups to request on the first SUBSCRIBE of a track (0 disabled)
+	WarmUpGroups uint64 `json:"warmupgroups"`
+	// Only connect when a subscriber needs it, disconnect after some time without subscriptions
+	Lazy bool `json:"lazy"`
+	// Parallel sessions to this origin, tracks are sharded across them (default 1)
+	Sessions int `json:"sessions"`
+	// Announce the local namespaces that match tracknamespace to the origin (this relay publishes into it), lazy is ignored
+	Push bool `json:"push"`
+	// Resolve originaddress using DNS SRV or A records (default none)
+	Discovery MoqOriginDiscovery `json:"discovery"`
+	// Used when originaddress is NOT available (ordered by priority), it fails back when a preferred one is available again
+	FailoverAddresses []MoqOriginAddress `json:"failoveraddresses"`
+	// Client certificate and key (PEM) presented to the origin (mutual TLS)
+	ClientCertPath string `json:"clientcertpath"`
+	ClientKeyPath  string `json:"clientkeypath"`
+	// Where authinfo comes from (default static, authinfo as is), refreshed tokens are used on the next connection
+	TokenProvider  MoqOriginTokenProvider `json:"tokenprovider"`
 	CertData       []byte
+	ClientCertData []byte
+	ClientKeyData  []byte
+}
+
+type MoqOriginAddress struct {
+	OriginAddress  string `json:"originaddress"`
+	OriginCertPath string `json:"origincertpath"`
+	// Lower is preferred (originaddress is 0)
+	Priority int `json:"priority"`
+	CertData []byte
+
+	// TLS server name (when the address host is a discovered IP)
+	serverName string
+}
+
+type MoqOriginStatus struct {
+	FriendlyName   string              `json:"friendlyName"`
+	Guid           string              `json:"guid"`
+	TrackNamespace string              `json:"trackNamespace"`
+	OriginAddress  string              `json:"originAddress"`
+	ActiveAddress  string              `json:"activeAddress,omitempty"`
+	Status         MoqOriginConnStatus `json:"status"`
+	StatusAgeMs    int64               `json:"statusAgeMs"`
+	LastError      string              `json:"lastError,omitempty"`
+}
+
+type MoqOriginMetrics struct {
+	FriendlyName    string `json:"friendlyName"`
+	Guid            string `json:"guid"`
+	ConnectAttempts uint64 `json:"connectAttempts"`
+	ConnectFailures uint64 `json:"connectFailures"`
+	// Current connection (0 if not connected) and all connections
+	UptimeMs      int64 `json:"uptimeMs"`
+	TotalUptimeMs int64 `json:"totalUptimeMs"`
+	// All connections
+	ReceivedObjects     uint64 `json:"receivedObjects"`
+	ReceivedBytes       uint64 `json:"receivedBytes"`
+	ForwardedSubscribes uint64 `json:"forwardedSubscribes"`
 }
 
 type MoqOrigin struct {
@@ -38,6 +141,28 @@ type MoqOrigin struct {
 
 	// Housekeeping thread channel
 	cleanUpChannel chan bool
+	// Subscribers waiting for this origin (on demand origins)
+	demandChannel chan bool
+
+	connConfig moqconnectionmanagment.MoqConnectionConfig
+
+	// Auth info (shared by the pool sessions)
+	token *moqOriginToken
+	// Idle on demand sessions kept connected (shared by all origins, nil disabled)
+	warmPool *moqOriginWarmPool
+
+	// Connection status (protected)
+	status          MoqOriginConnStatus
+	statusChangedAt time.Time
+	lastError       string
+	// Current session (WT or raw QUIC) and its address (protected)
+	session       moqconnectionmanagment.MoqTransportSession
+	activeAddress string
+	// Metrics (protected), counters of previous MOQ sessions are accumulated in metrics
+	metrics     MoqOriginMetrics
+	connectedAt time.Time
+	moqSession  *moqsession.MoqSession
+	lock        *sync.RWMutex
 
 	// Used for WT
 	d            *webtransport.Dialer
@@ -46,15 +171,23 @@ type MoqOrigin struct {
 
 type moqOriginExt struct {
 	MoqOriginData
-	moqOriginPtr *MoqOrigin
+	moqOriginPool *moqOriginPool
 }
 
 // New Creates a new moq origin
-func newOrigin(moqOriginData MoqOriginData, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) *MoqOrigin {
-	mor := MoqOrigin{moqOriginData, make(chan bool), nil, nil}
+func newOrigin(moqOriginData MoqOriginData, token *moqOriginToken, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig moqconnectionmanagment.MoqConnectionConfig, warmPool *moqOriginWarmPool) *MoqOrigin {
+	connConfig.OriginWarmUpGroups = moqOriginData.WarmUpGroups
+	connConfig.OriginPush = moqOriginData.Push
+	status := MoqOriginConnStatusConnecting
+	if moqOriginData.Lazy && !moqOriginData.Push {
+		status = MoqOriginConnStatusIdle
+	}
+	mor := MoqOrigin{moqOriginData: moqOriginData, cleanUpChannel: make(chan bool), demandChannel: make(chan bool, 1), connConfig: connConfig, token: token, warmPool: warmPool, status: status, statusChangedAt: connConfig.Clock.Now(), lock: new(sync.RWMutex)}
+
+	mor.connConfig.OriginOnSession = mor.setMoqSession
 
 	// Start process thread
-	go mor.process(mor.cleanUpChannel, moqtFwdTable, objects, objExpMs)
+	go mor.process(mor.cleanUpChannel, moqtFwdTable, objects)
 
 	return &mor
 }
@@ -66,6 +199,7 @@ func (mor *MoqOrigin) Close() (err error) {
 	// Wait to finish
 	<-mor.cleanUpChannel
 
+	mor.warmPool.remove(mor)
 	if mor.d != nil {
 		mor.d.Close()
 	}
@@ -75,81 +209,630 @@ func (mor *MoqOrigin) Close() (err error) {
 	mor.d = nil
 	mor.roundTripper = nil
 
+	mor.setStatus(MoqOriginConnStatusClosed, nil)
+
 	return
 }
 
-func (mor *MoqOrigin) process(cleanUpChannelBidi chan bool, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) {
-	log.Info(fmt.Sprintf("%s Entering origin process thread", mor.moqOriginData.FriendlyName))
+// Demand Connects an on demand origin (if it is not connected yet)
+func (mor *MoqOrigin) Demand() {
+	select {
+	case mor.demandChannel <- true:
+	default:
+	}
+}
+
+// GetStatus Returns the origin connection status
+func (mor *MoqOrigin) GetStatus() MoqOriginStatus {
+	mor.lock.RLock()
+	defer mor.lock.RUnlock()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	return MoqOriginStatus{FriendlyName: mor.moqOriginData.FriendlyName, Guid: mor.moqOriginData.Guid, TrackNamespace: mor.moqOriginData.TrackNamespace, OriginAddress: mor.moqOriginData.OriginAddress, ActiveAddress: mor.activeAddress, Status: mor.status, StatusAgeMs: mor.connConfig.Clock.Now().Sub(mor.statusChangedAt).Milliseconds(), LastError: mor.lastError}
+}
+
+// getLog Returns a log entry with the origin name as field
+func (mor *MoqOrigin) getLog() *log.Entry {
+	return log.WithField("originName", mor.moqOriginData.FriendlyName)
+}
 
-	// TODO: Reconnect if disconnected
+// GetMetrics Returns the origin counters (all connections)
+func (mor *MoqOrigin) GetMetrics() MoqOriginMetrics {
+	mor.lock.RLock()
+	defer mor.lock.RUnlock()
+
+	metrics := mor.metrics
+	metrics.FriendlyName = mor.moqOriginData.FriendlyName
+	metrics.Guid = mor.moqOriginData.Guid
+	if !mor.connectedAt.IsZero() {
+		metrics.UptimeMs = mor.connConfig.Clock.Now().Sub(mor.connectedAt).Milliseconds()
+		metrics.TotalUptimeMs += metrics.UptimeMs
+	}
+	if mor.moqSession != nil {
+		info := mor.moqSession.GetInfo()
+		metrics.ReceivedObjects += info.ReceivedObjects
+		metrics.ReceivedBytes += info.ReceivedBytes
+		metrics.ForwardedSubscribes += info.ForwardedSubscribes
+	}
+	return metrics
+}
+
+// addConnectAttempt Counts a connection attempt, connected is false if it failed
+func (mor *MoqOrigin) addConnectAttempt(connected bool) {
+	mor.lock.Lock()
+	defer mor.lock.Unlock()
+
+	mor.metrics.ConnectAttempts++
+	if !connected {
+		mor.metrics.ConnectFailures++
+	} else {
+		mor.connectedAt = mor.connConfig.Clock.Now()
+	}
+}
+
+// setMoqSession Keeps the MOQ session of the current connection (to read its counters)
+func (mor *MoqOrigin) setMoqSession(moqSession *moqsession.MoqSession) {
+	mor.lock.Lock()
+	defer mor.lock.Unlock()
+
+	mor.moqSession = moqSession
+}
 
-	go mor.processClientSession(ctx, moqtFwdTable, objects, objExpMs)
+// endConnectionMetrics Accumulates the counters of the finished connection
+func (mor *MoqOrigin) endConnectionMetrics() {
+	mor.lock.Lock()
+	defer mor.lock.Unlock()
+
+	if !mor.connectedAt.IsZero() {
+		mor.metrics.TotalUptimeMs += mor.connConfig.Clock.Now().Sub(mor.connectedAt).Milliseconds()
+		mor.connectedAt = time.Time{}
+	}
+	if mor.moqSession != nil {
+		info := mor.moqSession.GetInfo()
+		mor.metrics.ReceivedObjects += info.ReceivedObjects
+		mor.metrics.ReceivedBytes += info.ReceivedBytes
+		mor.metrics.ForwardedSubscribes += info.ForwardedSubscribes
+		mor.moqSession = nil
+	}
+}
+
+func (mor *MoqOrigin) setStatus(status MoqOriginConnStatus, err error) {
+	mor.lock.Lock()
+	defer mor.lock.Unlock()
+
+	// Session thread can finish after close
+	if mor.status == MoqOriginConnStatusClosed {
+		return
+	}
+	if mor.status != status {
+		mor.status = status
+		mor.statusChangedAt = mor.connConfig.Clock.Now()
+	}
+	if err != nil {
+		mor.lastError = err.Error()
+	}
+}
+
+func (mor *MoqOrigin) process(cleanUpChannelBidi chan bool, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects) {
+	mor.getLog().Info("Entering origin process thread")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if mor.moqOriginData.Lazy && !mor.moqOriginData.Push {
+		go mor.processLazyClientSession(ctx, moqtFwdTable, objects)
+	} else {
+		go mor.processClientSession(ctx, moqtFwdTable, objects)
+	}
 
 	select {
 	case <-cleanUpChannelBidi:
-		log.Info(fmt.Sprintf("%s Received exit signal", mor.moqOriginData.FriendlyName))
+		mor.getLog().Info("Received exit signal")
 	}
 	cancel()
 
 	// Indicates finished
 	cleanUpChannelBidi <- true
 
-	log.Info(fmt.Sprintf("%s Exited origin process thread", mor.moqOriginData.FriendlyName))
+	mor.getLog().Info("Exited origin process thread")
 }
 
-func (mor *MoqOrigin) processClientSession(ctx context.Context, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) {
+func (mor *MoqOrigin) processClientSession(ctx context.Context, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects) {
+	addresses := []MoqOriginAddress{}
+	addressIndex := 0
 
 	// Loop until context cancelled
 	for ctx.Err() == nil {
-		session, errConn := mor.connectClientWT(ctx, mor.moqOriginData.OriginAddress, mor.moqOriginData.CertData)
+		if addressIndex == 0 {
+			// DNS discovered addresses can change
+			addresses = mor.getAddresses(ctx)
+		}
+		address := addresses[addressIndex]
+		reconnectNow := false
+		mor.setStatus(MoqOriginConnStatusConnecting, nil)
+		authInfo, tokenRefreshAt, errToken := mor.token.Get(ctx)
+		if errToken != nil {
+			mor.getLog().WithField("tokenProvider", mor.moqOriginData.TokenProvider.Type).WithError(errToken).Error("Error getting auth token")
+			mor.setStatus(MoqOriginConnStatusDisconnected, errToken)
+			sleepWithContext(ctx, mor.connConfig.Clock, RECONNECT_DELAY_MS*time.Millisecond)
+			continue
+		}
+		session, errConn := mor.connectClient(ctx, address.OriginAddress, address.CertData, address.serverName)
+		mor.addConnectAttempt(errConn == nil)
 		if errConn != nil {
-			log.Error(fmt.Sprintf("%s - error connecting WT to: %s. Err %v", mor.moqOriginData.FriendlyName, mor.moqOriginData.OriginAddress, errConn))
+			mor.getLog().WithField("address", address.OriginAddress).WithError(errConn).Error("Error connecting")
+			mor.setStatus(MoqOriginConnStatusDisconnected, errConn)
+			// Failover to the next address
+			addressIndex = (addressIndex + 1) % len(addresses)
 		} else {
-			log.Info(fmt.Sprintf("%s - Connected WT", mor.moqOriginData.FriendlyName))
-
-			moqconnectionmanagment.MoqConnectionManagment(true, mor.moqOriginData.TrackNamespace, mor.moqOriginData.AuthInfo, ctx, session, mor.moqOriginData.FriendlyName, moqtFwdTable, objects, objExpMs)
+			mor.getLog().WithFields(log.Fields{"address": address.OriginAddress, "priority": address.Priority}).Info("Connected")
+			mor.setStatus(MoqOriginConnStatusConnected, nil)
+			mor.setSession(ctx, session, address.OriginAddress)
+
+			watchCtx, watchCancel := context.WithCancel(ctx)
+			reconnectChannel := make(chan bool, 2)
+			preferredAddresses := []MoqOriginAddress{}
+			for _, preferredAddress := range addresses[:addressIndex] {
+				if preferredAddress.Priority < address.Priority {
+					preferredAddresses = append(preferredAddresses, preferredAddress)
+				}
+			}
+			if len(preferredAddresses) > 0 {
+				go mor.failBackWhenAvailable(watchCtx, preferredAddresses, reconnectChannel)
+			}
+			if mor.moqOriginData.Discovery != MoqOriginDiscoveryNone {
+				go mor.reconnectOnDnsChange(watchCtx, address, reconnectChannel)
+			}
+			if !tokenRefreshAt.IsZero() {
+				go mor.reconnectOnTokenRefresh(watchCtx, tokenRefreshAt, reconnectChannel)
+			}
+			connConfig := mor.connConfig
+			connConfig.OriginSetupPath = getRawQuicPath(address.OriginAddress)
+			moqconnectionmanagment.MoqConnectionManagment(true, mor.moqOriginData.TrackNamespace, authInfo, ctx, session, moqsession.MoqSessionMetadata{}, mor.moqOriginData.FriendlyName, moqtFwdTable, objects, connConfig)
+			watchCancel()
+			mor.endConnectionMetrics()
+			select {
+			case reconnectNow = <-reconnectChannel:
+			default:
+			}
+
+			mor.setSession(ctx, nil, "")
+			mor.setStatus(MoqOriginConnStatusDisconnected, nil)
+			// Start again from the preferred address
+			addressIndex = 0
+		}
+		if !reconnectNow {
+			sleepWithContext(ctx, mor.connConfig.Clock, RECONNECT_DELAY_MS*time.Millisecond)
 		}
-		sleepWithContext(ctx, RECONNECT_DELAY_MS*time.Millisecond)
 	}
 	return
 }
 
-func (mor *MoqOrigin) connectClientWT(ctx context.Context, addr string, cert []byte) (session *webtransport.Session, err error) {
+// failBackWhenAvailable Closes the current session when any of the (preferred) addresses is available
+func (mor *MoqOrigin) failBackWhenAvailable(ctx context.Context, preferredAddresses []MoqOriginAddress, reconnectChannel chan bool) {
+	timeCh := mor.connConfig.Clock.NewTicker(FAILBACK_CHECK_PERIOD_MS * time.Millisecond)
+	defer timeCh.Stop()
 
-	var d webtransport.Dialer
-	mor.d = &d
-	if cert != nil {
-		pool, errPool := x509.SystemCertPool()
-		if errPool != nil {
-			log.Error(fmt.Sprintf("%s - Loading local cert pool. Err: %v", mor.moqOriginData.FriendlyName, errPool))
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-timeCh.C():
+			for _, address := range preferredAddresses {
+				if !mor.probeClient(ctx, address.OriginAddress, address.CertData, address.serverName) {
+					continue
+				}
+				mor.getLog().WithFields(log.Fields{"address": address.OriginAddress, "priority": address.Priority}).Info("Preferred address is available, failing back")
+				reconnectChannel <- true
+				mor.closeSession("Failing back")
+				return
+			}
 		}
-		pool.AppendCertsFromPEM(cert)
+	}
+}
+
+// reconnectOnDnsChange Closes the current session when its address is NOT in the DNS records anymore
+func (mor *MoqOrigin) reconnectOnDnsChange(ctx context.Context, activeAddress MoqOriginAddress, reconnectChannel chan bool) {
+	timeCh := mor.connConfig.Clock.NewTicker(DNS_REFRESH_PERIOD_MS * time.Millisecond)
+	defer timeCh.Stop()
 
-		mor.roundTripper = &http3.RoundTripper{
-			TLSClientConfig: &tls.Config{
-				RootCAs:            pool,
-				InsecureSkipVerify: false,
-			},
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeCh.C():
+			discoveredAddresses, errResolve := resolveOriginAddress(ctx, mor.moqOriginData.Discovery, mor.moqOriginData.OriginAddress)
+			if errResolve != nil {
+				// Keep current session
+				mor.getLog().WithFields(log.Fields{"address": mor.moqOriginData.OriginAddress, "discovery": mor.moqOriginData.Discovery}).WithError(errResolve).Error("Resolving origin address")
+				continue
+			}
+			found := false
+			for _, discoveredAddress := range discoveredAddresses {
+				if discoveredAddress.OriginAddress == activeAddress.OriginAddress {
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+			mor.getLog().WithFields(log.Fields{"address": activeAddress.OriginAddress, "originAddress": mor.moqOriginData.OriginAddress}).Info("Address is NOT in the DNS records anymore, reconnecting")
+			reconnectChannel <- true
+			mor.closeSession("DNS records changed")
+			return
 		}
-		mor.d.RoundTripper = mor.roundTripper
 	}
+}
+
+// reconnectOnTokenRefresh Closes the current session when its auth token needs to be refreshed (the new session uses a fresh one)
+func (mor *MoqOrigin) reconnectOnTokenRefresh(ctx context.Context, refreshAt time.Time, reconnectChannel chan bool) {
+	timer := mor.connConfig.Clock.NewTimer(refreshAt.Sub(mor.connConfig.Clock.Now()))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C():
+	}
+	mor.getLog().WithField("tokenProvider", mor.moqOriginData.TokenProvider.Type).Info("Auth token about to expire, reconnecting with a fresh one")
+	reconnectChannel <- true
+	mor.closeSession("Refreshing auth token")
+}
+
+// getAddresses Returns originaddress (resolved if DNS discovery) and the failover addresses ordered by priority
+func (mor *MoqOrigin) getAddresses(ctx context.Context) []MoqOriginAddress {
+	addresses := []MoqOriginAddress{{OriginAddress: mor.moqOriginData.OriginAddress, OriginCertPath: mor.moqOriginData.OriginCertPath, Priority: 0, CertData: mor.moqOriginData.CertData}}
+	if mor.moqOriginData.Discovery != MoqOriginDiscoveryNone {
+		discoveredAddresses, errResolve := resolveOriginAddress(ctx, mor.moqOriginData.Discovery, mor.moqOriginData.OriginAddress)
+		if errResolve != nil || len(discoveredAddresses) == 0 {
+			mor.getLog().WithFields(log.Fields{"address": mor.moqOriginData.OriginAddress, "discovery": mor.moqOriginData.Discovery}).WithError(errResolve).Error("Resolving origin address, using it as is")
+		} else {
+			for i := range discoveredAddresses {
+				discoveredAddresses[i].OriginCertPath = mor.moqOriginData.OriginCertPath
+				discoveredAddresses[i].CertData = mor.moqOriginData.CertData
+			}
+			addresses = discoveredAddresses
+		}
+	}
+	addresses = append(addresses, mor.moqOriginData.FailoverAddresses...)
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].Priority < addresses[j].Priority
+	})
+	return addresses
+}
+
+// processLazyClientSession Connects when there are subscribers waiting for this origin, disconnects when idle
+func (mor *MoqOrigin) processLazyClientSession(ctx context.Context, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects) {
+	for ctx.Err() == nil {
+		mor.setStatus(MoqOriginConnStatusIdle, nil)
+		select {
+		case <-ctx.Done():
+			return
+		case <-mor.demandChannel:
+		}
+		// Demand can be old (already served by a previous connection)
+		if moqtFwdTable.GetNamespaceDemand(mor.moqOriginData.TrackNamespace) <= 0 {
+			continue
+		}
+		mor.getLog().WithField("namespace", mor.moqOriginData.TrackNamespace).Info("Subscribers waiting, connecting on demand origin")
+		mor.warmPool.addUse(mor)
+
+		sessionCtx, sessionCancel := context.WithCancel(ctx)
+		go mor.closeWhenIdle(sessionCtx, sessionCancel, moqtFwdTable)
+		mor.processClientSession(sessionCtx, moqtFwdTable, objects)
+		sessionCancel()
+	}
+}
+
+// closeWhenIdle Closes the session after OriginLazyIdleTimeoutMs without subscriptions to this origin namespace, unless it gets a slot in the warm pool (then it is closed when the slot expires or it is taken by a more used origin)
+func (mor *MoqOrigin) closeWhenIdle(ctx context.Context, cancel context.CancelFunc, moqtFwdTable *moqfwdtable.MoqFwdTable) {
+	timeCh := mor.connConfig.Clock.NewTicker(LAZY_IDLE_CHECK_PERIOD_MS * time.Millisecond)
+	defer timeCh.Stop()
+	idleSince := mor.connConfig.Clock.Now()
+	warm := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			mor.warmPool.release(mor)
+			return
+		case tm := <-timeCh.C():
+			if moqtFwdTable.GetNamespaceDemand(mor.moqOriginData.TrackNamespace) > 0 {
+				idleSince = tm
+				if warm {
+					warm = false
+					mor.warmPool.release(mor)
+					mor.warmPool.addUse(mor)
+					mor.setStatus(MoqOriginConnStatusConnected, nil)
+					mor.getLog().WithField("namespace", mor.moqOriginData.TrackNamespace).Info("Subscribers back, using warm on demand origin")
+				}
+				continue
+			}
+			if warm {
+				if mor.warmPool.isWarm(mor) {
+					continue
+				}
+				mor.getLog().WithField("namespace", mor.moqOriginData.TrackNamespace).Info("Warm slot expired or taken, disconnecting on demand origin")
+				cancel()
+				mor.closeSession("Idle")
+				return
+			}
+			if tm.Sub(idleSince) < time.Duration(mor.connConfig.OriginLazyIdleTimeoutMs)*time.Millisecond {
+				continue
+			}
+			if mor.warmPool.acquire(mor) {
+				warm = true
+				mor.setStatus(MoqOriginConnStatusWarm, nil)
+				mor.getLog().WithField("namespace", mor.moqOriginData.TrackNamespace).Info("No subscriptions, keeping on demand origin warm")
+				continue
+			}
+			mor.getLog().WithFields(log.Fields{"namespace": mor.moqOriginData.TrackNamespace, "idleMs": mor.connConfig.OriginLazyIdleTimeoutMs}).Info("No subscriptions, disconnecting on demand origin")
+			cancel()
+			mor.closeSession("Idle")
+			return
+		}
+	}
+}
+
+func (mor *MoqOrigin) closeSession(reason string) {
+	mor.lock.RLock()
+	defer mor.lock.RUnlock()
+
+	if mor.session != nil {
+		mor.session.CloseWithError(0, reason)
+	}
+}
+
+// setSession Keeps the current session (to close it when idle / failing back), closes it if the context is already cancelled
+func (mor *MoqOrigin) setSession(ctx context.Context, session moqconnectionmanagment.MoqTransportSession, address string) {
+	mor.lock.Lock()
+	defer mor.lock.Unlock()
+
+	mor.session = session
+	mor.activeAddress = address
+	if session != nil && ctx.Err() != nil {
+		session.CloseWithError(0, "Idle")
+	}
+}
+
+// connectClient Connects to addr using WT (https://) or raw QUIC (moq://)
+func (mor *MoqOrigin) connectClient(ctx context.Context, addr string, cert []byte, serverName string) (session moqconnectionmanagment.MoqTransportSession, err error) {
+	if isRawQuicAddress(addr) {
+		return mor.connectClientRawQuic(ctx, addr, cert, serverName)
+	}
+	wtSession, errConn := mor.connectClientWT(ctx, addr, cert, serverName)
+	if errConn != nil {
+		err = errConn
+		return
+	}
+	session = wtSession
+	return
+}
+
+// probeClient Returns true if a session can be established with addr (that session is closed)
+func (mor *MoqOrigin) probeClient(ctx context.Context, addr string, cert []byte, serverName string) bool {
+	if isRawQuicAddress(addr) {
+		probeCtx, cancel := context.WithTimeout(ctx, FAILBACK_PROBE_TIMEOUT_MS*time.Millisecond)
+		defer cancel()
+		session, errDial := mor.connectClientRawQuic(probeCtx, addr, cert, serverName)
+		if errDial != nil {
+			return false
+		}
+		session.CloseWithError(0, "Probe")
+		return true
+	}
+	return mor.probeClientWT(ctx, addr, cert, serverName)
+}
+
+func (mor *MoqOrigin) connectClientWT(ctx context.Context, addr string, cert []byte, serverName string) (session *webtransport.Session, err error) {
+	d, roundTripper, errDialer := mor.createDialer(cert, serverName)
+	if errDialer != nil {
+		err = errDialer
+		return
+	}
+	mor.d = d
+	mor.roundTripper = roundTripper
 	_, session, err = mor.d.Dial(ctx, addr, nil)
 
 	return
 }
 
+// connectClientRawQuic Dials the MoqT endpoint directly over QUIC (moq://host:port/path)
+func (mor *MoqOrigin) connectClientRawQuic(ctx context.Context, addr string, cert []byte, serverName string) (session moqconnectionmanagment.MoqTransportSession, err error) {
+	addrUrl, errParse := url.Parse(addr)
+	if errParse != nil {
+		err = errParse
+		return
+	}
+	tlsConfig, errTls := mor.createTLSConfig(cert, serverName)
+	if errTls != nil {
+		err = errTls
+		return
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.NextProtos = []string{moqrawquic.MOQT_ALPN}
+	host := addrUrl.Host
+	if addrUrl.Port() == "" {
+		host = net.JoinHostPort(addrUrl.Hostname(), RAW_QUIC_DEFAULT_PORT)
+	}
+	conn, errDial := quic.DialAddr(ctx, host, tlsConfig, &quic.Config{Tracer: mor.connConfig.QuicStats.GetTracer()})
+	if errDial != nil {
+		err = errDial
+		return
+	}
+	session = moqrawquic.New(conn)
+	return
+}
+
+// probeClientWT Returns true if a WT session can be established with addr (that session is closed)
+func (mor *MoqOrigin) probeClientWT(ctx context.Context, addr string, cert []byte, serverName string) bool {
+	d, roundTripper, errDialer := mor.createDialer(cert, serverName)
+	if errDialer != nil {
+		return false
+	}
+	defer d.Close()
+	if roundTripper != nil {
+		defer roundTripper.Close()
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, FAILBACK_PROBE_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+	_, session, errDial := d.Dial(probeCtx, addr, nil)
+	if errDial != nil {
+		return false
+	}
+	session.CloseWithError(0, "Probe")
+	return true
+}
+
+func (mor *MoqOrigin) createDialer(cert []byte, serverName string) (d *webtransport.Dialer, roundTripper *http3.RoundTripper, err error) {
+	d = &webtransport.Dialer{}
+	tlsConfig, errTls := mor.createTLSConfig(cert, serverName)
+	if errTls != nil {
+		err = errTls
+		return
+	}
+	roundTripper = &http3.RoundTripper{
+		TLSClientConfig: tlsConfig,
+		QuicConfig:      &quic.Config{Tracer: mor.connConfig.QuicStats.GetTracer()},
+	}
+	d.RoundTripper = roundTripper
+	return
+}
+
+// createTLSConfig Returns the TLS config for the origin custom cert / server name / client cert (nil if none is needed)
+func (mor *MoqOrigin) createTLSConfig(cert []byte, serverName string) (tlsConfig *tls.Config, err error) {
+	hasClientCert := mor.moqOriginData.ClientCertData != nil && mor.moqOriginData.ClientKeyData != nil
+	if cert != nil || serverName != "" || hasClientCert {
+		var clientCerts []tls.Certificate = nil
+		if hasClientCert {
+			clientCert, errClientCert := tls.X509KeyPair(mor.moqOriginData.ClientCertData, mor.moqOriginData.ClientKeyData)
+			if errClientCert != nil {
+				mor.getLog().WithError(errClientCert).Error("Loading client cert / key")
+				err = errClientCert
+				return
+			}
+			clientCerts = []tls.Certificate{clientCert}
+		}
+		var pool *x509.CertPool = nil
+		if cert != nil {
+			var errPool error
+			pool, errPool = x509.SystemCertPool()
+			if errPool != nil {
+				mor.getLog().WithError(errPool).Error("Loading local cert pool")
+				err = errPool
+				return
+			}
+			pool.AppendCertsFromPEM(cert)
+		}
+
+		tlsConfig = &tls.Config{
+			RootCAs:            pool,
+			ServerName:         serverName,
+			Certificates:       clientCerts,
+			InsecureSkipVerify: false,
+		}
+	}
+	return
+}
+
 // Helpers
 
-func sleepWithContext(ctx context.Context, d time.Duration) error {
-	t := time.NewTimer(d)
+// isRawQuicAddress Returns true if addr is a raw QUIC MoqT endpoint (moq:// scheme)
+func isRawQuicAddress(addr string) bool {
+	addrUrl, errParse := url.Parse(addr)
+	return errParse == nil && addrUrl.Scheme == moqrawquic.MOQT_URL_SCHEME
+}
+
+// getRawQuicPath Returns the path to send in the client SETUP of raw QUIC endpoints (empty for WT)
+func getRawQuicPath(addr string) string {
+	addrUrl, errParse := url.Parse(addr)
+	if errParse != nil || addrUrl.Scheme != moqrawquic.MOQT_URL_SCHEME {
+		return ""
+	}
+	return addrUrl.RequestURI()
+}
+
+// IsValidOriginDiscovery Returns true if discovery is a known origin discovery mode
+func IsValidOriginDiscovery(discovery MoqOriginDiscovery) bool {
+	return discovery == MoqOriginDiscoveryNone || discovery == MoqOriginDiscoverySrv || discovery == MoqOriginDiscoveryA
+}
+
+// resolveOriginAddress Returns the endpoints of originAddress in the order they should be tried (load balanced)
+func resolveOriginAddress(ctx context.Context, discovery MoqOriginDiscovery, originAddress string) (addresses []MoqOriginAddress, err error) {
+	originUrl, errParse := url.Parse(originAddress)
+	if errParse != nil {
+		err = errParse
+		return
+	}
+
+	if discovery == MoqOriginDiscoverySrv {
+		_, srvs, errLookup := net.DefaultResolver.LookupSRV(ctx, "", "", originUrl.Hostname())
+		if errLookup != nil {
+			err = errLookup
+			return
+		}
+		// Lowest priority first, weighted random inside the same priority (RFC 2782)
+		sort.SliceStable(srvs, func(i, j int) bool {
+			return srvs[i].Priority < srvs[j].Priority
+		})
+		for len(srvs) > 0 {
+			samePriority := 1
+			totalWeight := int(srvs[0].Weight)
+			for samePriority < len(srvs) && srvs[samePriority].Priority == srvs[0].Priority {
+				totalWeight += int(srvs[samePriority].Weight)
+				samePriority++
+			}
+			selected := 0
+			r := rand.Intn(totalWeight + 1)
+			for i := 0; i < samePriority; i++ {
+				r -= int(srvs[i].Weight)
+				if r <= 0 {
+					selected = i
+					break
+				}
+			}
+			srv := srvs[selected]
+			srvs = slices.Delete(srvs, selected, selected+1)
+
+			endpointUrl := *originUrl
+			endpointUrl.Host = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprintf("%d", srv.Port))
+			addresses = append(addresses, MoqOriginAddress{OriginAddress: endpointUrl.String()})
+		}
+		return
+	}
+
+	ips, errLookup := net.DefaultResolver.LookupHost(ctx, originUrl.Hostname())
+	if errLookup != nil {
+		err = errLookup
+		return
+	}
+	rand.Shuffle(len(ips), func(i, j int) {
+		ips[i], ips[j] = ips[j], ips[i]
+	})
+	for _, ip := range ips {
+		endpointUrl := *originUrl
+		if originUrl.Port() != "" {
+			endpointUrl.Host = net.JoinHostPort(ip, originUrl.Port())
+		} else if strings.Contains(ip, ":") {
+			endpointUrl.Host = "[" + ip + "]"
+		} else {
+			endpointUrl.Host = ip
+		}
+		// Cert is validated against the original host
+		addresses = append(addresses, MoqOriginAddress{OriginAddress: endpointUrl.String(), serverName: originUrl.Hostname()})
+	}
+	return
+}
+
+func sleepWithContext(ctx context.Context, clock moqclock.Clock, d time.Duration) error {
+	t := clock.NewTimer(d)
 	select {
 	case <-ctx.Done():
 		t.Stop()
 		return fmt.Errorf("Interrupted")
-	case <-t.C:
+	case <-t.C():
 	}
 	return nil
 }
@@ -0,0 +1,76 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqorigins
+
+import (
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"fmt"
+)
+
+// Max parallel sessions to the same origin
+const MAX_ORIGIN_POOL_SESSIONS = 16
+
+// moqOriginPool Parallel sessions to the same origin, the forward table shards the tracks across them (balancing new upstream subscriptions)
+type moqOriginPool struct {
+	members []*MoqOrigin
+}
+
+// newOriginPool Creates the origin sessions (moqOriginData.Sessions, push origins only use 1)
+func newOriginPool(moqOriginData MoqOriginData, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig moqconnectionmanagment.MoqConnectionConfig, warmPool *moqOriginWarmPool) *moqOriginPool {
+	sessions := moqOriginData.Sessions
+	if sessions < 1 || moqOriginData.Push {
+		sessions = 1
+	} else if sessions > MAX_ORIGIN_POOL_SESSIONS {
+		sessions = MAX_ORIGIN_POOL_SESSIONS
+	}
+
+	token := newOriginToken(moqOriginData.TokenProvider, moqOriginData.AuthInfo, connConfig.Clock)
+	pool := moqOriginPool{}
+	if sessions == 1 {
+		pool.members = append(pool.members, newOrigin(moqOriginData, token, moqtFwdTable, objects, connConfig, warmPool))
+		return &pool
+	}
+
+	connConfig.OriginPool = moqOriginData.Guid
+	for i := 0; i < sessions; i++ {
+		memberData := moqOriginData
+		memberData.FriendlyName = fmt.Sprintf("%s-%d", moqOriginData.FriendlyName, i)
+		pool.members = append(pool.members, newOrigin(memberData, token, moqtFwdTable, objects, connConfig, warmPool))
+	}
+	return &pool
+}
+
+func (pool *moqOriginPool) Close() {
+	for _, member := range pool.members {
+		member.Close()
+	}
+}
+
+// Demand Connects the pool sessions (on demand origins)
+func (pool *moqOriginPool) Demand() {
+	for _, member := range pool.members {
+		member.Demand()
+	}
+}
+
+// GetMetrics Returns the counters of every session of the pool
+func (pool *moqOriginPool) GetMetrics() (metrics []MoqOriginMetrics) {
+	for _, member := range pool.members {
+		metrics = append(metrics, member.GetMetrics())
+	}
+	return
+}
+
+// GetStatus Returns the connection status of every session of the pool
+func (pool *moqOriginPool) GetStatus() (status []MoqOriginStatus) {
+	for _, member := range pool.members {
+		status = append(status, member.GetStatus())
+	}
+	return
+}
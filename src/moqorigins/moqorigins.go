@@ -7,8 +7,17 @@ LICENSE file in the root directory of this source tree.
 package moqorigins
 
 import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
 	"facebookexperimental/moq-go-server/moqfwdtable"
 	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type MoqOriginsData struct {
@@ -17,30 +26,223 @@ type MoqOriginsData struct {
 
 type MoqOrigins struct {
 	moqOriginsInfo []moqOriginExt
+
+	// Used to create origins (initialize / update)
+	moqtFwdTable *moqfwdtable.MoqFwdTable
+	objects      *moqmessageobjects.MoqMessageObjects
+	connConfig   moqconnectionmanagment.MoqConnectionConfig
+	// Idle on demand sessions kept connected (nil disabled)
+	warmPool *moqOriginWarmPool
+
+	lock *sync.Mutex
 }
 
 // New Creates a new moq origins list
 func New() *MoqOrigins {
-	mos := MoqOrigins{}
+	mos := MoqOrigins{lock: new(sync.Mutex)}
 	return &mos
 }
 
-func (mors *MoqOrigins) Initialize(moqOriginsData MoqOriginsData, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) (err error) {
+func (mors *MoqOrigins) Initialize(moqOriginsData MoqOriginsData, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig moqconnectionmanagment.MoqConnectionConfig) (err error) {
+	// Subscribes with no publishers connect the on demand origins
+	moqtFwdTable.SetOnSubscribeDemand(mors.subscribeDemand)
+
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
+	mors.moqtFwdTable = moqtFwdTable
+	mors.objects = objects
+	mors.connConfig = connConfig
+	mors.warmPool = newOriginWarmPool(connConfig.OriginWarmPoolSize, connConfig.OriginWarmPoolTtlMs, connConfig.Clock)
+	for _, moqOriginData := range moqOriginsData.MoqOrigins {
+		pool := newOriginPool(moqOriginData, moqtFwdTable, objects, connConfig, mors.warmPool)
+		mors.moqOriginsInfo = append(mors.moqOriginsInfo, moqOriginExt{moqOriginData, pool})
+	}
+	return
+}
+
+// Update Applies a new origins list (by guid): closes the removed origins, starts the added ones and restarts the changed ones
+func (mors *MoqOrigins) Update(moqOriginsData MoqOriginsData) (added int, removed int, changed int) {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
+	newOriginsData := map[string]MoqOriginData{}
+	for _, moqOriginData := range moqOriginsData.MoqOrigins {
+		newOriginsData[moqOriginData.Guid] = moqOriginData
+	}
+
+	moqOriginsInfo := []moqOriginExt{}
+	currentGuids := map[string]bool{}
+	for _, moqOrExt := range mors.moqOriginsInfo {
+		currentGuids[moqOrExt.Guid] = true
+		newOriginData, found := newOriginsData[moqOrExt.Guid]
+		if found && reflect.DeepEqual(newOriginData, moqOrExt.MoqOriginData) {
+			moqOriginsInfo = append(moqOriginsInfo, moqOrExt)
+			continue
+		}
+		moqOrExt.moqOriginPool.Close()
+		if !found {
+			log.Info(fmt.Sprintf("%s - Removed origin %s", moqOrExt.FriendlyName, moqOrExt.Guid))
+			removed++
+			continue
+		}
+		log.Info(fmt.Sprintf("%s - Changed origin %s, restarting it", newOriginData.FriendlyName, newOriginData.Guid))
+		pool := newOriginPool(newOriginData, mors.moqtFwdTable, mors.objects, mors.connConfig, mors.warmPool)
+		moqOriginsInfo = append(moqOriginsInfo, moqOriginExt{newOriginData, pool})
+		changed++
+	}
 	for _, moqOriginData := range moqOriginsData.MoqOrigins {
-		or := newOrigin(moqOriginData, moqtFwdTable, objects, objExpMs)
-		mors.moqOriginsInfo = append(mors.moqOriginsInfo, moqOriginExt{moqOriginData, or})
+		if currentGuids[moqOriginData.Guid] {
+			continue
+		}
+		log.Info(fmt.Sprintf("%s - Added origin %s", moqOriginData.FriendlyName, moqOriginData.Guid))
+		pool := newOriginPool(moqOriginData, mors.moqtFwdTable, mors.objects, mors.connConfig, mors.warmPool)
+		moqOriginsInfo = append(moqOriginsInfo, moqOriginExt{moqOriginData, pool})
+		currentGuids[moqOriginData.Guid] = true
+		added++
+	}
+	mors.moqOriginsInfo = moqOriginsInfo
+	return
+}
+
+// Add Creates a new origin (connection starts in background)
+func (mors *MoqOrigins) Add(moqOriginData MoqOriginData) (status []MoqOriginStatus, err error) {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
+	if moqOriginData.Guid == "" || moqOriginData.OriginAddress == "" || moqOriginData.TrackNamespace == "" {
+		err = errors.New("Origin needs guid, originaddress and tracknamespace")
+		return
+	}
+	if !IsValidOriginDiscovery(moqOriginData.Discovery) {
+		err = errors.New(fmt.Sprintf("Origin %s has an invalid discovery %s", moqOriginData.Guid, moqOriginData.Discovery))
+		return
+	}
+	errTokenProvider := IsValidOriginTokenProvider(moqOriginData.TokenProvider)
+	if errTokenProvider != nil {
+		err = errors.New(fmt.Sprintf("Origin %s: %v", moqOriginData.Guid, errTokenProvider))
+		return
+	}
+	if (moqOriginData.ClientCertData == nil) != (moqOriginData.ClientKeyData == nil) {
+		err = errors.New(fmt.Sprintf("Origin %s needs both client cert and key", moqOriginData.Guid))
+		return
+	}
+	for _, failoverAddress := range moqOriginData.FailoverAddresses {
+		if failoverAddress.OriginAddress == "" {
+			err = errors.New("Origin failover addresses need originaddress")
+			return
+		}
+	}
+	for _, moqOrExt := range mors.moqOriginsInfo {
+		if moqOrExt.Guid == moqOriginData.Guid {
+			err = errors.New(fmt.Sprintf("Origin %s already exists", moqOriginData.Guid))
+			return
+		}
+	}
+	log.Info(fmt.Sprintf("%s - Added origin %s", moqOriginData.FriendlyName, moqOriginData.Guid))
+	pool := newOriginPool(moqOriginData, mors.moqtFwdTable, mors.objects, mors.connConfig, mors.warmPool)
+	mors.moqOriginsInfo = append(mors.moqOriginsInfo, moqOriginExt{moqOriginData, pool})
+	status = pool.GetStatus()
+	return
+}
+
+// Remove Closes an origin, returns its last status
+func (mors *MoqOrigins) Remove(guid string) (status []MoqOriginStatus, found bool) {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
+	for i, moqOrExt := range mors.moqOriginsInfo {
+		if moqOrExt.Guid == guid {
+			log.Info(fmt.Sprintf("%s - Removed origin %s", moqOrExt.FriendlyName, moqOrExt.Guid))
+			moqOrExt.moqOriginPool.Close()
+			mors.moqOriginsInfo = append(mors.moqOriginsInfo[:i], mors.moqOriginsInfo[i+1:]...)
+			status = moqOrExt.moqOriginPool.GetStatus()
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// GetStatus Returns the connection status of all origins
+func (mors *MoqOrigins) GetStatus() []MoqOriginStatus {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
+	ret := []MoqOriginStatus{}
+	for _, moqOrExt := range mors.moqOriginsInfo {
+		ret = append(ret, moqOrExt.moqOriginPool.GetStatus()...)
+	}
+	return ret
+}
+
+// GetMetrics Returns the counters of all origins
+func (mors *MoqOrigins) GetMetrics() []MoqOriginMetrics {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
+	ret := []MoqOriginMetrics{}
+	for _, moqOrExt := range mors.moqOriginsInfo {
+		ret = append(ret, moqOrExt.moqOriginPool.GetMetrics()...)
+	}
+	return ret
+}
+
+// CheckHealth Returns an error if any origin has no connected session (on demand origins waiting for subscribers are fine)
+func (mors *MoqOrigins) CheckHealth() (err error) {
+	// Pools have a status per session, one connected is enough
+	healthy := map[string]bool{}
+	friendlyNames := map[string]string{}
+	for _, status := range mors.GetStatus() {
+		healthy[status.Guid] = healthy[status.Guid] || status.Status == MoqOriginConnStatusConnected || status.Status == MoqOriginConnStatusWarm || status.Status == MoqOriginConnStatusIdle
+		friendlyNames[status.Guid] = status.FriendlyName
+	}
+	unhealthy := []string{}
+	for guid, isHealthy := range healthy {
+		if !isHealthy {
+			unhealthy = append(unhealthy, friendlyNames[guid])
+		}
+	}
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		err = errors.New(fmt.Sprintf("Origins NOT connected: %s", strings.Join(unhealthy, ", ")))
+	}
+	return
+}
+
+// Demand Connects the on demand origins of that namespace (ex: its subscriptions moved to a new origin, they are resubscribed when it connects), returns true if any
+func (mors *MoqOrigins) Demand(trackNamespace string) bool {
+	return mors.subscribeDemand(trackNamespace)
+}
+
+// subscribeDemand Connects the on demand origins of that namespace, returns true if any
+func (mors *MoqOrigins) subscribeDemand(trackNamespace string) (found bool) {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
+	for _, moqOrExt := range mors.moqOriginsInfo {
+		if moqOrExt.Lazy && !moqOrExt.Push && moqfwdtable.MatchesNamespace(moqOrExt.TrackNamespace, trackNamespace) {
+			moqOrExt.moqOriginPool.Demand()
+			found = true
+		}
 	}
 	return
 }
 
 func (mors *MoqOrigins) Close() (err error) {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
 	for _, moqOrExt := range mors.moqOriginsInfo {
-		moqOrExt.moqOriginPtr.Close()
+		moqOrExt.moqOriginPool.Close()
 	}
 	return
 }
 
 func (mors *MoqOrigins) ToString() string {
+	mors.lock.Lock()
+	defer mors.lock.Unlock()
+
 	str := ""
 	for i, moqOrExt := range mors.moqOriginsInfo {
 		if i > 0 {
@@ -0,0 +1,227 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqorigins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetime of file / exec tokens (they are read again after it)
+const TOKEN_DEFAULT_REFRESH_MS = 5 * 60 * 1000
+
+// Tokens are refreshed this time before they expire (or at half of their lifetime if it is shorter)
+const TOKEN_REFRESH_MARGIN_MS = 30 * 1000
+
+// Max time to get a token (exec / oauth)
+const TOKEN_FETCH_TIMEOUT_MS = 10 * 1000
+
+// Max size of a token response
+const TOKEN_MAX_SIZE_BYTES = 64 * 1024
+
+// Where the origin auth info comes from
+type MoqOriginTokenProviderType string
+
+const (
+	// authinfo is used as is (default)
+	MoqOriginTokenProviderStatic MoqOriginTokenProviderType = "static"
+	// Content of a file (ex: rotated by an external agent)
+	MoqOriginTokenProviderFile MoqOriginTokenProviderType = "file"
+	// Stdout of a command
+	MoqOriginTokenProviderExec MoqOriginTokenProviderType = "exec"
+	// OAuth 2.0 client credentials grant, access_token is used
+	MoqOriginTokenProviderOAuth MoqOriginTokenProviderType = "oauth"
+)
+
+type MoqOriginTokenProvider struct {
+	Type MoqOriginTokenProviderType `json:"type"`
+	// file
+	Path string `json:"path"`
+	// exec (program and args)
+	Command []string `json:"command"`
+	// oauth
+	TokenUrl     string `json:"tokenurl"`
+	ClientId     string `json:"clientid"`
+	ClientSecret string `json:"clientsecret"`
+	Scope        string `json:"scope"`
+	// Lifetime of file / exec tokens, and of oauth tokens with no expires_in (default TOKEN_DEFAULT_REFRESH_MS)
+	RefreshMs int64 `json:"refreshms"`
+}
+
+// moqOriginToken Caches the auth info of an origin until it needs to be refreshed (shared by the pool sessions)
+type moqOriginToken struct {
+	provider MoqOriginTokenProvider
+	authInfo string
+	clock    moqclock.Clock
+
+	// Protected
+	token     string
+	refreshAt time.Time
+	lock      *sync.Mutex
+}
+
+// IsValidOriginTokenProvider Checks the provider type and that it has the needed fields
+func IsValidOriginTokenProvider(provider MoqOriginTokenProvider) (err error) {
+	switch provider.Type {
+	case "", MoqOriginTokenProviderStatic:
+	case MoqOriginTokenProviderFile:
+		if provider.Path == "" {
+			err = errors.New("File token provider needs path")
+		}
+	case MoqOriginTokenProviderExec:
+		if len(provider.Command) == 0 || provider.Command[0] == "" {
+			err = errors.New("Exec token provider needs command")
+		}
+	case MoqOriginTokenProviderOAuth:
+		if provider.TokenUrl == "" || provider.ClientId == "" {
+			err = errors.New("OAuth token provider needs tokenurl and clientid")
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Invalid token provider type %s", provider.Type))
+	}
+	return
+}
+
+func newOriginToken(provider MoqOriginTokenProvider, authInfo string, clock moqclock.Clock) *moqOriginToken {
+	return &moqOriginToken{provider: provider, authInfo: authInfo, clock: clock, lock: new(sync.Mutex)}
+}
+
+// Get Returns the current token (fetching a new one if needed) and when it needs to be refreshed (zero if never)
+func (t *moqOriginToken) Get(ctx context.Context) (token string, refreshAt time.Time, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.clock.Now()
+	if t.token != "" && (t.refreshAt.IsZero() || now.Before(t.refreshAt)) {
+		return t.token, t.refreshAt, nil
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, TOKEN_FETCH_TIMEOUT_MS*time.Millisecond)
+	defer cancel()
+
+	lifetime := time.Duration(0)
+	switch t.provider.Type {
+	case MoqOriginTokenProviderFile:
+		token, err = t.fetchFile()
+		lifetime = t.getDefaultLifetime()
+	case MoqOriginTokenProviderExec:
+		token, err = t.fetchExec(fetchCtx)
+		lifetime = t.getDefaultLifetime()
+	case MoqOriginTokenProviderOAuth:
+		token, lifetime, err = t.fetchOAuth(fetchCtx)
+	default:
+		token = t.authInfo
+	}
+	if err != nil {
+		return
+	}
+	if token == "" && t.provider.Type != "" && t.provider.Type != MoqOriginTokenProviderStatic {
+		err = errors.New(fmt.Sprintf("Empty token from %s provider", t.provider.Type))
+		return
+	}
+
+	refreshAt = time.Time{}
+	if lifetime > 0 {
+		margin := TOKEN_REFRESH_MARGIN_MS * time.Millisecond
+		if margin > lifetime/2 {
+			margin = lifetime / 2
+		}
+		refreshAt = now.Add(lifetime - margin)
+	}
+	t.token = token
+	t.refreshAt = refreshAt
+	return
+}
+
+func (t *moqOriginToken) getDefaultLifetime() time.Duration {
+	if t.provider.RefreshMs > 0 {
+		return time.Duration(t.provider.RefreshMs) * time.Millisecond
+	}
+	return TOKEN_DEFAULT_REFRESH_MS * time.Millisecond
+}
+
+func (t *moqOriginToken) fetchFile() (token string, err error) {
+	data, errRead := os.ReadFile(t.provider.Path)
+	if errRead != nil {
+		err = errors.New(fmt.Sprintf("Reading token file %s. Err: %v", t.provider.Path, errRead))
+		return
+	}
+	token = strings.TrimSpace(string(data))
+	return
+}
+
+func (t *moqOriginToken) fetchExec(ctx context.Context) (token string, err error) {
+	cmd := exec.CommandContext(ctx, t.provider.Command[0], t.provider.Command[1:]...)
+	out, errExec := cmd.Output()
+	if errExec != nil {
+		err = errors.New(fmt.Sprintf("Executing token command %s. Err: %v", t.provider.Command[0], errExec))
+		return
+	}
+	token = strings.TrimSpace(string(out))
+	return
+}
+
+func (t *moqOriginToken) fetchOAuth(ctx context.Context) (token string, lifetime time.Duration, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", t.provider.ClientId)
+	form.Set("client_secret", t.provider.ClientSecret)
+	if t.provider.Scope != "" {
+		form.Set("scope", t.provider.Scope)
+	}
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodPost, t.provider.TokenUrl, strings.NewReader(form.Encode()))
+	if errReq != nil {
+		err = errReq
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, errResp := http.DefaultClient.Do(req)
+	if errResp != nil {
+		err = errors.New(fmt.Sprintf("Requesting OAuth token to %s. Err: %v", t.provider.TokenUrl, errResp))
+		return
+	}
+	defer resp.Body.Close()
+
+	body, errBody := io.ReadAll(io.LimitReader(resp.Body, TOKEN_MAX_SIZE_BYTES))
+	if errBody != nil {
+		err = errors.New(fmt.Sprintf("Reading OAuth token response from %s. Err: %v", t.provider.TokenUrl, errBody))
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(fmt.Sprintf("OAuth token request to %s returned %d", t.provider.TokenUrl, resp.StatusCode))
+		return
+	}
+	tokenResp := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	errJson := json.Unmarshal(body, &tokenResp)
+	if errJson != nil {
+		err = errors.New(fmt.Sprintf("Parsing OAuth token response from %s. Err: %v", t.provider.TokenUrl, errJson))
+		return
+	}
+	token = tokenResp.AccessToken
+	if tokenResp.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResp.ExpiresIn) * time.Second
+	} else {
+		lifetime = t.getDefaultLifetime()
+	}
+	return
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqorigins
+
+import (
+	"facebookexperimental/moq-go-server/moqclock"
+	"sync"
+	"time"
+)
+
+// moqOriginWarmPool Idle on demand origin sessions kept connected (up to size, for ttl), the most used origins keep their slot so their next SUBSCRIBE does NOT wait for the handshake
+type moqOriginWarmPool struct {
+	size int
+	ttl  time.Duration
+
+	// On demand connections (and warm sessions used again) per origin session
+	uses map[*MoqOrigin]uint64
+	// Warm sessions, origin session -> warm since
+	warm map[*MoqOrigin]time.Time
+
+	clock moqclock.Clock
+	lock  *sync.Mutex
+}
+
+// newOriginWarmPool Returns nil (disabled) if size is 0
+func newOriginWarmPool(size int, ttlMs uint64, clock moqclock.Clock) *moqOriginWarmPool {
+	if size <= 0 {
+		return nil
+	}
+	return &moqOriginWarmPool{size: size, ttl: time.Duration(ttlMs) * time.Millisecond, uses: map[*MoqOrigin]uint64{}, warm: map[*MoqOrigin]time.Time{}, clock: clock, lock: new(sync.Mutex)}
+}
+
+// addUse Counts a use of the origin session (connected on demand / warm session used again)
+func (wp *moqOriginWarmPool) addUse(mor *MoqOrigin) {
+	if wp == nil {
+		return
+	}
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	wp.uses[mor]++
+}
+
+// acquire Returns true if the idle session can be kept warm, when the pool is full it takes the slot of the least used warm session (if it is used less than this one)
+func (wp *moqOriginWarmPool) acquire(mor *MoqOrigin) bool {
+	if wp == nil {
+		return false
+	}
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	if _, found := wp.warm[mor]; found {
+		return true
+	}
+	if len(wp.warm) >= wp.size {
+		var leastUsed *MoqOrigin
+		for warmOrigin := range wp.warm {
+			if leastUsed == nil || wp.uses[warmOrigin] < wp.uses[leastUsed] {
+				leastUsed = warmOrigin
+			}
+		}
+		if wp.uses[leastUsed] >= wp.uses[mor] {
+			return false
+		}
+		// That session closes on its next idle check
+		delete(wp.warm, leastUsed)
+	}
+	wp.warm[mor] = wp.clock.Now()
+	return true
+}
+
+// isWarm Returns true if the session still has its slot and it is NOT older than the TTL (if not it frees the slot)
+func (wp *moqOriginWarmPool) isWarm(mor *MoqOrigin) bool {
+	if wp == nil {
+		return false
+	}
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	warmSince, found := wp.warm[mor]
+	if !found {
+		return false
+	}
+	if wp.clock.Now().Sub(warmSince) >= wp.ttl {
+		delete(wp.warm, mor)
+		return false
+	}
+	return true
+}
+
+// release Frees the slot of the session (used again or closed)
+func (wp *moqOriginWarmPool) release(mor *MoqOrigin) {
+	if wp == nil {
+		return
+	}
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	delete(wp.warm, mor)
+}
+
+// remove Forgets the origin session (origin removed)
+func (wp *moqOriginWarmPool) remove(mor *MoqOrigin) {
+	if wp == nil {
+		return
+	}
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	delete(wp.warm, mor)
+	delete(wp.uses, mor)
+}
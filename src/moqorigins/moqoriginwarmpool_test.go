@@ -0,0 +1,105 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqorigins
+
+import (
+	"facebookexperimental/moq-go-server/moqclock"
+	"testing"
+	"time"
+)
+
+func TestWarmPoolDisabled(t *testing.T) {
+	wp := newOriginWarmPool(0, 1000, moqclock.NewFake(time.Unix(0, 0)))
+	if wp != nil {
+		t.Fatalf("size 0 should disable the warm pool")
+	}
+	mor := &MoqOrigin{}
+	wp.addUse(mor)
+	if wp.acquire(mor) || wp.isWarm(mor) {
+		t.Fatalf("disabled warm pool should NOT keep sessions warm")
+	}
+}
+
+func TestWarmPoolMostUsedKeepSlot(t *testing.T) {
+	tests := []struct {
+		name string
+		// Uses of the warm session and of the new idle one
+		warmUses      int
+		candidateUses int
+		// Candidate gets the slot (and the warm one loses it)
+		wantCandidate bool
+	}{
+		{name: "candidate used more takes the slot", warmUses: 1, candidateUses: 2, wantCandidate: true},
+		{name: "candidate used the same does NOT", warmUses: 2, candidateUses: 2, wantCandidate: false},
+		{name: "candidate used less does NOT", warmUses: 3, candidateUses: 1, wantCandidate: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wp := newOriginWarmPool(1, 60000, moqclock.NewFake(time.Unix(0, 0)))
+			warm := &MoqOrigin{}
+			candidate := &MoqOrigin{}
+			for i := 0; i < tt.warmUses; i++ {
+				wp.addUse(warm)
+			}
+			for i := 0; i < tt.candidateUses; i++ {
+				wp.addUse(candidate)
+			}
+			if !wp.acquire(warm) {
+				t.Fatalf("first session should get the free slot")
+			}
+
+			if got := wp.acquire(candidate); got != tt.wantCandidate {
+				t.Fatalf("acquire candidate = %t, want %t", got, tt.wantCandidate)
+			}
+			if got := wp.isWarm(warm); got == tt.wantCandidate {
+				t.Fatalf("isWarm previous session = %t, want %t", got, !tt.wantCandidate)
+			}
+		})
+	}
+}
+
+func TestWarmPoolTtl(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	wp := newOriginWarmPool(1, 1000, clock)
+	mor := &MoqOrigin{}
+
+	if !wp.acquire(mor) {
+		t.Fatalf("session should get the free slot")
+	}
+	clock.Advance(999 * time.Millisecond)
+	if !wp.isWarm(mor) {
+		t.Fatalf("session should be warm before the TTL")
+	}
+	clock.Advance(time.Millisecond)
+	if wp.isWarm(mor) {
+		t.Fatalf("session should NOT be warm after the TTL")
+	}
+	// Slot is free again
+	if !wp.acquire(&MoqOrigin{}) {
+		t.Fatalf("expired slot should be available")
+	}
+}
+
+func TestWarmPoolRelease(t *testing.T) {
+	wp := newOriginWarmPool(1, 60000, moqclock.NewFake(time.Unix(0, 0)))
+	used := &MoqOrigin{}
+	other := &MoqOrigin{}
+
+	wp.acquire(used)
+	// Subscribers back
+	wp.release(used)
+	if wp.isWarm(used) {
+		t.Fatalf("released session should NOT be warm")
+	}
+	if !wp.acquire(other) {
+		t.Fatalf("released slot should be available")
+	}
+	wp.remove(other)
+	if wp.isWarm(other) {
+		t.Fatalf("removed session should NOT be warm")
+	}
+}
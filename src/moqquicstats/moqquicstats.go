@@ -0,0 +1,223 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqquicstats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// MoqQuicConnStatsInfo Transport stats of a QUIC connection (WebTransport sessions share the connection ones)
+type MoqQuicConnStatsInfo struct {
+	SmoothedRttMs    float64 `json:"smoothedRttMs"`
+	MinRttMs         float64 `json:"minRttMs"`
+	LatestRttMs      float64 `json:"latestRttMs"`
+	RttVarMs         float64 `json:"rttVarMs"`
+	CongestionWindow uint64  `json:"congestionWindow"`
+	BytesInFlight    uint64  `json:"bytesInFlight"`
+	PacketsInFlight  int     `json:"packetsInFlight"`
+	CongestionState  string  `json:"congestionState"`
+	PacketsSent      uint64  `json:"packetsSent"`
+	PacketsReceived  uint64  `json:"packetsReceived"`
+	BytesSent        uint64  `json:"bytesSent"`
+	BytesReceived    uint64  `json:"bytesReceived"`
+	PacketsLost      uint64  `json:"packetsLost"`
+	PacketsDropped   uint64  `json:"packetsDropped"`
+	// MOQ session streams (opened by the relay, accepted from the peer, currently open)
+	StreamsOpened   uint64 `json:"streamsOpened"`
+	StreamsAccepted uint64 `json:"streamsAccepted"`
+	StreamsActive   int64  `json:"streamsActive"`
+}
+
+// MoqQuicConnStats Transport stats of a QUIC connection, updated by its tracer (nil disabled)
+type MoqQuicConnStats struct {
+	// Protected
+	info MoqQuicConnStatsInfo
+	lock *sync.Mutex
+}
+
+// MoqQuicStats Keeps the stats of the open QUIC connections, indexed by tracing ID (nil disabled)
+type MoqQuicStats struct {
+	// Protected
+	conns map[uint64]*MoqQuicConnStats
+	lock  *sync.RWMutex
+}
+
+// New Creates the QUIC connections stats registry
+func New() *MoqQuicStats {
+	return &MoqQuicStats{conns: map[uint64]*MoqQuicConnStats{}, lock: new(sync.RWMutex)}
+}
+
+// GetTracer Returns the function to set as quic.Config Tracer (nil if disabled)
+func (qs *MoqQuicStats) GetTracer() func(ctx context.Context, perspective logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+	if qs == nil {
+		return nil
+	}
+	return qs.newConnectionTracer
+}
+
+// Get Returns the stats of the QUIC connection of this context (ex: WebTransport session context), nil if not found
+func (qs *MoqQuicStats) Get(ctx context.Context) *MoqQuicConnStats {
+	if qs == nil {
+		return nil
+	}
+	tracingId, found := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !found {
+		return nil
+	}
+	qs.lock.RLock()
+	defer qs.lock.RUnlock()
+
+	return qs.conns[tracingId]
+}
+
+// Count Returns the number of tracked QUIC connections
+func (qs *MoqQuicStats) Count() int {
+	if qs == nil {
+		return 0
+	}
+	qs.lock.RLock()
+	defer qs.lock.RUnlock()
+
+	return len(qs.conns)
+}
+
+// GetInfo Returns a copy of the current stats
+func (cs *MoqQuicConnStats) GetInfo() (info MoqQuicConnStatsInfo) {
+	if cs == nil {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	return cs.info
+}
+
+// StreamOpened Counts a stream opened by the relay (isIncoming false) or accepted from the peer
+func (cs *MoqQuicConnStats) StreamOpened(isIncoming bool) {
+	if cs == nil {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if isIncoming {
+		cs.info.StreamsAccepted++
+	} else {
+		cs.info.StreamsOpened++
+	}
+	cs.info.StreamsActive++
+}
+
+// StreamClosed Counts a finished stream (opened or accepted)
+func (cs *MoqQuicConnStats) StreamClosed() {
+	if cs == nil {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.info.StreamsActive--
+}
+
+// Helpers
+
+func (qs *MoqQuicStats) newConnectionTracer(ctx context.Context, perspective logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+	tracingId, found := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !found {
+		return nil
+	}
+	cs := &MoqQuicConnStats{lock: new(sync.Mutex)}
+
+	qs.lock.Lock()
+	qs.conns[tracingId] = cs
+	qs.lock.Unlock()
+
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			cs.addSent(size)
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			cs.addSent(size)
+		},
+		ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			cs.addReceived(size)
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			cs.addReceived(size)
+		},
+		DroppedPacket: func(_ logging.PacketType, _ logging.PacketNumber, _ logging.ByteCount, _ logging.PacketDropReason) {
+			cs.lock.Lock()
+			defer cs.lock.Unlock()
+			cs.info.PacketsDropped++
+		},
+		LostPacket: func(_ logging.EncryptionLevel, _ logging.PacketNumber, _ logging.PacketLossReason) {
+			cs.lock.Lock()
+			defer cs.lock.Unlock()
+			cs.info.PacketsLost++
+		},
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd logging.ByteCount, bytesInFlight logging.ByteCount, packetsInFlight int) {
+			cs.lock.Lock()
+			defer cs.lock.Unlock()
+			cs.info.SmoothedRttMs = durationToMs(rttStats.SmoothedRTT())
+			cs.info.MinRttMs = durationToMs(rttStats.MinRTT())
+			cs.info.LatestRttMs = durationToMs(rttStats.LatestRTT())
+			cs.info.RttVarMs = durationToMs(rttStats.MeanDeviation())
+			cs.info.CongestionWindow = uint64(cwnd)
+			cs.info.BytesInFlight = uint64(bytesInFlight)
+			cs.info.PacketsInFlight = packetsInFlight
+		},
+		UpdatedCongestionState: func(state logging.CongestionState) {
+			cs.lock.Lock()
+			defer cs.lock.Unlock()
+			cs.info.CongestionState = congestionStateToString(state)
+		},
+		Close: func() {
+			qs.lock.Lock()
+			defer qs.lock.Unlock()
+			delete(qs.conns, tracingId)
+		},
+	}
+}
+
+func (cs *MoqQuicConnStats) addSent(size logging.ByteCount) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.info.PacketsSent++
+	cs.info.BytesSent += uint64(size)
+}
+
+func (cs *MoqQuicConnStats) addReceived(size logging.ByteCount) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.info.PacketsReceived++
+	cs.info.BytesReceived += uint64(size)
+}
+
+func congestionStateToString(state logging.CongestionState) string {
+	switch state {
+	case logging.CongestionStateSlowStart:
+		return "slow-start"
+	case logging.CongestionStateCongestionAvoidance:
+		return "congestion-avoidance"
+	case logging.CongestionStateRecovery:
+		return "recovery"
+	case logging.CongestionStateApplicationLimited:
+		return "application-limited"
+	}
+	return "unknown"
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqrawquic
+
+import (
+	"context"
+	"net"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+// ALPN of MoqT over raw QUIC (draft-01)
+const MOQT_ALPN = "moq-00"
+
+// URL scheme of raw QUIC MoqT endpoints (ex: moq://relay.example.com:4433/moq)
+const MOQT_URL_SCHEME = "moq"
+
+// MoqRawQuicSession Exposes a QUIC connection with the same methods (and stream types) as a WebTransport session
+type MoqRawQuicSession struct {
+	conn quic.Connection
+}
+
+// New Wraps a MoqT QUIC connection
+func New(conn quic.Connection) *MoqRawQuicSession {
+	return &MoqRawQuicSession{conn: conn}
+}
+
+func (s *MoqRawQuicSession) Context() context.Context {
+	return s.conn.Context()
+}
+
+func (s *MoqRawQuicSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *MoqRawQuicSession) OpenStream() (webtransport.Stream, error) {
+	stream, err := s.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &moqRawQuicStream{stream}, nil
+}
+
+func (s *MoqRawQuicSession) AcceptStream(ctx context.Context) (webtransport.Stream, error) {
+	stream, err := s.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &moqRawQuicStream{stream}, nil
+}
+
+func (s *MoqRawQuicSession) AcceptUniStream(ctx context.Context) (webtransport.ReceiveStream, error) {
+	stream, err := s.conn.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &moqRawQuicReceiveStream{stream}, nil
+}
+
+func (s *MoqRawQuicSession) OpenUniStreamSync(ctx context.Context) (webtransport.SendStream, error) {
+	stream, err := s.conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &moqRawQuicSendStream{stream}, nil
+}
+
+func (s *MoqRawQuicSession) CloseWithError(code webtransport.SessionErrorCode, msg string) error {
+	return s.conn.CloseWithError(quic.ApplicationErrorCode(code), msg)
+}
+
+// Streams (only the error code types are different)
+
+type moqRawQuicStream struct {
+	quic.Stream
+}
+
+func (s *moqRawQuicStream) CancelWrite(code webtransport.StreamErrorCode) {
+	s.Stream.CancelWrite(quic.StreamErrorCode(code))
+}
+
+func (s *moqRawQuicStream) CancelRead(code webtransport.StreamErrorCode) {
+	s.Stream.CancelRead(quic.StreamErrorCode(code))
+}
+
+type moqRawQuicSendStream struct {
+	quic.SendStream
+}
+
+func (s *moqRawQuicSendStream) CancelWrite(code webtransport.StreamErrorCode) {
+	s.SendStream.CancelWrite(quic.StreamErrorCode(code))
+}
+
+type moqRawQuicReceiveStream struct {
+	quic.ReceiveStream
+}
+
+func (s *moqRawQuicReceiveStream) CancelRead(code webtransport.StreamErrorCode) {
+	s.ReceiveStream.CancelRead(quic.StreamErrorCode(code))
+}
@@ -0,0 +1,438 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqrecorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Objects waiting to be written, new ones are dropped when full
+const RECORDER_QUEUE_SIZE = 1024
+
+// Files of tracks without objects for this time are closed
+const RECORDER_TRACK_IDLE_MS = 30 * 1000
+
+// Record header: groupSeq, objSeq, sendOrder, receivedAt (unix ns), payload size
+const RECORD_OBJECT_HEADER_SIZE = 5 * 8
+
+const RECORD_SEGMENT_FILE_EXTENSION = ".moqrec"
+const RECORD_INDEX_FILE_NAME = "index.jsonl"
+const RECORD_TRACK_FILE_NAME = "track.json"
+
+// MoqRecordTrackInfo Recorded track (track.json in the track dir)
+type MoqRecordTrackInfo struct {
+	TrackNamespace string    `json:"trackNamespace"`
+	TrackName      string    `json:"trackName"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// MoqRecordIndexEntry Recorded object (a line of index.jsonl in the track dir)
+type MoqRecordIndexEntry struct {
+	GroupSequence  uint64    `json:"groupSequence"`
+	ObjectSequence uint64    `json:"objectSequence"`
+	SendOrder      uint64    `json:"sendOrder"`
+	ReceivedAt     time.Time `json:"receivedAt"`
+	// Segment file name (in the track dir), offset of the record header and payload size
+	Segment string `json:"segment"`
+	Offset  uint64 `json:"offset"`
+	Size    uint64 `json:"size"`
+}
+
+type MoqRecorderConfig struct {
+	Dir string
+	// Namespaces recorded, exact or wildcard (ex: "live/*")
+	TrackNamespaces []string
+	// A new segment file is started when the current one reaches this size or duration
+	SegmentMaxBytes uint64
+	SegmentMaxMs    uint64
+}
+
+type MoqRecorderTrackStats struct {
+	TrackNamespace string    `json:"trackNamespace"`
+	TrackName      string    `json:"trackName"`
+	Dir            string    `json:"dir"`
+	Segment        string    `json:"segment"`
+	Objects        uint64    `json:"objects"`
+	Bytes          uint64    `json:"bytes"`
+	LastObjectAt   time.Time `json:"lastObjectAt"`
+}
+
+type MoqRecorderStats struct {
+	Tracks         []MoqRecorderTrackStats `json:"tracks"`
+	Objects        uint64                  `json:"objects"`
+	Bytes          uint64                  `json:"bytes"`
+	DroppedObjects uint64                  `json:"droppedObjects"`
+	Errors         uint64                  `json:"errors"`
+}
+
+type moqRecordRequest struct {
+	trackNamespace string
+	trackName      string
+	moqObj         *moqobject.MoqObject
+}
+
+// Open files of a recorded track (only used by the writer thread)
+type moqRecorderTrack struct {
+	stats MoqRecorderTrackStats
+
+	segmentFile      *os.File
+	segmentNumber    uint64
+	segmentBytes     uint64
+	segmentStartedAt time.Time
+	indexFile        *os.File
+}
+
+// MoqRecorder Persists every object of the configured namespaces to segmented files with an index, independent of the cache TTL (nil disabled)
+type MoqRecorder struct {
+	config MoqRecorderConfig
+
+	queue chan moqRecordRequest
+	done  chan bool
+
+	// Protected
+	stopped        bool
+	tracks         map[string]*moqRecorderTrack
+	objects        uint64
+	bytes          uint64
+	droppedObjects uint64
+	errors         uint64
+	lock           *sync.Mutex
+
+	clock moqclock.Clock
+}
+
+// New Creates the recorder and starts its writer thread
+func New(config MoqRecorderConfig, clock moqclock.Clock) (rec *MoqRecorder, err error) {
+	errMkDir := os.MkdirAll(config.Dir, 0o755)
+	if errMkDir != nil {
+		err = errMkDir
+		return
+	}
+	rec = &MoqRecorder{config: config, queue: make(chan moqRecordRequest, RECORDER_QUEUE_SIZE), done: make(chan bool), tracks: map[string]*moqRecorderTrack{}, lock: new(sync.Mutex), clock: clock}
+	go rec.runWriter()
+
+	log.Info(fmt.Sprintf("Recording namespaces %v to %s", config.TrackNamespaces, config.Dir))
+	return
+}
+
+// IsRecording Returns true if the objects of this namespace are recorded
+func (rec *MoqRecorder) IsRecording(trackNamespace string) bool {
+	if rec == nil {
+		return false
+	}
+	return slices.ContainsFunc(rec.config.TrackNamespaces, func(pattern string) bool { return moqfwdtable.MatchesNamespace(pattern, trackNamespace) })
+}
+
+// Record Queues a received object to be written (it never blocks, the object is written once it is complete)
+func (rec *MoqRecorder) Record(trackNamespace string, trackName string, moqObj *moqobject.MoqObject) {
+	if !rec.IsRecording(trackNamespace) {
+		return
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.stopped {
+		return
+	}
+	select {
+	case rec.queue <- moqRecordRequest{trackNamespace: trackNamespace, trackName: trackName, moqObj: moqObj}:
+	default:
+		rec.droppedObjects++
+		log.WithFields(log.Fields{"namespace": trackNamespace, "track": trackName, "obj": moqObj.GetDebugStr()}).Warning("Recorder queue full, object NOT recorded")
+	}
+}
+
+// Stats Returns the recorded tracks (with open files) and counters
+func (rec *MoqRecorder) Stats() (stats MoqRecorderStats) {
+	stats.Tracks = []MoqRecorderTrackStats{}
+	if rec == nil {
+		return
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	for _, track := range rec.tracks {
+		stats.Tracks = append(stats.Tracks, track.stats)
+	}
+	sort.Slice(stats.Tracks, func(i, j int) bool { return stats.Tracks[i].Dir < stats.Tracks[j].Dir })
+	stats.Objects = rec.objects
+	stats.Bytes = rec.bytes
+	stats.DroppedObjects = rec.droppedObjects
+	stats.Errors = rec.errors
+	return
+}
+
+// Stop Writes the queued objects and closes the files
+func (rec *MoqRecorder) Stop() {
+	if rec == nil {
+		return
+	}
+	rec.lock.Lock()
+	if rec.stopped {
+		rec.lock.Unlock()
+		return
+	}
+	rec.stopped = true
+	close(rec.queue)
+	rec.lock.Unlock()
+
+	<-rec.done
+}
+
+// Reading (replay / analysis)
+
+// GetTrackDir Returns the dir of a recorded track
+func GetTrackDir(dir string, trackNamespace string, trackName string) string {
+	return filepath.Join(dir, url.PathEscape(trackNamespace), url.PathEscape(trackName))
+}
+
+// ReadTrackInfo Returns the namespace / name of a recorded track dir
+func ReadTrackInfo(trackDir string) (trackInfo MoqRecordTrackInfo, err error) {
+	data, errRead := os.ReadFile(filepath.Join(trackDir, RECORD_TRACK_FILE_NAME))
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	err = json.Unmarshal(data, &trackInfo)
+	return
+}
+
+// ReadIndex Returns the recorded objects of a track dir in the order they were received
+func ReadIndex(trackDir string) (entries []MoqRecordIndexEntry, err error) {
+	indexFile, errOpen := os.Open(filepath.Join(trackDir, RECORD_INDEX_FILE_NAME))
+	if errOpen != nil {
+		err = errOpen
+		return
+	}
+	defer indexFile.Close()
+
+	entries = []MoqRecordIndexEntry{}
+	scanner := bufio.NewScanner(indexFile)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry MoqRecordIndexEntry
+		errUnmarshal := json.Unmarshal(scanner.Bytes(), &entry)
+		if errUnmarshal != nil {
+			// Last line can be truncated (relay stopped while writing)
+			log.Warning(fmt.Sprintf("Skipping invalid index entry in %s. Err: %v", trackDir, errUnmarshal))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	err = scanner.Err()
+	return
+}
+
+// ReadObject Reads a recorded object, the returned object is closed (EOF)
+func ReadObject(trackDir string, entry MoqRecordIndexEntry, trackId uint64, maxAgeS uint64, receivedAt time.Time) (moqObj *moqobject.MoqObject, err error) {
+	segmentFile, errOpen := os.Open(filepath.Join(trackDir, entry.Segment))
+	if errOpen != nil {
+		err = errOpen
+		return
+	}
+	defer segmentFile.Close()
+
+	data := make([]byte, RECORD_OBJECT_HEADER_SIZE+entry.Size)
+	_, errRead := segmentFile.ReadAt(data, int64(entry.Offset))
+	if errRead != nil {
+		err = errRead
+		return
+	}
+	if binary.BigEndian.Uint64(data[0:]) != entry.GroupSequence || binary.BigEndian.Uint64(data[8:]) != entry.ObjectSequence || binary.BigEndian.Uint64(data[32:]) != entry.Size {
+		err = errors.New(fmt.Sprintf("Corrupted record in %s, segment: %s, offset: %d", trackDir, entry.Segment, entry.Offset))
+		return
+	}
+
+	moqObj = moqobject.New(moqobject.MoqObjectHeader{TrackId: trackId, GroupSequence: entry.GroupSequence, ObjectSequence: entry.ObjectSequence, SendOrder: entry.SendOrder}, maxAgeS, receivedAt)
+	moqObj.PayloadWrite(data[RECORD_OBJECT_HEADER_SIZE:])
+	moqObj.SetEof()
+	return
+}
+
+// Writer thread
+
+func (rec *MoqRecorder) runWriter() {
+	ticker := rec.clock.NewTicker(RECORDER_TRACK_IDLE_MS * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case request, ok := <-rec.queue:
+			if !ok {
+				rec.closeTracks(func(track *moqRecorderTrack) bool { return true })
+				close(rec.done)
+				return
+			}
+			errWrite := rec.write(request)
+			if errWrite != nil {
+				rec.lock.Lock()
+				rec.errors++
+				rec.lock.Unlock()
+				log.WithFields(log.Fields{"namespace": request.trackNamespace, "track": request.trackName, "obj": request.moqObj.GetDebugStr()}).WithError(errWrite).Error("Recording object")
+			}
+		case <-ticker.C():
+			now := rec.clock.Now()
+			rec.closeTracks(func(track *moqRecorderTrack) bool {
+				return now.Sub(track.stats.LastObjectAt) > RECORDER_TRACK_IDLE_MS*time.Millisecond
+			})
+		}
+	}
+}
+
+func (rec *MoqRecorder) write(request moqRecordRequest) (err error) {
+	// Waits until the object is complete
+	payload, errPayload := io.ReadAll(request.moqObj.NewReader())
+	if errPayload != nil {
+		err = errPayload
+		return
+	}
+
+	track, errTrack := rec.getTrack(request.trackNamespace, request.trackName)
+	if errTrack != nil {
+		err = errTrack
+		return
+	}
+	now := rec.clock.Now()
+	if track.segmentFile == nil || (rec.config.SegmentMaxBytes > 0 && track.segmentBytes >= rec.config.SegmentMaxBytes) || (rec.config.SegmentMaxMs > 0 && now.Sub(track.segmentStartedAt) >= time.Duration(rec.config.SegmentMaxMs)*time.Millisecond) {
+		errSegment := rec.startSegment(track, now)
+		if errSegment != nil {
+			err = errSegment
+			return
+		}
+	}
+
+	header := make([]byte, RECORD_OBJECT_HEADER_SIZE)
+	binary.BigEndian.PutUint64(header[0:], request.moqObj.GroupSequence)
+	binary.BigEndian.PutUint64(header[8:], request.moqObj.ObjectSequence)
+	binary.BigEndian.PutUint64(header[16:], request.moqObj.SendOrder)
+	binary.BigEndian.PutUint64(header[24:], uint64(request.moqObj.ReceivedAt.UnixNano()))
+	binary.BigEndian.PutUint64(header[32:], uint64(len(payload)))
+
+	offset := track.segmentBytes
+	_, errWrite := track.segmentFile.Write(append(header, payload...))
+	if errWrite != nil {
+		err = errWrite
+		return
+	}
+	track.segmentBytes += uint64(len(header) + len(payload))
+
+	entry := MoqRecordIndexEntry{GroupSequence: request.moqObj.GroupSequence, ObjectSequence: request.moqObj.ObjectSequence, SendOrder: request.moqObj.SendOrder, ReceivedAt: request.moqObj.ReceivedAt, Segment: filepath.Base(track.segmentFile.Name()), Offset: offset, Size: uint64(len(payload))}
+	entryJson, errMarshal := json.Marshal(entry)
+	if errMarshal != nil {
+		err = errMarshal
+		return
+	}
+	_, errWriteIndex := track.indexFile.Write(append(entryJson, '\n'))
+	if errWriteIndex != nil {
+		err = errWriteIndex
+		return
+	}
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	track.stats.Objects++
+	track.stats.Bytes += uint64(len(payload))
+	track.stats.LastObjectAt = now
+	track.stats.Segment = entry.Segment
+	rec.objects++
+	rec.bytes += uint64(len(payload))
+	return
+}
+
+// getTrack Returns the open track, it creates its dir / opens its index if needed
+func (rec *MoqRecorder) getTrack(trackNamespace string, trackName string) (track *moqRecorderTrack, err error) {
+	trackDir := GetTrackDir(rec.config.Dir, trackNamespace, trackName)
+
+	rec.lock.Lock()
+	track, found := rec.tracks[trackDir]
+	rec.lock.Unlock()
+	if found {
+		return
+	}
+
+	errMkDir := os.MkdirAll(trackDir, 0o755)
+	if errMkDir != nil {
+		err = errMkDir
+		return
+	}
+	trackInfoFile := filepath.Join(trackDir, RECORD_TRACK_FILE_NAME)
+	if _, errStat := os.Stat(trackInfoFile); errors.Is(errStat, os.ErrNotExist) {
+		trackInfoJson, _ := json.Marshal(MoqRecordTrackInfo{TrackNamespace: trackNamespace, TrackName: trackName, CreatedAt: rec.clock.Now()})
+		errWrite := os.WriteFile(trackInfoFile, trackInfoJson, 0o644)
+		if errWrite != nil {
+			err = errWrite
+			return
+		}
+	}
+	indexFile, errOpen := os.OpenFile(filepath.Join(trackDir, RECORD_INDEX_FILE_NAME), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if errOpen != nil {
+		err = errOpen
+		return
+	}
+	// Continues after the segments of previous recordings
+	oldSegments, _ := filepath.Glob(filepath.Join(trackDir, "*"+RECORD_SEGMENT_FILE_EXTENSION))
+
+	track = &moqRecorderTrack{stats: MoqRecorderTrackStats{TrackNamespace: trackNamespace, TrackName: trackName, Dir: trackDir}, segmentNumber: uint64(len(oldSegments)), indexFile: indexFile}
+
+	rec.lock.Lock()
+	rec.tracks[trackDir] = track
+	rec.lock.Unlock()
+	return
+}
+
+func (rec *MoqRecorder) startSegment(track *moqRecorderTrack, now time.Time) (err error) {
+	if track.segmentFile != nil {
+		track.segmentFile.Close()
+		track.segmentFile = nil
+	}
+	track.segmentNumber++
+	segmentFile, errCreate := os.OpenFile(filepath.Join(track.stats.Dir, fmt.Sprintf("%08d%s", track.segmentNumber, RECORD_SEGMENT_FILE_EXTENSION)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if errCreate != nil {
+		err = errCreate
+		return
+	}
+	track.segmentFile = segmentFile
+	track.segmentBytes = 0
+	track.segmentStartedAt = now
+	return
+}
+
+func (rec *MoqRecorder) closeTracks(shouldClose func(track *moqRecorderTrack) bool) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	for trackDir, track := range rec.tracks {
+		if !shouldClose(track) {
+			continue
+		}
+		if track.segmentFile != nil {
+			track.segmentFile.Close()
+		}
+		track.indexFile.Close()
+		delete(rec.tracks, trackDir)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqreplay
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqlocalpublisher"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqrecorder"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pause between the end of the recording and the start of the next loop
+const REPLAY_LOOP_DELAY_MS = 1000
+
+// Name (remote address in the admin API) of the replay publisher sessions
+const REPLAY_SESSION_NAME = "replay"
+
+type MoqReplayConfig struct {
+	// Recorded track dirs (see moqrecorder), all played on the same timeline
+	TrackDirs []string
+	// Namespace to announce, empty uses the recorded one
+	TrackNamespace string
+	// Start again when the recording ends (groups keep increasing)
+	Loop bool
+}
+
+type moqReplayTrack struct {
+	trackDir  string
+	trackName string
+	trackId   uint64
+}
+
+// Object of the merged timeline of all the tracks
+type moqReplayItem struct {
+	track *moqReplayTrack
+	entry moqrecorder.MoqRecordIndexEntry
+}
+
+// MoqReplay Local publisher that plays back recorded tracks as if they were live (announces the namespace, answers SUBSCRIBEs and ingests the objects with the original pacing)
+type MoqReplay struct {
+	config         MoqReplayConfig
+	trackNamespace string
+	tracks         map[string]*moqReplayTrack
+	timeline       []moqReplayItem
+	// Groups of every loop start after the largest recorded one
+	groupsPerLoop uint64
+
+	publisher  *moqlocalpublisher.MoqLocalPublisher
+	connConfig moqconnectionmanagment.MoqConnectionConfig
+
+	// Housekeeping thread channel
+	cleanUpChannel chan bool
+}
+
+// New Loads the recorded tracks, announces their namespace and starts playing them back
+func New(config MoqReplayConfig, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, connConfig moqconnectionmanagment.MoqConnectionConfig) (mr *MoqReplay, err error) {
+	mr = &MoqReplay{config: config, trackNamespace: config.TrackNamespace, tracks: map[string]*moqReplayTrack{}, timeline: []moqReplayItem{}, connConfig: connConfig, cleanUpChannel: make(chan bool)}
+
+	errLoad := mr.loadTracks()
+	if errLoad != nil {
+		err = errLoad
+		mr = nil
+		return
+	}
+
+	publisher, errPublisher := moqlocalpublisher.New(REPLAY_SESSION_NAME, mr.trackNamespace, moqtFwdTable, objects, connConfig)
+	if errPublisher != nil {
+		err = errPublisher
+		mr = nil
+		return
+	}
+	mr.publisher = publisher
+	for _, track := range mr.tracks {
+		trackId, errTrack := publisher.AddTrack(track.trackName)
+		if errTrack != nil {
+			publisher.Close()
+			err = errTrack
+			mr = nil
+			return
+		}
+		track.trackId = trackId
+	}
+
+	go mr.process(mr.cleanUpChannel)
+
+	mr.getLog().WithFields(log.Fields{"tracks": len(mr.tracks), "objects": len(mr.timeline), "loop": config.Loop}).Info("Started replay")
+	return
+}
+
+// Close Stops the playback and removes the replay publisher (nil-safe)
+func (mr *MoqReplay) Close() {
+	if mr == nil {
+		return
+	}
+	// Send finish signal
+	mr.cleanUpChannel <- true
+
+	// Wait to finish
+	<-mr.cleanUpChannel
+}
+
+func (mr *MoqReplay) getLog() *log.Entry {
+	return log.WithFields(log.Fields{"session": mr.publisher.GetSessionName(), "namespace": mr.trackNamespace})
+}
+
+// loadTracks Reads the index of the recorded tracks and merges them in a single timeline
+func (mr *MoqReplay) loadTracks() (err error) {
+	if len(mr.config.TrackDirs) == 0 {
+		err = errors.New("No recorded track dirs to replay")
+		return
+	}
+	for _, trackDir := range mr.config.TrackDirs {
+		trackInfo, errInfo := moqrecorder.ReadTrackInfo(trackDir)
+		if errInfo != nil {
+			err = errors.New(fmt.Sprintf("Reading recorded track info from %s. Err: %v", trackDir, errInfo))
+			return
+		}
+		if mr.config.TrackNamespace == "" {
+			if mr.trackNamespace != "" && mr.trackNamespace != trackInfo.TrackNamespace {
+				err = errors.New(fmt.Sprintf("Recorded tracks are from different namespaces (%s, %s), set the replay namespace", mr.trackNamespace, trackInfo.TrackNamespace))
+				return
+			}
+			mr.trackNamespace = trackInfo.TrackNamespace
+		}
+		if _, found := mr.tracks[trackInfo.TrackName]; found {
+			err = errors.New(fmt.Sprintf("Track %s is in more than one recorded dir", trackInfo.TrackName))
+			return
+		}
+		entries, errIndex := moqrecorder.ReadIndex(trackDir)
+		if errIndex != nil {
+			err = errors.New(fmt.Sprintf("Reading recorded track index from %s. Err: %v", trackDir, errIndex))
+			return
+		}
+		track := &moqReplayTrack{trackDir: trackDir, trackName: trackInfo.TrackName}
+		mr.tracks[track.trackName] = track
+		for _, entry := range entries {
+			mr.timeline = append(mr.timeline, moqReplayItem{track: track, entry: entry})
+			if entry.GroupSequence+1 > mr.groupsPerLoop {
+				mr.groupsPerLoop = entry.GroupSequence + 1
+			}
+		}
+	}
+	if len(mr.timeline) == 0 {
+		err = errors.New(fmt.Sprintf("Recorded tracks %v do NOT have objects", mr.config.TrackDirs))
+		return
+	}
+	sort.SliceStable(mr.timeline, func(i, j int) bool {
+		return mr.timeline[i].entry.ReceivedAt.Before(mr.timeline[j].entry.ReceivedAt)
+	})
+	return
+}
+
+// Threads
+
+func (mr *MoqReplay) process(cleanUpChannelBidi chan bool) {
+	mr.getLog().Info("Entering replay process thread")
+
+	loop := uint64(0)
+	bExit := false
+	for bExit == false {
+		startedAt := mr.connConfig.Clock.Now()
+		recordingStartedAt := mr.timeline[0].entry.ReceivedAt
+		for _, item := range mr.timeline {
+			// Original pacing
+			wait := item.entry.ReceivedAt.Sub(recordingStartedAt) - mr.connConfig.Clock.Now().Sub(startedAt)
+			if mr.waitOrExit(wait, cleanUpChannelBidi) {
+				bExit = true
+				break
+			}
+			mr.ingestObject(item, loop*mr.groupsPerLoop)
+		}
+		if bExit {
+			break
+		}
+		if !mr.config.Loop {
+			mr.getLog().Info("Replay finished")
+			break
+		}
+		loop++
+		mr.getLog().WithField("loop", loop).Info("Replay finished, starting again")
+		bExit = mr.waitOrExit(REPLAY_LOOP_DELAY_MS*time.Millisecond, cleanUpChannelBidi)
+	}
+
+	// Same as a publisher that disconnects
+	mr.publisher.Close()
+
+	if !bExit {
+		<-cleanUpChannelBidi
+	}
+
+	// Indicates finished
+	cleanUpChannelBidi <- true
+
+	mr.getLog().Info("Exited replay process thread")
+}
+
+// waitOrExit Returns true if the exit signal is received before d
+func (mr *MoqReplay) waitOrExit(d time.Duration, cleanUpChannelBidi chan bool) bool {
+	if d <= 0 {
+		return false
+	}
+	timer := mr.connConfig.Clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-cleanUpChannelBidi:
+		return true
+	case <-timer.C():
+		return false
+	}
+}
+
+// ingestObject Reads a recorded object and publishes it
+func (mr *MoqReplay) ingestObject(item moqReplayItem, groupOffset uint64) {
+	recordedObj, errRead := moqrecorder.ReadObject(item.track.trackDir, item.entry, item.track.trackId, mr.connConfig.ObjExpMs/1000, mr.connConfig.Clock.Now())
+	if errRead != nil {
+		mr.getLog().WithFields(log.Fields{"track": item.track.trackName, "segment": item.entry.Segment, "offset": item.entry.Offset}).WithError(errRead).Error("Reading recorded obj")
+		return
+	}
+	payload, _ := io.ReadAll(recordedObj.NewReader())
+	errPublish := mr.publisher.PublishObject(item.track.trackName, item.entry.GroupSequence+groupOffset, item.entry.ObjectSequence, item.entry.SendOrder, payload)
+	if errPublish != nil {
+		mr.getLog().WithFields(log.Fields{"track": item.track.trackName, "groupSeq": item.entry.GroupSequence + groupOffset, "objSeq": item.entry.ObjectSequence}).WithError(errPublish).Warning("Dropped obj")
+	}
+	// Replayed objects are NOT recorded again
+}
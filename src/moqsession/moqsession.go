@@ -7,10 +7,14 @@ LICENSE file in the root directory of this source tree.
 package moqsession
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"facebookexperimental/moq-go-server/moqclock"
 	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqquicstats"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 )
@@ -18,19 +22,125 @@ import (
 const MAX_PUBLISH_NAMESPACES_PER_SESSION = 256
 const MAX_SUBSCRIBE_TRACKS_PER_SESSION = 256
 const SUBSCRIBER_INTERNAL_QUEUE_SIZE = 1024 * 1024
+const MAX_AUTH_TOKEN_ALIASES_PER_SESSION = 64
+
+// What to do when a subscriber objects queue is full
+type MoqObjQueuePolicy string
+
+const (
+	MoqObjQueuePolicyDropOldest         MoqObjQueuePolicy = "drop-oldest"
+	MoqObjQueuePolicyDropLowestPriority MoqObjQueuePolicy = "drop-lowest-priority"
+	MoqObjQueuePolicyDisconnect         MoqObjQueuePolicy = "disconnect-slow-subscriber"
+)
+
+// What to do when a SUBSCRIBE arrives for an already subscribed track
+type MoqDuplicateSubscribePolicy string
+
+const (
+	MoqDuplicateSubscribePolicyReject MoqDuplicateSubscribePolicy = "reject"
+	MoqDuplicateSubscribePolicyUpdate MoqDuplicateSubscribePolicy = "update"
+)
+
+// Session lifecycle
+type MoqSessionState string
+
+const (
+	MoqSessionStateSetup       MoqSessionState = "setup"
+	MoqSessionStateEstablished MoqSessionState = "established"
+	MoqSessionStateDraining    MoqSessionState = "draining"
+	MoqSessionStateClosed      MoqSessionState = "closed"
+)
+
+// Older groups still accepted (objects of different groups arrive in parallel streams)
+const MAX_TRACK_GROUP_BACKWARDS_JUMP = 2
 
 type moqNamespaceInfo struct {
 	AuthInfo       string
 	trackNamespace string
 }
 
+type moqTrackAlias struct {
+	trackNamespace string
+	trackName      string
+}
+
+type MoqTrack struct {
+	TrackNamespace string
+	TrackName      string
+}
+
+// Connection data captured when the session is created
+type MoqSessionMetadata struct {
+	RemoteAddr string `json:"remoteAddr"`
+	UserAgent  string `json:"userAgent"`
+	// WebTransport session ID (CONNECT stream ID), 0 for origin sessions
+	WtSessionId uint64 `json:"wtSessionId"`
+	// Identity of the verified client certificate (mTLS), if any
+	ClientCertIdentity string `json:"clientCertIdentity,omitempty"`
+}
+
+// Session info (admin API, routing)
+type MoqSessionInfo struct {
+	MoqSessionMetadata
+	AuthIdentity   string                `json:"authIdentity"`
+	UniqueName     string                `json:"uniqueName"`
+	CreatedAt      time.Time             `json:"createdAt"`
+	Version        moqhelpers.MoqVersion `json:"version"`
+	Role           moqhelpers.MoqRole    `json:"role"`
+	State          MoqSessionState       `json:"state"`
+	IdleMs         int64                 `json:"idleMs"`
+	Namespaces     int                   `json:"namespaces"`
+	ActiveTracks   int                   `json:"activeTracks"`
+	Subscriptions  int                   `json:"subscriptions"`
+	QueuedObjects  int                   `json:"queuedObjects"`
+	DroppedObjects uint64                `json:"droppedObjects"`
+	SkippedObjects uint64                `json:"skippedObjects"`
+	// Dropped by the send rate limit
+	RateLimitedObjects uint64 `json:"rateLimitedObjects"`
+	// Dropped after waiting too long for the higher priority streams
+	PriorityDroppedObjects uint64 `json:"priorityDroppedObjects"`
+	// Publisher side (objects received, SUBSCRIBEs sent to it)
+	ReceivedObjects     uint64 `json:"receivedObjects"`
+	ReceivedBytes       uint64 `json:"receivedBytes"`
+	ForwardedSubscribes uint64 `json:"forwardedSubscribes"`
+	// QUIC connection stats (RTT, congestion window, losses, streams), nil if not available
+	Transport *moqquicstats.MoqQuicConnStatsInfo `json:"transport,omitempty"`
+}
+
+type moqTrackSequenceState struct {
+	largestGroup uint64
+	// Objects seen per recent group
+	groups map[uint64]map[uint64]bool
+}
+
 type MoqSubscribeChannelMessage struct {
 	moqhelpers.MoqMessageSubscribe
-	stop bool
+	// Send UNSUBSCRIBE for that track instead
+	unSubscribe bool
+	stop        bool
 }
 
 type noOp struct{}
 
+type moqObjectQueueItem struct {
+	cacheKey string
+	// Track alias in this (subscriber) session
+	localTrackId uint64
+	// Higher send order is lower priority
+	sendOrder      uint64
+	groupSequence  uint64
+	objectSequence uint64
+}
+
+// Lag of a subscription (in groups)
+type moqSubscriptionLag struct {
+	// Newest group queued
+	latestGroup uint64
+	// Last object dequeued to send
+	sentGroup  uint64
+	sentObject uint64
+}
+
 type MoqSubscribeResponseChannelMessage struct {
 	moqSubscribeResponse interface{}
 	subscribeMessageType moqhelpers.MoqMessageType
@@ -39,9 +149,13 @@ type MoqSubscribeResponseChannelMessage struct {
 
 type MoqMessageSubscribeExtended struct {
 	moqhelpers.MoqMessageSubscribe
-	trackId   uint64
-	expires   uint64
-	validated bool
+	trackId uint64
+	// Track alias allocated by this session (publishers TrackIds can collide)
+	localTrackId uint64
+	expires      uint64
+	validated    bool
+	// Created from a wildcard (prefix) subscription
+	wildcard bool
 }
 
 type MoqSession struct {
@@ -55,9 +169,24 @@ type MoqSession struct {
 	// Role
 	Role moqhelpers.MoqRole
 
+	Metadata MoqSessionMetadata
+
+	// Fingerprint of the auth info used by this session (tokens are never stored)
+	authIdentity string
+
+	// Origins only, previous groups requested on the first SUBSCRIBE of a track (0 disabled)
+	warmUpGroups uint64
+	// Origins only, sessions of the same pool share the tracks (each track is subscribed in one of them)
+	originPool string
+
+	// Lifecycle state (forwarding only while established)
+	state MoqSessionState
+
 	// Data for publishers or both
 	// Namespaces, trackId -> trackName
 	namespaces map[string]map[uint64]string
+	// Active track aliases, trackId -> track (retired on UNANNOUNCE)
+	trackAliases map[uint64]moqTrackAlias
 
 	// Channel use to forward subscribes
 	channelSubscribe chan MoqSubscribeChannelMessage
@@ -68,19 +197,301 @@ type MoqSession struct {
 	// Data for subscribers or both
 	// Track info
 	tracks map[string]MoqMessageSubscribeExtended
-	// Channel notify new objects
-	channelObject chan string
+	// Next local track alias to allocate
+	nextLocalTrackId uint64
+	// Bounded queue of new objects to send
+	objQueue       []moqObjectQueueItem
+	objQueueSize   int
+	objQueuePolicy MoqObjQueuePolicy
+	objQueueStop   bool
+	objQueueCond   *sync.Cond
+	slowSubscriber bool
+	droppedObjects uint64
+	// Per subscription (localTrackId) lag
+	objQueueLags map[uint64]*moqSubscriptionLag
+	// Purge queued objects of older groups when a new group starts (live)
+	skipToLatestGroup bool
+	skippedObjects    uint64
+	// Dropped by send rate limit
+	rateLimitedObjects uint64
+	// Dropped waiting for higher priority streams
+	priorityDroppedObjects uint64
+
+	// Object sequence validation per trackId
+	sequenceStates     map[uint64]*moqTrackSequenceState
+	sequenceViolations uint64
+
+	// Publisher side counters
+	receivedObjects     uint64
+	receivedBytes       uint64
+	forwardedSubscribes uint64
+
+	// Registered auth tokens, alias -> token
+	authTokens map[uint64]moqhelpers.MoqAuthToken
+
+	// Last control / object activity (liveness)
+	lastActivityAt time.Time
+	// Last object received / sent
+	lastObjectAt time.Time
+	// Any ANNOUNCE / SUBSCRIBE received (idle sessions)
+	announceReceived  bool
+	subscribeReceived bool
+
+	// Closes the underlying transport session (set by the connection)
+	closer func(errCode moqhelpers.MoqErrorCode, errMsg string)
+	// Stats of the underlying QUIC connection (nil not available)
+	transportStats *moqquicstats.MoqQuicConnStats
+
+	clock moqclock.Clock
 
 	lock *sync.RWMutex
 }
 
-func New(uniqueName string, version moqhelpers.MoqVersion, role moqhelpers.MoqRole) *MoqSession {
-	now := time.Now()
-	s := MoqSession{UniqueName: uniqueName, CreatedAt: now, Version: version, Role: role, namespaces: map[string]map[uint64]string{}, tracks: map[string]MoqMessageSubscribeExtended{}, channelObject: make(chan string, SUBSCRIBER_INTERNAL_QUEUE_SIZE), channelSubscribe: make(chan MoqSubscribeChannelMessage, SUBSCRIBER_INTERNAL_QUEUE_SIZE), channelSubscribeResponse: make(chan MoqSubscribeResponseChannelMessage, SUBSCRIBER_INTERNAL_QUEUE_SIZE), lock: new(sync.RWMutex)}
+func New(uniqueName string, version moqhelpers.MoqVersion, role moqhelpers.MoqRole, metadata MoqSessionMetadata, objQueueSize int, objQueuePolicy MoqObjQueuePolicy, skipToLatestGroup bool, clock moqclock.Clock) *MoqSession {
+	now := clock.Now()
+	s := MoqSession{UniqueName: uniqueName, CreatedAt: now, Version: version, Role: role, Metadata: metadata, state: MoqSessionStateSetup, namespaces: map[string]map[uint64]string{}, trackAliases: map[uint64]moqTrackAlias{}, tracks: map[string]MoqMessageSubscribeExtended{}, authTokens: map[uint64]moqhelpers.MoqAuthToken{}, sequenceStates: map[uint64]*moqTrackSequenceState{}, objQueue: []moqObjectQueueItem{}, objQueueSize: objQueueSize, objQueuePolicy: objQueuePolicy, objQueueCond: sync.NewCond(new(sync.Mutex)), objQueueLags: map[uint64]*moqSubscriptionLag{}, skipToLatestGroup: skipToLatestGroup, channelSubscribe: make(chan MoqSubscribeChannelMessage, SUBSCRIBER_INTERNAL_QUEUE_SIZE), channelSubscribeResponse: make(chan MoqSubscribeResponseChannelMessage, SUBSCRIBER_INTERNAL_QUEUE_SIZE), lastActivityAt: now, lastObjectAt: now, clock: clock, lock: new(sync.RWMutex)}
 
 	return &s
 }
 
+func (s *MoqSession) GetInfo() MoqSessionInfo {
+	s.lock.RLock()
+	info := MoqSessionInfo{MoqSessionMetadata: s.Metadata, AuthIdentity: s.authIdentity, UniqueName: s.UniqueName, CreatedAt: s.CreatedAt, Version: s.Version, Role: s.Role, State: s.state, IdleMs: s.clock.Now().Sub(s.lastActivityAt).Milliseconds(), Namespaces: len(s.namespaces), ActiveTracks: len(s.trackAliases), Subscriptions: len(s.tracks), ReceivedObjects: s.receivedObjects, ReceivedBytes: s.receivedBytes, ForwardedSubscribes: s.forwardedSubscribes}
+	s.lock.RUnlock()
+
+	s.objQueueCond.L.Lock()
+	info.QueuedObjects = len(s.objQueue)
+	info.DroppedObjects = s.droppedObjects
+	info.SkippedObjects = s.skippedObjects
+	info.RateLimitedObjects = s.rateLimitedObjects
+	info.PriorityDroppedObjects = s.priorityDroppedObjects
+	s.objQueueCond.L.Unlock()
+
+	if transportStats := s.GetTransportStats(); transportStats != nil {
+		transportInfo := transportStats.GetInfo()
+		info.Transport = &transportInfo
+	}
+
+	return info
+}
+
+// SetCloser Sets the function that closes the underlying transport session
+func (s *MoqSession) SetCloser(closer func(errCode moqhelpers.MoqErrorCode, errMsg string)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closer = closer
+}
+
+// Close Closes the underlying transport session with an error, the connection then removes the session (subscriptions, threads, etc)
+func (s *MoqSession) Close(errCode moqhelpers.MoqErrorCode, errMsg string) (closed bool) {
+	s.lock.RLock()
+	closer := s.closer
+	s.lock.RUnlock()
+
+	if closer == nil {
+		return
+	}
+	closer(errCode, errMsg)
+	closed = true
+	return
+}
+
+// SetTransportStats Sets the stats of the underlying QUIC connection (set by the connection)
+func (s *MoqSession) SetTransportStats(transportStats *moqquicstats.MoqQuicConnStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.transportStats = transportStats
+}
+
+// GetTransportStats Returns the stats of the underlying QUIC connection (nil not available)
+func (s *MoqSession) GetTransportStats() *moqquicstats.MoqQuicConnStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.transportStats
+}
+
+// SetState Moves the session to a new state, only forward transitions are allowed
+func (s *MoqSession) SetState(state MoqSessionState) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !isValidStateTransition(s.state, state) {
+		err = errors.New(fmt.Sprintf("Invalid session state transition from %s to %s", s.state, state))
+		return
+	}
+	s.state = state
+	return
+}
+
+func (s *MoqSession) GetState() MoqSessionState {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.state
+}
+
+// SetAuthIdentity Records the identity of the auth info used by this session
+func (s *MoqSession) SetAuthIdentity(authInfo string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash := sha256.Sum256([]byte(authInfo))
+	s.authIdentity = "sha256:" + hex.EncodeToString(hash[:8])
+}
+
+// SetWarmUpGroups Sets the number of previous groups to request on the first SUBSCRIBE of a track (origins)
+func (s *MoqSession) SetWarmUpGroups(warmUpGroups uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.warmUpGroups = warmUpGroups
+}
+
+func (s *MoqSession) GetWarmUpGroups() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.warmUpGroups
+}
+
+// SetOriginPool Sets the pool of parallel sessions to the same origin this session belongs to
+func (s *MoqSession) SetOriginPool(originPool string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.originPool = originPool
+}
+
+func (s *MoqSession) GetOriginPool() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.originPool
+}
+
+// HasTrack Indicates the session publishes (active alias) or subscribes that track
+func (s *MoqSession) HasTrack(trackNamespace string, trackName string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, found := s.tracks[trackNamespace+"/"+trackName]
+	if found {
+		return true
+	}
+	for _, alias := range s.trackAliases {
+		if alias.trackNamespace == trackNamespace && alias.trackName == trackName {
+			return true
+		}
+	}
+	return false
+}
+
+// HasNamespace Indicates the session publishes or subscribes tracks of that namespace
+func (s *MoqSession) HasNamespace(trackNamespace string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, found := s.namespaces[trackNamespace]
+	if found {
+		return true
+	}
+	for _, subscribeExt := range s.tracks {
+		if subscribeExt.TrackNamespace == trackNamespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Touch Records activity in this session
+func (s *MoqSession) Touch() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastActivityAt = s.clock.Now()
+}
+
+// AddReceivedObject Counts an object (and its payload bytes) received from this publisher session
+func (s *MoqSession) AddReceivedObject(payloadBytes uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.receivedObjects++
+	s.receivedBytes += payloadBytes
+}
+
+// AddForwardedSubscribe Counts a SUBSCRIBE sent to this publisher session
+func (s *MoqSession) AddForwardedSubscribe() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.forwardedSubscribes++
+}
+
+// TouchObjects Records object activity in this session
+func (s *MoqSession) TouchObjects() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+	s.lastActivityAt = now
+	s.lastObjectAt = now
+}
+
+func (s *MoqSession) ControlMessageReceived(msgType moqhelpers.MoqMessageType) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if msgType == moqhelpers.MoqIdMessageAnnounce {
+		s.announceReceived = true
+	} else if msgType == moqhelpers.MoqIdSubscribe {
+		s.subscribeReceived = true
+	}
+}
+
+// CheckIdle Indicates the session is not doing anything for its role: no ANNOUNCE (publishers), no SUBSCRIBE (subscribers), or no objects (0 timeouts are disabled)
+func (s *MoqSession) CheckIdle(announceTimeout time.Duration, subscribeTimeout time.Duration, objectsTimeout time.Duration) (idle bool, reason string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := s.clock.Now()
+	age := now.Sub(s.CreatedAt)
+	isPublisher := s.Role == moqhelpers.MoqRolePublisher || s.Role == moqhelpers.MoqRoleBoth
+	isSubscriber := s.Role == moqhelpers.MoqRoleSubscriber || s.Role == moqhelpers.MoqRoleBoth
+
+	noAnnounce := isPublisher && announceTimeout > 0 && !s.announceReceived && age > announceTimeout
+	noSubscribe := isSubscriber && subscribeTimeout > 0 && !s.subscribeReceived && age > subscribeTimeout
+	if s.Role == moqhelpers.MoqRoleBoth {
+		// Doing any of them is enough
+		if noAnnounce && noSubscribe {
+			idle = true
+			reason = fmt.Sprintf("no ANNOUNCE / SUBSCRIBE for %v", age)
+		}
+	} else if noAnnounce {
+		idle = true
+		reason = fmt.Sprintf("no ANNOUNCE for %v", age)
+	} else if noSubscribe {
+		idle = true
+		reason = fmt.Sprintf("no SUBSCRIBE for %v", age)
+	}
+
+	if !idle && objectsTimeout > 0 && now.Sub(s.lastObjectAt) > objectsTimeout {
+		idle = true
+		reason = fmt.Sprintf("no objects for %v", now.Sub(s.lastObjectAt))
+	}
+	return
+}
+
+func (s *MoqSession) GetIdleTime() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.clock.Now().Sub(s.lastActivityAt)
+}
+
 func (s *MoqSession) AddTrackNamespace(announce moqhelpers.MoqMessageAnnounce) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -96,8 +507,13 @@ func (s *MoqSession) RemoveTrackNamespace(trackNamespace string) (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	_, found := s.namespaces[trackNamespace]
+	namespaceInfo, found := s.namespaces[trackNamespace]
 	if found {
+		// Retire all track aliases of that namespace
+		for trackId := range namespaceInfo {
+			delete(s.trackAliases, trackId)
+			delete(s.sequenceStates, trackId)
+		}
 		delete(s.namespaces, trackNamespace)
 	} else {
 		err = errors.New(fmt.Sprintf("Could NOT find namespace %s to delete", trackNamespace))
@@ -113,71 +529,267 @@ func (s *MoqSession) HasTrackNamespace(trackNamespace string) bool {
 	return found
 }
 
+// GetTrackNamespaces Returns the announced namespaces (origin sessions can have prefix patterns, ex: "vod/*")
+func (s *MoqSession) GetTrackNamespaces() (trackNamespaces []string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for trackNamespace := range s.namespaces {
+		trackNamespaces = append(trackNamespaces, trackNamespace)
+	}
+	return
+}
+
 func (s *MoqSession) AddTrackInfo(trackNamespace string, trackName string, trackId uint64) (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	namespaceInfo, found := s.namespaces[trackNamespace]
-	if found {
-		namespaceInfo[trackId] = trackName
-	} else {
+	if !found {
 		err = errors.New(fmt.Sprintf("Could NOT find track empty namespace %s to add track: %s (%d)", trackNamespace, trackName, trackId))
+		return err
 	}
+
+	// TrackIds can only be reused once retired
+	alias, foundAlias := s.trackAliases[trackId]
+	if foundAlias && (alias.trackNamespace != trackNamespace || alias.trackName != trackName) {
+		err = errors.New(fmt.Sprintf("TrackId %d is in use by %s/%s, can NOT reuse it for %s/%s", trackId, alias.trackNamespace, alias.trackName, trackNamespace, trackName))
+		return err
+	}
+
+	// Retire previous alias of the same track (if any)
+	for prevTrackId, prevTrackName := range namespaceInfo {
+		if prevTrackName == trackName && prevTrackId != trackId {
+			delete(namespaceInfo, prevTrackId)
+			delete(s.trackAliases, prevTrackId)
+			delete(s.sequenceStates, prevTrackId)
+		}
+	}
+
+	namespaceInfo[trackId] = trackName
+	s.trackAliases[trackId] = moqTrackAlias{trackNamespace, trackName}
 	return err
 }
 
+// GetActiveTracks Tracks with an active alias in this (publisher) session
+func (s *MoqSession) GetActiveTracks() (tracks []MoqTrack) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, alias := range s.trackAliases {
+		tracks = append(tracks, MoqTrack{alias.trackNamespace, alias.trackName})
+	}
+	return
+}
+
 func (s *MoqSession) GetTrackInfo(trackId uint64) (found bool, trackNamespace string, trackName string) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	for trackNamespaceItem, trackInfoItem := range s.namespaces {
-		for trackIdItem, trackNameItem := range trackInfoItem {
-			if trackIdItem == trackId {
-				trackNamespace = trackNamespaceItem
-				trackName = trackNameItem
-				trackName = trackNameItem
-				found = true
-				return
+	alias, found := s.trackAliases[trackId]
+	if found {
+		trackNamespace = alias.trackNamespace
+		trackName = alias.trackName
+	}
+	return
+}
+
+// GetSubscribedTrackInfo Returns the track of a subscription of this session by its local track alias
+func (s *MoqSession) GetSubscribedTrackInfo(localTrackId uint64) (found bool, trackNamespace string, trackName string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, subscribeExt := range s.tracks {
+		if subscribeExt.localTrackId == localTrackId {
+			return true, subscribeExt.TrackNamespace, subscribeExt.TrackName
+		}
+	}
+	return
+}
+
+// ValidateObjectSequence Checks for duplicated objects or absurd group jumps backwards in a track
+func (s *MoqSession) ValidateObjectSequence(moqObjHeader moqobject.MoqObjectHeader) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state, found := s.sequenceStates[moqObjHeader.TrackId]
+	if !found {
+		state = &moqTrackSequenceState{largestGroup: moqObjHeader.GroupSequence, groups: map[uint64]map[uint64]bool{}}
+		s.sequenceStates[moqObjHeader.TrackId] = state
+	}
+
+	if moqObjHeader.GroupSequence+MAX_TRACK_GROUP_BACKWARDS_JUMP < state.largestGroup {
+		err = errors.New(fmt.Sprintf("TrackId %d group %d jumped backwards, largest group is %d", moqObjHeader.TrackId, moqObjHeader.GroupSequence, state.largestGroup))
+	} else {
+		groupObjects, foundGroup := state.groups[moqObjHeader.GroupSequence]
+		if !foundGroup {
+			groupObjects = map[uint64]bool{}
+			state.groups[moqObjHeader.GroupSequence] = groupObjects
+		}
+		if groupObjects[moqObjHeader.ObjectSequence] {
+			err = errors.New(fmt.Sprintf("TrackId %d duplicated object %d in group %d", moqObjHeader.TrackId, moqObjHeader.ObjectSequence, moqObjHeader.GroupSequence))
+		}
+		groupObjects[moqObjHeader.ObjectSequence] = true
+
+		if moqObjHeader.GroupSequence > state.largestGroup {
+			state.largestGroup = moqObjHeader.GroupSequence
+			// Forget groups we do NOT accept anymore
+			for group := range state.groups {
+				if group+MAX_TRACK_GROUP_BACKWARDS_JUMP < state.largestGroup {
+					delete(state.groups, group)
+				}
 			}
 		}
 	}
+
+	if err != nil {
+		s.sequenceViolations++
+	}
 	return
 }
 
-func (s *MoqSession) NeedsToBeDForwarded(cacheKey string) bool {
+func (s *MoqSession) GetSequenceViolations() uint64 {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	// Cachekey example: simplechat/foo/1/0 [trackNamespace/trackName/Group/Obj]
+	return s.sequenceViolations
+}
 
-	cacheKeyItems := strings.Split(cacheKey, "/")
-	if len(cacheKeyItems) >= 2 {
-		cacheKeyTrackNamespace := cacheKeyItems[0]
-		cacheKeyTrackName := cacheKeyItems[1]
-		for k := range s.tracks {
-			// k [trackNamespace/trackName]
-			if k == cacheKeyTrackNamespace+"/"+cacheKeyTrackName {
-				return true
-			}
+// AddSubscribeRequest Adds a new subscription, if the track is already subscribed applies the duplicate policy (update keeps alias and state)
+func (s *MoqSession) AddSubscribeRequest(subscribe moqhelpers.MoqMessageSubscribe, duplicatePolicy MoqDuplicateSubscribePolicy) (duplicated bool, validated bool, localTrackId uint64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keyStr := subscribe.TrackNamespace + "/" + subscribe.TrackName
+	subscribeExt, found := s.tracks[keyStr]
+	if found {
+		duplicated = true
+		if duplicatePolicy != MoqDuplicateSubscribePolicyUpdate {
+			err = errors.New(fmt.Sprintf("Track %s already subscribed", keyStr))
+			return
 		}
+		subscribeExt.MoqMessageSubscribe = subscribe
+		s.tracks[keyStr] = subscribeExt
+		validated = subscribeExt.validated
+		localTrackId = subscribeExt.localTrackId
+		return
 	}
-	return false
+
+	if s.Role == moqhelpers.MoqRoleSubscriber && len(s.tracks) > MAX_SUBSCRIBE_TRACKS_PER_SESSION {
+		err = errors.New("Max subscribe tracks per session reached, can NOT add a new track")
+		return
+	}
+
+	// Local aliases are never reused in the session
+	localTrackId = s.nextLocalTrackId
+	s.nextLocalTrackId++
+	s.tracks[keyStr] = MoqMessageSubscribeExtended{subscribe, 0, localTrackId, 0, false, false}
+	return
 }
 
-func (s *MoqSession) AddSubscribeRequest(subscribe moqhelpers.MoqMessageSubscribe) error {
+// GetSubscriptionExpires Expires of a validated subscription
+func (s *MoqSession) GetSubscriptionExpires(trackNamespace string, trackName string) (expires uint64) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	subscribeExt, found := s.tracks[trackNamespace+"/"+trackName]
+	if found {
+		expires = subscribeExt.expires
+	}
+	return
+}
+
+func (s *MoqSession) GetSubscribedTracks() (tracks []MoqTrack) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, subscribeExt := range s.tracks {
+		tracks = append(tracks, MoqTrack{subscribeExt.TrackNamespace, subscribeExt.TrackName})
+	}
+	return
+}
+
+// AddWildcardSubscription Adds an already validated subscription for a track matched by a wildcard subscription
+func (s *MoqSession) AddWildcardSubscription(trackNamespace string, trackName string) (added bool, localTrackId uint64, err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	keyStr := trackNamespace + "/" + trackName
+	_, found := s.tracks[keyStr]
+	if found {
+		return
+	}
 	if s.Role == moqhelpers.MoqRoleSubscriber && len(s.tracks) > MAX_SUBSCRIBE_TRACKS_PER_SESSION {
-		return errors.New("Max subscribe tracks per session reached, can NOT add a new track")
+		err = errors.New("Max subscribe tracks per session reached, can NOT add a new wildcard track")
+		return
 	}
 
-	moqSubscribeExt := MoqMessageSubscribeExtended{subscribe, 0, 0, false}
-	s.tracks[subscribe.TrackNamespace+"/"+subscribe.TrackName] = moqSubscribeExt
-	return nil
+	localTrackId = s.nextLocalTrackId
+	s.nextLocalTrackId++
+	s.tracks[keyStr] = MoqMessageSubscribeExtended{moqhelpers.MoqMessageSubscribe{TrackNamespace: trackNamespace, TrackName: trackName}, 0, localTrackId, 0, true, true}
+	added = true
+	return
 }
 
-func (s *MoqSession) HasPendingTrackSubscriptionUpdate(trackNamespace string, trackName string, trackId uint64, expires uint64) (updated bool) {
+// RemoveWildcardSubscriptions Removes the subscriptions created from wildcards that match
+func (s *MoqSession) RemoveWildcardSubscriptions(match func(track MoqTrack) bool) (removed []MoqTrack) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for keyStr, subscribeExt := range s.tracks {
+		track := MoqTrack{subscribeExt.TrackNamespace, subscribeExt.TrackName}
+		if subscribeExt.wildcard && match(track) {
+			delete(s.tracks, keyStr)
+			removed = append(removed, track)
+		}
+	}
+	return
+}
+
+func (s *MoqSession) RemoveSubscribeRequest(trackNamespace string, trackName string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keyStr := trackNamespace + "/" + trackName
+	subscribeExt, found := s.tracks[keyStr]
+	if found {
+		delete(s.tracks, keyStr)
+
+		s.objQueueCond.L.Lock()
+		delete(s.objQueueLags, subscribeExt.localTrackId)
+		s.objQueueCond.L.Unlock()
+	} else {
+		err = errors.New(fmt.Sprintf("Could NOT find subscription %s to delete", keyStr))
+	}
+	return err
+}
+
+// EndSubscription Removes a validated subscription, returns the last object sent for it
+func (s *MoqSession) EndSubscription(trackNamespace string, trackName string) (found bool, finalGroup uint64, finalObject uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keyStr := trackNamespace + "/" + trackName
+	subscribeExt, found := s.tracks[keyStr]
+	if !found || !subscribeExt.validated {
+		found = false
+		return
+	}
+	delete(s.tracks, keyStr)
+
+	s.objQueueCond.L.Lock()
+	lag, foundLag := s.objQueueLags[subscribeExt.localTrackId]
+	if foundLag {
+		finalGroup = lag.sentGroup
+		finalObject = lag.sentObject
+	}
+	delete(s.objQueueLags, subscribeExt.localTrackId)
+	s.objQueueCond.L.Unlock()
+	return
+}
+
+// HasPendingTrackSubscriptionUpdate Validates the subscription with the publisher trackId, returns the local alias to use in this session
+func (s *MoqSession) HasPendingTrackSubscriptionUpdate(trackNamespace string, trackName string, trackId uint64, expires uint64) (updated bool, localTrackId uint64) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -187,8 +799,10 @@ func (s *MoqSession) HasPendingTrackSubscriptionUpdate(trackNamespace string, tr
 			subscribeExt.validated = true
 			subscribeExt.trackId = trackId
 			subscribeExt.expires = expires
+			s.tracks[trackNamespace+"/"+trackName] = subscribeExt
 
 			updated = true
+			localTrackId = subscribeExt.localTrackId
 		}
 	}
 	return
@@ -199,45 +813,308 @@ func (s *MoqSession) HasPendingTrackSubscriptionDelete(trackNamespace string, tr
 	defer s.lock.Unlock()
 
 	keyStr := trackNamespace + "/" + trackName
-	_, found := s.tracks[keyStr]
-	if found {
+	subscribeExt, found := s.tracks[keyStr]
+	if found && !subscribeExt.validated {
 		delete(s.tracks, keyStr)
 		deleted = true
 	}
 	return
 }
 
+// ResolveAuthToken Applies the token alias operation and returns the token value to use as auth info
+func (s *MoqSession) ResolveAuthToken(authToken moqhelpers.MoqAuthToken) (authInfo string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if authToken.AliasType == moqhelpers.MoqAuthTokenAliasTypeUseValue {
+		authInfo = authToken.Value
+	} else if authToken.AliasType == moqhelpers.MoqAuthTokenAliasTypeRegister {
+		_, found := s.authTokens[authToken.Alias]
+		if found {
+			err = errors.New(fmt.Sprintf("Auth token alias %d already registered", authToken.Alias))
+		} else if len(s.authTokens) >= MAX_AUTH_TOKEN_ALIASES_PER_SESSION {
+			err = errors.New(fmt.Sprintf("Max auth token aliases per session reached (%d), can NOT register alias %d", MAX_AUTH_TOKEN_ALIASES_PER_SESSION, authToken.Alias))
+		} else {
+			s.authTokens[authToken.Alias] = authToken
+			authInfo = authToken.Value
+		}
+	} else if authToken.AliasType == moqhelpers.MoqAuthTokenAliasTypeUseAlias {
+		registeredToken, found := s.authTokens[authToken.Alias]
+		if found {
+			authInfo = registeredToken.Value
+		} else {
+			err = errors.New(fmt.Sprintf("Unknown auth token alias %d", authToken.Alias))
+		}
+	} else if authToken.AliasType == moqhelpers.MoqAuthTokenAliasTypeDelete {
+		_, found := s.authTokens[authToken.Alias]
+		if found {
+			delete(s.authTokens, authToken.Alias)
+		} else {
+			err = errors.New(fmt.Sprintf("Unknown auth token alias %d to delete", authToken.Alias))
+		}
+	} else {
+		err = errors.New(fmt.Sprintf("Invalid auth token alias type %d", authToken.AliasType))
+	}
+	return
+}
+
+func isValidStateTransition(current MoqSessionState, next MoqSessionState) bool {
+	if current == MoqSessionStateSetup {
+		return next == MoqSessionStateEstablished || next == MoqSessionStateDraining || next == MoqSessionStateClosed
+	} else if current == MoqSessionStateEstablished {
+		return next == MoqSessionStateDraining || next == MoqSessionStateClosed
+	} else if current == MoqSessionStateDraining {
+		return next == MoqSessionStateClosed
+	}
+	return false
+}
+
+func IsValidDuplicateSubscribePolicy(policy MoqDuplicateSubscribePolicy) bool {
+	return policy == MoqDuplicateSubscribePolicyReject || policy == MoqDuplicateSubscribePolicyUpdate
+}
+
+func IsValidObjQueuePolicy(policy MoqObjQueuePolicy) bool {
+	return policy == MoqObjQueuePolicyDropOldest || policy == MoqObjQueuePolicyDropLowestPriority || policy == MoqObjQueuePolicyDisconnect
+}
+
+// StopThreads Closes the session and signals its threads to finish, it can be called several times
 func (s *MoqSession) StopThreads() {
-	s.ReceivedObject("")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.state == MoqSessionStateClosed {
+		return
+	}
+	s.state = MoqSessionStateClosed
+
+	s.objQueueCond.L.Lock()
+	s.objQueueStop = true
+	s.objQueueCond.L.Unlock()
+	s.objQueueCond.Signal()
+
 	s.forwardSubscribeStop()
 	s.forwardSubscribeResponseStop()
 }
 
-func (s *MoqSession) ReceivedObject(cacheKey string) {
-	s.channelObject <- cacheKey
+// ReceivedObject Queues the object to be sent, it never blocks (applies queue policy if full). Subscriptions NOT answered with SUBSCRIBE_OK yet do NOT get objects
+func (s *MoqSession) ReceivedObject(trackNamespace string, trackName string, cacheKey string, moqObjHeader moqobject.MoqObjectHeader) {
+	s.lock.RLock()
+	subscribeExt, found := s.tracks[trackNamespace+"/"+trackName]
+	state := s.state
+	s.lock.RUnlock()
+
+	if !found || !subscribeExt.validated || state != MoqSessionStateEstablished {
+		return
+	}
+	item := moqObjectQueueItem{cacheKey, subscribeExt.localTrackId, moqObjHeader.SendOrder, moqObjHeader.GroupSequence, moqObjHeader.ObjectSequence}
+
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	if s.objQueueStop {
+		return
+	}
+
+	lag, foundLag := s.objQueueLags[item.localTrackId]
+	if !foundLag {
+		lag = &moqSubscriptionLag{latestGroup: item.groupSequence, sentGroup: item.groupSequence}
+		s.objQueueLags[item.localTrackId] = lag
+	}
+	if item.groupSequence > lag.latestGroup {
+		lag.latestGroup = item.groupSequence
+		if s.skipToLatestGroup {
+			s.purgeQueuedOlderGroups(item.localTrackId, item.groupSequence)
+		}
+	}
+	if len(s.objQueue) >= s.objQueueSize {
+		s.droppedObjects++
+		if s.objQueuePolicy == MoqObjQueuePolicyDropOldest {
+			s.objQueue = append(s.objQueue[1:], item)
+		} else if s.objQueuePolicy == MoqObjQueuePolicyDropLowestPriority {
+			lowestIndex := -1
+			for i, queuedItem := range s.objQueue {
+				if queuedItem.sendOrder > item.sendOrder && (lowestIndex < 0 || queuedItem.sendOrder > s.objQueue[lowestIndex].sendOrder) {
+					lowestIndex = i
+				}
+			}
+			// If the new one is the lowest priority it is dropped
+			if lowestIndex >= 0 {
+				s.objQueue = append(s.objQueue[:lowestIndex], s.objQueue[lowestIndex+1:]...)
+				s.objQueue = append(s.objQueue, item)
+			}
+		} else {
+			s.slowSubscriber = true
+			s.objQueueStop = true
+		}
+	} else {
+		s.objQueue = append(s.objQueue, item)
+	}
+	s.objQueueCond.Signal()
+}
+
+// GetNewObject Blocks until there is a new object to send, stop indicates the queue is finished
+func (s *MoqSession) GetNewObject() (cacheKey string, localTrackId uint64, stop bool) {
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	for len(s.objQueue) == 0 && !s.objQueueStop {
+		s.objQueueCond.Wait()
+	}
+	if s.objQueueStop {
+		stop = true
+		return
+	}
+
+	item := s.objQueue[0]
+	s.objQueue = s.objQueue[1:]
+	cacheKey = item.cacheKey
+	localTrackId = item.localTrackId
+
+	lag, foundLag := s.objQueueLags[item.localTrackId]
+	if foundLag && (item.groupSequence > lag.sentGroup || (item.groupSequence == lag.sentGroup && item.objectSequence > lag.sentObject)) {
+		lag.sentGroup = item.groupSequence
+		lag.sentObject = item.objectSequence
+	}
+
+	return
+}
+
+// GetSubscriptionLag Number of groups the subscriber is behind the newest group received for that track
+func (s *MoqSession) GetSubscriptionLag(trackNamespace string, trackName string) (found bool, lagGroups uint64) {
+	s.lock.RLock()
+	subscribeExt, foundTrack := s.tracks[trackNamespace+"/"+trackName]
+	s.lock.RUnlock()
+	if !foundTrack {
+		return
+	}
+
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	lag, found := s.objQueueLags[subscribeExt.localTrackId]
+	if found {
+		lagGroups = lag.latestGroup - lag.sentGroup
+	}
+	return
 }
 
-func (s *MoqSession) GetNewObject() string {
-	return <-s.channelObject
+// GetQueuedObjects Objects of that track waiting to be sent
+func (s *MoqSession) GetQueuedObjects(trackNamespace string, trackName string) (queued int) {
+	s.lock.RLock()
+	subscribeExt, found := s.tracks[trackNamespace+"/"+trackName]
+	s.lock.RUnlock()
+	if !found {
+		return
+	}
+
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	for _, item := range s.objQueue {
+		if item.localTrackId == subscribeExt.localTrackId {
+			queued++
+		}
+	}
+	return
+}
+
+func (s *MoqSession) GetSkippedObjects() uint64 {
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	return s.skippedObjects
+}
+
+// HasHigherPriorityQueued Indicates there are objects waiting to be sent with higher priority (lower send order)
+func (s *MoqSession) HasHigherPriorityQueued(sendOrder uint64) bool {
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	for _, item := range s.objQueue {
+		if item.sendOrder < sendOrder {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MoqSession) AddRateLimitedObject() {
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	s.rateLimitedObjects++
+}
+
+func (s *MoqSession) AddPriorityDroppedObject() {
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	s.priorityDroppedObjects++
+}
+
+func (s *MoqSession) purgeQueuedOlderGroups(localTrackId uint64, groupSequence uint64) {
+	activeQueue := s.objQueue[:0]
+	for _, queuedItem := range s.objQueue {
+		if queuedItem.localTrackId == localTrackId && queuedItem.groupSequence < groupSequence {
+			s.skippedObjects++
+		} else {
+			activeQueue = append(activeQueue, queuedItem)
+		}
+	}
+	s.objQueue = activeQueue
+}
+
+// IsSlowSubscriber Indicates the objects queue overflowed with disconnect policy
+func (s *MoqSession) IsSlowSubscriber() bool {
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	return s.slowSubscriber
+}
+
+func (s *MoqSession) GetDroppedObjects() uint64 {
+	s.objQueueCond.L.Lock()
+	defer s.objQueueCond.L.Unlock()
+
+	return s.droppedObjects
 }
 
 func (s *MoqSession) ForwardSubscribe(subscribe moqhelpers.MoqMessageSubscribe) {
-	subscribeMsg := MoqSubscribeChannelMessage{subscribe, false}
+	subscribeMsg := MoqSubscribeChannelMessage{subscribe, false, false}
 
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state != MoqSessionStateEstablished {
+		return
+	}
 	s.channelSubscribe <- subscribeMsg
 }
 
-func (s *MoqSession) GetNewSubscribe() (subscribe moqhelpers.MoqMessageSubscribe, stop bool) {
+func (s *MoqSession) ForwardUnSubscribe(unSubscribe moqhelpers.MoqMessageUnSubscribe) {
+	unSubscribeMsg := MoqSubscribeChannelMessage{moqhelpers.MoqMessageSubscribe{TrackNamespace: unSubscribe.TrackNamespace, TrackName: unSubscribe.TrackName}, true, false}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state != MoqSessionStateEstablished {
+		return
+	}
+	s.channelSubscribe <- unSubscribeMsg
+}
+
+func (s *MoqSession) GetNewSubscribe() (subscribe moqhelpers.MoqMessageSubscribe, unSubscribe bool, stop bool) {
 	subscribeExt := <-s.channelSubscribe
 
 	subscribe = subscribeExt.MoqMessageSubscribe
+	unSubscribe = subscribeExt.unSubscribe
 	stop = subscribeExt.stop
 
 	return
 }
 
 func (s *MoqSession) forwardSubscribeStop() {
-	subscribeStop := MoqSubscribeChannelMessage{moqhelpers.MoqMessageSubscribe{}, true}
+	subscribeStop := MoqSubscribeChannelMessage{moqhelpers.MoqMessageSubscribe{}, false, true}
 
 	s.channelSubscribe <- subscribeStop
 }
@@ -245,15 +1122,39 @@ func (s *MoqSession) forwardSubscribeStop() {
 func (s *MoqSession) ForwardSubscribeResponseOk(subscribeOk moqhelpers.MoqMessageSubscribeOk) {
 	subscribeOkMsg := MoqSubscribeResponseChannelMessage{subscribeOk, moqhelpers.MoqIdSubscribeOk, false}
 
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state != MoqSessionStateEstablished {
+		return
+	}
 	s.channelSubscribeResponse <- subscribeOkMsg
 }
 
 func (s *MoqSession) ForwardSubscribeResponseError(subscribeError moqhelpers.MoqMessageSubscribeError) {
 	subscribeErrorMsg := MoqSubscribeResponseChannelMessage{subscribeError, moqhelpers.MoqIdSubscribeError, false}
 
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state != MoqSessionStateEstablished {
+		return
+	}
 	s.channelSubscribeResponse <- subscribeErrorMsg
 }
 
+func (s *MoqSession) ForwardSubscribeRst(subscribeRst moqhelpers.MoqMessageSubscribeRst) {
+	subscribeRstMsg := MoqSubscribeResponseChannelMessage{subscribeRst, moqhelpers.MoqIdSubscribeRst, false}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state != MoqSessionStateEstablished {
+		return
+	}
+	s.channelSubscribeResponse <- subscribeRstMsg
+}
+
 func (s *MoqSession) GetNewSubscribeResponse() (moqSubscribeResponse interface{}, subscribeMessageType moqhelpers.MoqMessageType, stop bool) {
 	subscribeResponseMsg := <-s.channelSubscribeResponse
 
@@ -0,0 +1,198 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqsession
+
+import (
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Session timeouts after SETUP
+const TEST_ANNOUNCE_TIMEOUT = 2 * time.Second
+const TEST_SUBSCRIBE_TIMEOUT = 3 * time.Second
+const TEST_OBJECTS_TIMEOUT = 10 * time.Second
+
+func newTestSession() *MoqSession {
+	return newTestSessionWithClock(moqhelpers.MoqRoleSubscriber, moqclock.NewFake(time.Unix(0, 0)))
+}
+
+func newTestSessionWithClock(role moqhelpers.MoqRole, clock moqclock.Clock) *MoqSession {
+	return New("test-session", moqhelpers.MOQ_SUPPORTED_VERSION, role, MoqSessionMetadata{}, 16, MoqObjQueuePolicyDropOldest, false, clock)
+}
+
+// Sessions that do NOT do anything for their role after SETUP are idle once the timeout of their role passes
+func TestCheckIdle(t *testing.T) {
+	tests := []struct {
+		name string
+		role moqhelpers.MoqRole
+		// Control message received after SETUP (0 none)
+		received moqhelpers.MoqMessageType
+		// Last time the session is NOT idle
+		wantIdleAfter time.Duration
+		wantReason    string
+	}{
+		{name: "publisher without ANNOUNCE", role: moqhelpers.MoqRolePublisher, wantIdleAfter: TEST_ANNOUNCE_TIMEOUT, wantReason: "no ANNOUNCE"},
+		{name: "publisher with ANNOUNCE", role: moqhelpers.MoqRolePublisher, received: moqhelpers.MoqIdMessageAnnounce, wantIdleAfter: TEST_OBJECTS_TIMEOUT, wantReason: "no objects"},
+		{name: "subscriber without SUBSCRIBE", role: moqhelpers.MoqRoleSubscriber, wantIdleAfter: TEST_SUBSCRIBE_TIMEOUT, wantReason: "no SUBSCRIBE"},
+		{name: "subscriber with SUBSCRIBE", role: moqhelpers.MoqRoleSubscriber, received: moqhelpers.MoqIdSubscribe, wantIdleAfter: TEST_OBJECTS_TIMEOUT, wantReason: "no objects"},
+		{name: "relay without ANNOUNCE nor SUBSCRIBE", role: moqhelpers.MoqRoleBoth, wantIdleAfter: TEST_SUBSCRIBE_TIMEOUT, wantReason: "no ANNOUNCE / SUBSCRIBE"},
+		{name: "relay with SUBSCRIBE", role: moqhelpers.MoqRoleBoth, received: moqhelpers.MoqIdSubscribe, wantIdleAfter: TEST_OBJECTS_TIMEOUT, wantReason: "no objects"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := moqclock.NewFake(time.Unix(0, 0))
+			s := newTestSessionWithClock(tt.role, clock)
+			if tt.received != 0 {
+				s.ControlMessageReceived(tt.received)
+			}
+
+			clock.Advance(tt.wantIdleAfter)
+			if idle, reason := s.CheckIdle(TEST_ANNOUNCE_TIMEOUT, TEST_SUBSCRIBE_TIMEOUT, TEST_OBJECTS_TIMEOUT); idle {
+				t.Fatalf("Session idle at %v (%s), want idle after it", tt.wantIdleAfter, reason)
+			}
+			clock.Advance(time.Millisecond)
+			idle, reason := s.CheckIdle(TEST_ANNOUNCE_TIMEOUT, TEST_SUBSCRIBE_TIMEOUT, TEST_OBJECTS_TIMEOUT)
+			if !idle || !strings.HasPrefix(reason, tt.wantReason) {
+				t.Fatalf("Session idle %t (%s), want idle (%s)", idle, reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+// Objects received push the objects timeout, 0 timeouts are disabled
+func TestCheckIdleObjects(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	s := newTestSessionWithClock(moqhelpers.MoqRoleSubscriber, clock)
+	s.ControlMessageReceived(moqhelpers.MoqIdSubscribe)
+
+	clock.Advance(TEST_OBJECTS_TIMEOUT)
+	s.TouchObjects()
+	clock.Advance(TEST_OBJECTS_TIMEOUT)
+	if idle, reason := s.CheckIdle(TEST_ANNOUNCE_TIMEOUT, TEST_SUBSCRIBE_TIMEOUT, TEST_OBJECTS_TIMEOUT); idle {
+		t.Fatalf("Session receiving objects should NOT be idle (%s)", reason)
+	}
+	clock.Advance(time.Hour)
+	if idle, reason := s.CheckIdle(0, 0, 0); idle {
+		t.Fatalf("Session should NOT be idle with timeouts disabled (%s)", reason)
+	}
+}
+
+// Stall watchdog idle time, any activity resets it
+func TestGetIdleTime(t *testing.T) {
+	clock := moqclock.NewFake(time.Unix(0, 0))
+	s := newTestSessionWithClock(moqhelpers.MoqRoleSubscriber, clock)
+
+	clock.Advance(5 * time.Second)
+	if idleTime := s.GetIdleTime(); idleTime != 5*time.Second {
+		t.Fatalf("Idle time %v, want %v", idleTime, 5*time.Second)
+	}
+	s.Touch()
+	clock.Advance(time.Second)
+	if idleTime := s.GetIdleTime(); idleTime != time.Second {
+		t.Fatalf("Idle time after activity %v, want %v", idleTime, time.Second)
+	}
+	s.TouchObjects()
+	if idleTime := s.GetIdleTime(); idleTime != 0 {
+		t.Fatalf("Idle time after objects %v, want 0", idleTime)
+	}
+}
+
+func TestAddSubscribeRequestDuplicated(t *testing.T) {
+	first := moqhelpers.MoqMessageSubscribe{TrackNamespace: "ns", TrackName: "video", StartGroup: moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeRelativePrevious, Value: 0}}
+	second := moqhelpers.MoqMessageSubscribe{TrackNamespace: "ns", TrackName: "video", StartGroup: moqhelpers.MoqLocation{Type: moqhelpers.MoqLocationTypeAbsolute, Value: 10}}
+
+	tests := []struct {
+		name   string
+		policy MoqDuplicateSubscribePolicy
+		// SUBSCRIBE_OK received (from upstream) before the second SUBSCRIBE
+		validatedBefore bool
+
+		wantErr       bool
+		wantValidated bool
+		// Subscription params after the second SUBSCRIBE
+		wantStartGroup moqhelpers.MoqLocation
+	}{
+		{name: "reject", policy: MoqDuplicateSubscribePolicyReject, validatedBefore: true, wantErr: true, wantValidated: false, wantStartGroup: first.StartGroup},
+		{name: "reject before validated", policy: MoqDuplicateSubscribePolicyReject, validatedBefore: false, wantErr: true, wantValidated: false, wantStartGroup: first.StartGroup},
+		{name: "update", policy: MoqDuplicateSubscribePolicyUpdate, validatedBefore: true, wantErr: false, wantValidated: true, wantStartGroup: second.StartGroup},
+		{name: "update before SUBSCRIBE_OK validated", policy: MoqDuplicateSubscribePolicyUpdate, validatedBefore: false, wantErr: false, wantValidated: false, wantStartGroup: second.StartGroup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession()
+
+			duplicated, validated, firstLocalTrackId, err := s.AddSubscribeRequest(first, tt.policy)
+			if err != nil || duplicated || validated {
+				t.Fatalf("first SUBSCRIBE: duplicated %t, validated %t, err %v", duplicated, validated, err)
+			}
+			if tt.validatedBefore {
+				updated, localTrackId := s.HasPendingTrackSubscriptionUpdate("ns", "video", 7, 1000)
+				if !updated || localTrackId != firstLocalTrackId {
+					t.Fatalf("SUBSCRIBE_OK: updated %t, localTrackId %d (want %d)", updated, localTrackId, firstLocalTrackId)
+				}
+			}
+
+			duplicated, validated, localTrackId, err := s.AddSubscribeRequest(second, tt.policy)
+			if !duplicated {
+				t.Fatalf("second SUBSCRIBE should be duplicated")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("second SUBSCRIBE err %v, want error %t", err, tt.wantErr)
+			}
+			if validated != tt.wantValidated {
+				t.Fatalf("second SUBSCRIBE validated %t, want %t", validated, tt.wantValidated)
+			}
+			if !tt.wantErr && localTrackId != firstLocalTrackId {
+				t.Fatalf("update should keep the track alias %d, got %d", firstLocalTrackId, localTrackId)
+			}
+			if got := s.tracks["ns/video"].StartGroup; got != tt.wantStartGroup {
+				t.Fatalf("subscription start group %v, want %v", got, tt.wantStartGroup)
+			}
+			if len(s.GetSubscribedTracks()) != 1 {
+				t.Fatalf("duplicated SUBSCRIBE should NOT add a subscription, got %d", len(s.GetSubscribedTracks()))
+			}
+
+			if !tt.validatedBefore && !tt.wantErr {
+				// SUBSCRIBE_OK arrives after the update, it validates the updated subscription once
+				updated, okLocalTrackId := s.HasPendingTrackSubscriptionUpdate("ns", "video", 7, 1000)
+				if !updated || okLocalTrackId != firstLocalTrackId {
+					t.Fatalf("SUBSCRIBE_OK after update: updated %t, localTrackId %d (want %d)", updated, okLocalTrackId, firstLocalTrackId)
+				}
+				if updated, _ = s.HasPendingTrackSubscriptionUpdate("ns", "video", 7, 1000); updated {
+					t.Fatalf("subscription should only be validated once")
+				}
+			}
+			if tt.validatedBefore && !tt.wantErr && s.GetSubscriptionExpires("ns", "video") != 1000 {
+				t.Fatalf("update should keep the validated expires, got %d", s.GetSubscriptionExpires("ns", "video"))
+			}
+		})
+	}
+}
+
+// Objects are only queued for subscriptions answered with SUBSCRIBE_OK
+func TestReceivedObjectValidated(t *testing.T) {
+	s := newTestSession()
+	s.SetState(MoqSessionStateEstablished)
+	if _, _, _, err := s.AddSubscribeRequest(moqhelpers.MoqMessageSubscribe{TrackNamespace: "ns", TrackName: "video"}, MoqDuplicateSubscribePolicyReject); err != nil {
+		t.Fatalf("Subscribing, err: %v", err)
+	}
+
+	s.ReceivedObject("ns", "video", "ns/video/0/0", moqobject.MoqObjectHeader{GroupSequence: 0, ObjectSequence: 0})
+	if queued := s.GetQueuedObjects("ns", "video"); queued != 0 {
+		t.Fatalf("Queued objects before SUBSCRIBE_OK %d, want 0", queued)
+	}
+
+	s.HasPendingTrackSubscriptionUpdate("ns", "video", 7, 0)
+	s.ReceivedObject("ns", "video", "ns/video/0/1", moqobject.MoqObjectHeader{GroupSequence: 0, ObjectSequence: 1})
+	if queued := s.GetQueuedObjects("ns", "video"); queued != 1 {
+		t.Fatalf("Queued objects after SUBSCRIBE_OK %d, want 1", queued)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqtest
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+// Error code of the streams reset by the chaos middleware
+const TEST_CHAOS_RESET_ERROR_CODE = webtransport.StreamErrorCode(0xc4a05)
+
+// MoqTestChaosConfig Faults injected in the relay side streams: ingest (read by the relay) and / or egress (written by the relay)
+type MoqTestChaosConfig struct {
+	// Same seed and same stream ids inject the same faults (0 uses the relay ChaosSeed)
+	Seed   int64
+	Ingest bool
+	Egress bool
+	// Random delay (up to) before each read / write
+	MaxDelayMs uint64
+	// Writes are split in random chunks and reads return random smaller chunks, so messages arrive fragmented
+	PartialWrites bool
+	// Probability (0 to 1) of resetting an object (unidirectional) stream on each read / write, the control stream is never reset
+	ResetProbability float64
+}
+
+// MoqTestChaosStats Faults injected so far
+type MoqTestChaosStats struct {
+	Delays        uint64
+	PartialWrites uint64
+	IngestResets  uint64
+	EgressResets  uint64
+}
+
+type moqTestChaos struct {
+	config MoqTestChaosConfig
+
+	delays        atomic.Uint64
+	partialWrites atomic.Uint64
+	ingestResets  atomic.Uint64
+	egressResets  atomic.Uint64
+}
+
+// moqTestChaosFaults Faults of a stream direction, decided by its own random source (seed + stream id) so they do NOT depend on the goroutines scheduling
+type moqTestChaosFaults struct {
+	chaos    *moqTestChaos
+	canReset bool
+	resets   *atomic.Uint64
+
+	// Protected
+	random *rand.Rand
+	lock   *sync.Mutex
+}
+
+func newChaos(config MoqTestChaosConfig) *moqTestChaos {
+	return &moqTestChaos{config: config}
+}
+
+func (chaos *moqTestChaos) getStats() MoqTestChaosStats {
+	if chaos == nil {
+		return MoqTestChaosStats{}
+	}
+	return MoqTestChaosStats{Delays: chaos.delays.Load(), PartialWrites: chaos.partialWrites.Load(), IngestResets: chaos.ingestResets.Load(), EgressResets: chaos.egressResets.Load()}
+}
+
+// wrapStream Control stream, delays and partial writes only
+func (chaos *moqTestChaos) wrapStream(stream webtransport.Stream) webtransport.Stream {
+	if chaos == nil {
+		return stream
+	}
+	return &moqTestChaosStream{Stream: stream, ingest: chaos.newFaults(stream.StreamID(), true, false), egress: chaos.newFaults(stream.StreamID(), false, false)}
+}
+
+func (chaos *moqTestChaos) wrapSendStream(stream webtransport.SendStream) webtransport.SendStream {
+	if chaos == nil || !chaos.config.Egress {
+		return stream
+	}
+	return &moqTestChaosSendStream{SendStream: stream, faults: chaos.newFaults(stream.StreamID(), false, true)}
+}
+
+func (chaos *moqTestChaos) wrapReceiveStream(stream webtransport.ReceiveStream) webtransport.ReceiveStream {
+	if chaos == nil || !chaos.config.Ingest {
+		return stream
+	}
+	return &moqTestChaosReceiveStream{ReceiveStream: stream, faults: chaos.newFaults(stream.StreamID(), true, true)}
+}
+
+// newFaults Returns nil if the direction has NO faults
+func (chaos *moqTestChaos) newFaults(id quic.StreamID, ingest bool, canReset bool) *moqTestChaosFaults {
+	resets := &chaos.egressResets
+	seed := chaos.config.Seed*1000003 + int64(id)*2
+	if ingest {
+		if !chaos.config.Ingest {
+			return nil
+		}
+		resets = &chaos.ingestResets
+		seed++
+	} else if !chaos.config.Egress {
+		return nil
+	}
+	return &moqTestChaosFaults{chaos: chaos, canReset: canReset, resets: resets, random: rand.New(rand.NewSource(seed)), lock: new(sync.Mutex)}
+}
+
+// next Decides the faults of the next read / write of size bytes, it waits the delay
+func (faults *moqTestChaosFaults) next(size int) (chunk int, reset bool) {
+	config := faults.chaos.config
+
+	faults.lock.Lock()
+	if faults.canReset && config.ResetProbability > 0 && faults.random.Float64() < config.ResetProbability {
+		faults.lock.Unlock()
+		faults.resets.Add(1)
+		reset = true
+		return
+	}
+	var delay time.Duration
+	if config.MaxDelayMs > 0 {
+		delay = time.Duration(faults.random.Int63n(int64(config.MaxDelayMs)+1)) * time.Millisecond
+	}
+	chunk = size
+	if config.PartialWrites && size > 1 {
+		chunk = 1 + faults.random.Intn(size)
+	}
+	faults.lock.Unlock()
+
+	if chunk < size {
+		faults.chaos.partialWrites.Add(1)
+	}
+	if delay > 0 {
+		faults.chaos.delays.Add(1)
+		time.Sleep(delay)
+	}
+	return
+}
+
+func (faults *moqTestChaosFaults) write(stream io.Writer, cancel func(), p []byte) (n int, err error) {
+	for n < len(p) {
+		chunk, reset := faults.next(len(p) - n)
+		if reset {
+			cancel()
+			err = &webtransport.StreamError{ErrorCode: TEST_CHAOS_RESET_ERROR_CODE}
+			return
+		}
+		written, errWrite := stream.Write(p[n : n+chunk])
+		n += written
+		if errWrite != nil {
+			err = errWrite
+			return
+		}
+	}
+	return
+}
+
+func (faults *moqTestChaosFaults) read(stream io.Reader, cancel func(), p []byte) (n int, err error) {
+	chunk, reset := faults.next(len(p))
+	if reset {
+		cancel()
+		err = &webtransport.StreamError{ErrorCode: TEST_CHAOS_RESET_ERROR_CODE}
+		return
+	}
+	return stream.Read(p[:chunk])
+}
+
+// moqTestChaosStream Control stream with faults (nil direction has none)
+type moqTestChaosStream struct {
+	webtransport.Stream
+	ingest *moqTestChaosFaults
+	egress *moqTestChaosFaults
+}
+
+func (s *moqTestChaosStream) Write(p []byte) (int, error) {
+	if s.egress == nil {
+		return s.Stream.Write(p)
+	}
+	return s.egress.write(s.Stream, nil, p)
+}
+
+func (s *moqTestChaosStream) Read(p []byte) (int, error) {
+	if s.ingest == nil {
+		return s.Stream.Read(p)
+	}
+	return s.ingest.read(s.Stream, nil, p)
+}
+
+type moqTestChaosSendStream struct {
+	webtransport.SendStream
+	faults *moqTestChaosFaults
+}
+
+func (s *moqTestChaosSendStream) Write(p []byte) (int, error) {
+	return s.faults.write(s.SendStream, func() { s.SendStream.CancelWrite(TEST_CHAOS_RESET_ERROR_CODE) }, p)
+}
+
+type moqTestChaosReceiveStream struct {
+	webtransport.ReceiveStream
+	faults *moqTestChaosFaults
+}
+
+func (s *moqTestChaosReceiveStream) Read(p []byte) (int, error) {
+	return s.faults.read(s.ReceiveStream, func() { s.ReceiveStream.CancelRead(TEST_CHAOS_RESET_ERROR_CODE) }, p)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqtest
+
+import (
+	"context"
+	"facebookexperimental/moq-go-server/moqbandwidth"
+	"facebookexperimental/moq-go-server/moqclient"
+	"facebookexperimental/moq-go-server/moqclock"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const TEST_RELAY_ID = "test-relay"
+const TEST_RELAY_NAMESPACE = "/moq"
+
+// Defaults of the relay settings NOT set in its config
+const TEST_RELAY_OBJ_EXP_MS = 10 * 1000
+const TEST_RELAY_OBJ_QUEUE_SIZE = 1024
+const TEST_RELAY_SUBSCRIBE_RESPONSE_TIMEOUT_MS = 2 * 1000
+const TEST_RELAY_CACHE_CLEANUP_PERIOD_MS = 1000
+const TEST_RELAY_CHAOS_SEED = 1
+
+// MoqTestRelay In-process relay: forward table, cache and a MoqConnectionManagment per connected client, over in-memory sessions
+type MoqTestRelay struct {
+	FwdTable *moqfwdtable.MoqFwdTable
+	Objects  *moqmessageobjects.MoqMessageObjects
+	// Seed of SetChaos configs without it
+	ChaosSeed int64
+
+	connConfig moqconnectionmanagment.MoqConnectionConfig
+	ctx        context.Context
+	cancel     context.CancelFunc
+	sessions   *sync.WaitGroup
+	clients    atomic.Uint64
+	chaos      *moqTestChaos
+}
+
+// NewRelay Creates the relay with connConfig (zero values get the test defaults)
+func NewRelay(connConfig moqconnectionmanagment.MoqConnectionConfig) *MoqTestRelay {
+	if connConfig.Clock == nil {
+		connConfig.Clock = moqclock.New()
+	}
+	if connConfig.Bandwidth == nil {
+		// Unlimited
+		connConfig.Bandwidth = moqbandwidth.New(0, connConfig.Clock)
+	}
+	if connConfig.ObjExpMs == 0 {
+		connConfig.ObjExpMs = TEST_RELAY_OBJ_EXP_MS
+	}
+	if connConfig.ObjQueueSize == 0 {
+		connConfig.ObjQueueSize = TEST_RELAY_OBJ_QUEUE_SIZE
+		connConfig.ObjQueuePolicy = moqsession.MoqObjQueuePolicyDropOldest
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MoqTestRelay{
+		FwdTable:   moqfwdtable.New(TEST_RELAY_ID, TEST_RELAY_SUBSCRIBE_RESPONSE_TIMEOUT_MS, 0, false, connConfig.Clock),
+		Objects:    moqmessageobjects.New(TEST_RELAY_CACHE_CLEANUP_PERIOD_MS, 0, connConfig.Clock),
+		ChaosSeed:  TEST_RELAY_CHAOS_SEED,
+		connConfig: connConfig,
+		ctx:        ctx,
+		cancel:     cancel,
+		sessions:   new(sync.WaitGroup),
+	}
+}
+
+// Connect Creates an in-memory session to the relay (served by MoqConnectionManagment) and does the SETUP with role
+func (relay *MoqTestRelay) Connect(ctx context.Context, role moqhelpers.MoqRole) (client *moqclient.MoqClient, session *MoqTestSession, err error) {
+	clientName := fmt.Sprintf("client-%d", relay.clients.Add(1))
+	session, relaySession := NewSessionPair(relay.ctx, clientName)
+	relaySession.chaos = relay.chaos
+
+	relay.sessions.Add(1)
+	go func() {
+		defer relay.sessions.Done()
+		moqconnectionmanagment.MoqConnectionManagment(false, "", "", relay.ctx, relaySession, moqsession.MoqSessionMetadata{UserAgent: clientName}, TEST_RELAY_NAMESPACE, relay.FwdTable, relay.Objects, relay.connConfig)
+		// Session ended by the relay (ex: error), as the WebTransport handler does
+		relaySession.CloseWithError(0, "")
+	}()
+
+	client, err = moqclient.Setup(ctx, session, role)
+	return
+}
+
+// SetChaos Injects faults in the relay side streams of the sessions connected after it
+func (relay *MoqTestRelay) SetChaos(config MoqTestChaosConfig) {
+	if config.Seed == 0 {
+		config.Seed = relay.ChaosSeed
+	}
+	relay.chaos = newChaos(config)
+}
+
+// SetEgressBatching Batches the small objects (up to maxObjectBytes, 0 disabled) sent to the sessions connected after it
+func (relay *MoqTestRelay) SetEgressBatching(maxObjectBytes uint64) {
+	relay.connConfig.EgressBatchMaxObjectBytes = maxObjectBytes
+}
+
+// GetChaosStats Returns the faults injected so far
+func (relay *MoqTestRelay) GetChaosStats() MoqTestChaosStats {
+	return relay.chaos.getStats()
+}
+
+// Close Closes all the sessions and waits for them to finish
+func (relay *MoqTestRelay) Close() {
+	relay.cancel()
+	relay.sessions.Wait()
+	relay.FwdTable.Stop()
+	relay.Objects.Stop()
+}
@@ -0,0 +1,509 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqtest
+
+import (
+	"context"
+	"facebookexperimental/moq-go-server/moqclient"
+	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqsession"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Max duration of a test (its context is cancelled after it)
+const TEST_TIMEOUT_MS = 10 * 1000
+
+// Wait for a control message that is NOT expected (ex: a second SUBSCRIBE)
+const TEST_NO_MESSAGE_WAIT_MS = 300
+
+// Objects are NOT expected after this time without any
+const TEST_RECEIVE_IDLE_MS = 500
+
+// Test payloads ("[group]-[object]") are smaller, so they are batched
+const TEST_BATCH_MAX_OBJECT_BYTES = 100
+
+var chaosSeed = flag.Int64("chaos_seed", TEST_RELAY_CHAOS_SEED, "Seed of the faults injected by the chaos tests (same seed same faults)")
+var logLevel = flag.String("log_level", "fatal", "Log level of the relay (panic, fatal, error, warn, info, debug, trace)")
+
+// testPublisher Publisher client with its control messages read in background
+type testPublisher struct {
+	client *moqclient.MoqClient
+	// Client side of the session (to send streams by hand)
+	session *MoqTestSession
+	control chan interface{}
+}
+
+// testObject Object received by a subscriber
+type testObject struct {
+	header  moqobject.MoqObjectHeader
+	payload []byte
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid log_level %s: %v\n", *logLevel, err)
+		os.Exit(2)
+	}
+	log.SetLevel(level)
+	os.Exit(m.Run())
+}
+
+// Publisher announces, subscriber subscribes (forwarded to the publisher) and receives the objects
+func TestAnnounceSubscribeObject(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	publisher, subscriber, subscriberTrackId, _ := connectPublisherSubscriber(t, ctx, relay, 7)
+
+	publisher.sendObjects(t, ctx, 7, 0, 5)
+	checkObjects(t, receiveObjects(t, ctx, subscriber, 5), subscriberTrackId, 0, 5)
+}
+
+// SUBSCRIBE of a namespace nobody announced is rejected
+func TestSubscribeWithoutPublisher(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	subscriber := connectClient(t, ctx, relay, moqhelpers.MoqRoleSubscriber)
+
+	if _, err := subscriber.Subscribe("missing", "video", ""); err == nil {
+		t.Fatalf("SUBSCRIBE without publisher accepted")
+	}
+}
+
+// Rejected SUBSCRIBE does NOT keep the track subscribed, the same session can subscribe it again once it is published
+func TestSubscribeAgainAfterError(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	subscriber := connectClient(t, ctx, relay, moqhelpers.MoqRoleSubscriber)
+	if _, err := subscriber.Subscribe("test", "video", ""); err == nil {
+		t.Fatalf("SUBSCRIBE without publisher accepted")
+	}
+	if relay.FwdTable.HasTrackSubscribers("test", "video") {
+		t.Fatalf("Rejected subscriber should NOT get the objects of the track")
+	}
+
+	publisher := connectPublisher(t, ctx, relay, "test")
+	subscribed := subscribeAsync(subscriber, "test", "video")
+	publisher.expectSubscribe(t, ctx, 2)
+	subscriberTrackId := waitSubscribed(t, ctx, subscribed)
+	publisher.sendObjects(t, ctx, 2, 0, 3)
+	checkObjects(t, receiveObjects(t, ctx, subscriber, 3), subscriberTrackId, 0, 3)
+}
+
+// Sessions of an endpoint with a namespace prefix use their own namespaces, the relay adds the prefix (and removes it from the messages sent to them)
+func TestEndpointNamespacePrefix(t *testing.T) {
+	endpoint := moqconnectionmanagment.MoqEndpointData{Path: "/tenant1", NamespacePrefix: "tenant1/", TrackNamespace: "tenant1/*"}
+	ctx, relay := newTestRelayWithConfig(t, moqconnectionmanagment.MoqConnectionConfig{Endpoint: endpoint})
+	// The publisher gets the SUBSCRIBE of test/video, NOT tenant1/test/video
+	publisher, subscriber, subscriberTrackId, _ := connectPublisherSubscriber(t, ctx, relay, 5)
+	if !relay.FwdTable.HasTrackSubscribers("tenant1/test", "video") {
+		t.Fatalf("Relay track tenant1/test/video without subscribers")
+	}
+
+	publisher.sendObjects(t, ctx, 5, 0, 3)
+	checkObjects(t, receiveObjects(t, ctx, subscriber, 3), subscriberTrackId, 0, 3)
+}
+
+// Second ANNOUNCE of the same namespace is rejected (default policy)
+func TestDuplicatedAnnounce(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	connectPublisher(t, ctx, relay, "test")
+
+	second := connectClient(t, ctx, relay, moqhelpers.MoqRolePublisher)
+	if err := second.Announce("test", ""); err == nil {
+		t.Fatalf("Second ANNOUNCE of the same namespace accepted")
+	}
+}
+
+// A rejected ANNOUNCE (too many namespaces in the session) does NOT block the namespace for other publishers
+func TestRejectedAnnounceRollback(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	first := connectClient(t, ctx, relay, moqhelpers.MoqRolePublisher)
+	rejectedNamespace := ""
+	for i := 0; i <= moqsession.MAX_PUBLISH_NAMESPACES_PER_SESSION+1 && rejectedNamespace == ""; i++ {
+		trackNamespace := fmt.Sprintf("test%d", i)
+		if err := first.Announce(trackNamespace, ""); err != nil {
+			rejectedNamespace = trackNamespace
+		}
+	}
+	if rejectedNamespace == "" {
+		t.Fatalf("ANNOUNCE over the max namespaces per session accepted")
+	}
+
+	second := connectClient(t, ctx, relay, moqhelpers.MoqRolePublisher)
+	if err := second.Announce(rejectedNamespace, ""); err != nil {
+		t.Fatalf("ANNOUNCE of %s rejected after the ANNOUNCE error of other session, err: %v", rejectedNamespace, err)
+	}
+}
+
+// Several subscribers of the same track share a single SUBSCRIBE to the publisher and all receive the objects
+func TestFanOut(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	publisher := connectPublisher(t, ctx, relay, "test")
+
+	subscribers := []*moqclient.MoqClient{}
+	subscriberTrackIds := []uint64{}
+	for i := 0; i < 3; i++ {
+		subscriber := connectClient(t, ctx, relay, moqhelpers.MoqRoleSubscriber)
+		subscribed := subscribeAsync(subscriber, "test", "video")
+		if i == 0 {
+			publisher.expectSubscribe(t, ctx, 1)
+		}
+		subscriberTrackIds = append(subscriberTrackIds, waitSubscribed(t, ctx, subscribed))
+		subscribers = append(subscribers, subscriber)
+	}
+	publisher.expectNoMessage(t)
+
+	publisher.sendObjects(t, ctx, 1, 0, 3)
+	for i, subscriber := range subscribers {
+		t.Logf("Subscriber %d", i)
+		checkObjects(t, receiveObjects(t, ctx, subscriber, 3), subscriberTrackIds[i], 0, 3)
+	}
+}
+
+// SUBSCRIBE of a cached track is answered by the relay without waiting for the publisher answer, and it gets the new objects
+func TestSubscribeAnsweredFromCache(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	publisher, first, firstTrackId, _ := connectPublisherSubscriber(t, ctx, relay, 7)
+	publisher.sendObjects(t, ctx, 7, 0, 3)
+	checkObjects(t, receiveObjects(t, ctx, first, 3), firstTrackId, 0, 3)
+	// Last subscriber left, the track is only in the cache
+	first.Close("Done")
+	publisher.expectUnSubscribe(t, ctx)
+
+	subscriber := connectClient(t, ctx, relay, moqhelpers.MoqRoleSubscriber)
+	subscriberTrackId := waitSubscribed(t, ctx, subscribeAsync(subscriber, "test", "video"))
+	// Forwarded anyway, the new objects come from the publisher
+	publisher.expectSubscribe(t, ctx, 7)
+	publisher.sendObjects(t, ctx, 7, 1, 3)
+	checkObjects(t, receiveObjects(t, ctx, subscriber, 3), subscriberTrackId, 1, 3)
+}
+
+// Delayed and fragmented reads / writes (control and objects) in both directions, all the objects arrive
+func TestChaosDelayPartial(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	relay.SetChaos(MoqTestChaosConfig{Ingest: true, Egress: true, MaxDelayMs: 5, PartialWrites: true})
+	publisher, subscriber, subscriberTrackId, _ := connectPublisherSubscriber(t, ctx, relay, 3)
+
+	publisher.sendObjects(t, ctx, 3, 0, 20)
+	checkObjects(t, receiveObjects(t, ctx, subscriber, 20), subscriberTrackId, 0, 20)
+	if stats := relay.GetChaosStats(); stats.Delays == 0 || stats.PartialWrites == 0 {
+		t.Fatalf("Faults NOT injected: %+v", stats)
+	}
+}
+
+// Object streams to the subscriber are reset, it only loses those objects and its session continues
+func TestChaosEgressResets(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	relay.SetChaos(MoqTestChaosConfig{Egress: true, ResetProbability: 0.05})
+	publisher, subscriber, subscriberTrackId, _ := connectPublisherSubscriber(t, ctx, relay, 3)
+
+	publisher.sendObjects(t, ctx, 3, 0, 50)
+	objects, failed := receiveUntilIdle(t, ctx, subscriber)
+	checkObjectsSubset(t, objects, subscriberTrackId, 0, 50)
+	stats := relay.GetChaosStats()
+	if stats.EgressResets == 0 || uint64(failed) != stats.EgressResets || len(objects)+failed != 50 {
+		t.Fatalf("Received %d objects, %d failed, %d streams reset, want 50 in total", len(objects), failed, stats.EgressResets)
+	}
+	if subscriber.Context().Err() != nil {
+		t.Fatalf("Subscriber session closed after stream resets")
+	}
+}
+
+// Object streams from the publisher are reset, the relay drops those objects (aborting the ones being forwarded) and the sessions continue
+func TestChaosIngestResets(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	relay.SetChaos(MoqTestChaosConfig{Ingest: true, ResetProbability: 0.05})
+	publisher, subscriber, subscriberTrackId, _ := connectPublisherSubscriber(t, ctx, relay, 3)
+
+	for i := uint64(0); i < 50; i++ {
+		// Reset streams can fail writing
+		publisher.client.SendObject(ctx, 3, moqobject.MoqObjectHeader{TrackId: 3, ObjectSequence: i}, getTestPayload(0, i))
+	}
+	objects, _ := receiveUntilIdle(t, ctx, subscriber)
+	checkObjectsSubset(t, objects, subscriberTrackId, 0, 50)
+	stats := relay.GetChaosStats()
+	if stats.IngestResets == 0 || uint64(len(objects))+stats.IngestResets != 50 {
+		t.Fatalf("Received %d objects, %d streams reset, want 50 in total", len(objects), stats.IngestResets)
+	}
+	if publisher.client.Context().Err() != nil || subscriber.Context().Err() != nil {
+		t.Fatalf("Session closed after stream resets")
+	}
+}
+
+// Small objects of a group are sent to the subscriber in a single stream, a new group opens a new one
+func TestBatchedSmallObjects(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	relay.SetEgressBatching(TEST_BATCH_MAX_OBJECT_BYTES)
+	publisher, subscriber, subscriberTrackId, subscriberSession := connectPublisherSubscriber(t, ctx, relay, 5)
+
+	for group := uint64(0); group < 2; group++ {
+		publisher.sendObjects(t, ctx, 5, group, 20)
+		checkObjects(t, receiveObjects(t, ctx, subscriber, 20), subscriberTrackId, group, 20)
+		// Control stream + a stream per group
+		if streams := subscriberSession.GetStreamsCount(); streams != group+2 {
+			t.Fatalf("Subscriber session streams %d after group %d, want %d", streams, group, group+2)
+		}
+	}
+}
+
+// An incomplete small object does NOT block the objects of other tracks of the subscriber while it waits to be batched
+func TestBatchedIncompleteObject(t *testing.T) {
+	ctx, relay := newTestRelay(t)
+	relay.SetEgressBatching(TEST_BATCH_MAX_OBJECT_BYTES)
+	publisher, subscriber, videoTrackId, _ := connectPublisherSubscriber(t, ctx, relay, 5)
+	subscribed := subscribeAsync(subscriber, "test", "audio")
+	publisher.expectSubscribe(t, ctx, 6)
+	audioTrackId := waitSubscribed(t, ctx, subscribed)
+
+	// Video object with only its first byte, the rest is sent after the audio objects
+	stream, err := publisher.session.OpenUniStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("Opening video object stream, err: %v", err)
+	}
+	videoObj := moqobject.New(moqobject.MoqObjectHeader{TrackId: 5}, 0, time.Now())
+	videoPayload := getTestPayload(0, 0)
+	videoObj.PayloadWrite(videoPayload[:1])
+	videoSent := make(chan error, 1)
+	go func() {
+		videoSent <- moqhelpers.SendObject(stream, videoObj, 5)
+		stream.Close()
+	}()
+
+	publisher.sendObjects(t, ctx, 6, 0, 5)
+	checkObjects(t, receiveObjects(t, ctx, subscriber, 5), audioTrackId, 0, 5)
+
+	videoObj.PayloadWrite(videoPayload[1:])
+	videoObj.SetEof()
+	if err := <-videoSent; err != nil {
+		t.Fatalf("Sending video object, err: %v", err)
+	}
+	checkObjects(t, receiveObjects(t, ctx, subscriber, 1), videoTrackId, 0, 1)
+}
+
+// Helpers
+
+// newTestRelay New relay (chaos_seed flag) closed at the end of the test, and the test context
+func newTestRelay(t *testing.T) (ctx context.Context, relay *MoqTestRelay) {
+	return newTestRelayWithConfig(t, moqconnectionmanagment.MoqConnectionConfig{})
+}
+
+// newTestRelayWithConfig Same as newTestRelay with connConfig (zero values get the test defaults)
+func newTestRelayWithConfig(t *testing.T, connConfig moqconnectionmanagment.MoqConnectionConfig) (ctx context.Context, relay *MoqTestRelay) {
+	relay = NewRelay(connConfig)
+	relay.ChaosSeed = *chaosSeed
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT_MS*time.Millisecond)
+	t.Cleanup(func() {
+		cancel()
+		relay.Close()
+	})
+	return
+}
+
+func connectClient(t *testing.T, ctx context.Context, relay *MoqTestRelay, role moqhelpers.MoqRole) *moqclient.MoqClient {
+	client, _, err := relay.Connect(ctx, role)
+	if err != nil {
+		t.Fatalf("Connecting %v, err: %v", role, err)
+	}
+	return client
+}
+
+// connectPublisher Connects a publisher and announces trackNamespace
+func connectPublisher(t *testing.T, ctx context.Context, relay *MoqTestRelay, trackNamespace string) *testPublisher {
+	client, session, err := relay.Connect(ctx, moqhelpers.MoqRolePublisher)
+	if err != nil {
+		t.Fatalf("Connecting publisher, err: %v", err)
+	}
+	if err := client.Announce(trackNamespace, ""); err != nil {
+		t.Fatalf("Announcing %s, err: %v", trackNamespace, err)
+	}
+	publisher := &testPublisher{client: client, session: session, control: make(chan interface{}, 64)}
+	go func() {
+		defer close(publisher.control)
+		for {
+			moqMsg, _, errReceive := client.ReceiveControlMessage()
+			if errReceive != nil {
+				return
+			}
+			publisher.control <- moqMsg
+		}
+	}()
+	return publisher
+}
+
+// connectPublisherSubscriber Publisher announces "test", subscriber subscribes to "test/video" and the publisher answers with trackId, returns the track id of the subscriber objects
+func connectPublisherSubscriber(t *testing.T, ctx context.Context, relay *MoqTestRelay, trackId uint64) (publisher *testPublisher, subscriber *moqclient.MoqClient, subscriberTrackId uint64, subscriberSession *MoqTestSession) {
+	publisher = connectPublisher(t, ctx, relay, "test")
+	subscriber, subscriberSession, err := relay.Connect(ctx, moqhelpers.MoqRoleSubscriber)
+	if err != nil {
+		t.Fatalf("Connecting subscriber, err: %v", err)
+	}
+
+	subscribed := subscribeAsync(subscriber, "test", "video")
+	subscribe := publisher.expectSubscribe(t, ctx, trackId)
+	if subscribe.TrackNamespace != "test" || subscribe.TrackName != "video" {
+		t.Fatalf("Publisher SUBSCRIBE of %s/%s, want test/video", subscribe.TrackNamespace, subscribe.TrackName)
+	}
+	subscriberTrackId = waitSubscribed(t, ctx, subscribed)
+	return
+}
+
+// expectSubscribe Waits for the SUBSCRIBE forwarded by the relay and answers it with SUBSCRIBE OK (trackId)
+func (publisher *testPublisher) expectSubscribe(t *testing.T, ctx context.Context, trackId uint64) (subscribe moqhelpers.MoqMessageSubscribe) {
+	var moqMsg interface{}
+	select {
+	case moqMsg = <-publisher.control:
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for SUBSCRIBE")
+	}
+	subscribe, isSubscribe := moqMsg.(moqhelpers.MoqMessageSubscribe)
+	if !isSubscribe {
+		t.Fatalf("Publisher received %T, want SUBSCRIBE", moqMsg)
+	}
+	err := publisher.client.WriteControl(func(stream webtransport.Stream) error {
+		return moqhelpers.SendSubscribeOk(stream, moqhelpers.MoqMessageSubscribeOk{TrackNamespace: subscribe.TrackNamespace, TrackName: subscribe.TrackName, TrackId: trackId})
+	})
+	if err != nil {
+		t.Fatalf("Sending SUBSCRIBE OK, err: %v", err)
+	}
+	return
+}
+
+// expectUnSubscribe Waits for the UNSUBSCRIBE sent by the relay when the last subscriber of the track leaves
+func (publisher *testPublisher) expectUnSubscribe(t *testing.T, ctx context.Context) {
+	select {
+	case moqMsg := <-publisher.control:
+		if _, isUnSubscribe := moqMsg.(moqhelpers.MoqMessageUnSubscribe); !isUnSubscribe {
+			t.Fatalf("Publisher received %T, want UNSUBSCRIBE", moqMsg)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for UNSUBSCRIBE")
+	}
+}
+
+// expectNoMessage Checks that NO control message arrives in TEST_NO_MESSAGE_WAIT_MS
+func (publisher *testPublisher) expectNoMessage(t *testing.T) {
+	select {
+	case moqMsg, ok := <-publisher.control:
+		if ok {
+			t.Fatalf("Publisher received NOT expected %T: %+v", moqMsg, moqMsg)
+		}
+	case <-time.After(TEST_NO_MESSAGE_WAIT_MS * time.Millisecond):
+	}
+}
+
+// sendObjects Sends objects 0 to count-1 of group with payloads "[group]-[object]"
+func (publisher *testPublisher) sendObjects(t *testing.T, ctx context.Context, trackId uint64, group uint64, count uint64) {
+	for i := uint64(0); i < count; i++ {
+		header := moqobject.MoqObjectHeader{TrackId: trackId, GroupSequence: group, ObjectSequence: i}
+		if err := publisher.client.SendObject(ctx, trackId, header, getTestPayload(group, i)); err != nil {
+			t.Fatalf("Sending object %s, err: %v", header.GetDebugStr(), err)
+		}
+	}
+}
+
+type subscribeResult struct {
+	trackId uint64
+	err     error
+}
+
+// subscribeAsync Subscribes in background (SUBSCRIBE OK arrives after the publisher answers), the result is sent to the returned channel
+func subscribeAsync(client *moqclient.MoqClient, trackNamespace string, trackName string) chan subscribeResult {
+	result := make(chan subscribeResult, 1)
+	go func() {
+		trackId, err := client.Subscribe(trackNamespace, trackName, "")
+		result <- subscribeResult{trackId: trackId, err: err}
+	}()
+	return result
+}
+
+func waitSubscribed(t *testing.T, ctx context.Context, subscribed chan subscribeResult) uint64 {
+	select {
+	case result := <-subscribed:
+		if result.err != nil {
+			t.Fatalf("Subscribing, err: %v", result.err)
+		}
+		return result.trackId
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for SUBSCRIBE OK")
+	}
+	return 0
+}
+
+// receiveObjects Receives count objects, any error fails the test
+func receiveObjects(t *testing.T, ctx context.Context, client *moqclient.MoqClient, count int) (objects []testObject) {
+	for len(objects) < count {
+		header, payload, err := client.ReceiveObject(ctx)
+		if err != nil {
+			t.Fatalf("Received %d of %d objects, err: %v", len(objects), count, err)
+		}
+		objects = append(objects, testObject{header: header, payload: payload})
+	}
+	return
+}
+
+// receiveUntilIdle Receives objects until none arrives in TEST_RECEIVE_IDLE_MS, objects with errors (ex: reset streams) are counted as failed
+func receiveUntilIdle(t *testing.T, ctx context.Context, client *moqclient.MoqClient) (objects []testObject, failed int) {
+	for {
+		receiveCtx, cancel := context.WithTimeout(ctx, TEST_RECEIVE_IDLE_MS*time.Millisecond)
+		header, payload, err := client.ReceiveObject(receiveCtx)
+		idle := receiveCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			t.Fatalf("Received %d objects (%d failed), err: %v", len(objects), failed, ctx.Err())
+		}
+		if err != nil && idle {
+			return
+		}
+		if err != nil {
+			failed++
+			continue
+		}
+		objects = append(objects, testObject{header: header, payload: payload})
+	}
+}
+
+// checkObjects Objects (in any order) are exactly 0 to count-1 of group
+func checkObjects(t *testing.T, objects []testObject, trackId uint64, group uint64, count uint64) {
+	objectSequences := checkObjectsSubset(t, objects, trackId, group, count)
+	if uint64(len(objectSequences)) != count {
+		t.Fatalf("Received objects %v, want 0 to %d", objectSequences, count-1)
+	}
+}
+
+// checkObjectsSubset Objects (in any order) are of trackId and group, NOT repeated, under count and with their "[group]-[object]" payload, returns their sorted sequences
+func checkObjectsSubset(t *testing.T, objects []testObject, trackId uint64, group uint64, count uint64) (objectSequences []uint64) {
+	received := map[uint64]bool{}
+	for _, object := range objects {
+		header := object.header
+		if header.TrackId != trackId || header.GroupSequence != group || header.ObjectSequence >= count {
+			t.Fatalf("Received object %s, want track %d group %d objects 0 to %d", header.GetDebugStr(), trackId, group, count-1)
+		}
+		if want := string(getTestPayload(header.GroupSequence, header.ObjectSequence)); string(object.payload) != want {
+			t.Fatalf("Object %s payload %q, want %q", header.GetDebugStr(), object.payload, want)
+		}
+		if received[header.ObjectSequence] {
+			t.Fatalf("Object %s received twice", header.GetDebugStr())
+		}
+		received[header.ObjectSequence] = true
+		objectSequences = append(objectSequences, header.ObjectSequence)
+	}
+	sort.Slice(objectSequences, func(i, j int) bool { return objectSequences[i] < objectSequences[j] })
+	return
+}
+
+func getTestPayload(group uint64, object uint64) []byte {
+	return []byte(fmt.Sprintf("%d-%d", group, object))
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqtest
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+// Streams opened by the peer and NOT accepted yet, opening blocks when full
+const TEST_SESSION_ACCEPT_QUEUE_SIZE = 1024
+
+// moqTestConn State shared by the 2 sessions of a pair (closing one closes both, as QUIC does)
+type moqTestConn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Protected
+	pipes     []*moqTestPipe
+	closed    bool
+	closeErr  webtransport.ConnectionError
+	closedBy  string
+	streamIds quic.StreamID
+	lock      *sync.Mutex
+}
+
+// MoqTestSession In-memory session, implements the transport session of the relay (moqconnectionmanagment) and of the clients (moqclient)
+type MoqTestSession struct {
+	name       string
+	conn       *moqTestConn
+	remoteAddr net.Addr
+	peer       *MoqTestSession
+	// Faults injected in the streams of this side (nil none)
+	chaos *moqTestChaos
+
+	acceptStreams    chan webtransport.Stream
+	acceptUniStreams chan webtransport.ReceiveStream
+}
+
+// NewSessionPair Creates the client and relay sides of an in-memory session
+func NewSessionPair(ctx context.Context, clientName string) (client *MoqTestSession, relay *MoqTestSession) {
+	connCtx, cancel := context.WithCancel(ctx)
+	conn := &moqTestConn{ctx: connCtx, cancel: cancel, pipes: []*moqTestPipe{}, lock: new(sync.Mutex)}
+
+	client = newSession("client", conn, &net.UnixAddr{Name: "relay", Net: "memory"})
+	relay = newSession("relay", conn, &net.UnixAddr{Name: clientName, Net: "memory"})
+	client.peer = relay
+	relay.peer = client
+
+	// Parent context done (ex: relay closed) closes the session
+	go func() {
+		<-connCtx.Done()
+		conn.close(0, "Context canceled", "")
+	}()
+	return
+}
+
+func newSession(name string, conn *moqTestConn, remoteAddr net.Addr) *MoqTestSession {
+	return &MoqTestSession{name: name, conn: conn, remoteAddr: remoteAddr, acceptStreams: make(chan webtransport.Stream, TEST_SESSION_ACCEPT_QUEUE_SIZE), acceptUniStreams: make(chan webtransport.ReceiveStream, TEST_SESSION_ACCEPT_QUEUE_SIZE)}
+}
+
+// Context Done when the session is closed (by any side)
+func (s *MoqTestSession) Context() context.Context {
+	return s.conn.ctx
+}
+
+func (s *MoqTestSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *MoqTestSession) OpenStream() (webtransport.Stream, error) {
+	return s.OpenStreamSync(s.conn.ctx)
+}
+
+// OpenStreamSync Opens a bidirectional stream, the peer accepts it
+func (s *MoqTestSession) OpenStreamSync(ctx context.Context) (stream webtransport.Stream, err error) {
+	id, pipes, errOpen := s.conn.newPipes(2)
+	if errOpen != nil {
+		err = errOpen
+		return
+	}
+	local := &moqTestStream{moqTestSendStream{id: id, pipe: pipes[0]}, moqTestReceiveStream{id: id, pipe: pipes[1]}}
+	remote := &moqTestStream{moqTestSendStream{id: id, pipe: pipes[1]}, moqTestReceiveStream{id: id, pipe: pipes[0]}}
+	select {
+	case s.peer.acceptStreams <- remote:
+		stream = s.chaos.wrapStream(local)
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.conn.ctx.Done():
+		err = s.conn.ctx.Err()
+	}
+	return
+}
+
+// OpenUniStreamSync Opens a unidirectional stream, the peer accepts it
+func (s *MoqTestSession) OpenUniStreamSync(ctx context.Context) (stream webtransport.SendStream, err error) {
+	id, pipes, errOpen := s.conn.newPipes(1)
+	if errOpen != nil {
+		err = errOpen
+		return
+	}
+	select {
+	case s.peer.acceptUniStreams <- &moqTestReceiveStream{id: id, pipe: pipes[0]}:
+		stream = s.chaos.wrapSendStream(&moqTestSendStream{id: id, pipe: pipes[0]})
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.conn.ctx.Done():
+		err = s.conn.ctx.Err()
+	}
+	return
+}
+
+func (s *MoqTestSession) AcceptStream(ctx context.Context) (stream webtransport.Stream, err error) {
+	select {
+	case stream = <-s.acceptStreams:
+		stream = s.chaos.wrapStream(stream)
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.conn.ctx.Done():
+		err = s.conn.ctx.Err()
+	}
+	return
+}
+
+func (s *MoqTestSession) AcceptUniStream(ctx context.Context) (stream webtransport.ReceiveStream, err error) {
+	select {
+	case stream = <-s.acceptUniStreams:
+		stream = s.chaos.wrapReceiveStream(stream)
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.conn.ctx.Done():
+		err = s.conn.ctx.Err()
+	}
+	return
+}
+
+// CloseWithError Closes the session (both sides), the streams return the error, only the first close is kept
+func (s *MoqTestSession) CloseWithError(code webtransport.SessionErrorCode, msg string) error {
+	s.conn.close(code, msg, s.name)
+	return nil
+}
+
+// GetCloseError Returns who closed the session ("client" / "relay") and its error, closed false if it is open
+func (s *MoqTestSession) GetCloseError() (closed bool, closedBy string, closeErr webtransport.ConnectionError) {
+	s.conn.lock.Lock()
+	defer s.conn.lock.Unlock()
+
+	return s.conn.closed, s.conn.closedBy, s.conn.closeErr
+}
+
+// GetStreamsCount Returns the streams opened by both sides
+func (s *MoqTestSession) GetStreamsCount() uint64 {
+	s.conn.lock.Lock()
+	defer s.conn.lock.Unlock()
+
+	return uint64(s.conn.streamIds)
+}
+
+// Helpers
+
+func (conn *moqTestConn) close(code webtransport.SessionErrorCode, msg string, closedBy string) {
+	conn.lock.Lock()
+	if conn.closed {
+		conn.lock.Unlock()
+		return
+	}
+	conn.closed = true
+	conn.closeErr = webtransport.ConnectionError{ErrorCode: code, Message: msg}
+	conn.closedBy = closedBy
+	pipes := conn.pipes
+	conn.pipes = nil
+	conn.lock.Unlock()
+
+	for _, pipe := range pipes {
+		pipe.cancel(&webtransport.ConnectionError{ErrorCode: code, Message: msg})
+	}
+	conn.cancel()
+}
+
+func (conn *moqTestConn) newPipes(n int) (id quic.StreamID, pipes []*moqTestPipe, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.closed {
+		err = conn.ctx.Err()
+		if err == nil {
+			err = context.Canceled
+		}
+		return
+	}
+	conn.streamIds++
+	id = conn.streamIds
+	pipes = make([]*moqTestPipe, n)
+	for i := range pipes {
+		pipes[i] = newPipe()
+	}
+	conn.pipes = append(conn.pipes, pipes...)
+	return
+}
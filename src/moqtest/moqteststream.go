@@ -0,0 +1,181 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqtest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+// moqTestPipe In-memory unidirectional byte stream, writes never block (unlimited flow control window)
+type moqTestPipe struct {
+	// Protected
+	data []byte
+	// Writer finished, reads return io.EOF after the data
+	finished bool
+	// Canceled (stream / session), reads and writes return it
+	err          error
+	readDeadline time.Time
+	lock         *sync.Mutex
+	cond         *sync.Cond
+}
+
+func newPipe() *moqTestPipe {
+	pipe := &moqTestPipe{data: []byte{}, lock: new(sync.Mutex)}
+	pipe.cond = sync.NewCond(pipe.lock)
+	return pipe
+}
+
+func (pipe *moqTestPipe) write(p []byte) (n int, err error) {
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
+
+	if pipe.err != nil {
+		err = pipe.err
+		return
+	}
+	if pipe.finished {
+		err = errors.New("write on closed stream")
+		return
+	}
+	pipe.data = append(pipe.data, p...)
+	n = len(p)
+	pipe.cond.Broadcast()
+	return
+}
+
+func (pipe *moqTestPipe) read(p []byte) (n int, err error) {
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
+
+	for {
+		if pipe.err != nil {
+			err = pipe.err
+			return
+		}
+		if len(pipe.data) > 0 {
+			n = copy(p, pipe.data)
+			pipe.data = pipe.data[n:]
+			return
+		}
+		if pipe.finished {
+			err = io.EOF
+			return
+		}
+		if !pipe.readDeadline.IsZero() && !time.Now().Before(pipe.readDeadline) {
+			err = os.ErrDeadlineExceeded
+			return
+		}
+		pipe.cond.Wait()
+	}
+}
+
+func (pipe *moqTestPipe) finish() {
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
+
+	pipe.finished = true
+	pipe.cond.Broadcast()
+}
+
+// cancel Makes the pending and next reads / writes return err (the first cancel error is kept)
+func (pipe *moqTestPipe) cancel(err error) {
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
+
+	if pipe.err == nil {
+		pipe.err = err
+	}
+	pipe.cond.Broadcast()
+}
+
+func (pipe *moqTestPipe) setReadDeadline(deadline time.Time) {
+	pipe.lock.Lock()
+	pipe.readDeadline = deadline
+	pipe.cond.Broadcast()
+	pipe.lock.Unlock()
+
+	if !deadline.IsZero() {
+		// Wake up the reader when it expires
+		time.AfterFunc(time.Until(deadline), func() {
+			pipe.lock.Lock()
+			defer pipe.lock.Unlock()
+			pipe.cond.Broadcast()
+		})
+	}
+}
+
+// moqTestSendStream Write side of a pipe (webtransport.SendStream)
+type moqTestSendStream struct {
+	id   quic.StreamID
+	pipe *moqTestPipe
+}
+
+func (s *moqTestSendStream) Write(p []byte) (int, error) {
+	return s.pipe.write(p)
+}
+
+func (s *moqTestSendStream) Close() error {
+	s.pipe.finish()
+	return nil
+}
+
+func (s *moqTestSendStream) StreamID() quic.StreamID {
+	return s.id
+}
+
+func (s *moqTestSendStream) CancelWrite(code webtransport.StreamErrorCode) {
+	s.pipe.cancel(&webtransport.StreamError{ErrorCode: code})
+}
+
+func (s *moqTestSendStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// moqTestReceiveStream Read side of a pipe (webtransport.ReceiveStream)
+type moqTestReceiveStream struct {
+	id   quic.StreamID
+	pipe *moqTestPipe
+}
+
+func (s *moqTestReceiveStream) Read(p []byte) (int, error) {
+	return s.pipe.read(p)
+}
+
+func (s *moqTestReceiveStream) StreamID() quic.StreamID {
+	return s.id
+}
+
+func (s *moqTestReceiveStream) CancelRead(code webtransport.StreamErrorCode) {
+	s.pipe.cancel(&webtransport.StreamError{ErrorCode: code})
+}
+
+func (s *moqTestReceiveStream) SetReadDeadline(t time.Time) error {
+	s.pipe.setReadDeadline(t)
+	return nil
+}
+
+// moqTestStream Bidirectional stream, a pipe per direction (webtransport.Stream)
+type moqTestStream struct {
+	moqTestSendStream
+	moqTestReceiveStream
+}
+
+func (s *moqTestStream) StreamID() quic.StreamID {
+	return s.moqTestSendStream.id
+}
+
+func (s *moqTestStream) SetDeadline(t time.Time) error {
+	s.SetWriteDeadline(t)
+	return s.SetReadDeadline(t)
+}
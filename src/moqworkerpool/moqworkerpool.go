@@ -0,0 +1,92 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqworkerpool
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type MoqWorkerPoolStats struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+	// Tasks waiting for a worker
+	Queued int `json:"queued"`
+	// Workers running a task
+	Busy int `json:"busy"`
+	// Tasks accepted / rejected (queue full) since the start
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// MoqWorkerPool Runs tasks in a fixed number of goroutines, tasks wait in a bounded queue and are rejected when it is full
+type MoqWorkerPool struct {
+	workers int
+	tasks   chan func()
+	stop    chan bool
+
+	busy     atomic.Int64
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+
+	stopOnce *sync.Once
+}
+
+// New Starts workers goroutines, up to queueSize tasks can wait for them
+func New(workers int, queueSize int) *MoqWorkerPool {
+	p := &MoqWorkerPool{workers: workers, tasks: make(chan func(), queueSize), stop: make(chan bool), stopOnce: new(sync.Once)}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Submit Queues the task, returns false (task NOT run) if the queue is full. A nil pool runs every task in its own goroutine
+func (p *MoqWorkerPool) Submit(task func()) bool {
+	if p == nil {
+		go task()
+		return true
+	}
+	select {
+	case p.tasks <- task:
+		p.accepted.Add(1)
+		return true
+	default:
+		p.rejected.Add(1)
+		return false
+	}
+}
+
+func (p *MoqWorkerPool) GetStats() MoqWorkerPoolStats {
+	if p == nil {
+		return MoqWorkerPoolStats{}
+	}
+	return MoqWorkerPoolStats{Workers: p.workers, QueueSize: cap(p.tasks), Queued: len(p.tasks), Busy: int(p.busy.Load()), Accepted: p.accepted.Load(), Rejected: p.rejected.Load()}
+}
+
+// Stop Workers exit after their current task, the queued tasks are NOT run
+func (p *MoqWorkerPool) Stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *MoqWorkerPool) worker() {
+	for {
+		select {
+		case task := <-p.tasks:
+			p.busy.Add(1)
+			task()
+			p.busy.Add(-1)
+		case <-p.stop:
+			return
+		}
+	}
+}